@@ -7,7 +7,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -22,6 +24,7 @@ import (
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/route"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/thanos-io/thanos/pkg/block"
@@ -52,6 +55,7 @@ var (
 		verifier.IndexIssueID:                verifier.IndexIssue,
 		verifier.OverlappedBlocksIssueID:     verifier.OverlappedBlocksIssue,
 		verifier.DuplicatedCompactionIssueID: verifier.DuplicatedCompactionIssue,
+		verifier.MetaStatsIssueID:            verifier.MetaStatsIssue,
 	}
 	allIssues = func() (s []string) {
 		for id := range issuesMap {
@@ -74,6 +78,7 @@ func registerBucket(m map[string]setupFunc, app *kingpin.Application, name strin
 	registerBucketWeb(m, cmd, name, objStoreConfig)
 	registerBucketReplicate(m, cmd, name, objStoreConfig)
 	registerBucketDownsample(m, cmd, name, objStoreConfig)
+	registerBucketRelabel(m, cmd, name, objStoreConfig)
 }
 
 func registerBucketVerify(m map[string]setupFunc, root *kingpin.CmdClause, name string, objStoreConfig *extflag.PathOrContent) {
@@ -176,7 +181,7 @@ func registerBucketVerify(m map[string]setupFunc, root *kingpin.CmdClause, name
 
 func registerBucketLs(m map[string]setupFunc, root *kingpin.CmdClause, name string, objStoreConfig *extflag.PathOrContent) {
 	cmd := root.Command("ls", "List all blocks in the bucket")
-	output := cmd.Flag("output", "Optional format in which to print each block's information. Options are 'json', 'wide' or a custom template.").
+	output := cmd.Flag("output", "Optional format in which to print each block's information. Options are 'json', printing the meta.json of each block, 'summary', printing the same JSON array of block summaries as the inspect command, 'wide' or a custom template.").
 		Short('o').Default("").String()
 	m[name+" ls"] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer, _ <-chan struct{}, _ bool) error {
 		confContentYaml, err := objStoreConfig.Content()
@@ -233,6 +238,9 @@ func registerBucketLs(m map[string]setupFunc, root *kingpin.CmdClause, name stri
 			printBlock = func(m *metadata.Meta) error {
 				return enc.Encode(&m)
 			}
+		case "summary":
+			// The summaries are printed as a whole once all blocks are collected.
+			printBlock = func(*metadata.Meta) error { return nil }
 		default:
 			tmpl, err := template.New("").Parse(format)
 			if err != nil {
@@ -252,11 +260,18 @@ func registerBucketLs(m map[string]setupFunc, root *kingpin.CmdClause, name stri
 			return err
 		}
 
+		blockMetas := make([]*metadata.Meta, 0, len(metas))
 		for _, meta := range metas {
 			objects++
 			if err := printBlock(meta); err != nil {
 				return errors.Wrap(err, "iter")
 			}
+			blockMetas = append(blockMetas, meta)
+		}
+		if format == "summary" {
+			if err := printJSON(ctx, logger, bkt, os.Stdout, blockMetas, nil); err != nil {
+				return err
+			}
 		}
 		level.Info(logger).Log("msg", "ls done", "objects", objects)
 		return nil
@@ -270,6 +285,8 @@ func registerBucketInspect(m map[string]setupFunc, root *kingpin.CmdClause, name
 	sortBy := cmd.Flag("sort-by", "Sort by columns. It's also possible to sort by multiple columns, e.g. '--sort-by FROM --sort-by UNTIL'. I.e., if the 'FROM' value is equal the rows are then further sorted by the 'UNTIL' value.").
 		Default("FROM", "UNTIL").Enums(inspectColumns...)
 	timeout := cmd.Flag("timeout", "Timeout to download metadata from remote storage").Default("5m").Duration()
+	output := cmd.Flag("output", "Format in which to print the blocks. Options are 'table' or 'json', printing a JSON summary of each block, including its deletion mark.").
+		Short('o').Default("table").Enum("table", "json")
 
 	m[name+" inspect"] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer, _ <-chan struct{}, _ bool) error {
 
@@ -313,6 +330,9 @@ func registerBucketInspect(m map[string]setupFunc, root *kingpin.CmdClause, name
 			blockMetas = append(blockMetas, meta)
 		}
 
+		if *output == "json" {
+			return printJSON(ctx, logger, bkt, os.Stdout, blockMetas, selectorLabels)
+		}
 		return printTable(blockMetas, selectorLabels, *sortBy)
 	}
 }
@@ -462,8 +482,114 @@ func registerBucketDownsample(m map[string]setupFunc, root *kingpin.CmdClause, n
 	dataDir := cmd.Flag("data-dir", "Data directory in which to cache blocks and process downsamplings.").
 		Default("./data").String()
 
+	resolutions := regDownsampleResolutionFlags(cmd)
+
 	m[name+" "+comp.String()] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, _ <-chan struct{}, _ bool) error {
-		return RunDownsample(g, logger, reg, *httpAddr, time.Duration(*httpGracePeriod), *dataDir, objStoreConfig, comp)
+		levels, err := downsample.NewLevels(*resolutions)
+		if err != nil {
+			return errors.Wrap(err, "parse downsampling resolutions")
+		}
+		return RunDownsample(g, logger, reg, *httpAddr, time.Duration(*httpGracePeriod), *dataDir, objStoreConfig, comp, levels)
+	}
+}
+
+func registerBucketRelabel(m map[string]setupFunc, root *kingpin.CmdClause, name string, objStoreConfig *extflag.PathOrContent) {
+	cmd := root.Command("relabel", "Replace blocks in the bucket with blocks whose external labels and, optionally, series labels are relabeled. Replaced blocks are marked for deletion. Relabeling blocks again with the same configuration is a no-op.")
+	ids := cmd.Flag("id", "Block IDs to relabel only. If none is specified, all blocks will be relabeled. Repeated field").Strings()
+	dataDir := cmd.Flag("data-dir", "Data directory in which to cache blocks and process relabelings.").
+		Default("./data").String()
+	extRelabelConf := extflag.RegisterPathOrContent(cmd, "external-labels.relabel-config",
+		"YAML file that contains relabeling configuration applied to the external labels of blocks. It follows native Prometheus relabel-config syntax. "+
+			"See format details: https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config ",
+		false)
+	seriesRelabelConf := extflag.RegisterPathOrContent(cmd, "series.relabel-config",
+		"YAML file that contains relabeling configuration applied to the labels of the series of blocks, without their external labels. It follows native Prometheus relabel-config syntax. "+
+			"Series dropped by it are removed from the blocks. See format details: https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config ",
+		false)
+	m[name+" relabel"] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer, _ <-chan struct{}, _ bool) error {
+		extRelabelContentYaml, err := extRelabelConf.Content()
+		if err != nil {
+			return errors.Wrap(err, "get content of external labels relabel configuration")
+		}
+		extRelabelConfig, err := parseRelabelConfig(extRelabelContentYaml)
+		if err != nil {
+			return err
+		}
+		seriesRelabelContentYaml, err := seriesRelabelConf.Content()
+		if err != nil {
+			return errors.Wrap(err, "get content of series relabel configuration")
+		}
+		seriesRelabelConfig, err := parseRelabelConfig(seriesRelabelContentYaml)
+		if err != nil {
+			return err
+		}
+		if len(extRelabelConfig) == 0 && len(seriesRelabelConfig) == 0 {
+			return errors.New("no relabel configuration specified")
+		}
+
+		relabelIDs := map[ulid.ULID]struct{}{}
+		for _, bid := range *ids {
+			id, err := ulid.Parse(bid)
+			if err != nil {
+				return errors.Wrap(err, "invalid ULID found in --id flag")
+			}
+			relabelIDs[id] = struct{}{}
+		}
+
+		confContentYaml, err := objStoreConfig.Content()
+		if err != nil {
+			return err
+		}
+
+		bkt, err := client.NewBucket(logger, confContentYaml, reg, name)
+		if err != nil {
+			return err
+		}
+		defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+
+		// Dummy actor to immediately kill the group after the run function returns.
+		g.Add(func() error { return nil }, func(error) {})
+
+		// Blocks already marked for deletion were replaced before and must not be relabeled again.
+		fetcher, err := block.NewMetaFetcher(logger, fetcherConcurrency, bkt, "", extprom.WrapRegistererWithPrefix(extpromPrefix, reg), []block.MetadataFilter{
+			block.NewIgnoreDeletionMarkFilter(logger, bkt, 0),
+		}, nil)
+		if err != nil {
+			return err
+		}
+
+		blocksMarkedForDeletion := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: extpromPrefix + "blocks_marked_for_deletion_total",
+			Help: "Total number of blocks marked for deletion after being relabeled.",
+		})
+
+		ctx := context.Background()
+		metas, _, err := fetcher.Fetch(ctx)
+		if err != nil {
+			return err
+		}
+
+		var replaced int
+		for id, meta := range metas {
+			if len(relabelIDs) > 0 {
+				if _, ok := relabelIDs[id]; !ok {
+					continue
+				}
+			}
+
+			resid, ok, err := compact.RelabelBlock(ctx, logger, bkt, filepath.Join(*dataDir, id.String()), meta, extRelabelConfig, seriesRelabelConfig, blocksMarkedForDeletion)
+			if err != nil {
+				return errors.Wrapf(err, "relabel block %s", id)
+			}
+			if !ok {
+				level.Info(logger).Log("msg", "labels of block unchanged, skipping", "id", id)
+				continue
+			}
+			level.Info(logger).Log("msg", "relabeled block", "id", id, "newID", resid)
+			replaced++
+		}
+		level.Info(logger).Log("msg", "relabeling done", "replaced", replaced)
+		return nil
 	}
 }
 
@@ -481,7 +607,7 @@ func printTable(blockMetas []*metadata.Meta, selectorLabels labels.Labels, sortB
 		timeRange := time.Duration((blockMeta.MaxTime - blockMeta.MinTime) * int64(time.Millisecond))
 
 		untilDown := "-"
-		if until, err := compact.UntilNextDownsampling(blockMeta); err == nil {
+		if until, err := compact.UntilNextDownsampling(blockMeta, downsample.DefaultLevels); err == nil {
 			untilDown = until.String()
 		}
 		var labels []string
@@ -531,6 +657,85 @@ func printTable(blockMetas []*metadata.Meta, selectorLabels labels.Labels, sortB
 	return nil
 }
 
+// blockSummary is the JSON summary of a block printed by the bucket inspect and ls commands. Its fields are kept
+// stable, so that it can be processed by other tools.
+type blockSummary struct {
+	ULID            string            `json:"ulid"`
+	MinTime         int64             `json:"minTime"`
+	MaxTime         int64             `json:"maxTime"`
+	Resolution      int64             `json:"resolution"`
+	CompactionLevel int               `json:"compactionLevel"`
+	NumSeries       uint64            `json:"numSeries"`
+	NumSamples      uint64            `json:"numSamples"`
+	NumChunks       uint64            `json:"numChunks"`
+	Labels          map[string]string `json:"labels"`
+	Source          string            `json:"source"`
+	// DeletionTime is the unix timestamp of the deletion mark of the block, or null if it is not marked for deletion.
+	DeletionTime *int64 `json:"deletionTime"`
+}
+
+func newBlockSummary(m *metadata.Meta, mark *metadata.DeletionMark) blockSummary {
+	s := blockSummary{
+		ULID:            m.ULID.String(),
+		MinTime:         m.MinTime,
+		MaxTime:         m.MaxTime,
+		Resolution:      m.Thanos.Downsample.Resolution,
+		CompactionLevel: m.Compaction.Level,
+		NumSeries:       m.Stats.NumSeries,
+		NumSamples:      m.Stats.NumSamples,
+		NumChunks:       m.Stats.NumChunks,
+		Labels:          m.Thanos.Labels,
+		Source:          string(m.Thanos.Source),
+	}
+	if s.Labels == nil {
+		s.Labels = map[string]string{}
+	}
+	if mark != nil {
+		s.DeletionTime = &mark.DeletionTime
+	}
+	return s
+}
+
+// readDeletionMark returns the deletion mark of the given block, or nil if it is not marked for deletion.
+func readDeletionMark(ctx context.Context, logger log.Logger, bkt objstore.BucketReader, id ulid.ULID) (*metadata.DeletionMark, error) {
+	mark, err := metadata.ReadDeletionMark(ctx, bkt, logger, id.String())
+	if err == metadata.ErrorDeletionMarkNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "read deletion mark of block %s", id)
+	}
+	return mark, nil
+}
+
+// printJSON prints a JSON array of the summaries of the blocks matching the selector, sorted by time range.
+func printJSON(ctx context.Context, logger log.Logger, bkt objstore.BucketReader, w io.Writer, blockMetas []*metadata.Meta, selectorLabels labels.Labels) error {
+	summaries := []blockSummary{}
+	for _, m := range blockMetas {
+		if !matchesSelector(m, selectorLabels) {
+			continue
+		}
+		mark, err := readDeletionMark(ctx, logger, bkt, m.ULID)
+		if err != nil {
+			return err
+		}
+		summaries = append(summaries, newBlockSummary(m, mark))
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].MinTime != summaries[j].MinTime {
+			return summaries[i].MinTime < summaries[j].MinTime
+		}
+		if summaries[i].MaxTime != summaries[j].MaxTime {
+			return summaries[i].MaxTime < summaries[j].MaxTime
+		}
+		return summaries[i].ULID < summaries[j].ULID
+	})
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(summaries)
+}
+
 func getKeysAlphabetically(labels map[string]string) []string {
 	var keys []string
 	for k := range labels {
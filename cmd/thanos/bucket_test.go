@@ -0,0 +1,97 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func Test_printJSON(t *testing.T) {
+	ctx := context.Background()
+	bkt := inmem.NewBucket()
+
+	newMeta := func(id string, minTime, maxTime int64, lset map[string]string) *metadata.Meta {
+		return &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{
+				ULID:       ulid.MustParse(id),
+				MinTime:    minTime,
+				MaxTime:    maxTime,
+				Stats:      tsdb.BlockStats{NumSeries: 10, NumSamples: 1200, NumChunks: 20},
+				Compaction: tsdb.BlockMetaCompaction{Level: 2},
+			},
+			Thanos: metadata.Thanos{
+				Labels:     lset,
+				Downsample: metadata.ThanosDownsample{Resolution: 300000},
+				Source:     metadata.CompactorSource,
+			},
+		}
+	}
+	metas := []*metadata.Meta{
+		newMeta("01DTVP434PA9VFXSW2JKB3392D", 7200000, 14400000, map[string]string{"cluster": "a"}),
+		newMeta("01DTVP434PA9VFXSW2JKB3392E", 0, 7200000, map[string]string{"cluster": "a"}),
+		newMeta("01DTVP434PA9VFXSW2JKB3392F", 0, 7200000, map[string]string{"cluster": "b"}),
+	}
+	testutil.Ok(t, bkt.Upload(ctx, path.Join("01DTVP434PA9VFXSW2JKB3392D", metadata.DeletionMarkFilename),
+		strings.NewReader(`{"id":"01DTVP434PA9VFXSW2JKB3392D","deletion_time":1590000000,"version":1}`)))
+
+	var b bytes.Buffer
+	testutil.Ok(t, printJSON(ctx, log.NewNopLogger(), bkt, &b, metas, labels.FromStrings("cluster", "a")))
+	testutil.Equals(t, `[
+	{
+		"ulid": "01DTVP434PA9VFXSW2JKB3392E",
+		"minTime": 0,
+		"maxTime": 7200000,
+		"resolution": 300000,
+		"compactionLevel": 2,
+		"numSeries": 10,
+		"numSamples": 1200,
+		"numChunks": 20,
+		"labels": {
+			"cluster": "a"
+		},
+		"source": "compactor",
+		"deletionTime": null
+	},
+	{
+		"ulid": "01DTVP434PA9VFXSW2JKB3392D",
+		"minTime": 7200000,
+		"maxTime": 14400000,
+		"resolution": 300000,
+		"compactionLevel": 2,
+		"numSeries": 10,
+		"numSamples": 1200,
+		"numChunks": 20,
+		"labels": {
+			"cluster": "a"
+		},
+		"source": "compactor",
+		"deletionTime": 1590000000
+	}
+]
+`, b.String())
+
+	// Blocks without labels and an empty selection are printed as empty objects and arrays rather than null.
+	b.Reset()
+	testutil.Ok(t, printJSON(ctx, log.NewNopLogger(), bkt, &b, []*metadata.Meta{newMeta("01DTVP434PA9VFXSW2JKB3392F", 0, 1, nil)}, nil))
+	var summaries []map[string]interface{}
+	testutil.Ok(t, json.Unmarshal(b.Bytes(), &summaries))
+	testutil.Equals(t, map[string]interface{}{}, summaries[0]["labels"])
+
+	b.Reset()
+	testutil.Ok(t, printJSON(ctx, log.NewNopLogger(), bkt, &b, metas, labels.FromStrings("cluster", "c")))
+	testutil.Equals(t, "[]\n", b.String())
+}
@@ -6,6 +6,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"os"
 	"path"
 	"path/filepath"
@@ -78,6 +79,20 @@ func (cs compactionSet) levels(maxLevel int) ([]int64, error) {
 	return levels, nil
 }
 
+// levelFor returns the highest compaction level whose blocks span at most the given time range.
+func (cs compactionSet) levelFor(maxRange time.Duration) (int, error) {
+	if maxRange < cs[0] {
+		return 0, errors.Errorf("time range %s is shorter than the lowest compaction level of %s", maxRange, cs[0])
+	}
+	level := 0
+	for i, c := range cs {
+		if c <= maxRange {
+			level = i
+		}
+	}
+	return level, nil
+}
+
 // maxLevel returns max available compaction level.
 func (cs compactionSet) maxLevel() int {
 	return len(cs) - 1
@@ -113,6 +128,10 @@ func registerCompact(m map[string]setupFunc, app *kingpin.Application) {
 	waitInterval := cmd.Flag("wait-interval", "Wait interval between consecutive compaction runs and bucket refreshes. Only works when --wait flag specified.").
 		Default("5m").Duration()
 
+	waitIntervalJitter := cmd.Flag("wait-interval-jitter", "Maximum random delay added to the wait interval before every compaction run, "+
+		"which spreads the bucket operations of compactor replicas started at the same time. Only works when --wait flag specified.").
+		Default("0s").Duration()
+
 	generateMissingIndexCacheFiles := cmd.Flag("index.generate-missing-cache-file", "If enabled, on startup compactor runs an on-off job that scans all the blocks to find all blocks with missing index cache file. It generates those if needed and upload.").
 		Hidden().Default("false").Bool()
 
@@ -120,15 +139,81 @@ func registerCompact(m map[string]setupFunc, app *kingpin.Application) {
 		"as querying long time ranges without non-downsampled data is not efficient and useful e.g it is not possible to render all samples for a human eye anyway").
 		Default("false").Bool()
 
+	downsamplingResolutions := regDownsampleResolutionFlags(cmd)
+
 	maxCompactionLevel := cmd.Flag("debug.max-compaction-level", fmt.Sprintf("Maximum compaction level, default is %d: %s", compactions.maxLevel(), compactions.String())).
 		Hidden().Default(strconv.Itoa(compactions.maxLevel())).Int()
 
+	maxBlockDuration := modelDuration(cmd.Flag("compact.max-block-duration", fmt.Sprintf("Maximum time range of the blocks produced by compactions. Blocks are not merged beyond the highest compaction level "+
+		"whose blocks span at most this time range, keeping blocks small enough to download and compact again. The compaction levels are %s. 0s does not cap the compaction levels.", compactions.String())).
+		Default("0s"))
+
 	blockSyncConcurrency := cmd.Flag("block-sync-concurrency", "Number of goroutines to use when syncing block metadata from object storage.").
 		Default("20").Int()
 
 	compactionConcurrency := cmd.Flag("compact.concurrency", "Number of goroutines to use when compacting groups.").
 		Default("1").Int()
 
+	enableCheckpoints := cmd.Flag("compact.enable-checkpoints", "If true, the downloaded source blocks and the written compacted block of every group compaction are checkpointed in the data directory. "+
+		"A compaction interrupted by a failure or restart then skips re-downloading its checkpointed source blocks, and skips re-compacting them if the compacted block was written before. "+
+		"An interrupted merge of series is not checkpointed and restarts from the beginning. "+
+		"Checkpoints are discarded if the source blocks of the compaction changed in the meantime.").
+		Default("false").Bool()
+
+	diskBudget := cmd.Flag("compact.disk-budget", "Maximum disk space used by the compactions running concurrently in the data directory. "+
+		"The disk usage of a group compaction is estimated as twice the size of its source blocks in the bucket. Compactions not fitting next to the running ones are deferred, "+
+		"compactions larger than the budget are skipped. 0 disables the budget.").
+		Default("0B").Bytes()
+
+	stagingCacheSize := cmd.Flag("compact.staging-cache-size", "Maximum size of the local staging cache in the data directory, keeping the index and chunk files downloaded for one operation, "+
+		"e.g. a compaction, so that the next operations on the same blocks, e.g. downsampling, read them from disk instead of the bucket. The least recently used files are evicted first. "+
+		"The cache comes on top of the disk budget. 0 disables the cache.").
+		Default("0B").Bytes()
+
+	stagingCacheTTL := modelDuration(cmd.Flag("compact.staging-cache-ttl", "Duration for which files are kept in the local staging cache.").Default("1h"))
+
+	minFreeDisk := cmd.Flag("compact.min-free-disk", "Minimum free disk space of the data directory for starting new group compactions. "+
+		"While less space is free, compactions are paused until space is freed, e.g. by running compactions completing. 0 disables the check.").
+		Default("0B").Bytes()
+
+	maintenanceWindows := cmd.Flag("compact.maintenance-window", "Recurring window during which no new group compactions are started, e.g. to leave IO and CPU to queries during peak hours, "+
+		"in the form '[<days>] <HH:MM>-<HH:MM>' in the local time zone of the compactor, e.g. 'mon-fri 08:00-18:00' or 'sat,sun 22:00-02:00' (repeated). "+
+		"Group compactions in progress at the start of a window are completed.").
+		Strings()
+
+	haltWebhookURL := cmd.Flag("compact.halt-webhook-url", "URL the compactor POSTs a JSON event to when it halts on a critical error, e.g. overlapping blocks, "+
+		"with the reason and the compaction groups and blocks involved. Empty disables the webhook.").
+		Default("").String()
+
+	haltMark := cmd.Flag("compact.halt-mark", "If true, the compactor writes the JSON event it halted on to "+compact.HaltMarkFilename+" in the root of the bucket. "+
+		"The mark is removed once the compactor starts again.").
+		Default("false").Bool()
+
+	overlapToleranceDuration := modelDuration(cmd.Flag("compact.overlap-tolerance-duration", "Maximum time range of overlaps between blocks of a compaction group that are vertically compacted instead of halting the compactor, "+
+		"e.g. small expected overlaps caused by the timing of uploads. 0s disables the bound. No overlaps are tolerated if both the duration and samples bounds are disabled.").
+		Default("0s"))
+
+	overlapToleranceSamples := cmd.Flag("compact.overlap-tolerance-samples", "Maximum number of samples within the time range of overlaps between blocks of a compaction group that are vertically compacted instead of halting the compactor. "+
+		"Samples are estimated from the stats of the overlapping blocks. 0 disables the bound.").
+		Default("0").Uint64()
+
+	enableLeaderElection := cmd.Flag("compact.enable-leader-election", "If true, the compactor only compacts, downsamples and applies retention while it holds a leader lease stored in the bucket. "+
+		"This allows to run multiple compactor replicas against the same bucket for availability: the other replicas stand by and take over once the lease of the leader expires. "+
+		"The lease is best effort as object storages do not support atomic updates, and the clocks of all replicas are expected to be in sync.").
+		Default("false").Bool()
+
+	leaderLeaseDuration := cmd.Flag("compact.leader-lease-duration", "Duration of the leader lease. The leader renews its lease every third of the duration, "+
+		"and aborts its work if the lease could not be renewed before it expires. Only works when --compact.enable-leader-election flag specified.").
+		Default("1m").Duration()
+
+	leaderID := cmd.Flag("compact.leader-id", "Identity of the compactor replica in the leader election, which must be unique among all replicas. Defaults to the hostname.").
+		Default("").String()
+
+	protectedBlocksSelectors := cmd.Flag("compact.protected-blocks-selector", "Series selector matching the external labels of blocks that are never marked for deletion by retention, "+
+		"garbage collection or compaction, e.g. '{tenant=\"team-a\"}' (repeated). A block is protected if it matches any of the selectors. "+
+		"Prevented deletions are logged.").
+		Strings()
+
 	deleteDelay := modelDuration(cmd.Flag("delete-delay", "Time before a block marked for deletion is deleted from bucket. "+
 		"If delete-delay is non zero, blocks will be marked for deletion and compactor component will delete blocks marked for deletion from the bucket. "+
 		"If delete-delay is 0, blocks will be deleted straight away. "+
@@ -149,6 +234,28 @@ func registerCompact(m map[string]setupFunc, app *kingpin.Application) {
 	label := cmd.Flag("bucket-web-label", "Prometheus label to use as timeline title in the bucket web UI").String()
 
 	m[component.Compact.String()] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, _ <-chan struct{}, _ bool) error {
+		downsamplingLevels, err := downsample.NewLevels(*downsamplingResolutions)
+		if err != nil {
+			return errors.Wrap(err, "parse downsampling resolutions")
+		}
+		var windows []compact.MaintenanceWindow
+		for _, w := range *maintenanceWindows {
+			window, err := compact.ParseMaintenanceWindow(w)
+			if err != nil {
+				return errors.Wrap(err, "parse --compact.maintenance-window")
+			}
+			windows = append(windows, window)
+		}
+		maxLevel := *maxCompactionLevel
+		if *maxBlockDuration > 0 {
+			l, err := compactions.levelFor(time.Duration(*maxBlockDuration))
+			if err != nil {
+				return errors.Wrap(err, "parse --compact.max-block-duration")
+			}
+			if l < maxLevel {
+				maxLevel = l
+			}
+		}
 		return runCompact(g, logger, reg,
 			*httpAddr,
 			time.Duration(*httpGracePeriod),
@@ -167,15 +274,33 @@ func registerCompact(m map[string]setupFunc, app *kingpin.Application) {
 			},
 			component.Compact,
 			*disableDownsampling,
-			*maxCompactionLevel,
+			downsamplingLevels,
+			maxLevel,
 			*blockSyncConcurrency,
 			*compactionConcurrency,
+			*enableCheckpoints,
+			int64(*diskBudget),
+			int64(*stagingCacheSize),
+			time.Duration(*stagingCacheTTL),
+			compact.OverlapTolerance{
+				MaxDuration: time.Duration(*overlapToleranceDuration),
+				MaxSamples:  *overlapToleranceSamples,
+			},
+			*enableLeaderElection,
+			*leaderID,
+			*leaderLeaseDuration,
+			*protectedBlocksSelectors,
 			*dedupReplicaLabels,
 			selectorRelabelConf,
 			*waitInterval,
+			*waitIntervalJitter,
 			*label,
 			*webExternalPrefix,
 			*webPrefixHeaderName,
+			uint64(*minFreeDisk),
+			windows,
+			*haltWebhookURL,
+			*haltMark,
 		)
 	}
 }
@@ -194,13 +319,28 @@ func runCompact(
 	retentionByResolution map[compact.ResolutionLevel]time.Duration,
 	component component.Component,
 	disableDownsampling bool,
+	downsamplingLevels []downsample.Level,
 	maxCompactionLevel, blockSyncConcurrency int,
 	concurrency int,
+	enableCheckpoints bool,
+	diskBudget int64,
+	stagingCacheSize int64,
+	stagingCacheTTL time.Duration,
+	overlapTolerance compact.OverlapTolerance,
+	enableLeaderElection bool,
+	leaderID string,
+	leaderLeaseDuration time.Duration,
+	protectedBlocksSelectors []string,
 	dedupReplicaLabels []string,
 	selectorRelabelConf *extflag.PathOrContent,
 	waitInterval time.Duration,
+	waitIntervalJitter time.Duration,
 	label string,
 	externalPrefix, prefixHeader string,
+	minFreeDisk uint64,
+	maintenanceWindows []compact.MaintenanceWindow,
+	haltWebhookURL string,
+	haltMark bool,
 ) error {
 	halted := promauto.With(reg).NewGauge(prometheus.GaugeOpts{
 		Name: "thanos_compactor_halted",
@@ -251,6 +391,10 @@ func runCompact(
 		httpserver.WithGracePeriod(httpGracePeriod),
 	)
 
+	pauser := compact.NewPauser(logger, reg)
+	srv.Handle("/-/pause", pauser.PauseHandler())
+	srv.Handle("/-/resume", pauser.ResumeHandler())
+
 	g.Add(func() error {
 		statusProber.Healthy()
 
@@ -272,6 +416,19 @@ func runCompact(
 		return err
 	}
 
+	if stagingCacheSize > 0 {
+		bkt, err = objstore.BucketWithStagingCache(logger, reg, bkt, path.Join(dataDir, "staging"), stagingCacheSize, stagingCacheTTL, isImmutableBlockFile)
+		if err != nil {
+			return errors.Wrap(err, "create staging cache")
+		}
+	}
+
+	var haltMarkBkt objstore.Bucket
+	if haltMark {
+		haltMarkBkt = bkt
+	}
+	haltNotifier := compact.NewHaltNotifier(logger, haltWebhookURL, haltMarkBkt)
+
 	relabelContentYaml, err := selectorRelabelConf.Content()
 	if err != nil {
 		return errors.Wrap(err, "get content of relabel configuration")
@@ -310,7 +467,15 @@ func runCompact(
 		level.Info(logger).Log("msg", "deduplication.replica-label specified, vertical compaction is enabled", "dedupReplicaLabels", strings.Join(dedupReplicaLabels, ","))
 	}
 
-	sy, err := compact.NewSyncer(logger, reg, bkt, compactFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, blockSyncConcurrency, acceptMalformedIndex, enableVerticalCompaction)
+	protector, err := compact.NewDeletionProtector(logger, reg, protectedBlocksSelectors)
+	if err != nil {
+		return errors.Wrap(err, "create deletion protector")
+	}
+	if len(protectedBlocksSelectors) > 0 {
+		level.Info(logger).Log("msg", "blocks matching protected selectors are never marked for deletion", "selectors", strings.Join(protectedBlocksSelectors, ","))
+	}
+
+	sy, err := compact.NewSyncer(logger, reg, bkt, compactFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, blockSyncConcurrency, acceptMalformedIndex, enableVerticalCompaction, overlapTolerance, enableCheckpoints, compact.NewDiskBudget(reg, diskBudget), protector)
 	if err != nil {
 		return errors.Wrap(err, "create syncer")
 	}
@@ -345,7 +510,28 @@ func runCompact(
 	}
 
 	blocksCleaner := compact.NewBlocksCleaner(logger, bkt, ignoreDeletionMarkFilter, deleteDelay, blocksCleaned, blockCleanupFailures)
-	compactor, err := compact.NewBucketCompactor(logger, sy, comp, compactDir, bkt, concurrency)
+	gates := []compact.Gate{pauser}
+	if minFreeDisk > 0 {
+		if err := os.MkdirAll(dataDir, 0777); err != nil {
+			cancel()
+			return errors.Wrap(err, "create data directory")
+		}
+		diskSpace, err := compact.NewDiskSpaceGate(logger, reg, dataDir, minFreeDisk)
+		if err != nil {
+			cancel()
+			return errors.Wrap(err, "create disk space gate")
+		}
+		gates = append(gates, diskSpace)
+	}
+
+	if maintenance := compact.NewMaintenanceWindows(logger, reg, maintenanceWindows); maintenance != nil {
+		gates = append(gates, maintenance)
+	}
+	for _, w := range maintenanceWindows {
+		level.Info(logger).Log("msg", "compactions are paused during maintenance window", "window", w)
+	}
+
+	compactor, err := compact.NewBucketCompactor(logger, sy, comp, compactDir, bkt, concurrency, gates)
 	if err != nil {
 		cancel()
 		return errors.Wrap(err, "create bucket compactor")
@@ -361,32 +547,44 @@ func runCompact(
 		level.Info(logger).Log("msg", "retention policy of 1 hour aggregated samples is enabled", "duration", retentionByResolution[compact.ResolutionLevel1h])
 	}
 
-	compactMainFn := func() error {
+	compactMainFn := func(ctx context.Context) error {
 		if err := compactor.Compact(ctx); err != nil {
 			return errors.Wrap(err, "compaction")
 		}
 
+		if err := pauser.Wait(ctx); err != nil {
+			return errors.Wrap(err, "wait for resume")
+		}
 		if !disableDownsampling {
 			// After all compactions are done, work down the downsampling backlog.
-			// We run two passes of this to ensure that the 1h downsampling is generated
-			// for 5m downsamplings created in the first run.
-			level.Info(logger).Log("msg", "start first pass of downsampling")
-
-			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, compactFetcher, downsamplingDir); err != nil {
-				return errors.Wrap(err, "first pass of downsampling failed")
-			}
-
-			level.Info(logger).Log("msg", "start second pass of downsampling")
+			// We run a pass per level to ensure that every level is generated
+			// for the downsamplings of the previous level created in the previous pass.
+			for i := range downsamplingLevels {
+				if i > 0 {
+					if err := pauser.Wait(ctx); err != nil {
+						return errors.Wrap(err, "wait for resume")
+					}
+				}
+				level.Info(logger).Log("msg", "start pass of downsampling", "pass", i+1)
 
-			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, compactFetcher, downsamplingDir); err != nil {
-				return errors.Wrap(err, "second pass of downsampling failed")
+				if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, compactFetcher, downsamplingDir, downsamplingLevels); err != nil {
+					return errors.Wrapf(err, "pass %d of downsampling failed", i+1)
+				}
 			}
 			level.Info(logger).Log("msg", "downsampling iterations done")
 		} else {
 			level.Warn(logger).Log("msg", "downsampling was explicitly disabled")
 		}
 
-		if err := compact.ApplyRetentionPolicyByResolution(ctx, logger, bkt, compactFetcher, retentionByResolution, blocksMarkedForDeletion); err != nil {
+		if err := pauser.Wait(ctx); err != nil {
+			return errors.Wrap(err, "wait for resume")
+		}
+		// Without downsampling, raw blocks must not wait for downsampled blocks that are never created.
+		var retentionDownsamplingLevels []downsample.Level
+		if !disableDownsampling {
+			retentionDownsamplingLevels = downsamplingLevels
+		}
+		if err := compact.ApplyRetentionPolicyByResolution(ctx, logger, bkt, compactFetcher, retentionByResolution, blocksMarkedForDeletion, protector, retentionDownsamplingLevels); err != nil {
 			return errors.Wrap(err, fmt.Sprintf("retention failed"))
 		}
 
@@ -398,9 +596,52 @@ func runCompact(
 		return nil
 	}
 
+	if enableLeaderElection {
+		if leaderID == "" {
+			if leaderID, err = os.Hostname(); err != nil {
+				cancel()
+				return errors.Wrap(err, "get hostname for leader id")
+			}
+		}
+		lease, err := compact.NewLease(log.With(logger, "component", "leader-election"), reg, bkt, leaderID, leaderLeaseDuration)
+		if err != nil {
+			cancel()
+			return errors.Wrap(err, "create leader lease")
+		}
+
+		leaseCtx, leaseCancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return lease.Run(leaseCtx)
+		}, func(error) {
+			leaseCancel()
+		})
+
+		leaderFn := compactMainFn
+		compactMainFn = func(ctx context.Context) error {
+			leader, err := lease.Do(ctx, leaderFn)
+			if err != nil && !lease.IsLeader() {
+				// The lease could not be acquired or was lost during the run, which aborted it.
+				// Either way another replica may be the leader now, so just try again next run.
+				level.Warn(logger).Log("msg", "compaction run did not complete as leader", "err", err)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if !leader {
+				level.Info(logger).Log("msg", "not the leader, standing by", "id", leaderID)
+			}
+			return nil
+		}
+	}
+
 	g.Add(func() error {
 		defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
 
+		if err := haltNotifier.Reset(ctx); err != nil {
+			level.Warn(logger).Log("msg", "failed to remove halt mark", "err", err)
+		}
+
 		// Generate index file.
 		if generateMissingIndexCacheFiles {
 			if err := genMissingIndexCacheFiles(ctx, logger, reg, bkt, compactFetcher, indexCacheDir); err != nil {
@@ -409,12 +650,20 @@ func runCompact(
 		}
 
 		if !wait {
-			return compactMainFn()
+			return compactMainFn(ctx)
 		}
 
 		// --wait=true is specified.
 		return runutil.Repeat(waitInterval, ctx.Done(), func() error {
-			err := compactMainFn()
+			if waitIntervalJitter > 0 {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(time.Duration(rand.Int63n(int64(waitIntervalJitter)))):
+				}
+			}
+
+			err := compactMainFn(ctx)
 			if err == nil {
 				iterations.Inc()
 				return nil
@@ -426,6 +675,11 @@ func runCompact(
 				if haltOnError {
 					level.Error(logger).Log("msg", "critical error detected; halting", "err", err)
 					halted.Set(1)
+					nctx, ncancel := context.WithTimeout(ctx, time.Minute)
+					if err := haltNotifier.Notify(nctx, err); err != nil {
+						level.Error(logger).Log("msg", "failed to notify about halt", "err", err)
+					}
+					ncancel()
 					select {}
 				} else {
 					return errors.Wrap(err, "critical error detected")
@@ -493,6 +747,19 @@ func runCompact(
 	return nil
 }
 
+// isImmutableBlockFile returns true if the given object is the index or a chunk file of a block. Unlike the meta.json
+// and marker files, those are never changed once uploaded.
+func isImmutableBlockFile(name string) bool {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	if _, ok := block.IsBlockDir(parts[0]); !ok {
+		return false
+	}
+	return parts[1] == block.IndexFilename || strings.HasPrefix(parts[1], block.ChunksDirname+"/")
+}
+
 // genMissingIndexCacheFiles scans over all blocks, generates missing index cache files and uploads them to object storage.
 func genMissingIndexCacheFiles(ctx context.Context, logger log.Logger, reg *prometheus.Registry, bkt objstore.Bucket, fetcher block.MetadataFetcher, dir string) error {
 	genIndex := promauto.With(reg).NewCounter(prometheus.CounterOpts{
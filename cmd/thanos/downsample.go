@@ -61,6 +61,7 @@ func RunDownsample(
 	dataDir string,
 	objStoreConfig *extflag.PathOrContent,
 	comp component.Component,
+	levels []downsample.Level,
 ) error {
 	confContentYaml, err := objStoreConfig.Content()
 	if err != nil {
@@ -101,16 +102,13 @@ func RunDownsample(
 			defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
 			statusProber.Ready()
 
-			level.Info(logger).Log("msg", "start first pass of downsampling")
+			// Run a pass per level, so that every level is generated from the blocks downsampled in the previous pass.
+			for i := range levels {
+				level.Info(logger).Log("msg", "start pass of downsampling", "pass", i+1)
 
-			if err := downsampleBucket(ctx, logger, metrics, bkt, metaFetcher, dataDir); err != nil {
-				return errors.Wrap(err, "downsampling failed")
-			}
-
-			level.Info(logger).Log("msg", "start second pass of downsampling")
-
-			if err := downsampleBucket(ctx, logger, metrics, bkt, metaFetcher, dataDir); err != nil {
-				return errors.Wrap(err, "downsampling failed")
+				if err := downsampleBucket(ctx, logger, metrics, bkt, metaFetcher, dataDir, levels); err != nil {
+					return errors.Wrap(err, "downsampling failed")
+				}
 			}
 
 			return nil
@@ -146,6 +144,7 @@ func downsampleBucket(
 	bkt objstore.Bucket,
 	fetcher block.MetadataFetcher,
 	dir string,
+	levels []downsample.Level,
 ) error {
 	if err := os.RemoveAll(dir); err != nil {
 		return errors.Wrap(err, "clean working directory")
@@ -165,76 +164,53 @@ func downsampleBucket(
 		return errors.Wrap(err, "downsampling meta fetch")
 	}
 
-	// mapping from a hash over all source IDs to blocks. We don't need to downsample a block
+	// mapping from a hash over all source IDs to blocks per resolution. We don't need to downsample a block
 	// if a downsampled version with the same hash already exists.
-	sources5m := map[ulid.ULID]struct{}{}
-	sources1h := map[ulid.ULID]struct{}{}
+	sources := map[int64]map[ulid.ULID]struct{}{}
+	for _, l := range levels {
+		sources[l.Resolution] = map[ulid.ULID]struct{}{}
+	}
 
 	for _, m := range metas {
-		switch m.Thanos.Downsample.Resolution {
-		case downsample.ResLevel0:
+		res := m.Thanos.Downsample.Resolution
+		if res == downsample.ResLevel0 {
 			continue
-		case downsample.ResLevel1:
-			for _, id := range m.Compaction.Sources {
-				sources5m[id] = struct{}{}
-			}
-		case downsample.ResLevel2:
-			for _, id := range m.Compaction.Sources {
-				sources1h[id] = struct{}{}
-			}
-		default:
-			return errors.Errorf("unexpected downsampling resolution %d", m.Thanos.Downsample.Resolution)
+		}
+		if _, ok := sources[res]; !ok {
+			// Blocks of resolutions that are not configured (anymore) are neither sources nor targets.
+			continue
+		}
+		for _, id := range m.Compaction.Sources {
+			sources[res][id] = struct{}{}
 		}
 	}
 
 	for _, m := range metas {
-		switch m.Thanos.Downsample.Resolution {
-		case downsample.ResLevel0:
-			missing := false
-			for _, id := range m.Compaction.Sources {
-				if _, ok := sources5m[id]; !ok {
-					missing = true
-					break
-				}
-			}
-			if !missing {
-				continue
-			}
-			// Only downsample blocks once we are sure to get roughly 2 chunks out of it.
-			// NOTE(fabxc): this must match with at which block size the compactor creates downsampled
-			// blocks. Otherwise we may never downsample some data.
-			if m.MaxTime-m.MinTime < downsample.DownsampleRange0 {
-				continue
-			}
-			if err := processDownsampling(ctx, logger, bkt, m, dir, downsample.ResLevel1); err != nil {
-				metrics.downsampleFailures.WithLabelValues(compact.GroupKey(m.Thanos)).Inc()
-				return errors.Wrap(err, "downsampling to 5 min")
-			}
-			metrics.downsamples.WithLabelValues(compact.GroupKey(m.Thanos)).Inc()
-
-		case downsample.ResLevel1:
-			missing := false
-			for _, id := range m.Compaction.Sources {
-				if _, ok := sources1h[id]; !ok {
-					missing = true
-					break
-				}
-			}
-			if !missing {
-				continue
-			}
-			// Only downsample blocks once we are sure to get roughly 2 chunks out of it.
-			// NOTE(fabxc): this must match with at which block size the compactor creates downsampled
-			// blocks. Otherwise we may never downsample some data.
-			if m.MaxTime-m.MinTime < downsample.DownsampleRange1 {
-				continue
-			}
-			if err := processDownsampling(ctx, logger, bkt, m, dir, downsample.ResLevel2); err != nil {
-				metrics.downsampleFailures.WithLabelValues(compact.GroupKey(m.Thanos))
-				return errors.Wrap(err, "downsampling to 60 min")
+		next, ok := downsample.NextLevel(levels, m.Thanos.Downsample.Resolution)
+		if !ok {
+			continue
+		}
+		missing := false
+		for _, id := range m.Compaction.Sources {
+			if _, ok := sources[next.Resolution][id]; !ok {
+				missing = true
+				break
 			}
-			metrics.downsamples.WithLabelValues(compact.GroupKey(m.Thanos))
 		}
+		if !missing {
+			continue
+		}
+		// Only downsample blocks once we are sure to get roughly 2 chunks out of it.
+		// NOTE(fabxc): this must match with at which block size the compactor creates downsampled
+		// blocks. Otherwise we may never downsample some data.
+		if m.MaxTime-m.MinTime < next.MinSourceRange {
+			continue
+		}
+		if err := processDownsampling(ctx, logger, bkt, m, dir, next.Resolution); err != nil {
+			metrics.downsampleFailures.WithLabelValues(compact.GroupKey(m.Thanos)).Inc()
+			return errors.Wrapf(err, "downsampling to %s", time.Duration(next.Resolution)*time.Millisecond)
+		}
+		metrics.downsamples.WithLabelValues(compact.GroupKey(m.Thanos)).Inc()
 	}
 	return nil
 }
@@ -6,6 +6,7 @@ package main
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/thanos-io/thanos/pkg/extflag"
 
@@ -73,3 +74,10 @@ func regSelectorRelabelFlags(cmd *kingpin.CmdClause) *extflag.PathOrContent {
 		false,
 	)
 }
+
+func regDownsampleResolutionFlags(cmd *kingpin.CmdClause) *[]time.Duration {
+	return cmd.Flag("downsampling.resolution", "Resolution to downsample blocks to (repeated flag). The first resolution is downsampled from raw blocks, "+
+		"every following one from the blocks of the previous resolution, so resolutions must be increasing. "+
+		"Blocks are downsampled to 5m once they span 40h, to 1h once they span 10d and to other resolutions once they span 240 times the resolution.").
+		Default("5m", "1h").DurationList()
+}
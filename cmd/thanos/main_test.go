@@ -18,6 +18,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/compact"
@@ -119,9 +120,127 @@ func TestCleanupDownsampleCacheFolder(t *testing.T) {
 	metaFetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, nil, nil)
 	testutil.Ok(t, err)
 
-	testutil.Ok(t, downsampleBucket(ctx, logger, metrics, bkt, metaFetcher, dir))
+	testutil.Ok(t, downsampleBucket(ctx, logger, metrics, bkt, metaFetcher, dir, downsample.DefaultLevels))
 	testutil.Equals(t, 1.0, promtest.ToFloat64(metrics.downsamples.WithLabelValues(compact.GroupKey(meta.Thanos))))
 
 	_, err = os.Stat(dir)
 	testutil.Assert(t, os.IsNotExist(err), "index cache dir should not exist at the end of execution")
 }
+
+func TestDownsampleBucket_CustomLevels(t *testing.T) {
+	logger := log.NewLogfmtLogger(os.Stderr)
+	dir, err := ioutil.TempDir("", "test-downsample-custom-levels")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	levels, err := downsample.NewLevels([]time.Duration{10 * time.Minute, 20 * time.Minute})
+	testutil.Ok(t, err)
+	testutil.Equals(t, []downsample.Level{
+		{Resolution: 10 * 60 * 1000, MinSourceRange: 40 * 60 * 60 * 1000},
+		{Resolution: 20 * 60 * 1000, MinSourceRange: 80 * 60 * 60 * 1000},
+	}, levels)
+
+	bkt := inmem.NewBucket()
+	id, err := e2eutil.CreateBlock(
+		ctx,
+		dir,
+		[]labels.Labels{{{Name: "a", Value: "1"}}},
+		100, 0, levels[1].MinSourceRange+1, // Pass the minimum range of both levels.
+		labels.Labels{{Name: "e1", Value: "1"}},
+		downsample.ResLevel0)
+	testutil.Ok(t, err)
+	testutil.Ok(t, block.Upload(ctx, logger, bkt, path.Join(dir, id.String())))
+
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, nil, nil)
+	testutil.Ok(t, err)
+	metrics := newDownsampleMetrics(prometheus.NewRegistry())
+
+	for range levels {
+		testutil.Ok(t, downsampleBucket(ctx, logger, metrics, bkt, metaFetcher, path.Join(dir, "downsample"), levels))
+	}
+
+	metas, _, err := metaFetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	resolutions := map[int64]int{}
+	for _, m := range metas {
+		resolutions[m.Thanos.Downsample.Resolution]++
+		testutil.Equals(t, []ulid.ULID{id}, m.Compaction.Sources)
+	}
+	testutil.Equals(t, map[int64]int{downsample.ResLevel0: 1, levels[0].Resolution: 1, levels[1].Resolution: 1}, resolutions)
+
+	// Further passes do not downsample the blocks again.
+	testutil.Ok(t, downsampleBucket(ctx, logger, metrics, bkt, metaFetcher, path.Join(dir, "downsample"), levels))
+	metas, _, err = metaFetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(metas))
+}
+
+func TestCompactionSet_MaxBlockDuration(t *testing.T) {
+	for _, tcase := range []struct {
+		maxRange time.Duration
+		expected int
+	}{
+		{maxRange: time.Hour, expected: 0},
+		{maxRange: 8 * time.Hour, expected: 2},
+		{maxRange: 24 * time.Hour, expected: 2},
+		{maxRange: 14 * 24 * time.Hour, expected: 4},
+		{maxRange: 365 * 24 * time.Hour, expected: 4},
+	} {
+		l, err := compactions.levelFor(tcase.maxRange)
+		testutil.Ok(t, err)
+		testutil.Equals(t, tcase.expected, l)
+	}
+	_, err := compactions.levelFor(time.Minute)
+	testutil.NotOk(t, err)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	// plan returns the time ranges of the blocks of the given time ranges planned for compaction, given the
+	// compaction levels up to blocks of the given time range. The last block is never compacted, as it is the newest.
+	plan := func(maxRange time.Duration, ranges ...[2]time.Duration) [][2]time.Duration {
+		dir, err := ioutil.TempDir("", "test-compaction-max-block-duration")
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+		for _, r := range ranges {
+			_, err := e2eutil.CreateBlock(ctx, dir, []labels.Labels{labels.FromStrings("a", "1")}, 10, int64(r[0]/time.Millisecond), int64(r[1]/time.Millisecond), labels.Labels{}, 0)
+			testutil.Ok(t, err)
+		}
+
+		maxLevel, err := compactions.levelFor(maxRange)
+		testutil.Ok(t, err)
+		levels, err := compactions.levels(maxLevel)
+		testutil.Ok(t, err)
+		comp, err := tsdb.NewLeveledCompactor(ctx, nil, logger, levels, nil)
+		testutil.Ok(t, err)
+
+		dirs, err := comp.Plan(dir)
+		testutil.Ok(t, err)
+		var res [][2]time.Duration
+		for _, d := range dirs {
+			meta, err := metadata.Read(d)
+			testutil.Ok(t, err)
+			res = append(res, [2]time.Duration{time.Duration(meta.MinTime) * time.Millisecond, time.Duration(meta.MaxTime) * time.Millisecond})
+		}
+		return res
+	}
+
+	var (
+		h = time.Hour
+		// Six blocks of 8h forming two days, followed by four blocks of 2h forming 8h.
+		maxLevel8h = [][2]time.Duration{{0, 8 * h}, {8 * h, 16 * h}, {16 * h, 24 * h}, {24 * h, 32 * h}, {32 * h, 40 * h}, {40 * h, 48 * h}}
+		lowerLevel = [][2]time.Duration{{48 * h, 50 * h}, {50 * h, 52 * h}, {52 * h, 54 * h}, {54 * h, 56 * h}}
+		newest     = [2]time.Duration{56 * h, 58 * h}
+	)
+
+	// Without cap, the blocks of 8h are merged into a block of two days.
+	testutil.Equals(t, maxLevel8h, plan(14*24*h, append(maxLevel8h, newest)...))
+	// With a cap of 8h, the blocks of 8h are not merged any further.
+	testutil.Equals(t, [][2]time.Duration(nil), plan(8*h, append(maxLevel8h, newest)...))
+	// With a cap of 8h, blocks of lower levels are still merged up to blocks of 8h.
+	testutil.Equals(t, lowerLevel, plan(8*h, append(append(maxLevel8h, lowerLevel...), newest)...))
+}
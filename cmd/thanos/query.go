@@ -9,6 +9,7 @@ import (
 	"math"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -29,6 +30,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/discovery/cache"
 	"github.com/thanos-io/thanos/pkg/discovery/dns"
+	"github.com/thanos-io/thanos/pkg/extflag"
 	"github.com/thanos-io/thanos/pkg/extgrpc"
 	"github.com/thanos-io/thanos/pkg/extprom"
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
@@ -39,6 +41,7 @@ import (
 	grpcserver "github.com/thanos-io/thanos/pkg/server/grpc"
 	httpserver "github.com/thanos-io/thanos/pkg/server/http"
 	"github.com/thanos-io/thanos/pkg/store"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/tls"
 	"github.com/thanos-io/thanos/pkg/ui"
 )
@@ -57,6 +60,15 @@ func registerQuery(m map[string]setupFunc, app *kingpin.Application) {
 	caCert := cmd.Flag("grpc-client-tls-ca", "TLS CA Certificates to use to verify gRPC servers").Default("").String()
 	serverName := cmd.Flag("grpc-client-server-name", "Server name to verify the hostname on the returned gRPC certificates. See https://tools.ietf.org/html/rfc4366#section-3.1").Default("").String()
 
+	compression := cmd.Flag("store.grpc.compression", "Compression of the gRPC messages exchanged with store API servers, trading CPU for bandwidth. Store API servers respond in kind, so they need to support it. Possible options: ["+strings.Join(extgrpc.Compressions, ", ")+"].").
+		Default(extgrpc.CompressionNone).Enum(extgrpc.Compressions...)
+
+	keepaliveTime := modelDuration(cmd.Flag("store.grpc.keepalive-time", "Duration without activity after which the connections to store API servers are pinged, keeping idle connections from being dropped, "+
+		"e.g. by load balancers, and detecting broken ones. Durations shorter than 10s are raised to 10s. 0s disables keepalive pings.").Default("0s"))
+	keepaliveTimeout := modelDuration(cmd.Flag("store.grpc.keepalive-timeout", "Duration to wait for the response to a keepalive ping before closing the connection to a store API server.").Default("20s"))
+	keepalivePermitWithoutStream := cmd.Flag("store.grpc.keepalive-permit-without-stream", "If true, connections to store API servers are also pinged while no request is running, so that idle connections are kept alive. "+
+		"Store API servers need to permit it, which Thanos components do.").Default("false").Bool()
+
 	webRoutePrefix := cmd.Flag("web.route-prefix", "Prefix for API and UI endpoints. This allows thanos UI to be served on a sub-path. This option is analogous to --web.route-prefix of Promethus.").Default("").String()
 	webExternalPrefix := cmd.Flag("web.external-prefix", "Static prefix for all HTML links and redirect URLs in the UI query web interface. Actual endpoints are still served on / or the web.route-prefix. This allows thanos UI to be served behind a reverse proxy that strips a URL sub-path.").Default("").String()
 	webPrefixHeaderName := cmd.Flag("web.prefix-header", "Name of HTTP request header used for dynamic prefixing of UI links and redirects. This option is ignored if web.external-prefix argument is set. Security risk: enable this option only if a reverse proxy in front of thanos is resetting the header. The --web.prefix-header=X-Forwarded-Prefix option can be useful, for example, if Thanos UI is served via Traefik reverse proxy with PathPrefixStrip option enabled, which sends the stripped prefix value in X-Forwarded-Prefix header. This allows thanos UI to be served on a sub-path.").Default("").String()
@@ -64,14 +76,39 @@ func registerQuery(m map[string]setupFunc, app *kingpin.Application) {
 	queryTimeout := modelDuration(cmd.Flag("query.timeout", "Maximum time to process query by query node.").
 		Default("2m"))
 
+	maxQueryTimeout := modelDuration(cmd.Flag("query.max-timeout", "Maximum timeout of queries requesting their own timeout with the timeout param or the "+v1.TimeoutHeader+" header. "+
+		"Longer requested timeouts are lowered to the maximum with a warning. Queries without requested timeout use --query.timeout. Defaults to --query.timeout if lower.").
+		Default("0s"))
+
 	maxConcurrentQueries := cmd.Flag("query.max-concurrent", "Maximum number of queries processed concurrently by query node.").
 		Default("20").Int()
 
+	maxConcurrentMetadata := cmd.Flag("query.max-concurrent-metadata", "Maximum number of label names, label values and series requests processed concurrently by query node, independently of query.max-concurrent. Requests over the limit wait for their turn. 0 disables the limit.").
+		Default("0").Int()
+
 	replicaLabels := cmd.Flag("query.replica-label", "Labels to treat as a replica indicator along which data is deduplicated. Still you will be able to query without deduplication using 'dedup=false' parameter.").
 		Strings()
 
+	replicaPrecedence := cmd.Flag("query.replica-precedence", "Value of a replica label, in decreasing order of precedence (repeated). When deduplicating, the samples of the replica with the highest precedence are used, and the samples of the following replicas only fill its gaps. Replicas not listed come last and are deduplicated by the default heuristic among themselves.").
+		Strings()
+
 	instantDefaultMaxSourceResolution := modelDuration(cmd.Flag("query.instant.default.max_source_resolution", "default value for max_source_resolution for instant queries. If not set, defaults to 0s only taking raw resolution into account. 1h can be a good value if you use instant queries over time ranges that incorporate times outside of your raw-retention.").Default("0s").Hidden())
 
+	instantFreshStoresOnly := cmd.Flag("query.instant.fresh-stores-only", "If true, instant queries only select stores whose advertised max time reaches the query time, skipping e.g. long-term stores lagging behind the most recent data of sidecars and receivers.").
+		Default("false").Bool()
+
+	enableReplicaVerification := cmd.Flag("query.replica-verification", "Debugging mode allowing queries with 'verify_replicas=true' parameter, which are evaluated once per value of the replica labels "+
+		"instead of deduplicated and return the results of all replicas side by side. This allows to spot divergence between HA replicas, but multiplies the cost of such queries.").
+		Default("false").Bool()
+
+	tenantHeader := cmd.Flag("query.tenant-header", "HTTP header to determine the tenant of query and metadata requests.").Default(v1.DefaultTenantHeader).String()
+
+	defaultTenant := cmd.Flag("query.default-tenant", "Tenant of query and metadata requests without tenant header.").Default("").String()
+
+	tenantLabel := cmd.Flag("query.tenant-label-name", "Name of the label holding the tenant of series. If set, query and metadata requests only select the series of their tenant, "+
+		"and requests without tenant header fail unless a default tenant is set. Label names and values are then collected from the series of the tenant, which is more expensive.").
+		Default("").String()
+
 	selectorLabels := cmd.Flag("selector-label", "Query selector labels that will be exposed in info endpoint (repeated).").
 		PlaceHolder("<name>=\"<value>\"").Strings()
 
@@ -94,17 +131,91 @@ func registerQuery(m map[string]setupFunc, app *kingpin.Application) {
 	dnsSDResolver := cmd.Flag("store.sd-dns-resolver", fmt.Sprintf("Resolver to use. Possible options: [%s, %s]", dns.GolangResolverType, dns.MiekgdnsResolverType)).
 		Default(string(dns.GolangResolverType)).Hidden().String()
 
+	federationEndpoints := cmd.Flag("federation.endpoint", "Cluster name and gRPC address of a downstream querier federated into this one (repeatable). The address may be prefixed with 'dns+' or 'dnssrv+' to detect the queriers of a cluster through respective DNS lookups. "+
+		"The cluster label is set on all series of the federated queriers.").
+		PlaceHolder("<cluster>=<address>").Strings()
+
+	federationClusterLabel := cmd.Flag("federation.cluster-label", "Name of the label identifying the cluster of the series of federated queriers.").
+		Default("cluster").String()
+
 	unhealthyStoreTimeout := modelDuration(cmd.Flag("store.unhealthy-timeout", "Timeout before an unhealthy store is cleaned from the store UI page.").Default("5m"))
 
+	storeLimit := cmd.Flag("store.limit", "Maximum number of stores to connect to, not counting strict stores. If more stores are discovered, the ones sorted last by address are dropped. 0 means no limit.").
+		Default("0").Int()
+
+	warmupMinStores := cmd.Flag("query.warmup.min-stores", "Minimum number of stores with successful Info calls before the querier becomes ready. 0 disables the check.").
+		Default("0").Int()
+
+	warmupMinStoresRatio := cmd.Flag("query.warmup.min-stores-ratio", "Minimum ratio of the discovered stores, between 0 and 1, with successful Info calls before the querier becomes ready. 0 disables the check.").
+		Default("0").Float64()
+
+	warmupTimeout := modelDuration(cmd.Flag("query.warmup.timeout", "Maximum duration to wait for the minimum stores on startup. The querier becomes ready once it passed, even if the minimum stores are not healthy.").
+		Default("5m"))
+
 	enableAutodownsampling := cmd.Flag("query.auto-downsampling", "Enable automatic adjustment (step / 5) to what source of data should be used in store gateways if no max_source_resolution param is specified.").
 		Default("false").Bool()
 
+	downsamplingThresholds := cmd.Flag("query.auto-downsampling-threshold", "Threshold overriding the automatic adjustment (step / 5) of the max source resolution of range queries, of the form <step|range>:<min>=<resolution>, "+
+		"e.g. step:25m=5m or range:14d=1h. Range queries whose step or time range reaches the minimum use the resolution, the highest resolution of the reached thresholds is used, raw data if none is reached. "+
+		"Applies whenever the max source resolution is chosen automatically, i.e. with --query.auto-downsampling or max_source_resolution=auto. Can be specified multiple times.").
+		PlaceHolder("<threshold>").Strings()
+
 	enablePartialResponse := cmd.Flag("query.partial-response", "Enable partial response for queries if no partial_response param is specified. --no-query.partial-response for disabling.").
 		Default("true").Bool()
 
+	unsortedMetadata := cmd.Flag("query.unsorted-metadata", "Return the series, label names and label values of metadata requests in no particular order if no unsorted param is specified, skipping the cost of sorting the merged results of the Stores. Results are sorted by default.").
+		Default("false").Bool()
+
 	defaultEvaluationInterval := modelDuration(cmd.Flag("query.default-evaluation-interval", "Set default evaluation interval for sub queries.").Default("1m"))
 
 	storeResponseTimeout := modelDuration(cmd.Flag("store.response-timeout", "If a Store doesn't send any data in this specified duration then a Store will be ignored and partial data will be returned if it's enabled. 0 disables timeout.").Default("0ms"))
+	storeRequestTimeout := modelDuration(cmd.Flag("store.request-timeout", "If a Store doesn't complete a Series request in this specified duration then a Store will be ignored and partial data will be returned if it's enabled. Applies to every Store on its own and is bounded by the query timeout. 0 disables timeout.").Default("0ms"))
+
+	slowStoreLatencyFactor := cmd.Flag("store.slow-latency-factor", "If set, a Store whose 99th percentile latency of its latest Series requests exceeds this factor times the median of the other Stores is demoted until its latency recovers. "+
+		"Demoted Stores stay in rotation, but their Series requests time out after --store.slow-request-timeout. 0 disables the detection.").
+		Default("0").Float64()
+	slowStoreRequestTimeout := modelDuration(cmd.Flag("store.slow-request-timeout", "Series request timeout of demoted Stores, bounded by --store.request-timeout. 0 keeps the request timeout of demoted Stores.").Default("0ms"))
+
+	storeSessionHeader := cmd.Flag("query.store-session-header", "HTTP header carrying the session token of query and metadata requests. The first request of a session pins the Stores it sees, "+
+		"so that later requests of the session, e.g. of a scrolling dashboard, do not see data appear and disappear as Stores join and leave. Stores are not pinned if empty.").
+		Default("").String()
+	storeSessionTTL := modelDuration(cmd.Flag("query.store-session-ttl", "Time for which the Stores of a session are pinned, starting from its first request.").Default("15m"))
+	maxStoreSessions := cmd.Flag("query.store-session-max", "Maximum number of sessions with pinned Stores. Once reached, the least recently used session is evicted to make room for new ones. 0 means no limit.").
+		Default("10000").Int()
+
+	storeRoutingConfig := extflag.RegisterPathOrContent(cmd, "store.routing-config", "YAML file that contains rules selecting the Stores Series requests are sent to, based on their time range and matchers. See format details: https://thanos.io/components/query.md/#store-routing. All Stores are queried if not defined.", false)
+
+	remoteReadConfig := extflag.RegisterPathOrContent(cmd, "store.remote-read-config", "YAML file that contains Prometheus remote read endpoints queried as Stores, e.g. Prometheus instances without sidecar. See format details: https://thanos.io/components/query.md/#remote-read-stores", false)
+
+	macrosConfig := extflag.RegisterPathOrContent(cmd, "query.macros-config", "YAML file that contains named PromQL fragments referenced as $<name> in queries and expanded before the queries are run. See format details: https://thanos.io/components/query.md/#query-macros", false)
+
+	labelsCacheTTL := modelDuration(cmd.Flag("query.labels-cache-ttl", "Time for which label names and values responses are cached in memory and shared across the requests of this querier. Useful to reduce the fan-out of repeated autocompletion requests. 0 disables the cache.").Default("0s"))
+
+	labelsCacheGranularity := modelDuration(cmd.Flag("query.labels-cache-granularity", "Granularity to which the time range of label names and values requests is aligned for caching. Requests with time ranges within the same granularity share a cache entry.").Default("5m"))
+
+	maxRawSamples := cmd.Flag("query.max-raw-samples", "Maximum number of samples a single raw query to the /api/v1/query_raw endpoint can return. Raw queries exceeding the limit fail. 0 disables the limit.").
+		Default("10000000").Int()
+
+	maxMatchersPerSelector := cmd.Flag("query.max-matchers-per-selector", "Maximum number of label matchers of a single selector of a query, including the metric name. Queries exceeding the limit are rejected with 400 before they are run. 0 disables the limit.").
+		Default("0").Int()
+
+	maxMatchersPerQuery := cmd.Flag("query.max-matchers-per-query", "Maximum number of label matchers of all selectors of a query in total, including metric names. Queries exceeding the limit are rejected with 400 before they are run. 0 disables the limit.").
+		Default("0").Int()
+
+	maxPointsPerSeries := cmd.Flag("query.max-points-per-series", "Maximum number of points of a single series in the result of a query to /api/v1/query or /api/v1/query_range. Range queries whose step and time range exceed the limit are rejected with 400 before they are run, other queries exceeding the limit fail after they are evaluated, before their response is written, so the limit protects clients, not the memory of the Querier evaluating the query. 0 disables the limit.").
+		Default("0").Int()
+
+	maxPoints := cmd.Flag("query.max-points", "Maximum number of points of all series in the result of a query to /api/v1/query or /api/v1/query_range in total. Queries exceeding the limit fail after they are evaluated, before their response is written, so the limit protects clients, not the memory of the Querier evaluating the query. 0 disables the limit.").
+		Default("0").Int()
+
+	maxSeries := cmd.Flag("query.max-series", "Maximum number of series a single query can select. Series are counted without fetching chunks before the query data is fetched, and queries exceeding the limit fail. 0 disables the limit.").
+		Default("0").Int()
+
+	tenantMaxSeries := cmd.Flag("query.tenant-max-series", "Maximum number of series a single query of the given tenant can select, overriding --query.max-series for it (repeatable). 0 disables the limit for the tenant.").
+		PlaceHolder("<tenant>=<limit>").Strings()
+
+	maxBytes := cmd.Flag("query.max-bytes", "Maximum size of series and chunks a single query can fetch from the Stores. Queries exceeding the limit fail with the ResourceExhausted status. 0 disables the limit.").
+		Default("0B").Bytes()
 
 	m[comp.String()] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, _ <-chan struct{}, _ bool) error {
 		selectorLset, err := parseFlagLabels(*selectorLabels)
@@ -112,6 +223,10 @@ func registerQuery(m map[string]setupFunc, app *kingpin.Application) {
 			return errors.Wrap(err, "parse federation labels")
 		}
 
+		if *warmupMinStoresRatio < 0 || *warmupMinStoresRatio > 1 {
+			return errors.New("--query.warmup.min-stores-ratio must be between 0 and 1")
+		}
+
 		lookupStores := map[string]struct{}{}
 		for _, s := range *stores {
 			if _, ok := lookupStores[s]; ok {
@@ -121,6 +236,16 @@ func registerQuery(m map[string]setupFunc, app *kingpin.Application) {
 			lookupStores[s] = struct{}{}
 		}
 
+		federation, err := parseFederationEndpoints(*federationEndpoints)
+		if err != nil {
+			return errors.Wrap(err, "parse federation endpoints")
+		}
+
+		tenantMaxSeriesLimits, err := parseTenantMaxSeries(*tenantMaxSeries)
+		if err != nil {
+			return errors.Wrap(err, "parse tenant series limits")
+		}
+
 		var fileSD *file.Discovery
 		if len(*fileSDFiles) > 0 {
 			conf := &file.SDConfig{
@@ -132,6 +257,61 @@ func registerQuery(m map[string]setupFunc, app *kingpin.Application) {
 
 		promql.SetDefaultEvaluationInterval(time.Duration(*defaultEvaluationInterval))
 
+		var storeRouter *store.StoreRouter
+		storeRoutingConfigYAML, err := storeRoutingConfig.Content()
+		if err != nil {
+			return err
+		}
+		if len(storeRoutingConfigYAML) > 0 {
+			storeRouter, err = store.NewStoreRouter(storeRoutingConfigYAML)
+			if err != nil {
+				return errors.Wrap(err, "parse store routing config")
+			}
+		}
+
+		var slowStores *store.SlowStoreDetector
+		if *slowStoreLatencyFactor > 0 {
+			slowStores = store.NewSlowStoreDetector(logger, reg, *slowStoreLatencyFactor, time.Duration(*slowStoreRequestTimeout))
+		}
+
+		var storeSessions *store.StoreSessions
+		if *storeSessionHeader != "" {
+			storeSessions = store.NewStoreSessions(reg, time.Duration(*storeSessionTTL), *maxStoreSessions)
+		}
+
+		var remoteReadStores []store.Client
+		remoteReadConfigYAML, err := remoteReadConfig.Content()
+		if err != nil {
+			return err
+		}
+		if len(remoteReadConfigYAML) > 0 {
+			remoteReadStores, err = store.NewRemoteReadClients(logger, remoteReadConfigYAML)
+			if err != nil {
+				return errors.Wrap(err, "parse store remote read config")
+			}
+		}
+
+		var macros *v1.QueryMacros
+		macrosConfigYAML, err := macrosConfig.Content()
+		if err != nil {
+			return err
+		}
+		if len(macrosConfigYAML) > 0 {
+			macros, err = v1.NewQueryMacros(macrosConfigYAML)
+			if err != nil {
+				return errors.Wrap(err, "parse query macros config")
+			}
+		}
+
+		var thresholds v1.DownsamplingThresholds
+		for _, th := range *downsamplingThresholds {
+			threshold, err := v1.ParseDownsamplingThreshold(th)
+			if err != nil {
+				return errors.Wrap(err, "parse --query.auto-downsampling-threshold")
+			}
+			thresholds = append(thresholds, threshold)
+		}
+
 		return runQuery(
 			g,
 			logger,
@@ -147,25 +327,66 @@ func registerQuery(m map[string]setupFunc, app *kingpin.Application) {
 			*key,
 			*caCert,
 			*serverName,
+			*compression,
+			extgrpc.KeepaliveConfig{
+				Time:                time.Duration(*keepaliveTime),
+				Timeout:             time.Duration(*keepaliveTimeout),
+				PermitWithoutStream: *keepalivePermitWithoutStream,
+			},
 			*httpBindAddr,
 			time.Duration(*httpGracePeriod),
 			*webRoutePrefix,
 			*webExternalPrefix,
 			*webPrefixHeaderName,
 			*maxConcurrentQueries,
+			*maxConcurrentMetadata,
 			time.Duration(*queryTimeout),
+			time.Duration(*maxQueryTimeout),
 			time.Duration(*storeResponseTimeout),
+			time.Duration(*storeRequestTimeout),
+			storeRouter,
+			slowStores,
+			storeSessions,
+			*storeSessionHeader,
+			remoteReadStores,
 			*replicaLabels,
 			selectorLset,
 			*stores,
 			*enableAutodownsampling,
 			*enablePartialResponse,
+			*unsortedMetadata,
 			fileSD,
 			time.Duration(*dnsSDInterval),
 			*dnsSDResolver,
 			time.Duration(*unhealthyStoreTimeout),
+			*storeLimit,
+			*warmupMinStores,
+			*warmupMinStoresRatio,
+			time.Duration(*warmupTimeout),
+			federation,
+			*federationClusterLabel,
 			time.Duration(*instantDefaultMaxSourceResolution),
+			*instantFreshStoresOnly,
+			*enableReplicaVerification,
+			v1.TenancyConfig{
+				Header:        *tenantHeader,
+				DefaultTenant: *defaultTenant,
+				LabelName:     *tenantLabel,
+				MaxSeries:     tenantMaxSeriesLimits,
+			},
+			macros,
 			*strictStores,
+			time.Duration(*labelsCacheTTL),
+			time.Duration(*labelsCacheGranularity),
+			*maxSeries,
+			int64(*maxBytes),
+			*maxRawSamples,
+			*replicaPrecedence,
+			*maxMatchersPerSelector,
+			*maxMatchersPerQuery,
+			thresholds,
+			*maxPointsPerSeries,
+			*maxPoints,
 			component.Query,
 		)
 	}
@@ -188,25 +409,57 @@ func runQuery(
 	key string,
 	caCert string,
 	serverName string,
+	compression string,
+	keepalive extgrpc.KeepaliveConfig,
 	httpBindAddr string,
 	httpGracePeriod time.Duration,
 	webRoutePrefix string,
 	webExternalPrefix string,
 	webPrefixHeaderName string,
 	maxConcurrentQueries int,
+	maxConcurrentMetadata int,
 	queryTimeout time.Duration,
+	maxQueryTimeout time.Duration,
 	storeResponseTimeout time.Duration,
+	storeRequestTimeout time.Duration,
+	storeRouter *store.StoreRouter,
+	slowStores *store.SlowStoreDetector,
+	storeSessions *store.StoreSessions,
+	storeSessionHeader string,
+	remoteReadStores []store.Client,
 	replicaLabels []string,
 	selectorLset labels.Labels,
 	storeAddrs []string,
 	enableAutodownsampling bool,
 	enablePartialResponse bool,
+	unsortedMetadata bool,
 	fileSD *file.Discovery,
 	dnsSDInterval time.Duration,
 	dnsSDResolver string,
 	unhealthyStoreTimeout time.Duration,
+	storeLimit int,
+	warmupMinStores int,
+	warmupMinStoresRatio float64,
+	warmupTimeout time.Duration,
+	federationEndpoints map[string][]string,
+	federationClusterLabel string,
 	instantDefaultMaxSourceResolution time.Duration,
+	instantFreshStoresOnly bool,
+	enableReplicaVerification bool,
+	tenancy v1.TenancyConfig,
+	macros *v1.QueryMacros,
 	strictStores []string,
+	labelsCacheTTL time.Duration,
+	labelsCacheGranularity time.Duration,
+	maxSeries int,
+	maxBytes int64,
+	maxRawSamples int,
+	replicaPrecedence []string,
+	maxMatchersPerSelector int,
+	maxMatchersPerQuery int,
+	downsamplingThresholds v1.DownsamplingThresholds,
+	maxPointsPerSeries int,
+	maxPoints int,
 	comp component.Component,
 ) error {
 	// TODO(bplotka in PR #513 review): Move arguments into struct.
@@ -215,7 +468,7 @@ func runQuery(
 		Help: "The number of times a duplicated store addresses is detected from the different configs in query",
 	})
 
-	dialOpts, err := extgrpc.StoreClientGRPCOpts(logger, reg, tracer, secure, cert, key, caCert, serverName)
+	dialOpts, err := extgrpc.StoreClientGRPCOpts(logger, reg, tracer, secure, cert, key, caCert, serverName, compression, keepalive)
 	if err != nil {
 		return errors.Wrap(err, "building gRPC client")
 	}
@@ -227,12 +480,29 @@ func runQuery(
 		dns.ResolverType(dnsSDResolver),
 	)
 
+	// Queriers of every federated cluster are resolved on their own to keep track of their cluster.
+	federationProviders := make(map[string]*dns.Provider, len(federationEndpoints))
+	for cluster := range federationEndpoints {
+		federationProviders[cluster] = dnsProvider.Clone()
+	}
+
 	for _, store := range strictStores {
 		if dns.IsDynamicNode(store) {
 			return errors.Errorf("%s is a dynamically specified store i.e. it uses SD and that is not permitted under strict mode. Use --store for this", store)
 		}
 	}
 
+	// The engine bounds all queries, including the ones requesting a longer timeout than the default.
+	engineTimeout := queryTimeout
+	if maxQueryTimeout > engineTimeout {
+		engineTimeout = maxQueryTimeout
+	}
+
+	var labelsCache *query.LabelsCache
+	if labelsCacheTTL > 0 {
+		labelsCache = query.NewLabelsCache(reg, labelsCacheTTL, labelsCacheGranularity)
+	}
+
 	var (
 		stores = query.NewStoreSet(
 			logger,
@@ -246,6 +516,12 @@ func runQuery(
 				for _, addr := range strictStores {
 					specs = append(specs, query.NewGRPCStoreSpec(addr, true))
 				}
+				// Add federated queriers.
+				for cluster, p := range federationProviders {
+					for _, addr := range p.Addresses() {
+						specs = append(specs, query.NewGRPCFederatedStoreSpec(addr, storepb.Label{Name: federationClusterLabel, Value: cluster}))
+					}
+				}
 
 				specs = removeDuplicateStoreSpecs(logger, duplicatedStores, specs)
 
@@ -253,9 +529,14 @@ func runQuery(
 			},
 			dialOpts,
 			unhealthyStoreTimeout,
+			storeLimit,
 		)
-		proxy            = store.NewProxyStore(logger, reg, stores.Get, component.Query, selectorLset, storeResponseTimeout)
-		queryableCreator = query.NewQueryableCreator(logger, proxy)
+		// Remote read stores are queried in process next to the discovered stores.
+		allStores = func() []store.Client {
+			return append(stores.Get(), remoteReadStores...)
+		}
+		proxy            = store.NewProxyStore(logger, reg, allStores, component.Query, selectorLset, storeResponseTimeout, storeRequestTimeout, storeRouter, slowStores, storeSessions)
+		queryableCreator = query.NewQueryableCreator(logger, proxy, labelsCache, maxSeries, maxBytes, replicaPrecedence)
 		engine           = promql.NewEngine(
 			promql.EngineOpts{
 				Logger:        logger,
@@ -263,7 +544,7 @@ func runQuery(
 				MaxConcurrent: maxConcurrentQueries,
 				// TODO(bwplotka): Expose this as a flag: https://github.com/thanos-io/thanos/issues/703.
 				MaxSamples: math.MaxInt32,
-				Timeout:    queryTimeout,
+				Timeout:    engineTimeout,
 			},
 		)
 	)
@@ -321,6 +602,9 @@ func runQuery(
 		g.Add(func() error {
 			return runutil.Repeat(dnsSDInterval, ctx.Done(), func() error {
 				dnsProvider.Resolve(ctx, append(fileSDCache.Addresses(), storeAddrs...))
+				for cluster, p := range federationProviders {
+					p.Resolve(ctx, federationEndpoints[cluster])
+				}
 				return nil
 			})
 		}, func(error) {
@@ -355,7 +639,7 @@ func runQuery(
 		// TODO(bplotka in PR #513 review): pass all flags, not only the flags needed by prefix rewriting.
 		ui.NewQueryUI(logger, reg, stores, webExternalPrefix, webPrefixHeaderName).Register(router, ins)
 
-		api := v1.NewAPI(logger, reg, engine, queryableCreator, enableAutodownsampling, enablePartialResponse, replicaLabels, instantDefaultMaxSourceResolution)
+		api := v1.NewAPI(logger, reg, engine, queryableCreator, enableAutodownsampling, enablePartialResponse, replicaLabels, instantDefaultMaxSourceResolution, instantFreshStoresOnly, maxRawSamples, query.NewMetadataFetcher(logger, stores.MetadataClients), labelsCache, enableReplicaVerification, tenancy, macros, maxConcurrentMetadata, maxMatchersPerSelector, maxMatchersPerQuery, storeSessionHeader, unsortedMetadata, queryTimeout, maxQueryTimeout, downsamplingThresholds, maxPointsPerSeries, maxPoints)
 
 		api.Register(router.WithPrefix(path.Join(webRoutePrefix, "/api/v1")), tracer, logger, ins)
 
@@ -390,18 +674,68 @@ func runQuery(
 		)
 
 		g.Add(func() error {
-			statusProber.Ready()
+			if warmupMinStores <= 0 && warmupMinStoresRatio <= 0 {
+				statusProber.Ready()
+			}
 			return s.ListenAndServe()
 		}, func(error) {
 			statusProber.NotReady(err)
 			s.Shutdown(err)
 		})
 	}
+	// Delay readiness until the minimum stores are healthy.
+	if warmupMinStores > 0 || warmupMinStoresRatio > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			if err := query.WaitForMinStores(ctx, stores, warmupMinStores, warmupMinStoresRatio, time.Second, warmupTimeout); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				level.Warn(logger).Log("msg", "minimum stores not healthy within warmup timeout, becoming ready anyway", "err", err)
+			}
+			statusProber.Ready()
+
+			<-ctx.Done()
+			return nil
+		}, func(error) {
+			cancel()
+		})
+	}
 
 	level.Info(logger).Log("msg", "starting query node")
 	return nil
 }
 
+// parseFederationEndpoints parses federation endpoints of the form <cluster>=<address> into the addresses per cluster.
+func parseFederationEndpoints(endpoints []string) (map[string][]string, error) {
+	res := make(map[string][]string, len(endpoints))
+	for _, e := range endpoints {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("unrecognized federation endpoint %q, expected <cluster>=<address>", e)
+		}
+		res[parts[0]] = append(res[parts[0]], parts[1])
+	}
+	return res, nil
+}
+
+// parseTenantMaxSeries parses series limits of the form <tenant>=<limit> into the limit per tenant.
+func parseTenantMaxSeries(limits []string) (map[string]int, error) {
+	res := make(map[string]int, len(limits))
+	for _, l := range limits {
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("unrecognized tenant series limit %q, expected <tenant>=<limit>", l)
+		}
+		limit, err := strconv.Atoi(parts[1])
+		if err != nil || limit < 0 {
+			return nil, errors.Errorf("invalid series limit %q of tenant %s, expected a non-negative integer", parts[1], parts[0])
+		}
+		res[parts[0]] = limit
+	}
+	return res, nil
+}
+
 func removeDuplicateStoreSpecs(logger log.Logger, duplicatedStores prometheus.Counter, specs []query.StoreSpec) []query.StoreSpec {
 	set := make(map[string]query.StoreSpec)
 	for _, spec := range specs {
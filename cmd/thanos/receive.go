@@ -62,20 +62,62 @@ func registerReceive(m map[string]setupFunc, app *kingpin.Application) {
 
 	retention := modelDuration(cmd.Flag("tsdb.retention", "How long to retain raw samples on local storage. 0d - disables this retention").Default("15d"))
 
+	tooFarInFuture := modelDuration(cmd.Flag("tsdb.too-far-in-future.time-window", "Maximum duration samples may be ahead of the current time, e.g. due to clients with skewed clocks. Later samples are rejected, while the other samples of the write request are still appended. 0s disables the check.").Default("0s"))
+
 	hashringsFile := cmd.Flag("receive.hashrings-file", "Path to file that contains the hashring configuration.").
 		PlaceHolder("<path>").String()
 
 	refreshInterval := modelDuration(cmd.Flag("receive.hashrings-file-refresh-interval", "Refresh interval to re-read the hashring configuration file. (used as a fallback)").
 		Default("5m"))
 
+	hashringTransitionPeriod := modelDuration(cmd.Flag("receive.hashrings-transition-period", "Duration for which writes to a hashring whose algorithm changed on reload of the hashring configuration are also written to the hashring with its previous algorithm, so the series of the hashring are owned by the nodes of both algorithms during the transition. 0s switches to the new algorithm immediately.").Default("0s"))
+
 	local := cmd.Flag("receive.local-endpoint", "Endpoint of local receive node. Used to identify the local node in the hashring configuration.").String()
 
-	tenantHeader := cmd.Flag("receive.tenant-header", "HTTP header to determine tenant for write requests.").Default(receive.DefaultTenantHeader).String()
+	tenantHeader := cmd.Flag("receive.tenant-header", "HTTP header to determine tenant for write requests. The gRPC metadata key of the same name is used for gRPC write requests.").Default(receive.DefaultTenantHeader).String()
 
-	replicaHeader := cmd.Flag("receive.replica-header", "HTTP header specifying the replica number of a write request.").Default(receive.DefaultReplicaHeader).String()
+	replicaHeader := cmd.Flag("receive.replica-header", "HTTP header specifying the replica number of a write request. The gRPC metadata key of the same name is used for gRPC write requests.").Default(receive.DefaultReplicaHeader).String()
 
 	replicationFactor := cmd.Flag("receive.replication-factor", "How many times to replicate incoming write requests.").Default("1").Uint64()
 
+	replicationTimeout := modelDuration(cmd.Flag("receive.replication-timeout", "Timeout for replication requests to other receive nodes. Replication requests still in flight once the write quorum of a hashring is met are bounded by this timeout. 0s disables the timeout.").Default("5s"))
+
+	seriesIdleTimeout := modelDuration(cmd.Flag("receive.tenant-series-idle-timeout", "Duration after which series that did not receive any samples no longer count towards the series limit of their tenant configured in the hashring configuration. 0s disables eviction of idle series.").Default("2h"))
+
+	idempotencyKeyHeader := cmd.Flag("receive.idempotency-key-header", "HTTP header holding the idempotency key of write requests. Retries of successful requests with the same key are not appended again. The gRPC metadata key of the same name is used for gRPC write requests. Empty disables deduplication of write requests.").Default("").String()
+
+	idempotencyKeyTTL := modelDuration(cmd.Flag("receive.idempotency-key-ttl", "Duration for which the idempotency keys of successful write requests are remembered.").Default("5m"))
+
+	idempotencyKeyCacheSize := cmd.Flag("receive.idempotency-key-cache-size", "Maximum number of idempotency keys remembered per tenant. The least recently used keys are forgotten first.").Default("10000").Int()
+
+	metadataLimit := cmd.Flag("receive.tenant-metadata-limit", "Maximum number of metric metadata entries, i.e. distinct combinations of metric name, type, help and unit, stored per tenant. New entries over the limit are dropped. 0 disables the limit.").Default("10000").Int()
+
+	requestBodySizeLimit := cmd.Flag("receive.request-body-size-limit", "Maximum decompressed size of a single write request. Larger requests are rejected with 413 before they are decompressed. Can be overridden per hashring with request_body_size_limit in the hashring configuration. 0 disables the limit.").Default("0").Bytes()
+
+	requestSeriesLimit := cmd.Flag("receive.request-series-limit", "Maximum number of time series of a single write request. Requests with more series are rejected with 413. Can be overridden per hashring with request_series_limit in the hashring configuration. 0 disables the limit.").Default("0").Uint64()
+
+	labelLimit := cmd.Flag("receive.series-label-limit", "Maximum number of labels of a single series. Series with more labels are rejected, while the other series of the write request are still appended. 0 disables the limit.").Default("0").Int()
+
+	labelNameLengthLimit := cmd.Flag("receive.series-label-name-length-limit", "Maximum length of the label names of a series. Series with longer label names are rejected, while the other series of the write request are still appended. 0 disables the limit.").Default("0").Int()
+
+	labelValueLengthLimit := cmd.Flag("receive.series-label-value-length-limit", "Maximum length of the label values of a series. Series with longer label values are rejected, while the other series of the write request are still appended. 0 disables the limit.").Default("0").Int()
+
+	labelSetSizeLimit := cmd.Flag("receive.series-label-set-size-limit", "Maximum total length of the label names and values of a series. Larger series are rejected, while the other series of the write request are still appended. 0 disables the limit.").Default("0").Bytes()
+
+	backpressureMaxInflight := cmd.Flag("receive.backpressure.max-inflight-requests", "Maximum number of write requests appended concurrently. HTTP write requests over the limit are rejected with 503, a Retry-After header and the X-Thanos-Backpressure-Reason header, so clients back off. Write requests of other receivers count towards the limit, but are not rejected. 0 disables the limit.").Default("0").Int()
+
+	backpressureMaxHeap := cmd.Flag("receive.backpressure.max-heap-size", "Heap size in use above which HTTP write requests are rejected with 503, a Retry-After header and the X-Thanos-Backpressure-Reason header, so clients back off. 0 disables the limit.").Default("0").Bytes()
+
+	backpressureRetryAfter := modelDuration(cmd.Flag("receive.backpressure.retry-after", "Duration clients are asked to wait in the Retry-After header before retrying write requests rejected by backpressure.").Default("5s"))
+
+	requestLogging := cmd.Flag("receive.request-logging", "If true, write requests are logged with their tenant, number of series, samples and metadata entries, decompressed size, duration and outcome.").Default("false").Bool()
+
+	requestLoggingSampleRatio := cmd.Flag("receive.request-logging.sample-ratio", "Ratio of write requests logged when request logging is enabled, between 0 and 1, to avoid flooding the logs of busy receivers.").Default("1").Float64()
+
+	tenantHeartbeat := cmd.Flag("receive.tenant-heartbeat", "If true, the time of the last successful write of every tenant is exposed as thanos_receive_tenant_last_write_timestamp_seconds, so tenants that stopped sending data entirely can be alerted on.").Default("false").Bool()
+
+	tenantHeartbeatStaleTimeout := modelDuration(cmd.Flag("receive.tenant-heartbeat.stale-timeout", "Duration after which the heartbeat series of a tenant that stopped writing is removed and goes stale. Should be longer than the silence alerted on. 0s never removes heartbeat series.").Default("24h"))
+
 	tsdbMinBlockDuration := modelDuration(cmd.Flag("tsdb.min-block-duration", "Min duration for local TSDB blocks").Default("2h").Hidden())
 	tsdbMaxBlockDuration := modelDuration(cmd.Flag("tsdb.max-block-duration", "Max duration for local TSDB blocks").Default("2h").Hidden())
 	ignoreBlockSize := cmd.Flag("shipper.ignore-unequal-block-size", "If true receive will not require min and max block size flags to be set to the same value. Only use this if you want to keep long retention and compaction enabled, as in the worst case it can result in ~2h data loss for your Thanos bucket storage.").Default("false").Hidden().Bool()
@@ -88,6 +130,18 @@ func registerReceive(m map[string]setupFunc, app *kingpin.Application) {
 			return errors.Wrap(err, "parse labels")
 		}
 
+		if *idempotencyKeyHeader != "" && *idempotencyKeyCacheSize <= 0 {
+			return errors.New("--receive.idempotency-key-cache-size must be positive when deduplicating write requests")
+		}
+
+		if *requestLoggingSampleRatio < 0 || *requestLoggingSampleRatio > 1 {
+			return errors.New("--receive.request-logging.sample-ratio must be between 0 and 1")
+		}
+		requestLogSampleRatio := 0.0
+		if *requestLogging {
+			requestLogSampleRatio = *requestLoggingSampleRatio
+		}
+
 		var cw *receive.ConfigWatcher
 		if *hashringsFile != "" {
 			cw, err = receive.NewConfigWatcher(log.With(logger, "component", "config-watcher"), reg, *hashringsFile, *refreshInterval)
@@ -146,7 +200,29 @@ func registerReceive(m map[string]setupFunc, app *kingpin.Application) {
 			*tenantHeader,
 			*replicaHeader,
 			*replicationFactor,
+			time.Duration(*replicationTimeout),
+			time.Duration(*seriesIdleTimeout),
+			*idempotencyKeyHeader,
+			time.Duration(*idempotencyKeyTTL),
+			*idempotencyKeyCacheSize,
+			*metadataLimit,
+			requestLogSampleRatio,
+			uint64(*requestBodySizeLimit),
+			*requestSeriesLimit,
+			*backpressureMaxInflight,
+			uint64(*backpressureMaxHeap),
+			time.Duration(*backpressureRetryAfter),
+			time.Duration(*tooFarInFuture),
+			receive.LabelLimits{
+				LabelsPerSeries:  *labelLimit,
+				LabelNameLength:  *labelNameLengthLimit,
+				LabelValueLength: *labelValueLengthLimit,
+				LabelSetSize:     int(*labelSetSizeLimit),
+			},
 			comp,
+			time.Duration(*hashringTransitionPeriod),
+			*tenantHeartbeat,
+			time.Duration(*tenantHeartbeatStaleTimeout),
 		)
 	}
 }
@@ -181,31 +257,66 @@ func runReceive(
 	tenantHeader string,
 	replicaHeader string,
 	replicationFactor uint64,
+	replicationTimeout time.Duration,
+	seriesIdleTimeout time.Duration,
+	idempotencyKeyHeader string,
+	idempotencyKeyTTL time.Duration,
+	idempotencyKeyCacheSize int,
+	metadataLimit int,
+	requestLogSampleRatio float64,
+	requestBodySizeLimit, requestSeriesLimit uint64,
+	backpressureMaxInflight int,
+	backpressureMaxHeap uint64,
+	backpressureRetryAfter time.Duration,
+	tooFarInFuture time.Duration,
+	labelLimits receive.LabelLimits,
 	comp component.SourceStoreAPI,
+	hashringTransitionPeriod time.Duration,
+	tenantHeartbeat bool,
+	tenantHeartbeatStaleTimeout time.Duration,
 ) error {
 	logger = log.With(logger, "component", "receive")
 	level.Warn(logger).Log("msg", "setting up receive; the Thanos receive component is EXPERIMENTAL, it may break significantly without notice")
 
 	localStorage := &tsdb.ReadyStorage{}
+	// The writer appends to the local storage, which is swapped whenever the DB is reopened.
+	writer := receive.NewWriter(log.With(logger, "component", "receive-writer"), reg, localStorage, tooFarInFuture, labelLimits)
 	rwTLSConfig, err := tls.NewServerConfig(log.With(logger, "protocol", "HTTP"), rwServerCert, rwServerKey, rwServerClientCA)
 	if err != nil {
 		return err
 	}
-	dialOpts, err := extgrpc.StoreClientGRPCOpts(logger, reg, tracer, rwServerCert != "", rwClientCert, rwClientKey, rwClientServerCA, rwClientServerName)
+	dialOpts, err := extgrpc.StoreClientGRPCOpts(logger, reg, tracer, rwServerCert != "", rwClientCert, rwClientKey, rwClientServerCA, rwClientServerName, extgrpc.CompressionNone, extgrpc.KeepaliveConfig{})
 	if err != nil {
 		return err
 	}
 
 	webHandler := receive.NewHandler(log.With(logger, "component", "receive-handler"), &receive.Options{
-		ListenAddress:     rwAddress,
-		Registry:          reg,
-		Endpoint:          endpoint,
-		TenantHeader:      tenantHeader,
-		ReplicaHeader:     replicaHeader,
-		ReplicationFactor: replicationFactor,
-		Tracer:            tracer,
-		TLSConfig:         rwTLSConfig,
-		DialOpts:          dialOpts,
+		ListenAddress:      rwAddress,
+		Registry:           reg,
+		Endpoint:           endpoint,
+		TenantHeader:       tenantHeader,
+		ReplicaHeader:      replicaHeader,
+		ReplicationFactor:  replicationFactor,
+		ReplicationTimeout: replicationTimeout,
+		Tracer:             tracer,
+		TLSConfig:          rwTLSConfig,
+		DialOpts:           dialOpts,
+		SeriesIdleTimeout:  seriesIdleTimeout,
+
+		IdempotencyKeyHeader:    idempotencyKeyHeader,
+		IdempotencyKeyTTL:       idempotencyKeyTTL,
+		IdempotencyKeyCacheSize: idempotencyKeyCacheSize,
+		MetadataLimit:           metadataLimit,
+		RequestLogSampleRatio:   requestLogSampleRatio,
+		RequestBodySizeLimit:    requestBodySizeLimit,
+		RequestSeriesLimit:      requestSeriesLimit,
+
+		BackpressureMaxInflightRequests: backpressureMaxInflight,
+		BackpressureMaxHeapBytes:        backpressureMaxHeap,
+		BackpressureRetryAfter:          backpressureRetryAfter,
+
+		TenantHeartbeat:             tenantHeartbeat,
+		TenantHeartbeatStaleTimeout: tenantHeartbeatStaleTimeout,
 	})
 
 	grpcProbe := prober.NewGRPC()
@@ -295,7 +406,7 @@ func runReceive(
 					}
 					level.Info(logger).Log("msg", "tsdb started")
 					localStorage.Set(db.Get(), startTimeMargin)
-					webHandler.SetWriter(receive.NewWriter(log.With(logger, "component", "receive-writer"), localStorage))
+					webHandler.SetWriter(writer)
 					statusProber.Ready()
 					level.Info(logger).Log("msg", "server is ready to receive web requests")
 					dbReady <- struct{}{}
@@ -324,7 +435,7 @@ func runReceive(
 
 			ctx, cancel := context.WithCancel(context.Background())
 			g.Add(func() error {
-				return receive.HashringFromConfig(ctx, updates, cw)
+				return receive.HashringFromConfig(ctx, updates, cw, hashringTransitionPeriod)
 			}, func(error) {
 				cancel()
 			})
@@ -407,6 +518,7 @@ func runReceive(
 					grpcserver.WithListen(grpcBindAddr),
 					grpcserver.WithGracePeriod(grpcGracePeriod),
 					grpcserver.WithTLSConfig(tlsCfg),
+					grpcserver.WithMetadataServer(webHandler),
 				)
 				startGRPC <- struct{}{}
 			}
@@ -6,6 +6,8 @@ package main
 import (
 	"context"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -22,6 +24,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/extprom"
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
 	"github.com/thanos-io/thanos/pkg/model"
+	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/objstore/client"
 	"github.com/thanos-io/thanos/pkg/prober"
 	"github.com/thanos-io/thanos/pkg/runutil"
@@ -57,14 +60,37 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application) {
 	chunkPoolSize := cmd.Flag("chunk-pool-size", "Maximum size of concurrently allocatable bytes reserved strictly to reuse for chunks in memory.").
 		Default("2GB").Bytes()
 
+	chunksDiskCacheSize := cmd.Flag("store.chunks-disk-cache-size", "Maximum size of the chunk files of blocks kept on local disk in the data directory. Chunk files are downloaded on their first read and evicted least recently read first, "+
+		"so that chunks of hot blocks are read from disk instead of the object storage. 0 disables the cache.").
+		Default("0").Bytes()
+
+	chunksPrefetchBudget := cmd.Flag("store.chunks-prefetch-budget", "Maximum size of the chunk files downloaded into the chunks disk cache after each Series call, ahead of their first read. "+
+		"The chunks of the blocks covering the time range of the same length following the call are prefetched, anticipating e.g. a dashboard moving forward in time. Requires --store.chunks-disk-cache-size. 0 disables prefetching.").
+		Default("0").Bytes()
+
 	maxSampleCount := cmd.Flag("store.grpc.series-sample-limit",
 		"Maximum amount of samples returned via a single Series call. 0 means no limit. NOTE: For efficiency we take 120 as the number of samples in chunk (it cannot be bigger than that), so the actual number of samples might be lower, even though the maximum could be hit.").
 		Default("0").Uint()
 
+	maxChunksPerSeries := cmd.Flag("store.grpc.series-max-chunks-per-series",
+		"Maximum number of chunks of a single series in a block touched by a Series call. Series calls exceeding it are aborted, to stop runaway queries on series with an unexpectedly high number of chunks, e.g. due to churn. 0 means no limit.").
+		Default("0").Uint()
+
+	maxBlocks := cmd.Flag("store.grpc.series-max-blocks",
+		"Maximum number of blocks queried by a single Series call. Series calls exceeding it are aborted before reading any block, to stop queries over broad time ranges from spiking memory and latency. 0 means no limit.").
+		Default("0").Uint()
+
+	reportGaps := cmd.Flag("store.grpc.series-report-gaps",
+		"If true, Series calls return a warning for every time range not covered by any block, e.g. because a block is missing, quarantined or marked for deletion, so that queriers can tell gaps in the data apart from empty results. Only time ranges between the oldest and the newest block of the matching external labels are reported. Cannot be used with --block.shard.").
+		Default("false").Bool()
+
 	maxConcurrent := cmd.Flag("store.grpc.series-max-concurrency", "Maximum number of concurrent Series calls.").Default("20").Int()
 
 	objStoreConfig := regCommonObjStoreFlags(cmd, "", true)
 
+	failoverObjStoreConfig := regCommonObjStoreFlags(cmd, "-failover", false,
+		"Optional read replica of the bucket. Reads and block discovery failing against the primary bucket are run against this bucket instead.")
+
 	syncInterval := cmd.Flag("sync-block-duration", "Repeat interval for syncing the blocks between local and remote view.").
 		Default("3m").Duration()
 
@@ -82,6 +108,15 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application) {
 
 	selectorRelabelConf := regSelectorRelabelFlags(cmd)
 
+	blockShard := cmd.Flag("block.shard", "Shard of the blocks to serve, as <index>/<total>, e.g. 0/3 for the first of three shards. Blocks are assigned to shards by the hash of their ULID, so Store Gateways serving all indexes of the same total together serve all blocks. "+
+		"Empty serves all blocks.").
+		PlaceHolder("<index>/<total>").String()
+
+	seriesRelabelConf := extflag.RegisterPathOrContent(cmd, "store.series-relabel-config",
+		"YAML file that contains relabeling configuration applied to the labels of the series of blocks, without their external labels, as they are returned by Series, LabelNames and LabelValues. "+
+			"It follows native Prometheus relabel-config syntax. Series dropped by it are not returned. See format details: https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config ",
+		false)
+
 	// TODO(bwplotka): Remove in v0.13.0 if no issues.
 	disableIndexHeader := cmd.Flag("store.disable-index-header", "If specified, Store Gateway will use index-cache.json for each block instead of recreating binary index-header").
 		Hidden().Default("false").Bool()
@@ -99,6 +134,22 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application) {
 		"Default is 24h, half of the default value for --delete-delay on compactor.").
 		Default("24h"))
 
+	quarantineFailures := cmd.Flag("store.quarantine-failures", "Number of times a block has to fail to load or to be read before it is quarantined, i.e. excluded from syncs and queries until the quarantine retry interval passed. "+
+		"This keeps the Store Gateway serving the healthy blocks if a block is corrupted. 0 disables the quarantine.").
+		Default("0").Int()
+
+	quarantineRetryInterval := modelDuration(cmd.Flag("store.quarantine-retry-interval", "Duration after which a quarantined block is loaded and queried again. A block failing again after the retry is quarantined right away.").
+		Default("1h"))
+
+	seriesBatchSize := cmd.Flag("store.series-batch-size", "Maximum number of series of a block loaded at once for a Series request. Further series are loaded in batches of this size while the previous ones are sent, "+
+		"which bounds the memory used by requests touching many series at the cost of more object storage requests. 0 loads all series of a block at once.").
+		Default("0").Int()
+
+	decodeConcurrency := cmd.Flag("store.index-decode-concurrency", "Number of goroutines decoding the postings and series of a block within a Series request, "+
+		"which speeds up broad requests touching many postings and series on machines with many cores. Requests to several blocks already run concurrently, "+
+		"so the total number of goroutines is bounded by this value times the number of blocks queried at once. 1 decodes sequentially.").
+		Default("1").Int()
+
 	webExternalPrefix := cmd.Flag("web.external-prefix", "Static prefix for all HTML links and redirect URLs in the bucket web UI interface. Actual endpoints are still served on / or the web.route-prefix. This allows thanos bucket web UI to be served behind a reverse proxy that strips a URL sub-path.").Default("").String()
 	webPrefixHeaderName := cmd.Flag("web.prefix-header", "Name of HTTP request header used for dynamic prefixing of UI links and redirects. This option is ignored if web.external-prefix argument is set. Security risk: enable this option only if a reverse proxy in front of thanos is resetting the header. The --web.prefix-header=X-Forwarded-Prefix option can be useful, for example, if Thanos UI is served via Traefik reverse proxy with PathPrefixStrip option enabled, which sends the stripped prefix value in X-Forwarded-Prefix header. This allows thanos UI to be served on a sub-path.").Default("").String()
 
@@ -108,12 +159,22 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application) {
 				minTime, maxTime)
 		}
 
+		shard, shards, err := parseBlockShard(*blockShard)
+		if err != nil {
+			return errors.Wrap(err, "invalid argument: --block.shard")
+		}
+		if shards > 0 && *reportGaps {
+			// The time ranges of the blocks of other shards would be reported as gaps.
+			return errors.New("invalid argument: --store.grpc.series-report-gaps cannot be used with --block.shard")
+		}
+
 		return runStore(g,
 			logger,
 			reg,
 			tracer,
 			indexCacheConfig,
 			objStoreConfig,
+			failoverObjStoreConfig,
 			*dataDir,
 			*grpcBindAddr,
 			time.Duration(*grpcGracePeriod),
@@ -124,7 +185,11 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application) {
 			time.Duration(*httpGracePeriod),
 			uint64(*indexCacheSize),
 			uint64(*chunkPoolSize),
+			uint64(*chunksDiskCacheSize),
+			uint64(*chunksPrefetchBudget),
 			uint64(*maxSampleCount),
+			uint64(*maxChunksPerSeries),
+			uint64(*maxBlocks),
 			*maxConcurrent,
 			component.Store,
 			debugLogging,
@@ -134,12 +199,20 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application) {
 				MinTime: *minTime,
 				MaxTime: *maxTime,
 			},
+			shard,
+			shards,
 			selectorRelabelConf,
+			seriesRelabelConf,
 			*advertiseCompatibilityLabel,
 			*disableIndexHeader,
 			*enablePostingsCompression,
+			*reportGaps,
 			time.Duration(*consistencyDelay),
 			time.Duration(*ignoreDeletionMarksDelay),
+			*quarantineFailures,
+			time.Duration(*quarantineRetryInterval),
+			*seriesBatchSize,
+			*decodeConcurrency,
 			*webExternalPrefix,
 			*webPrefixHeaderName,
 		)
@@ -154,22 +227,29 @@ func runStore(
 	tracer opentracing.Tracer,
 	indexCacheConfig *extflag.PathOrContent,
 	objStoreConfig *extflag.PathOrContent,
+	failoverObjStoreConfig *extflag.PathOrContent,
 	dataDir string,
 	grpcBindAddr string,
 	grpcGracePeriod time.Duration,
 	grpcCert, grpcKey, grpcClientCA, httpBindAddr string,
 	httpGracePeriod time.Duration,
-	indexCacheSizeBytes, chunkPoolSizeBytes, maxSampleCount uint64,
+	indexCacheSizeBytes, chunkPoolSizeBytes, chunksDiskCacheSizeBytes, chunksPrefetchBudgetBytes, maxSampleCount, maxChunksPerSeries, maxBlocks uint64,
 	maxConcurrency int,
 	component component.Component,
 	verbose bool,
 	syncInterval time.Duration,
 	blockSyncConcurrency int,
 	filterConf *store.FilterConfig,
+	blockShard, blockShards uint64,
 	selectorRelabelConf *extflag.PathOrContent,
-	advertiseCompatibilityLabel, disableIndexHeader, enablePostingsCompression bool,
+	seriesRelabelConf *extflag.PathOrContent,
+	advertiseCompatibilityLabel, disableIndexHeader, enablePostingsCompression, reportGaps bool,
 	consistencyDelay time.Duration,
 	ignoreDeletionMarksDelay time.Duration,
+	quarantineFailures int,
+	quarantineRetryInterval time.Duration,
+	seriesBatchSize int,
+	decodeConcurrency int,
 	externalPrefix, prefixHeader string,
 ) error {
 	grpcProbe := prober.NewGRPC()
@@ -201,11 +281,40 @@ func runStore(
 		return err
 	}
 
-	bkt, err := client.NewBucket(logger, confContentYaml, reg, component.String())
+	failoverConfContentYaml, err := failoverObjStoreConfig.Content()
+	if err != nil {
+		return err
+	}
+
+	bktReg := prometheus.Registerer(reg)
+	if len(failoverConfContentYaml) > 0 {
+		// Both buckets register the same bucket metrics, so they are told apart by their role.
+		bktReg = prometheus.WrapRegistererWith(prometheus.Labels{"failover": "primary"}, reg)
+	}
+	bkt, err := client.NewBucket(logger, confContentYaml, bktReg, component.String())
 	if err != nil {
 		return errors.Wrap(err, "create bucket client")
 	}
 
+	var (
+		readBkt     objstore.BucketReader = bkt
+		failoverBkt objstore.Bucket
+	)
+	if len(failoverConfContentYaml) > 0 {
+		failoverBkt, err = client.NewBucket(logger, failoverConfContentYaml, prometheus.WrapRegistererWith(prometheus.Labels{"failover": "secondary"}, reg), component.String())
+		if err != nil {
+			runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+			return errors.Wrap(err, "create failover bucket client")
+		}
+		readBkt = objstore.BucketReaderWithFailover(bkt, failoverBkt, reg)
+	}
+	closeBuckets := func() {
+		runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+		if failoverBkt != nil {
+			runutil.CloseWithLogOnErr(logger, failoverBkt, "failover bucket client")
+		}
+	}
+
 	relabelContentYaml, err := selectorRelabelConf.Content()
 	if err != nil {
 		return errors.Wrap(err, "get content of relabel configuration")
@@ -216,6 +325,16 @@ func runStore(
 		return err
 	}
 
+	seriesRelabelContentYaml, err := seriesRelabelConf.Content()
+	if err != nil {
+		return errors.Wrap(err, "get content of series relabel configuration")
+	}
+
+	seriesRelabelConfig, err := parseRelabelConfig(seriesRelabelContentYaml)
+	if err != nil {
+		return err
+	}
+
 	indexCacheContentYaml, err := indexCacheConfig.Content()
 	if err != nil {
 		return errors.Wrap(err, "get content of index cache configuration")
@@ -224,7 +343,7 @@ func runStore(
 	// Ensure we close up everything properly.
 	defer func() {
 		if err != nil {
-			runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+			closeBuckets()
 		}
 	}()
 
@@ -243,15 +362,34 @@ func runStore(
 		return errors.Wrap(err, "create index cache")
 	}
 
-	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, bkt, ignoreDeletionMarksDelay)
-	metaFetcher, err := block.NewMetaFetcher(logger, fetcherConcurrency, bkt, dataDir, extprom.WrapRegistererWithPrefix("thanos_", reg),
-		[]block.MetadataFilter{
-			block.NewTimePartitionMetaFilter(filterConf.MinTime, filterConf.MaxTime),
-			block.NewLabelShardedMetaFilter(relabelConfig),
-			block.NewConsistencyDelayMetaFilter(logger, consistencyDelay, extprom.WrapRegistererWithPrefix("thanos_", reg)),
-			ignoreDeletionMarkFilter,
-			block.NewDeduplicateFilter(),
-		}, nil)
+	if chunksPrefetchBudgetBytes > 0 && chunksDiskCacheSizeBytes == 0 {
+		return errors.New("--store.chunks-prefetch-budget requires --store.chunks-disk-cache-size")
+	}
+	storeBkt := readBkt
+	if chunksDiskCacheSizeBytes > 0 {
+		storeBkt, err = storecache.NewChunksDiskCache(logger, reg, readBkt, path.Join(dataDir, "chunks-cache"), chunksDiskCacheSizeBytes)
+		if err != nil {
+			return errors.Wrap(err, "create chunks disk cache")
+		}
+	}
+
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, readBkt, ignoreDeletionMarksDelay)
+	filters := []block.MetadataFilter{
+		block.NewTimePartitionMetaFilter(filterConf.MinTime, filterConf.MaxTime),
+		block.NewLabelShardedMetaFilter(relabelConfig),
+		block.NewConsistencyDelayMetaFilter(logger, consistencyDelay, extprom.WrapRegistererWithPrefix("thanos_", reg)),
+		ignoreDeletionMarkFilter,
+		block.NewDeduplicateFilter(),
+	}
+	if blockShards > 0 {
+		// Sharding applies after deduplication, so that no shard serves blocks compacted into a block of another shard.
+		shardFilter, err := block.NewULIDShardedMetaFilter(blockShard, blockShards)
+		if err != nil {
+			return errors.Wrap(err, "block shard")
+		}
+		filters = append(filters, shardFilter)
+	}
+	metaFetcher, err := block.NewMetaFetcher(logger, fetcherConcurrency, readBkt, dataDir, extprom.WrapRegistererWithPrefix("thanos_", reg), filters, nil)
 	if err != nil {
 		return errors.Wrap(err, "meta fetcher")
 	}
@@ -262,7 +400,7 @@ func runStore(
 	bs, err := store.NewBucketStore(
 		logger,
 		reg,
-		bkt,
+		storeBkt,
 		metaFetcher,
 		dataDir,
 		indexCache,
@@ -275,6 +413,16 @@ func runStore(
 		advertiseCompatibilityLabel,
 		!disableIndexHeader,
 		enablePostingsCompression,
+		ignoreDeletionMarkFilter,
+		quarantineFailures,
+		quarantineRetryInterval,
+		seriesBatchSize,
+		seriesRelabelConfig,
+		maxChunksPerSeries,
+		chunksPrefetchBudgetBytes,
+		maxBlocks,
+		reportGaps,
+		decodeConcurrency,
 	)
 	if err != nil {
 		return errors.Wrap(err, "create object storage store")
@@ -285,7 +433,7 @@ func runStore(
 	{
 		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(func() error {
-			defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+			defer closeBuckets()
 
 			level.Info(logger).Log("msg", "initializing bucket store")
 			begin := time.Now()
@@ -338,6 +486,7 @@ func runStore(
 		compactorView.Register(r, extpromhttp.NewInstrumentationMiddleware(reg))
 		metaFetcher.UpdateOnChange(compactorView.Set)
 		srv.Handle("/", r)
+		srv.Handle("/api/v1/status/index-header-failures", bs.IndexHeaderFailuresHandler())
 	}
 
 	level.Info(logger).Log("msg", "starting store node")
@@ -352,3 +501,24 @@ func parseRelabelConfig(contentYaml []byte) ([]*relabel.Config, error) {
 
 	return relabelConfig, nil
 }
+
+// parseBlockShard parses a block shard given as <index>/<total>. Empty returns zero shards.
+func parseBlockShard(s string) (index, total uint64, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("expected <index>/<total>, got %q", s)
+	}
+	if index, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return 0, 0, errors.Wrap(err, "shard index")
+	}
+	if total, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return 0, 0, errors.Wrap(err, "number of shards")
+	}
+	if total == 0 || index >= total {
+		return 0, 0, errors.Errorf("shard index %d out of range of %d shards", index, total)
+	}
+	return index, total, nil
+}
@@ -0,0 +1,40 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/run"
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestRegisterStore_ReportGapsWithBlockShard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_store_flags")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	app := kingpin.New("thanos", "")
+	cmds := map[string]setupFunc{}
+	registerStore(cmds, app)
+
+	cmd, err := app.Parse([]string{
+		"store",
+		"--objstore.config=type: FILESYSTEM\nconfig:\n  directory: " + dir,
+		"--block.shard=0/2",
+		"--store.grpc.series-report-gaps",
+	})
+	testutil.Ok(t, err)
+
+	err = cmds[cmd](&run.Group{}, log.NewNopLogger(), prometheus.NewRegistry(), opentracing.NoopTracer{}, nil, false)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "--store.grpc.series-report-gaps cannot be used with --block.shard"), "unexpected error %s", err)
+}
@@ -43,6 +43,14 @@ const (
 	DebugMetas = "debug/metas"
 )
 
+// Object metadata of the uploaded block files. Index and chunks are never modified once uploaded,
+// while meta files may be rewritten, e.g. when repairing or relabeling blocks.
+var (
+	metaFileMetadata       = objstore.ObjectMetadata{ContentType: "application/json", CacheControl: "no-cache"}
+	indexCacheFileMetadata = objstore.ObjectMetadata{ContentType: "application/json", CacheControl: "max-age=31536000, immutable"}
+	dataFileMetadata       = objstore.ObjectMetadata{ContentType: "application/octet-stream", CacheControl: "max-age=31536000, immutable"}
+)
+
 // Download downloads directory that is mean to be block directory.
 func Download(ctx context.Context, logger log.Logger, bucket objstore.Bucket, id ulid.ULID, dst string) error {
 	if err := objstore.DownloadDir(ctx, logger, bucket, id.String(), dst); err != nil {
@@ -92,27 +100,27 @@ func Upload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir st
 		return errors.New("empty external labels are not allowed for Thanos block.")
 	}
 
-	if err := objstore.UploadFile(ctx, logger, bkt, path.Join(bdir, MetaFilename), path.Join(DebugMetas, fmt.Sprintf("%s.json", id))); err != nil {
+	if err := objstore.UploadFileWithMetadata(ctx, logger, bkt, path.Join(bdir, MetaFilename), path.Join(DebugMetas, fmt.Sprintf("%s.json", id)), metaFileMetadata); err != nil {
 		return errors.Wrap(err, "upload meta file to debug dir")
 	}
 
-	if err := objstore.UploadDir(ctx, logger, bkt, path.Join(bdir, ChunksDirname), path.Join(id.String(), ChunksDirname)); err != nil {
+	if err := objstore.UploadDirWithMetadata(ctx, logger, bkt, path.Join(bdir, ChunksDirname), path.Join(id.String(), ChunksDirname), dataFileMetadata); err != nil {
 		return cleanUp(logger, bkt, id, errors.Wrap(err, "upload chunks"))
 	}
 
-	if err := objstore.UploadFile(ctx, logger, bkt, path.Join(bdir, IndexFilename), path.Join(id.String(), IndexFilename)); err != nil {
+	if err := objstore.UploadFileWithMetadata(ctx, logger, bkt, path.Join(bdir, IndexFilename), path.Join(id.String(), IndexFilename), dataFileMetadata); err != nil {
 		return cleanUp(logger, bkt, id, errors.Wrap(err, "upload index"))
 	}
 
 	if meta.Thanos.Source == metadata.CompactorSource {
-		if err := objstore.UploadFile(ctx, logger, bkt, path.Join(bdir, IndexCacheFilename), path.Join(id.String(), IndexCacheFilename)); err != nil {
+		if err := objstore.UploadFileWithMetadata(ctx, logger, bkt, path.Join(bdir, IndexCacheFilename), path.Join(id.String(), IndexCacheFilename), indexCacheFileMetadata); err != nil {
 			return cleanUp(logger, bkt, id, errors.Wrap(err, "upload index cache"))
 		}
 	}
 
 	// Meta.json always need to be uploaded as a last item. This will allow to assume block directories without meta file
 	// to be pending uploads.
-	if err := objstore.UploadFile(ctx, logger, bkt, path.Join(bdir, MetaFilename), path.Join(id.String(), MetaFilename)); err != nil {
+	if err := objstore.UploadFileWithMetadata(ctx, logger, bkt, path.Join(bdir, MetaFilename), path.Join(id.String(), MetaFilename), metaFileMetadata); err != nil {
 		return cleanUp(logger, bkt, id, errors.Wrap(err, "upload meta file"))
 	}
 
@@ -148,7 +156,7 @@ func MarkForDeletion(ctx context.Context, logger log.Logger, bkt objstore.Bucket
 		return errors.Wrap(err, "json encode deletion mark")
 	}
 
-	if err := bkt.Upload(ctx, deletionMarkFile, bytes.NewBuffer(deletionMark)); err != nil {
+	if err := objstore.UploadWithMetadata(ctx, bkt, deletionMarkFile, bytes.NewBuffer(deletionMark), metaFileMetadata); err != nil {
 		return errors.Wrapf(err, "upload file %s to bucket", deletionMarkFile)
 	}
 
@@ -176,33 +184,69 @@ func Delete(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid
 	}
 
 	// Delete the bucket, but skip the metaFile as we just deleted that. This is required for eventual object storages (list after write).
-	return deleteDirRec(ctx, logger, bkt, id.String(), func(name string) bool {
-		return name == metaFile
-	})
+	var names []string
+	if err := listDirRec(ctx, bkt, id.String(), func(name string) {
+		if name != metaFile {
+			names = append(names, name)
+		}
+	}); err != nil {
+		return errors.Wrapf(err, "list %s", id.String())
+	}
+	// Buckets supporting batched deletes remove all remaining files with few requests.
+	if err := objstore.DeleteMultiple(ctx, bkt, names); err != nil {
+		return errors.Wrapf(err, "delete files of %s", id.String())
+	}
+	level.Debug(logger).Log("msg", "deleted files", "block", id, "files", len(names), "bucket", bkt.Name())
+	return nil
+}
+
+// Copy copies the files of the block with the given ID from the bucket from into the directory dstDir of the
+// bucket to, e.g. to relocate the block to another prefix or bucket. Within the same bucket, files are copied
+// server-side if the bucket supports it, see objstore.Copier; otherwise they are downloaded and uploaded again.
+// The meta.json file is copied last, so that an interrupted copy leaves a partial block without meta file.
+func Copy(ctx context.Context, logger log.Logger, from objstore.Bucket, id ulid.ULID, to objstore.Bucket, dstDir string) error {
+	metaFile := path.Join(id.String(), MetaFilename)
+	ok, err := from.Exists(ctx, metaFile)
+	if err != nil {
+		return errors.Wrapf(err, "stat %s", metaFile)
+	}
+	if !ok {
+		return errors.Errorf("block %s has no meta file", id)
+	}
+
+	var names []string
+	if err := listDirRec(ctx, from, id.String(), func(name string) {
+		if name != metaFile {
+			names = append(names, name)
+		}
+	}); err != nil {
+		return errors.Wrapf(err, "list %s", id.String())
+	}
+	for _, name := range append(names, metaFile) {
+		if err := objstore.CopyBetween(ctx, from, name, to, path.Join(dstDir, name)); err != nil {
+			return errors.Wrapf(err, "copy %s", name)
+		}
+	}
+	level.Debug(logger).Log("msg", "copied block", "block", id, "files", len(names)+1, "from", from.Name(), "to", to.Name(), "dir", dstDir)
+	return nil
 }
 
-// deleteDirRec removes all objects prefixed with dir from the bucket. It skips objects that return true for the passed keep function.
+// listDirRec calls f for all objects prefixed with dir in the bucket.
 // NOTE: For objects removal use `block.Delete` strictly.
-func deleteDirRec(ctx context.Context, logger log.Logger, bkt objstore.Bucket, dir string, keep func(name string) bool) error {
+func listDirRec(ctx context.Context, bkt objstore.Bucket, dir string, f func(name string)) error {
 	return bkt.Iter(ctx, dir, func(name string) error {
-		// If we hit a directory, call DeleteDir recursively.
+		// If we hit a directory, list it recursively.
 		if strings.HasSuffix(name, objstore.DirDelim) {
-			return deleteDirRec(ctx, logger, bkt, name, keep)
-		}
-		if keep(name) {
-			return nil
-		}
-		if err := bkt.Delete(ctx, name); err != nil {
-			return err
+			return listDirRec(ctx, bkt, name, f)
 		}
-		level.Debug(logger).Log("msg", "deleted file", "file", name, "bucket", bkt.Name())
+		f(name)
 		return nil
 	})
 }
 
 // DownloadMeta downloads only meta file from bucket by block ID.
 // TODO(bwplotka): Differentiate between network error & partial upload.
-func DownloadMeta(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID) (metadata.Meta, error) {
+func DownloadMeta(ctx context.Context, logger log.Logger, bkt objstore.BucketReader, id ulid.ULID) (metadata.Meta, error) {
 	rc, err := bkt.Get(ctx, path.Join(id.String(), MetaFilename))
 	if err != nil {
 		return metadata.Meta{}, errors.Wrapf(err, "meta.json bkt get for %s", id.String())
@@ -19,6 +19,7 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/objstore/inmem"
 	"github.com/thanos-io/thanos/pkg/testutil"
 	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
@@ -176,6 +177,34 @@ func TestUpload(t *testing.T) {
 	}
 }
 
+func TestUpload_ObjectMetadata(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-upload-metadata")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := inmem.NewBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String())))
+	testutil.Ok(t, MarkForDeletion(ctx, log.NewNopLogger(), bkt, b1))
+
+	for name, md := range map[string]objstore.ObjectMetadata{
+		path.Join(DebugMetas, b1.String()+".json"):            metaFileMetadata,
+		path.Join(b1.String(), MetaFilename):                  metaFileMetadata,
+		path.Join(b1.String(), metadata.DeletionMarkFilename): metaFileMetadata,
+		path.Join(b1.String(), IndexFilename):                 dataFileMetadata,
+		path.Join(b1.String(), ChunksDirname, "000001"):       dataFileMetadata,
+	} {
+		testutil.Equals(t, md, bkt.Metadata(name), "metadata of %s", name)
+	}
+	testutil.Equals(t, "application/json", metaFileMetadata.ContentType)
+	testutil.Equals(t, "no-cache", metaFileMetadata.CacheControl)
+}
+
 func TestDelete(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 
@@ -223,6 +252,49 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestCopy(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-copy")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := inmem.NewBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String())))
+
+	files := []string{MetaFilename, IndexFilename, path.Join(ChunksDirname, "000001")}
+
+	// Within the bucket, the files are copied server-side, keeping their metadata.
+	testutil.Ok(t, Copy(ctx, log.NewNopLogger(), bkt, b1, bkt, "relocated"))
+	for _, f := range files {
+		src, dst := path.Join(b1.String(), f), path.Join("relocated", b1.String(), f)
+		testutil.Equals(t, bkt.Objects()[src], bkt.Objects()[dst], "content of %s", dst)
+		testutil.Equals(t, bkt.Metadata(src), bkt.Metadata(dst), "metadata of %s", dst)
+	}
+
+	// Between buckets, the files are downloaded and uploaded again.
+	other := inmem.NewBucket()
+	testutil.Ok(t, Copy(ctx, log.NewNopLogger(), bkt, b1, other, ""))
+	testutil.Equals(t, len(files), len(other.Objects()))
+	for _, f := range files {
+		name := path.Join(b1.String(), f)
+		testutil.Equals(t, bkt.Objects()[name], other.Objects()[name], "content of %s", name)
+	}
+
+	// Partial blocks without meta file are not copied.
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(b1.String(), MetaFilename)))
+	err = Copy(ctx, log.NewNopLogger(), bkt, b1, bkt, "partial")
+	testutil.NotOk(t, err)
+	testutil.Equals(t, fmt.Sprintf("block %s has no meta file", b1), err.Error())
+}
+
 func TestMarkForDeletion(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 
@@ -273,3 +345,67 @@ func TestMarkForDeletion(t *testing.T) {
 		testutil.Equals(t, fmt.Sprintf("file %s already exists in bucket", path.Join(blockWithDeletionMark.String(), metadata.DeletionMarkFilename)), err.Error())
 	}
 }
+
+func TestCheckObjects(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-check-objects")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	uploadBlock := func(bkt objstore.Bucket) ulid.ULID {
+		id, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+			{{Name: "a", Value: "1"}},
+			{{Name: "a", Value: "2"}},
+			{{Name: "b", Value: "1"}},
+		}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124)
+		testutil.Ok(t, err)
+		testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, id.String())))
+		return id
+	}
+
+	t.Run("complete block", func(t *testing.T) {
+		bkt := inmem.NewBucket()
+		id := uploadBlock(bkt)
+
+		report, err := CheckObjects(ctx, log.NewNopLogger(), bkt, id)
+		testutil.Ok(t, err)
+		testutil.Assert(t, report.OK(), "unexpected report %s", report)
+	})
+	t.Run("missing chunks", func(t *testing.T) {
+		bkt := inmem.NewBucket()
+		id := uploadBlock(bkt)
+		testutil.Ok(t, bkt.Delete(ctx, path.Join(id.String(), ChunksDirname, "000001")))
+
+		report, err := CheckObjects(ctx, log.NewNopLogger(), bkt, id)
+		testutil.Ok(t, err)
+		testutil.Equals(t, ObjectsReport{Missing: []string{"chunks/000001"}}, report)
+	})
+	t.Run("missing chunk segment before the last one", func(t *testing.T) {
+		bkt := inmem.NewBucket()
+		id := uploadBlock(bkt)
+		testutil.Ok(t, bkt.Copy(ctx, path.Join(id.String(), ChunksDirname, "000001"), path.Join(id.String(), ChunksDirname, "000003")))
+
+		report, err := CheckObjects(ctx, log.NewNopLogger(), bkt, id)
+		testutil.Ok(t, err)
+		testutil.Equals(t, ObjectsReport{Missing: []string{"chunks/000002"}}, report)
+	})
+	t.Run("missing meta and truncated index", func(t *testing.T) {
+		bkt := inmem.NewBucket()
+		id := uploadBlock(bkt)
+		testutil.Ok(t, bkt.Delete(ctx, path.Join(id.String(), MetaFilename)))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), IndexFilename), strings.NewReader("")))
+
+		report, err := CheckObjects(ctx, log.NewNopLogger(), bkt, id)
+		testutil.Ok(t, err)
+		testutil.Equals(t, ObjectsReport{Missing: []string{MetaFilename}, Truncated: []string{IndexFilename}}, report)
+		testutil.Assert(t, !report.OK(), "expected failed report")
+	})
+	t.Run("block not in bucket", func(t *testing.T) {
+		report, err := CheckObjects(ctx, log.NewNopLogger(), inmem.NewBucket(), ulid.MustNew(1, nil))
+		testutil.Ok(t, err)
+		testutil.Equals(t, ObjectsReport{Missing: []string{IndexFilename, MetaFilename}}, report)
+	})
+}
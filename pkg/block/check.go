@@ -0,0 +1,113 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// ObjectsReport is the result of the check of the objects of a block in the bucket. Object names are relative
+// to the block directory, e.g. "chunks/000001".
+type ObjectsReport struct {
+	// Missing are the objects of the block that are not present in the bucket.
+	Missing []string
+	// Truncated are the objects of the block that are present in the bucket, but empty.
+	Truncated []string
+}
+
+// OK returns true if no objects of the block are missing or truncated.
+func (r ObjectsReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Truncated) == 0
+}
+
+func (r ObjectsReport) String() string {
+	if r.OK() {
+		return "all objects present"
+	}
+	return fmt.Sprintf("missing objects: %v, truncated objects: %v", r.Missing, r.Truncated)
+}
+
+// CheckObjects verifies that all objects of the block with the given ID are present in the bucket and not empty,
+// e.g. before the block is used after a partial upload or an incomplete replication.
+// The meta file does not list the files of the block, so the expected objects are derived from the block layout:
+// the meta file, the index and the chunk segments, which are numbered consecutively from 000001 up to the highest
+// listed segment. At least one chunk segment is expected if the meta file reports any chunks.
+// Errors are only returned if the bucket cannot be listed or the meta file cannot be read.
+func CheckObjects(ctx context.Context, logger log.Logger, bkt objstore.BucketReader, id ulid.ULID) (ObjectsReport, error) {
+	sizes := map[string]int64{}
+	if err := listDirRecWithAttributes(ctx, bkt, id.String()+objstore.DirDelim, func(name string, attrs objstore.ObjectAttributes) {
+		sizes[strings.TrimPrefix(name, id.String()+objstore.DirDelim)] = attrs.Size
+	}); err != nil {
+		return ObjectsReport{}, errors.Wrapf(err, "list objects of block %s", id)
+	}
+
+	expected := []string{MetaFilename, IndexFilename}
+
+	lastSegment := 0
+	for name := range sizes {
+		dir, file := path.Split(name)
+		if dir != ChunksDirname+objstore.DirDelim {
+			continue
+		}
+		seq, err := strconv.Atoi(file)
+		if err != nil {
+			continue
+		}
+		if seq > lastSegment {
+			lastSegment = seq
+		}
+	}
+	if lastSegment == 0 {
+		if _, ok := sizes[MetaFilename]; ok {
+			meta, err := DownloadMeta(ctx, logger, bkt, id)
+			if err != nil {
+				return ObjectsReport{}, err
+			}
+			if meta.Stats.NumChunks > 0 {
+				lastSegment = 1
+			}
+		}
+	}
+	for seq := 1; seq <= lastSegment; seq++ {
+		expected = append(expected, path.Join(ChunksDirname, fmt.Sprintf("%06d", seq)))
+	}
+
+	var report ObjectsReport
+	for _, name := range expected {
+		size, ok := sizes[name]
+		if !ok {
+			report.Missing = append(report.Missing, name)
+			continue
+		}
+		if size <= 0 {
+			report.Truncated = append(report.Truncated, name)
+		}
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.Truncated)
+	return report, nil
+}
+
+// listDirRecWithAttributes calls f for all objects below the given directory with their attributes.
+func listDirRecWithAttributes(ctx context.Context, bkt objstore.BucketReader, dir string, f func(name string, attrs objstore.ObjectAttributes)) error {
+	return objstore.IterWithAttributes(ctx, bkt, dir, func(name string, attrs objstore.ObjectAttributes) error {
+		// If we hit a directory, list it recursively.
+		if strings.HasSuffix(name, objstore.DirDelim) {
+			return listDirRecWithAttributes(ctx, bkt, name, f)
+		}
+		f(name, attrs)
+		return nil
+	})
+}
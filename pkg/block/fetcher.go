@@ -14,6 +14,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/cespare/xxhash"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/golang/groupcache/singleflight"
@@ -64,6 +65,7 @@ const (
 	// Synced label values.
 	labelExcludedMeta = "label-excluded"
 	timeExcludedMeta  = "time-excluded"
+	shardExcludedMeta = "shard-excluded"
 	tooFreshMeta      = "too-fresh"
 	duplicateMeta     = "duplicate"
 	// Blocks that are marked for deletion can be loaded as well. This is done to make sure that we load blocks that are meant to be deleted,
@@ -108,6 +110,7 @@ func newFetcherMetrics(reg prometheus.Registerer) *fetcherMetrics {
 		[]string{failedMeta},
 		[]string{labelExcludedMeta},
 		[]string{timeExcludedMeta},
+		[]string{shardExcludedMeta},
 		[]string{duplicateMeta},
 		[]string{markedForDeletionMeta},
 	)
@@ -542,6 +545,40 @@ func (f *LabelShardedMetaFilter) Filter(_ context.Context, metas map[ulid.ULID]*
 	return nil
 }
 
+var _ MetadataFilter = &ULIDShardedMetaFilter{}
+
+// ULIDShardedMetaFilter is a BaseFetcher filter that filters out blocks not belonging to its shard of all blocks.
+// Blocks are assigned to shards by the hash of their ULID, so the shard of a block never changes and shards
+// of all indexes are disjoint and together cover all blocks.
+type ULIDShardedMetaFilter struct {
+	index, total uint64
+}
+
+// NewULIDShardedMetaFilter creates ULIDShardedMetaFilter keeping the blocks of the shard with the given index
+// out of total shards.
+func NewULIDShardedMetaFilter(index, total uint64) (*ULIDShardedMetaFilter, error) {
+	if total == 0 || index >= total {
+		return nil, errors.Errorf("invalid shard %d out of %d shards", index, total)
+	}
+	return &ULIDShardedMetaFilter{index: index, total: total}, nil
+}
+
+// Filter filters out blocks whose ULID hash does not belong to the shard.
+func (f *ULIDShardedMetaFilter) Filter(_ context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec, _ bool) error {
+	for id := range metas {
+		if ulidShard(id, f.total) != f.index {
+			synced.WithLabelValues(shardExcludedMeta).Inc()
+			delete(metas, id)
+		}
+	}
+	return nil
+}
+
+// ulidShard returns the index of the shard the block with the given ULID belongs to out of total shards.
+func ulidShard(id ulid.ULID, total uint64) uint64 {
+	return xxhash.Sum64(id[:]) % total
+}
+
 var _ MetadataFilter = &DeduplicateFilter{}
 
 // DeduplicateFilter is a BaseFetcher filter that filters out older blocks that have exactly the same data.
@@ -758,6 +795,11 @@ func (f *IgnoreDeletionMarkFilter) DeletionMarkBlocks() map[ulid.ULID]*metadata.
 	return f.deletionMarkMap
 }
 
+// Delay returns the duration after which blocks marked for deletion are filtered out.
+func (f *IgnoreDeletionMarkFilter) Delay() time.Duration {
+	return f.delay
+}
+
 // Filter filters out blocks that are marked for deletion after a given delay.
 // It also returns the blocks that can be deleted since they were uploaded delay duration before current time.
 func (f *IgnoreDeletionMarkFilter) Filter(ctx context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec, _ bool) error {
@@ -463,6 +463,57 @@ func TestLabelShardedMetaFilter_Filter_Hashmod(t *testing.T) {
 	}
 }
 
+func TestULIDShardedMetaFilter_Filter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	input := func(n int) map[ulid.ULID]*metadata.Meta {
+		metas := map[ulid.ULID]*metadata.Meta{}
+		for i := 1; i <= n; i++ {
+			metas[ULID(i)] = &metadata.Meta{}
+		}
+		return metas
+	}
+
+	_, err := NewULIDShardedMetaFilter(3, 3)
+	testutil.NotOk(t, err)
+	_, err = NewULIDShardedMetaFilter(0, 0)
+	testutil.NotOk(t, err)
+
+	const shards = 3
+	seen := map[ulid.ULID]uint64{}
+	for i := uint64(0); i < shards; i++ {
+		f, err := NewULIDShardedMetaFilter(i, shards)
+		testutil.Ok(t, err)
+
+		metas := input(100)
+		m := newTestFetcherMetrics()
+		testutil.Ok(t, f.Filter(ctx, metas, m.synced, false))
+		testutil.Assert(t, len(metas) > 0, "expected shard %d to keep blocks", i)
+		testutil.Equals(t, float64(100-len(metas)), promtest.ToFloat64(m.synced.WithLabelValues(shardExcludedMeta)))
+
+		for id := range metas {
+			other, ok := seen[id]
+			testutil.Assert(t, !ok, "block %s kept by shards %d and %d", id, other, i)
+			seen[id] = i
+		}
+
+		// Adding blocks does not change the shard of existing blocks.
+		more := input(200)
+		testutil.Ok(t, f.Filter(ctx, more, newTestFetcherMetrics().synced, false))
+		for id := range metas {
+			_, ok := more[id]
+			testutil.Assert(t, ok, "block %s moved from shard %d", id, i)
+		}
+		for id := range more {
+			if _, ok := metas[id]; !ok {
+				testutil.Assert(t, id.Time() > 100, "block %s moved to shard %d", id, i)
+			}
+		}
+	}
+	testutil.Equals(t, 100, len(seen))
+}
+
 func TestTimePartitionMetaFilter_Filter(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
 	defer cancel()
@@ -15,6 +15,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"sync"
 	"time"
 	"unsafe"
 
@@ -398,10 +399,47 @@ func (w *binaryWriter) Close() error {
 }
 
 type postingValueOffsets struct {
-	offsets       []postingOffset
+	// Offset of the first entry of the label name in posting offset table and the number of its entries,
+	// used to read the sampled offsets on first access.
+	firstTableOff int
+	count         int
+
+	once    sync.Once
+	offsets []postingOffset
+	err     error
+
 	lastValOffset int64
 }
 
+// load returns every nth label value's position in the offset table (plus the first and last one),
+// reading them from the given index-header posting offset table on the first call.
+func (e *postingValueOffsets) load(b index.ByteSlice, postingsOffsetTable uint64) ([]postingOffset, error) {
+	e.once.Do(func() {
+		// Don't Crc32 the entire postings offset table, it was verified on open.
+		d := encoding.NewDecbufAt(b, int(postingsOffsetTable), nil)
+		startLen := d.Len()
+		d.Skip(e.firstTableOff)
+
+		offsets := make([]postingOffset, 0, (e.count-1)/symbolFactor+2)
+		for i := 0; i < e.count && d.Err() == nil; i++ {
+			tableOff := startLen - d.Len()
+			d.Uvarint()           // Keycount.
+			d.UvarintBytes()      // Label name.
+			v := d.UvarintBytes() // Label value.
+			d.Uvarint64()         // Offset.
+			if i%symbolFactor == 0 || i == e.count-1 {
+				offsets = append(offsets, postingOffset{value: string(v), tableOff: tableOff})
+			}
+		}
+		if d.Err() != nil {
+			e.err = errors.Wrap(d.Err(), "read postings offset entries")
+			return
+		}
+		e.offsets = offsets
+	})
+	return e.offsets, e.err
+}
+
 type postingOffset struct {
 	// label value.
 	value string
@@ -409,6 +447,9 @@ type postingOffset struct {
 	tableOff int
 }
 
+// BinaryReader reads the index-header binary file. Only the header and the label names are read on open,
+// while the symbols and posting offsets are loaded on first access and cached, so that the memory used by
+// blocks depends on the parts of their index-header that are actually queried.
 type BinaryReader struct {
 	b   index.ByteSlice
 	toc *BinaryTOC
@@ -419,12 +460,17 @@ type BinaryReader struct {
 	// Map of LabelName to a list of some LabelValues's position in the offset table.
 	// The first and last values for each name are always present.
 	postings map[string]*postingValueOffsets
+
 	// For the v1 format, labelname -> labelvalue -> offset.
-	postingsV1 map[string]map[string]index.Range
+	postingsV1Once sync.Once
+	postingsV1     map[string]map[string]index.Range
+	postingsV1Err  error
 
+	symbolsOnce sync.Once
 	symbols     *index.Symbols
 	nameSymbols map[uint32]string // Cache of the label name symbol lookups,
 	// as there are not many and they are half of all lookups.
+	symbolsErr error
 
 	dec *index.Decoder
 
@@ -491,18 +537,75 @@ func newFileBinaryReader(path string) (bw *BinaryReader, err error) {
 		return nil, errors.Wrap(err, "read index header TOC")
 	}
 
-	r.symbols, err = index.NewSymbols(r.b, r.indexVersion, int(r.toc.Symbols))
-	if err != nil {
-		return nil, errors.Wrap(err, "read symbols")
+	// Only keep the label names and where their entries are in the postings offset table, the offsets
+	// themselves are read on first access. This verifies the checksum of the table as well.
+	var last *postingValueOffsets
+	if err := index.ReadOffsetTable(r.b, r.toc.PostingsOffsetTable, func(key []string, off uint64, tableOff int) error {
+		if len(key) != 2 {
+			return errors.Errorf("unexpected key length for posting table %d", len(key))
+		}
+
+		e, ok := r.postings[key[0]]
+		if !ok {
+			// Next label name.
+			if last != nil {
+				last.lastValOffset = int64(off - crc32.Size)
+			}
+			e = &postingValueOffsets{firstTableOff: tableOff}
+			r.postings[key[0]] = e
+			last = e
+		}
+		e.count++
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "read postings table")
+	}
+	if last != nil {
+		last.lastValOffset = r.indexLastPostingEnd - crc32.Size
 	}
 
-	var lastKey []string
-	if r.indexVersion == index.FormatV1 {
+	r.dec = &index.Decoder{LookupSymbol: r.LookupSymbol}
+
+	return r, nil
+}
+
+// loadSymbols reads the symbol table on first use.
+func (r *BinaryReader) loadSymbols() error {
+	r.symbolsOnce.Do(func() {
+		symbols, err := index.NewSymbols(r.b, r.indexVersion, int(r.toc.Symbols))
+		if err != nil {
+			r.symbolsErr = errors.Wrap(err, "read symbols")
+			return
+		}
+
+		nameSymbols := make(map[uint32]string, len(r.postings))
+		for k := range r.postings {
+			if k == "" {
+				continue
+			}
+			off, err := symbols.ReverseLookup(k)
+			if err != nil {
+				r.symbolsErr = errors.Wrap(err, "reverse symbol lookup")
+				return
+			}
+			nameSymbols[off] = k
+		}
+		r.symbols, r.nameSymbols = symbols, nameSymbols
+	})
+	return r.symbolsErr
+}
+
+// loadPostingsV1 reads the whole postings offset table of index format V1 on first use.
+func (r *BinaryReader) loadPostingsV1() error {
+	r.postingsV1Once.Do(func() {
 		// Earlier V1 formats don't have a sorted postings offset table, so
 		// load the whole offset table into memory.
-		r.postingsV1 = map[string]map[string]index.Range{}
+		postingsV1 := map[string]map[string]index.Range{}
 
-		var prevRng index.Range
+		var (
+			lastKey []string
+			prevRng index.Range
+		)
 		if err := index.ReadOffsetTable(r.b, r.toc.PostingsOffsetTable, func(key []string, off uint64, _ int) error {
 			if len(key) != 2 {
 				return errors.Errorf("unexpected key length for posting table %d", len(key))
@@ -510,90 +613,27 @@ func newFileBinaryReader(path string) (bw *BinaryReader, err error) {
 
 			if lastKey != nil {
 				prevRng.End = int64(off - crc32.Size)
-				r.postingsV1[lastKey[0]][lastKey[1]] = prevRng
+				postingsV1[lastKey[0]][lastKey[1]] = prevRng
 			}
 
-			if _, ok := r.postingsV1[key[0]]; !ok {
-				r.postingsV1[key[0]] = map[string]index.Range{}
-				r.postings[key[0]] = nil // Used to get a list of labelnames in places.
+			if _, ok := postingsV1[key[0]]; !ok {
+				postingsV1[key[0]] = map[string]index.Range{}
 			}
 
 			lastKey = key
 			prevRng = index.Range{Start: int64(off + postingLengthFieldSize)}
 			return nil
 		}); err != nil {
-			return nil, errors.Wrap(err, "read postings table")
+			r.postingsV1Err = errors.Wrap(err, "read postings table")
+			return
 		}
 		if lastKey != nil {
 			prevRng.End = r.indexLastPostingEnd - crc32.Size
-			r.postingsV1[lastKey[0]][lastKey[1]] = prevRng
-		}
-	} else {
-		lastTableOff := 0
-		valueCount := 0
-
-		// For the postings offset table we keep every label name but only every nth
-		// label value (plus the first and last one), to save memory.
-		if err := index.ReadOffsetTable(r.b, r.toc.PostingsOffsetTable, func(key []string, off uint64, tableOff int) error {
-			if len(key) != 2 {
-				return errors.Errorf("unexpected key length for posting table %d", len(key))
-			}
-
-			if _, ok := r.postings[key[0]]; !ok {
-				// Next label name.
-				r.postings[key[0]] = &postingValueOffsets{}
-				if lastKey != nil {
-					if valueCount%symbolFactor != 0 {
-						// Always include last value for each label name.
-						r.postings[lastKey[0]].offsets = append(r.postings[lastKey[0]].offsets, postingOffset{value: lastKey[1], tableOff: lastTableOff})
-					}
-					r.postings[lastKey[0]].lastValOffset = int64(off - crc32.Size)
-					lastKey = nil
-				}
-				valueCount = 0
-			}
-
-			lastKey = key
-			if valueCount%symbolFactor == 0 {
-				r.postings[key[0]].offsets = append(r.postings[key[0]].offsets, postingOffset{value: key[1], tableOff: tableOff})
-				return nil
-			}
-
-			lastTableOff = tableOff
-			valueCount++
-			return nil
-		}); err != nil {
-			return nil, errors.Wrap(err, "read postings table")
-		}
-		if lastKey != nil {
-			if valueCount%symbolFactor != 0 {
-				r.postings[lastKey[0]].offsets = append(r.postings[lastKey[0]].offsets, postingOffset{value: lastKey[1], tableOff: lastTableOff})
-			}
-			r.postings[lastKey[0]].lastValOffset = r.indexLastPostingEnd - crc32.Size
-		}
-		// Trim any extra space in the slices.
-		for k, v := range r.postings {
-			l := make([]postingOffset, len(v.offsets))
-			copy(l, v.offsets)
-			r.postings[k].offsets = l
-		}
-	}
-
-	r.nameSymbols = make(map[uint32]string, len(r.postings))
-	for k := range r.postings {
-		if k == "" {
-			continue
+			postingsV1[lastKey[0]][lastKey[1]] = prevRng
 		}
-		off, err := r.symbols.ReverseLookup(k)
-		if err != nil {
-			return nil, errors.Wrap(err, "reverse symbol lookup")
-		}
-		r.nameSymbols[off] = k
-	}
-
-	r.dec = &index.Decoder{LookupSymbol: r.LookupSymbol}
-
-	return r, nil
+		r.postingsV1 = postingsV1
+	})
+	return r.postingsV1Err
 }
 
 // newBinaryTOCFromByteSlice return parsed TOC from given index header byte slice.
@@ -620,12 +660,12 @@ func newBinaryTOCFromByteSlice(bs index.ByteSlice) (*BinaryTOC, error) {
 	}, nil
 }
 
-func (r BinaryReader) IndexVersion() int {
+func (r *BinaryReader) IndexVersion() int {
 	return r.indexVersion
 }
 
 // TODO(bwplotka): Get advantage of multi value offset fetch.
-func (r BinaryReader) PostingsOffset(name string, value string) (index.Range, error) {
+func (r *BinaryReader) PostingsOffset(name string, value string) (index.Range, error) {
 	rngs, err := r.postingsOffset(name, value)
 	if err != nil {
 		return index.Range{}, err
@@ -636,9 +676,12 @@ func (r BinaryReader) PostingsOffset(name string, value string) (index.Range, er
 	return rngs[0], nil
 }
 
-func (r BinaryReader) postingsOffset(name string, values ...string) ([]index.Range, error) {
+func (r *BinaryReader) postingsOffset(name string, values ...string) ([]index.Range, error) {
 	rngs := make([]index.Range, 0, len(values))
 	if r.indexVersion == index.FormatV1 {
+		if err := r.loadPostingsV1(); err != nil {
+			return nil, err
+		}
 		e, ok := r.postingsV1[name]
 		if !ok {
 			return nil, nil
@@ -662,9 +705,14 @@ func (r BinaryReader) postingsOffset(name string, values ...string) ([]index.Ran
 		return nil, nil
 	}
 
+	offsets, err := e.load(r.b, r.toc.PostingsOffsetTable)
+	if err != nil {
+		return nil, err
+	}
+
 	skip := 0
 	valueIndex := 0
-	for valueIndex < len(values) && values[valueIndex] < e.offsets[0].value {
+	for valueIndex < len(values) && values[valueIndex] < offsets[0].value {
 		// Discard values before the start.
 		valueIndex++
 	}
@@ -673,19 +721,19 @@ func (r BinaryReader) postingsOffset(name string, values ...string) ([]index.Ran
 	for valueIndex < len(values) {
 		value := values[valueIndex]
 
-		i := sort.Search(len(e.offsets), func(i int) bool { return e.offsets[i].value >= value })
-		if i == len(e.offsets) {
+		i := sort.Search(len(offsets), func(i int) bool { return offsets[i].value >= value })
+		if i == len(offsets) {
 			// We're past the end.
 			break
 		}
-		if i > 0 && e.offsets[i].value != value {
+		if i > 0 && offsets[i].value != value {
 			// Need to look from previous entry.
 			i--
 		}
 		// Don't Crc32 the entire postings offset table, this is very slow
 		// so hope any issues were caught at startup.
 		d := encoding.NewDecbufAt(r.b, int(r.toc.PostingsOffsetTable), nil)
-		d.Skip(e.offsets[i].tableOff)
+		d.Skip(offsets[i].tableOff)
 
 		tmpRngs = tmpRngs[:0]
 		// Iterate on the offset table.
@@ -712,7 +760,7 @@ func (r BinaryReader) postingsOffset(name string, values ...string) ([]index.Ran
 				}
 				value = values[valueIndex]
 			}
-			if i+1 == len(e.offsets) {
+			if i+1 == len(offsets) {
 				for i := range tmpRngs {
 					tmpRngs[i].End = e.lastValOffset
 				}
@@ -721,7 +769,7 @@ func (r BinaryReader) postingsOffset(name string, values ...string) ([]index.Ran
 				break
 			}
 
-			if value >= e.offsets[i+1].value || valueIndex == len(values) {
+			if value >= offsets[i+1].value || valueIndex == len(values) {
 				d.Skip(skip)
 				d.UvarintBytes()                      // Label value.
 				postingOffset := int64(d.Uvarint64()) // Offset.
@@ -741,7 +789,10 @@ func (r BinaryReader) postingsOffset(name string, values ...string) ([]index.Ran
 	return rngs, nil
 }
 
-func (r BinaryReader) LookupSymbol(o uint32) (string, error) {
+func (r *BinaryReader) LookupSymbol(o uint32) (string, error) {
+	if err := r.loadSymbols(); err != nil {
+		return "", err
+	}
 	if s, ok := r.nameSymbols[o]; ok {
 		return s, nil
 	}
@@ -755,8 +806,11 @@ func (r BinaryReader) LookupSymbol(o uint32) (string, error) {
 	return r.symbols.Lookup(o)
 }
 
-func (r BinaryReader) LabelValues(name string) ([]string, error) {
+func (r *BinaryReader) LabelValues(name string) ([]string, error) {
 	if r.indexVersion == index.FormatV1 {
+		if err := r.loadPostingsV1(); err != nil {
+			return nil, err
+		}
 		e, ok := r.postingsV1[name]
 		if !ok {
 			return nil, nil
@@ -773,17 +827,17 @@ func (r BinaryReader) LabelValues(name string) ([]string, error) {
 	if !ok {
 		return nil, nil
 	}
-	if len(e.offsets) == 0 {
+	if e.count == 0 {
 		return nil, nil
 	}
-	values := make([]string, 0, len(e.offsets)*symbolFactor)
+	values := make([]string, 0, e.count)
 
+	// The entries of a label name are consecutive, so there is no need to load its sampled offsets.
 	d := encoding.NewDecbufAt(r.b, int(r.toc.PostingsOffsetTable), nil)
-	d.Skip(e.offsets[0].tableOff)
-	lastVal := e.offsets[len(e.offsets)-1].value
+	d.Skip(e.firstTableOff)
 
 	skip := 0
-	for d.Err() == nil {
+	for d.Err() == nil && len(values) < e.count {
 		if skip == 0 {
 			// These are always the same number of bytes,
 			// and it's faster to skip than parse.
@@ -794,12 +848,8 @@ func (r BinaryReader) LabelValues(name string) ([]string, error) {
 		} else {
 			d.Skip(skip)
 		}
-		s := yoloString(d.UvarintBytes()) // Label value.
-		values = append(values, s)
-		if s == lastVal {
-			break
-		}
-		d.Uvarint64() // Offset.
+		values = append(values, yoloString(d.UvarintBytes())) // Label value.
+		d.Uvarint64()                                         // Offset.
 	}
 	if d.Err() != nil {
 		return nil, errors.Wrap(d.Err(), "get postings offset entry")
@@ -811,7 +861,7 @@ func yoloString(b []byte) string {
 	return *((*string)(unsafe.Pointer(&b)))
 }
 
-func (r BinaryReader) LabelNames() []string {
+func (r *BinaryReader) LabelNames() []string {
 	allPostingsKeyName, _ := index.AllPostingsKey()
 	labelNames := make([]string, 0, len(r.postings))
 	for name := range r.postings {
@@ -10,6 +10,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/go-kit/kit/log"
@@ -26,6 +27,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/runutil"
 	"github.com/thanos-io/thanos/pkg/testutil"
 	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+	"golang.org/x/sync/errgroup"
 )
 
 func TestReaders(t *testing.T) {
@@ -97,18 +99,28 @@ func TestReaders(t *testing.T) {
 
 				defer func() { testutil.Ok(t, br.Close()) }()
 
+				// Only label names are read on open, everything else is loaded on first access.
+				testutil.Assert(t, br.symbols == nil, "symbols should not be loaded on open")
+				testutil.Assert(t, br.postingsV1 == nil, "v1 postings should not be loaded on open")
+				for name, e := range br.postings {
+					testutil.Assert(t, e.offsets == nil, "postings offsets of %q should not be loaded on open", name)
+				}
+
 				if id == id1 {
 					testutil.Equals(t, 1, br.version)
 					testutil.Equals(t, 2, br.indexVersion)
 					testutil.Equals(t, &BinaryTOC{Symbols: headerLen, PostingsOffsetTable: 50}, br.toc)
 					testutil.Equals(t, int64(330), br.indexLastPostingEnd)
-					testutil.Equals(t, 8, br.symbols.Size())
 					testutil.Equals(t, 3, len(br.postings))
-					testutil.Equals(t, 0, len(br.postingsV1))
-					testutil.Equals(t, 2, len(br.nameSymbols))
 				}
 
 				compareIndexToHeader(t, b, br)
+
+				if id == id1 {
+					testutil.Equals(t, 8, br.symbols.Size())
+					testutil.Equals(t, 0, len(br.postingsV1))
+					testutil.Equals(t, 2, len(br.nameSymbols))
+				}
 			})
 
 			t.Run("json", func(t *testing.T) {
@@ -232,6 +244,94 @@ func compareIndexToHeader(t *testing.T, indexByteSlice index.ByteSlice, headerRe
 	testutil.NotOk(t, err)
 }
 
+func TestBinaryReader_LazyLoading(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-indexheader")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt, err := filesystem.NewBucket(filepath.Join(tmpDir, "bkt"))
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bkt.Close()) }()
+
+	m := prepareIndexV2Block(t, tmpDir, bkt)
+	fn := filepath.Join(tmpDir, m.ULID.String(), block.IndexHeaderFilename)
+	testutil.Ok(t, WriteBinary(ctx, bkt, m.ULID, fn))
+
+	full, err := newFileBinaryReader(fn)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, full.Close()) }()
+	testutil.Ok(t, loadAll(full))
+
+	lazy, err := newFileBinaryReader(fn)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, lazy.Close()) }()
+
+	names := full.LabelNames()
+	testutil.Equals(t, names, lazy.LabelNames())
+
+	// Access all label names concurrently, to make sure sections are loaded exactly once.
+	g, _ := errgroup.WithContext(ctx)
+	for _, name := range names {
+		name := name
+		g.Go(func() error {
+			exp, err := full.LabelValues(name)
+			if err != nil {
+				return err
+			}
+			vals, err := lazy.LabelValues(name)
+			if err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(exp, vals) {
+				return errors.Errorf("label values of %q differ: expected %v, got %v", name, exp, vals)
+			}
+			for _, v := range vals {
+				expRng, err := full.PostingsOffset(name, v)
+				if err != nil {
+					return err
+				}
+				rng, err := lazy.PostingsOffset(name, v)
+				if err != nil {
+					return err
+				}
+				if expRng != rng {
+					return errors.Errorf("postings offset of %s=%q differ: expected %v, got %v", name, v, expRng, rng)
+				}
+			}
+			return nil
+		})
+	}
+	testutil.Ok(t, g.Wait())
+
+	for i := uint32(0); ; i++ {
+		exp, expErr := full.LookupSymbol(i)
+		s, err := lazy.LookupSymbol(i)
+		testutil.Equals(t, expErr != nil, err != nil)
+		if expErr != nil {
+			break
+		}
+		testutil.Equals(t, exp, s)
+	}
+}
+
+// loadAll loads all sections of the given binary reader that are otherwise loaded on first access.
+func loadAll(r *BinaryReader) error {
+	if err := r.loadSymbols(); err != nil {
+		return err
+	}
+	if r.indexVersion == index.FormatV1 {
+		return r.loadPostingsV1()
+	}
+	for _, e := range r.postings {
+		if _, err := e.load(r.b, r.toc.PostingsOffsetTable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func prepareIndexV2Block(t testing.TB, tmpDir string, bkt objstore.Bucket) *metadata.Meta {
 	/* Copy index 6MB block index version 2. It was generated via thanosbench. Meta.json:
 		{
@@ -390,10 +490,22 @@ func BenchmarkBinaryReader(t *testing.B) {
 	fn := filepath.Join(tmpDir, m.ULID.String(), block.IndexHeaderFilename)
 	testutil.Ok(t, WriteBinary(ctx, bkt, m.ULID, fn))
 
-	t.ResetTimer()
-	for i := 0; i < t.N; i++ {
-		br, err := newFileBinaryReader(fn)
-		testutil.Ok(t, err)
-		testutil.Ok(t, br.Close())
-	}
+	t.Run("lazy", func(t *testing.B) {
+		t.ReportAllocs()
+		for i := 0; i < t.N; i++ {
+			br, err := newFileBinaryReader(fn)
+			testutil.Ok(t, err)
+			testutil.Ok(t, br.Close())
+		}
+	})
+	// Loading all sections on open, as done before sections were loaded lazily.
+	t.Run("full", func(t *testing.B) {
+		t.ReportAllocs()
+		for i := 0; i < t.N; i++ {
+			br, err := newFileBinaryReader(fn)
+			testutil.Ok(t, err)
+			testutil.Ok(t, loadAll(br))
+			testutil.Ok(t, br.Close())
+		}
+	})
 }
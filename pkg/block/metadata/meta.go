@@ -31,6 +31,7 @@ const (
 	CompactorRepairSource SourceType = "compactor.repair"
 	RulerSource           SourceType = "ruler"
 	BucketRepairSource    SourceType = "bucket.repair"
+	BucketRelabelSource   SourceType = "bucket.relabel"
 	TestSource            SourceType = "test"
 )
 
@@ -0,0 +1,189 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// Relabel writes a new block into dir with the data of the block with the given ID in dir, applying the given relabel
+// configs to the labels of its series and replacing its external labels with the given ones. Series dropped by the
+// relabel configs are not written. Chunks are copied as they are, read with the given pool, which must support the chunk
+// encodings of the block, e.g. the aggregate chunks of downsampled blocks. A nil pool only supports raw chunks.
+// It returns the ID of the new block and whether the labels of any series changed.
+func Relabel(
+	logger log.Logger,
+	dir string,
+	id ulid.ULID,
+	source metadata.SourceType,
+	extLset labels.Labels,
+	relabelConfigs []*relabel.Config,
+	pool chunkenc.Pool,
+) (resid ulid.ULID, changed bool, err error) {
+	bdir := filepath.Join(dir, id.String())
+	entropy := rand.New(rand.NewSource(time.Now().UnixNano()))
+	resid = ulid.MustNew(ulid.Now(), entropy)
+
+	meta, err := metadata.Read(bdir)
+	if err != nil {
+		return resid, false, errors.Wrap(err, "read meta file")
+	}
+	b, err := tsdb.OpenBlock(logger, bdir, pool)
+	if err != nil {
+		return resid, false, errors.Wrap(err, "open block")
+	}
+	defer runutil.CloseWithErrCapture(&err, b, "relabel block reader")
+
+	indexr, err := b.Index()
+	if err != nil {
+		return resid, false, errors.Wrap(err, "open index")
+	}
+	defer runutil.CloseWithErrCapture(&err, indexr, "relabel index reader")
+
+	chunkr, err := b.Chunks()
+	if err != nil {
+		return resid, false, errors.Wrap(err, "open chunks")
+	}
+	defer runutil.CloseWithErrCapture(&err, chunkr, "relabel chunk reader")
+
+	series, changed, err := relabelSeries(indexr, chunkr, relabelConfigs)
+	if err != nil {
+		return resid, false, err
+	}
+
+	resdir := filepath.Join(dir, resid.String())
+
+	chunkw, err := chunks.NewWriter(filepath.Join(resdir, ChunksDirname))
+	if err != nil {
+		return resid, false, errors.Wrap(err, "open chunk writer")
+	}
+	defer runutil.CloseWithErrCapture(&err, chunkw, "relabel chunk writer")
+
+	indexw, err := index.NewWriter(context.TODO(), filepath.Join(resdir, IndexFilename))
+	if err != nil {
+		return resid, false, errors.Wrap(err, "open index writer")
+	}
+	defer runutil.CloseWithErrCapture(&err, indexw, "relabel index writer")
+
+	resmeta := *meta
+	resmeta.ULID = resid
+	resmeta.Stats = tsdb.BlockStats{}
+	resmeta.Thanos.Source = source
+	resmeta.Thanos.Labels = extLset.Map()
+
+	if err := writeSeries(indexw, chunkw, &resmeta, series); err != nil {
+		return resid, false, errors.Wrap(err, "write series")
+	}
+	if err := metadata.Write(logger, resdir, &resmeta); err != nil {
+		return resid, false, err
+	}
+	return resid, changed, nil
+}
+
+// relabelSeries returns all series of the block with their chunks, relabeled and sorted by their new labels.
+// Relabeling must not make distinct series identical, as their chunks would overlap.
+func relabelSeries(indexr tsdb.IndexReader, chunkr tsdb.ChunkReader, relabelConfigs []*relabel.Config) ([]seriesRepair, bool, error) {
+	all, err := indexr.Postings(index.AllPostingsKey())
+	if err != nil {
+		return nil, false, errors.Wrap(err, "postings")
+	}
+	all = indexr.SortedPostings(all)
+
+	var (
+		series  []seriesRepair
+		changed bool
+	)
+	for all.Next() {
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+		)
+		if err := indexr.Series(all.At(), &lset, &chks); err != nil {
+			return nil, false, errors.Wrap(err, "series")
+		}
+
+		relabeled := relabel.Process(lset, relabelConfigs...)
+		if !labels.Equal(lset, relabeled) {
+			changed = true
+		}
+		if relabeled == nil {
+			continue
+		}
+
+		for i, c := range chks {
+			chks[i].Chunk, err = chunkr.Chunk(c.Ref)
+			if err != nil {
+				return nil, false, errors.Wrap(err, "chunk read")
+			}
+		}
+		series = append(series, seriesRepair{lset: relabeled, chks: chks})
+	}
+	if all.Err() != nil {
+		return nil, false, errors.Wrap(all.Err(), "iterate series")
+	}
+
+	sort.Slice(series, func(i, j int) bool {
+		return labels.Compare(series[i].lset, series[j].lset) < 0
+	})
+	for i := 1; i < len(series); i++ {
+		if labels.Equal(series[i-1].lset, series[i].lset) {
+			return nil, false, errors.Errorf("relabeling results in duplicate series %s", series[i].lset)
+		}
+	}
+	return series, changed, nil
+}
+
+// writeSeries writes the given sorted series with their symbols and updates the stats of the meta accordingly.
+func writeSeries(indexw tsdb.IndexWriter, chunkw tsdb.ChunkWriter, meta *metadata.Meta, series []seriesRepair) error {
+	symbols := map[string]struct{}{}
+	for _, s := range series {
+		for _, l := range s.lset {
+			symbols[l.Name] = struct{}{}
+			symbols[l.Value] = struct{}{}
+		}
+	}
+	sorted := make([]string, 0, len(symbols))
+	for s := range symbols {
+		sorted = append(sorted, s)
+	}
+	sort.Strings(sorted)
+	for _, s := range sorted {
+		if err := indexw.AddSymbol(s); err != nil {
+			return errors.Wrap(err, "add symbol")
+		}
+	}
+
+	for i, s := range series {
+		if err := chunkw.WriteChunks(s.chks...); err != nil {
+			return errors.Wrap(err, "write chunks")
+		}
+		if err := indexw.AddSeries(uint64(i), s.lset, s.chks...); err != nil {
+			return errors.Wrap(err, "add series")
+		}
+
+		meta.Stats.NumChunks += uint64(len(s.chks))
+		meta.Stats.NumSeries++
+		for _, chk := range s.chks {
+			meta.Stats.NumSamples += uint64(chk.Chunk.NumSamples())
+		}
+	}
+	return nil
+}
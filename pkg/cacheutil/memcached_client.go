@@ -14,6 +14,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	terrors "github.com/prometheus/prometheus/tsdb/errors"
 	"github.com/thanos-io/thanos/pkg/discovery/dns"
 	"github.com/thanos-io/thanos/pkg/extprom"
 	"github.com/thanos-io/thanos/pkg/gate"
@@ -29,8 +30,9 @@ const (
 )
 
 var (
-	errMemcachedAsyncBufferFull = errors.New("the async buffer is full")
-	errMemcachedConfigNoAddrs   = errors.New("no memcached addresses provided")
+	errMemcachedAsyncBufferFull     = errors.New("the async buffer is full")
+	errMemcachedConfigNoAddrs       = errors.New("no memcached addresses provided")
+	errMemcachedConfigAddrsAndPools = errors.New("memcached addresses and pools are mutually exclusive")
 
 	defaultMemcachedClientConfig = MemcachedClientConfig{
 		Timeout:                   500 * time.Millisecond,
@@ -71,6 +73,11 @@ type MemcachedClientConfig struct {
 	// resolved with the DNS provider.
 	Addresses []string `yaml:"addresses"`
 
+	// Pools specifies multiple pools of memcached servers, as an alternative to
+	// Addresses. Keys are distributed across the pools with consistent hashing,
+	// so that adding or removing a pool only moves the keys of that pool.
+	Pools []MemcachedPoolConfig `yaml:"pools"`
+
 	// Timeout specifies the socket read/write timeout.
 	Timeout time.Duration `yaml:"timeout"`
 
@@ -106,14 +113,55 @@ type MemcachedClientConfig struct {
 	DNSProviderUpdateInterval time.Duration `yaml:"dns_provider_update_interval"`
 }
 
+// MemcachedPoolConfig is the config of a pool of memcached servers.
+type MemcachedPoolConfig struct {
+	// Name identifies the pool. It must be unique and not change, as it
+	// determines the keys mapped to the pool.
+	Name string `yaml:"name"`
+
+	// Addresses specifies the list of memcached addresses of the pool. The
+	// addresses get resolved with the DNS provider.
+	Addresses []string `yaml:"addresses"`
+}
+
 func (c *MemcachedClientConfig) validate() error {
-	if len(c.Addresses) == 0 {
-		return errMemcachedConfigNoAddrs
+	if len(c.Pools) == 0 {
+		if len(c.Addresses) == 0 {
+			return errMemcachedConfigNoAddrs
+		}
+		return nil
+	}
+	if len(c.Addresses) > 0 {
+		return errMemcachedConfigAddrsAndPools
+	}
+
+	names := map[string]struct{}{}
+	for _, p := range c.Pools {
+		if p.Name == "" {
+			return errors.New("no memcached pool name provided")
+		}
+		if _, ok := names[p.Name]; ok {
+			return errors.Errorf("duplicate memcached pool %q", p.Name)
+		}
+		names[p.Name] = struct{}{}
+
+		if len(p.Addresses) == 0 {
+			return errors.Wrapf(errMemcachedConfigNoAddrs, "pool %q", p.Name)
+		}
 	}
 
 	return nil
 }
 
+// pools returns the configured pools, or a single unnamed pool of the
+// configured addresses.
+func (c *MemcachedClientConfig) pools() []MemcachedPoolConfig {
+	if len(c.Pools) == 0 {
+		return []MemcachedPoolConfig{{Addresses: c.Addresses}}
+	}
+	return c.Pools
+}
+
 // parseMemcachedClientConfig unmarshals a buffer into a MemcachedClientConfig with default values.
 func parseMemcachedClientConfig(conf []byte) (MemcachedClientConfig, error) {
 	config := defaultMemcachedClientConfig
@@ -128,10 +176,10 @@ type memcachedClient struct {
 	logger   log.Logger
 	config   MemcachedClientConfig
 	client   memcachedClientBackend
-	selector *MemcachedJumpHashSelector
+	selector *MemcachedPoolsSelector
 
-	// DNS provider used to keep the memcached servers list updated.
-	dnsProvider *dns.Provider
+	// DNS providers used to keep the memcached servers list of each pool updated.
+	dnsProviders map[string]*dns.Provider
 
 	// Channel used to notify internal goroutines when they should quit.
 	stop chan struct{}
@@ -174,8 +222,12 @@ func NewMemcachedClientWithConfig(logger log.Logger, name string, config Memcach
 	}
 
 	// We use a custom servers selector in order to use a jump hash
-	// for servers selection.
-	selector := &MemcachedJumpHashSelector{}
+	// for servers selection, within a pool picked with consistent hashing.
+	var names []string
+	for _, p := range config.pools() {
+		names = append(names, p.Name)
+	}
+	selector := NewMemcachedPoolsSelector(names...)
 
 	client := memcache.NewFromSelector(selector)
 	client.Timeout = config.Timeout
@@ -188,24 +240,34 @@ func newMemcachedClient(
 	logger log.Logger,
 	name string,
 	client memcachedClientBackend,
-	selector *MemcachedJumpHashSelector,
+	selector *MemcachedPoolsSelector,
 	config MemcachedClientConfig,
 	reg prometheus.Registerer,
 ) (*memcachedClient, error) {
-	dnsProvider := dns.NewProvider(
-		logger,
-		extprom.WrapRegistererWithPrefix("thanos_memcached_", reg),
-		dns.ResolverType(dns.GolangResolverType),
-	)
+	dnsProviders := map[string]*dns.Provider{}
+	for _, p := range config.Pools {
+		dnsProviders[p.Name] = dns.NewProvider(
+			logger,
+			extprom.WrapRegistererWithPrefix("thanos_memcached_", prometheus.WrapRegistererWith(prometheus.Labels{"pool": p.Name}, reg)),
+			dns.ResolverType(dns.GolangResolverType),
+		)
+	}
+	if len(config.Pools) == 0 {
+		dnsProviders[""] = dns.NewProvider(
+			logger,
+			extprom.WrapRegistererWithPrefix("thanos_memcached_", reg),
+			dns.ResolverType(dns.GolangResolverType),
+		)
+	}
 
 	c := &memcachedClient{
-		logger:      logger,
-		config:      config,
-		client:      client,
-		selector:    selector,
-		dnsProvider: dnsProvider,
-		asyncQueue:  make(chan func(), config.MaxAsyncBufferSize),
-		stop:        make(chan struct{}, 1),
+		logger:       logger,
+		config:       config,
+		client:       client,
+		selector:     selector,
+		dnsProviders: dnsProviders,
+		asyncQueue:   make(chan func(), config.MaxAsyncBufferSize),
+		stop:         make(chan struct{}, 1),
 		getMultiGate: gate.NewGate(
 			config.MaxGetMultiConcurrency,
 			extprom.WrapRegistererWithPrefix("thanos_memcached_getmulti_", reg),
@@ -454,13 +516,26 @@ func (c *memcachedClient) resolveAddrs() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	c.dnsProvider.Resolve(ctx, c.config.Addresses)
-
-	// Fail in case no server address is resolved.
-	servers := c.dnsProvider.Addresses()
-	if len(servers) == 0 {
-		return errors.New("no server address resolved")
+	// Pools resolving no server address keep their previous servers, so
+	// that their keys are not moved to other pools.
+	var merr terrors.MultiError
+	for _, p := range c.config.pools() {
+		provider := c.dnsProviders[p.Name]
+		provider.Resolve(ctx, p.Addresses)
+
+		servers := provider.Addresses()
+		if len(servers) == 0 {
+			if p.Name == "" {
+				merr.Add(errors.New("no server address resolved"))
+			} else {
+				merr.Add(errors.Errorf("no server address resolved for pool %q", p.Name))
+			}
+			continue
+		}
+		if err := c.selector.SetPoolServers(p.Name, servers...); err != nil {
+			merr.Add(err)
+		}
 	}
 
-	return c.selector.SetServers(servers...)
+	return merr.Err()
 }
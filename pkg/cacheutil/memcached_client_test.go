@@ -5,6 +5,7 @@ package cacheutil
 
 import (
 	"context"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -13,6 +14,7 @@ import (
 	"github.com/fortytw2/leaktest"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/thanos-io/thanos/pkg/model"
 	"github.com/thanos-io/thanos/pkg/testutil"
@@ -35,6 +37,22 @@ func TestMemcachedClientConfig_validate(t *testing.T) {
 			},
 			expected: errMemcachedConfigNoAddrs,
 		},
+		"should pass on valid pools": {
+			config: MemcachedClientConfig{
+				Pools: []MemcachedPoolConfig{
+					{Name: "a", Addresses: []string{"127.0.0.1:11211"}},
+					{Name: "b", Addresses: []string{"127.0.0.2:11211"}},
+				},
+			},
+			expected: nil,
+		},
+		"should fail on both addresses and pools": {
+			config: MemcachedClientConfig{
+				Addresses: []string{"127.0.0.1:11211"},
+				Pools:     []MemcachedPoolConfig{{Name: "a", Addresses: []string{"127.0.0.2:11211"}}},
+			},
+			expected: errMemcachedConfigAddrsAndPools,
+		},
 	}
 
 	for testName, testData := range tests {
@@ -42,6 +60,20 @@ func TestMemcachedClientConfig_validate(t *testing.T) {
 			testutil.Equals(t, testData.expected, testData.config.validate())
 		})
 	}
+
+	for testName, pools := range map[string][]MemcachedPoolConfig{
+		"should fail on unnamed pool": {{Addresses: []string{"127.0.0.1:11211"}}},
+		"should fail on duplicate pools": {
+			{Name: "a", Addresses: []string{"127.0.0.1:11211"}},
+			{Name: "a", Addresses: []string{"127.0.0.2:11211"}},
+		},
+		"should fail on pool without addresses": {{Name: "a"}},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			config := MemcachedClientConfig{Pools: pools}
+			testutil.NotOk(t, config.validate())
+		})
+	}
 }
 
 func TestNewMemcachedClient(t *testing.T) {
@@ -106,6 +138,33 @@ dns_provider_update_interval: 1s
 	testutil.Equals(t, 1, cache.config.MaxGetMultiConcurrency)
 	testutil.Equals(t, 1, cache.config.MaxGetMultiBatchSize)
 	testutil.Equals(t, model.Bytes(1024*1024), cache.config.MaxItemSize)
+
+	// Should instance a memcached client with multiple pools.
+	conf = []byte(`
+pools:
+  - name: a
+    addresses:
+      - 127.0.0.1:11211
+  - name: b
+    addresses:
+      - 127.0.0.2:11211
+      - 127.0.0.3:11211
+`)
+	cache, err = NewMemcachedClient(log.NewNopLogger(), "test", conf, prometheus.NewRegistry())
+	testutil.Ok(t, err)
+	defer cache.Stop()
+
+	testutil.Equals(t, []MemcachedPoolConfig{
+		{Name: "a", Addresses: []string{"127.0.0.1:11211"}},
+		{Name: "b", Addresses: []string{"127.0.0.2:11211", "127.0.0.3:11211"}},
+	}, cache.config.Pools)
+
+	var servers []string
+	testutil.Ok(t, cache.selector.Each(func(addr net.Addr) error {
+		servers = append(servers, addr.String())
+		return nil
+	}))
+	testutil.Equals(t, []string{"127.0.0.1:11211", "127.0.0.2:11211", "127.0.0.3:11211"}, servers)
 }
 
 func TestMemcachedClient_SetAsync(t *testing.T) {
@@ -377,7 +436,7 @@ func TestMemcachedClient_GetMulti(t *testing.T) {
 
 func prepare(config MemcachedClientConfig, backendMock *memcachedClientBackendMock) (*memcachedClient, error) {
 	logger := log.NewNopLogger()
-	selector := &MemcachedJumpHashSelector{}
+	selector := NewMemcachedPoolsSelector("")
 	client, err := newMemcachedClient(logger, "test", backendMock, selector, config, nil)
 
 	return client, err
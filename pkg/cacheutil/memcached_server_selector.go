@@ -10,6 +10,7 @@ import (
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/cespare/xxhash"
 	"github.com/facette/natsort"
+	"github.com/pkg/errors"
 )
 
 var (
@@ -102,3 +103,91 @@ func (s *MemcachedJumpHashSelector) PickServer(key string) (net.Addr, error) {
 func (s *MemcachedJumpHashSelector) Each(f func(net.Addr) error) error {
 	return s.servers.Each(f)
 }
+
+// MemcachedPoolsSelector implements the memcache.ServerSelector
+// interface, distributing keys to multiple pools of servers with
+// rendezvous hashing, and to the servers of each pool with a
+// MemcachedJumpHashSelector.
+//
+// Rendezvous hashing enables adding or removing any pool, not only
+// the last one, while only requiring the keys of the added or removed
+// pool to move.
+type MemcachedPoolsSelector struct {
+	pools []memcachedSelectorPool
+}
+
+type memcachedSelectorPool struct {
+	name     string
+	hash     uint64
+	selector *MemcachedJumpHashSelector
+}
+
+// NewMemcachedPoolsSelector returns a MemcachedPoolsSelector for the pools
+// with the given names. The servers of each pool are initially empty.
+func NewMemcachedPoolsSelector(pools ...string) *MemcachedPoolsSelector {
+	s := &MemcachedPoolsSelector{}
+	for _, name := range pools {
+		s.pools = append(s.pools, memcachedSelectorPool{
+			name:     name,
+			hash:     xxhash.Sum64String(name),
+			selector: &MemcachedJumpHashSelector{},
+		})
+	}
+	return s
+}
+
+// SetPoolServers changes the set of servers of the given pool at runtime,
+// as MemcachedJumpHashSelector.SetServers does, and is safe for concurrent
+// use by multiple goroutines.
+func (s *MemcachedPoolsSelector) SetPoolServers(pool string, servers ...string) error {
+	for _, p := range s.pools {
+		if p.name == pool {
+			return p.selector.SetServers(servers...)
+		}
+	}
+	return errors.Errorf("unknown memcached pool %q", pool)
+}
+
+// PickServer returns the server address that a given item
+// should be shared onto.
+func (s *MemcachedPoolsSelector) PickServer(key string) (net.Addr, error) {
+	if len(s.pools) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+	if len(s.pools) == 1 {
+		return s.pools[0].selector.PickServer(key)
+	}
+
+	// Pick the pool with the highest score for the key.
+	var (
+		cs     = xxhash.Sum64String(key)
+		picked *MemcachedJumpHashSelector
+		max    uint64
+	)
+	for _, p := range s.pools {
+		if score := mixHash(cs ^ p.hash); picked == nil || score > max {
+			picked, max = p.selector, score
+		}
+	}
+	return picked.PickServer(key)
+}
+
+// Each iterates over each server of all pools and calls the given
+// function. If f returns a non-nil error, iteration will stop and that
+// error will be returned.
+func (s *MemcachedPoolsSelector) Each(f func(net.Addr) error) error {
+	for _, p := range s.pools {
+		if err := p.selector.Each(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mixHash is the finalizer of the SplitMix64 generator, used to derive
+// uniformly distributed and independent scores of a key for each pool.
+func mixHash(h uint64) uint64 {
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	return h ^ (h >> 31)
+}
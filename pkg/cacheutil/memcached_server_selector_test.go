@@ -212,6 +212,109 @@ func TestMemcachedJumpHashSelector_PickServer_ShouldReturnErrNoServersOnNoServer
 	testutil.Equals(t, memcache.ErrNoServers, err)
 }
 
+func TestMemcachedPoolsSelector_PickServer_ShouldEvenlyDistributeKeysToPools(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	pools := map[string][]string{
+		"a": {"127.0.0.1:11211", "127.0.0.2:11211"},
+		"b": {"127.0.1.1:11211", "127.0.1.2:11211"},
+		"c": {"127.0.2.1:11211", "127.0.2.2:11211"},
+	}
+	selector := NewMemcachedPoolsSelector("a", "b", "c")
+	for name, servers := range pools {
+		testutil.Ok(t, selector.SetPoolServers(name, servers...))
+	}
+
+	// Calculate the distribution of keys.
+	distribution := make(map[string]int)
+	numKeys := 3000
+
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		addr, err := selector.PickServer(key)
+		testutil.Ok(t, err)
+		distribution[addr.String()]++
+	}
+
+	// Expect each pool got at least 25% of keys, where the perfect split would be 33.3% each.
+	minKeysPerPool := int(float64(numKeys) * 0.25)
+	testutil.Equals(t, 6, len(distribution))
+
+	for name, servers := range pools {
+		count := 0
+		for _, addr := range servers {
+			count += distribution[addr]
+		}
+		if count < minKeysPerPool {
+			testutil.Ok(t, errors.Errorf("expected pool %s to have received at least %d keys instead it received %d", name, minKeysPerPool, count))
+		}
+	}
+}
+
+func TestMemcachedPoolsSelector_PickServer_ShouldUseConsistentHashing(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	pools := map[string][]string{
+		"a": {"127.0.0.1:11211", "127.0.0.2:11211"},
+		"b": {"127.0.1.1:11211", "127.0.1.2:11211"},
+		"c": {"127.0.2.1:11211", "127.0.2.2:11211"},
+		"d": {"127.0.3.1:11211", "127.0.3.2:11211"},
+	}
+	newSelector := func(names ...string) *MemcachedPoolsSelector {
+		selector := NewMemcachedPoolsSelector(names...)
+		for _, name := range names {
+			testutil.Ok(t, selector.SetPoolServers(name, pools[name]...))
+		}
+		return selector
+	}
+
+	// Pick a server for each key.
+	selector := newSelector("a", "b", "c")
+	distribution := make(map[string]string)
+	numKeys := 3000
+
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		addr, err := selector.PickServer(key)
+		testutil.Ok(t, err)
+		distribution[key] = addr.String()
+	}
+
+	// Add 1 more pool, which does not need to be the last one.
+	selector = newSelector("a", "d", "b", "c")
+
+	// Calculate the number of keys who has been moved due to the resharding.
+	moved := 0
+
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		addr, err := selector.PickServer(key)
+		testutil.Ok(t, err)
+
+		if distribution[key] != addr.String() {
+			moved++
+
+			// Keys are only moved to the added pool.
+			testutil.Assert(t, addr.String() == pools["d"][0] || addr.String() == pools["d"][1], "key %s moved to %s instead of the added pool", key, addr)
+		}
+	}
+
+	// Expect we haven't moved more than (1/pools)% +2% tolerance.
+	maxExpectedMovedPerc := (1.0 / float64(len(pools))) + 0.02
+	maxExpectedMoved := int(float64(numKeys) * maxExpectedMovedPerc)
+	if moved > maxExpectedMoved {
+		testutil.Ok(t, errors.Errorf("expected resharding moved no more then %d keys while %d have been moved", maxExpectedMoved, moved))
+	}
+}
+
+func TestMemcachedPoolsSelector_SetPoolServers_ShouldFailOnUnknownPool(t *testing.T) {
+	s := NewMemcachedPoolsSelector("a")
+	testutil.NotOk(t, s.SetPoolServers("b", "127.0.0.1:11211"))
+
+	_, err := s.PickServer("foo")
+	testutil.Equals(t, memcache.ErrNoServers, err)
+}
+
 func BenchmarkMemcachedJumpHashSelector_PickServer(b *testing.B) {
 	// Create a pretty long list of servers.
 	servers := make([]string, 0)
@@ -0,0 +1,165 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cespare/xxhash"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+const (
+	// CheckpointFilename is the known JSON filename of a group compaction checkpoint.
+	CheckpointFilename = "checkpoint.json"
+
+	checkpointVersion1 = 1
+)
+
+// checkpoint records the progress of a single group compaction in the group's work directory,
+// so that a compactor restarted in the middle of a compaction can resume it from the last
+// completed step instead of downloading and compacting all blocks from scratch.
+// The merge of series itself is done by the TSDB compactor in one pass and cannot be resumed,
+// but its result is only marked as done once the compacted block was completely written.
+type checkpoint struct {
+	Version int `json:"version"`
+	// Sources are the planned blocks of the compaction.
+	Sources []checkpointSource `json:"sources"`
+	// Compacted is the ID of the block resulting from the compaction of all sources.
+	// It is only set once the block was completely written to the work directory.
+	Compacted *ulid.ULID `json:"compacted,omitempty"`
+}
+
+// checkpointSource is a planned block of a checkpointed compaction.
+type checkpointSource struct {
+	ID ulid.ULID `json:"id"`
+	// Hash is the hash of the block's meta.json at the time it was planned.
+	// It is used to detect blocks that changed in the bucket since.
+	Hash uint64 `json:"hash"`
+	// Downloaded is set once the block was downloaded and verified successfully.
+	Downloaded bool `json:"downloaded"`
+}
+
+// newCheckpoint returns a checkpoint for the compaction of the given planned blocks.
+func newCheckpoint(plan []*metadata.Meta) (*checkpoint, error) {
+	cp := &checkpoint{Version: checkpointVersion1}
+	for _, m := range plan {
+		h, err := metaHash(m)
+		if err != nil {
+			return nil, err
+		}
+		cp.Sources = append(cp.Sources, checkpointSource{ID: m.ULID, Hash: h})
+	}
+	return cp, nil
+}
+
+// readCheckpoint reads the checkpoint from the given group work directory.
+// It returns nil if there is no checkpoint.
+func readCheckpoint(dir string) (*checkpoint, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, CheckpointFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read checkpoint")
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, errors.Wrap(err, "unmarshal checkpoint")
+	}
+	if cp.Version != checkpointVersion1 {
+		return nil, errors.Errorf("unexpected checkpoint version %d", cp.Version)
+	}
+	return &cp, nil
+}
+
+// write atomically writes the checkpoint into the given group work directory.
+func (cp *checkpoint) write(dir string) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return errors.Wrap(err, "marshal checkpoint")
+	}
+	path := filepath.Join(dir, CheckpointFilename)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return errors.Wrap(err, "write checkpoint")
+	}
+	return errors.Wrap(os.Rename(tmp, path), "rename checkpoint")
+}
+
+// validate checks that the checkpoint is consistent with the given blocks of the group and the
+// content of the work directory. A checkpoint is only valid if all its source blocks are still
+// part of the group and did not change, and all progress it records is still present on disk.
+func (cp *checkpoint) validate(dir string, blocks map[ulid.ULID]*metadata.Meta) error {
+	if len(cp.Sources) == 0 {
+		return errors.New("checkpoint without sources")
+	}
+	for _, s := range cp.Sources {
+		m, ok := blocks[s.ID]
+		if !ok {
+			return errors.Errorf("source block %s is not part of the group anymore", s.ID)
+		}
+		h, err := metaHash(m)
+		if err != nil {
+			return err
+		}
+		if h != s.Hash {
+			return errors.Errorf("source block %s changed since checkpoint", s.ID)
+		}
+		if !s.Downloaded {
+			continue
+		}
+		if _, err := metadata.Read(filepath.Join(dir, s.ID.String())); err != nil {
+			return errors.Wrapf(err, "downloaded source block %s", s.ID)
+		}
+	}
+	if cp.Compacted != nil {
+		if _, err := metadata.Read(filepath.Join(dir, cp.Compacted.String())); err != nil {
+			return errors.Wrapf(err, "compacted block %s", cp.Compacted)
+		}
+	}
+	return nil
+}
+
+// plan returns the directories of the checkpointed source blocks within the given work directory.
+func (cp *checkpoint) plan(dir string) []string {
+	plan := make([]string, 0, len(cp.Sources))
+	for _, s := range cp.Sources {
+		plan = append(plan, filepath.Join(dir, s.ID.String()))
+	}
+	return plan
+}
+
+// downloaded returns true if the given source block was already downloaded and verified.
+func (cp *checkpoint) downloaded(id ulid.ULID) bool {
+	for _, s := range cp.Sources {
+		if s.ID == id {
+			return s.Downloaded
+		}
+	}
+	return false
+}
+
+// markDownloaded marks the given source block as downloaded and verified.
+func (cp *checkpoint) markDownloaded(id ulid.ULID) {
+	for i := range cp.Sources {
+		if cp.Sources[i].ID == id {
+			cp.Sources[i].Downloaded = true
+		}
+	}
+}
+
+// metaHash returns a hash of the TSDB part of the given meta, which determines the block's content.
+func metaHash(m *metadata.Meta) (uint64, error) {
+	b, err := json.Marshal(m.BlockMeta)
+	if err != nil {
+		return 0, errors.Wrapf(err, "marshal meta of block %s", m.ULID)
+	}
+	return xxhash.Sum64(b), nil
+}
@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
@@ -50,8 +51,12 @@ type Syncer struct {
 	metrics                  *syncerMetrics
 	acceptMalformedIndex     bool
 	enableVerticalCompaction bool
+	overlapTolerance         OverlapTolerance
+	enableCheckpoints        bool
+	diskBudget               *DiskBudget
 	duplicateBlocksFilter    *block.DeduplicateFilter
 	ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter
+	protector                *DeletionProtector
 }
 
 type syncerMetrics struct {
@@ -64,7 +69,12 @@ type syncerMetrics struct {
 	compactionRunsCompleted   *prometheus.CounterVec
 	compactionFailures        *prometheus.CounterVec
 	verticalCompactions       *prometheus.CounterVec
+	compactionsDeferred       *prometheus.CounterVec
+	lastSuccessfulRuns        *prometheus.GaugeVec
 	blocksMarkedForDeletion   prometheus.Counter
+	outputBlockSize           prometheus.Histogram
+	outputBlockSeries         prometheus.Histogram
+	outputBlockDuration       prometheus.Histogram
 }
 
 func newSyncerMetrics(reg prometheus.Registerer, blocksMarkedForDeletion prometheus.Counter) *syncerMetrics {
@@ -108,6 +118,29 @@ func newSyncerMetrics(reg prometheus.Registerer, blocksMarkedForDeletion prometh
 		Name: "thanos_compact_group_vertical_compactions_total",
 		Help: "Total number of group compaction attempts that resulted in a new block based on overlapping blocks.",
 	}, []string{"group"})
+	m.compactionsDeferred = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_compact_group_compactions_deferred_total",
+		Help: "Total number of group compactions deferred or skipped because their estimated disk usage did not fit the disk budget.",
+	}, []string{"group"})
+	m.lastSuccessfulRuns = promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name: "thanos_compact_group_last_successful_run_timestamp_seconds",
+		Help: "Timestamp of the last group compaction run that completed without its planned compaction failing, or being deferred or skipped for the disk budget.",
+	}, []string{"group"})
+	m.outputBlockSize = promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+		Name:    "thanos_compact_group_compaction_output_block_size_bytes",
+		Help:    "Size of the blocks produced by completed group compactions.",
+		Buckets: prometheus.ExponentialBuckets(1<<20, 4, 11),
+	})
+	m.outputBlockSeries = promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+		Name:    "thanos_compact_group_compaction_output_block_series",
+		Help:    "Number of series of the blocks produced by completed group compactions.",
+		Buckets: prometheus.ExponentialBuckets(1000, 4, 10),
+	})
+	m.outputBlockDuration = promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+		Name:    "thanos_compact_group_compaction_output_block_duration_seconds",
+		Help:    "Time range covered by the blocks produced by completed group compactions.",
+		Buckets: []float64{(2 * time.Hour).Seconds(), (8 * time.Hour).Seconds(), (24 * time.Hour).Seconds(), (2 * 24 * time.Hour).Seconds(), (7 * 24 * time.Hour).Seconds(), (14 * 24 * time.Hour).Seconds(), (30 * 24 * time.Hour).Seconds()},
+	})
 	m.blocksMarkedForDeletion = blocksMarkedForDeletion
 
 	return &m
@@ -115,7 +148,7 @@ func newSyncerMetrics(reg prometheus.Registerer, blocksMarkedForDeletion prometh
 
 // NewMetaSyncer returns a new Syncer for the given Bucket and directory.
 // Blocks must be at least as old as the sync delay for being considered.
-func NewSyncer(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket, fetcher block.MetadataFetcher, duplicateBlocksFilter *block.DeduplicateFilter, ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter, blocksMarkedForDeletion prometheus.Counter, blockSyncConcurrency int, acceptMalformedIndex bool, enableVerticalCompaction bool) (*Syncer, error) {
+func NewSyncer(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket, fetcher block.MetadataFetcher, duplicateBlocksFilter *block.DeduplicateFilter, ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter, blocksMarkedForDeletion prometheus.Counter, blockSyncConcurrency int, acceptMalformedIndex bool, enableVerticalCompaction bool, overlapTolerance OverlapTolerance, enableCheckpoints bool, diskBudget *DiskBudget, protector *DeletionProtector) (*Syncer, error) {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
@@ -134,23 +167,23 @@ func NewSyncer(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket
 		// not currently used by Thanos, because the compactor is also used by Cortex
 		// which needs vertical compaction.
 		enableVerticalCompaction: enableVerticalCompaction,
+		overlapTolerance:         overlapTolerance,
+		enableCheckpoints:        enableCheckpoints,
+		diskBudget:               diskBudget,
+		protector:                protector,
 	}, nil
 }
 
-// UntilNextDownsampling calculates how long it will take until the next downsampling operation.
+// UntilNextDownsampling calculates how long it will take until the next downsampling operation
+// with the given downsampling levels.
 // Returns an error if there will be no downsampling.
-func UntilNextDownsampling(m *metadata.Meta) (time.Duration, error) {
-	timeRange := time.Duration((m.MaxTime - m.MinTime) * int64(time.Millisecond))
-	switch m.Thanos.Downsample.Resolution {
-	case downsample.ResLevel2:
+func UntilNextDownsampling(m *metadata.Meta, levels []downsample.Level) (time.Duration, error) {
+	next, ok := downsample.NextLevel(levels, m.Thanos.Downsample.Resolution)
+	if !ok {
 		return time.Duration(0), errors.New("no downsampling")
-	case downsample.ResLevel1:
-		return time.Duration(downsample.DownsampleRange1*time.Millisecond) - timeRange, nil
-	case downsample.ResLevel0:
-		return time.Duration(downsample.DownsampleRange0*time.Millisecond) - timeRange, nil
-	default:
-		panic(errors.Errorf("invalid resolution %v", m.Thanos.Downsample.Resolution))
 	}
+	timeRange := time.Duration((m.MaxTime - m.MinTime) * int64(time.Millisecond))
+	return time.Duration(next.MinSourceRange)*time.Millisecond - timeRange, nil
 }
 
 func (s *Syncer) SyncMetas(ctx context.Context) error {
@@ -195,13 +228,22 @@ func (s *Syncer) Groups() (res []*Group, err error) {
 				m.Thanos.Downsample.Resolution,
 				s.acceptMalformedIndex,
 				s.enableVerticalCompaction,
+				s.overlapTolerance,
+				s.enableCheckpoints,
+				s.diskBudget,
+				s.protector,
 				s.metrics.compactions.WithLabelValues(groupKey),
 				s.metrics.compactionRunsStarted.WithLabelValues(groupKey),
 				s.metrics.compactionRunsCompleted.WithLabelValues(groupKey),
 				s.metrics.compactionFailures.WithLabelValues(groupKey),
 				s.metrics.verticalCompactions.WithLabelValues(groupKey),
+				s.metrics.compactionsDeferred.WithLabelValues(groupKey),
+				s.metrics.lastSuccessfulRuns.WithLabelValues(groupKey),
 				s.metrics.garbageCollectedBlocks,
 				s.metrics.blocksMarkedForDeletion,
+				s.metrics.outputBlockSize,
+				s.metrics.outputBlockSeries,
+				s.metrics.outputBlockDuration,
 			)
 			if err != nil {
 				return nil, errors.Wrap(err, "create compaction group")
@@ -245,6 +287,18 @@ func (s *Syncer) GarbageCollect(ctx context.Context) error {
 			return ctx.Err()
 		}
 
+		if s.protector.enabled() {
+			// Outdated blocks are filtered out of the synced metas, fetch the labels from the bucket.
+			meta, err := block.DownloadMeta(ctx, s.logger, s.bkt, id)
+			if err != nil {
+				s.metrics.garbageCollectionFailures.Inc()
+				return retry(errors.Wrapf(err, "download meta of block %s", id))
+			}
+			if s.protector.prevent(id, labels.FromMap(meta.Thanos.Labels), "garbage-collection") {
+				continue
+			}
+		}
+
 		// Spawn a new context so we always delete a block in full on shutdown.
 		delCtx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 
@@ -279,13 +333,22 @@ type Group struct {
 	blocks                      map[ulid.ULID]*metadata.Meta
 	acceptMalformedIndex        bool
 	enableVerticalCompaction    bool
+	overlapTolerance            OverlapTolerance
+	enableCheckpoints           bool
+	diskBudget                  *DiskBudget
+	protector                   *DeletionProtector
 	compactions                 prometheus.Counter
 	compactionRunsStarted       prometheus.Counter
 	compactionRunsCompleted     prometheus.Counter
 	compactionFailures          prometheus.Counter
 	verticalCompactions         prometheus.Counter
+	compactionsDeferred         prometheus.Counter
+	lastSuccessfulRun           prometheus.Gauge
 	groupGarbageCollectedBlocks prometheus.Counter
 	blocksMarkedForDeletion     prometheus.Counter
+	outputBlockSize             prometheus.Histogram
+	outputBlockSeries           prometheus.Histogram
+	outputBlockDuration         prometheus.Histogram
 }
 
 // newGroup returns a new compaction group.
@@ -296,13 +359,22 @@ func newGroup(
 	resolution int64,
 	acceptMalformedIndex bool,
 	enableVerticalCompaction bool,
+	overlapTolerance OverlapTolerance,
+	enableCheckpoints bool,
+	diskBudget *DiskBudget,
+	protector *DeletionProtector,
 	compactions prometheus.Counter,
 	compactionRunsStarted prometheus.Counter,
 	compactionRunsCompleted prometheus.Counter,
 	compactionFailures prometheus.Counter,
 	verticalCompactions prometheus.Counter,
+	compactionsDeferred prometheus.Counter,
+	lastSuccessfulRun prometheus.Gauge,
 	groupGarbageCollectedBlocks prometheus.Counter,
 	blocksMarkedForDeletion prometheus.Counter,
+	outputBlockSize prometheus.Histogram,
+	outputBlockSeries prometheus.Histogram,
+	outputBlockDuration prometheus.Histogram,
 ) (*Group, error) {
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -315,13 +387,22 @@ func newGroup(
 		blocks:                      map[ulid.ULID]*metadata.Meta{},
 		acceptMalformedIndex:        acceptMalformedIndex,
 		enableVerticalCompaction:    enableVerticalCompaction,
+		overlapTolerance:            overlapTolerance,
+		enableCheckpoints:           enableCheckpoints,
+		diskBudget:                  diskBudget,
+		protector:                   protector,
 		compactions:                 compactions,
 		compactionRunsStarted:       compactionRunsStarted,
 		compactionRunsCompleted:     compactionRunsCompleted,
 		compactionFailures:          compactionFailures,
 		verticalCompactions:         verticalCompactions,
+		compactionsDeferred:         compactionsDeferred,
+		lastSuccessfulRun:           lastSuccessfulRun,
 		groupGarbageCollectedBlocks: groupGarbageCollectedBlocks,
 		blocksMarkedForDeletion:     blocksMarkedForDeletion,
+		outputBlockSize:             outputBlockSize,
+		outputBlockSeries:           outputBlockSeries,
+		outputBlockDuration:         outputBlockDuration,
 	}
 	return g, nil
 }
@@ -372,27 +453,38 @@ func (cg *Group) Resolution() int64 {
 
 // Compact plans and runs a single compaction against the group. The compacted result
 // is uploaded into the bucket the blocks were retrieved from.
-func (cg *Group) Compact(ctx context.Context, dir string, comp tsdb.Compactor) (bool, ulid.ULID, error) {
+// If checkpoints are enabled, the work directory of a failed compaction is kept, so that
+// the next compaction of the group can resume from it.
+func (cg *Group) Compact(ctx context.Context, dir string, comp tsdb.Compactor) (shouldRerun bool, compID ulid.ULID, err error) {
 	cg.compactionRunsStarted.Inc()
 
 	subDir := filepath.Join(dir, cg.Key())
 
 	defer func() {
+		if err != nil && cg.enableCheckpoints {
+			return
+		}
 		if err := os.RemoveAll(subDir); err != nil {
 			level.Error(cg.logger).Log("msg", "failed to remove compaction group work directory", "path", subDir, "err", err)
 		}
 	}()
 
-	if err := os.RemoveAll(subDir); err != nil {
-		return false, ulid.ULID{}, errors.Wrap(err, "clean compaction group dir")
+	if !cg.enableCheckpoints {
+		if err := os.RemoveAll(subDir); err != nil {
+			return false, ulid.ULID{}, errors.Wrap(err, "clean compaction group dir")
+		}
 	}
 	if err := os.MkdirAll(subDir, 0777); err != nil {
 		return false, ulid.ULID{}, errors.Wrap(err, "create compaction group dir")
 	}
 
-	shouldRerun, compID, err := cg.compact(ctx, subDir, comp)
+	shouldRerun, compID, err = cg.compact(ctx, subDir, comp)
 	if err != nil {
 		cg.compactionFailures.Inc()
+		if he, ok := err.(HaltError); ok {
+			he.group, he.blocks = cg.Key(), cg.IDs()
+			err = he
+		}
 		return false, ulid.ULID{}, err
 	}
 	cg.compactionRunsCompleted.Inc()
@@ -423,6 +515,10 @@ func IsIssue347Error(err error) bool {
 // HaltError is a type wrapper for errors that should halt any further progress on compactions.
 type HaltError struct {
 	err error
+
+	// group and blocks are the key and blocks of the compaction group whose compaction failed, if any.
+	group  string
+	blocks []ulid.ULID
 }
 
 func halt(err error) HaltError {
@@ -482,7 +578,10 @@ func IsRetryError(err error) bool {
 	return ok
 }
 
-func (cg *Group) areBlocksOverlapping(include *metadata.Meta, excludeDirs ...string) error {
+// areBlocksOverlapping returns an error if the blocks of the group, including the given one and excluding the
+// ones of the given directories, overlap. The returned bool reports whether all overlaps are within the overlap
+// tolerance of the group.
+func (cg *Group) areBlocksOverlapping(include *metadata.Meta, excludeDirs ...string) (bool, error) {
 	var (
 		metas   []tsdb.BlockMeta
 		exclude = map[ulid.ULID]struct{}{}
@@ -491,7 +590,7 @@ func (cg *Group) areBlocksOverlapping(include *metadata.Meta, excludeDirs ...str
 	for _, e := range excludeDirs {
 		id, err := ulid.Parse(filepath.Base(e))
 		if err != nil {
-			return errors.Wrapf(err, "overlaps find dir %s", e)
+			return false, errors.Wrapf(err, "overlaps find dir %s", e)
 		}
 		exclude[id] = struct{}{}
 	}
@@ -511,9 +610,46 @@ func (cg *Group) areBlocksOverlapping(include *metadata.Meta, excludeDirs ...str
 		return metas[i].MinTime < metas[j].MinTime
 	})
 	if overlaps := tsdb.OverlappingBlocks(metas); len(overlaps) > 0 {
-		return errors.Errorf("overlaps found while gathering blocks. %s", overlaps)
+		return cg.overlapTolerance.tolerates(overlaps), errors.Errorf("overlaps found while gathering blocks. %s", overlaps)
 	}
-	return nil
+	return false, nil
+}
+
+// OverlapTolerance bounds the overlaps between blocks that are expected, e.g. due to timing of uploads,
+// and can be vertically compacted even if vertical compaction is not enabled. Zero values disable the respective bound,
+// while no overlaps are tolerated if both are zero.
+type OverlapTolerance struct {
+	// MaxDuration is the maximum time range of a single overlap.
+	MaxDuration time.Duration
+	// MaxSamples is the maximum number of samples within the time range of a single overlap. Samples are estimated
+	// from the stats of the overlapping blocks, assuming samples are spread evenly across the time range of a block.
+	MaxSamples uint64
+}
+
+func (t OverlapTolerance) tolerates(overlaps tsdb.Overlaps) bool {
+	if t.MaxDuration <= 0 && t.MaxSamples == 0 {
+		return false
+	}
+	for rng, metas := range overlaps {
+		if t.MaxDuration > 0 && time.Duration(rng.Max-rng.Min)*time.Millisecond > t.MaxDuration {
+			return false
+		}
+		if t.MaxSamples > 0 && overlapSamples(rng, metas) > t.MaxSamples {
+			return false
+		}
+	}
+	return true
+}
+
+// overlapSamples estimates the number of samples of the given blocks within the given time range.
+func overlapSamples(rng tsdb.TimeRange, metas []tsdb.BlockMeta) uint64 {
+	var samples float64
+	for _, m := range metas {
+		if d := m.MaxTime - m.MinTime; d > 0 {
+			samples += float64(m.Stats.NumSamples) * float64(rng.Max-rng.Min) / float64(d)
+		}
+	}
+	return uint64(math.Ceil(samples))
 }
 
 // RepairIssue347 repairs the https://github.com/prometheus/tsdb/issues/347 issue when having issue347Error.
@@ -579,41 +715,101 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 	cg.mtx.Lock()
 	defer cg.mtx.Unlock()
 
+	// Runs without anything to compact count as successful, so that the last successful run only
+	// goes stale for groups failing or not fitting the disk budget.
+	skipped := false
+	defer func() {
+		if err == nil && !skipped {
+			cg.lastSuccessfulRun.SetToCurrentTime()
+		}
+	}()
+
 	// Check for overlapped blocks.
 	overlappingBlocks := false
-	if err := cg.areBlocksOverlapping(nil); err != nil {
+	if tolerated, err := cg.areBlocksOverlapping(nil); err != nil {
 		// TODO(bwplotka): It would really nice if we could still check for other overlaps than replica. In fact this should be checked
 		// in syncer itself. Otherwise with vertical compaction enabled we will sacrifice this important check.
 		if !cg.enableVerticalCompaction {
-			return false, ulid.ULID{}, halt(errors.Wrap(err, "pre compaction overlap check"))
+			if !tolerated {
+				return false, ulid.ULID{}, halt(errors.Wrap(err, "pre compaction overlap check"))
+			}
+			level.Info(cg.logger).Log("msg", "overlaps within the overlap tolerance found, compacting them vertically", "err", err)
 		}
 
 		overlappingBlocks = true
 	}
 
-	// Planning a compaction works purely based on the meta.json files in our future group's dir.
-	// So we first dump all our memory block metas into the directory.
-	for _, meta := range cg.blocks {
-		bdir := filepath.Join(dir, meta.ULID.String())
-		if err := os.MkdirAll(bdir, 0777); err != nil {
-			return false, ulid.ULID{}, errors.Wrap(err, "create planning block dir")
-		}
-		if err := metadata.Write(cg.logger, bdir, meta); err != nil {
-			return false, ulid.ULID{}, errors.Wrap(err, "write planning meta file")
+	var cp *checkpoint
+	if cg.enableCheckpoints {
+		if cp, err = cg.resumableCheckpoint(dir); err != nil {
+			return false, ulid.ULID{}, err
 		}
 	}
 
-	// Plan against the written meta.json files.
-	plan, err := comp.Plan(dir)
-	if err != nil {
-		return false, ulid.ULID{}, errors.Wrap(err, "plan compaction")
-	}
-	if len(plan) == 0 {
-		// Nothing to do.
-		return false, ulid.ULID{}, nil
+	var plan []string
+	if cp != nil {
+		// Resume the checkpointed compaction. The plan is taken from the checkpoint, as the directory
+		// may already contain results of the compaction that would affect planning.
+		plan = cp.plan(dir)
+		for _, s := range cp.Sources {
+			if s.Downloaded {
+				continue
+			}
+			if err := cg.writePlanningMeta(dir, cg.blocks[s.ID]); err != nil {
+				return false, ulid.ULID{}, err
+			}
+		}
+		level.Info(cg.logger).Log("msg", "resuming compaction from checkpoint", "plan", fmt.Sprintf("%v", plan))
+	} else {
+		// Planning a compaction works purely based on the meta.json files in our future group's dir.
+		// So we first dump all our memory block metas into the directory.
+		for _, meta := range cg.blocks {
+			if err := cg.writePlanningMeta(dir, meta); err != nil {
+				return false, ulid.ULID{}, err
+			}
+		}
+
+		// Plan against the written meta.json files.
+		plan, err = comp.Plan(dir)
+		if err != nil {
+			return false, ulid.ULID{}, errors.Wrap(err, "plan compaction")
+		}
+		if len(plan) == 0 {
+			// Nothing to do.
+			return false, ulid.ULID{}, nil
+		}
+
+		if cg.enableCheckpoints {
+			planned := make([]*metadata.Meta, 0, len(plan))
+			for _, pdir := range plan {
+				id, err := ulid.Parse(filepath.Base(pdir))
+				if err != nil {
+					return false, ulid.ULID{}, errors.Wrapf(err, "plan dir %s", pdir)
+				}
+				planned = append(planned, cg.blocks[id])
+			}
+			if cp, err = newCheckpoint(planned); err != nil {
+				return false, ulid.ULID{}, errors.Wrap(err, "create checkpoint")
+			}
+			if err := cp.write(dir); err != nil {
+				return false, ulid.ULID{}, err
+			}
+		}
+
+		level.Info(cg.logger).Log("msg", "compaction available and planned; downloading blocks", "plan", fmt.Sprintf("%v", plan))
 	}
 
-	level.Info(cg.logger).Log("msg", "compaction available and planned; downloading blocks", "plan", fmt.Sprintf("%v", plan))
+	if !cg.diskBudget.unlimited() {
+		reserved, ok, deferred, err := cg.reserveDiskBudget(ctx, plan)
+		if err != nil {
+			return false, ulid.ULID{}, err
+		}
+		if !ok {
+			skipped = true
+			return deferred, ulid.ULID{}, nil
+		}
+		defer cg.diskBudget.release(reserved)
+	}
 
 	// Due to #183 we verify that none of the blocks in the plan have overlapping sources.
 	// This is one potential source of how we could end up with duplicated chunks.
@@ -649,6 +845,11 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 			return false, ulid.ULID{}, errors.Errorf("mismatch between meta %s and dir %s", meta.ULID, id)
 		}
 
+		if cp != nil && cp.downloaded(id) {
+			level.Debug(cg.logger).Log("msg", "block already downloaded and verified according to checkpoint", "block", id)
+			continue
+		}
+
 		if err := block.Download(ctx, cg.logger, cg.bkt, id, pdir); err != nil {
 			return false, ulid.ULID{}, retry(errors.Wrapf(err, "download block %s", id))
 		}
@@ -671,39 +872,34 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 			return false, ulid.ULID{}, errors.Wrapf(err,
 				"block id %s, try running with --debug.accept-malformed-index", id)
 		}
+
+		if cp != nil {
+			cp.markDownloaded(id)
+			if err := cp.write(dir); err != nil {
+				return false, ulid.ULID{}, err
+			}
+		}
 	}
 	level.Info(cg.logger).Log("msg", "downloaded and verified blocks; compacting blocks", "plan", fmt.Sprintf("%v", plan), "duration", time.Since(begin))
 
-	begin = time.Now()
-
-	compID, err = comp.Compact(dir, plan, nil)
-	if err != nil {
-		return false, ulid.ULID{}, halt(errors.Wrapf(err, "compact blocks %v", plan))
-	}
-	if compID == (ulid.ULID{}) {
-		// Prometheus compactor found that the compacted block would have no samples.
-		level.Info(cg.logger).Log("msg", "compacted block would have no samples, deleting source blocks", "blocks", fmt.Sprintf("%v", plan))
-		for _, block := range plan {
-			meta, err := metadata.Read(block)
-			if err != nil {
-				level.Warn(cg.logger).Log("msg", "failed to read meta for block", "block", block)
-				continue
-			}
-			if meta.Stats.NumSamples == 0 {
-				if err := cg.deleteBlock(block); err != nil {
-					level.Warn(cg.logger).Log("msg", "failed to delete empty block found during compaction", "block", block)
-				}
+	if cp != nil && cp.Compacted != nil {
+		compID = *cp.Compacted
+		level.Info(cg.logger).Log("msg", "blocks already compacted according to checkpoint", "blocks", fmt.Sprintf("%v", plan), "result_block", compID)
+	} else {
+		if compID, err = cg.compactBlocks(dir, comp, plan, overlappingBlocks); err != nil {
+			return false, ulid.ULID{}, err
+		}
+		if compID == (ulid.ULID{}) {
+			// Even though this block was empty, there may be more work to do.
+			return true, ulid.ULID{}, nil
+		}
+		if cp != nil {
+			cp.Compacted = &compID
+			if err := cp.write(dir); err != nil {
+				return false, ulid.ULID{}, err
 			}
 		}
-		// Even though this block was empty, there may be more work to do.
-		return true, ulid.ULID{}, nil
 	}
-	cg.compactions.Inc()
-	if overlappingBlocks {
-		cg.verticalCompactions.Inc()
-	}
-	level.Info(cg.logger).Log("msg", "compacted blocks",
-		"blocks", fmt.Sprintf("%v", plan), "duration", time.Since(begin), "overlapping_blocks", overlappingBlocks)
 
 	bdir := filepath.Join(dir, compID.String())
 	index := filepath.Join(bdir, block.IndexFilename)
@@ -718,7 +914,8 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 		return false, ulid.ULID{}, errors.Wrapf(err, "failed to finalize the block %s", bdir)
 	}
 
-	if err = os.Remove(filepath.Join(bdir, "tombstones")); err != nil {
+	// The tombstones might already be removed if the compaction was resumed from a checkpoint.
+	if err = os.Remove(filepath.Join(bdir, "tombstones")); err != nil && !os.IsNotExist(err) {
 		return false, ulid.ULID{}, errors.Wrap(err, "remove tombstones")
 	}
 
@@ -730,7 +927,7 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 	// Ensure the output block is not overlapping with anything else,
 	// unless vertical compaction is enabled.
 	if !cg.enableVerticalCompaction {
-		if err := cg.areBlocksOverlapping(newMeta, plan...); err != nil {
+		if tolerated, err := cg.areBlocksOverlapping(newMeta, plan...); err != nil && !tolerated {
 			return false, ulid.ULID{}, halt(errors.Wrapf(err, "resulted compacted block %s overlaps with something", bdir))
 		}
 	}
@@ -745,6 +942,7 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 		return false, ulid.ULID{}, retry(errors.Wrapf(err, "upload of %s failed", compID))
 	}
 	level.Info(cg.logger).Log("msg", "uploaded block", "result_block", compID, "duration", time.Since(begin))
+	cg.observeOutputBlock(bdir, newMeta)
 
 	// Delete the blocks we just compacted from the group and bucket so they do not get included
 	// into the next planning cycle.
@@ -759,6 +957,158 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 	return true, compID, nil
 }
 
+// observeOutputBlock records the size, number of series and time range of the block produced by a compaction.
+func (cg *Group) observeOutputBlock(bdir string, meta *metadata.Meta) {
+	cg.outputBlockSeries.Observe(float64(meta.Stats.NumSeries))
+	cg.outputBlockDuration.Observe(time.Duration((meta.MaxTime - meta.MinTime) * int64(time.Millisecond)).Seconds())
+
+	var size int64
+	if err := filepath.Walk(bdir, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	}); err != nil {
+		level.Warn(cg.logger).Log("msg", "failed to get size of compacted block", "block", meta.ULID, "err", err)
+		return
+	}
+	cg.outputBlockSize.Observe(float64(size))
+}
+
+// reserveDiskBudget reserves the estimated disk usage of compacting the planned blocks and returns the reserved size.
+// If the estimate does not fit the budget, nothing is reserved and deferred reports whether the compaction should be
+// retried once running compactions released their reservations.
+func (cg *Group) reserveDiskBudget(ctx context.Context, plan []string) (reserved int64, ok bool, deferred bool, err error) {
+	ids := make([]ulid.ULID, 0, len(plan))
+	for _, pdir := range plan {
+		id, err := ulid.Parse(filepath.Base(pdir))
+		if err != nil {
+			return 0, false, false, errors.Wrapf(err, "plan dir %s", pdir)
+		}
+		ids = append(ids, id)
+	}
+	size, err := estimateCompactionDiskUsage(ctx, cg.bkt, ids)
+	if err != nil {
+		return 0, false, false, retry(errors.Wrap(err, "estimate compaction disk usage"))
+	}
+
+	if cg.diskBudget.exceeded(size) {
+		level.Warn(cg.logger).Log("msg", "estimated disk usage of compaction exceeds the disk budget; skipping it",
+			"estimatedBytes", size, "budgetBytes", cg.diskBudget.limit, "plan", fmt.Sprintf("%v", plan))
+		cg.compactionsDeferred.Inc()
+		return 0, false, false, nil
+	}
+	if !cg.diskBudget.reserve(size) {
+		level.Info(cg.logger).Log("msg", "estimated disk usage of compaction does not fit the disk budget left by running compactions; deferring it",
+			"estimatedBytes", size, "budgetBytes", cg.diskBudget.limit, "plan", fmt.Sprintf("%v", plan))
+		cg.compactionsDeferred.Inc()
+		return 0, false, true, nil
+	}
+	return size, true, false, nil
+}
+
+// compactBlocks compacts the given planned blocks into a new block within the given directory.
+// It returns an empty ULID if the compacted block would have no samples, in which case the
+// empty source blocks are deleted.
+func (cg *Group) compactBlocks(dir string, comp tsdb.Compactor, plan []string, overlappingBlocks bool) (ulid.ULID, error) {
+	begin := time.Now()
+
+	compID, err := comp.Compact(dir, plan, nil)
+	if err != nil {
+		return ulid.ULID{}, halt(errors.Wrapf(err, "compact blocks %v", plan))
+	}
+	if compID == (ulid.ULID{}) {
+		// Prometheus compactor found that the compacted block would have no samples.
+		level.Info(cg.logger).Log("msg", "compacted block would have no samples, deleting source blocks", "blocks", fmt.Sprintf("%v", plan))
+		for _, block := range plan {
+			meta, err := metadata.Read(block)
+			if err != nil {
+				level.Warn(cg.logger).Log("msg", "failed to read meta for block", "block", block)
+				continue
+			}
+			if meta.Stats.NumSamples == 0 {
+				if err := cg.deleteBlock(block); err != nil {
+					level.Warn(cg.logger).Log("msg", "failed to delete empty block found during compaction", "block", block)
+				}
+			}
+		}
+		return ulid.ULID{}, nil
+	}
+	cg.compactions.Inc()
+	if overlappingBlocks {
+		cg.verticalCompactions.Inc()
+	}
+	level.Info(cg.logger).Log("msg", "compacted blocks",
+		"blocks", fmt.Sprintf("%v", plan), "duration", time.Since(begin), "overlapping_blocks", overlappingBlocks)
+	return compID, nil
+}
+
+// writePlanningMeta writes the given meta into its block directory within the given directory.
+func (cg *Group) writePlanningMeta(dir string, meta *metadata.Meta) error {
+	bdir := filepath.Join(dir, meta.ULID.String())
+	if err := os.MkdirAll(bdir, 0777); err != nil {
+		return errors.Wrap(err, "create planning block dir")
+	}
+	if err := metadata.Write(cg.logger, bdir, meta); err != nil {
+		return errors.Wrap(err, "write planning meta file")
+	}
+	return nil
+}
+
+// resumableCheckpoint returns the checkpoint of a previous compaction found in the given group
+// work directory, if it is still valid. Otherwise the directory is cleaned and nil is returned.
+func (cg *Group) resumableCheckpoint(dir string) (*checkpoint, error) {
+	cp, err := readCheckpoint(dir)
+	if err == nil && cp != nil {
+		if err = cp.validate(dir, cg.blocks); err == nil {
+			return cp, cleanCheckpointDir(dir, cp)
+		}
+	}
+	if err != nil {
+		level.Warn(cg.logger).Log("msg", "discarding compaction checkpoint", "err", err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read compaction group dir")
+	}
+	for _, f := range files {
+		if err := os.RemoveAll(filepath.Join(dir, f.Name())); err != nil {
+			return nil, errors.Wrap(err, "clean compaction group dir")
+		}
+	}
+	return nil, nil
+}
+
+// cleanCheckpointDir removes everything from the given group work directory
+// that is not referenced by the given checkpoint, e.g. leftovers of an aborted compaction.
+func cleanCheckpointDir(dir string, cp *checkpoint) error {
+	keep := map[string]struct{}{CheckpointFilename: {}}
+	for _, s := range cp.Sources {
+		keep[s.ID.String()] = struct{}{}
+	}
+	if cp.Compacted != nil {
+		keep[cp.Compacted.String()] = struct{}{}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "read compaction group dir")
+	}
+	for _, f := range files {
+		if _, ok := keep[f.Name()]; ok {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, f.Name())); err != nil {
+			return errors.Wrap(err, "clean compaction group dir")
+		}
+	}
+	return nil
+}
+
 func (cg *Group) deleteBlock(b string) error {
 	id, err := ulid.Parse(filepath.Base(b))
 	if err != nil {
@@ -768,6 +1118,9 @@ func (cg *Group) deleteBlock(b string) error {
 	if err := os.RemoveAll(b); err != nil {
 		return errors.Wrapf(err, "remove old block dir %s", id)
 	}
+	if cg.protector.prevent(id, cg.labels, "compaction") {
+		return nil
+	}
 
 	// Spawn a new context so we always delete a block in full on shutdown.
 	delCtx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
@@ -788,9 +1141,17 @@ type BucketCompactor struct {
 	compactDir  string
 	bkt         objstore.Bucket
 	concurrency int
+	gates       []Gate
+}
+
+// Gate pauses compactions until they are allowed again.
+type Gate interface {
+	// Wait blocks until compactions are allowed or the context is done.
+	Wait(ctx context.Context) error
 }
 
-// NewBucketCompactor creates a new bucket compactor.
+// NewBucketCompactor creates a new bucket compactor. The compaction waits for all given gates before every pass and
+// between groups.
 func NewBucketCompactor(
 	logger log.Logger,
 	sy *Syncer,
@@ -798,6 +1159,7 @@ func NewBucketCompactor(
 	compactDir string,
 	bkt objstore.Bucket,
 	concurrency int,
+	gates []Gate,
 ) (*BucketCompactor, error) {
 	if concurrency <= 0 {
 		return nil, errors.Errorf("invalid concurrency level (%d), concurrency level must be > 0", concurrency)
@@ -809,12 +1171,27 @@ func NewBucketCompactor(
 		compactDir:  compactDir,
 		bkt:         bkt,
 		concurrency: concurrency,
+		gates:       gates,
 	}, nil
 }
 
+// waitGates blocks until all gates allow compactions.
+func (c *BucketCompactor) waitGates(ctx context.Context) error {
+	for _, g := range c.gates {
+		if err := g.Wait(ctx); err != nil {
+			return errors.Wrap(err, "wait for compaction gate")
+		}
+	}
+	return nil
+}
+
 // Compact runs compaction over bucket.
 func (c *BucketCompactor) Compact(ctx context.Context) error {
 	defer func() {
+		// Work directories of groups are kept for resuming their compaction if checkpoints are enabled.
+		if c.sy.enableCheckpoints {
+			return
+		}
 		if err := os.RemoveAll(c.compactDir); err != nil {
 			level.Error(c.logger).Log("msg", "failed to remove compaction work directory", "path", c.compactDir, "err", err)
 		}
@@ -822,6 +1199,10 @@ func (c *BucketCompactor) Compact(ctx context.Context) error {
 
 	// Loop over bucket and compact until there's no work left.
 	for {
+		if err := c.waitGates(ctx); err != nil {
+			return err
+		}
+
 		var (
 			wg                     sync.WaitGroup
 			workCtx, workCtxCancel = context.WithCancel(ctx)
@@ -864,8 +1245,10 @@ func (c *BucketCompactor) Compact(ctx context.Context) error {
 		}
 
 		// Clean up the compaction temporary directory at the beginning of every compaction loop.
-		if err := os.RemoveAll(c.compactDir); err != nil {
-			return errors.Wrap(err, "clean up the compaction temporary directory")
+		if !c.sy.enableCheckpoints {
+			if err := os.RemoveAll(c.compactDir); err != nil {
+				return errors.Wrap(err, "clean up the compaction temporary directory")
+			}
 		}
 
 		level.Info(c.logger).Log("msg", "start sync of metas")
@@ -889,11 +1272,21 @@ func (c *BucketCompactor) Compact(ctx context.Context) error {
 			return errors.Wrap(err, "build compaction groups")
 		}
 
+		if c.sy.enableCheckpoints {
+			if err := c.cleanStaleGroupDirs(groups); err != nil {
+				return errors.Wrap(err, "clean up stale compaction group directories")
+			}
+		}
+
 		// Send all groups found during this pass to the compaction workers.
 		var groupErrs terrors.MultiError
 
 	groupLoop:
 		for _, g := range groups {
+			if err := c.waitGates(ctx); err != nil {
+				groupErrs.Add(err)
+				break groupLoop
+			}
 			select {
 			case groupErr := <-errChan:
 				groupErrs.Add(groupErr)
@@ -923,3 +1316,30 @@ func (c *BucketCompactor) Compact(ctx context.Context) error {
 	level.Info(c.logger).Log("msg", "compaction iterations done")
 	return nil
 }
+
+// cleanStaleGroupDirs removes work directories of groups that do not exist anymore
+// from the compaction temporary directory.
+func (c *BucketCompactor) cleanStaleGroupDirs(groups []*Group) error {
+	files, err := ioutil.ReadDir(c.compactDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]struct{}, len(groups))
+	for _, g := range groups {
+		keys[g.Key()] = struct{}{}
+	}
+	for _, f := range files {
+		if _, ok := keys[f.Name()]; ok {
+			continue
+		}
+		level.Info(c.logger).Log("msg", "removing work directory of stale compaction group", "dir", f.Name())
+		if err := os.RemoveAll(filepath.Join(c.compactDir, f.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -8,24 +8,32 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
 	"github.com/thanos-io/thanos/pkg/objstore/objtesting"
 	"github.com/thanos-io/thanos/pkg/testutil"
 	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
@@ -97,7 +105,7 @@ func TestSyncer_GarbageCollect_e2e(t *testing.T) {
 
 		blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
 		ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(nil, nil, 48*time.Hour)
-		sy, err := NewSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, 1, false, false)
+		sy, err := NewSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, 1, false, false, OverlapTolerance{}, false, nil, nil)
 		testutil.Ok(t, err)
 
 		// Do one initial synchronization with the bucket.
@@ -162,6 +170,12 @@ func MetricCount(c prometheus.Collector) int {
 	return mCount
 }
 
+func histogramCountAndSum(t *testing.T, h prometheus.Histogram) (uint64, float64) {
+	m := &dto.Metric{}
+	testutil.Ok(t, h.Write(m))
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
 func TestGroup_Compact_e2e(t *testing.T) {
 	objtesting.ForeachStore(t, func(t *testing.T, bkt objstore.Bucket) {
 		ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
@@ -185,13 +199,13 @@ func TestGroup_Compact_e2e(t *testing.T) {
 		testutil.Ok(t, err)
 
 		blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
-		sy, err := NewSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, 5, false, false)
+		sy, err := NewSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, 5, false, false, OverlapTolerance{}, false, nil, nil)
 		testutil.Ok(t, err)
 
 		comp, err := tsdb.NewLeveledCompactor(ctx, reg, logger, []int64{1000, 3000}, nil)
 		testutil.Ok(t, err)
 
-		bComp, err := NewBucketCompactor(logger, sy, comp, dir, bkt, 2)
+		bComp, err := NewBucketCompactor(logger, sy, comp, dir, bkt, 2, nil)
 		testutil.Ok(t, err)
 
 		// Compaction on empty should not fail.
@@ -311,6 +325,17 @@ func TestGroup_Compact_e2e(t *testing.T) {
 		testutil.Equals(t, 0.0, promtest.ToFloat64(sy.metrics.compactionFailures.WithLabelValues(GroupKey(metas[4].Thanos))))
 		testutil.Equals(t, 0.0, promtest.ToFloat64(sy.metrics.compactionFailures.WithLabelValues(GroupKey(metas[5].Thanos))))
 
+		// Both compacted blocks span 0 to 3000, with 6 and 5 series.
+		count, sum := histogramCountAndSum(t, sy.metrics.outputBlockSeries)
+		testutil.Equals(t, uint64(2), count)
+		testutil.Equals(t, 11.0, sum)
+		count, sum = histogramCountAndSum(t, sy.metrics.outputBlockDuration)
+		testutil.Equals(t, uint64(2), count)
+		testutil.Equals(t, 6.0, sum)
+		count, sum = histogramCountAndSum(t, sy.metrics.outputBlockSize)
+		testutil.Equals(t, uint64(2), count)
+		testutil.Assert(t, sum > 0, "expected size of compacted blocks to be observed")
+
 		_, err = os.Stat(dir)
 		testutil.Assert(t, os.IsNotExist(err), "dir %s should be remove after compaction.", dir)
 
@@ -382,6 +407,401 @@ func TestGroup_Compact_e2e(t *testing.T) {
 	})
 }
 
+func TestGroup_Compact_Checkpoint_e2e(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	logger := log.NewLogfmtLogger(os.Stderr)
+	extLset := labels.Labels{{Name: "e1", Value: "1"}}
+	series := []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}, {Name: "b", Value: "2"}},
+		{{Name: "a", Value: "3"}},
+	}
+	specs := []blockgenSpec{
+		{numSamples: 100, mint: 0, maxt: 1000, extLset: extLset, res: 124, series: series},
+		{numSamples: 100, mint: 1000, maxt: 2000, extLset: extLset, res: 124, series: series},
+		{numSamples: 100, mint: 2000, maxt: 3000, extLset: extLset, res: 124, series: series},
+		// Due to TSDB compaction delay (not compacting fresh block), we need one more block to be pushed to trigger compaction.
+		{numSamples: 100, mint: 3000, maxt: 4000, extLset: extLset, res: 124, series: series},
+	}
+
+	// prepare uploads the source blocks and returns a work directory and compactor to use.
+	prepare := func(t *testing.T) (objstore.Bucket, []*metadata.Meta, string, *countingCompactor) {
+		bkt := inmem.NewBucket()
+		metas := createAndUpload(t, bkt, specs)
+
+		dir, err := ioutil.TempDir("", "test-compact-checkpoint")
+		testutil.Ok(t, err)
+
+		comp, err := tsdb.NewLeveledCompactor(ctx, nil, logger, []int64{1000, 3000}, nil)
+		testutil.Ok(t, err)
+		return bkt, metas, dir, &countingCompactor{Compactor: comp}
+	}
+
+	t.Run("crash during upload", func(t *testing.T) {
+		bkt, metas, dir, comp := prepare(t)
+		defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+		// The first attempt fails uploading the compacted block, after it was written completely.
+		g := checkpointTestGroup(t, ctx, bkt, &faultyBucket{Bucket: bkt, failUploads: true})
+		_, _, err := g.Compact(ctx, dir, comp)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, IsRetryError(err), "expected retry error, got %v", err)
+		testutil.Equals(t, 1, comp.compactions)
+
+		cp, err := readCheckpoint(filepath.Join(dir, g.Key()))
+		testutil.Ok(t, err)
+		testutil.Assert(t, cp != nil, "checkpoint not found")
+		testutil.Assert(t, cp.Compacted != nil, "compacted block not checkpointed")
+		testutil.Equals(t, []string{
+			filepath.Join(dir, g.Key(), metas[0].ULID.String()),
+			filepath.Join(dir, g.Key(), metas[1].ULID.String()),
+			filepath.Join(dir, g.Key(), metas[2].ULID.String()),
+		}, cp.plan(filepath.Join(dir, g.Key())))
+		for _, s := range cp.Sources {
+			testutil.Assert(t, s.Downloaded, "source block %s not checkpointed as downloaded", s.ID)
+		}
+		expectedIndex, err := ioutil.ReadFile(filepath.Join(dir, g.Key(), cp.Compacted.String(), block.IndexFilename))
+		testutil.Ok(t, err)
+
+		// The resumed attempt must neither download nor compact the blocks again.
+		fbkt := &faultyBucket{Bucket: bkt}
+		g = checkpointTestGroup(t, ctx, bkt, fbkt)
+		_, compID, err := g.Compact(ctx, dir, comp)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, comp.compactions)
+		testutil.Equals(t, *cp.Compacted, compID)
+		for _, m := range metas[:3] {
+			testutil.Equals(t, 0, fbkt.gets(m.ULID))
+		}
+
+		_, err = os.Stat(filepath.Join(dir, g.Key()))
+		testutil.Assert(t, os.IsNotExist(err), "group dir should be removed after successful compaction")
+
+		// The uploaded block is identical to the one compacted before the crash.
+		meta, err := block.DownloadMeta(ctx, logger, bkt, compID)
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(0), meta.MinTime)
+		testutil.Equals(t, int64(3000), meta.MaxTime)
+		testutil.Equals(t, uint64(3*3*100), meta.Stats.NumSamples)
+		testutil.Equals(t, []ulid.ULID{metas[0].ULID, metas[1].ULID, metas[2].ULID}, meta.Compaction.Sources)
+		testutil.Assert(t, labels.Equal(extLset, labels.FromMap(meta.Thanos.Labels)), "ext labels does not match")
+
+		r, err := bkt.Get(ctx, path.Join(compID.String(), block.IndexFilename))
+		testutil.Ok(t, err)
+		defer r.Close()
+		uploadedIndex, err := ioutil.ReadAll(r)
+		testutil.Ok(t, err)
+		testutil.Assert(t, bytes.Equal(expectedIndex, uploadedIndex), "uploaded index differs from the compacted one")
+	})
+
+	t.Run("crash during download", func(t *testing.T) {
+		bkt, metas, dir, comp := prepare(t)
+		defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+		// The first attempt fails downloading the second planned block.
+		g := checkpointTestGroup(t, ctx, bkt, &faultyBucket{Bucket: bkt, failGets: metas[1].ULID.String()})
+		_, _, err := g.Compact(ctx, dir, comp)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, 0, comp.compactions)
+
+		cp, err := readCheckpoint(filepath.Join(dir, g.Key()))
+		testutil.Ok(t, err)
+		testutil.Assert(t, cp != nil, "checkpoint not found")
+		testutil.Assert(t, cp.downloaded(metas[0].ULID), "first block not checkpointed as downloaded")
+		testutil.Assert(t, !cp.downloaded(metas[1].ULID), "second block checkpointed as downloaded")
+		testutil.Assert(t, cp.Compacted == nil, "compacted block checkpointed")
+
+		// The resumed attempt only downloads the missing blocks.
+		fbkt := &faultyBucket{Bucket: bkt}
+		g = checkpointTestGroup(t, ctx, bkt, fbkt)
+		_, compID, err := g.Compact(ctx, dir, comp)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, comp.compactions)
+		testutil.Equals(t, 0, fbkt.gets(metas[0].ULID))
+		testutil.Assert(t, fbkt.gets(metas[1].ULID) > 0, "second block not downloaded")
+		testutil.Assert(t, fbkt.gets(metas[2].ULID) > 0, "third block not downloaded")
+
+		meta, err := block.DownloadMeta(ctx, logger, bkt, compID)
+		testutil.Ok(t, err)
+		testutil.Equals(t, uint64(3*3*100), meta.Stats.NumSamples)
+		testutil.Equals(t, []ulid.ULID{metas[0].ULID, metas[1].ULID, metas[2].ULID}, meta.Compaction.Sources)
+	})
+
+	t.Run("source block changed", func(t *testing.T) {
+		bkt, metas, dir, comp := prepare(t)
+		defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+		g := checkpointTestGroup(t, ctx, bkt, &faultyBucket{Bucket: bkt, failUploads: true})
+		_, _, err := g.Compact(ctx, dir, comp)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, 1, comp.compactions)
+
+		cp, err := readCheckpoint(filepath.Join(dir, g.Key()))
+		testutil.Ok(t, err)
+		testutil.Assert(t, cp != nil && cp.Compacted != nil, "compacted block not checkpointed")
+
+		// Change a source block in the bucket, which invalidates the checkpoint.
+		changed := *metas[1]
+		changed.Stats.NumTombstones++
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(&changed))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(changed.ULID.String(), metadata.MetaFilename), &buf))
+
+		g = checkpointTestGroup(t, ctx, bkt, bkt)
+		_, compID, err := g.Compact(ctx, dir, comp)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 2, comp.compactions)
+		testutil.Assert(t, compID != *cp.Compacted, "compacted block from discarded checkpoint was reused")
+	})
+}
+
+func TestGroup_Compact_OverlapTolerance_e2e(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	extLset := labels.Labels{{Name: "e1", Value: "1"}}
+	series := []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+	}
+
+	for _, tcase := range []struct {
+		name      string
+		tolerance OverlapTolerance
+		halt      bool
+	}{
+		{name: "no tolerance", halt: true},
+		{name: "overlap just under the tolerance", tolerance: OverlapTolerance{MaxDuration: 11 * time.Millisecond}},
+		{name: "overlap at the tolerance", tolerance: OverlapTolerance{MaxDuration: 10 * time.Millisecond}},
+		{name: "overlap just over the tolerance", tolerance: OverlapTolerance{MaxDuration: 9 * time.Millisecond}, halt: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			bkt := inmem.NewBucket()
+			// The blocks overlap by 10ms.
+			metas := createAndUpload(t, bkt, []blockgenSpec{
+				{numSamples: 100, mint: 0, maxt: 1000, extLset: extLset, res: 124, series: series},
+				{numSamples: 100, mint: 990, maxt: 2000, extLset: extLset, res: 124, series: series},
+			})
+
+			dir, err := ioutil.TempDir("", "test-compact-overlap")
+			testutil.Ok(t, err)
+			defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+			duplicateBlocksFilter := block.NewDeduplicateFilter()
+			metaFetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, []block.MetadataFilter{duplicateBlocksFilter}, nil)
+			testutil.Ok(t, err)
+			blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+			ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(nil, bkt, 48*time.Hour)
+			sy, err := NewSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, 1, false, false, tcase.tolerance, false, nil, nil)
+			testutil.Ok(t, err)
+			testutil.Ok(t, sy.SyncMetas(ctx))
+			groups, err := sy.Groups()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(groups))
+
+			comp, err := tsdb.NewLeveledCompactor(ctx, nil, log.NewNopLogger(), []int64{1000, 3000}, nil)
+			testutil.Ok(t, err)
+
+			_, compID, err := groups[0].Compact(ctx, dir, comp)
+			if tcase.halt {
+				testutil.NotOk(t, err)
+				testutil.Assert(t, IsHaltError(err), "expected halt error, got %v", err)
+
+				// The halt event names the group and blocks the compaction halted on.
+				ev := NewHaltEvent(err, time.Time{})
+				testutil.Equals(t, 1, len(ev.Groups))
+				testutil.Equals(t, groups[0].Key(), ev.Groups[0].Group)
+				testutil.Equals(t, []ulid.ULID{metas[0].ULID, metas[1].ULID}, ev.Groups[0].Blocks)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1.0, promtest.ToFloat64(groups[0].verticalCompactions))
+
+			comped, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt, compID)
+			testutil.Ok(t, err)
+			testutil.Equals(t, int64(0), comped.MinTime)
+			testutil.Equals(t, int64(2000), comped.MaxTime)
+			testutil.Equals(t, []ulid.ULID{metas[0].ULID, metas[1].ULID}, comped.Compaction.Sources)
+		})
+	}
+}
+
+func TestGroup_Compact_DiskBudget_e2e(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	var (
+		smallLset = labels.Labels{{Name: "e1", Value: "small"}}
+		largeLset = labels.Labels{{Name: "e1", Value: "large"}}
+		series    []labels.Labels
+	)
+	for i := 0; i < 100; i++ {
+		series = append(series, labels.Labels{{Name: "a", Value: fmt.Sprintf("%d", i)}})
+	}
+
+	bkt := inmem.NewBucket()
+	small := createAndUpload(t, bkt, []blockgenSpec{
+		{numSamples: 10, mint: 0, maxt: 1000, extLset: smallLset, res: 124, series: series[:1]},
+		{numSamples: 10, mint: 1000, maxt: 2000, extLset: smallLset, res: 124, series: series[:1]},
+		{numSamples: 10, mint: 2000, maxt: 3000, extLset: smallLset, res: 124, series: series[:1]},
+		// The most recent block is not planned for compaction.
+		{numSamples: 10, mint: 3000, maxt: 4000, extLset: smallLset, res: 124, series: series[:1]},
+	})
+	large := createAndUpload(t, bkt, []blockgenSpec{
+		{numSamples: 100, mint: 0, maxt: 1000, extLset: largeLset, res: 124, series: series},
+		{numSamples: 100, mint: 1000, maxt: 2000, extLset: largeLset, res: 124, series: series},
+		{numSamples: 100, mint: 2000, maxt: 3000, extLset: largeLset, res: 124, series: series},
+		// The most recent block is not planned for compaction.
+		{numSamples: 100, mint: 3000, maxt: 4000, extLset: largeLset, res: 124, series: series},
+	})
+
+	smallSize, err := estimateCompactionDiskUsage(ctx, bkt, []ulid.ULID{small[0].ULID, small[1].ULID, small[2].ULID})
+	testutil.Ok(t, err)
+	largeSize, err := estimateCompactionDiskUsage(ctx, bkt, []ulid.ULID{large[0].ULID, large[1].ULID, large[2].ULID})
+	testutil.Ok(t, err)
+	testutil.Assert(t, smallSize < largeSize, "small group estimate %d should be less than large group estimate %d", smallSize, largeSize)
+
+	dir, err := ioutil.TempDir("", "test-compact-disk-budget")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	budget := NewDiskBudget(nil, smallSize+(largeSize-smallSize)/2)
+
+	duplicateBlocksFilter := block.NewDeduplicateFilter()
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, []block.MetadataFilter{duplicateBlocksFilter}, nil)
+	testutil.Ok(t, err)
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(nil, bkt, 48*time.Hour)
+	sy, err := NewSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, 1, false, false, OverlapTolerance{}, false, budget, nil)
+	testutil.Ok(t, err)
+	testutil.Ok(t, sy.SyncMetas(ctx))
+	groups, err := sy.Groups()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(groups))
+
+	var smallGroup, largeGroup *Group
+	for _, g := range groups {
+		if labels.Equal(g.labels, smallLset) {
+			smallGroup = g
+		} else {
+			largeGroup = g
+		}
+	}
+
+	comp, err := tsdb.NewLeveledCompactor(ctx, nil, log.NewNopLogger(), []int64{1000, 3000}, nil)
+	testutil.Ok(t, err)
+
+	// The large group never fits the budget and is skipped.
+	rerun, compID, err := largeGroup.Compact(ctx, dir, comp)
+	testutil.Ok(t, err)
+	testutil.Assert(t, !rerun, "compaction exceeding the budget should not be rerun")
+	testutil.Equals(t, ulid.ULID{}, compID)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(largeGroup.compactionsDeferred))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(largeGroup.compactions))
+
+	// Skipped compactions do not count as successful runs, no matter how often the group is skipped.
+	_, _, err = largeGroup.Compact(ctx, dir, comp)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2.0, promtest.ToFloat64(largeGroup.compactionsDeferred))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(largeGroup.compactionRunsCompleted))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(largeGroup.lastSuccessfulRun))
+
+	// The small group is deferred while other compactions hold too much of the budget.
+	held := budget.limit - smallSize + 1
+	testutil.Assert(t, budget.reserve(held), "reservation should fit the budget")
+	rerun, compID, err = smallGroup.Compact(ctx, dir, comp)
+	testutil.Ok(t, err)
+	testutil.Assert(t, rerun, "deferred compaction should be rerun")
+	testutil.Equals(t, ulid.ULID{}, compID)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(smallGroup.compactionsDeferred))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(smallGroup.lastSuccessfulRun))
+	budget.release(held)
+
+	// Once the budget is released, the small group is compacted.
+	before := float64(time.Now().Unix())
+	_, compID, err = smallGroup.Compact(ctx, dir, comp)
+	testutil.Ok(t, err)
+	testutil.Assert(t, promtest.ToFloat64(smallGroup.lastSuccessfulRun) >= before, "successful run should set the timestamp of the last successful run")
+	testutil.Assert(t, compID != ulid.ULID{}, "small group should be compacted")
+	testutil.Equals(t, 1.0, promtest.ToFloat64(smallGroup.compactions))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(smallGroup.compactionsDeferred))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(budget.reservedBytes))
+
+	comped, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt, compID)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{small[0].ULID, small[1].ULID, small[2].ULID}, comped.Compaction.Sources)
+}
+
+// checkpointTestGroup returns the only compaction group of the given bucket with checkpoints enabled.
+// The group operates on the given group bucket.
+func checkpointTestGroup(t *testing.T, ctx context.Context, bkt objstore.Bucket, groupBkt objstore.Bucket) *Group {
+	duplicateBlocksFilter := block.NewDeduplicateFilter()
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, []block.MetadataFilter{duplicateBlocksFilter}, nil)
+	testutil.Ok(t, err)
+
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(nil, bkt, 48*time.Hour)
+	sy, err := NewSyncer(nil, nil, groupBkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, 1, false, false, OverlapTolerance{}, true, nil, nil)
+	testutil.Ok(t, err)
+	testutil.Ok(t, sy.SyncMetas(ctx))
+
+	groups, err := sy.Groups()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(groups))
+	return groups[0]
+}
+
+// countingCompactor counts the compactions done by the wrapped compactor.
+type countingCompactor struct {
+	tsdb.Compactor
+	compactions int
+}
+
+func (c *countingCompactor) Compact(dest string, dirs []string, open []*tsdb.Block) (ulid.ULID, error) {
+	c.compactions++
+	return c.Compactor.Compact(dest, dirs, open)
+}
+
+// faultyBucket is a bucket that optionally fails all uploads or reads of objects with the given prefix.
+// It counts the reads of objects per block.
+type faultyBucket struct {
+	objstore.Bucket
+	failUploads bool
+	failGets    string
+
+	mtx       sync.Mutex
+	blockGets map[string]int
+}
+
+func (b *faultyBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if b.failUploads {
+		return errors.Errorf("upload of %s failed", name)
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func (b *faultyBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.mtx.Lock()
+	if b.blockGets == nil {
+		b.blockGets = map[string]int{}
+	}
+	b.blockGets[strings.Split(name, objstore.DirDelim)[0]]++
+	b.mtx.Unlock()
+
+	if b.failGets != "" && strings.HasPrefix(name, b.failGets) {
+		return nil, errors.Errorf("get of %s failed", name)
+	}
+	return b.Bucket.Get(ctx, name)
+}
+
+func (b *faultyBucket) gets(id ulid.ULID) int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.blockGets[id.String()]
+}
+
 type blockgenSpec struct {
 	mint, maxt int64
 	series     []labels.Labels
@@ -416,3 +836,82 @@ func createAndUpload(t testing.TB, bkt objstore.Bucket, blocks []blockgenSpec) (
 	}
 	return metas
 }
+
+func TestBucketCompactor_SelectorRelabel_e2e(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	var (
+		selectedLset = labels.Labels{{Name: "tenant", Value: "a"}}
+		ignoredLset  = labels.Labels{{Name: "tenant", Value: "b"}}
+		series       = []labels.Labels{{{Name: "a", Value: "1"}}}
+	)
+	bkt := inmem.NewBucket()
+	selected := createAndUpload(t, bkt, []blockgenSpec{
+		{numSamples: 10, mint: 0, maxt: 1000, extLset: selectedLset, res: 124, series: series},
+		{numSamples: 10, mint: 1000, maxt: 2000, extLset: selectedLset, res: 124, series: series},
+		{numSamples: 10, mint: 2000, maxt: 3000, extLset: selectedLset, res: 124, series: series},
+		// The most recent block is not planned for compaction.
+		{numSamples: 10, mint: 3000, maxt: 4000, extLset: selectedLset, res: 124, series: series},
+	})
+	// Overlapping blocks would halt the compactor if they were selected.
+	ignored := createAndUpload(t, bkt, []blockgenSpec{
+		{numSamples: 10, mint: 0, maxt: 1000, extLset: ignoredLset, res: 124, series: series},
+		{numSamples: 10, mint: 500, maxt: 1500, extLset: ignoredLset, res: 124, series: series},
+		{numSamples: 10, mint: 1500, maxt: 3000, extLset: ignoredLset, res: 124, series: series},
+		{numSamples: 10, mint: 3000, maxt: 4000, extLset: ignoredLset, res: 124, series: series},
+	})
+
+	dir, err := ioutil.TempDir("", "test-compact-selector-relabel")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(nil, bkt, 48*time.Hour)
+	duplicateBlocksFilter := block.NewDeduplicateFilter()
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, []block.MetadataFilter{
+		block.NewLabelShardedMetaFilter([]*relabel.Config{{
+			Action:       relabel.Keep,
+			SourceLabels: model.LabelNames{"tenant"},
+			Regex:        relabel.MustNewRegexp("a"),
+		}}),
+		ignoreDeletionMarkFilter,
+		duplicateBlocksFilter,
+	}, nil)
+	testutil.Ok(t, err)
+
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	sy, err := NewSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, 1, false, false, OverlapTolerance{}, false, nil, nil)
+	testutil.Ok(t, err)
+
+	comp, err := tsdb.NewLeveledCompactor(ctx, nil, log.NewNopLogger(), []int64{1000, 3000}, nil)
+	testutil.Ok(t, err)
+	bComp, err := NewBucketCompactor(log.NewNopLogger(), sy, comp, dir, bkt, 1, nil)
+	testutil.Ok(t, err)
+	testutil.Ok(t, bComp.Compact(ctx))
+
+	groups, err := sy.Groups()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(groups))
+	testutil.Equals(t, selectedLset, groups[0].Labels())
+
+	// Only the selected blocks were compacted, while the ignored ones are left untouched.
+	fetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, nil, nil)
+	testutil.Ok(t, err)
+	all, _, err := fetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+
+	var compacted []ulid.ULID
+	for _, m := range all {
+		if labels.FromMap(m.Thanos.Labels).Get("tenant") == "a" && m.Compaction.Level > 1 {
+			compacted = append(compacted, m.Compaction.Sources...)
+		}
+	}
+	testutil.Equals(t, []ulid.ULID{selected[0].ULID, selected[1].ULID, selected[2].ULID}, compacted)
+	for _, m := range ignored {
+		_, ok := all[m.ULID]
+		testutil.Assert(t, ok, "ignored block %s should not be removed", m.ULID)
+		marked, err := bkt.Exists(ctx, path.Join(m.ULID.String(), metadata.DeletionMarkFilename))
+		testutil.Ok(t, err)
+		testutil.Assert(t, !marked, "ignored block %s should not be marked for deletion", m.ULID)
+	}
+}
@@ -5,10 +5,12 @@ package compact
 
 import (
 	"testing"
+	"time"
 
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb"
 	terrors "github.com/prometheus/prometheus/tsdb/errors"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
@@ -109,3 +111,39 @@ func TestGroupKey(t *testing.T) {
 		}
 	}
 }
+
+func TestOverlapTolerance(t *testing.T) {
+	// Two blocks of 1000 samples each overlapping by 10ms, estimated to hold 10 and 20 samples in the overlap.
+	overlaps := tsdb.Overlaps{
+		{Min: 990, Max: 1000}: {
+			{MinTime: 0, MaxTime: 1000, Stats: tsdb.BlockStats{NumSamples: 1000}},
+			{MinTime: 990, MaxTime: 1490, Stats: tsdb.BlockStats{NumSamples: 1000}},
+		},
+	}
+	for _, tcase := range []struct {
+		name      string
+		tolerance OverlapTolerance
+		tolerated bool
+	}{
+		{name: "no tolerance"},
+		{name: "duration just under", tolerance: OverlapTolerance{MaxDuration: 11 * time.Millisecond}, tolerated: true},
+		{name: "duration at", tolerance: OverlapTolerance{MaxDuration: 10 * time.Millisecond}, tolerated: true},
+		{name: "duration just over", tolerance: OverlapTolerance{MaxDuration: 9 * time.Millisecond}},
+		{name: "samples at", tolerance: OverlapTolerance{MaxSamples: 30}, tolerated: true},
+		{name: "samples just over", tolerance: OverlapTolerance{MaxSamples: 29}},
+		{name: "both within", tolerance: OverlapTolerance{MaxDuration: 10 * time.Millisecond, MaxSamples: 30}, tolerated: true},
+		{name: "samples over with duration within", tolerance: OverlapTolerance{MaxDuration: 10 * time.Millisecond, MaxSamples: 29}},
+		{name: "duration over with samples within", tolerance: OverlapTolerance{MaxDuration: 9 * time.Millisecond, MaxSamples: 30}},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			testutil.Equals(t, tcase.tolerated, tcase.tolerance.tolerates(overlaps))
+		})
+	}
+
+	// All overlaps must be within the tolerance.
+	overlaps[tsdb.TimeRange{Min: 1400, Max: 1490}] = []tsdb.BlockMeta{
+		{MinTime: 990, MaxTime: 1490, Stats: tsdb.BlockStats{NumSamples: 1000}},
+		{MinTime: 1400, MaxTime: 2000, Stats: tsdb.BlockStats{NumSamples: 1000}},
+	}
+	testutil.Assert(t, !OverlapTolerance{MaxDuration: 10 * time.Millisecond}.tolerates(overlaps), "large overlap should not be tolerated")
+}
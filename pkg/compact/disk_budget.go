@@ -0,0 +1,115 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// DiskBudget limits the disk space used by concurrent group compactions in the compaction work directory.
+// Each compaction reserves its estimated disk usage before downloading its blocks, and releases it once done.
+// A nil budget or a budget with a limit of 0 is unlimited.
+type DiskBudget struct {
+	limit int64
+
+	mtx      sync.Mutex
+	reserved int64
+
+	reservedBytes prometheus.Gauge
+}
+
+// NewDiskBudget returns a new budget of limit bytes shared by all compactions.
+func NewDiskBudget(reg prometheus.Registerer, limit int64) *DiskBudget {
+	b := &DiskBudget{
+		limit: limit,
+		reservedBytes: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_disk_budget_reserved_bytes",
+			Help: "Estimated disk usage in bytes reserved by the currently running group compactions.",
+		}),
+	}
+	promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_compact_disk_budget_bytes",
+		Help: "Disk budget in bytes of the compaction work directory. 0 if unlimited.",
+	}).Set(float64(limit))
+	return b
+}
+
+func (b *DiskBudget) unlimited() bool {
+	return b == nil || b.limit <= 0
+}
+
+// exceeded returns true if a compaction of the given estimated size can never run within the budget.
+func (b *DiskBudget) exceeded(size int64) bool {
+	return !b.unlimited() && size > b.limit
+}
+
+// reserve reserves size bytes of the budget and returns true, or returns false if the reservation
+// does not fit next to the reservations of currently running compactions.
+func (b *DiskBudget) reserve(size int64) bool {
+	if b.unlimited() {
+		return true
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.reserved+size > b.limit {
+		return false
+	}
+	b.reserved += size
+	b.reservedBytes.Set(float64(b.reserved))
+	return true
+}
+
+// release releases size bytes reserved before.
+func (b *DiskBudget) release(size int64) {
+	if b.unlimited() {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.reserved -= size
+	b.reservedBytes.Set(float64(b.reserved))
+}
+
+// estimateCompactionDiskUsage estimates the disk usage of compacting the given blocks. Both the downloaded
+// source blocks and the compacted block are kept in the work directory until the compaction is done, and the
+// compacted block is assumed to be at most as large as its sources.
+func estimateCompactionDiskUsage(ctx context.Context, bkt objstore.BucketReader, ids []ulid.ULID) (int64, error) {
+	var size int64
+	for _, id := range ids {
+		s, err := bucketDirSize(ctx, bkt, id.String()+objstore.DirDelim)
+		if err != nil {
+			return 0, errors.Wrapf(err, "get size of block %s", id)
+		}
+		size += s
+	}
+	return 2 * size, nil
+}
+
+// bucketDirSize returns the total size of all objects in the given bucket directory and its subdirectories.
+func bucketDirSize(ctx context.Context, bkt objstore.BucketReader, dir string) (int64, error) {
+	var size int64
+	err := objstore.IterWithAttributes(ctx, bkt, dir, func(name string, attrs objstore.ObjectAttributes) error {
+		if !strings.HasSuffix(name, objstore.DirDelim) {
+			size += attrs.Size
+			return nil
+		}
+		s, err := bucketDirSize(ctx, bkt, name)
+		if err != nil {
+			return err
+		}
+		size += s
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,93 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// diskSpaceCheckInterval is the interval at which the free disk space is checked again while compactions are paused.
+const diskSpaceCheckInterval = 30 * time.Second
+
+// DiskSpaceGate pauses the start of new group compactions while the free disk space of the data directory is below
+// a minimum, so that the compactor does not fill the disk mid-operation. Compactions resume once space was freed,
+// e.g. by running compactions uploading their blocks and removing their work directories.
+// A nil DiskSpaceGate never pauses.
+type DiskSpaceGate struct {
+	logger    log.Logger
+	dir       string
+	minFree   uint64
+	interval  time.Duration
+	freeSpace func(dir string) (uint64, error)
+
+	freeBytes prometheus.Gauge
+	paused    prometheus.Gauge
+}
+
+// NewDiskSpaceGate returns a new DiskSpaceGate pausing compactions while the disk of the given directory has less than
+// minFree bytes available. It returns nil if minFree is 0, and an error if the free disk space cannot be determined.
+func NewDiskSpaceGate(logger log.Logger, reg prometheus.Registerer, dir string, minFree uint64) (*DiskSpaceGate, error) {
+	if minFree == 0 {
+		return nil, nil
+	}
+	if _, err := freeDiskSpace(dir); err != nil {
+		return nil, errors.Wrapf(err, "get free disk space of %s", dir)
+	}
+	return &DiskSpaceGate{
+		logger:    logger,
+		dir:       dir,
+		minFree:   minFree,
+		interval:  diskSpaceCheckInterval,
+		freeSpace: freeDiskSpace,
+		freeBytes: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_disk_free_bytes",
+			Help: "Free disk space in bytes of the data directory, as of the last check before a group compaction.",
+		}),
+		paused: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_disk_free_paused",
+			Help: "Set to 1 while compactions are paused because the free disk space is below its minimum.",
+		}),
+	}, nil
+}
+
+// Wait blocks while the free disk space is below the minimum. It returns the context's error if the context is done
+// before enough space is free. Failures to check the free disk space are logged and do not pause compactions.
+func (g *DiskSpaceGate) Wait(ctx context.Context) error {
+	if g == nil {
+		return nil
+	}
+	defer g.paused.Set(0)
+
+	for paused := false; ; paused = true {
+		free, err := g.freeSpace(g.dir)
+		if err != nil {
+			level.Warn(g.logger).Log("msg", "failed to check free disk space; not pausing compactions", "dir", g.dir, "err", err)
+			return nil
+		}
+		g.freeBytes.Set(float64(free))
+		if free >= g.minFree {
+			if paused {
+				level.Info(g.logger).Log("msg", "free disk space recovered; resuming compactions", "freeBytes", free, "minFreeBytes", g.minFree)
+			}
+			return nil
+		}
+		if !paused {
+			level.Warn(g.logger).Log("msg", "free disk space below minimum; pausing compactions", "freeBytes", free, "minFreeBytes", g.minFree)
+			g.paused.Set(1)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(g.interval):
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestDiskSpaceGate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-disk-space-gate")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	// A gate without minimum never pauses.
+	g, err := NewDiskSpaceGate(log.NewNopLogger(), nil, dir, 0)
+	testutil.Ok(t, err)
+	testutil.Assert(t, g == nil, "expected no gate without minimum")
+	testutil.Ok(t, g.Wait(context.Background()))
+
+	g, err = NewDiskSpaceGate(log.NewNopLogger(), nil, dir, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, g.Wait(context.Background()))
+	testutil.Assert(t, promtest.ToFloat64(g.freeBytes) > 0, "expected the free disk space of the directory")
+
+	_, err = NewDiskSpaceGate(log.NewNopLogger(), nil, "/does/not/exist", 1)
+	testutil.NotOk(t, err)
+
+	// Failures to check the free disk space do not pause.
+	g.freeSpace = func(string) (uint64, error) { return 0, errors.New("failure") }
+	testutil.Ok(t, g.Wait(context.Background()))
+}
@@ -0,0 +1,11 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import "github.com/pkg/errors"
+
+// freeDiskSpace is not supported on Windows.
+func freeDiskSpace(string) (uint64, error) {
+	return 0, errors.New("free disk space is not supported on windows")
+}
@@ -0,0 +1,69 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package downsample
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Level is a resolution level the compactor downsamples blocks to.
+type Level struct {
+	// Resolution of the downsampled blocks in milliseconds.
+	Resolution int64
+	// MinSourceRange is the minimum time range in milliseconds of a block of the previous level
+	// before it is downsampled to this level.
+	MinSourceRange int64
+}
+
+// DefaultLevels are the standard downsampling levels in Thanos: raw blocks are downsampled to 5 minutes,
+// 5 minutes blocks to 1 hour.
+var DefaultLevels = []Level{
+	{Resolution: ResLevel1, MinSourceRange: DownsampleRange0},
+	{Resolution: ResLevel2, MinSourceRange: DownsampleRange1},
+}
+
+// NewLevels returns the downsampling levels for the given resolutions. The first level is downsampled from raw
+// blocks and every following level from the blocks of the previous one, so resolutions must be increasing.
+// The standard resolutions keep their standard minimum source ranges, other resolutions require a source range
+// of 240 times the resolution, so that we get roughly 2 chunks out of every downsampled block.
+func NewLevels(resolutions []time.Duration) ([]Level, error) {
+	levels := make([]Level, 0, len(resolutions))
+	for _, r := range resolutions {
+		res := int64(r / time.Millisecond)
+		if res <= 0 {
+			return nil, errors.Errorf("downsampling resolution %s must be at least 1ms", r)
+		}
+		if len(levels) > 0 && res <= levels[len(levels)-1].Resolution {
+			return nil, errors.Errorf("downsampling resolutions must be increasing, got %s after %s", r, time.Duration(levels[len(levels)-1].Resolution)*time.Millisecond)
+		}
+
+		l := Level{Resolution: res, MinSourceRange: 240 * res}
+		for _, d := range DefaultLevels {
+			if d.Resolution == res {
+				l = d
+			}
+		}
+		levels = append(levels, l)
+	}
+	return levels, nil
+}
+
+// NextLevel returns the level blocks of the given resolution are downsampled to. It returns false if blocks of
+// this resolution are not downsampled further.
+func NextLevel(levels []Level, resolution int64) (Level, bool) {
+	if len(levels) == 0 {
+		return Level{}, false
+	}
+	if resolution == ResLevel0 {
+		return levels[0], true
+	}
+	for i, l := range levels[:len(levels)-1] {
+		if l.Resolution == resolution {
+			return levels[i+1], true
+		}
+	}
+	return Level{}, false
+}
@@ -0,0 +1,37 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package downsample
+
+import (
+	"testing"
+	"time"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestLevels(t *testing.T) {
+	levels, err := NewLevels([]time.Duration{5 * time.Minute, time.Hour})
+	testutil.Ok(t, err)
+	testutil.Equals(t, DefaultLevels, levels)
+
+	for _, c := range []struct {
+		res  int64
+		next int64
+		ok   bool
+	}{
+		{res: ResLevel0, next: ResLevel1, ok: true},
+		{res: ResLevel1, next: ResLevel2, ok: true},
+		{res: ResLevel2},
+		{res: 10 * 60 * 1000},
+	} {
+		next, ok := NextLevel(levels, c.res)
+		testutil.Equals(t, c.ok, ok)
+		testutil.Equals(t, c.next, next.Resolution)
+	}
+
+	_, err = NewLevels([]time.Duration{time.Hour, 5 * time.Minute})
+	testutil.NotOk(t, err)
+	_, err = NewLevels([]time.Duration{0})
+	testutil.NotOk(t, err)
+}
@@ -0,0 +1,155 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// iterCountingBucket counts the iterations over the bucket.
+type iterCountingBucket struct {
+	objstore.Bucket
+	iters int32
+}
+
+func (b *iterCountingBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	atomic.AddInt32(&b.iters, 1)
+	return b.Bucket.Iter(ctx, dir, f, options...)
+}
+
+// testGate is a closed gate and the functions to control and inspect it.
+type testGate struct {
+	gate Gate
+	// open allows compactions again.
+	open func()
+	// close pauses compactions.
+	close func()
+	// paused returns the value of the paused metric of the gate.
+	paused func() float64
+}
+
+func TestBucketCompactor_Gates(t *testing.T) {
+	for _, tcase := range []struct {
+		name    string
+		newGate func(t *testing.T, dir string) testGate
+	}{
+		{
+			name: "pauser",
+			newGate: func(t *testing.T, _ string) testGate {
+				p := NewPauser(nil, nil)
+				p.Pause()
+				return testGate{gate: p, open: p.Resume, close: p.Pause, paused: func() float64 { return promtest.ToFloat64(p.paused) }}
+			},
+		},
+		{
+			name: "disk space",
+			newGate: func(t *testing.T, dir string) testGate {
+				g, err := NewDiskSpaceGate(log.NewNopLogger(), nil, dir, 100)
+				testutil.Ok(t, err)
+				g.interval = 10 * time.Millisecond
+				var free uint64 = 10
+				g.freeSpace = func(string) (uint64, error) { return atomic.LoadUint64(&free), nil }
+				return testGate{
+					gate:   g,
+					open:   func() { atomic.StoreUint64(&free, 1000) },
+					close:  func() { atomic.StoreUint64(&free, 10) },
+					paused: func() float64 { return promtest.ToFloat64(g.paused) },
+				}
+			},
+		},
+		{
+			name: "maintenance window",
+			newGate: func(t *testing.T, _ string) testGate {
+				window, err := ParseMaintenanceWindow("mon 08:00-18:00")
+				testutil.Ok(t, err)
+				m := NewMaintenanceWindows(log.NewNopLogger(), nil, []MaintenanceWindow{window})
+				m.interval = 10 * time.Millisecond
+				// 2020-06-01 is a Monday.
+				now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC).UnixNano()
+				m.now = func() time.Time { return time.Unix(0, atomic.LoadInt64(&now)).UTC() }
+				return testGate{
+					gate:   m,
+					open:   func() { atomic.StoreInt64(&now, time.Date(2020, 6, 1, 18, 0, 0, 0, time.UTC).UnixNano()) },
+					close:  func() { atomic.StoreInt64(&now, time.Date(2020, 6, 8, 8, 0, 0, 0, time.UTC).UnixNano()) },
+					paused: func() float64 { return promtest.ToFloat64(m.paused) },
+				}
+			},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			testBucketCompactorGate(t, tcase.newGate)
+		})
+	}
+}
+
+// testBucketCompactorGate checks that the bucket compactor starts no work while the gate is closed, resumes once
+// it is opened and aborts paused compactions once the context is done.
+func testBucketCompactorGate(t *testing.T, newGate func(t *testing.T, dir string) testGate) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test-compact-gate")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := &iterCountingBucket{Bucket: inmem.NewBucket()}
+
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(nil, bkt, 48*time.Hour)
+	duplicateBlocksFilter := block.NewDeduplicateFilter()
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, []block.MetadataFilter{
+		ignoreDeletionMarkFilter,
+		duplicateBlocksFilter,
+	}, nil)
+	testutil.Ok(t, err)
+
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	sy, err := NewSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, 5, false, false, OverlapTolerance{}, false, nil, nil)
+	testutil.Ok(t, err)
+
+	comp, err := tsdb.NewLeveledCompactor(ctx, nil, nil, []int64{1000, 3000}, nil)
+	testutil.Ok(t, err)
+
+	g := newGate(t, dir)
+	bComp, err := NewBucketCompactor(log.NewNopLogger(), sy, comp, dir, bkt, 1, []Gate{g.gate})
+	testutil.Ok(t, err)
+
+	done := make(chan error)
+	go func() { done <- bComp.Compact(ctx) }()
+
+	// No work is started while the gate is closed.
+	select {
+	case err := <-done:
+		t.Fatalf("compaction finished while paused: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	testutil.Equals(t, int32(0), atomic.LoadInt32(&bkt.iters))
+	testutil.Equals(t, 1.0, g.paused())
+
+	g.open()
+	testutil.Ok(t, <-done)
+	testutil.Assert(t, atomic.LoadInt32(&bkt.iters) > 0, "expected the bucket to be synced after resume")
+	testutil.Equals(t, 0.0, g.paused())
+
+	// Paused compactions are aborted once the context is done.
+	g.close()
+	cctx, ccancel := context.WithCancel(ctx)
+	ccancel()
+	testutil.Equals(t, context.Canceled, errors.Cause(bComp.Compact(cctx)))
+}
@@ -0,0 +1,138 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	terrors "github.com/prometheus/prometheus/tsdb/errors"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// HaltMarkFilename is the name of the object written to the root of the bucket when the compactor halts.
+const HaltMarkFilename = "compactor-halt-mark.json"
+
+// HaltEvent describes why the compactor halted.
+type HaltEvent struct {
+	// Time is the time the compactor halted.
+	Time time.Time `json:"time"`
+	// Reason is the error the compactor halted on.
+	Reason string `json:"reason"`
+	// Groups are the compaction groups whose compaction halted the compactor.
+	Groups []HaltedGroup `json:"groups,omitempty"`
+}
+
+// HaltedGroup is a compaction group whose compaction halted the compactor.
+type HaltedGroup struct {
+	// Group is the key of the compaction group.
+	Group string `json:"group"`
+	// Reason is the error the compaction of the group halted on.
+	Reason string `json:"reason"`
+	// Blocks are the blocks of the compaction group.
+	Blocks []ulid.ULID `json:"blocks"`
+}
+
+// NewHaltEvent returns the halt event of the given error, which is expected to be a halt error or a multierror
+// containing halt errors.
+func NewHaltEvent(err error, t time.Time) HaltEvent {
+	ev := HaltEvent{Time: t, Reason: err.Error()}
+
+	errs := []error{err}
+	if multiErr, ok := errors.Cause(err).(terrors.MultiError); ok {
+		errs = multiErr
+	}
+	for _, err := range errs {
+		if he, ok := errors.Cause(err).(HaltError); ok && he.group != "" {
+			ev.Groups = append(ev.Groups, HaltedGroup{Group: he.group, Reason: he.Error(), Blocks: he.blocks})
+		}
+	}
+	return ev
+}
+
+// HaltNotifier notifies about the compactor halting by posting the halt event to a webhook and writing it to the
+// bucket as halt mark. A nil HaltNotifier does not notify.
+type HaltNotifier struct {
+	logger     log.Logger
+	client     *http.Client
+	webhookURL string
+	bkt        objstore.Bucket
+}
+
+// NewHaltNotifier returns a new HaltNotifier posting halt events to the given webhook URL, if not empty, and writing
+// them to the given bucket, if not nil. It returns nil if there is neither a webhook URL nor a bucket.
+func NewHaltNotifier(logger log.Logger, webhookURL string, bkt objstore.Bucket) *HaltNotifier {
+	if webhookURL == "" && bkt == nil {
+		return nil
+	}
+	return &HaltNotifier{
+		logger:     logger,
+		client:     http.DefaultClient,
+		webhookURL: webhookURL,
+		bkt:        bkt,
+	}
+}
+
+// Notify notifies about the compactor halting on the given error. The webhook and the bucket are notified
+// independently, errors of both are returned.
+func (n *HaltNotifier) Notify(ctx context.Context, err error) error {
+	if n == nil {
+		return nil
+	}
+
+	b, merr := json.Marshal(NewHaltEvent(err, time.Now()))
+	if merr != nil {
+		return errors.Wrap(merr, "marshal halt event")
+	}
+
+	var errs terrors.MultiError
+	if n.webhookURL != "" {
+		errs.Add(errors.Wrap(n.post(ctx, b), "post halt event to webhook"))
+	}
+	if n.bkt != nil {
+		errs.Add(errors.Wrap(n.bkt.Upload(ctx, HaltMarkFilename, bytes.NewReader(b)), "upload halt mark"))
+	}
+	return errs.Err()
+}
+
+func (n *HaltNotifier) post(ctx context.Context, b []byte) error {
+	req, err := http.NewRequest("POST", n.webhookURL, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(ctx)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer runutil.ExhaustCloseWithLogOnErr(n.logger, resp.Body, "halt webhook resp body")
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("received non-2xx response: %s", resp.Status)
+	}
+	return nil
+}
+
+// Reset removes the halt mark of a previous halt from the bucket, if any.
+func (n *HaltNotifier) Reset(ctx context.Context) error {
+	if n == nil || n.bkt == nil {
+		return nil
+	}
+	if err := n.bkt.Delete(ctx, HaltMarkFilename); err != nil && !n.bkt.IsObjNotFoundErr(err) {
+		return errors.Wrap(err, "delete halt mark")
+	}
+	level.Debug(n.logger).Log("msg", "removed halt mark of previous halt", "path", HaltMarkFilename)
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	terrors "github.com/prometheus/prometheus/tsdb/errors"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestHaltNotifier(t *testing.T) {
+	ctx := context.Background()
+
+	var (
+		received    []HaltEvent
+		contentType string
+		status      = http.StatusOK
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.Equals(t, http.MethodPost, r.Method)
+		contentType = r.Header.Get("Content-Type")
+
+		var ev HaltEvent
+		testutil.Ok(t, json.NewDecoder(r.Body).Decode(&ev))
+		received = append(received, ev)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	bkt := inmem.NewBucket()
+	n := NewHaltNotifier(log.NewNopLogger(), srv.URL, bkt)
+
+	// Simulate compactions of two groups, one of them halting.
+	blocks := []ulid.ULID{ulid.MustNew(1, nil), ulid.MustNew(2, nil)}
+	haltErr := halt(errors.New("pre compaction overlap check: overlaps found"))
+	haltErr.group, haltErr.blocks = "0@123", blocks
+	var errs terrors.MultiError
+	errs.Add(errors.New("other group failed"))
+	errs.Add(haltErr)
+	err := errors.Wrap(errs, "compaction")
+
+	testutil.Ok(t, n.Notify(ctx, err))
+	testutil.Equals(t, 1, len(received))
+	testutil.Equals(t, "application/json", contentType)
+
+	ev := received[0]
+	testutil.Equals(t, err.Error(), ev.Reason)
+	testutil.Assert(t, time.Since(ev.Time) < time.Minute, "unexpected halt time %v", ev.Time)
+	testutil.Equals(t, []HaltedGroup{{
+		Group:  "0@123",
+		Reason: "pre compaction overlap check: overlaps found",
+		Blocks: blocks,
+	}}, ev.Groups)
+
+	// The same event is written to the bucket as halt mark.
+	r, err := bkt.Get(ctx, HaltMarkFilename)
+	testutil.Ok(t, err)
+	b, err := ioutil.ReadAll(r)
+	testutil.Ok(t, err)
+	var mark HaltEvent
+	testutil.Ok(t, json.Unmarshal(b, &mark))
+	testutil.Equals(t, ev, mark)
+
+	// The mark is removed on reset.
+	testutil.Ok(t, n.Reset(ctx))
+	_, err = bkt.Get(ctx, HaltMarkFilename)
+	testutil.Assert(t, bkt.IsObjNotFoundErr(err), "expected halt mark to be removed, got %v", err)
+	testutil.Ok(t, n.Reset(ctx))
+
+	// Failing webhooks are reported, while the halt mark is still written.
+	status = http.StatusInternalServerError
+	testutil.NotOk(t, n.Notify(ctx, haltErr))
+	testutil.Equals(t, 2, len(received))
+	_, err = bkt.Get(ctx, HaltMarkFilename)
+	testutil.Ok(t, err)
+
+	// Without webhook and bucket nothing is notified.
+	n = NewHaltNotifier(log.NewNopLogger(), "", nil)
+	testutil.Assert(t, n == nil, "expected no halt notifier")
+	testutil.Ok(t, n.Notify(ctx, haltErr))
+	testutil.Ok(t, n.Reset(ctx))
+}
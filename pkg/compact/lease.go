@@ -0,0 +1,272 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const (
+	// LeaseFilename is the known JSON filename of the compactor leader lease in the root of the bucket.
+	LeaseFilename = "compactor-lease.json"
+
+	leaseVersion1 = 1
+)
+
+// leaseRecord is the content of the lease object.
+type leaseRecord struct {
+	Version int `json:"version"`
+	// Holder identifies the compactor replica holding the lease.
+	Holder string `json:"holder"`
+	// Expires is the time after which the lease can be taken over by another replica,
+	// unless it was renewed by the holder.
+	Expires time.Time `json:"expires"`
+}
+
+// Lease elects a single leader among compactor replicas running against the same bucket.
+// The leader holds a lease object in the bucket and renews it periodically. Other replicas stand by
+// and take over the lease once it expired.
+//
+// Object storages do not offer compare-and-swap operations, so acquiring the lease is best effort:
+// after writing the lease, it is read back after a settle delay to detect concurrent writers, and the
+// last writer wins. To make sure a leader never works alongside its successor, work run with Do is
+// canceled as soon as the lease was lost or could not be renewed before it expires. Expiry times are
+// compared across replicas, so their clocks are expected to be roughly in sync.
+type Lease struct {
+	logger   log.Logger
+	bkt      objstore.Bucket
+	holder   string
+	duration time.Duration
+	settle   time.Duration
+	now      func() time.Time
+
+	mtx     sync.Mutex
+	expires time.Time
+	cancels map[int]context.CancelFunc
+	nextID  int
+
+	leader prometheus.Gauge
+}
+
+// NewLease returns a new Lease of the given duration for the replica identified by holder.
+func NewLease(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket, holder string, duration time.Duration) (*Lease, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	if holder == "" {
+		return nil, errors.New("empty lease holder")
+	}
+	if duration <= 0 {
+		return nil, errors.New("lease duration must be positive")
+	}
+	return &Lease{
+		logger:   logger,
+		bkt:      bkt,
+		holder:   holder,
+		duration: duration,
+		settle:   duration / 10,
+		now:      time.Now,
+		cancels:  map[int]context.CancelFunc{},
+		leader: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compactor_leader",
+			Help: "Set to 1 if the compactor holds the leader lease.",
+		}),
+	}, nil
+}
+
+// renewInterval returns the interval in which the lease is renewed by its holder.
+func (l *Lease) renewInterval() time.Duration {
+	return l.duration / 3
+}
+
+// held returns true if the lease is held and not about to expire before its next renewal.
+// The caller must hold the mutex.
+func (l *Lease) held() bool {
+	return l.now().Add(l.renewInterval()).Before(l.expires)
+}
+
+// IsLeader returns true if the replica currently holds the lease.
+func (l *Lease) IsLeader() bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.held()
+}
+
+// TryAcquire acquires the lease if it is free or expired, or renews it if it is already held by the replica.
+// It returns true if the replica holds the lease afterwards.
+// If the lease is lost or cannot be renewed in time, all work run with Do is canceled.
+func (l *Lease) TryAcquire(ctx context.Context) (bool, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	wasLeader := l.held()
+	ok, err := l.tryAcquire(ctx)
+	if err != nil {
+		level.Warn(l.logger).Log("msg", "failed to acquire or renew leader lease", "err", err)
+	}
+	if l.held() {
+		l.leader.Set(1)
+		return ok, err
+	}
+	if wasLeader {
+		level.Warn(l.logger).Log("msg", "leader lease lost, aborting work", "holder", l.holder)
+	}
+	l.release()
+	l.leader.Set(0)
+	return ok, err
+}
+
+func (l *Lease) tryAcquire(ctx context.Context) (bool, error) {
+	rec, err := l.read(ctx)
+	if err != nil {
+		return false, err
+	}
+	now := l.now()
+	if rec != nil && rec.Holder != l.holder && now.Before(rec.Expires) {
+		l.expires = time.Time{}
+		return false, nil
+	}
+	if rec == nil || rec.Holder != l.holder {
+		level.Info(l.logger).Log("msg", "acquiring leader lease", "holder", l.holder)
+	}
+
+	expires := now.Add(l.duration)
+	if err := l.write(ctx, leaseRecord{Version: leaseVersion1, Holder: l.holder, Expires: expires}); err != nil {
+		return false, err
+	}
+
+	// Another replica might have written the lease concurrently. Wait for concurrent
+	// writes to settle and only consider the lease held if our write was the last one.
+	if rec == nil || rec.Holder != l.holder {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(l.settle):
+		}
+		if rec, err = l.read(ctx); err != nil {
+			return false, err
+		}
+		if rec == nil || rec.Holder != l.holder {
+			l.expires = time.Time{}
+			return false, nil
+		}
+	}
+	l.expires = expires
+	return true, nil
+}
+
+// release cancels all work run with Do. The caller must hold the mutex.
+func (l *Lease) release() {
+	for _, cancel := range l.cancels {
+		cancel()
+	}
+	l.cancels = map[int]context.CancelFunc{}
+}
+
+// Run renews the lease, or tries to acquire it if it is not held, until the given context is canceled.
+// If the lease is held on return, it is deleted from the bucket so that a standby replica can take over
+// without waiting for it to expire.
+func (l *Lease) Run(ctx context.Context) error {
+	err := runutil.Repeat(l.renewInterval(), ctx.Done(), func() error {
+		_, _ = l.TryAcquire(ctx)
+		return nil
+	})
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.release()
+	if !l.expires.IsZero() {
+		l.expires = time.Time{}
+		l.leader.Set(0)
+		// The given context is already canceled, use a fresh one bounded by the lease duration.
+		dctx, cancel := context.WithTimeout(context.Background(), l.duration)
+		defer cancel()
+		if rec, rerr := l.read(dctx); rerr == nil && rec != nil && rec.Holder == l.holder {
+			if derr := l.bkt.Delete(dctx, LeaseFilename); derr != nil {
+				level.Warn(l.logger).Log("msg", "failed to delete leader lease", "err", derr)
+			}
+		}
+	}
+	return err
+}
+
+// Do runs f if the replica holds the lease, trying to acquire it first if needed.
+// The context passed to f is canceled once the lease is lost or cannot be renewed in time.
+// It returns false without running f if another replica holds the lease.
+func (l *Lease) Do(ctx context.Context, f func(ctx context.Context) error) (bool, error) {
+	if !l.IsLeader() {
+		ok, err := l.TryAcquire(ctx)
+		if err != nil {
+			return false, errors.Wrap(err, "acquire leader lease")
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	l.mtx.Lock()
+	if !l.held() {
+		l.mtx.Unlock()
+		return false, nil
+	}
+	id := l.nextID
+	l.nextID++
+	l.cancels[id] = cancel
+	l.mtx.Unlock()
+
+	defer func() {
+		l.mtx.Lock()
+		delete(l.cancels, id)
+		l.mtx.Unlock()
+	}()
+	return true, f(ctx)
+}
+
+func (l *Lease) read(ctx context.Context) (*leaseRecord, error) {
+	r, err := l.bkt.Get(ctx, LeaseFilename)
+	if l.bkt.IsObjNotFoundErr(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "get lease")
+	}
+	defer runutil.CloseWithLogOnErr(l.logger, r, "lease reader")
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "read lease")
+	}
+	var rec leaseRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, errors.Wrap(err, "unmarshal lease")
+	}
+	if rec.Version != leaseVersion1 {
+		return nil, errors.Errorf("unexpected lease version %d", rec.Version)
+	}
+	return &rec, nil
+}
+
+func (l *Lease) write(ctx context.Context, rec leaseRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "marshal lease")
+	}
+	return errors.Wrap(l.bkt.Upload(ctx, LeaseFilename, bytes.NewReader(b)), "upload lease")
+}
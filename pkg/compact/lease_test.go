@@ -0,0 +1,247 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// partitionedBucket fails all lease operations while partitioned.
+type partitionedBucket struct {
+	objstore.Bucket
+	partitioned int32
+}
+
+func (b *partitionedBucket) err() error {
+	if atomic.LoadInt32(&b.partitioned) == 1 {
+		return errors.New("partitioned")
+	}
+	return nil
+}
+
+func (b *partitionedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+	return b.Bucket.Get(ctx, name)
+}
+
+func (b *partitionedBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.err(); err != nil {
+		return err
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func (b *partitionedBucket) Delete(ctx context.Context, name string) error {
+	if err := b.err(); err != nil {
+		return err
+	}
+	return b.Bucket.Delete(ctx, name)
+}
+
+func newTestLease(t *testing.T, bkt objstore.Bucket, holder string, now *time.Time) *Lease {
+	l, err := NewLease(nil, prometheus.NewRegistry(), bkt, holder, time.Minute)
+	testutil.Ok(t, err)
+	l.settle = 0
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestLease_TryAcquire(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	bkt := &partitionedBucket{Bucket: inmem.NewBucket()}
+	a := newTestLease(t, bkt, "a", &now)
+	b := newTestLease(t, bkt, "b", &now)
+
+	acquire := func(l *Lease) bool {
+		ok, err := l.TryAcquire(ctx)
+		testutil.Ok(t, err)
+		return ok
+	}
+
+	testutil.Assert(t, acquire(a), "a should acquire the free lease")
+	testutil.Assert(t, !acquire(b), "b should not acquire the lease held by a")
+	testutil.Assert(t, a.IsLeader(), "a should be the leader")
+	testutil.Assert(t, !b.IsLeader(), "b should not be the leader")
+
+	// Renewals keep the lease held beyond its initial duration.
+	now = now.Add(40 * time.Second)
+	testutil.Assert(t, acquire(a), "a should renew its lease")
+	now = now.Add(40 * time.Second)
+	testutil.Assert(t, !acquire(b), "b should not acquire the renewed lease")
+	testutil.Assert(t, acquire(a), "a should renew its lease")
+
+	// A failed renewal is tolerated as long as the lease does not expire before the next one.
+	now = now.Add(20 * time.Second)
+	atomic.StoreInt32(&bkt.partitioned, 1)
+	_, err := a.TryAcquire(ctx)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, a.IsLeader(), "a should still be the leader")
+	now = now.Add(20 * time.Second)
+	_, err = a.TryAcquire(ctx)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, !a.IsLeader(), "a should not be the leader with its lease about to expire")
+	atomic.StoreInt32(&bkt.partitioned, 0)
+
+	// Expired leases are taken over.
+	now = now.Add(21 * time.Second)
+	testutil.Assert(t, acquire(b), "b should acquire the expired lease")
+	testutil.Assert(t, !acquire(a), "a should not acquire the lease taken over by b")
+
+	// Leases are released on shutdown.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	testutil.Ok(t, b.Run(cctx))
+	testutil.Assert(t, !b.IsLeader(), "b should not be the leader after shutdown")
+	testutil.Assert(t, acquire(a), "a should acquire the released lease")
+}
+
+func TestLease_Do(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	bkt := &partitionedBucket{Bucket: inmem.NewBucket()}
+	a := newTestLease(t, bkt, "a", &now)
+	b := newTestLease(t, bkt, "b", &now)
+
+	leader, err := a.Do(ctx, func(context.Context) error { return nil })
+	testutil.Ok(t, err)
+	testutil.Assert(t, leader, "a should acquire the free lease and run")
+
+	leader, err = b.Do(ctx, func(context.Context) error {
+		t.Error("standby replica should not run")
+		return nil
+	})
+	testutil.Ok(t, err)
+	testutil.Assert(t, !leader, "b should stand by")
+
+	// Work of a leader that loses its lease is aborted.
+	started := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.Do(ctx, func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		done <- err
+	}()
+	<-started
+
+	now = now.Add(2 * time.Minute)
+	ok, err := b.TryAcquire(ctx)
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "b should acquire the expired lease")
+
+	ok, err = a.TryAcquire(ctx)
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "a should have lost its lease")
+	select {
+	case err := <-done:
+		testutil.Equals(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("work of the former leader was not aborted")
+	}
+}
+
+func TestLease_Failover(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		bkt    = inmem.NewBucket()
+		active int32
+		worked = map[string]int{}
+		mtx    sync.Mutex
+		wg     sync.WaitGroup
+	)
+
+	type replica struct {
+		lease *Lease
+		bkt   *partitionedBucket
+	}
+	start := func(name string) *replica {
+		r := &replica{bkt: &partitionedBucket{Bucket: bkt}}
+		var err error
+		r.lease, err = NewLease(nil, prometheus.NewRegistry(), r.bkt, name, 300*time.Millisecond)
+		testutil.Ok(t, err)
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = r.lease.Run(ctx)
+		}()
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				_, _ = r.lease.Do(ctx, func(ctx context.Context) error {
+					if n := atomic.AddInt32(&active, 1); n > 1 {
+						t.Errorf("%d replicas working concurrently", n)
+					}
+					defer atomic.AddInt32(&active, -1)
+
+					mtx.Lock()
+					worked[name]++
+					mtx.Unlock()
+
+					select {
+					case <-ctx.Done():
+					case <-time.After(20 * time.Millisecond):
+					}
+					return nil
+				})
+				time.Sleep(5 * time.Millisecond)
+			}
+		}()
+		return r
+	}
+	workedBy := func(name string) int {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return worked[name]
+	}
+	waitFor := func(cond func() bool, msg string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal(msg)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	a := start("a")
+	waitFor(a.lease.IsLeader, "a did not become the leader")
+	b := start("b")
+
+	time.Sleep(500 * time.Millisecond)
+	testutil.Assert(t, !b.lease.IsLeader(), "b should stand by while a holds the lease")
+	testutil.Equals(t, 0, workedBy("b"))
+	testutil.Assert(t, workedBy("a") > 0, "a should have worked as the leader")
+
+	// Cut the leader off from the bucket and wait for the standby replica to take over.
+	atomic.StoreInt32(&a.bkt.partitioned, 1)
+	waitFor(func() bool { return workedBy("b") > 0 }, "b did not take over")
+	testutil.Assert(t, !a.lease.IsLeader(), "a should not be the leader anymore")
+
+	cancel()
+	wg.Wait()
+}
@@ -0,0 +1,233 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// maintenanceCheckInterval is the maximum interval at which the maintenance windows are checked again while
+// compactions are paused.
+const maintenanceCheckInterval = time.Minute
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// MaintenanceWindow is a recurring time of day range on some days of the week.
+type MaintenanceWindow struct {
+	// Days are the days of the week the window starts on. The window starts on every day if empty.
+	Days []time.Weekday
+	// Start and End are the offsets of the window from midnight. Windows ending before they start end on the
+	// following day.
+	Start, End time.Duration
+}
+
+// ParseMaintenanceWindow parses a maintenance window of the form "[<days>] <HH:MM>-<HH:MM>", where days are
+// comma separated days of the week or ranges of days of the week, e.g. "mon-fri 08:00-18:00" or
+// "sat,sun 22:00-02:00".
+func ParseMaintenanceWindow(s string) (MaintenanceWindow, error) {
+	var w MaintenanceWindow
+
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+	case 2:
+		for _, d := range strings.Split(strings.ToLower(fields[0]), ",") {
+			from, to := d, d
+			if i := strings.Index(d, "-"); i >= 0 {
+				from, to = d[:i], d[i+1:]
+			}
+			first, ok := weekdays[from]
+			if !ok {
+				return w, errors.Errorf("invalid day of the week %q in maintenance window %q", from, s)
+			}
+			last, ok := weekdays[to]
+			if !ok {
+				return w, errors.Errorf("invalid day of the week %q in maintenance window %q", to, s)
+			}
+			for day := first; ; day = (day + 1) % 7 {
+				w.Days = append(w.Days, day)
+				if day == last {
+					break
+				}
+			}
+		}
+	default:
+		return w, errors.Errorf("invalid maintenance window %q, expected [<days>] <HH:MM>-<HH:MM>", s)
+	}
+
+	times := strings.Split(fields[len(fields)-1], "-")
+	if len(times) != 2 {
+		return w, errors.Errorf("invalid time range %q in maintenance window %q", fields[len(fields)-1], s)
+	}
+	var err error
+	if w.Start, err = parseTimeOfDay(times[0]); err != nil {
+		return w, errors.Wrapf(err, "maintenance window %q", s)
+	}
+	if w.End, err = parseTimeOfDay(times[1]); err != nil {
+		return w, errors.Wrapf(err, "maintenance window %q", s)
+	}
+	if w.Start == w.End {
+		return w, errors.Errorf("empty time range in maintenance window %q", s)
+	}
+	return w, nil
+}
+
+// parseTimeOfDay parses a time of day of the form HH:MM into its offset from midnight. 24:00 is the end of the day.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, errors.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, errors.Errorf("invalid hour in time of day %q", s)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, errors.Errorf("invalid minute in time of day %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+func (w MaintenanceWindow) String() string {
+	var days []string
+	for _, d := range w.Days {
+		days = append(days, strings.ToLower(d.String()[:3]))
+	}
+	tod := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	if len(days) == 0 {
+		return tod(w.Start) + "-" + tod(w.End)
+	}
+	return strings.Join(days, ",") + " " + tod(w.Start) + "-" + tod(w.End)
+}
+
+// end returns the end of the occurrence of the window the given time is in, if any.
+func (w MaintenanceWindow) end(t time.Time) (time.Time, bool) {
+	// Occurrences of windows ending on the following day may have started the day before.
+	for _, offset := range []int{0, -1} {
+		day := time.Date(t.Year(), t.Month(), t.Day()+offset, 0, 0, 0, 0, t.Location())
+		if !w.on(day.Weekday()) {
+			continue
+		}
+		start, end := day.Add(w.Start), day.Add(w.End)
+		if w.End < w.Start {
+			end = end.Add(24 * time.Hour)
+		}
+		if !t.Before(start) && t.Before(end) {
+			return end, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (w MaintenanceWindow) on(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// MaintenanceWindows pauses the start of new compaction work during recurring maintenance windows, e.g. to free
+// IO and CPU for queries during peak hours. Work in progress at the start of a window is completed first, work is
+// resumed once the window ends. Windows are in the local time zone of the compactor.
+// A nil MaintenanceWindows never pauses.
+type MaintenanceWindows struct {
+	logger   log.Logger
+	windows  []MaintenanceWindow
+	interval time.Duration
+	now      func() time.Time
+
+	paused prometheus.Gauge
+}
+
+// NewMaintenanceWindows returns new MaintenanceWindows pausing compactions during the given windows. It returns nil
+// if there are no windows.
+func NewMaintenanceWindows(logger log.Logger, reg prometheus.Registerer, windows []MaintenanceWindow) *MaintenanceWindows {
+	if len(windows) == 0 {
+		return nil
+	}
+	return &MaintenanceWindows{
+		logger:   logger,
+		windows:  windows,
+		interval: maintenanceCheckInterval,
+		now:      time.Now,
+		paused: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_maintenance_paused",
+			Help: "Set to 1 while compactions are paused because of a maintenance window.",
+		}),
+	}
+}
+
+// end returns the end of the maintenance window the given time is in, if any. Windows overlapping the end of the
+// window are not taken into account.
+func (m *MaintenanceWindows) end(t time.Time) (time.Time, bool) {
+	var (
+		latest time.Time
+		found  bool
+	)
+	for _, w := range m.windows {
+		if end, ok := w.end(t); ok && end.After(latest) {
+			latest, found = end, true
+		}
+	}
+	return latest, found
+}
+
+// Wait blocks during maintenance windows. It returns the context's error if the context is done before the
+// maintenance window ends.
+func (m *MaintenanceWindows) Wait(ctx context.Context) error {
+	if m == nil {
+		return nil
+	}
+	defer m.paused.Set(0)
+
+	for paused := false; ; paused = true {
+		end, ok := m.end(m.now())
+		if !ok {
+			if paused {
+				level.Info(m.logger).Log("msg", "maintenance window ended; resuming compactions")
+			}
+			return nil
+		}
+		if !paused {
+			level.Info(m.logger).Log("msg", "maintenance window started; pausing compactions", "until", end)
+			m.paused.Set(1)
+		}
+
+		wait := end.Sub(m.now())
+		if wait > m.interval {
+			wait = m.interval
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	for _, tcase := range []struct {
+		input    string
+		expected MaintenanceWindow
+		err      bool
+	}{
+		{input: "08:00-18:00", expected: MaintenanceWindow{Start: 8 * time.Hour, End: 18 * time.Hour}},
+		{input: "00:00-24:00", expected: MaintenanceWindow{End: 24 * time.Hour}},
+		{
+			input:    "Mon-Fri 08:30-18:00",
+			expected: MaintenanceWindow{Days: []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}, Start: 8*time.Hour + 30*time.Minute, End: 18 * time.Hour},
+		},
+		{
+			input:    "sat,sun 22:00-02:00",
+			expected: MaintenanceWindow{Days: []time.Weekday{time.Saturday, time.Sunday}, Start: 22 * time.Hour, End: 2 * time.Hour},
+		},
+		{
+			input:    "fri-mon,wed 01:00-02:00",
+			expected: MaintenanceWindow{Days: []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Monday, time.Wednesday}, Start: time.Hour, End: 2 * time.Hour},
+		},
+		{input: "", err: true},
+		{input: "08:00", err: true},
+		{input: "08:00-08:00", err: true},
+		{input: "08:00-25:00", err: true},
+		{input: "24:30-01:00", err: true},
+		{input: "08:60-09:00", err: true},
+		{input: "monday 08:00-09:00", err: true},
+		{input: "mon-fri 08:00-09:00 UTC", err: true},
+	} {
+		t.Run(tcase.input, func(t *testing.T) {
+			w, err := ParseMaintenanceWindow(tcase.input)
+			if tcase.err {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, w)
+		})
+	}
+
+	w, err := ParseMaintenanceWindow("Sat,Sun 22:00-02:30")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "sat,sun 22:00-02:30", w.String())
+}
+
+func TestMaintenanceWindows_End(t *testing.T) {
+	parse := func(s string) MaintenanceWindow {
+		w, err := ParseMaintenanceWindow(s)
+		testutil.Ok(t, err)
+		return w
+	}
+	m := NewMaintenanceWindows(log.NewNopLogger(), nil, []MaintenanceWindow{
+		parse("mon-fri 08:00-18:00"),
+		parse("fri 17:00-02:00"),
+	})
+
+	// 2020-06-01 is a Monday.
+	at := func(day, hour, min int) time.Time { return time.Date(2020, 6, day, hour, min, 0, 0, time.UTC) }
+	for _, tcase := range []struct {
+		t   time.Time
+		end time.Time
+		ok  bool
+	}{
+		{t: at(1, 7, 59)},
+		{t: at(1, 8, 0), end: at(1, 18, 0), ok: true},
+		{t: at(3, 17, 59), end: at(3, 18, 0), ok: true},
+		{t: at(3, 18, 0)},
+		// Overlapping windows end with the latest window.
+		{t: at(5, 17, 30), end: at(6, 2, 0), ok: true},
+		// Windows ending on the following day end on the following day, also if they do not start on that day.
+		{t: at(6, 1, 59), end: at(6, 2, 0), ok: true},
+		{t: at(6, 2, 0)},
+		{t: at(7, 10, 0)},
+	} {
+		end, ok := m.end(tcase.t)
+		testutil.Equals(t, tcase.ok, ok, "%v", tcase.t)
+		testutil.Equals(t, tcase.end, end, "%v", tcase.t)
+	}
+
+	// Without windows compactions are never paused.
+	m = NewMaintenanceWindows(log.NewNopLogger(), nil, nil)
+	testutil.Assert(t, m == nil, "expected no maintenance windows")
+	testutil.Ok(t, m.Wait(context.Background()))
+}
@@ -0,0 +1,125 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Pauser allows to pause the work of a compactor without stopping it, e.g. during bucket maintenance.
+// Work is only paused at safe points, i.e. before a compaction pass, between the compaction of groups
+// and between the steps of a compactor run, so work in progress is completed first.
+// A nil Pauser never pauses.
+type Pauser struct {
+	logger log.Logger
+
+	mtx sync.Mutex
+	// resumed is closed once a paused compactor is resumed. It is nil while not paused.
+	resumed chan struct{}
+
+	paused prometheus.Gauge
+}
+
+// NewPauser returns a new Pauser, initially not paused.
+func NewPauser(logger log.Logger, reg prometheus.Registerer) *Pauser {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &Pauser{
+		logger: logger,
+		paused: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compactor_paused",
+			Help: "Set to 1 if the compactor is paused.",
+		}),
+	}
+}
+
+// Pause pauses the work at the next safe point.
+func (p *Pauser) Pause() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.resumed != nil {
+		return
+	}
+	p.resumed = make(chan struct{})
+	p.paused.Set(1)
+	level.Info(p.logger).Log("msg", "compactor paused")
+}
+
+// Resume resumes paused work.
+func (p *Pauser) Resume() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.resumed == nil {
+		return
+	}
+	close(p.resumed)
+	p.resumed = nil
+	p.paused.Set(0)
+	level.Info(p.logger).Log("msg", "compactor resumed")
+}
+
+// Paused returns true if the work is paused.
+func (p *Pauser) Paused() bool {
+	if p == nil {
+		return false
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.resumed != nil
+}
+
+// Wait blocks while the work is paused. It returns the context's error if the context is done before the work is resumed.
+func (p *Pauser) Wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	p.mtx.Lock()
+	resumed := p.resumed
+	p.mtx.Unlock()
+
+	if resumed == nil {
+		return nil
+	}
+	level.Info(p.logger).Log("msg", "waiting for paused compactor to be resumed")
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-resumed:
+		return nil
+	}
+}
+
+// PauseHandler returns a HTTP handler pausing the work on POST requests.
+func (p *Pauser) PauseHandler() http.HandlerFunc {
+	return p.handler(p.Pause)
+}
+
+// ResumeHandler returns a HTTP handler resuming paused work on POST requests.
+func (p *Pauser) ResumeHandler() http.HandlerFunc {
+	return p.handler(p.Resume)
+}
+
+func (p *Pauser) handler(f func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		f()
+		if _, err := io.WriteString(w, "OK"); err != nil {
+			level.Error(p.logger).Log("msg", "failed to write pause response", "err", err)
+		}
+	}
+}
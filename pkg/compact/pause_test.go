@@ -0,0 +1,63 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestPauser(t *testing.T) {
+	p := NewPauser(nil, nil)
+	testutil.Assert(t, !p.Paused(), "should not be paused initially")
+	testutil.Ok(t, p.Wait(context.Background()))
+
+	p.Pause()
+	p.Pause()
+	testutil.Assert(t, p.Paused(), "should be paused")
+	testutil.Equals(t, 1.0, promtest.ToFloat64(p.paused))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	testutil.Equals(t, context.DeadlineExceeded, p.Wait(ctx))
+
+	done := make(chan error)
+	go func() { done <- p.Wait(context.Background()) }()
+	p.Resume()
+	p.Resume()
+	testutil.Ok(t, <-done)
+	testutil.Assert(t, !p.Paused(), "should be resumed")
+	testutil.Equals(t, 0.0, promtest.ToFloat64(p.paused))
+
+	// A nil pauser never pauses.
+	var nilPauser *Pauser
+	testutil.Assert(t, !nilPauser.Paused(), "nil pauser should not be paused")
+	testutil.Ok(t, nilPauser.Wait(context.Background()))
+}
+
+func TestPauser_Handlers(t *testing.T) {
+	p := NewPauser(nil, nil)
+	for _, tcase := range []struct {
+		handler      http.HandlerFunc
+		method       string
+		expectedCode int
+		paused       bool
+	}{
+		{handler: p.PauseHandler(), method: http.MethodGet, expectedCode: http.StatusMethodNotAllowed, paused: false},
+		{handler: p.PauseHandler(), method: http.MethodPost, expectedCode: http.StatusOK, paused: true},
+		{handler: p.ResumeHandler(), method: http.MethodGet, expectedCode: http.StatusMethodNotAllowed, paused: true},
+		{handler: p.ResumeHandler(), method: http.MethodPost, expectedCode: http.StatusOK, paused: false},
+	} {
+		rec := httptest.NewRecorder()
+		tcase.handler(rec, httptest.NewRequest(tcase.method, "/", nil))
+		testutil.Equals(t, tcase.expectedCode, rec.Code)
+		testutil.Equals(t, tcase.paused, p.Paused())
+	}
+}
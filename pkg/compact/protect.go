@@ -0,0 +1,81 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// DeletionProtector prevents the compactor from marking blocks for deletion based on their external labels,
+// e.g. to keep the blocks of a tenant under investigation regardless of retention and garbage collection.
+// A nil DeletionProtector or one without selectors protects no block.
+type DeletionProtector struct {
+	logger    log.Logger
+	selectors [][]*labels.Matcher
+
+	prevented *prometheus.CounterVec
+}
+
+// NewDeletionProtector returns a new DeletionProtector protecting the blocks matched by any of the given
+// series selectors, e.g. '{tenant="team-a"}'. All matchers of a selector must match the block's external labels.
+func NewDeletionProtector(logger log.Logger, reg prometheus.Registerer, selectors []string) (*DeletionProtector, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	p := &DeletionProtector{
+		logger: logger,
+		prevented: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_protected_blocks_deletions_prevented_total",
+			Help: "Total number of times a block was not marked for deletion because it is protected.",
+		}, []string{"reason"}),
+	}
+	for _, s := range selectors {
+		ms, err := promql.ParseMetricSelector(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse protected blocks selector %q", s)
+		}
+		p.selectors = append(p.selectors, ms)
+	}
+	return p, nil
+}
+
+// enabled returns true if any block can be protected.
+func (p *DeletionProtector) enabled() bool {
+	return p != nil && len(p.selectors) > 0
+}
+
+// protects returns true if the block with the given external labels must not be marked for deletion.
+func (p *DeletionProtector) protects(lset labels.Labels) bool {
+	if !p.enabled() {
+		return false
+	}
+Selectors:
+	for _, ms := range p.selectors {
+		for _, m := range ms {
+			if !m.Matches(lset.Get(m.Name)) {
+				continue Selectors
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// prevent returns true and logs the prevented deletion if the block is protected.
+// The reason describes the action that would have marked the block for deletion.
+func (p *DeletionProtector) prevent(id ulid.ULID, lset labels.Labels, reason string) bool {
+	if !p.protects(lset) {
+		return false
+	}
+	level.Info(p.logger).Log("msg", "block is protected, not marking it for deletion", "block", id, "labels", lset.String(), "reason", reason)
+	p.prevented.WithLabelValues(reason).Inc()
+	return true
+}
@@ -0,0 +1,149 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestDeletionProtector_Protects(t *testing.T) {
+	var nilProtector *DeletionProtector
+	testutil.Assert(t, !nilProtector.protects(labels.FromStrings("tenant", "a")), "nil protector must not protect")
+
+	_, err := NewDeletionProtector(nil, nil, []string{"{tenant="})
+	testutil.NotOk(t, err)
+
+	p, err := NewDeletionProtector(nil, nil, []string{`{tenant="a"}`, `{tenant=~"b.*", replica!="1"}`})
+	testutil.Ok(t, err)
+
+	for _, tcase := range []struct {
+		lset      labels.Labels
+		protected bool
+	}{
+		{lset: labels.FromStrings("tenant", "a"), protected: true},
+		{lset: labels.FromStrings("tenant", "a", "replica", "1"), protected: true},
+		{lset: labels.FromStrings("tenant", "b2", "replica", "0"), protected: true},
+		{lset: labels.FromStrings("tenant", "b2", "replica", "1"), protected: false},
+		{lset: labels.FromStrings("tenant", "c"), protected: false},
+		{lset: labels.Labels{}, protected: false},
+	} {
+		testutil.Equals(t, tcase.protected, p.protects(tcase.lset), "labels %s", tcase.lset)
+	}
+}
+
+func uploadProtectTestMeta(t *testing.T, bkt objstore.Bucket, m metadata.Meta) {
+	t.Helper()
+	var buf bytes.Buffer
+	testutil.Ok(t, json.NewEncoder(&buf).Encode(&m))
+	testutil.Ok(t, bkt.Upload(context.Background(), path.Join(m.ULID.String(), metadata.MetaFilename), &buf))
+}
+
+func markedForDeletion(t *testing.T, bkt objstore.Bucket, id ulid.ULID) bool {
+	t.Helper()
+	exists, err := bkt.Exists(context.Background(), path.Join(id.String(), metadata.DeletionMarkFilename))
+	testutil.Ok(t, err)
+	return exists
+}
+
+func TestApplyRetentionPolicyByResolution_Protected(t *testing.T) {
+	ctx := context.Background()
+	bkt := inmem.NewBucket()
+
+	old := time.Now().Add(-3 * 24 * time.Hour)
+	protected, unprotected := metadata.Meta{}, metadata.Meta{}
+	for i, m := range []*metadata.Meta{&protected, &unprotected} {
+		m.Version = 1
+		m.ULID = ulid.MustNew(uint64(i+1), nil)
+		m.MinTime = old.Add(-time.Hour).Unix() * 1000
+		m.MaxTime = old.Unix() * 1000
+	}
+	protected.Thanos.Labels = map[string]string{"tenant": "a"}
+	unprotected.Thanos.Labels = map[string]string{"tenant": "b"}
+	uploadProtectTestMeta(t, bkt, protected)
+	uploadProtectTestMeta(t, bkt, unprotected)
+
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, nil, nil)
+	testutil.Ok(t, err)
+
+	protector, err := NewDeletionProtector(nil, nil, []string{`{tenant="a"}`})
+	testutil.Ok(t, err)
+
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	testutil.Ok(t, ApplyRetentionPolicyByResolution(ctx, log.NewNopLogger(), bkt, metaFetcher, map[ResolutionLevel]time.Duration{
+		ResolutionLevelRaw: 24 * time.Hour,
+	}, blocksMarkedForDeletion, protector, nil))
+
+	testutil.Assert(t, !markedForDeletion(t, bkt, protected.ULID), "protected block must not be marked for deletion")
+	testutil.Assert(t, markedForDeletion(t, bkt, unprotected.ULID), "unprotected block must be marked for deletion")
+	testutil.Equals(t, 1.0, promtest.ToFloat64(blocksMarkedForDeletion))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(protector.prevented.WithLabelValues("retention")))
+}
+
+func TestSyncer_GarbageCollect_Protected(t *testing.T) {
+	ctx := context.Background()
+	bkt := inmem.NewBucket()
+
+	// Each tenant has a source block replaced by a level 2 block, also covering a source block that is already gone.
+	var sources, compacted []metadata.Meta
+	for i, tenant := range []string{"a", "b"} {
+		var src metadata.Meta
+		src.Version = 1
+		src.ULID = ulid.MustNew(uint64(i+1), nil)
+		src.Compaction.Level = 1
+		src.Compaction.Sources = []ulid.ULID{src.ULID}
+		src.Thanos.Labels = map[string]string{"tenant": tenant}
+
+		var m metadata.Meta
+		m.Version = 1
+		m.ULID = ulid.MustNew(uint64(i+100), nil)
+		m.Compaction.Level = 2
+		m.Compaction.Sources = []ulid.ULID{src.ULID, ulid.MustNew(uint64(i+10), nil)}
+		m.Thanos.Labels = map[string]string{"tenant": tenant}
+
+		uploadProtectTestMeta(t, bkt, src)
+		uploadProtectTestMeta(t, bkt, m)
+		sources = append(sources, src)
+		compacted = append(compacted, m)
+	}
+
+	duplicateBlocksFilter := block.NewDeduplicateFilter()
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, bkt, "", nil, []block.MetadataFilter{duplicateBlocksFilter}, nil)
+	testutil.Ok(t, err)
+
+	protector, err := NewDeletionProtector(nil, nil, []string{`{tenant="a"}`})
+	testutil.Ok(t, err)
+
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(nil, nil, 48*time.Hour)
+	sy, err := NewSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, 1, false, false, OverlapTolerance{}, false, nil, protector)
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, sy.SyncMetas(ctx))
+	testutil.Ok(t, sy.GarbageCollect(ctx))
+
+	testutil.Assert(t, !markedForDeletion(t, bkt, sources[0].ULID), "protected block must not be marked for deletion")
+	testutil.Assert(t, markedForDeletion(t, bkt, sources[1].ULID), "unprotected block must be marked for deletion")
+	for _, m := range compacted {
+		testutil.Assert(t, !markedForDeletion(t, bkt, m.ULID), "compacted block %s must not be marked for deletion", m.ULID)
+	}
+	testutil.Equals(t, 1.0, promtest.ToFloat64(blocksMarkedForDeletion))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(protector.prevented.WithLabelValues("garbage-collection")))
+}
@@ -0,0 +1,119 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// RelabelBlock replaces the block of the given meta in the bucket with a block whose external labels and, if series
+// relabel configs are given, series labels are relabeled with the given relabel configs. The new block is verified and
+// uploaded before the old block is marked for deletion.
+// Blocks whose labels would not change are left untouched, so relabeling blocks again with the same configs is a
+// no-op. The block is downloaded into dir, which is cleaned up afterwards. It returns the ID of the new block and
+// whether the block was replaced.
+func RelabelBlock(
+	ctx context.Context,
+	logger log.Logger,
+	bkt objstore.Bucket,
+	dir string,
+	meta *metadata.Meta,
+	extRelabelConfigs, seriesRelabelConfigs []*relabel.Config,
+	blocksMarkedForDeletion prometheus.Counter,
+) (resid ulid.ULID, replaced bool, err error) {
+	id := meta.ULID
+	extLset := labels.FromMap(meta.Thanos.Labels)
+	newExtLset := relabel.Process(extLset, extRelabelConfigs...)
+	if len(newExtLset) == 0 {
+		return resid, false, errors.Errorf("relabeling drops all external labels of block %s", id)
+	}
+	extChanged := !labels.Equal(extLset, newExtLset)
+	if !extChanged && len(seriesRelabelConfigs) == 0 {
+		return resid, false, nil
+	}
+
+	defer func() {
+		if rerr := os.RemoveAll(dir); rerr != nil {
+			level.Warn(logger).Log("msg", "failed to remove relabel dir", "dir", dir, "err", rerr)
+		}
+	}()
+
+	bdir := filepath.Join(dir, id.String())
+	if err := block.Download(ctx, logger, bkt, id, bdir); err != nil {
+		return resid, false, errors.Wrapf(err, "download block %s", id)
+	}
+
+	if len(seriesRelabelConfigs) > 0 {
+		var seriesChanged bool
+		resid, seriesChanged, err = block.Relabel(logger, dir, id, metadata.BucketRelabelSource, newExtLset, seriesRelabelConfigs, downsample.NewPool())
+		if err != nil {
+			return resid, false, errors.Wrapf(err, "relabel block %s", id)
+		}
+		if !extChanged && !seriesChanged {
+			return resid, false, nil
+		}
+	} else {
+		resid, err = relabelExternalLabels(logger, dir, id, newExtLset)
+		if err != nil {
+			return resid, false, errors.Wrapf(err, "relabel external labels of block %s", id)
+		}
+	}
+
+	// Verify the relabeled block before uploading it.
+	if err := block.VerifyIndex(logger, filepath.Join(dir, resid.String(), block.IndexFilename), meta.MinTime, meta.MaxTime); err != nil {
+		return resid, false, errors.Wrapf(err, "relabeled block is invalid %s", resid)
+	}
+
+	level.Info(logger).Log("msg", "uploading relabeled block", "id", id, "newID", resid, "labels", newExtLset)
+	if err := block.Upload(ctx, logger, bkt, filepath.Join(dir, resid.String())); err != nil {
+		return resid, false, errors.Wrapf(err, "upload of %s failed", resid)
+	}
+
+	// Spawn a new context so we always mark the old block on shutdown.
+	delCtx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	if err := block.MarkForDeletion(delCtx, logger, bkt, id); err != nil {
+		return resid, false, errors.Wrapf(err, "marking old block %s for deletion failed. You need to delete this block manually", id)
+	}
+	blocksMarkedForDeletion.Inc()
+	return resid, true, nil
+}
+
+// relabelExternalLabels moves the block with the given ID in dir to a new block with the given external labels and
+// otherwise the same data, and returns the ID of the new block.
+func relabelExternalLabels(logger log.Logger, dir string, id ulid.ULID, extLset labels.Labels) (ulid.ULID, error) {
+	resid := ulid.MustNew(ulid.Now(), rand.New(rand.NewSource(time.Now().UnixNano())))
+
+	bdir, resdir := filepath.Join(dir, id.String()), filepath.Join(dir, resid.String())
+	meta, err := metadata.Read(bdir)
+	if err != nil {
+		return resid, errors.Wrap(err, "read meta file")
+	}
+	if err := os.Rename(bdir, resdir); err != nil {
+		return resid, errors.Wrap(err, "rename block dir")
+	}
+
+	meta.ULID = resid
+	meta.Thanos.Labels = extLset.Map()
+	meta.Thanos.Source = metadata.BucketRelabelSource
+	return resid, metadata.Write(logger, resdir, meta)
+}
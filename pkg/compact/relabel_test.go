@@ -0,0 +1,258 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestRelabelBlock(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	bkt := inmem.NewBucket()
+	metas := createAndUpload(t, bkt, []blockgenSpec{{
+		numSamples: 100, mint: 0, maxt: 1000, extLset: labels.FromStrings("cluster", "a", "replica", "1"), res: 0,
+		series: []labels.Labels{
+			labels.FromStrings("__name__", "up", "instance", "1", "env", "prod"),
+			labels.FromStrings("__name__", "up", "instance", "2", "env", "prod"),
+			labels.FromStrings("__name__", "up", "instance", "3", "env", "dev"),
+		},
+	}})
+	origSeries := readBlockSeries(t, bkt, metas[0].ULID)
+
+	dir, err := ioutil.TempDir("", "test-compact-relabel")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	extRelabel := []*relabel.Config{{
+		Action:       relabel.Replace,
+		SourceLabels: model.LabelNames{"cluster"},
+		Regex:        relabel.MustNewRegexp("a"),
+		TargetLabel:  "cluster",
+		Replacement:  "eu-1",
+	}}
+	seriesRelabel := []*relabel.Config{
+		{Action: relabel.Drop, SourceLabels: model.LabelNames{"env"}, Regex: relabel.MustNewRegexp("dev")},
+		{Action: relabel.LabelDrop, Regex: relabel.MustNewRegexp("env")},
+		{Action: relabel.Replace, Regex: relabel.MustNewRegexp(".*"), TargetLabel: "team", Replacement: "infra"},
+	}
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+
+	// External labels only.
+	resid, replaced, err := RelabelBlock(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, "ext"), metas[0], extRelabel, nil, blocksMarkedForDeletion)
+	testutil.Ok(t, err)
+	testutil.Assert(t, replaced, "expected block to be replaced")
+	testutil.Equals(t, 1.0, promtest.ToFloat64(blocksMarkedForDeletion))
+	assertMarkedForDeletion(t, bkt, metas[0].ULID)
+
+	extMeta, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt, resid)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]string{"cluster": "eu-1", "replica": "1"}, extMeta.Thanos.Labels)
+	testutil.Equals(t, metadata.BucketRelabelSource, extMeta.Thanos.Source)
+	testutil.Equals(t, metas[0].MinTime, extMeta.MinTime)
+	testutil.Equals(t, metas[0].MaxTime, extMeta.MaxTime)
+	testutil.Equals(t, metas[0].Stats, extMeta.Stats)
+	testutil.Equals(t, metas[0].Compaction.Sources, extMeta.Compaction.Sources)
+	testutil.Equals(t, origSeries, readBlockSeries(t, bkt, resid))
+
+	// Relabeling again with the same configs is a no-op.
+	_, replaced, err = RelabelBlock(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, "ext-again"), &extMeta, extRelabel, nil, blocksMarkedForDeletion)
+	testutil.Ok(t, err)
+	testutil.Assert(t, !replaced, "expected already relabeled block to be left untouched")
+
+	// Series labels.
+	resid, replaced, err = RelabelBlock(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, "series"), &extMeta, extRelabel, seriesRelabel, blocksMarkedForDeletion)
+	testutil.Ok(t, err)
+	testutil.Assert(t, replaced, "expected block to be replaced")
+	testutil.Equals(t, 2.0, promtest.ToFloat64(blocksMarkedForDeletion))
+	assertMarkedForDeletion(t, bkt, extMeta.ULID)
+
+	seriesMeta, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt, resid)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]string{"cluster": "eu-1", "replica": "1"}, seriesMeta.Thanos.Labels)
+	testutil.Equals(t, uint64(2), seriesMeta.Stats.NumSeries)
+	testutil.Equals(t, uint64(200), seriesMeta.Stats.NumSamples)
+
+	// The series that are kept hold the same samples under their new labels.
+	testutil.Equals(t, map[string][]sample{
+		labels.FromStrings("__name__", "up", "instance", "1", "team", "infra").String(): origSeries[labels.FromStrings("__name__", "up", "instance", "1", "env", "prod").String()],
+		labels.FromStrings("__name__", "up", "instance", "2", "team", "infra").String(): origSeries[labels.FromStrings("__name__", "up", "instance", "2", "env", "prod").String()],
+	}, readBlockSeries(t, bkt, resid))
+
+	_, replaced, err = RelabelBlock(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, "series-again"), &seriesMeta, extRelabel, seriesRelabel, blocksMarkedForDeletion)
+	testutil.Ok(t, err)
+	testutil.Assert(t, !replaced, "expected already relabeled block to be left untouched")
+	testutil.Equals(t, 2.0, promtest.ToFloat64(blocksMarkedForDeletion))
+
+	// Relabeling must neither drop all external labels nor make distinct series identical.
+	_, _, err = RelabelBlock(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, "drop"), &seriesMeta, []*relabel.Config{{Action: relabel.LabelDrop, Regex: relabel.MustNewRegexp(".*")}}, nil, blocksMarkedForDeletion)
+	testutil.NotOk(t, err)
+	_, _, err = RelabelBlock(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, "duplicate"), &seriesMeta, nil, []*relabel.Config{{Action: relabel.LabelDrop, Regex: relabel.MustNewRegexp("instance")}}, blocksMarkedForDeletion)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 2.0, promtest.ToFloat64(blocksMarkedForDeletion))
+}
+
+type sample struct {
+	t int64
+	v float64
+}
+
+// readBlockSeries returns the samples of all series of the block with the given ID in the bucket by their labels.
+func readBlockSeries(t *testing.T, bkt objstore.Bucket, id ulid.ULID) map[string][]sample {
+	dir, err := ioutil.TempDir("", "test-compact-relabel-read")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bdir := filepath.Join(dir, id.String())
+	testutil.Ok(t, block.Download(context.Background(), log.NewNopLogger(), bkt, id, bdir))
+	b, err := tsdb.OpenBlock(nil, bdir, nil)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, b.Close()) }()
+
+	q, err := tsdb.NewBlockQuerier(b, b.MinTime(), b.MaxTime())
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, q.Close()) }()
+
+	set, err := q.Select(labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+"))
+	testutil.Ok(t, err)
+	res := map[string][]sample{}
+	for set.Next() {
+		var samples []sample
+		it := set.At().Iterator()
+		for it.Next() {
+			ts, v := it.At()
+			samples = append(samples, sample{t: ts, v: v})
+		}
+		testutil.Ok(t, it.Err())
+		res[set.At().Labels().String()] = samples
+	}
+	testutil.Ok(t, set.Err())
+	return res
+}
+
+func assertMarkedForDeletion(t *testing.T, bkt objstore.Bucket, id ulid.ULID) {
+	ok, err := bkt.Exists(context.Background(), filepath.Join(id.String(), metadata.DeletionMarkFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "expected block %s to be marked for deletion", id)
+}
+
+func TestRelabelBlock_Downsampled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test-compact-relabel-downsampled")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	// Downsample a raw block, so that the relabeled block has aggregated chunks.
+	rawID, err := e2eutil.CreateBlock(ctx, dir, []labels.Labels{
+		labels.FromStrings("__name__", "up", "instance", "1", "env", "prod"),
+		labels.FromStrings("__name__", "up", "instance", "2", "env", "dev"),
+	}, 100, 0, int64(2*time.Hour/time.Millisecond), labels.FromStrings("cluster", "a"), 0)
+	testutil.Ok(t, err)
+	rawMeta, err := metadata.Read(filepath.Join(dir, rawID.String()))
+	testutil.Ok(t, err)
+	b, err := tsdb.OpenBlock(log.NewNopLogger(), filepath.Join(dir, rawID.String()), downsample.NewPool())
+	testutil.Ok(t, err)
+	id, err := downsample.Downsample(log.NewNopLogger(), rawMeta, b, dir, downsample.ResLevel1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, b.Close())
+
+	bkt := inmem.NewBucket()
+	testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, id.String())))
+	meta, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt, id)
+	testutil.Ok(t, err)
+	origChunks := readBlockChunks(t, bkt, id)
+
+	extRelabel := []*relabel.Config{{
+		Action:       relabel.Replace,
+		SourceLabels: model.LabelNames{"cluster"},
+		Regex:        relabel.MustNewRegexp("a"),
+		TargetLabel:  "cluster",
+		Replacement:  "eu-1",
+	}}
+	seriesRelabel := []*relabel.Config{{Action: relabel.Drop, SourceLabels: model.LabelNames{"env"}, Regex: relabel.MustNewRegexp("dev")}}
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+
+	resid, replaced, err := RelabelBlock(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, "relabel"), &meta, extRelabel, seriesRelabel, blocksMarkedForDeletion)
+	testutil.Ok(t, err)
+	testutil.Assert(t, replaced, "expected block to be replaced")
+	assertMarkedForDeletion(t, bkt, id)
+
+	resMeta, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt, resid)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]string{"cluster": "eu-1"}, resMeta.Thanos.Labels)
+	testutil.Equals(t, downsample.ResLevel1, resMeta.Thanos.Downsample.Resolution)
+
+	// The aggregated chunks of the remaining series are copied unchanged.
+	prod := labels.FromStrings("__name__", "up", "instance", "1", "env", "prod").String()
+	testutil.Assert(t, len(origChunks[prod]) > 0, "expected chunks of series %s", prod)
+	testutil.Equals(t, map[string][][]byte{prod: origChunks[prod]}, readBlockChunks(t, bkt, resid))
+}
+
+// readBlockChunks returns the raw bytes of the aggregated chunks of all series of the given downsampled block by
+// their labels.
+func readBlockChunks(t *testing.T, bkt objstore.Bucket, id ulid.ULID) map[string][][]byte {
+	dir, err := ioutil.TempDir("", "test-compact-relabel-read")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bdir := filepath.Join(dir, id.String())
+	testutil.Ok(t, block.Download(context.Background(), log.NewNopLogger(), bkt, id, bdir))
+	b, err := tsdb.OpenBlock(nil, bdir, downsample.NewPool())
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, b.Close()) }()
+
+	indexr, err := b.Index()
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, indexr.Close()) }()
+	chunkr, err := b.Chunks()
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, chunkr.Close()) }()
+
+	all, err := indexr.Postings(index.AllPostingsKey())
+	testutil.Ok(t, err)
+	res := map[string][][]byte{}
+	for all.Next() {
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+		)
+		testutil.Ok(t, indexr.Series(all.At(), &lset, &chks))
+		for _, c := range chks {
+			chk, err := chunkr.Chunk(c.Ref)
+			testutil.Ok(t, err)
+			testutil.Equals(t, downsample.ChunkEncAggr, chk.Encoding())
+			res[lset.String()] = append(res[lset.String()], append([]byte(nil), chk.Bytes()...))
+		}
+	}
+	testutil.Ok(t, all.Err())
+	return res
+}
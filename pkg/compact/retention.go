@@ -9,21 +9,42 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
 	"github.com/thanos-io/thanos/pkg/objstore"
 )
 
 // ApplyRetentionPolicyByResolution removes blocks depending on the specified retentionByResolution based on blocks MaxTime.
-// A value of 0 disables the retention for its resolution.
-func ApplyRetentionPolicyByResolution(ctx context.Context, logger log.Logger, bkt objstore.Bucket, fetcher block.MetadataFetcher, retentionByResolution map[ResolutionLevel]time.Duration, blocksMarkedForDeletion prometheus.Counter) error {
+// A value of 0 disables the retention for its resolution. Blocks protected by the protector are kept.
+// If the blocks of the next of the given downsampling levels are retained longer, the deletion of a block is deferred
+// until a downsampled block of all its sources exists, so that no gap remains between the resolutions. Blocks too
+// short to ever be downsampled are not deferred.
+func ApplyRetentionPolicyByResolution(ctx context.Context, logger log.Logger, bkt objstore.Bucket, fetcher block.MetadataFetcher, retentionByResolution map[ResolutionLevel]time.Duration, blocksMarkedForDeletion prometheus.Counter, protector *DeletionProtector, downsamplingLevels []downsample.Level) error {
 	level.Info(logger).Log("msg", "start optional retention")
 	metas, _, err := fetcher.Fetch(ctx)
 	if err != nil {
 		return errors.Wrap(err, "fetch metas")
 	}
 
+	// The sources of the blocks of each downsampled resolution, to find the blocks that are downsampled already.
+	downsampled := map[int64]map[ulid.ULID]struct{}{}
+	for _, m := range metas {
+		res := m.Thanos.Downsample.Resolution
+		if res == downsample.ResLevel0 {
+			continue
+		}
+		if _, ok := downsampled[res]; !ok {
+			downsampled[res] = map[ulid.ULID]struct{}{}
+		}
+		for _, id := range m.Compaction.Sources {
+			downsampled[res][id] = struct{}{}
+		}
+	}
+
 	for id, m := range metas {
 		retentionDuration := retentionByResolution[ResolutionLevel(m.Thanos.Downsample.Resolution)]
 		if retentionDuration.Seconds() == 0 {
@@ -32,6 +53,16 @@ func ApplyRetentionPolicyByResolution(ctx context.Context, logger log.Logger, bk
 
 		maxTime := time.Unix(m.MaxTime/1000, 0)
 		if time.Now().After(maxTime.Add(retentionDuration)) {
+			if protector.prevent(id, labels.FromMap(m.Thanos.Labels), "retention") {
+				continue
+			}
+			if next, ok := downsample.NextLevel(downsamplingLevels, m.Thanos.Downsample.Resolution); ok &&
+				retainedLonger(retentionByResolution, retentionDuration, next.Resolution) &&
+				m.MaxTime-m.MinTime >= next.MinSourceRange &&
+				!allSourcesIn(m.Compaction.Sources, downsampled[next.Resolution]) {
+				level.Info(logger).Log("msg", "applying retention: deferring deletion of block until it is downsampled", "id", id, "maxTime", maxTime.String(), "resolution", next.Resolution)
+				continue
+			}
 			level.Info(logger).Log("msg", "applying retention: marking block for deletion", "id", id, "maxTime", maxTime.String())
 			if err := block.MarkForDeletion(ctx, logger, bkt, id); err != nil {
 				return errors.Wrap(err, "delete block")
@@ -43,3 +74,18 @@ func ApplyRetentionPolicyByResolution(ctx context.Context, logger log.Logger, bk
 	level.Info(logger).Log("msg", "optional retention apply done")
 	return nil
 }
+
+// retainedLonger returns true if the blocks of the given resolution are retained longer than the given retention.
+func retainedLonger(retentionByResolution map[ResolutionLevel]time.Duration, retention time.Duration, resolution int64) bool {
+	r := retentionByResolution[ResolutionLevel(resolution)]
+	return r == 0 || r > retention
+}
+
+func allSourcesIn(sources []ulid.ULID, set map[ulid.ULID]struct{}) bool {
+	for _, id := range sources {
+		if _, ok := set[id]; !ok {
+			return false
+		}
+	}
+	return true
+}
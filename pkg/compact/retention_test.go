@@ -21,6 +21,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/compact"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/objstore/inmem"
 	"github.com/thanos-io/thanos/pkg/testutil"
@@ -249,7 +250,7 @@ func TestApplyRetentionPolicyByResolution(t *testing.T) {
 			testutil.Ok(t, err)
 
 			blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
-			if err := compact.ApplyRetentionPolicyByResolution(ctx, logger, bkt, metaFetcher, tt.retentionByResolution, blocksMarkedForDeletion); (err != nil) != tt.wantErr {
+			if err := compact.ApplyRetentionPolicyByResolution(ctx, logger, bkt, metaFetcher, tt.retentionByResolution, blocksMarkedForDeletion, nil, nil); (err != nil) != tt.wantErr {
 				t.Errorf("ApplyRetentionPolicyByResolution() error = %v, wantErr %v", err, tt.wantErr)
 			}
 
@@ -298,3 +299,87 @@ func uploadMockBlock(t *testing.T, bkt objstore.Bucket, id string, minTime, maxT
 	testutil.Ok(t, bkt.Upload(context.Background(), id+"/chunks/000002", strings.NewReader("@test-data@")))
 	testutil.Ok(t, bkt.Upload(context.Background(), id+"/chunks/000003", strings.NewReader("@test-data@")))
 }
+
+func TestApplyRetentionPolicyByResolution_DeferUntilDownsampled(t *testing.T) {
+	logger := log.NewNopLogger()
+	ctx := context.TODO()
+	bkt := inmem.NewBucket()
+
+	upload := func(id string, minTime, maxTime time.Time, res int64, sources ...string) {
+		m := metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{
+				ULID:    ulid.MustParse(id),
+				MinTime: minTime.Unix() * 1000,
+				MaxTime: maxTime.Unix() * 1000,
+				Version: 1,
+			},
+			Thanos: metadata.Thanos{Downsample: metadata.ThanosDownsample{Resolution: res}},
+		}
+		for _, s := range sources {
+			m.Compaction.Sources = append(m.Compaction.Sources, ulid.MustParse(s))
+		}
+		b, err := json.Marshal(m)
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Upload(ctx, id+"/meta.json", bytes.NewReader(b)))
+	}
+	marked := func(id string) bool {
+		exists, err := bkt.Exists(ctx, filepath.Join(id, metadata.DeletionMarkFilename))
+		testutil.Ok(t, err)
+		return exists
+	}
+	apply := func(retentionByResolution map[compact.ResolutionLevel]time.Duration) {
+		metaFetcher, err := block.NewMetaFetcher(logger, 32, bkt, "", nil, nil, nil)
+		testutil.Ok(t, err)
+		blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+		testutil.Ok(t, compact.ApplyRetentionPolicyByResolution(ctx, logger, bkt, metaFetcher, retentionByResolution, blocksMarkedForDeletion, nil, downsample.DefaultLevels))
+	}
+
+	const (
+		downsampledRaw = "01CPHBEX20729MJQZXE3W0BW40"
+		partialRaw     = "01CPHBEX20729MJQZXE3W0BW41"
+		shortRaw       = "01CPHBEX20729MJQZXE3W0BW42"
+		downsampled5m  = "01CPHBEX20729MJQZXE3W0BW43"
+		partial5m      = "01CPHBEX20729MJQZXE3W0BW44"
+		missing5m      = "01CPHBEX20729MJQZXE3W0BW45"
+
+		partialRawSource1 = "01CPHBEX20729MJQZXE3W0BW50"
+		partialRawSource2 = "01CPHBEX20729MJQZXE3W0BW51"
+	)
+	now := time.Now()
+	// A raw block downsampled already.
+	upload(downsampledRaw, now.Add(-6*24*time.Hour), now.Add(-3*24*time.Hour), downsample.ResLevel0, downsampledRaw)
+	upload(downsampled5m, now.Add(-6*24*time.Hour), now.Add(-3*24*time.Hour), downsample.ResLevel1, downsampledRaw)
+	// A raw block compacted from two sources, only one of which is downsampled yet.
+	upload(partialRaw, now.Add(-9*24*time.Hour), now.Add(-6*24*time.Hour), downsample.ResLevel0, partialRawSource1, partialRawSource2)
+	upload(partial5m, now.Add(-9*24*time.Hour), now.Add(-7*24*time.Hour), downsample.ResLevel1, partialRawSource1)
+	// A raw block too short to ever be downsampled.
+	upload(shortRaw, now.Add(-3*24*time.Hour-time.Hour), now.Add(-3*24*time.Hour), downsample.ResLevel0, shortRaw)
+
+	// Downsampled blocks retained shorter than raw blocks do not defer deletion.
+	apply(map[compact.ResolutionLevel]time.Duration{
+		compact.ResolutionLevelRaw: 30 * 24 * time.Hour,
+		compact.ResolutionLevel5m:  24 * time.Hour,
+	})
+	testutil.Assert(t, !marked(downsampledRaw), "raw block within retention must not be marked")
+	testutil.Assert(t, marked(downsampled5m), "5m block past retention must be marked")
+	testutil.Assert(t, marked(partial5m), "5m block past retention must be marked")
+	testutil.Ok(t, bkt.Delete(ctx, filepath.Join(downsampled5m, metadata.DeletionMarkFilename)))
+	testutil.Ok(t, bkt.Delete(ctx, filepath.Join(partial5m, metadata.DeletionMarkFilename)))
+
+	retention := map[compact.ResolutionLevel]time.Duration{
+		compact.ResolutionLevelRaw: 24 * time.Hour,
+		compact.ResolutionLevel5m:  0,
+	}
+	apply(retention)
+	testutil.Assert(t, marked(downsampledRaw), "downsampled raw block must be marked")
+	testutil.Assert(t, !marked(partialRaw), "raw block with sources not downsampled yet must not be marked")
+	testutil.Assert(t, marked(shortRaw), "raw block too short to be downsampled must be marked")
+	testutil.Assert(t, !marked(downsampled5m), "5m block without retention must not be marked")
+
+	// Once all sources are downsampled, the raw block is deleted. The blocks marked before are deleted by then.
+	testutil.Ok(t, bkt.Delete(ctx, filepath.Join(downsampledRaw, metadata.MetaFilename)))
+	testutil.Ok(t, bkt.Delete(ctx, filepath.Join(shortRaw, metadata.MetaFilename)))
+	upload(missing5m, now.Add(-7*24*time.Hour), now.Add(-6*24*time.Hour), downsample.ResLevel1, partialRawSource2)
+	apply(retention)
+	testutil.Assert(t, marked(partialRaw), "raw block downsampled completely must be marked")
+}
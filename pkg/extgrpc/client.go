@@ -11,15 +11,19 @@ import (
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/thanos-io/thanos/pkg/tls"
 	"github.com/thanos-io/thanos/pkg/tracing"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
 )
 
 // StoreClientGRPCOpts creates gRPC dial options for connecting to a store client.
-func StoreClientGRPCOpts(logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, secure bool, cert, key, caCert, serverName string) ([]grpc.DialOption, error) {
+// Requests are compressed with the given compression, one of Compressions, and servers respond in kind.
+// Idle connections are kept alive by the pings of the given keepalive config.
+func StoreClientGRPCOpts(logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, secure bool, cert, key, caCert, serverName, compression string, keepalive KeepaliveConfig) ([]grpc.DialOption, error) {
 	grpcMets := grpc_prometheus.NewClientMetrics()
 	grpcMets.EnableClientHandlingTimeHistogram(
 		grpc_prometheus.WithHistogramBuckets([]float64{0.001, 0.01, 0.1, 0.3, 0.6, 1, 3, 6, 9, 20, 30, 60, 90, 120}),
@@ -43,8 +47,18 @@ func StoreClientGRPCOpts(logger log.Logger, reg *prometheus.Registry, tracer ope
 			),
 		),
 	}
+	if compression != CompressionNone {
+		if encoding.GetCompressor(compression) == nil {
+			return nil, errors.Errorf("unsupported gRPC compression %q", compression)
+		}
+		dialOpts = append(dialOpts, grpc.WithDefaultCallOptions(grpc.UseCompressor(compression)))
+	}
+	if opt := keepalive.dialOption(); opt != nil {
+		dialOpts = append(dialOpts, opt)
+	}
 	if reg != nil {
 		reg.MustRegister(grpcMets)
+		dialOpts = append(dialOpts, grpc.WithStatsHandler(NewPayloadStatsHandler(reg, "client")))
 	}
 
 	if !secure {
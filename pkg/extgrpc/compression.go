@@ -0,0 +1,63 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extgrpc
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/extgrpc/snappy"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/stats"
+)
+
+// CompressionNone disables the compression of gRPC messages.
+const CompressionNone = "none"
+
+// Compressions are the names of the compressions of gRPC messages that can be used with StoreClientGRPCOpts.
+// Importing this package registers their compressors, so servers respond to compressed requests in kind.
+var Compressions = []string{CompressionNone, snappy.Name, gzip.Name}
+
+// payloadStatsHandler counts the bytes of the gRPC messages sent and received, both before compression and
+// on the wire, so that the effect of the compression can be observed.
+type payloadStatsHandler struct {
+	bytes *prometheus.CounterVec
+}
+
+// NewPayloadStatsHandler returns a gRPC stats handler counting the bytes of the messages sent and received by
+// direction and size, where the size is either "uncompressed" or "wire". It is registered with the given registerer
+// as thanos_grpc_<side>_payload_bytes_total, where side is either client or server.
+func NewPayloadStatsHandler(reg prometheus.Registerer, side string) stats.Handler {
+	h := &payloadStatsHandler{
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_grpc_" + side + "_payload_bytes_total",
+			Help: "Total number of bytes of the gRPC messages by direction, before compression (uncompressed) and on the wire (wire).",
+		}, []string{"direction", "size"}),
+	}
+	if reg != nil {
+		reg.MustRegister(h.bytes)
+	}
+	return h
+}
+
+func (h *payloadStatsHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (h *payloadStatsHandler) HandleRPC(_ context.Context, s stats.RPCStats) {
+	switch p := s.(type) {
+	case *stats.InPayload:
+		h.bytes.WithLabelValues("received", "uncompressed").Add(float64(p.Length))
+		h.bytes.WithLabelValues("received", "wire").Add(float64(p.WireLength))
+	case *stats.OutPayload:
+		h.bytes.WithLabelValues("sent", "uncompressed").Add(float64(p.Length))
+		h.bytes.WithLabelValues("sent", "wire").Add(float64(p.WireLength))
+	}
+}
+
+func (h *payloadStatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h *payloadStatsHandler) HandleConn(context.Context, stats.ConnStats) {}
@@ -0,0 +1,111 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extgrpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"google.golang.org/grpc"
+)
+
+// seriesServer returns the same series for every Series call.
+type seriesServer struct {
+	storepb.StoreServer
+
+	series []storepb.Series
+}
+
+func (s *seriesServer) Series(_ *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	for i := range s.series {
+		if err := srv.Send(storepb.NewSeriesResponse(&s.series[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestStoreClientGRPCOpts_Compression(t *testing.T) {
+	var series []storepb.Series
+	for i := 0; i < 100; i++ {
+		series = append(series, storepb.Series{
+			Labels: []storepb.Label{
+				{Name: "__name__", Value: "http_requests_total"},
+				{Name: "instance", Value: fmt.Sprintf("%s-%d", strings.Repeat("instance", 10), i)},
+			},
+			Chunks: []storepb.AggrChunk{{MinTime: 0, MaxTime: 100, Raw: &storepb.Chunk{Type: storepb.Chunk_XOR, Data: []byte(strings.Repeat("chunk", 100))}}},
+		})
+	}
+
+	for _, compression := range Compressions {
+		t.Run(compression, func(t *testing.T) {
+			serverReg := prometheus.NewRegistry()
+			srv := grpc.NewServer(grpc.StatsHandler(NewPayloadStatsHandler(serverReg, "server")))
+			storepb.RegisterStoreServer(srv, &seriesServer{series: series})
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			testutil.Ok(t, err)
+			go func() { _ = srv.Serve(l) }()
+			defer srv.Stop()
+
+			clientReg := prometheus.NewRegistry()
+			dialOpts, err := StoreClientGRPCOpts(log.NewNopLogger(), clientReg, opentracing.NoopTracer{}, false, "", "", "", "", compression, KeepaliveConfig{})
+			testutil.Ok(t, err)
+			conn, err := grpc.Dial(l.Addr().String(), dialOpts...)
+			testutil.Ok(t, err)
+			defer func() { testutil.Ok(t, conn.Close()) }()
+
+			sc, err := storepb.NewStoreClient(conn).Series(context.Background(), &storepb.SeriesRequest{})
+			testutil.Ok(t, err)
+			var received []storepb.Series
+			for {
+				resp, err := sc.Recv()
+				if err == io.EOF {
+					break
+				}
+				testutil.Ok(t, err)
+				received = append(received, *resp.GetSeries())
+			}
+			testutil.Equals(t, series, received)
+
+			payloadBytes := func(reg *prometheus.Registry, side, direction, size string) float64 {
+				mfs, err := reg.Gather()
+				testutil.Ok(t, err)
+				for _, mf := range mfs {
+					if mf.GetName() != "thanos_grpc_"+side+"_payload_bytes_total" {
+						continue
+					}
+					for _, m := range mf.GetMetric() {
+						if m.GetLabel()[0].GetValue() == direction && m.GetLabel()[1].GetValue() == size {
+							return m.GetCounter().GetValue()
+						}
+					}
+				}
+				return 0
+			}
+			uncompressed, wire := payloadBytes(clientReg, "client", "received", "uncompressed"), payloadBytes(clientReg, "client", "received", "wire")
+			testutil.Assert(t, uncompressed > 0, "expected received bytes")
+			testutil.Equals(t, uncompressed, payloadBytes(serverReg, "server", "sent", "uncompressed"))
+			if compression == CompressionNone {
+				testutil.Assert(t, wire >= uncompressed, "expected no compression, got %v bytes on the wire for %v bytes", wire, uncompressed)
+				return
+			}
+			// The server responds with the compression of the request.
+			testutil.Assert(t, wire < uncompressed/2, "expected the %s compression to reduce %v bytes, got %v bytes on the wire", compression, uncompressed, wire)
+			testutil.Assert(t, payloadBytes(serverReg, "server", "sent", "wire") < uncompressed/2, "expected the server to send %s compressed messages", compression)
+		})
+	}
+
+	_, err := StoreClientGRPCOpts(log.NewNopLogger(), nil, opentracing.NoopTracer{}, false, "", "", "", "", "zip", KeepaliveConfig{})
+	testutil.NotOk(t, err)
+}
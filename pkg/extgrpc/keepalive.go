@@ -0,0 +1,58 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extgrpc
+
+import (
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// minKeepaliveTime is the minimum interval of keepalive pings gRPC clients send.
+const minKeepaliveTime = 10 * time.Second
+
+// KeepaliveConfig configures the keepalive pings of client connections, which keep idle connections from being
+// dropped, e.g. by load balancers or NAT gateways, and detect broken connections.
+type KeepaliveConfig struct {
+	// Time is the duration without activity after which the client pings the server. Zero disables keepalive pings,
+	// shorter durations are raised to 10s.
+	Time time.Duration
+	// Timeout is the duration the client waits for a response to a ping before closing the connection.
+	Timeout time.Duration
+	// PermitWithoutStream allows pings on connections without active requests, keeping idle connections alive.
+	PermitWithoutStream bool
+}
+
+// dialOption returns the dial option of the keepalive config, or nil if keepalive pings are disabled.
+func (c KeepaliveConfig) dialOption() grpc.DialOption {
+	params, ok := c.clientParameters()
+	if !ok {
+		return nil
+	}
+	return grpc.WithKeepaliveParams(params)
+}
+
+// clientParameters returns the gRPC client keepalive parameters of the config, and false if keepalive pings are
+// disabled.
+func (c KeepaliveConfig) clientParameters() (keepalive.ClientParameters, bool) {
+	if c.Time <= 0 {
+		return keepalive.ClientParameters{}, false
+	}
+	return keepalive.ClientParameters{
+		Time:                c.Time,
+		Timeout:             c.Timeout,
+		PermitWithoutStream: c.PermitWithoutStream,
+	}, true
+}
+
+// ServerKeepaliveEnforcement returns the server option accepting the keepalive pings of any client, also on
+// connections without active requests. By default, servers close the connections of clients pinging more often
+// than every five minutes.
+func ServerKeepaliveEnforcement() grpc.ServerOption {
+	return grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+		MinTime:             minKeepaliveTime,
+		PermitWithoutStream: true,
+	})
+}
@@ -0,0 +1,87 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package extgrpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/opentracing/opentracing-go"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
+)
+
+// countingListener counts the accepted connections.
+type countingListener struct {
+	net.Listener
+
+	accepted int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&l.accepted, 1)
+	return c, nil
+}
+
+func TestKeepaliveConfig_ClientParameters(t *testing.T) {
+	params, ok := KeepaliveConfig{Time: time.Minute, Timeout: 20 * time.Second, PermitWithoutStream: true}.clientParameters()
+	testutil.Assert(t, ok, "expected keepalive pings to be enabled")
+	testutil.Equals(t, keepalive.ClientParameters{Time: time.Minute, Timeout: 20 * time.Second, PermitWithoutStream: true}, params)
+
+	_, ok = KeepaliveConfig{Timeout: 20 * time.Second}.clientParameters()
+	testutil.Assert(t, !ok, "expected keepalive pings to be disabled")
+	testutil.Equals(t, nil, KeepaliveConfig{}.dialOption())
+}
+
+func TestStoreClientGRPCOpts_Keepalive(t *testing.T) {
+	srv := grpc.NewServer(ServerKeepaliveEnforcement())
+	storepb.RegisterStoreServer(srv, &seriesServer{series: []storepb.Series{{Labels: []storepb.Label{{Name: "a", Value: "1"}}}}})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	cl := &countingListener{Listener: l}
+	go func() { _ = srv.Serve(cl) }()
+	defer srv.Stop()
+
+	dialOpts, err := StoreClientGRPCOpts(log.NewNopLogger(), nil, opentracing.NoopTracer{}, false, "", "", "", "", CompressionNone, KeepaliveConfig{
+		Time:                time.Second,
+		Timeout:             time.Second,
+		PermitWithoutStream: true,
+	})
+	testutil.Ok(t, err)
+	conn, err := grpc.Dial(l.Addr().String(), dialOpts...)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, conn.Close()) }()
+
+	series := func() {
+		sc, err := storepb.NewStoreClient(conn).Series(context.Background(), &storepb.SeriesRequest{})
+		testutil.Ok(t, err)
+		for {
+			_, err := sc.Recv()
+			if err == io.EOF {
+				return
+			}
+			testutil.Ok(t, err)
+		}
+	}
+
+	// Connections with keepalive pings are accepted by servers enforcing them, and reused by the following requests.
+	series()
+	series()
+	series()
+	testutil.Equals(t, connectivity.Ready, conn.GetState())
+	testutil.Equals(t, int64(1), atomic.LoadInt64(&cl.accepted))
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/go-kit/kit/log/level"
 	"github.com/pkg/errors"
 	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/credentials"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -31,6 +32,11 @@ type Config struct {
 	ContainerName      string `yaml:"container"`
 	Endpoint           string `yaml:"endpoint"`
 	MaxRetries         int    `yaml:"max_retries"`
+	// Credentials selects the provider of Azure AD access tokens instead of storage_account_key.
+	Credentials credentials.Config `yaml:"credentials"`
+
+	// tokenCredential authenticates requests with the tokens of the credentials provider, if any.
+	tokenCredential blob.TokenCredential
 }
 
 // Bucket implements the store.Bucket interface against Azure APIs.
@@ -42,15 +48,27 @@ type Bucket struct {
 
 // Validate checks to see if any of the config options are set.
 func (conf *Config) validate() error {
-	if conf.StorageAccountName == "" ||
-		conf.StorageAccountKey == "" {
-		return errors.New("invalid Azure storage configuration")
-	}
-	if conf.StorageAccountName == "" && conf.StorageAccountKey != "" {
-		return errors.New("no Azure storage_account specified while storage_account_key is present in config file; both should be present")
-	}
-	if conf.StorageAccountName != "" && conf.StorageAccountKey == "" {
-		return errors.New("no Azure storage_account_key specified while storage_account is present in config file; both should be present")
+	if conf.Credentials.Enabled() {
+		if conf.StorageAccountName == "" {
+			return errors.New("no Azure storage_account specified while a credentials provider is present in config file")
+		}
+		if conf.StorageAccountKey != "" {
+			return errors.New("Azure storage_account_key cannot be specified together with a credentials provider")
+		}
+		if conf.Credentials.Type == credentials.IAM {
+			return errors.New("IAM credentials are not supported by the Azure client")
+		}
+	} else {
+		if conf.StorageAccountName == "" ||
+			conf.StorageAccountKey == "" {
+			return errors.New("invalid Azure storage configuration")
+		}
+		if conf.StorageAccountName == "" && conf.StorageAccountKey != "" {
+			return errors.New("no Azure storage_account specified while storage_account_key is present in config file; both should be present")
+		}
+		if conf.StorageAccountName != "" && conf.StorageAccountKey == "" {
+			return errors.New("no Azure storage_account_key specified while storage_account is present in config file; both should be present")
+		}
 	}
 	if conf.ContainerName == "" {
 		return errors.New("no Azure container specified")
@@ -77,6 +95,17 @@ func NewBucket(logger log.Logger, azureConfig []byte, component string) (*Bucket
 		return nil, err
 	}
 
+	if conf.Credentials.Enabled() {
+		creds, err := credentials.NewCredentials(logger, conf.Credentials)
+		if err != nil {
+			return nil, errors.Wrap(err, "initialize Azure credentials")
+		}
+		conf.tokenCredential, err = newTokenCredential(logger, creds)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	ctx := context.Background()
 	container, err := createContainer(ctx, conf)
 	if err != nil {
@@ -107,38 +136,70 @@ func NewBucket(logger log.Logger, azureConfig []byte, component string) (*Bucket
 
 // Iter calls f for each entry in the given directory. The argument to f is the full
 // object name including the prefix of the inspected directory.
-func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	return b.IterWithAttributes(ctx, dir, func(name string, _ objstore.ObjectAttributes) error {
+		return f(name)
+	}, options...)
+}
+
+// IterWithAttributes calls f for each entry in the given directory with the entry's attributes
+// returned by the same listing call. The argument to f is the full object name including the
+// prefix of the inspected directory.
+func (b *Bucket) IterWithAttributes(ctx context.Context, dir string, f func(string, objstore.ObjectAttributes) error, options ...objstore.IterOption) error {
 
 	prefix := dir
 	if prefix != "" && !strings.HasSuffix(prefix, DirDelim) {
 		prefix += DirDelim
 	}
 
+	recursive := objstore.ApplyIterOptions(options...).Recursive
 	marker := blob.Marker{}
 
 	for i := 1; ; i++ {
-		list, err := b.containerURL.ListBlobsHierarchySegment(ctx, marker, DirDelim, blob.ListBlobsSegmentOptions{
-			Prefix: prefix,
-		})
-
-		if err != nil {
-			return errors.Wrapf(err, "cannot list blobs in directory %s (iteration #%d)", dir, i)
+		var (
+			blobItems    []blob.BlobItem
+			blobPrefixes []blob.BlobPrefix
+		)
+		// Recursive listings are flat, without blob prefixes.
+		if recursive {
+			list, err := b.containerURL.ListBlobsFlatSegment(ctx, marker, blob.ListBlobsSegmentOptions{
+				Prefix: prefix,
+			})
+			if err != nil {
+				return errors.Wrapf(err, "cannot list blobs in directory %s recursively (iteration #%d)", dir, i)
+			}
+			marker = list.NextMarker
+			blobItems = list.Segment.BlobItems
+		} else {
+			list, err := b.containerURL.ListBlobsHierarchySegment(ctx, marker, DirDelim, blob.ListBlobsSegmentOptions{
+				Prefix: prefix,
+			})
+			if err != nil {
+				return errors.Wrapf(err, "cannot list blobs in directory %s (iteration #%d)", dir, i)
+			}
+			marker = list.NextMarker
+			blobItems, blobPrefixes = list.Segment.BlobItems, list.Segment.BlobPrefixes
 		}
 
-		marker = list.NextMarker
-
 		var listNames []string
+		listAttrs := map[string]objstore.ObjectAttributes{}
 
-		for _, blob := range list.Segment.BlobItems {
+		for _, blob := range blobItems {
 			listNames = append(listNames, blob.Name)
+
+			attrs := objstore.ObjectAttributes{LastModified: blob.Properties.LastModified}
+			if blob.Properties.ContentLength != nil {
+				attrs.Size = *blob.Properties.ContentLength
+			}
+			listAttrs[blob.Name] = attrs
 		}
 
-		for _, blobPrefix := range list.Segment.BlobPrefixes {
+		for _, blobPrefix := range blobPrefixes {
 			listNames = append(listNames, blobPrefix.Name)
 		}
 
 		for _, name := range listNames {
-			if err := f(name); err != nil {
+			if err := f(name, listAttrs[name]); err != nil {
 				return err
 			}
 		}
@@ -231,6 +292,22 @@ func (b *Bucket) GetRange(ctx context.Context, name string, off, length int64) (
 	return b.getBlobReader(ctx, name, off, length)
 }
 
+// Attributes returns the attributes of the specified object.
+func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	blobURL, err := getBlobURL(ctx, *b.config, name)
+	if err != nil {
+		return objstore.ObjectAttributes{}, errors.Wrapf(err, "cannot get Azure blob URL, blob: %s", name)
+	}
+	props, err := blobURL.GetProperties(ctx, blob.BlobAccessConditions{})
+	if err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	return objstore.ObjectAttributes{
+		Size:         props.ContentLength(),
+		LastModified: props.LastModified(),
+	}, nil
+}
+
 // ObjectSize returns the size of the specified object.
 func (b *Bucket) ObjectSize(ctx context.Context, name string) (uint64, error) {
 	blobURL, err := getBlobURL(ctx, *b.config, name)
@@ -265,6 +342,12 @@ func (b *Bucket) Exists(ctx context.Context, name string) (bool, error) {
 
 // Upload the contents of the reader as an object into the bucket.
 func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	return b.UploadWithMetadata(ctx, name, r, objstore.ObjectMetadata{})
+}
+
+// UploadWithMetadata uploads the contents of the reader as an object into the bucket, with the given
+// content type and cache control as blob HTTP headers.
+func (b *Bucket) UploadWithMetadata(ctx context.Context, name string, r io.Reader, md objstore.ObjectMetadata) error {
 	level.Debug(b.logger).Log("msg", "Uploading blob", "blob", name)
 	blobURL, err := getBlobURL(ctx, *b.config, name)
 	if err != nil {
@@ -274,6 +357,10 @@ func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
 		blob.UploadStreamToBlockBlobOptions{
 			BufferSize: 3 * 1024 * 1024,
 			MaxBuffers: 4,
+			BlobHTTPHeaders: blob.BlobHTTPHeaders{
+				ContentType:  md.ContentType,
+				CacheControl: md.CacheControl,
+			},
 		},
 	); err != nil {
 		return errors.Wrapf(err, "cannot upload Azure blob, address: %s", name)
@@ -300,6 +387,14 @@ func (b *Bucket) Name() string {
 	return b.config.ContainerName
 }
 
+// SupportedOperations returns the optional operations supported by the bucket.
+func (b *Bucket) SupportedOperations() []objstore.Operation {
+	return []objstore.Operation{
+		objstore.OpIterWithAttributes,
+		objstore.OpUploadWithMetadata,
+	}
+}
+
 // NewTestBucket creates test bkt client that before returning creates temporary bucket.
 // In a close function it empties and deletes the bucket.
 func NewTestBucket(t testing.TB, component string) (objstore.Bucket, func(), error) {
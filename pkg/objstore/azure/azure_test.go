@@ -6,6 +6,7 @@ package azure
 import (
 	"testing"
 
+	"github.com/thanos-io/thanos/pkg/objstore/credentials"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
 
@@ -102,3 +103,23 @@ func TestConfig_validate(t *testing.T) {
 		})
 	}
 }
+
+func TestConfig_validateCredentials(t *testing.T) {
+	conf := &Config{
+		StorageAccountName: "foo",
+		ContainerName:      "roo",
+		Credentials:        credentials.Config{Type: credentials.VAULT},
+	}
+	testutil.Ok(t, conf.validate())
+
+	conf.StorageAccountKey = "bar"
+	testutil.NotOk(t, conf.validate())
+
+	conf.StorageAccountKey = ""
+	conf.Credentials.Type = credentials.IAM
+	testutil.NotOk(t, conf.validate())
+
+	conf.StorageAccountName = ""
+	conf.Credentials.Type = credentials.STATIC
+	testutil.NotOk(t, conf.validate())
+}
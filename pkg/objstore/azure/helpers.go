@@ -11,17 +11,62 @@ import (
 	"time"
 
 	blob "github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/objstore/credentials"
 )
 
 // DirDelim is the delimiter used to model a directory structure in an object store bucket.
 const DirDelim = "/"
 
+// tokenRefreshRetryInterval is the interval failed refreshes of token credentials are retried at.
+const tokenRefreshRetryInterval = 10 * time.Second
+
 var errorCodeRegex = regexp.MustCompile(`X-Ms-Error-Code:\D*\[(\w+)\]`)
 
-func getContainerURL(ctx context.Context, conf Config) (blob.ContainerURL, error) {
-	c, err := blob.NewSharedKeyCredential(conf.StorageAccountName, conf.StorageAccountKey)
+// newTokenCredential returns a token credential authenticating with the tokens of the given credentials, which
+// sets the new token whenever the current one is due to be refreshed.
+func newTokenCredential(logger log.Logger, creds *credentials.Credentials) (blob.TokenCredential, error) {
+	v, err := creds.Get(context.Background())
 	if err != nil {
-		return blob.ContainerURL{}, err
+		return nil, err
+	}
+	if v.Token == "" {
+		return nil, errors.New("no token in provided credentials")
+	}
+
+	return blob.NewTokenCredential(v.Token, func(tc blob.TokenCredential) time.Duration {
+		v, err := creds.Get(context.Background())
+		if err == nil && v.Token == "" {
+			err = errors.New("no token in provided credentials")
+		}
+		if err != nil {
+			level.Warn(logger).Log("msg", "failed to refresh Azure token", "err", err)
+			return tokenRefreshRetryInterval
+		}
+		tc.SetToken(v.Token)
+
+		refreshAt := creds.RefreshAt()
+		if refreshAt.IsZero() {
+			// The token never expires, so it is never refreshed again.
+			return 0
+		}
+		if d := time.Until(refreshAt); d > 0 {
+			return d
+		}
+		return tokenRefreshRetryInterval
+	}), nil
+}
+
+func getContainerURL(ctx context.Context, conf Config) (blob.ContainerURL, error) {
+	var c blob.Credential = conf.tokenCredential
+	if c == nil {
+		var err error
+		c, err = blob.NewSharedKeyCredential(conf.StorageAccountName, conf.StorageAccountKey)
+		if err != nil {
+			return blob.ContainerURL{}, err
+		}
 	}
 
 	retryOptions := blob.RetryOptions{
@@ -5,8 +5,13 @@ package azure
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/thanos-io/thanos/pkg/objstore/credentials"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
 
@@ -59,3 +64,52 @@ func Test_getContainerURL(t *testing.T) {
 		})
 	}
 }
+
+// rotatingProvider provides a new token with every retrieval, valid for the given lease.
+type rotatingProvider struct {
+	lease time.Duration
+
+	mtx       sync.Mutex
+	retrieved int
+}
+
+func (p *rotatingProvider) Retrieve(context.Context) (credentials.Value, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.retrieved++
+	return credentials.Value{Token: fmt.Sprintf("token-%d", p.retrieved), Expiration: time.Now().Add(p.lease)}, nil
+}
+
+func Test_newTokenCredential(t *testing.T) {
+	creds := credentials.New(log.NewNopLogger(), &rotatingProvider{lease: 300 * time.Millisecond}, 200*time.Millisecond)
+	tc, err := newTokenCredential(log.NewNopLogger(), creds)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "token-1", tc.Token())
+
+	// The token is replaced once it is due to be refreshed, so that requests continue with the new one.
+	deadline := time.Now().Add(5 * time.Second)
+	for tc.Token() == "token-1" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	testutil.Equals(t, "token-2", tc.Token())
+
+	c, err := getContainerURL(context.Background(), Config{
+		StorageAccountName: "foo",
+		ContainerName:      "roo",
+		Endpoint:           azureDefaultEndpoint,
+		tokenCredential:    tc,
+	})
+	testutil.Ok(t, err)
+	testutil.Equals(t, "https://foo.blob.core.windows.net/roo", c.String())
+
+	_, err = newTokenCredential(log.NewNopLogger(), credentials.New(log.NewNopLogger(), &staticKeysProvider{}, time.Minute))
+	testutil.NotOk(t, err)
+}
+
+// staticKeysProvider provides keys without a token.
+type staticKeysProvider struct{}
+
+func (staticKeysProvider) Retrieve(context.Context) (credentials.Value, error) {
+	return credentials.Value{AccessKey: "key", SecretKey: "secret"}, nil
+}
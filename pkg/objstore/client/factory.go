@@ -7,11 +7,13 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/objstore/azure"
 	"github.com/thanos-io/thanos/pkg/objstore/cos"
@@ -38,6 +40,28 @@ const (
 type BucketConfig struct {
 	Type   ObjProvider `yaml:"type"`
 	Config interface{} `yaml:"config"`
+	// MaxConcurrency limits the number of operations running concurrently against the bucket. 0 disables the limit.
+	MaxConcurrency int `yaml:"max_concurrency,omitempty"`
+	// LogOperations logs every operation run against the bucket with its parameters.
+	LogOperations bool `yaml:"log_operations,omitempty"`
+	// DryRun logs every operation like LogOperations, and skips writes and deletions reporting them as successful.
+	DryRun bool `yaml:"dry_run,omitempty"`
+	// Timeouts are the timeouts of the operations against the bucket by type of operation.
+	Timeouts TimeoutsConfig `yaml:"timeouts,omitempty"`
+}
+
+// TimeoutsConfig are the timeouts of the operations against a bucket by type of operation. Zero disables a timeout.
+type TimeoutsConfig struct {
+	// Metadata is the timeout of requests for the size, attributes or existence of an object.
+	Metadata model.Duration `yaml:"metadata,omitempty"`
+	// Iter is the timeout of listings.
+	Iter model.Duration `yaml:"iter,omitempty"`
+	// Read is the timeout of downloads, including reading the object.
+	Read model.Duration `yaml:"read,omitempty"`
+	// Write is the timeout of uploads and copies.
+	Write model.Duration `yaml:"write,omitempty"`
+	// Delete is the timeout of deletions.
+	Delete model.Duration `yaml:"delete,omitempty"`
 }
 
 // NewBucket initializes and returns new object storage clients.
@@ -48,6 +72,9 @@ func NewBucket(logger log.Logger, confContentYaml []byte, reg prometheus.Registe
 	if err := yaml.UnmarshalStrict(confContentYaml, bucketConf); err != nil {
 		return nil, errors.Wrap(err, "parsing config YAML file")
 	}
+	if bucketConf.MaxConcurrency < 0 {
+		return nil, errors.Errorf("invalid max_concurrency %d, must be >= 0", bucketConf.MaxConcurrency)
+	}
 
 	config, err := yaml.Marshal(bucketConf.Config)
 	if err != nil {
@@ -76,5 +103,23 @@ func NewBucket(logger log.Logger, confContentYaml []byte, reg prometheus.Registe
 	if err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("create %s client", bucketConf.Type))
 	}
-	return objstore.BucketWithMetrics(bucket.Name(), bucket, reg), nil
+	if bucketConf.LogOperations || bucketConf.DryRun {
+		level.Warn(logger).Log("msg", "logging every bucket operation", "dry_run", bucketConf.DryRun)
+		bucket = objstore.BucketWithOperationLog(logger, bucket, bucketConf.DryRun)
+	}
+	if t := bucketConf.Timeouts; t != (TimeoutsConfig{}) {
+		bucket = objstore.BucketWithTimeouts(bucket, objstore.OperationTimeouts{
+			Metadata: time.Duration(t.Metadata),
+			Iter:     time.Duration(t.Iter),
+			Read:     time.Duration(t.Read),
+			Write:    time.Duration(t.Write),
+			Delete:   time.Duration(t.Delete),
+		})
+	}
+	bucket = objstore.BucketWithMetrics(bucket.Name(), objstore.BucketWithTracing(bucket), reg)
+	if bucketConf.MaxConcurrency > 0 {
+		// Limit outside of the metrics, so that operations waiting for the limit are not reported as running.
+		bucket = objstore.BucketWithConcurrencyLimit(bucket, bucketConf.MaxConcurrency)
+	}
+	return bucket, nil
 }
@@ -92,6 +92,31 @@ func (b *Bucket) Name() string {
 	return b.name
 }
 
+// SupportedOperations returns the optional operations supported by the bucket, none of which are supported natively.
+func (b *Bucket) SupportedOperations() []objstore.Operation {
+	return nil
+}
+
+// Attributes returns the attributes of the specified object.
+func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	resp, err := b.client.Object.Head(ctx, name, nil)
+	if err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return objstore.ObjectAttributes{}, errors.Wrap(err, "convert content-length")
+	}
+	mod, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return objstore.ObjectAttributes{}, errors.Wrap(err, "parse last-modified")
+	}
+	return objstore.ObjectAttributes{
+		Size:         size,
+		LastModified: mod,
+	}, nil
+}
+
 // ObjectSize returns the size of the specified object.
 func (b *Bucket) ObjectSize(ctx context.Context, name string) (uint64, error) {
 	resp, err := b.client.Object.Head(ctx, name, nil)
@@ -127,14 +152,20 @@ func (b *Bucket) Delete(ctx context.Context, name string) error {
 	return nil
 }
 
-// Iter calls f for each entry in the given directory (not recursive.). The argument to f is the full
+// Iter calls f for each entry in the given directory. The argument to f is the full
 // object name including the prefix of the inspected directory.
-func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
 	if dir != "" {
 		dir = strings.TrimSuffix(dir, dirDelim) + dirDelim
 	}
 
-	for object := range b.listObjects(ctx, dir) {
+	// Recursive listings are not delimited.
+	delimiter := dirDelim
+	if objstore.ApplyIterOptions(options...).Recursive {
+		delimiter = ""
+	}
+
+	for object := range b.listObjects(ctx, dir, delimiter) {
 		if object.err != nil {
 			return object.err
 		}
@@ -216,7 +247,7 @@ type objectInfo struct {
 	err error
 }
 
-func (b *Bucket) listObjects(ctx context.Context, objectPrefix string) <-chan objectInfo {
+func (b *Bucket) listObjects(ctx context.Context, objectPrefix, delimiter string) <-chan objectInfo {
 	objectsCh := make(chan objectInfo, 1)
 
 	go func(objectsCh chan<- objectInfo) {
@@ -227,7 +258,7 @@ func (b *Bucket) listObjects(ctx context.Context, objectPrefix string) <-chan ob
 				Prefix:    objectPrefix,
 				MaxKeys:   1000,
 				Marker:    marker,
-				Delimiter: dirDelim,
+				Delimiter: delimiter,
 			})
 			if err != nil {
 				select {
@@ -0,0 +1,215 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+// Package credentials provides the credentials of object storage clients from pluggable sources, refreshing
+// expiring credentials before they expire.
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+type ProviderType string
+
+const (
+	STATIC ProviderType = "STATIC"
+	ENV    ProviderType = "ENV"
+	FILE   ProviderType = "FILE"
+	VAULT  ProviderType = "VAULT"
+	// IAM credentials are retrieved by the object storage clients themselves, e.g. from an instance profile.
+	IAM ProviderType = "IAM"
+)
+
+// DefaultRefreshBefore is how long before their expiration credentials are refreshed by default.
+const DefaultRefreshBefore = time.Minute
+
+// refreshRetryInterval is how long after a failed retrieval credentials are retrieved again at the earliest.
+const refreshRetryInterval = 10 * time.Second
+
+// Config specifies the provider of the credentials of an object storage client.
+type Config struct {
+	Type ProviderType `yaml:"type"`
+	// RefreshBefore is how long before their expiration credentials are refreshed. Defaults to DefaultRefreshBefore.
+	RefreshBefore model.Duration `yaml:"refresh_before"`
+	Config        interface{}    `yaml:"config"`
+}
+
+// Enabled returns whether a credentials provider is configured.
+func (c Config) Enabled() bool {
+	return c.Type != ""
+}
+
+// Value is a set of credentials. Clients authenticating with keys use the access and secret key, and the token as
+// session token if any, while clients authenticating with bearer tokens use the token only.
+type Value struct {
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	Token     string `yaml:"token"`
+	// Expiration is the time the credentials expire at. Credentials with zero expiration never expire.
+	Expiration time.Time `yaml:"expiration"`
+}
+
+// Provider retrieves credentials.
+type Provider interface {
+	Retrieve(ctx context.Context) (Value, error)
+}
+
+// NewProvider returns the provider of the given config. IAM credentials are not provided, as they are retrieved by
+// the object storage clients.
+func NewProvider(conf Config) (Provider, error) {
+	providerConf, err := yaml.Marshal(conf.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal content of credentials provider configuration")
+	}
+
+	var p Provider
+	switch strings.ToUpper(string(conf.Type)) {
+	case string(STATIC):
+		p, err = newStaticProvider(providerConf)
+	case string(ENV):
+		p, err = newEnvProvider(providerConf)
+	case string(FILE):
+		p, err = newFileProvider(providerConf)
+	case string(VAULT):
+		p, err = newVaultProvider(providerConf)
+	default:
+		return nil, errors.Errorf("credentials provider with type %s is not supported", conf.Type)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("create %s credentials provider", conf.Type))
+	}
+	return p, nil
+}
+
+// Credentials caches the credentials of a provider and retrieves new ones before they expire.
+type Credentials struct {
+	logger        log.Logger
+	provider      Provider
+	refreshBefore time.Duration
+	now           func() time.Time
+
+	mtx   sync.Mutex
+	value *Value
+	// refreshing is closed once the retrieval in progress, if any, is done.
+	refreshing chan struct{}
+	// failed is the time of the last failed retrieval, zero if the last retrieval succeeded.
+	failed  time.Time
+	lastErr error
+}
+
+// NewCredentials returns new Credentials of the provider of the given config.
+func NewCredentials(logger log.Logger, conf Config) (*Credentials, error) {
+	p, err := NewProvider(conf)
+	if err != nil {
+		return nil, err
+	}
+	refreshBefore := time.Duration(conf.RefreshBefore)
+	if refreshBefore <= 0 {
+		refreshBefore = DefaultRefreshBefore
+	}
+	return New(logger, p, refreshBefore), nil
+}
+
+// New returns new Credentials of the given provider, refreshing credentials the given duration before they expire.
+func New(logger log.Logger, provider Provider, refreshBefore time.Duration) *Credentials {
+	return &Credentials{
+		logger:        logger,
+		provider:      provider,
+		refreshBefore: refreshBefore,
+		now:           time.Now,
+	}
+}
+
+// Get returns the current credentials, retrieving new ones if there are none yet or they are due to be refreshed.
+// Only one retrieval runs at a time; concurrent calls return the current credentials if they did not expire yet, or
+// wait for the retrieval otherwise. If retrieving new credentials fails before the current ones expired, the current
+// ones are returned. Retrieval is retried no earlier than refreshRetryInterval after a failure.
+func (c *Credentials) Get(ctx context.Context) (Value, error) {
+	for {
+		c.mtx.Lock()
+		if c.value != nil && !c.due(*c.value, c.refreshBefore) {
+			v := *c.value
+			c.mtx.Unlock()
+			return v, nil
+		}
+		if c.refreshing != nil || c.now().Before(c.failed.Add(refreshRetryInterval)) {
+			if c.value != nil && !c.due(*c.value, 0) {
+				v := *c.value
+				c.mtx.Unlock()
+				return v, nil
+			}
+			if c.refreshing == nil {
+				err := c.lastErr
+				c.mtx.Unlock()
+				return Value{}, errors.Wrap(err, "retrieve credentials")
+			}
+			refreshing := c.refreshing
+			c.mtx.Unlock()
+
+			select {
+			case <-refreshing:
+				continue
+			case <-ctx.Done():
+				return Value{}, ctx.Err()
+			}
+		}
+		refreshing := make(chan struct{})
+		c.refreshing = refreshing
+		c.mtx.Unlock()
+
+		v, err := c.provider.Retrieve(ctx)
+
+		c.mtx.Lock()
+		c.refreshing = nil
+		close(refreshing)
+		if err != nil {
+			c.failed, c.lastErr = c.now(), err
+			if c.value != nil && !c.due(*c.value, 0) {
+				level.Warn(c.logger).Log("msg", "failed to refresh credentials, using current ones until they expire", "expiration", c.value.Expiration, "err", err)
+				v := *c.value
+				c.mtx.Unlock()
+				return v, nil
+			}
+			c.mtx.Unlock()
+			return Value{}, errors.Wrap(err, "retrieve credentials")
+		}
+		c.value, c.failed, c.lastErr = &v, time.Time{}, nil
+		c.mtx.Unlock()
+		return v, nil
+	}
+}
+
+// Expired returns whether there are no current credentials or they are due to be refreshed.
+func (c *Credentials) Expired() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.value == nil || c.due(*c.value, c.refreshBefore)
+}
+
+// RefreshAt returns the time the current credentials are due to be refreshed at, or zero if there are none or they
+// never expire.
+func (c *Credentials) RefreshAt() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.value == nil || c.value.Expiration.IsZero() {
+		return time.Time{}
+	}
+	return c.value.Expiration.Add(-c.refreshBefore)
+}
+
+// due returns whether the given credentials expire within the given duration.
+func (c *Credentials) due(v Value, within time.Duration) bool {
+	return !v.Expiration.IsZero() && !c.now().Add(within).Before(v.Expiration)
+}
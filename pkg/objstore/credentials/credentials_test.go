@@ -0,0 +1,323 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// rotatingProvider provides new credentials with every retrieval, valid for the given lease.
+type rotatingProvider struct {
+	now       func() time.Time
+	lease     time.Duration
+	retrieved int
+	attempts  int
+	err       error
+}
+
+func (p *rotatingProvider) Retrieve(context.Context) (Value, error) {
+	p.attempts++
+	if p.err != nil {
+		return Value{}, p.err
+	}
+	p.retrieved++
+	return Value{
+		AccessKey:  fmt.Sprintf("key-%d", p.retrieved),
+		SecretKey:  fmt.Sprintf("secret-%d", p.retrieved),
+		Expiration: p.now().Add(p.lease),
+	}, nil
+}
+
+func TestCredentials_Refresh(t *testing.T) {
+	now := time.Unix(1000, 0)
+	p := &rotatingProvider{now: func() time.Time { return now }, lease: 10 * time.Minute}
+	c := New(log.NewNopLogger(), p, time.Minute)
+	c.now = p.now
+
+	testutil.Assert(t, c.Expired(), "expected credentials without value to be expired")
+	testutil.Equals(t, time.Time{}, c.RefreshAt())
+
+	v, err := c.Get(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, "key-1", v.AccessKey)
+	testutil.Equals(t, now.Add(9*time.Minute), c.RefreshAt())
+
+	// Credentials are cached until they are due to be refreshed.
+	now = now.Add(8 * time.Minute)
+	testutil.Assert(t, !c.Expired(), "expected credentials to be valid")
+	v, err = c.Get(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, "key-1", v.AccessKey)
+
+	// Credentials are refreshed before they expire.
+	now = now.Add(90 * time.Second)
+	testutil.Assert(t, c.Expired(), "expected credentials to be due to be refreshed")
+	v, err = c.Get(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, "key-2", v.AccessKey)
+	testutil.Equals(t, 2, p.retrieved)
+
+	// Failed refreshes fall back to the current credentials until they expire.
+	p.err = errors.New("unavailable")
+	now = now.Add(9*time.Minute + 30*time.Second)
+	v, err = c.Get(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, "key-2", v.AccessKey)
+
+	now = now.Add(time.Minute)
+	_, err = c.Get(context.Background())
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 4, p.attempts)
+
+	// Retrieval is not retried right after a failure.
+	p.err = nil
+	_, err = c.Get(context.Background())
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 4, p.attempts)
+
+	now = now.Add(refreshRetryInterval)
+	v, err = c.Get(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, "key-3", v.AccessKey)
+}
+
+// blockingProvider blocks retrievals until released.
+type blockingProvider struct {
+	started, release chan struct{}
+}
+
+func (p *blockingProvider) Retrieve(ctx context.Context) (Value, error) {
+	p.started <- struct{}{}
+	<-p.release
+	return Value{AccessKey: "new"}, nil
+}
+
+func TestCredentials_ConcurrentRefresh(t *testing.T) {
+	now := time.Unix(1000, 0)
+	p := &blockingProvider{started: make(chan struct{}, 1), release: make(chan struct{})}
+	c := New(log.NewNopLogger(), p, time.Minute)
+	c.now = func() time.Time { return now }
+	c.value = &Value{AccessKey: "current", Expiration: now.Add(30 * time.Second)}
+
+	refreshed := make(chan Value)
+	go func() {
+		v, err := c.Get(context.Background())
+		testutil.Ok(t, err)
+		refreshed <- v
+	}()
+	<-p.started
+
+	// Calls during a refresh get the current credentials that did not expire yet without waiting for it.
+	v, err := c.Get(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, "current", v.AccessKey)
+
+	// Once they expired, calls wait for the refresh, or their context.
+	now = now.Add(time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.Get(ctx)
+	testutil.Equals(t, context.Canceled, err)
+
+	waiting := make(chan Value)
+	go func() {
+		v, err := c.Get(context.Background())
+		testutil.Ok(t, err)
+		waiting <- v
+	}()
+	close(p.release)
+	testutil.Equals(t, "new", (<-refreshed).AccessKey)
+	testutil.Equals(t, "new", (<-waiting).AccessKey)
+}
+
+func newTestProvider(t *testing.T, typ ProviderType, conf interface{}) (Provider, error) {
+	b, err := yaml.Marshal(Config{Type: typ, Config: conf})
+	testutil.Ok(t, err)
+	var c Config
+	testutil.Ok(t, yaml.Unmarshal(b, &c))
+	return NewProvider(c)
+}
+
+func TestNewProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-credentials")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	credsFile := filepath.Join(dir, "creds.yaml")
+	testutil.Ok(t, ioutil.WriteFile(credsFile, []byte("access_key: file-key\nsecret_key: file-secret\nexpiration: 2030-01-01T00:00:00Z\n"), os.ModePerm))
+	testutil.Ok(t, os.Setenv("TEST_CREDENTIALS_TOKEN", "env-token"))
+	defer func() { testutil.Ok(t, os.Unsetenv("TEST_CREDENTIALS_TOKEN")) }()
+
+	for _, tcase := range []struct {
+		name     string
+		typ      ProviderType
+		conf     interface{}
+		expected Value
+		err      bool
+	}{
+		{
+			name:     "static",
+			typ:      STATIC,
+			conf:     map[string]string{"access_key": "key", "secret_key": "secret"},
+			expected: Value{AccessKey: "key", SecretKey: "secret"},
+		},
+		{
+			name: "static without secret key",
+			typ:  STATIC,
+			conf: map[string]string{"access_key": "key"},
+			err:  true,
+		},
+		{
+			name:     "env",
+			typ:      "env",
+			conf:     map[string]string{"token_env": "TEST_CREDENTIALS_TOKEN"},
+			expected: Value{Token: "env-token"},
+		},
+		{
+			name: "env unset",
+			typ:  ENV,
+			conf: map[string]string{"token_env": "TEST_CREDENTIALS_UNSET"},
+			err:  true,
+		},
+		{
+			name:     "file",
+			typ:      FILE,
+			conf:     map[string]string{"path": credsFile},
+			expected: Value{AccessKey: "file-key", SecretKey: "file-secret", Expiration: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name: "file missing",
+			typ:  FILE,
+			conf: map[string]string{"path": filepath.Join(dir, "missing.yaml")},
+			err:  true,
+		},
+		{
+			name: "IAM",
+			typ:  IAM,
+			err:  true,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			p, err := newTestProvider(t, tcase.typ, tcase.conf)
+			if err == nil {
+				var v Value
+				v, err = p.Retrieve(context.Background())
+				if !tcase.err {
+					testutil.Ok(t, err)
+					testutil.Equals(t, tcase.expected, v)
+					return
+				}
+			}
+			testutil.NotOk(t, err)
+		})
+	}
+}
+
+func TestFileProvider_ReloadInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-credentials")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	credsFile := filepath.Join(dir, "creds.yaml")
+	testutil.Ok(t, ioutil.WriteFile(credsFile, []byte("access_key: key-1\nsecret_key: secret-1\n"), os.ModePerm))
+
+	p, err := newTestProvider(t, FILE, map[string]string{"path": credsFile, "reload_interval": "5m"})
+	testutil.Ok(t, err)
+	now := time.Unix(1000, 0)
+	p.(*fileProvider).now = func() time.Time { return now }
+	c := New(log.NewNopLogger(), p, time.Minute)
+	c.now = func() time.Time { return now }
+
+	v, err := c.Get(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, Value{AccessKey: "key-1", SecretKey: "secret-1", Expiration: now.Add(5 * time.Minute)}, v)
+
+	// Rotated credentials are picked up with the next reload.
+	testutil.Ok(t, ioutil.WriteFile(credsFile, []byte("access_key: key-2\nsecret_key: secret-2\n"), os.ModePerm))
+	v, err = c.Get(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, "key-1", v.AccessKey)
+
+	now = now.Add(4 * time.Minute)
+	v, err = c.Get(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, "key-2", v.AccessKey)
+}
+
+func TestVaultProvider(t *testing.T) {
+	var leases int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors":["permission denied"]}`)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/aws/creds/thanos":
+			leases++
+			fmt.Fprintf(w, `{"lease_duration":3600,"data":{"access_key":"key-%d","secret_key":"secret-%d","security_token":"token-%d"}}`, leases, leases, leases)
+		case "/v1/proxied/thanos":
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprint(w, "<html>Bad Gateway</html>")
+		case "/v1/secret/data/thanos":
+			fmt.Fprint(w, `{"lease_duration":0,"data":{"data":{"key":"kv-key","secret":"kv-secret"},"metadata":{"version":1}}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[]}`)
+		}
+	}))
+	defer srv.Close()
+
+	now := time.Unix(1000, 0)
+	retrieve := func(conf map[string]string) (Value, error) {
+		p, err := newTestProvider(t, VAULT, conf)
+		testutil.Ok(t, err)
+		p.(*vaultProvider).now = func() time.Time { return now }
+		return p.Retrieve(context.Background())
+	}
+
+	v, err := retrieve(map[string]string{"address": srv.URL, "token": "vault-token", "path": "aws/creds/thanos"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, Value{AccessKey: "key-1", SecretKey: "secret-1", Token: "token-1", Expiration: now.Add(time.Hour)}, v)
+
+	dir, err := ioutil.TempDir("", "test-credentials")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+	tokenFile := filepath.Join(dir, "token")
+	testutil.Ok(t, ioutil.WriteFile(tokenFile, []byte("vault-token\n"), os.ModePerm))
+
+	v, err = retrieve(map[string]string{"address": srv.URL + "/", "token_file": tokenFile, "path": "/secret/data/thanos", "access_key_field": "key", "secret_key_field": "secret"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, Value{AccessKey: "kv-key", SecretKey: "kv-secret"}, v)
+
+	_, err = retrieve(map[string]string{"address": srv.URL, "token": "wrong", "path": "aws/creds/thanos"})
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "permission denied"), "unexpected error: %v", err)
+
+	_, err = retrieve(map[string]string{"address": srv.URL, "token": "vault-token", "path": "secret/data/thanos"})
+	testutil.NotOk(t, err)
+
+	// Errors of proxies in front of Vault are reported with their status.
+	_, err = retrieve(map[string]string{"address": srv.URL, "token": "vault-token", "path": "proxied/thanos"})
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "status 502"), "unexpected error: %v", err)
+
+	_, err = newTestProvider(t, VAULT, map[string]string{"address": srv.URL, "path": "aws/creds/thanos"})
+	testutil.NotOk(t, err)
+}
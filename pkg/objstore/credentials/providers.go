@@ -0,0 +1,134 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package credentials
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// validate returns an error if the given credentials have neither both keys nor a token.
+func validate(v Value) error {
+	if (v.AccessKey == "") != (v.SecretKey == "") {
+		return errors.New("access key and secret key must be provided together")
+	}
+	if v.AccessKey == "" && v.Token == "" {
+		return errors.New("no access key, secret key or token provided")
+	}
+	return nil
+}
+
+type staticConfig struct {
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	Token     string `yaml:"token"`
+}
+
+// staticProvider provides credentials from its configuration, which never expire.
+type staticProvider struct {
+	value Value
+}
+
+func newStaticProvider(conf []byte) (*staticProvider, error) {
+	var c staticConfig
+	if err := yaml.UnmarshalStrict(conf, &c); err != nil {
+		return nil, err
+	}
+	v := Value{AccessKey: c.AccessKey, SecretKey: c.SecretKey, Token: c.Token}
+	if err := validate(v); err != nil {
+		return nil, err
+	}
+	return &staticProvider{value: v}, nil
+}
+
+func (p *staticProvider) Retrieve(context.Context) (Value, error) {
+	return p.value, nil
+}
+
+type envConfig struct {
+	AccessKeyEnv string `yaml:"access_key_env"`
+	SecretKeyEnv string `yaml:"secret_key_env"`
+	TokenEnv     string `yaml:"token_env"`
+}
+
+// envProvider provides credentials from the environment variables named in its configuration, which never expire.
+type envProvider struct {
+	conf envConfig
+}
+
+func newEnvProvider(conf []byte) (*envProvider, error) {
+	var c envConfig
+	if err := yaml.UnmarshalStrict(conf, &c); err != nil {
+		return nil, err
+	}
+	if c.AccessKeyEnv == "" && c.SecretKeyEnv == "" && c.TokenEnv == "" {
+		return nil, errors.New("no environment variables configured")
+	}
+	return &envProvider{conf: c}, nil
+}
+
+func (p *envProvider) Retrieve(context.Context) (Value, error) {
+	getenv := func(name string) string {
+		if name == "" {
+			return ""
+		}
+		return os.Getenv(name)
+	}
+	v := Value{
+		AccessKey: getenv(p.conf.AccessKeyEnv),
+		SecretKey: getenv(p.conf.SecretKeyEnv),
+		Token:     getenv(p.conf.TokenEnv),
+	}
+	return v, validate(v)
+}
+
+type fileConfig struct {
+	Path string `yaml:"path"`
+	// ReloadInterval is the interval the file is read again at, e.g. to pick up credentials rotated by an agent,
+	// unless the credentials in it expire earlier. Zero reads it again only once its credentials expire.
+	ReloadInterval model.Duration `yaml:"reload_interval"`
+}
+
+// fileProvider provides credentials from a YAML file with the access_key, secret_key, token and expiration keys.
+type fileProvider struct {
+	conf fileConfig
+	now  func() time.Time
+}
+
+func newFileProvider(conf []byte) (*fileProvider, error) {
+	var c fileConfig
+	if err := yaml.UnmarshalStrict(conf, &c); err != nil {
+		return nil, err
+	}
+	if c.Path == "" {
+		return nil, errors.New("no credentials file path configured")
+	}
+	return &fileProvider{conf: c, now: time.Now}, nil
+}
+
+func (p *fileProvider) Retrieve(context.Context) (Value, error) {
+	b, err := ioutil.ReadFile(p.conf.Path)
+	if err != nil {
+		return Value{}, errors.Wrap(err, "read credentials file")
+	}
+	var v Value
+	if err := yaml.UnmarshalStrict(b, &v); err != nil {
+		return Value{}, errors.Wrapf(err, "parse credentials file %s", p.conf.Path)
+	}
+	if err := validate(v); err != nil {
+		return Value{}, errors.Wrapf(err, "credentials file %s", p.conf.Path)
+	}
+	if p.conf.ReloadInterval > 0 {
+		if reload := p.now().Add(time.Duration(p.conf.ReloadInterval)); v.Expiration.IsZero() || reload.Before(v.Expiration) {
+			v.Expiration = reload
+		}
+	}
+	return v, nil
+}
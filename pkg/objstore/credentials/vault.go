@@ -0,0 +1,138 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+type vaultConfig struct {
+	// Address is the URL of the Vault server, e.g. https://vault:8200.
+	Address string `yaml:"address"`
+	Token   string `yaml:"token"`
+	// TokenFile is read before every request instead of Token, so that tokens renewed by an agent are picked up.
+	TokenFile string `yaml:"token_file"`
+	// Path is the path of the secret, e.g. aws/creds/thanos for the AWS secrets engine or secret/data/thanos for a
+	// version 2 key-value secret.
+	Path           string         `yaml:"path"`
+	AccessKeyField string         `yaml:"access_key_field"`
+	SecretKeyField string         `yaml:"secret_key_field"`
+	TokenField     string         `yaml:"token_field"`
+	Timeout        model.Duration `yaml:"timeout"`
+}
+
+var defaultVaultConfig = vaultConfig{
+	AccessKeyField: "access_key",
+	SecretKeyField: "secret_key",
+	TokenField:     "security_token",
+	Timeout:        model.Duration(10 * time.Second),
+}
+
+// vaultProvider provides credentials from a secret read from HashiCorp Vault, which expire with the lease of the
+// secret.
+type vaultProvider struct {
+	conf   vaultConfig
+	client *http.Client
+	now    func() time.Time
+}
+
+func newVaultProvider(conf []byte) (*vaultProvider, error) {
+	c := defaultVaultConfig
+	if err := yaml.UnmarshalStrict(conf, &c); err != nil {
+		return nil, err
+	}
+	if c.Address == "" {
+		return nil, errors.New("no Vault address configured")
+	}
+	if c.Path == "" {
+		return nil, errors.New("no Vault secret path configured")
+	}
+	if c.Token == "" && c.TokenFile == "" {
+		return nil, errors.New("no Vault token or token file configured")
+	}
+	return &vaultProvider{
+		conf:   c,
+		client: &http.Client{Timeout: time.Duration(c.Timeout)},
+		now:    time.Now,
+	}, nil
+}
+
+// vaultSecret is the response of Vault to reads of secrets.
+type vaultSecret struct {
+	LeaseDuration int64                  `json:"lease_duration"`
+	Data          map[string]interface{} `json:"data"`
+	Errors        []string               `json:"errors"`
+}
+
+func (p *vaultProvider) Retrieve(ctx context.Context) (_ Value, err error) {
+	token := p.conf.Token
+	if p.conf.TokenFile != "" {
+		b, err := ioutil.ReadFile(p.conf.TokenFile)
+		if err != nil {
+			return Value{}, errors.Wrap(err, "read Vault token file")
+		}
+		token = strings.TrimSpace(string(b))
+	}
+
+	u := fmt.Sprintf("%s/v1/%s", strings.TrimSuffix(p.conf.Address, "/"), strings.TrimPrefix(p.conf.Path, "/"))
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return Value{}, errors.Wrap(err, "create Vault request")
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	requested := p.now()
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return Value{}, errors.Wrapf(err, "read Vault secret %s", p.conf.Path)
+	}
+	defer runutil.ExhaustCloseWithErrCapture(&err, resp.Body, "Vault response body")
+
+	var secret vaultSecret
+	if resp.StatusCode != http.StatusOK {
+		// Errors are not necessarily returned by Vault itself, e.g. by proxies in front of it, so the body is only
+		// decoded on a best-effort basis.
+		if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil || len(secret.Errors) == 0 {
+			return Value{}, errors.Errorf("read Vault secret %s: status %d", p.conf.Path, resp.StatusCode)
+		}
+		return Value{}, errors.Errorf("read Vault secret %s: status %d: %s", p.conf.Path, resp.StatusCode, strings.Join(secret.Errors, ", "))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return Value{}, errors.Wrapf(err, "decode Vault secret %s", p.conf.Path)
+	}
+
+	data := secret.Data
+	// Version 2 key-value secrets nest their data along with its metadata.
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	field := func(name string) string {
+		s, _ := data[name].(string)
+		return s
+	}
+	v := Value{
+		AccessKey: field(p.conf.AccessKeyField),
+		SecretKey: field(p.conf.SecretKeyField),
+		Token:     field(p.conf.TokenField),
+	}
+	if err := validate(v); err != nil {
+		return Value{}, errors.Wrapf(err, "Vault secret %s", p.conf.Path)
+	}
+	if secret.LeaseDuration > 0 {
+		v.Expiration = requested.Add(time.Duration(secret.LeaseDuration) * time.Second)
+	}
+	return v, nil
+}
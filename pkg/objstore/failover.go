@@ -0,0 +1,156 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// BucketReaderWithFailover returns a bucket reader reading from the primary bucket and failing over to the
+// secondary bucket, e.g. a read replica of the primary bucket, for every operation failing against the primary.
+// Objects not found in the primary bucket are not looked up in the secondary one. Errors while reading an object
+// after it was opened are not failed over.
+func BucketReaderWithFailover(primary, secondary BucketReader, reg prometheus.Registerer) BucketReader {
+	b := &failoverBucketReader{
+		primary:   primary,
+		secondary: secondary,
+		failovers: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_objstore_bucket_failovers_total",
+			Help: "Total number of operations that failed against the primary bucket and were run against the secondary bucket.",
+		}, []string{"operation"}),
+	}
+	for _, op := range []string{iterOp, iterAttrOp, sizeOp, attrOp, getOp, getRangeOp, existsOp} {
+		b.failovers.WithLabelValues(op)
+	}
+	return b
+}
+
+type failoverBucketReader struct {
+	primary, secondary BucketReader
+
+	failovers *prometheus.CounterVec
+}
+
+// failover returns true if the operation failed against the primary bucket with the given error has to be
+// run against the secondary bucket.
+func (b *failoverBucketReader) failover(op string, err error) bool {
+	if err == nil || b.primary.IsObjNotFoundErr(err) {
+		return false
+	}
+	b.failovers.WithLabelValues(op).Inc()
+	return true
+}
+
+// Iter lists the whole directory before calling f, so that a listing failing halfway through against the
+// primary bucket does not call f twice for the same entries.
+func (b *failoverBucketReader) Iter(ctx context.Context, dir string, f func(name string) error, options ...IterOption) error {
+	var names []string
+	collect := func(name string) error {
+		names = append(names, name)
+		return nil
+	}
+	if err := b.primary.Iter(ctx, dir, collect, options...); b.failover(iterOp, err) {
+		names = names[:0]
+		if err := b.secondary.Iter(ctx, dir, collect, options...); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		if err := f(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *failoverBucketReader) IterWithAttributes(ctx context.Context, dir string, f func(name string, attrs ObjectAttributes) error, options ...IterOption) error {
+	var (
+		names []string
+		attrs []ObjectAttributes
+	)
+	collect := func(name string, a ObjectAttributes) error {
+		names = append(names, name)
+		attrs = append(attrs, a)
+		return nil
+	}
+	if err := IterWithAttributes(ctx, b.primary, dir, collect, options...); b.failover(iterAttrOp, err) {
+		names, attrs = names[:0], attrs[:0]
+		if err := IterWithAttributes(ctx, b.secondary, dir, collect, options...); err != nil {
+			return err
+		}
+	}
+
+	for i, name := range names {
+		if err := f(name, attrs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *failoverBucketReader) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, err := b.primary.Get(ctx, name)
+	if b.failover(getOp, err) {
+		return b.secondary.Get(ctx, name)
+	}
+	return rc, err
+}
+
+func (b *failoverBucketReader) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	rc, err := b.primary.GetRange(ctx, name, off, length)
+	if b.failover(getRangeOp, err) {
+		return b.secondary.GetRange(ctx, name, off, length)
+	}
+	return rc, err
+}
+
+func (b *failoverBucketReader) Exists(ctx context.Context, name string) (bool, error) {
+	ok, err := b.primary.Exists(ctx, name)
+	if b.failover(existsOp, err) {
+		return b.secondary.Exists(ctx, name)
+	}
+	return ok, err
+}
+
+func (b *failoverBucketReader) ObjectSize(ctx context.Context, name string) (uint64, error) {
+	size, err := b.primary.ObjectSize(ctx, name)
+	if b.failover(sizeOp, err) {
+		return b.secondary.ObjectSize(ctx, name)
+	}
+	return size, err
+}
+
+func (b *failoverBucketReader) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	attrs, err := b.primary.Attributes(ctx, name)
+	if b.failover(attrOp, err) {
+		return b.secondary.Attributes(ctx, name)
+	}
+	return attrs, err
+}
+
+// SupportedOperations returns the operations supported by both buckets, as every operation may fail over.
+func (b *failoverBucketReader) SupportedOperations() []Operation {
+	secondary := map[Operation]struct{}{}
+	for _, op := range SupportedOperations(b.secondary) {
+		secondary[op] = struct{}{}
+	}
+	var ops []Operation
+	for _, op := range SupportedOperations(b.primary) {
+		if _, ok := secondary[op]; ok {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// IsObjNotFoundErr returns true if the error means that the object is not found in either bucket, as the error
+// may come from any of them.
+func (b *failoverBucketReader) IsObjNotFoundErr(err error) bool {
+	return b.primary.IsObjNotFoundErr(err) || b.secondary.IsObjNotFoundErr(err)
+}
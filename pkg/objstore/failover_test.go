@@ -0,0 +1,98 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestBucketReaderWithFailover(t *testing.T) {
+	ctx := context.Background()
+
+	primaryInner := inmem.NewBucket()
+	testutil.Ok(t, primaryInner.Upload(ctx, "a/obj", bytes.NewReader([]byte("primary"))))
+	primary, err := objstore.NewFaultyBucket(primaryInner)
+	testutil.Ok(t, err)
+
+	secondary := inmem.NewBucket()
+	testutil.Ok(t, secondary.Upload(ctx, "a/obj", bytes.NewReader([]byte("secondary"))))
+	testutil.Ok(t, secondary.Upload(ctx, "b/obj", bytes.NewReader([]byte("secondary"))))
+
+	reg := prometheus.NewRegistry()
+	bkt := objstore.BucketReaderWithFailover(primary, secondary, reg)
+
+	read := func(t *testing.T, name string) string {
+		t.Helper()
+		rc, err := bkt.Get(ctx, name)
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, rc.Close()) }()
+		b, err := ioutil.ReadAll(rc)
+		testutil.Ok(t, err)
+		return string(b)
+	}
+	iter := func(t *testing.T) []string {
+		t.Helper()
+		var names []string
+		testutil.Ok(t, bkt.Iter(ctx, "", func(name string) error {
+			names = append(names, name)
+			return nil
+		}))
+		return names
+	}
+
+	// A healthy primary bucket serves all reads, objects missing in it are not read from the secondary bucket.
+	testutil.Equals(t, "primary", read(t, "a/obj"))
+	testutil.Equals(t, []string{"a/"}, iter(t))
+	_, err = bkt.Get(ctx, "b/obj")
+	testutil.NotOk(t, err)
+	testutil.Assert(t, bkt.IsObjNotFoundErr(err), "not found error expected, got %v", err)
+	ok, err := bkt.Exists(ctx, "b/obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "object should not exist in the primary bucket")
+
+	testutil.Ok(t, primary.SetRules(objstore.FaultRule{ErrorRate: 1}))
+
+	testutil.Equals(t, "secondary", read(t, "a/obj"))
+	testutil.Equals(t, []string{"a/", "b/"}, iter(t))
+	rc, err := bkt.GetRange(ctx, "a/obj", 2, 3)
+	testutil.Ok(t, err)
+	b, err := ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "con", string(b))
+	ok, err = bkt.Exists(ctx, "b/obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "object should exist in the secondary bucket")
+	size, err := bkt.ObjectSize(ctx, "a/obj")
+	testutil.Ok(t, err)
+	testutil.Equals(t, uint64(len("secondary")), size)
+
+	// Not found errors of the primary bucket are not failed over.
+	testutil.Ok(t, primary.SetRules(objstore.FaultRule{ErrorRate: 1, Fault: objstore.FaultNotFound}))
+	_, err = bkt.Get(ctx, "a/obj")
+	testutil.NotOk(t, err)
+	testutil.Assert(t, bkt.IsObjNotFoundErr(err), "not found error expected, got %v", err)
+
+	testutil.Ok(t, promtest.GatherAndCompare(reg, strings.NewReader(`
+		# HELP thanos_objstore_bucket_failovers_total Total number of operations that failed against the primary bucket and were run against the secondary bucket.
+		# TYPE thanos_objstore_bucket_failovers_total counter
+		thanos_objstore_bucket_failovers_total{operation="attributes"} 0
+		thanos_objstore_bucket_failovers_total{operation="exists"} 1
+		thanos_objstore_bucket_failovers_total{operation="get"} 1
+		thanos_objstore_bucket_failovers_total{operation="get_range"} 1
+		thanos_objstore_bucket_failovers_total{operation="iter"} 1
+		thanos_objstore_bucket_failovers_total{operation="iter_with_attributes"} 0
+		thanos_objstore_bucket_failovers_total{operation="objectsize"} 1
+	`), "thanos_objstore_bucket_failovers_total"))
+}
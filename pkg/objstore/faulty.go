@@ -0,0 +1,284 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Fault is the kind of error injected by a FaultyBucket.
+type Fault int
+
+const (
+	// FaultError fails operations with ErrInjected.
+	FaultError Fault = iota
+	// FaultThrottled fails operations with ErrThrottled, like a provider rate limiting requests.
+	FaultThrottled
+	// FaultTimeout fails operations with context.DeadlineExceeded, like a request timing out.
+	FaultTimeout
+	// FaultNotFound fails operations with an error the bucket's IsObjNotFoundErr reports as not found.
+	FaultNotFound
+)
+
+var (
+	// ErrInjected is the error of operations failed by a FaultyBucket with FaultError.
+	ErrInjected = errors.New("injected fault")
+	// ErrThrottled is the error of operations failed by a FaultyBucket with FaultThrottled.
+	ErrThrottled = errors.New("injected fault: request throttled")
+
+	errInjectedNotFound = errors.New("injected fault: object not found")
+)
+
+var faultOps = map[string]struct{}{
+	iterOp: {}, iterAttrOp: {}, sizeOp: {}, attrOp: {}, getOp: {}, getRangeOp: {}, existsOp: {}, uploadOp: {}, uploadIfOp: {}, deleteOp: {}, deleteMultipleOp: {}, copyOp: {},
+}
+
+// FaultRule selects operations against a FaultyBucket and the latency and faults injected into them.
+type FaultRule struct {
+	// Operations the rule applies to, by the operation names used in the bucket metrics: iter, iter_with_attributes,
+	// objectsize, attributes, get, get_range, exists, upload, upload_if, delete, delete_multiple and copy. The rule applies
+	// to all operations if empty. Faults of batched deletes are injected for every object, faults of copies for the
+	// destination object.
+	Operations []string
+	// Prefix of the object names, or directories for iterations, the rule applies to. The rule applies to all objects if empty.
+	Prefix string
+
+	// Latency is added to the operations before they run, or fail.
+	Latency time.Duration
+	// ErrorRate is the probability between 0 and 1 of an operation to fail with the Fault.
+	ErrorRate float64
+	// Fault is the kind of error failing operations return.
+	Fault Fault
+}
+
+func (r FaultRule) applies(op, name string) bool {
+	if !strings.HasPrefix(name, r.Prefix) {
+		return false
+	}
+	if len(r.Operations) == 0 {
+		return true
+	}
+	for _, o := range r.Operations {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// FaultyBucket is a bucket injecting latency and errors into the operations against the wrapped bucket
+// according to rules. It is meant for testing components against failures of the object storage.
+// Faults are injected before the operation is run against the wrapped bucket, so failed writes have no effect.
+type FaultyBucket struct {
+	bkt Bucket
+
+	mtx   sync.Mutex
+	rules []FaultRule
+	rand  *rand.Rand
+}
+
+// NewFaultyBucket returns a bucket wrapping the given bucket and injecting latency and errors into its
+// operations according to the given rules. For every operation, the first rule applying to it is used.
+func NewFaultyBucket(bkt Bucket, rules ...FaultRule) (*FaultyBucket, error) {
+	b := &FaultyBucket{bkt: bkt, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	if err := b.SetRules(rules...); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// SetRules replaces the rules of the bucket, e.g. to start failing operations in the middle of a test.
+func (b *FaultyBucket) SetRules(rules ...FaultRule) error {
+	for i, r := range rules {
+		for _, op := range r.Operations {
+			if _, ok := faultOps[op]; !ok {
+				return errors.Errorf("rule %d: unknown operation %q", i, op)
+			}
+		}
+		if r.ErrorRate < 0 || r.ErrorRate > 1 {
+			return errors.Errorf("rule %d: error rate %v is not between 0 and 1", i, r.ErrorRate)
+		}
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.rules = rules
+	return nil
+}
+
+// inject waits for the latency of the rule applying to the given operation and returns the injected error, if any.
+func (b *FaultyBucket) inject(ctx context.Context, op, name string) error {
+	b.mtx.Lock()
+	var (
+		rule  FaultRule
+		found bool
+	)
+	for _, r := range b.rules {
+		if r.applies(op, name) {
+			rule, found = r, true
+			break
+		}
+	}
+	fail := found && b.rand.Float64() < rule.ErrorRate
+	b.mtx.Unlock()
+
+	if !found {
+		return nil
+	}
+	if rule.Latency > 0 {
+		select {
+		case <-time.After(rule.Latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if !fail {
+		return nil
+	}
+
+	switch rule.Fault {
+	case FaultThrottled:
+		return errors.Wrapf(ErrThrottled, "%s %s", op, name)
+	case FaultTimeout:
+		return errors.Wrapf(context.DeadlineExceeded, "injected fault: %s %s", op, name)
+	case FaultNotFound:
+		return errors.Wrapf(errInjectedNotFound, "%s %s", op, name)
+	default:
+		return errors.Wrapf(ErrInjected, "%s %s", op, name)
+	}
+}
+
+func (b *FaultyBucket) Iter(ctx context.Context, dir string, f func(name string) error, options ...IterOption) error {
+	if err := b.inject(ctx, iterOp, dir); err != nil {
+		return err
+	}
+	return b.bkt.Iter(ctx, dir, f, options...)
+}
+
+func (b *FaultyBucket) IterWithAttributes(ctx context.Context, dir string, f func(name string, attrs ObjectAttributes) error, options ...IterOption) error {
+	if err := b.inject(ctx, iterAttrOp, dir); err != nil {
+		return err
+	}
+	return IterWithAttributes(ctx, b.bkt, dir, f, options...)
+}
+
+func (b *FaultyBucket) ObjectSize(ctx context.Context, name string) (uint64, error) {
+	if err := b.inject(ctx, sizeOp, name); err != nil {
+		return 0, err
+	}
+	return b.bkt.ObjectSize(ctx, name)
+}
+
+func (b *FaultyBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	if err := b.inject(ctx, attrOp, name); err != nil {
+		return ObjectAttributes{}, err
+	}
+	return b.bkt.Attributes(ctx, name)
+}
+
+func (b *FaultyBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.inject(ctx, getOp, name); err != nil {
+		return nil, err
+	}
+	return b.bkt.Get(ctx, name)
+}
+
+func (b *FaultyBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := b.inject(ctx, getRangeOp, name); err != nil {
+		return nil, err
+	}
+	return b.bkt.GetRange(ctx, name, off, length)
+}
+
+func (b *FaultyBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.inject(ctx, existsOp, name); err != nil {
+		return false, err
+	}
+	return b.bkt.Exists(ctx, name)
+}
+
+func (b *FaultyBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.inject(ctx, uploadOp, name); err != nil {
+		return err
+	}
+	return b.bkt.Upload(ctx, name, r)
+}
+
+func (b *FaultyBucket) UploadIf(ctx context.Context, name string, r io.Reader, cond UploadCondition) error {
+	if err := b.inject(ctx, uploadIfOp, name); err != nil {
+		return err
+	}
+	return UploadIf(ctx, b.bkt, name, r, cond)
+}
+
+func (b *FaultyBucket) UploadWithMetadata(ctx context.Context, name string, r io.Reader, md ObjectMetadata) error {
+	if err := b.inject(ctx, uploadOp, name); err != nil {
+		return err
+	}
+	return UploadWithMetadata(ctx, b.bkt, name, r, md)
+}
+
+func (b *FaultyBucket) Delete(ctx context.Context, name string) error {
+	if err := b.inject(ctx, deleteOp, name); err != nil {
+		return err
+	}
+	return b.bkt.Delete(ctx, name)
+}
+
+// DeleteMultiple deletes the objects without injected faults from the wrapped bucket, failing the deletion of the others.
+func (b *FaultyBucket) DeleteMultiple(ctx context.Context, names []string) error {
+	errs := map[string]error{}
+	remaining := make([]string, 0, len(names))
+	for _, name := range names {
+		if err := b.inject(ctx, deleteMultipleOp, name); err != nil {
+			errs[name] = err
+			continue
+		}
+		remaining = append(remaining, name)
+	}
+
+	err := DeleteMultiple(ctx, b.bkt, remaining)
+	if len(errs) == 0 {
+		return err
+	}
+	if derr, ok := err.(*DeleteMultipleError); ok {
+		for name, err := range derr.Errs {
+			errs[name] = err
+		}
+	} else if err != nil {
+		return err
+	}
+	return &DeleteMultipleError{Errs: errs}
+}
+
+func (b *FaultyBucket) Copy(ctx context.Context, src, dst string) error {
+	if err := b.inject(ctx, copyOp, dst); err != nil {
+		return err
+	}
+	return Copy(ctx, b.bkt, src, dst)
+}
+
+// IsObjNotFoundErr returns true for errors injected with FaultNotFound and for not found errors of the wrapped bucket.
+func (b *FaultyBucket) IsObjNotFoundErr(err error) bool {
+	return errors.Cause(err) == errInjectedNotFound || b.bkt.IsObjNotFoundErr(err)
+}
+
+func (b *FaultyBucket) Close() error {
+	return b.bkt.Close()
+}
+
+func (b *FaultyBucket) Name() string {
+	return b.bkt.Name()
+}
+
+func (b *FaultyBucket) SupportedOperations() []Operation {
+	return SupportedOperations(b.bkt)
+}
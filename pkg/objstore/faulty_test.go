@@ -0,0 +1,117 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestFaultyBucket(t *testing.T) {
+	ctx := context.Background()
+
+	newBucket := func(t *testing.T, rules ...objstore.FaultRule) *objstore.FaultyBucket {
+		inner := inmem.NewBucket()
+		testutil.Ok(t, inner.Upload(ctx, "a/obj", bytes.NewReader([]byte("content"))))
+		testutil.Ok(t, inner.Upload(ctx, "b/obj", bytes.NewReader([]byte("content"))))
+		bkt, err := objstore.NewFaultyBucket(inner, rules...)
+		testutil.Ok(t, err)
+		return bkt
+	}
+
+	t.Run("no rules", func(t *testing.T) {
+		bkt := newBucket(t)
+		ok, err := bkt.Exists(ctx, "a/obj")
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "object should exist")
+
+		_, err = bkt.Get(ctx, "a/missing")
+		testutil.NotOk(t, err)
+		testutil.Assert(t, bkt.IsObjNotFoundErr(err), "not found errors of the wrapped bucket should be reported")
+	})
+
+	t.Run("faults", func(t *testing.T) {
+		for _, tcase := range []struct {
+			fault objstore.Fault
+			check func(bkt *objstore.FaultyBucket, err error) bool
+		}{
+			{fault: objstore.FaultError, check: func(_ *objstore.FaultyBucket, err error) bool { return errors.Cause(err) == objstore.ErrInjected }},
+			{fault: objstore.FaultThrottled, check: func(_ *objstore.FaultyBucket, err error) bool { return errors.Cause(err) == objstore.ErrThrottled }},
+			{fault: objstore.FaultTimeout, check: func(_ *objstore.FaultyBucket, err error) bool { return errors.Cause(err) == context.DeadlineExceeded }},
+			{fault: objstore.FaultNotFound, check: func(bkt *objstore.FaultyBucket, err error) bool { return bkt.IsObjNotFoundErr(err) }},
+		} {
+			bkt := newBucket(t, objstore.FaultRule{ErrorRate: 1, Fault: tcase.fault})
+			_, err := bkt.Get(ctx, "a/obj")
+			testutil.NotOk(t, err)
+			testutil.Assert(t, tcase.check(bkt, err), "unexpected error for fault %d: %v", tcase.fault, err)
+			if tcase.fault != objstore.FaultNotFound {
+				testutil.Assert(t, !bkt.IsObjNotFoundErr(err), "fault %d should not be reported as not found", tcase.fault)
+			}
+		}
+	})
+
+	t.Run("rules select operations and objects", func(t *testing.T) {
+		bkt := newBucket(t,
+			objstore.FaultRule{Operations: []string{"get", "upload"}, Prefix: "a/", ErrorRate: 1, Fault: objstore.FaultThrottled},
+			// Not used for gets of a/, the first rule applying to an operation is used.
+			objstore.FaultRule{Prefix: "a/", ErrorRate: 1},
+		)
+		_, err := bkt.Get(ctx, "a/obj")
+		testutil.Equals(t, objstore.ErrThrottled, errors.Cause(err))
+		_, err = bkt.Exists(ctx, "a/obj")
+		testutil.Equals(t, objstore.ErrInjected, errors.Cause(err))
+
+		rc, err := bkt.Get(ctx, "b/obj")
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+
+		// Failed writes have no effect.
+		testutil.NotOk(t, bkt.Upload(ctx, "a/new", bytes.NewReader([]byte("content"))))
+		testutil.Ok(t, bkt.SetRules())
+		ok, err := bkt.Exists(ctx, "a/new")
+		testutil.Ok(t, err)
+		testutil.Assert(t, !ok, "failed upload should not create the object")
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		bkt := newBucket(t, objstore.FaultRule{Operations: []string{"exists"}, Latency: 100 * time.Millisecond})
+
+		start := time.Now()
+		ok, err := bkt.Exists(ctx, "a/obj")
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "object should exist")
+		testutil.Assert(t, time.Since(start) >= 100*time.Millisecond, "operation should be delayed")
+
+		// Delayed operations fail once their context is done.
+		tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err = bkt.Exists(tctx, "a/obj")
+		testutil.Equals(t, context.DeadlineExceeded, errors.Cause(err))
+	})
+
+	t.Run("error rate", func(t *testing.T) {
+		bkt := newBucket(t, objstore.FaultRule{ErrorRate: 0.5})
+		failed := 0
+		for i := 0; i < 1000; i++ {
+			if _, err := bkt.Exists(ctx, "a/obj"); err != nil {
+				failed++
+			}
+		}
+		testutil.Assert(t, failed > 350 && failed < 650, "expected about half of the operations to fail, got %d", failed)
+	})
+
+	t.Run("invalid rules", func(t *testing.T) {
+		_, err := objstore.NewFaultyBucket(inmem.NewBucket(), objstore.FaultRule{Operations: []string{"list"}})
+		testutil.NotOk(t, err)
+		_, err = objstore.NewFaultyBucket(inmem.NewBucket(), objstore.FaultRule{ErrorRate: 1.5})
+		testutil.NotOk(t, err)
+	})
+}
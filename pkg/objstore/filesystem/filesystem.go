@@ -4,12 +4,16 @@
 package filesystem
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"regexp"
+	"time"
 
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"gopkg.in/yaml.v2"
@@ -19,16 +23,39 @@ import (
 	"github.com/pkg/errors"
 )
 
+const (
+	// tmpPrefix starts the names of the hidden files objects are written to in their directory before they are
+	// renamed into place, so that readers never observe partially written objects.
+	tmpPrefix = ".thanos-upload-"
+	// staleTmpAge is the age after which temporary files are considered left behind by interrupted uploads.
+	// Younger ones may belong to uploads of other processes sharing the directory.
+	staleTmpAge = time.Minute
+)
+
+// tmpFileRegexp matches the reserved names of temporary files of uploads: the prefix, 16 random hex digits and
+// the .tmp extension.
+var tmpFileRegexp = regexp.MustCompile(`^` + regexp.QuoteMeta(tmpPrefix) + `[0-9a-f]{16}\.tmp$`)
+
 // Config stores the configuration for storing and accessing blobs in filesystem.
 type Config struct {
 	Directory string `yaml:"directory"`
+	// Fsync makes uploads fsync the written object before renaming it into place.
+	Fsync bool `yaml:"fsync"`
+	// FsyncDirectory makes uploads fsync the directory of the object after renaming it into place.
+	FsyncDirectory bool `yaml:"fsync_directory"`
+	// Mmap makes range reads read from memory mapped pages of the object instead of copying them with regular
+	// reads, falling back to regular reads if the range cannot be mapped.
+	Mmap bool `yaml:"mmap"`
 }
 
 // Bucket implements the objstore.Bucket interfaces against filesystem that binary runs on.
 // Methods from Bucket interface are thread-safe. Objects are assumed to be immutable.
 // NOTE: It does not follow symbolic links.
 type Bucket struct {
-	rootDir string
+	rootDir  string
+	fsync    bool
+	fsyncDir bool
+	mmap     bool
 }
 
 // NewBucketFromConfig returns a new filesystem.Bucket from config.
@@ -40,21 +67,60 @@ func NewBucketFromConfig(conf []byte) (*Bucket, error) {
 	if c.Directory == "" {
 		return nil, errors.New("missing directory for filesystem bucket")
 	}
-	return NewBucket(c.Directory)
+	return NewBucketWithConfig(c)
 }
 
 // NewBucket returns a new filesystem.Bucket.
 func NewBucket(rootDir string) (*Bucket, error) {
-	absDir, err := filepath.Abs(rootDir)
+	return NewBucketWithConfig(Config{Directory: rootDir})
+}
+
+// NewBucketWithConfig returns a new filesystem.Bucket using the provided config. Temporary files left behind by
+// uploads interrupted by a crash are removed.
+func NewBucketWithConfig(c Config) (*Bucket, error) {
+	absDir, err := filepath.Abs(c.Directory)
 	if err != nil {
 		return nil, err
 	}
-	return &Bucket{rootDir: absDir}, nil
+	if err := removeStaleTempFiles(absDir, time.Now().Add(-staleTmpAge)); err != nil {
+		return nil, errors.Wrapf(err, "remove temporary files of interrupted uploads in %s", absDir)
+	}
+	return &Bucket{rootDir: absDir, fsync: c.Fsync, fsyncDir: c.FsyncDirectory, mmap: c.Mmap}, nil
+}
+
+// removeStaleTempFiles removes the temporary files of uploads below the given directory last modified before the
+// given time.
+func removeStaleTempFiles(dir string, before time.Time) error {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || !isTempFile(info.Name()) || !info.ModTime().Before(before) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+	return err
 }
 
 // Iter calls f for each entry in the given directory. The argument to f is the full
 // object name including the prefix of the inspected directory.
-func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	return b.IterWithAttributes(ctx, dir, func(name string, _ objstore.ObjectAttributes) error {
+		return f(name)
+	}, options...)
+}
+
+// IterWithAttributes calls f for each entry in the given directory with the entry's attributes.
+// The argument to f is the full object name including the prefix of the inspected directory.
+// Recursive listings walk all subdirectories.
+func (b *Bucket) IterWithAttributes(ctx context.Context, dir string, f func(string, objstore.ObjectAttributes) error, options ...objstore.IterOption) error {
 	absDir := filepath.Join(b.rootDir, dir)
 	info, err := os.Stat(absDir)
 	if err != nil {
@@ -71,22 +137,36 @@ func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error) err
 	if err != nil {
 		return err
 	}
+	params := objstore.ApplyIterOptions(options...)
 	for _, file := range files {
+		if !file.IsDir() && isTempFile(file.Name()) {
+			// Skip objects being uploaded, or left behind by interrupted uploads.
+			continue
+		}
 		name := filepath.Join(dir, file.Name())
 
+		var attrs objstore.ObjectAttributes
+		if file.IsDir() && params.Recursive {
+			if err := b.IterWithAttributes(ctx, name, f, options...); err != nil {
+				return err
+			}
+			continue
+		}
 		if file.IsDir() {
-			empty, err := isDirEmpty(filepath.Join(absDir, file.Name()))
+			ok, err := containsObjects(filepath.Join(absDir, file.Name()))
 			if err != nil {
 				return err
 			}
 
-			if empty {
+			if !ok {
 				// Skip empty directories.
 				continue
 			}
 			name += objstore.DirDelim
+		} else {
+			attrs = fileAttributes(file)
 		}
-		if err := f(name); err != nil {
+		if err := f(name, attrs); err != nil {
 			return err
 		}
 	}
@@ -107,6 +187,21 @@ func (r *rangeReaderCloser) Close() error {
 	return r.f.Close()
 }
 
+// mmapReaderCloser reads a range of an object from its memory mapped pages, which are unmapped on close.
+type mmapReaderCloser struct {
+	*bytes.Reader
+	b []byte
+}
+
+func (r *mmapReaderCloser) Close() error {
+	if r.b == nil {
+		return nil
+	}
+	err := munmap(r.b)
+	r.b = nil
+	return err
+}
+
 // ObjectSize returns the size of the specified object.
 func (b *Bucket) ObjectSize(_ context.Context, name string) (uint64, error) {
 	file := filepath.Join(b.rootDir, name)
@@ -117,6 +212,23 @@ func (b *Bucket) ObjectSize(_ context.Context, name string) (uint64, error) {
 	return uint64(st.Size()), nil
 }
 
+// Attributes returns the attributes of the specified object.
+func (b *Bucket) Attributes(_ context.Context, name string) (objstore.ObjectAttributes, error) {
+	file := filepath.Join(b.rootDir, name)
+	st, err := os.Stat(file)
+	if err != nil {
+		return objstore.ObjectAttributes{}, errors.Wrapf(err, "stat %s", file)
+	}
+	return fileAttributes(st), nil
+}
+
+func fileAttributes(fi os.FileInfo) objstore.ObjectAttributes {
+	return objstore.ObjectAttributes{
+		Size:         fi.Size(),
+		LastModified: fi.ModTime(),
+	}
+}
+
 // GetRange returns a new range reader for the given object name and range.
 func (b *Bucket) GetRange(_ context.Context, name string, off, length int64) (io.ReadCloser, error) {
 	if name == "" {
@@ -124,10 +236,18 @@ func (b *Bucket) GetRange(_ context.Context, name string, off, length int64) (io
 	}
 
 	file := filepath.Join(b.rootDir, name)
-	if _, err := os.Stat(file); err != nil {
+	info, err := os.Stat(file)
+	if err != nil {
 		return nil, errors.Wrapf(err, "stat %s", file)
 	}
 
+	if b.mmap && off >= 0 && length >= 0 {
+		// Ranges that cannot be mapped are read regularly.
+		if r, err := mmapRange(file, info.Size(), off, length); err == nil {
+			return r, nil
+		}
+	}
+
 	f, err := os.OpenFile(file, os.O_RDONLY, 0666)
 	if err != nil {
 		return nil, err
@@ -147,6 +267,35 @@ func (b *Bucket) GetRange(_ context.Context, name string, off, length int64) (io
 	return &rangeReaderCloser{Reader: io.LimitReader(f, length), f: f}, nil
 }
 
+// mmapRange returns a reader of the given range of the file of the given size, reading from its memory mapped
+// pages. Only the pages of the range are mapped. Ranges past the end of the file are cut at the end of the file.
+func mmapRange(file string, size, off, length int64) (io.ReadCloser, error) {
+	end := off + length
+	if end > size {
+		end = size
+	}
+	if off >= end {
+		return &mmapReaderCloser{Reader: bytes.NewReader(nil)}, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pageOff := off - off%int64(os.Getpagesize())
+	b, err := mmap(f, pageOff, int(end-pageOff))
+	// The mapping stays valid once the file is closed.
+	if cerr := f.Close(); err == nil && cerr != nil {
+		_ = munmap(b)
+		err = cerr
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "mmap %s", file)
+	}
+	return &mmapReaderCloser{Reader: bytes.NewReader(b[off-pageOff:]), b: b}, nil
+}
+
 // Exists checks if the given directory exists in memory.
 func (b *Bucket) Exists(_ context.Context, name string) (bool, error) {
 	info, err := os.Stat(filepath.Join(b.rootDir, name))
@@ -160,24 +309,128 @@ func (b *Bucket) Exists(_ context.Context, name string) (bool, error) {
 }
 
 // Upload writes the file specified in src to into the memory.
-func (b *Bucket) Upload(_ context.Context, name string, r io.Reader) (err error) {
+// The object is written to a temporary file first and renamed into place once complete,
+// so that readers never observe partially written objects.
+func (b *Bucket) Upload(_ context.Context, name string, r io.Reader) error {
+	return b.upload(name, r, func(tmp, file string) error {
+		return errors.Wrapf(os.Rename(tmp, file), "rename %s to %s", tmp, file)
+	})
+}
+
+// UploadIf writes the file specified in src to rootDir/dst if the given condition is met.
+// Only the IfNotExists condition is supported, as files have no versions.
+func (b *Bucket) UploadIf(ctx context.Context, name string, r io.Reader, cond objstore.UploadCondition) error {
+	if cond.IfMatch != "" {
+		return errors.Wrap(objstore.ErrConditionalUploadNotSupported, "filesystem: upload if match")
+	}
+	if !cond.IfNotExists {
+		return b.Upload(ctx, name, r)
+	}
+	// Unlike renames, links fail if the file exists.
+	return b.upload(name, r, func(tmp, file string) error {
+		if err := os.Link(tmp, file); err != nil {
+			if os.IsExist(err) {
+				return errors.Wrapf(objstore.ErrPreconditionFailed, "file %s exists", file)
+			}
+			return errors.Wrapf(err, "link %s to %s", tmp, file)
+		}
+		return errors.Wrapf(os.Remove(tmp), "remove %s", tmp)
+	})
+}
+
+// upload writes r into a temporary file next to the object with the given name and puts it in place of the object.
+// The temporary file is removed if the upload fails.
+func (b *Bucket) upload(name string, r io.Reader, place func(tmp, file string) error) (err error) {
 	file := filepath.Join(b.rootDir, name)
 	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
 		return err
 	}
 
-	f, err := os.Create(file)
+	f, err := createTemp(filepath.Dir(file))
 	if err != nil {
 		return err
 	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp)
+		}
+	}()
+
+	if err := b.write(f, r); err != nil {
+		return errors.Wrapf(err, "write to %s", tmp)
+	}
+	if err := place(tmp, file); err != nil {
+		return err
+	}
+	if b.fsyncDir {
+		return errors.Wrapf(fsyncDir(filepath.Dir(file)), "fsync directory of %s", file)
+	}
+	return nil
+}
+
+// write copies r into the given file and closes it, syncing it to disk first if configured.
+func (b *Bucket) write(f *os.File, r io.Reader) (err error) {
 	defer runutil.CloseWithErrCapture(&err, f, "close")
 
 	if _, err := io.Copy(f, r); err != nil {
-		return errors.Wrapf(err, "copy to %s", file)
+		return err
+	}
+	if b.fsync {
+		return f.Sync()
 	}
 	return nil
 }
 
+// createTemp creates a new temporary file of an upload with a random name in the given directory.
+// Unlike ioutil.TempFile it creates the file with the same permissions as os.Create.
+func createTemp(dir string) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%s%016x.tmp", tmpPrefix, rand.Uint64())), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+}
+
+func fsyncDir(dir string) (err error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer runutil.CloseWithErrCapture(&err, f, "close dir")
+
+	return f.Sync()
+}
+
+// isTempFile returns true if the given file name is the reserved name of a temporary file of an upload.
+func isTempFile(name string) bool {
+	return tmpFileRegexp.MatchString(name)
+}
+
+// containsObjects returns true if the given directory or any directory below it contains anything but temporary
+// files of uploads.
+func containsObjects(dir string) (bool, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		if !file.IsDir() && isTempFile(file.Name()) {
+			continue
+		}
+		if !file.IsDir() {
+			return true, nil
+		}
+		ok, err := containsObjects(filepath.Join(dir, file.Name()))
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
 func isDirEmpty(name string) (ok bool, err error) {
 	f, err := os.Open(name)
 	if err != nil {
@@ -221,3 +474,12 @@ func (b *Bucket) Close() error { return nil }
 func (b *Bucket) Name() string {
 	return fmt.Sprintf("fs: %s", b.rootDir)
 }
+
+// SupportedOperations returns the optional operations supported by the bucket. Uploads cannot be conditioned on the
+// version of the object, as files have none.
+func (b *Bucket) SupportedOperations() []objstore.Operation {
+	return []objstore.Operation{
+		objstore.OpUploadIfNotExists,
+		objstore.OpIterWithAttributes,
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestNewBucketFromConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesystem-bucket")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	b, err := NewBucketFromConfig([]byte("directory: " + dir + "\nfsync: true\nfsync_directory: true\n"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, dir, b.rootDir)
+	testutil.Assert(t, b.fsync, "fsync should be enabled")
+	testutil.Assert(t, b.fsyncDir, "fsync of directories should be enabled")
+
+	_, err = NewBucketFromConfig([]byte("fsync: true"))
+	testutil.NotOk(t, err)
+}
+
+func TestBucket_Upload(t *testing.T) {
+	for _, c := range []Config{
+		{},
+		{Fsync: true, FsyncDirectory: true},
+	} {
+		t.Run("", func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "filesystem-bucket")
+			testutil.Ok(t, err)
+			defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+			ctx := context.Background()
+			c.Directory = dir
+			b, err := NewBucketWithConfig(c)
+			testutil.Ok(t, err)
+
+			// Start an upload and stop writing half the way through.
+			pr, pw := io.Pipe()
+			uploaded := make(chan error)
+			go func() {
+				uploaded <- b.Upload(ctx, "a/b/obj", pr)
+			}()
+			_, err = pw.Write([]byte("first half "))
+			testutil.Ok(t, err)
+
+			ok, err := b.Exists(ctx, "a/b/obj")
+			testutil.Ok(t, err)
+			testutil.Assert(t, !ok, "partially written object should not exist")
+			_, err = b.Get(ctx, "a/b/obj")
+			testutil.Assert(t, b.IsObjNotFoundErr(err), "partially written object should not be found, got %v", err)
+
+			var names []string
+			testutil.Ok(t, b.Iter(ctx, "", func(name string) error {
+				names = append(names, name)
+				return nil
+			}))
+			testutil.Equals(t, 0, len(names))
+
+			_, err = pw.Write([]byte("second half"))
+			testutil.Ok(t, err)
+			testutil.Ok(t, pw.Close())
+			testutil.Ok(t, <-uploaded)
+
+			r, err := b.Get(ctx, "a/b/obj")
+			testutil.Ok(t, err)
+			content, err := ioutil.ReadAll(r)
+			testutil.Ok(t, err)
+			testutil.Ok(t, r.Close())
+			testutil.Equals(t, "first half second half", string(content))
+
+			// Failed uploads leave neither the object nor temporary files behind.
+			pr, pw = io.Pipe()
+			go func() {
+				_, _ = pw.Write([]byte("partial"))
+				pw.CloseWithError(errors.New("interrupted"))
+			}()
+			testutil.NotOk(t, b.Upload(ctx, "a/b/failed", pr))
+			ok, err = b.Exists(ctx, "a/b/failed")
+			testutil.Ok(t, err)
+			testutil.Assert(t, !ok, "failed upload should not exist")
+
+			files, err := ioutil.ReadDir(filepath.Join(dir, "a", "b"))
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(files))
+			testutil.Equals(t, "obj", files[0].Name())
+		})
+	}
+}
+
+func TestBucket_RemovesInterruptedUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesystem-bucket")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	ctx := context.Background()
+	b, err := NewBucket(dir)
+	testutil.Ok(t, err)
+	testutil.Ok(t, b.Upload(ctx, "obj", bytes.NewReader([]byte("content"))))
+	// Objects with names resembling temporary files are regular objects.
+	testutil.Ok(t, b.Upload(ctx, ".obj2.tmp.123", bytes.NewReader([]byte("content"))))
+	testutil.Ok(t, b.Upload(ctx, ".tmp/obj", bytes.NewReader([]byte("content"))))
+
+	// Simulate uploads interrupted by a crash, and one still running in another process.
+	stale := time.Now().Add(-2 * staleTmpAge)
+	interrupted := []string{
+		filepath.Join(dir, tmpPrefix+"0123456789abcdef.tmp"),
+		filepath.Join(dir, "a", tmpPrefix+"fedcba9876543210.tmp"),
+	}
+	testutil.Ok(t, os.MkdirAll(filepath.Join(dir, "a"), os.ModePerm))
+	for _, f := range interrupted {
+		testutil.Ok(t, ioutil.WriteFile(f, []byte("partial"), 0666))
+		testutil.Ok(t, os.Chtimes(f, stale, stale))
+	}
+	running := filepath.Join(dir, tmpPrefix+"00000000000000ff.tmp")
+	testutil.Ok(t, ioutil.WriteFile(running, []byte("partial"), 0666))
+
+	// New buckets remove the temporary files of interrupted uploads only.
+	b, err = NewBucket(dir)
+	testutil.Ok(t, err)
+	for _, f := range interrupted {
+		_, err = os.Stat(f)
+		testutil.Assert(t, os.IsNotExist(err), "expected %s to be removed, got %v", f, err)
+	}
+	_, err = os.Stat(running)
+	testutil.Ok(t, err)
+
+	// Temporary files of running uploads are not listed.
+	for _, recursive := range []bool{false, true} {
+		var opts []objstore.IterOption
+		if recursive {
+			opts = append(opts, objstore.WithRecursiveIter)
+		}
+		var names []string
+		testutil.Ok(t, b.Iter(ctx, "", func(name string) error {
+			names = append(names, name)
+			return nil
+		}, opts...))
+		if recursive {
+			testutil.Equals(t, []string{".obj2.tmp.123", ".tmp/obj", "obj"}, names)
+		} else {
+			testutil.Equals(t, []string{".obj2.tmp.123", ".tmp/", "obj"}, names)
+		}
+	}
+}
+
+func TestBucket_GetRange_Mmap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesystem-bucket")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	ctx := context.Background()
+	regular, err := NewBucketWithConfig(Config{Directory: dir})
+	testutil.Ok(t, err)
+	mmapped, err := NewBucketFromConfig([]byte("directory: " + dir + "\nmmap: true\n"))
+	testutil.Ok(t, err)
+	testutil.Assert(t, mmapped.mmap, "mmap should be enabled")
+
+	pageSize := int64(os.Getpagesize())
+	content := make([]byte, 3*pageSize+100)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	testutil.Ok(t, regular.Upload(ctx, "obj", bytes.NewReader(content)))
+	testutil.Ok(t, regular.Upload(ctx, "empty", bytes.NewReader(nil)))
+
+	size := int64(len(content))
+	for _, tcase := range []struct {
+		name        string
+		off, length int64
+	}{
+		{name: "obj", off: 0, length: 10},
+		{name: "obj", off: 7, length: 100},
+		{name: "obj", off: pageSize, length: pageSize},
+		{name: "obj", off: pageSize - 3, length: 6},
+		{name: "obj", off: 0, length: size},
+		{name: "obj", off: 0, length: 0},
+		{name: "obj", off: size - 10, length: 100},
+		{name: "obj", off: size, length: 10},
+		{name: "obj", off: size + pageSize, length: 10},
+		{name: "obj", off: 10, length: -1},
+		{name: "empty", off: 0, length: 10},
+	} {
+		read := func(b *Bucket) []byte {
+			r, err := b.GetRange(ctx, tcase.name, tcase.off, tcase.length)
+			testutil.Ok(t, err)
+			res, err := ioutil.ReadAll(r)
+			testutil.Ok(t, err)
+			testutil.Ok(t, r.Close())
+			return res
+		}
+		expected := read(regular)
+		testutil.Equals(t, expected, read(mmapped), "%s at %d with length %d", tcase.name, tcase.off, tcase.length)
+	}
+
+	// Range reads of the object are served from memory mapped pages.
+	r, err := mmapped.GetRange(ctx, "obj", pageSize-3, 6)
+	testutil.Ok(t, err)
+	_, ok := r.(*mmapReaderCloser)
+	testutil.Assert(t, ok, "expected memory mapped reader, got %T", r)
+	testutil.Ok(t, r.Close())
+	testutil.Ok(t, r.Close())
+
+	_, err = mmapped.GetRange(ctx, "missing", 0, 10)
+	testutil.Assert(t, mmapped.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+}
@@ -0,0 +1,19 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package filesystem
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// mmap is not supported on Windows, range reads fall back to regular reads.
+func mmap(*os.File, int64, int) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on windows")
+}
+
+func munmap([]byte) error {
+	return nil
+}
@@ -8,7 +8,9 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"runtime"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -17,7 +19,10 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/version"
 	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/credentials"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"gopkg.in/yaml.v2"
@@ -30,6 +35,8 @@ const DirDelim = "/"
 type Config struct {
 	Bucket         string `yaml:"bucket"`
 	ServiceAccount string `yaml:"service_account"`
+	// Credentials selects the provider of OAuth2 access tokens instead of service_account.
+	Credentials credentials.Config `yaml:"credentials"`
 }
 
 // Bucket implements the store.Bucket and shipper.Bucket interfaces against GCS.
@@ -51,9 +58,21 @@ func NewBucket(ctx context.Context, logger log.Logger, conf []byte, component st
 		return nil, errors.New("missing Google Cloud Storage bucket name for stored blocks")
 	}
 
+	if gc.ServiceAccount != "" && gc.Credentials.Enabled() {
+		return nil, errors.New("service_account cannot be specified together with a credentials provider")
+	}
+
 	var opts []option.ClientOption
 
-	// If ServiceAccount is provided, use them in GCS client, otherwise fallback to Google default logic.
+	// If ServiceAccount is provided, use them in GCS client, otherwise fallback to Google default logic,
+	// which also covers IAM credentials.
+	if gc.Credentials.Enabled() && gc.Credentials.Type != credentials.IAM {
+		creds, err := credentials.NewCredentials(logger, gc.Credentials)
+		if err != nil {
+			return nil, errors.Wrap(err, "initialize gcs credentials")
+		}
+		opts = append(opts, option.WithTokenSource(&tokenSource{creds: creds}))
+	}
 	if gc.ServiceAccount != "" {
 		credentials, err := google.CredentialsFromJSON(ctx, []byte(gc.ServiceAccount), storage.ScopeFullControl)
 		if err != nil {
@@ -79,22 +98,63 @@ func NewBucket(ctx context.Context, logger log.Logger, conf []byte, component st
 	return bkt, nil
 }
 
+// tokenSource provides the tokens of credentials retrieved from a configured provider as OAuth2 access tokens.
+type tokenSource struct {
+	creds *credentials.Credentials
+}
+
+func (s *tokenSource) Token() (*oauth2.Token, error) {
+	v, err := s.creds.Get(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if v.Token == "" {
+		return nil, errors.New("no token in provided credentials")
+	}
+	return &oauth2.Token{AccessToken: v.Token, TokenType: "Bearer", Expiry: v.Expiration}, nil
+}
+
 // Name returns the bucket name for gcs.
 func (b *Bucket) Name() string {
 	return b.name
 }
 
+// SupportedOperations returns the optional operations supported by the bucket.
+func (b *Bucket) SupportedOperations() []objstore.Operation {
+	return []objstore.Operation{
+		objstore.OpUploadIfNotExists,
+		objstore.OpUploadIfMatch,
+		objstore.OpUploadWithMetadata,
+		objstore.OpIterWithAttributes,
+		objstore.OpCopy,
+	}
+}
+
 // Iter calls f for each entry in the given directory. The argument to f is the full
 // object name including the prefix of the inspected directory.
-func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	return b.IterWithAttributes(ctx, dir, func(name string, _ objstore.ObjectAttributes) error {
+		return f(name)
+	}, options...)
+}
+
+// IterWithAttributes calls f for each entry in the given directory with the entry's attributes
+// returned by the same listing call. The argument to f is the full object name including the
+// prefix of the inspected directory.
+func (b *Bucket) IterWithAttributes(ctx context.Context, dir string, f func(string, objstore.ObjectAttributes) error, options ...objstore.IterOption) error {
 	// Ensure the object name actually ends with a dir suffix. Otherwise we'll just iterate the
 	// object itself as one prefix item.
 	if dir != "" {
 		dir = strings.TrimSuffix(dir, DirDelim) + DirDelim
 	}
+	// Recursive listings are not delimited.
+	delimiter := DirDelim
+	if objstore.ApplyIterOptions(options...).Recursive {
+		delimiter = ""
+	}
 	it := b.bkt.Objects(ctx, &storage.Query{
 		Prefix:    dir,
-		Delimiter: DirDelim,
+		Delimiter: delimiter,
 	})
 	for {
 		select {
@@ -109,7 +169,7 @@ func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error) err
 		if err != nil {
 			return err
 		}
-		if err := f(attrs.Prefix + attrs.Name); err != nil {
+		if err := f(attrs.Prefix+attrs.Name, objectAttributes(attrs)); err != nil {
 			return err
 		}
 	}
@@ -125,6 +185,28 @@ func (b *Bucket) GetRange(ctx context.Context, name string, off, length int64) (
 	return b.bkt.Object(name).NewRangeReader(ctx, off, length)
 }
 
+// Attributes returns the attributes of the specified object.
+func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	attrs, err := b.bkt.Object(name).Attrs(ctx)
+	if err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	return objectAttributes(attrs), nil
+}
+
+// objectAttributes returns the attributes of the given object. The generation of objects is used as their ETag,
+// as conditional writes in GCS are based on generations.
+func objectAttributes(attrs *storage.ObjectAttrs) objstore.ObjectAttributes {
+	a := objstore.ObjectAttributes{
+		Size:         attrs.Size,
+		LastModified: attrs.Updated,
+	}
+	if attrs.Generation != 0 {
+		a.ETag = strconv.FormatInt(attrs.Generation, 10)
+	}
+	return a
+}
+
 // ObjectSize returns the size of the specified object.
 func (b *Bucket) ObjectSize(ctx context.Context, name string) (uint64, error) {
 	obj, err := b.bkt.Object(name).Attrs(ctx)
@@ -152,7 +234,15 @@ func (b *Bucket) Exists(ctx context.Context, name string) (bool, error) {
 
 // Upload writes the file specified in src to remote GCS location specified as target.
 func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	return b.UploadWithMetadata(ctx, name, r, objstore.ObjectMetadata{})
+}
+
+// UploadWithMetadata writes the file specified in src to remote GCS location specified as target with the given
+// content type and cache control.
+func (b *Bucket) UploadWithMetadata(ctx context.Context, name string, r io.Reader, md objstore.ObjectMetadata) error {
 	w := b.bkt.Object(name).NewWriter(ctx)
+	w.ContentType = md.ContentType
+	w.CacheControl = md.CacheControl
 
 	if _, err := io.Copy(w, r); err != nil {
 		return err
@@ -160,11 +250,51 @@ func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
 	return w.Close()
 }
 
+// UploadIf writes the file specified in src to remote GCS location specified as target if the given condition is met.
+func (b *Bucket) UploadIf(ctx context.Context, name string, r io.Reader, cond objstore.UploadCondition) error {
+	if err := cond.Validate(); err != nil {
+		return err
+	}
+	var conds storage.Conditions
+	if cond.IfNotExists {
+		conds.DoesNotExist = true
+	}
+	if cond.IfMatch != "" {
+		gen, err := strconv.ParseInt(cond.IfMatch, 10, 64)
+		if err != nil || gen == 0 {
+			return errors.Wrapf(objstore.ErrPreconditionFailed, "object %s does not match ETag %s", name, cond.IfMatch)
+		}
+		conds.GenerationMatch = gen
+	}
+
+	obj := b.bkt.Object(name)
+	if conds != (storage.Conditions{}) {
+		obj = obj.If(conds)
+	}
+	w := obj.NewWriter(ctx)
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusPreconditionFailed {
+			return errors.Wrapf(objstore.ErrPreconditionFailed, "upload %s: %s", name, e.Message)
+		}
+		return err
+	}
+	return nil
+}
+
 // Delete removes the object with the given name.
 func (b *Bucket) Delete(ctx context.Context, name string) error {
 	return b.bkt.Object(name).Delete(ctx)
 }
 
+// Copy copies the object src to dst server-side by rewriting it.
+func (b *Bucket) Copy(ctx context.Context, src, dst string) error {
+	_, err := b.bkt.Object(dst).CopierFrom(b.bkt.Object(src)).Run(ctx)
+	return err
+}
+
 // IsObjNotFoundErr returns true if error means that object is not found. Relevant to Get operations.
 func (b *Bucket) IsObjNotFoundErr(err error) bool {
 	return err == storage.ErrObjectNotExist
@@ -6,11 +6,14 @@ package inmem
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/thanos-io/thanos/pkg/objstore"
@@ -21,14 +24,16 @@ var errNotFound = errors.New("inmem: object not found")
 // Bucket implements the objstore.Bucket interfaces against local memory.
 // Methods from Bucket interface are thread-safe. Objects are assumed to be immutable.
 type Bucket struct {
-	mtx     sync.RWMutex
-	objects map[string][]byte
+	mtx      sync.RWMutex
+	objects  map[string][]byte
+	modified map[string]time.Time
+	metadata map[string]objstore.ObjectMetadata
 }
 
 // NewBucket returns a new in memory Bucket.
 // NOTE: Returned bucket is just a naive in memory bucket implementation. For test use cases only.
 func NewBucket() *Bucket {
-	return &Bucket{objects: map[string][]byte{}}
+	return &Bucket{objects: map[string][]byte{}, modified: map[string]time.Time{}, metadata: map[string]objstore.ObjectMetadata{}}
 }
 
 // Objects returns internally stored objects.
@@ -37,10 +42,31 @@ func (b *Bucket) Objects() map[string][]byte {
 	return b.objects
 }
 
+// Metadata returns the metadata the given object was uploaded with.
+// NOTE: For assert purposes.
+func (b *Bucket) Metadata(name string) objstore.ObjectMetadata {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	return b.metadata[name]
+}
+
 // Iter calls f for each entry in the given directory. The argument to f is the full
 // object name including the prefix of the inspected directory.
-func (b *Bucket) Iter(_ context.Context, dir string, f func(string) error) error {
-	unique := map[string]struct{}{}
+func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	return b.IterWithAttributes(ctx, dir, func(name string, _ objstore.ObjectAttributes) error {
+		return f(name)
+	}, options...)
+}
+
+// IterWithAttributes calls f for each entry in the given directory with the entry's attributes.
+// The argument to f is the full object name including the prefix of the inspected directory.
+// Recursive listings return all objects with the prefix of the directory.
+func (b *Bucket) IterWithAttributes(_ context.Context, dir string, f func(string, objstore.ObjectAttributes) error, options ...objstore.IterOption) error {
+	unique := map[string]objstore.ObjectAttributes{}
+	params := objstore.ApplyIterOptions(options...)
+	if params.Recursive && dir != "" {
+		dir = strings.TrimSuffix(dir, objstore.DirDelim) + objstore.DirDelim
+	}
 
 	var dirPartsCount int
 	dirParts := strings.SplitAfter(dir, objstore.DirDelim)
@@ -57,8 +83,19 @@ func (b *Bucket) Iter(_ context.Context, dir string, f func(string) error) error
 			continue
 		}
 
+		if params.Recursive {
+			unique[filename] = b.attributes(filename)
+			continue
+		}
+
 		parts := strings.SplitAfter(filename, objstore.DirDelim)
-		unique[strings.Join(parts[:dirPartsCount+1], "")] = struct{}{}
+		name := strings.Join(parts[:dirPartsCount+1], "")
+		if name != filename {
+			// A directory.
+			unique[name] = objstore.ObjectAttributes{}
+			continue
+		}
+		unique[name] = b.attributes(name)
 	}
 	b.mtx.RUnlock()
 
@@ -81,7 +118,7 @@ func (b *Bucket) Iter(_ context.Context, dir string, f func(string) error) error
 	})
 
 	for _, k := range keys {
-		if err := f(k); err != nil {
+		if err := f(k, unique[k]); err != nil {
 			return err
 		}
 	}
@@ -156,8 +193,32 @@ func (b *Bucket) ObjectSize(_ context.Context, name string) (uint64, error) {
 	return uint64(len(file)), nil
 }
 
+// Attributes returns the attributes of the specified object.
+func (b *Bucket) Attributes(_ context.Context, name string) (objstore.ObjectAttributes, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	if _, ok := b.objects[name]; !ok {
+		return objstore.ObjectAttributes{}, errNotFound
+	}
+	return b.attributes(name), nil
+}
+
+// attributes returns the attributes of the given existing object. It requires the read lock to be held.
+func (b *Bucket) attributes(name string) objstore.ObjectAttributes {
+	return objstore.ObjectAttributes{
+		Size:         int64(len(b.objects[name])),
+		LastModified: b.modified[name],
+		ETag:         fmt.Sprintf("%x", md5.Sum(b.objects[name])),
+	}
+}
+
 // Upload writes the file specified in src to into the memory.
-func (b *Bucket) Upload(_ context.Context, name string, r io.Reader) error {
+func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	return b.UploadWithMetadata(ctx, name, r, objstore.ObjectMetadata{})
+}
+
+// UploadWithMetadata writes the file specified in src to into the memory, keeping the given metadata.
+func (b *Bucket) UploadWithMetadata(_ context.Context, name string, r io.Reader, md objstore.ObjectMetadata) error {
 	b.mtx.Lock()
 	defer b.mtx.Unlock()
 	body, err := ioutil.ReadAll(r)
@@ -165,6 +226,29 @@ func (b *Bucket) Upload(_ context.Context, name string, r io.Reader) error {
 		return err
 	}
 	b.objects[name] = body
+	b.modified[name] = time.Now()
+	b.metadata[name] = md
+	return nil
+}
+
+// UploadIf writes the file specified in src to into the memory if the given condition is met.
+func (b *Bucket) UploadIf(_ context.Context, name string, r io.Reader, cond objstore.UploadCondition) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	_, ok := b.objects[name]
+	if cond.IfNotExists && ok {
+		return errors.Wrapf(objstore.ErrPreconditionFailed, "object %s exists", name)
+	}
+	if cond.IfMatch != "" && (!ok || b.attributes(name).ETag != cond.IfMatch) {
+		return errors.Wrapf(objstore.ErrPreconditionFailed, "object %s does not match ETag %s", name, cond.IfMatch)
+	}
+	b.objects[name] = body
+	b.modified[name] = time.Now()
+	delete(b.metadata, name)
 	return nil
 }
 
@@ -176,6 +260,35 @@ func (b *Bucket) Delete(_ context.Context, name string) error {
 		return errNotFound
 	}
 	delete(b.objects, name)
+	delete(b.modified, name)
+	delete(b.metadata, name)
+	return nil
+}
+
+// DeleteMultiple removes the objects with the given names at once.
+func (b *Bucket) DeleteMultiple(_ context.Context, names []string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for _, name := range names {
+		delete(b.objects, name)
+		delete(b.modified, name)
+		delete(b.metadata, name)
+	}
+	return nil
+}
+
+// Copy copies the object src to dst, keeping its metadata.
+func (b *Bucket) Copy(_ context.Context, src, dst string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	body, ok := b.objects[src]
+	if !ok {
+		return errNotFound
+	}
+	// Objects are immutable, so the copy shares the contents of the source.
+	b.objects[dst] = body
+	b.modified[dst] = time.Now()
+	b.metadata[dst] = b.metadata[src]
 	return nil
 }
 
@@ -190,3 +303,15 @@ func (b *Bucket) Close() error { return nil }
 func (b *Bucket) Name() string {
 	return "inmem"
 }
+
+// SupportedOperations returns the optional operations supported by the bucket.
+func (b *Bucket) SupportedOperations() []objstore.Operation {
+	return []objstore.Operation{
+		objstore.OpUploadIfNotExists,
+		objstore.OpUploadIfMatch,
+		objstore.OpUploadWithMetadata,
+		objstore.OpDeleteMultiple,
+		objstore.OpIterWithAttributes,
+		objstore.OpCopy,
+	}
+}
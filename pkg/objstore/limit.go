@@ -0,0 +1,222 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// BucketWithConcurrencyLimit takes a bucket and limits the number of operations running concurrently
+// against it to the given limit. Operations exceeding the limit wait for a running operation to finish,
+// or fail once their context is done.
+// Reads hold their slot until the returned reader is closed. Iterations only hold their slot while listing,
+// so that the given function can run further operations against the bucket.
+func BucketWithConcurrencyLimit(b Bucket, limit int) Bucket {
+	return &limitedBucket{bkt: b, slots: make(chan struct{}, limit)}
+}
+
+type limitedBucket struct {
+	bkt   Bucket
+	slots chan struct{}
+}
+
+func (b *limitedBucket) acquire(ctx context.Context, op string) error {
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "wait for %s operation slot", op)
+	}
+}
+
+func (b *limitedBucket) release() {
+	<-b.slots
+}
+
+func (b *limitedBucket) Iter(ctx context.Context, dir string, f func(name string) error, options ...IterOption) error {
+	if err := b.acquire(ctx, iterOp); err != nil {
+		return err
+	}
+	var names []string
+	err := b.bkt.Iter(ctx, dir, func(name string) error {
+		names = append(names, name)
+		return nil
+	}, options...)
+	b.release()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := f(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *limitedBucket) IterWithAttributes(ctx context.Context, dir string, f func(name string, attrs ObjectAttributes) error, options ...IterOption) error {
+	if err := b.acquire(ctx, iterAttrOp); err != nil {
+		return err
+	}
+	var (
+		names []string
+		attrs []ObjectAttributes
+	)
+	err := IterWithAttributes(ctx, b.bkt, dir, func(name string, a ObjectAttributes) error {
+		names = append(names, name)
+		attrs = append(attrs, a)
+		return nil
+	}, options...)
+	b.release()
+	if err != nil {
+		return err
+	}
+
+	for i, name := range names {
+		if err := f(name, attrs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *limitedBucket) ObjectSize(ctx context.Context, name string) (uint64, error) {
+	if err := b.acquire(ctx, sizeOp); err != nil {
+		return 0, err
+	}
+	defer b.release()
+
+	return b.bkt.ObjectSize(ctx, name)
+}
+
+func (b *limitedBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	if err := b.acquire(ctx, attrOp); err != nil {
+		return ObjectAttributes{}, err
+	}
+	defer b.release()
+
+	return b.bkt.Attributes(ctx, name)
+}
+
+func (b *limitedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.acquire(ctx, getOp); err != nil {
+		return nil, err
+	}
+	rc, err := b.bkt.Get(ctx, name)
+	if err != nil {
+		b.release()
+		return nil, err
+	}
+	return &releasingReadCloser{ReadCloser: rc, release: b.release}, nil
+}
+
+func (b *limitedBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := b.acquire(ctx, getRangeOp); err != nil {
+		return nil, err
+	}
+	rc, err := b.bkt.GetRange(ctx, name, off, length)
+	if err != nil {
+		b.release()
+		return nil, err
+	}
+	return &releasingReadCloser{ReadCloser: rc, release: b.release}, nil
+}
+
+func (b *limitedBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.acquire(ctx, existsOp); err != nil {
+		return false, err
+	}
+	defer b.release()
+
+	return b.bkt.Exists(ctx, name)
+}
+
+func (b *limitedBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.acquire(ctx, uploadOp); err != nil {
+		return err
+	}
+	defer b.release()
+
+	return b.bkt.Upload(ctx, name, r)
+}
+
+func (b *limitedBucket) UploadIf(ctx context.Context, name string, r io.Reader, cond UploadCondition) error {
+	if err := b.acquire(ctx, uploadIfOp); err != nil {
+		return err
+	}
+	defer b.release()
+
+	return UploadIf(ctx, b.bkt, name, r, cond)
+}
+
+func (b *limitedBucket) UploadWithMetadata(ctx context.Context, name string, r io.Reader, md ObjectMetadata) error {
+	if err := b.acquire(ctx, uploadOp); err != nil {
+		return err
+	}
+	defer b.release()
+
+	return UploadWithMetadata(ctx, b.bkt, name, r, md)
+}
+
+func (b *limitedBucket) Delete(ctx context.Context, name string) error {
+	if err := b.acquire(ctx, deleteOp); err != nil {
+		return err
+	}
+	defer b.release()
+
+	return b.bkt.Delete(ctx, name)
+}
+
+func (b *limitedBucket) DeleteMultiple(ctx context.Context, names []string) error {
+	if err := b.acquire(ctx, deleteMultipleOp); err != nil {
+		return err
+	}
+	defer b.release()
+
+	return DeleteMultiple(ctx, b.bkt, names)
+}
+
+func (b *limitedBucket) Copy(ctx context.Context, src, dst string) error {
+	if err := b.acquire(ctx, copyOp); err != nil {
+		return err
+	}
+	defer b.release()
+
+	return Copy(ctx, b.bkt, src, dst)
+}
+
+func (b *limitedBucket) IsObjNotFoundErr(err error) bool {
+	return b.bkt.IsObjNotFoundErr(err)
+}
+
+func (b *limitedBucket) Close() error {
+	return b.bkt.Close()
+}
+
+func (b *limitedBucket) Name() string {
+	return b.bkt.Name()
+}
+
+func (b *limitedBucket) SupportedOperations() []Operation {
+	return SupportedOperations(b.bkt)
+}
+
+// releasingReadCloser releases the slot of a read operation once the reader is closed.
+type releasingReadCloser struct {
+	io.ReadCloser
+
+	once    sync.Once
+	release func()
+}
+
+func (rc *releasingReadCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	rc.once.Do(rc.release)
+	return err
+}
@@ -0,0 +1,225 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// blockingBucket is a bucket whose Exists operations block until unblocked. It records the maximum
+// number of operations running concurrently.
+type blockingBucket struct {
+	objstore.Bucket
+
+	started chan struct{}
+	unblock chan struct{}
+
+	mtx                 sync.Mutex
+	running, maxRunning int
+}
+
+func newBlockingBucket() *blockingBucket {
+	return &blockingBucket{
+		Bucket:  inmem.NewBucket(),
+		started: make(chan struct{}, 100),
+		unblock: make(chan struct{}),
+	}
+}
+
+func (b *blockingBucket) Exists(ctx context.Context, name string) (bool, error) {
+	b.mtx.Lock()
+	b.running++
+	if b.running > b.maxRunning {
+		b.maxRunning = b.running
+	}
+	b.mtx.Unlock()
+	defer func() {
+		b.mtx.Lock()
+		b.running--
+		b.mtx.Unlock()
+	}()
+
+	b.started <- struct{}{}
+	<-b.unblock
+	return b.Bucket.Exists(ctx, name)
+}
+
+func TestBucketWithConcurrencyLimit(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("limit is enforced", func(t *testing.T) {
+		inner := newBlockingBucket()
+		bkt := objstore.BucketWithConcurrencyLimit(inner, 3)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := bkt.Exists(ctx, "obj")
+				testutil.Ok(t, err)
+			}()
+		}
+		for i := 0; i < 3; i++ {
+			<-inner.started
+		}
+		// No further operation starts while the limit is reached.
+		select {
+		case <-inner.started:
+			t.Fatal("operation started while the concurrency limit was reached")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		close(inner.unblock)
+		wg.Wait()
+		testutil.Equals(t, 3, inner.maxRunning)
+	})
+
+	t.Run("waiting operations fail once their context is done", func(t *testing.T) {
+		inner := newBlockingBucket()
+		bkt := objstore.BucketWithConcurrencyLimit(inner, 1)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := bkt.Exists(ctx, "obj")
+			testutil.Ok(t, err)
+		}()
+		<-inner.started
+
+		tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		_, err := bkt.Exists(tctx, "obj")
+		testutil.NotOk(t, err)
+		testutil.Equals(t, context.DeadlineExceeded, errors.Cause(err))
+
+		close(inner.unblock)
+		wg.Wait()
+	})
+
+	t.Run("reads hold their slot until closed", func(t *testing.T) {
+		bkt := objstore.BucketWithConcurrencyLimit(inmem.NewBucket(), 1)
+		testutil.Ok(t, bkt.Upload(ctx, "obj", bytes.NewReader([]byte("content"))))
+
+		rc, err := bkt.Get(ctx, "obj")
+		testutil.Ok(t, err)
+
+		tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		_, err = bkt.Exists(tctx, "obj")
+		testutil.NotOk(t, err)
+
+		testutil.Ok(t, rc.Close())
+		ok, err := bkt.Exists(ctx, "obj")
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "object should exist")
+	})
+
+	t.Run("iterations do not hold their slot while calling the function", func(t *testing.T) {
+		bkt := objstore.BucketWithConcurrencyLimit(inmem.NewBucket(), 1)
+		testutil.Ok(t, bkt.Upload(ctx, "dir/obj", bytes.NewReader([]byte("content"))))
+
+		var names []string
+		testutil.Ok(t, bkt.Iter(ctx, "dir/", func(name string) error {
+			names = append(names, name)
+			_, err := bkt.Exists(ctx, name)
+			return err
+		}))
+		testutil.Equals(t, []string{"dir/obj"}, names)
+	})
+}
+
+func TestBucketWithMetrics_InFlight(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+	inner := newBlockingBucket()
+	bkt := objstore.BucketWithMetrics("test", inner, reg)
+
+	check := func(exists, get int) {
+		t.Helper()
+		expected := fmt.Sprintf(`
+# HELP thanos_objstore_bucket_operations_in_flight Number of operations against the bucket currently running. Reads are running until their reader is closed.
+# TYPE thanos_objstore_bucket_operations_in_flight gauge
+thanos_objstore_bucket_operations_in_flight{bucket="test",operation="attributes"} 0
+thanos_objstore_bucket_operations_in_flight{bucket="test",operation="copy"} 0
+thanos_objstore_bucket_operations_in_flight{bucket="test",operation="delete"} 0
+thanos_objstore_bucket_operations_in_flight{bucket="test",operation="delete_multiple"} 0
+thanos_objstore_bucket_operations_in_flight{bucket="test",operation="exists"} %d
+thanos_objstore_bucket_operations_in_flight{bucket="test",operation="get"} %d
+thanos_objstore_bucket_operations_in_flight{bucket="test",operation="get_range"} 0
+thanos_objstore_bucket_operations_in_flight{bucket="test",operation="iter"} 0
+thanos_objstore_bucket_operations_in_flight{bucket="test",operation="iter_with_attributes"} 0
+thanos_objstore_bucket_operations_in_flight{bucket="test",operation="objectsize"} 0
+thanos_objstore_bucket_operations_in_flight{bucket="test",operation="upload"} 0
+thanos_objstore_bucket_operations_in_flight{bucket="test",operation="upload_if"} 0
+`, exists, get)
+		testutil.Ok(t, promtest.GatherAndCompare(reg, strings.NewReader(expected), "thanos_objstore_bucket_operations_in_flight"))
+	}
+
+	testutil.Ok(t, bkt.Upload(ctx, "obj", bytes.NewReader([]byte("content"))))
+	check(0, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := bkt.Exists(ctx, "obj")
+			testutil.Ok(t, err)
+		}()
+	}
+	<-inner.started
+	<-inner.started
+	rc, err := bkt.Get(ctx, "obj")
+	testutil.Ok(t, err)
+	check(2, 1)
+
+	close(inner.unblock)
+	wg.Wait()
+	check(0, 1)
+
+	testutil.Ok(t, rc.Close())
+	check(0, 0)
+}
+
+func TestBucketWithMetrics_UploadIf(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+	bkt := objstore.BucketWithMetrics("test", objstore.BucketWithConcurrencyLimit(inmem.NewBucket(), 1), reg)
+
+	cond := objstore.UploadCondition{IfNotExists: true}
+	testutil.Ok(t, objstore.UploadIf(ctx, bkt, "lock", bytes.NewReader([]byte("a")), cond))
+	err := objstore.UploadIf(ctx, bkt, "lock", bytes.NewReader([]byte("b")), cond)
+	testutil.Assert(t, objstore.IsPreconditionFailedErr(err), "expected precondition failed error got %v", err)
+
+	// Unmet conditions are no failures of the bucket.
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	values := map[string]float64{}
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			for _, l := range m.Label {
+				if l.GetName() == "operation" && l.GetValue() == "upload_if" && m.Counter != nil {
+					values[mf.GetName()] = m.Counter.GetValue()
+				}
+			}
+		}
+	}
+	testutil.Equals(t, 2.0, values["thanos_objstore_bucket_operations_total"])
+	testutil.Equals(t, 0.0, values["thanos_objstore_bucket_operation_failures_total"])
+}
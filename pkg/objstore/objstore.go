@@ -11,6 +11,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -41,6 +42,244 @@ type Bucket interface {
 	Name() string
 }
 
+var (
+	// ErrPreconditionFailed is returned by conditional uploads if the condition of the upload is not met.
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrConditionalUploadNotSupported is returned by conditional uploads if the bucket does not support the condition.
+	ErrConditionalUploadNotSupported = errors.New("conditional upload not supported")
+)
+
+// UploadCondition is the condition of a conditional upload. An empty condition always applies.
+// IfNotExists and IfMatch exclude each other.
+type UploadCondition struct {
+	// IfNotExists makes the upload fail if the object already exists.
+	IfNotExists bool
+	// IfMatch makes the upload fail unless the object exists with the given ETag, see ObjectAttributes.
+	IfMatch string
+}
+
+// Validate returns an error if the condition can never be met.
+func (c UploadCondition) Validate() error {
+	if c.IfNotExists && c.IfMatch != "" {
+		return errors.New("upload condition cannot require both that the object does not exist and that it matches an ETag")
+	}
+	return nil
+}
+
+// ConditionalUploader is implemented by buckets able to upload objects only if a condition is met,
+// atomically with the upload.
+type ConditionalUploader interface {
+	// UploadIf uploads the contents of the reader as an object into the bucket if the given condition is met.
+	// It returns an error with ErrPreconditionFailed as cause if the condition is not met, and one with
+	// ErrConditionalUploadNotSupported as cause if the bucket does not support the condition.
+	UploadIf(ctx context.Context, name string, r io.Reader, cond UploadCondition) error
+}
+
+// UploadIf uploads the contents of the reader as an object into the bucket if the given condition is met.
+// Conditions are not emulated, so it fails with ErrConditionalUploadNotSupported if the bucket does
+// not implement ConditionalUploader.
+func UploadIf(ctx context.Context, bkt Bucket, name string, r io.Reader, cond UploadCondition) error {
+	if err := cond.Validate(); err != nil {
+		return err
+	}
+	if u, ok := bkt.(ConditionalUploader); ok {
+		return u.UploadIf(ctx, name, r, cond)
+	}
+	return errors.Wrapf(ErrConditionalUploadNotSupported, "bucket %s", bkt.Name())
+}
+
+// IsPreconditionFailedErr returns true if the error means that the condition of a conditional upload was not met.
+func IsPreconditionFailedErr(err error) bool {
+	return errors.Cause(err) == ErrPreconditionFailed
+}
+
+// ObjectMetadata is the optional metadata set on an uploaded object. Empty fields are not set.
+type ObjectMetadata struct {
+	// ContentType is the MIME type of the object, e.g. application/json.
+	ContentType string
+	// CacheControl is the value of the Cache-Control header served with the object, e.g. by CDNs fronting the bucket.
+	CacheControl string
+}
+
+// MetadataUploader is implemented by buckets able to set metadata on uploaded objects.
+type MetadataUploader interface {
+	// UploadWithMetadata uploads the contents of the reader as an object with the given metadata into the bucket.
+	UploadWithMetadata(ctx context.Context, name string, r io.Reader, md ObjectMetadata) error
+}
+
+// UploadWithMetadata uploads the contents of the reader as an object with the given metadata into the bucket.
+// If the bucket does not implement MetadataUploader, the metadata is ignored and the object is uploaded without it.
+func UploadWithMetadata(ctx context.Context, bkt Bucket, name string, r io.Reader, md ObjectMetadata) error {
+	if u, ok := bkt.(MetadataUploader); ok {
+		return u.UploadWithMetadata(ctx, name, r, md)
+	}
+	return bkt.Upload(ctx, name, r)
+}
+
+// BatchDeleter is implemented by buckets able to delete many objects with a single request.
+type BatchDeleter interface {
+	// DeleteMultiple removes the objects with the given names. Objects that do not exist are ignored.
+	// Failing deletions of some objects do not stop the deletion of the others; if some objects could not
+	// be deleted, a *DeleteMultipleError naming them is returned.
+	DeleteMultiple(ctx context.Context, names []string) error
+}
+
+// DeleteMultipleError is returned by batched deletes if some of the objects could not be deleted.
+type DeleteMultipleError struct {
+	// Errs holds the error of every object that could not be deleted, by object name.
+	Errs map[string]error
+}
+
+func (e *DeleteMultipleError) Error() string {
+	names := make([]string, 0, len(e.Errs))
+	for name := range e.Errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "delete %d objects", len(names))
+	for i, name := range names {
+		sep := "; "
+		if i == 0 {
+			sep = ": "
+		}
+		fmt.Fprintf(&b, "%s%s: %s", sep, name, e.Errs[name])
+	}
+	return b.String()
+}
+
+// DeleteMultiple removes the objects with the given names, see BatchDeleter. If the bucket does not
+// implement BatchDeleter, the objects are deleted one at a time.
+func DeleteMultiple(ctx context.Context, bkt Bucket, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	if d, ok := bkt.(BatchDeleter); ok {
+		return d.DeleteMultiple(ctx, names)
+	}
+
+	errs := map[string]error{}
+	for _, name := range names {
+		if err := bkt.Delete(ctx, name); err != nil && !bkt.IsObjNotFoundErr(err) {
+			errs[name] = err
+		}
+	}
+	if len(errs) > 0 {
+		return &DeleteMultipleError{Errs: errs}
+	}
+	return nil
+}
+
+// Copier is implemented by buckets able to copy objects within the bucket without downloading them, i.e. server-side.
+type Copier interface {
+	// Copy copies the object src to dst, overwriting dst if it exists.
+	Copy(ctx context.Context, src, dst string) error
+}
+
+// Copy copies the object src to dst within the bucket, overwriting dst if it exists. If the bucket does not
+// implement Copier, the object is downloaded and uploaded again.
+func Copy(ctx context.Context, bkt Bucket, src, dst string) error {
+	if c, ok := bkt.(Copier); ok {
+		return c.Copy(ctx, src, dst)
+	}
+	return copyObject(ctx, bkt, src, bkt, dst)
+}
+
+// CopyBetween copies the object src of the bucket from to the object dst of the bucket to, overwriting dst if it
+// exists. Objects are copied server-side within the same bucket if it implements Copier, and downloaded and uploaded
+// again otherwise.
+func CopyBetween(ctx context.Context, from Bucket, src string, to Bucket, dst string) error {
+	if from == to {
+		return Copy(ctx, from, src, dst)
+	}
+	return copyObject(ctx, from, src, to, dst)
+}
+
+func copyObject(ctx context.Context, from Bucket, src string, to Bucket, dst string) (err error) {
+	r, err := from.Get(ctx, src)
+	if err != nil {
+		return errors.Wrapf(err, "get %s", src)
+	}
+	defer runutil.CloseWithErrCapture(&err, r, "copied object reader")
+
+	if err := to.Upload(ctx, dst, r); err != nil {
+		return errors.Wrapf(err, "upload %s", dst)
+	}
+	return nil
+}
+
+// Operation is an optional operation of buckets, which not all of them support natively.
+type Operation string
+
+const (
+	// OpUploadIfNotExists is a conditional upload with the IfNotExists condition, see ConditionalUploader.
+	OpUploadIfNotExists Operation = "upload_if_not_exists"
+	// OpUploadIfMatch is a conditional upload with the IfMatch condition, see ConditionalUploader.
+	OpUploadIfMatch Operation = "upload_if_match"
+	// OpUploadWithMetadata is an upload setting object metadata, see MetadataUploader.
+	OpUploadWithMetadata Operation = "upload_with_metadata"
+	// OpDeleteMultiple is a deletion of many objects with a single request, see BatchDeleter.
+	OpDeleteMultiple Operation = "delete_multiple"
+	// OpIterWithAttributes is a listing returning the attributes of objects, see AttributesIterator.
+	OpIterWithAttributes Operation = "iter_with_attributes"
+	// OpCopy is a server-side copy of objects, see Copier.
+	OpCopy Operation = "copy"
+)
+
+// OperationsReporter is implemented by buckets reporting the optional operations they support natively.
+// Wrapping buckets report the operations of the wrapped bucket, even if they emulate the others.
+type OperationsReporter interface {
+	// SupportedOperations returns the optional operations supported natively by the bucket.
+	SupportedOperations() []Operation
+}
+
+// SupportedOperations returns the optional operations supported natively by the bucket. If the bucket does not
+// implement OperationsReporter, the operations are derived from the optional interfaces it implements.
+func SupportedOperations(bkt BucketReader) []Operation {
+	if r, ok := bkt.(OperationsReporter); ok {
+		return r.SupportedOperations()
+	}
+
+	var ops []Operation
+	if _, ok := bkt.(ConditionalUploader); ok {
+		ops = append(ops, OpUploadIfNotExists, OpUploadIfMatch)
+	}
+	if _, ok := bkt.(MetadataUploader); ok {
+		ops = append(ops, OpUploadWithMetadata)
+	}
+	if _, ok := bkt.(BatchDeleter); ok {
+		ops = append(ops, OpDeleteMultiple)
+	}
+	if _, ok := bkt.(AttributesIterator); ok {
+		ops = append(ops, OpIterWithAttributes)
+	}
+	if _, ok := bkt.(Copier); ok {
+		ops = append(ops, OpCopy)
+	}
+	return ops
+}
+
+// CheckOperations returns an error naming the given operations the bucket does not support natively, e.g. to fail
+// on startup rather than on the first use of an operation that is not emulated.
+func CheckOperations(bkt BucketReader, ops ...Operation) error {
+	supported := map[Operation]struct{}{}
+	for _, op := range SupportedOperations(bkt) {
+		supported[op] = struct{}{}
+	}
+
+	var missing []string
+	for _, op := range ops {
+		if _, ok := supported[op]; !ok {
+			missing = append(missing, string(op))
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("bucket does not support the operations %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
 // TryToGetSize tries to get upfront size from reader.
 // TODO(https://github.com/thanos-io/thanos/issues/678): Remove guessing length when minio provider will support multipart upload without this.
 func TryToGetSize(r io.Reader) (int64, error) {
@@ -55,6 +294,9 @@ func TryToGetSize(r io.Reader) (int64, error) {
 		return int64(f.Len()), nil
 	case *strings.Reader:
 		return f.Size(), nil
+	case *countingReader:
+		// Readers counted by the tracing and operation log buckets keep the size of the wrapped one.
+		return TryToGetSize(f.Reader)
 	}
 	return 0, errors.New("unsupported type of io.Reader")
 }
@@ -62,8 +304,10 @@ func TryToGetSize(r io.Reader) (int64, error) {
 // BucketReader provides read access to an object storage bucket.
 type BucketReader interface {
 	// Iter calls f for each entry in the given directory (not recursive.). The argument to f is the full
-	// object name including the prefix of the inspected directory.
-	Iter(ctx context.Context, dir string, f func(string) error) error
+	// object name including the prefix of the inspected directory. Entries that are directories end with
+	// DirDelim. With the WithRecursiveIter option, f is called for all objects below the directory instead,
+	// and never for directories.
+	Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error
 
 	// Get returns a reader for the given object name.
 	Get(ctx context.Context, name string) (io.ReadCloser, error)
@@ -79,11 +323,82 @@ type BucketReader interface {
 
 	// ObjectSize returns the size of the specified object.
 	ObjectSize(ctx context.Context, name string) (uint64, error)
+
+	// Attributes returns the attributes of the specified object.
+	Attributes(ctx context.Context, name string) (ObjectAttributes, error)
+}
+
+// IterOption configures a listing of Iter or IterWithAttributes.
+type IterOption func(params *IterParams)
+
+// IterParams holds the parameters of a listing, set by IterOptions.
+type IterParams struct {
+	// Recursive lists all objects below the directory instead of its direct entries. The listing is not
+	// delimited, so no directories are listed.
+	Recursive bool
+}
+
+// WithRecursiveIter lists all objects below the directory instead of its direct entries.
+func WithRecursiveIter(params *IterParams) {
+	params.Recursive = true
+}
+
+// ApplyIterOptions returns the parameters of a listing with the given options.
+func ApplyIterOptions(options ...IterOption) IterParams {
+	var params IterParams
+	for _, opt := range options {
+		opt(&params)
+	}
+	return params
+}
+
+// ObjectAttributes holds the attributes of an object in a bucket.
+type ObjectAttributes struct {
+	// Size is the object size in bytes.
+	Size int64
+	// LastModified is the time the object was last modified.
+	LastModified time.Time
+	// ETag identifies the version of the object for conditional uploads. It is empty if the bucket
+	// does not support conditional uploads on object versions.
+	ETag string
+}
+
+// AttributesIterator is implemented by buckets able to return the attributes of objects
+// within the same listing call as their names.
+type AttributesIterator interface {
+	// IterWithAttributes calls f for each entry in the given directory (not recursive.) with the entry's attributes.
+	// The argument to f is the full object name including the prefix of the inspected directory.
+	// Attributes of directories are empty. Options are the same as for Iter.
+	IterWithAttributes(ctx context.Context, dir string, f func(name string, attrs ObjectAttributes) error, options ...IterOption) error
+}
+
+// IterWithAttributes calls f for each entry in the given directory (not recursive.) with the entry's attributes.
+// If the bucket does not implement AttributesIterator, the attributes of every object are requested separately.
+func IterWithAttributes(ctx context.Context, bkt BucketReader, dir string, f func(name string, attrs ObjectAttributes) error, options ...IterOption) error {
+	if it, ok := bkt.(AttributesIterator); ok {
+		return it.IterWithAttributes(ctx, dir, f, options...)
+	}
+	return bkt.Iter(ctx, dir, func(name string) error {
+		if strings.HasSuffix(name, DirDelim) {
+			return f(name, ObjectAttributes{})
+		}
+		attrs, err := bkt.Attributes(ctx, name)
+		if err != nil {
+			return errors.Wrapf(err, "attributes of %s", name)
+		}
+		return f(name, attrs)
+	}, options...)
 }
 
 // UploadDir uploads all files in srcdir to the bucket with into a top-level directory
 // named dstdir. It is a caller responsibility to clean partial upload in case of failure.
 func UploadDir(ctx context.Context, logger log.Logger, bkt Bucket, srcdir, dstdir string) error {
+	return UploadDirWithMetadata(ctx, logger, bkt, srcdir, dstdir, ObjectMetadata{})
+}
+
+// UploadDirWithMetadata uploads all files in srcdir like UploadDir, setting the given metadata on every
+// uploaded object. See UploadWithMetadata.
+func UploadDirWithMetadata(ctx context.Context, logger log.Logger, bkt Bucket, srcdir, dstdir string, md ObjectMetadata) error {
 	df, err := os.Stat(srcdir)
 	if err != nil {
 		return errors.Wrap(err, "stat dir")
@@ -100,20 +415,26 @@ func UploadDir(ctx context.Context, logger log.Logger, bkt Bucket, srcdir, dstdi
 		}
 		dst := filepath.Join(dstdir, strings.TrimPrefix(src, srcdir))
 
-		return UploadFile(ctx, logger, bkt, src, dst)
+		return UploadFileWithMetadata(ctx, logger, bkt, src, dst, md)
 	})
 }
 
 // UploadFile uploads the file with the given name to the bucket.
 // It is a caller responsibility to clean partial upload in case of failure.
 func UploadFile(ctx context.Context, logger log.Logger, bkt Bucket, src, dst string) error {
+	return UploadFileWithMetadata(ctx, logger, bkt, src, dst, ObjectMetadata{})
+}
+
+// UploadFileWithMetadata uploads the file with the given name to the bucket, setting the given metadata
+// on the object. See UploadWithMetadata.
+func UploadFileWithMetadata(ctx context.Context, logger log.Logger, bkt Bucket, src, dst string, md ObjectMetadata) error {
 	r, err := os.Open(src)
 	if err != nil {
 		return errors.Wrapf(err, "open file %s", src)
 	}
 	defer runutil.CloseWithLogOnErr(logger, r, "close file %s", src)
 
-	if err := bkt.Upload(ctx, dst, r); err != nil {
+	if err := UploadWithMetadata(ctx, bkt, dst, r, md); err != nil {
 		return errors.Wrapf(err, "upload file %s as %s", src, dst)
 	}
 	level.Debug(logger).Log("msg", "uploaded file", "from", src, "dst", dst, "bucket", bkt.Name())
@@ -192,12 +513,30 @@ func DownloadDir(ctx context.Context, logger log.Logger, bkt BucketReader, src,
 
 const (
 	iterOp     = "iter"
+	iterAttrOp = "iter_with_attributes"
 	sizeOp     = "objectsize"
+	attrOp     = "attributes"
 	getOp      = "get"
 	getRangeOp = "get_range"
 	existsOp   = "exists"
 	uploadOp   = "upload"
+	uploadIfOp = "upload_if"
 	deleteOp   = "delete"
+	// deleteMultipleOp is a single operation for all objects of a batched delete.
+	deleteMultipleOp = "delete_multiple"
+	copyOp           = "copy"
+)
+
+// Results of operations against a bucket, classifying failed operations by their error.
+const (
+	resultSuccess = "success"
+	// resultNotFound are operations failing because the object does not exist, which is expected by some callers.
+	resultNotFound = "not_found"
+	// resultPreconditionFailed are conditional uploads whose condition was not met.
+	resultPreconditionFailed = "precondition_failed"
+	// resultCanceled are operations aborted because their context was canceled or timed out.
+	resultCanceled = "canceled"
+	resultFailure  = "failure"
 )
 
 // BucketWithMetrics takes a bucket and registers metrics with the given registry for
@@ -224,15 +563,29 @@ func BucketWithMetrics(name string, b Bucket, reg prometheus.Registerer) Bucket
 			ConstLabels: prometheus.Labels{"bucket": name},
 			Buckets:     []float64{0.001, 0.01, 0.1, 0.3, 0.6, 1, 3, 6, 9, 20, 30, 60, 90, 120},
 		}, []string{"operation"}),
+		opsResultDuration: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "thanos_objstore_bucket_operation_result_duration_seconds",
+			Help:        "Duration of operations against the bucket by result, i.e. success or the class of the error of failed operations. Reads last until their reader is closed.",
+			ConstLabels: prometheus.Labels{"bucket": name},
+			Buckets:     []float64{0.001, 0.01, 0.1, 0.3, 0.6, 1, 3, 6, 9, 20, 30, 60, 90, 120},
+		}, []string{"operation", "result"}),
+		opsInFlight: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "thanos_objstore_bucket_operations_in_flight",
+			Help:        "Number of operations against the bucket currently running. Reads are running until their reader is closed.",
+			ConstLabels: prometheus.Labels{"bucket": name},
+		}, []string{"operation"}),
 		lastSuccessfulUploadTime: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
 			Name: "thanos_objstore_bucket_last_successful_upload_time",
 			Help: "Second timestamp of the last successful upload to the bucket.",
 		}, []string{"bucket"}),
 	}
-	for _, op := range []string{iterOp, sizeOp, getOp, getRangeOp, existsOp, uploadOp, deleteOp} {
+	for _, op := range []string{iterOp, iterAttrOp, sizeOp, attrOp, getOp, getRangeOp, existsOp, uploadOp, uploadIfOp, deleteOp, deleteMultipleOp, copyOp} {
 		bkt.ops.WithLabelValues(op)
 		bkt.opsFailures.WithLabelValues(op)
 		bkt.opsDuration.WithLabelValues(op)
+		bkt.opsResultDuration.WithLabelValues(op, resultSuccess)
+		bkt.opsResultDuration.WithLabelValues(op, resultFailure)
+		bkt.opsInFlight.WithLabelValues(op)
 	}
 	bkt.lastSuccessfulUploadTime.WithLabelValues(b.Name())
 	return bkt
@@ -244,15 +597,63 @@ type metricBucket struct {
 	ops                      *prometheus.CounterVec
 	opsFailures              *prometheus.CounterVec
 	opsDuration              *prometheus.HistogramVec
+	opsResultDuration        *prometheus.HistogramVec
+	opsInFlight              *prometheus.GaugeVec
 	lastSuccessfulUploadTime *prometheus.GaugeVec
 }
 
-func (b *metricBucket) Iter(ctx context.Context, dir string, f func(name string) error) error {
-	err := b.bkt.Iter(ctx, dir, f)
+// inFlight marks an operation as running and returns a function marking it as done.
+func (b *metricBucket) inFlight(op string) func() {
+	g := b.opsInFlight.WithLabelValues(op)
+	g.Inc()
+	return g.Dec
+}
+
+// observe records the duration of the given operation started at the given time by its result.
+func (b *metricBucket) observe(op string, start time.Time, err error) {
+	b.opsResultDuration.WithLabelValues(op, b.result(err)).Observe(time.Since(start).Seconds())
+}
+
+// result returns the result of an operation failing with the given error.
+func (b *metricBucket) result(err error) string {
+	switch {
+	case err == nil:
+		return resultSuccess
+	case b.bkt.IsObjNotFoundErr(err):
+		return resultNotFound
+	case IsPreconditionFailedErr(err):
+		return resultPreconditionFailed
+	case errors.Cause(err) == context.Canceled || errors.Cause(err) == context.DeadlineExceeded:
+		return resultCanceled
+	default:
+		return resultFailure
+	}
+}
+
+func (b *metricBucket) Iter(ctx context.Context, dir string, f func(name string) error, options ...IterOption) error {
+	defer b.inFlight(iterOp)()
+	start := time.Now()
+
+	err := b.bkt.Iter(ctx, dir, f, options...)
 	if err != nil {
 		b.opsFailures.WithLabelValues(iterOp).Inc()
 	}
 	b.ops.WithLabelValues(iterOp).Inc()
+	b.observe(iterOp, start, err)
+
+	return err
+}
+
+func (b *metricBucket) IterWithAttributes(ctx context.Context, dir string, f func(name string, attrs ObjectAttributes) error, options ...IterOption) error {
+	defer b.inFlight(iterAttrOp)()
+	start := time.Now()
+
+	err := IterWithAttributes(ctx, b.bkt, dir, f, options...)
+	if err != nil {
+		b.opsFailures.WithLabelValues(iterAttrOp).Inc()
+	}
+	b.ops.WithLabelValues(iterAttrOp).Inc()
+	b.observe(iterAttrOp, start, err)
 
 	return err
 }
@@ -260,23 +661,46 @@ func (b *metricBucket) Iter(ctx context.Context, dir string, f func(name string)
 // ObjectSize returns the size of the specified object.
 func (b *metricBucket) ObjectSize(ctx context.Context, name string) (uint64, error) {
 	b.ops.WithLabelValues(sizeOp).Inc()
+	defer b.inFlight(sizeOp)()
 	start := time.Now()
 
 	rc, err := b.bkt.ObjectSize(ctx, name)
 	if err != nil {
 		b.opsFailures.WithLabelValues(sizeOp).Inc()
+		b.observe(sizeOp, start, err)
 		return 0, err
 	}
 	b.opsDuration.WithLabelValues(sizeOp).Observe(time.Since(start).Seconds())
+	b.observe(sizeOp, start, nil)
 	return rc, nil
 }
 
+func (b *metricBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	b.ops.WithLabelValues(attrOp).Inc()
+	defer b.inFlight(attrOp)()
+	start := time.Now()
+
+	attrs, err := b.bkt.Attributes(ctx, name)
+	if err != nil {
+		b.opsFailures.WithLabelValues(attrOp).Inc()
+		b.observe(attrOp, start, err)
+		return ObjectAttributes{}, err
+	}
+	b.opsDuration.WithLabelValues(attrOp).Observe(time.Since(start).Seconds())
+	b.observe(attrOp, start, nil)
+	return attrs, nil
+}
+
 func (b *metricBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
 	b.ops.WithLabelValues(getOp).Inc()
+	done := b.inFlight(getOp)
+	start := time.Now()
 
 	rc, err := b.bkt.Get(ctx, name)
 	if err != nil {
 		b.opsFailures.WithLabelValues(getOp).Inc()
+		b.observe(getOp, start, err)
+		done()
 		return nil, err
 	}
 	return newTimingReadCloser(
@@ -284,15 +708,23 @@ func (b *metricBucket) Get(ctx context.Context, name string) (io.ReadCloser, err
 		getOp,
 		b.opsDuration,
 		b.opsFailures,
+		func(err error) {
+			b.observe(getOp, start, err)
+			done()
+		},
 	), nil
 }
 
 func (b *metricBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
 	b.ops.WithLabelValues(getRangeOp).Inc()
+	done := b.inFlight(getRangeOp)
+	start := time.Now()
 
 	rc, err := b.bkt.GetRange(ctx, name, off, length)
 	if err != nil {
 		b.opsFailures.WithLabelValues(getRangeOp).Inc()
+		b.observe(getRangeOp, start, err)
+		done()
 		return nil, err
 	}
 	return newTimingReadCloser(
@@ -300,10 +732,15 @@ func (b *metricBucket) GetRange(ctx context.Context, name string, off, length in
 		getRangeOp,
 		b.opsDuration,
 		b.opsFailures,
+		func(err error) {
+			b.observe(getRangeOp, start, err)
+			done()
+		},
 	), nil
 }
 
 func (b *metricBucket) Exists(ctx context.Context, name string) (bool, error) {
+	defer b.inFlight(existsOp)()
 	start := time.Now()
 
 	ok, err := b.bkt.Exists(ctx, name)
@@ -312,11 +749,13 @@ func (b *metricBucket) Exists(ctx context.Context, name string) (bool, error) {
 	}
 	b.ops.WithLabelValues(existsOp).Inc()
 	b.opsDuration.WithLabelValues(existsOp).Observe(time.Since(start).Seconds())
+	b.observe(existsOp, start, err)
 
 	return ok, err
 }
 
 func (b *metricBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	defer b.inFlight(uploadOp)()
 	start := time.Now()
 
 	err := b.bkt.Upload(ctx, name, r)
@@ -327,11 +766,48 @@ func (b *metricBucket) Upload(ctx context.Context, name string, r io.Reader) err
 	}
 	b.ops.WithLabelValues(uploadOp).Inc()
 	b.opsDuration.WithLabelValues(uploadOp).Observe(time.Since(start).Seconds())
+	b.observe(uploadOp, start, err)
+
+	return err
+}
+
+// UploadIf uploads the object if the condition is met. Unmet conditions are not counted as failures.
+func (b *metricBucket) UploadIf(ctx context.Context, name string, r io.Reader, cond UploadCondition) error {
+	defer b.inFlight(uploadIfOp)()
+	start := time.Now()
+
+	err := UploadIf(ctx, b.bkt, name, r, cond)
+	if err == nil {
+		b.lastSuccessfulUploadTime.WithLabelValues(b.bkt.Name()).SetToCurrentTime()
+	} else if !IsPreconditionFailedErr(err) {
+		b.opsFailures.WithLabelValues(uploadIfOp).Inc()
+	}
+	b.ops.WithLabelValues(uploadIfOp).Inc()
+	b.opsDuration.WithLabelValues(uploadIfOp).Observe(time.Since(start).Seconds())
+	b.observe(uploadIfOp, start, err)
+
+	return err
+}
+
+func (b *metricBucket) UploadWithMetadata(ctx context.Context, name string, r io.Reader, md ObjectMetadata) error {
+	defer b.inFlight(uploadOp)()
+	start := time.Now()
+
+	err := UploadWithMetadata(ctx, b.bkt, name, r, md)
+	if err != nil {
+		b.opsFailures.WithLabelValues(uploadOp).Inc()
+	} else {
+		b.lastSuccessfulUploadTime.WithLabelValues(b.bkt.Name()).SetToCurrentTime()
+	}
+	b.ops.WithLabelValues(uploadOp).Inc()
+	b.opsDuration.WithLabelValues(uploadOp).Observe(time.Since(start).Seconds())
+	b.observe(uploadOp, start, err)
 
 	return err
 }
 
 func (b *metricBucket) Delete(ctx context.Context, name string) error {
+	defer b.inFlight(deleteOp)()
 	start := time.Now()
 
 	err := b.bkt.Delete(ctx, name)
@@ -340,6 +816,39 @@ func (b *metricBucket) Delete(ctx context.Context, name string) error {
 	}
 	b.ops.WithLabelValues(deleteOp).Inc()
 	b.opsDuration.WithLabelValues(deleteOp).Observe(time.Since(start).Seconds())
+	b.observe(deleteOp, start, err)
+
+	return err
+}
+
+func (b *metricBucket) DeleteMultiple(ctx context.Context, names []string) error {
+	defer b.inFlight(deleteMultipleOp)()
+	start := time.Now()
+
+	err := DeleteMultiple(ctx, b.bkt, names)
+	if err != nil {
+		b.opsFailures.WithLabelValues(deleteMultipleOp).Inc()
+	}
+	b.ops.WithLabelValues(deleteMultipleOp).Inc()
+	b.opsDuration.WithLabelValues(deleteMultipleOp).Observe(time.Since(start).Seconds())
+	b.observe(deleteMultipleOp, start, err)
+
+	return err
+}
+
+func (b *metricBucket) Copy(ctx context.Context, src, dst string) error {
+	defer b.inFlight(copyOp)()
+	start := time.Now()
+
+	err := Copy(ctx, b.bkt, src, dst)
+	if err != nil {
+		b.opsFailures.WithLabelValues(copyOp).Inc()
+	} else {
+		b.lastSuccessfulUploadTime.WithLabelValues(b.bkt.Name()).SetToCurrentTime()
+	}
+	b.ops.WithLabelValues(copyOp).Inc()
+	b.opsDuration.WithLabelValues(copyOp).Observe(time.Since(start).Seconds())
+	b.observe(copyOp, start, err)
 
 	return err
 }
@@ -356,17 +865,25 @@ func (b *metricBucket) Name() string {
 	return b.bkt.Name()
 }
 
+func (b *metricBucket) SupportedOperations() []Operation {
+	return SupportedOperations(b.bkt)
+}
+
 type timingReadCloser struct {
 	io.ReadCloser
 
 	ok       bool
+	err      error
 	start    time.Time
 	op       string
 	duration *prometheus.HistogramVec
 	failed   *prometheus.CounterVec
+	done     func(err error)
 }
 
-func newTimingReadCloser(rc io.ReadCloser, op string, dur *prometheus.HistogramVec, failed *prometheus.CounterVec) *timingReadCloser {
+// newTimingReadCloser returns a reader observing the duration of the read until it is closed. Done is called on
+// close with the first error of the read, if any.
+func newTimingReadCloser(rc io.ReadCloser, op string, dur *prometheus.HistogramVec, failed *prometheus.CounterVec, done func(err error)) *timingReadCloser {
 	// Initialize the metrics with 0.
 	dur.WithLabelValues(op)
 	failed.WithLabelValues(op)
@@ -377,6 +894,7 @@ func newTimingReadCloser(rc io.ReadCloser, op string, dur *prometheus.HistogramV
 		op:         op,
 		duration:   dur,
 		failed:     failed,
+		done:       done,
 	}
 }
 
@@ -386,6 +904,11 @@ func (rc *timingReadCloser) Close() error {
 	if rc.ok && err != nil {
 		rc.failed.WithLabelValues(rc.op).Inc()
 		rc.ok = false
+		rc.err = err
+	}
+	if rc.done != nil {
+		rc.done(rc.err)
+		rc.done = nil
 	}
 	return err
 }
@@ -395,6 +918,7 @@ func (rc *timingReadCloser) Read(b []byte) (n int, err error) {
 	if rc.ok && err != nil && err != io.EOF {
 		rc.failed.WithLabelValues(rc.op).Inc()
 		rc.ok = false
+		rc.err = err
 	}
 	return n, err
 }
@@ -0,0 +1,274 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/objstore/s3"
+	"github.com/thanos-io/thanos/pkg/objstore/swift"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// sequentialBucket hides the batched deletes of the wrapped bucket.
+type sequentialBucket struct {
+	objstore.Bucket
+}
+
+func TestDeleteMultiple(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tcase := range []struct {
+		name string
+		// newBucket returns a bucket with deletions of objects prefixed with a/fail failing.
+		newBucket func(t *testing.T, inner objstore.Bucket) objstore.Bucket
+	}{
+		{
+			name: "batched",
+			newBucket: func(t *testing.T, inner objstore.Bucket) objstore.Bucket {
+				bkt, err := objstore.NewFaultyBucket(inner, objstore.FaultRule{Operations: []string{"delete_multiple"}, Prefix: "a/fail", ErrorRate: 1})
+				testutil.Ok(t, err)
+				return bkt
+			},
+		},
+		{
+			name: "sequential",
+			newBucket: func(t *testing.T, inner objstore.Bucket) objstore.Bucket {
+				bkt, err := objstore.NewFaultyBucket(inner, objstore.FaultRule{Operations: []string{"delete"}, Prefix: "a/fail", ErrorRate: 1})
+				testutil.Ok(t, err)
+				return sequentialBucket{Bucket: bkt}
+			},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			inner := inmem.NewBucket()
+			for _, name := range []string{"a/1", "a/2", "a/fail1", "a/fail2", "b/1"} {
+				testutil.Ok(t, inner.Upload(ctx, name, bytes.NewReader([]byte("content"))))
+			}
+			bkt := tcase.newBucket(t, inner)
+
+			testutil.Ok(t, objstore.DeleteMultiple(ctx, bkt, nil))
+			// Objects that do not exist are ignored.
+			testutil.Ok(t, objstore.DeleteMultiple(ctx, bkt, []string{"a/1", "a/missing"}))
+
+			// Failed deletions do not stop the deletion of other objects.
+			err := objstore.DeleteMultiple(ctx, bkt, []string{"a/fail1", "a/2", "a/fail2"})
+			testutil.NotOk(t, err)
+			derr, ok := err.(*objstore.DeleteMultipleError)
+			testutil.Assert(t, ok, "expected delete multiple error, got %v", err)
+			testutil.Equals(t, 2, len(derr.Errs))
+			testutil.Equals(t, objstore.ErrInjected, errors.Cause(derr.Errs["a/fail1"]))
+			testutil.Equals(t, objstore.ErrInjected, errors.Cause(derr.Errs["a/fail2"]))
+
+			testutil.Equals(t, []string{"a/fail1", "a/fail2", "b/1"}, objectNames(inner))
+		})
+	}
+}
+
+func TestDeleteMultipleError(t *testing.T) {
+	err := &objstore.DeleteMultipleError{Errs: map[string]error{"b": errors.New("err b"), "a": errors.New("err a")}}
+	testutil.Equals(t, "delete 2 objects: a: err a; b: err b", err.Error())
+}
+
+func TestUploadWithMetadata(t *testing.T) {
+	ctx := context.Background()
+	md := objstore.ObjectMetadata{ContentType: "application/json", CacheControl: "no-cache"}
+
+	inner := inmem.NewBucket()
+	bkt := objstore.BucketWithMetrics("", objstore.BucketWithTracing(inner), prometheus.NewRegistry())
+
+	// The metadata is passed through the wrapping buckets.
+	testutil.Ok(t, objstore.UploadWithMetadata(ctx, bkt, "a", bytes.NewReader([]byte("content")), md))
+	testutil.Equals(t, md, inner.Metadata("a"))
+
+	// Plain uploads carry no metadata.
+	testutil.Ok(t, bkt.Upload(ctx, "a", bytes.NewReader([]byte("content"))))
+	testutil.Equals(t, objstore.ObjectMetadata{}, inner.Metadata("a"))
+
+	// Buckets not supporting metadata upload the object without it.
+	testutil.Ok(t, objstore.UploadWithMetadata(ctx, sequentialBucket{Bucket: inner}, "b", bytes.NewReader([]byte("content")), md))
+	testutil.Equals(t, []byte("content"), inner.Objects()["b"])
+	testutil.Equals(t, objstore.ObjectMetadata{}, inner.Metadata("b"))
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	md := objstore.ObjectMetadata{ContentType: "application/json", CacheControl: "no-cache"}
+
+	inner := inmem.NewBucket()
+	testutil.Ok(t, inner.UploadWithMetadata(ctx, "a", bytes.NewReader([]byte("content")), md))
+	counting := &getCountingBucket{Bucket: inner, gets: map[string]int{}}
+
+	// Buckets supporting copies copy objects server-side through the wrapping buckets, keeping their metadata.
+	bkt := objstore.BucketWithMetrics("", objstore.BucketWithTracing(inner), prometheus.NewRegistry())
+	testutil.Ok(t, objstore.Copy(ctx, bkt, "a", "b"))
+	testutil.Equals(t, []byte("content"), inner.Objects()["b"])
+	testutil.Equals(t, md, inner.Metadata("b"))
+
+	err := objstore.Copy(ctx, bkt, "missing", "c")
+	testutil.NotOk(t, err)
+	testutil.Assert(t, bkt.IsObjNotFoundErr(err), "expected not found error, got %s", err)
+
+	// Other buckets download and upload the object again.
+	testutil.Ok(t, objstore.Copy(ctx, counting, "a", "c"))
+	testutil.Equals(t, []byte("content"), inner.Objects()["c"])
+	testutil.Equals(t, objstore.ObjectMetadata{}, inner.Metadata("c"))
+	testutil.Equals(t, 1, counting.count("a"))
+
+	// Objects are copied between buckets by downloading and uploading them.
+	other := inmem.NewBucket()
+	testutil.Ok(t, objstore.CopyBetween(ctx, bkt, "a", other, "d"))
+	testutil.Equals(t, []byte("content"), other.Objects()["d"])
+	testutil.Ok(t, objstore.CopyBetween(ctx, inner, "a", inner, "e"))
+	testutil.Equals(t, md, inner.Metadata("e"))
+}
+
+func TestBucketWithMetrics_ResultDuration(t *testing.T) {
+	ctx := context.Background()
+
+	inner := inmem.NewBucket()
+	testutil.Ok(t, inner.Upload(ctx, "a", bytes.NewReader([]byte("content"))))
+	faulty, err := objstore.NewFaultyBucket(inner,
+		objstore.FaultRule{Prefix: "fail/", ErrorRate: 1, Fault: objstore.FaultError},
+		objstore.FaultRule{Prefix: "timeout/", ErrorRate: 1, Fault: objstore.FaultTimeout},
+	)
+	testutil.Ok(t, err)
+
+	reg := prometheus.NewRegistry()
+	bkt := objstore.BucketWithMetrics("test", faulty, reg)
+
+	testutil.Ok(t, bkt.Upload(ctx, "b", bytes.NewReader([]byte("content"))))
+	testutil.NotOk(t, bkt.Upload(ctx, "fail/b", bytes.NewReader([]byte("content"))))
+	testutil.NotOk(t, bkt.Upload(ctx, "timeout/b", bytes.NewReader([]byte("content"))))
+	testutil.Ok(t, bkt.Iter(ctx, "", func(string) error { return nil }))
+
+	rc, err := bkt.Get(ctx, "a")
+	testutil.Ok(t, err)
+	// Reads are only observed once their reader is closed.
+	testutil.Equals(t, uint64(0), resultDurationCount(t, reg, "get", "success"))
+	testutil.Ok(t, rc.Close())
+	_, err = bkt.Get(ctx, "missing")
+	testutil.NotOk(t, err)
+	_, err = bkt.Attributes(ctx, "fail/a")
+	testutil.NotOk(t, err)
+
+	for _, tcase := range []struct {
+		op, result string
+		count      uint64
+	}{
+		{op: "upload", result: "success", count: 1},
+		{op: "upload", result: "failure", count: 1},
+		{op: "upload", result: "canceled", count: 1},
+		{op: "iter", result: "success", count: 1},
+		{op: "get", result: "success", count: 1},
+		{op: "get", result: "not_found", count: 1},
+		{op: "get", result: "failure", count: 0},
+		{op: "attributes", result: "success", count: 0},
+		{op: "attributes", result: "failure", count: 1},
+	} {
+		testutil.Equals(t, tcase.count, resultDurationCount(t, reg, tcase.op, tcase.result), "%s %s", tcase.op, tcase.result)
+	}
+}
+
+// resultDurationCount returns the number of operations observed by the result duration histogram of the bucket.
+func resultDurationCount(t *testing.T, reg *prometheus.Registry, op, result string) uint64 {
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != "thanos_objstore_bucket_operation_result_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			lbls := map[string]string{}
+			for _, l := range m.GetLabel() {
+				lbls[l.GetName()] = l.GetValue()
+			}
+			if lbls["operation"] == op && lbls["result"] == result {
+				return m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+func objectNames(bkt *inmem.Bucket) []string {
+	var names []string
+	for name := range bkt.Objects() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSupportedOperations(t *testing.T) {
+	all := []objstore.Operation{
+		objstore.OpUploadIfNotExists,
+		objstore.OpUploadIfMatch,
+		objstore.OpUploadWithMetadata,
+		objstore.OpDeleteMultiple,
+		objstore.OpIterWithAttributes,
+		objstore.OpCopy,
+	}
+	for _, tcase := range []struct {
+		name     string
+		bkt      objstore.BucketReader
+		expected []objstore.Operation
+	}{
+		{name: "inmem", bkt: inmem.NewBucket(), expected: all},
+		{name: "wrapped inmem", bkt: objstore.BucketWithMetrics("", inmem.NewBucket(), nil), expected: all},
+		{name: "s3", bkt: &s3.Bucket{}, expected: []objstore.Operation{objstore.OpUploadWithMetadata, objstore.OpDeleteMultiple, objstore.OpIterWithAttributes, objstore.OpCopy}},
+		{name: "wrapped swift", bkt: objstore.BucketWithMetrics("", &swift.Container{}, nil)},
+		// Buckets not reporting their operations are inspected for the optional interfaces.
+		{name: "sequential", bkt: sequentialBucket{Bucket: inmem.NewBucket()}},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			testutil.Equals(t, tcase.expected, objstore.SupportedOperations(tcase.bkt))
+		})
+	}
+
+	bkt := objstore.BucketWithMetrics("", &s3.Bucket{}, nil)
+	testutil.Ok(t, objstore.CheckOperations(bkt, objstore.OpDeleteMultiple))
+	err := objstore.CheckOperations(bkt, objstore.OpUploadIfNotExists, objstore.OpDeleteMultiple, objstore.OpUploadIfMatch)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, "bucket does not support the operations upload_if_not_exists, upload_if_match", err.Error())
+}
+
+// sizeBucket records the upfront sizes of uploaded readers, like the S3 and Swift clients need them.
+type sizeBucket struct {
+	objstore.Bucket
+
+	sizes []int64
+}
+
+func (b *sizeBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	size, err := objstore.TryToGetSize(r)
+	if err != nil {
+		return err
+	}
+	b.sizes = append(b.sizes, size)
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestTryToGetSize_WrappedBuckets(t *testing.T) {
+	ctx := context.Background()
+	inner := &sizeBucket{Bucket: inmem.NewBucket()}
+	bkt := objstore.BucketWithOperationLog(log.NewNopLogger(), objstore.BucketWithTracing(inner), false)
+
+	testutil.Ok(t, bkt.Upload(ctx, "obj", strings.NewReader("some content")))
+	testutil.Ok(t, bkt.Upload(ctx, "obj2", bytes.NewBufferString("other")))
+	testutil.Equals(t, []int64{12, 5}, inner.sizes)
+
+	_, err := objstore.TryToGetSize(io.MultiReader(strings.NewReader("unknown")))
+	testutil.NotOk(t, err)
+}
@@ -10,6 +10,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
@@ -38,6 +39,10 @@ func TestObjStore_AcceptanceTest_e2e(t *testing.T) {
 		testutil.NotOk(t, err)
 		testutil.Assert(t, bkt.IsObjNotFoundErr(err), "expected not found error but got %s", err)
 
+		_, err = bkt.Attributes(ctx, "id1/obj_1.some")
+		testutil.NotOk(t, err)
+		testutil.Assert(t, bkt.IsObjNotFoundErr(err), "expected not found error but got %s", err)
+
 		// Upload first object.
 		testutil.Ok(t, bkt.Upload(ctx, "id1/obj_1.some", strings.NewReader("@test-data@")))
 
@@ -54,6 +59,11 @@ func TestObjStore_AcceptanceTest_e2e(t *testing.T) {
 		testutil.Ok(t, err)
 		testutil.Assert(t, sz == 11, "expected size to be equal to 11")
 
+		attrs, err := bkt.Attributes(ctx, "id1/obj_1.some")
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(11), attrs.Size)
+		testutil.Assert(t, !attrs.LastModified.IsZero(), "expected last modified time to be set")
+
 		rc2, err := bkt.GetRange(ctx, "id1/obj_1.some", 1, 3)
 		testutil.Ok(t, err)
 		defer func() { testutil.Ok(t, rc2.Close()) }()
@@ -123,6 +133,29 @@ func TestObjStore_AcceptanceTest_e2e(t *testing.T) {
 		}))
 		testutil.Equals(t, []string{"id1/obj_1.some", "id1/obj_2.some", "id1/obj_3.some"}, seen)
 
+		// Can we iter over items with attributes, both natively if supported and with the fallback to
+		// requesting attributes of every object?
+		for _, b := range []objstore.BucketReader{bkt, bucketReader{BucketReader: bkt}} {
+			seenAttrs := map[string]objstore.ObjectAttributes{}
+			testutil.Ok(t, objstore.IterWithAttributes(ctx, b, "", func(fn string, attrs objstore.ObjectAttributes) error {
+				seenAttrs[fn] = attrs
+				return nil
+			}))
+			testutil.Equals(t, 3, len(seenAttrs))
+			testutil.Equals(t, objstore.ObjectAttributes{}, seenAttrs["id1/"])
+			testutil.Equals(t, objstore.ObjectAttributes{}, seenAttrs["id2/"])
+			testutil.Equals(t, int64(12), seenAttrs["obj_5.some"].Size)
+			testutil.Assert(t, !seenAttrs["obj_5.some"].LastModified.IsZero(), "expected last modified time to be set")
+
+			seen = []string{}
+			testutil.Ok(t, objstore.IterWithAttributes(ctx, b, "id1/", func(fn string, attrs objstore.ObjectAttributes) error {
+				seen = append(seen, fn)
+				testutil.Assert(t, attrs.Size > 0, "expected size of %s to be set", fn)
+				return nil
+			}))
+			testutil.Equals(t, []string{"id1/obj_1.some", "id1/obj_2.some", "id1/obj_3.some"}, seen)
+		}
+
 		// Can we iter over items from not existing dir?
 		testutil.Ok(t, bkt.Iter(ctx, "id0", func(fn string) error {
 			t.Error("Not expected to loop through not existing directory")
@@ -131,6 +164,49 @@ func TestObjStore_AcceptanceTest_e2e(t *testing.T) {
 			return nil
 		}))
 
+		// Can we iter over all objects below a directory recursively, both with and without attributes, and
+		// are directories listed consistently otherwise?
+		testutil.Ok(t, bkt.Upload(ctx, "id2/sub/obj_6.some", strings.NewReader("@test-data6@")))
+		for _, tcase := range []struct {
+			dir       string
+			recursive bool
+			expected  []string
+		}{
+			{dir: "", recursive: true, expected: []string{"id1/obj_1.some", "id1/obj_2.some", "id1/obj_3.some", "id2/obj_4.some", "id2/sub/obj_6.some", "obj_5.some"}},
+			{dir: "id2/", recursive: true, expected: []string{"id2/obj_4.some", "id2/sub/obj_6.some"}},
+			{dir: "id2", recursive: true, expected: []string{"id2/obj_4.some", "id2/sub/obj_6.some"}},
+			{dir: "id2/sub", recursive: true, expected: []string{"id2/sub/obj_6.some"}},
+			{dir: "id0", recursive: true, expected: []string{}},
+			{dir: "id2/", expected: []string{"id2/obj_4.some", "id2/sub/"}},
+		} {
+			var opts []objstore.IterOption
+			if tcase.recursive {
+				opts = append(opts, objstore.WithRecursiveIter)
+			}
+
+			seen = []string{}
+			testutil.Ok(t, bkt.Iter(ctx, tcase.dir, func(fn string) error {
+				seen = append(seen, fn)
+				return nil
+			}, opts...))
+			sort.Strings(seen)
+			testutil.Equals(t, tcase.expected, seen)
+
+			for _, b := range []objstore.BucketReader{bkt, bucketReader{BucketReader: bkt}} {
+				seen = []string{}
+				testutil.Ok(t, objstore.IterWithAttributes(ctx, b, tcase.dir, func(fn string, attrs objstore.ObjectAttributes) error {
+					seen = append(seen, fn)
+					if !strings.HasSuffix(fn, objstore.DirDelim) {
+						testutil.Assert(t, attrs.Size > 0, "expected size of %s to be set", fn)
+					}
+					return nil
+				}, opts...))
+				sort.Strings(seen)
+				testutil.Equals(t, tcase.expected, seen)
+			}
+		}
+		testutil.Ok(t, bkt.Delete(ctx, "id2/sub/obj_6.some"))
+
 		testutil.Ok(t, bkt.Delete(ctx, "id1/obj_2.some"))
 
 		// Delete is expected to fail on non existing object.
@@ -158,3 +234,121 @@ func TestObjStore_AcceptanceTest_e2e(t *testing.T) {
 		testutil.Equals(t, expected, seen)
 	})
 }
+
+// TestObjStore_ConditionalUpload_e2e tests that the conditions of conditional uploads are enforced by all implementations
+// supporting them, and that all others fail with a not supported error.
+func TestObjStore_ConditionalUpload_e2e(t *testing.T) {
+	ForeachStore(t, func(t *testing.T, bkt objstore.Bucket) {
+		ctx := context.Background()
+
+		if _, ok := bkt.(objstore.ConditionalUploader); !ok {
+			err := objstore.UploadIf(ctx, bkt, "lock", strings.NewReader("a"), objstore.UploadCondition{IfNotExists: true})
+			testutil.Equals(t, objstore.ErrConditionalUploadNotSupported, errors.Cause(err))
+			return
+		}
+
+		read := func(name string) string {
+			rc, err := bkt.Get(ctx, name)
+			testutil.Ok(t, err)
+			defer func() { testutil.Ok(t, rc.Close()) }()
+			content, err := ioutil.ReadAll(rc)
+			testutil.Ok(t, err)
+			return string(content)
+		}
+
+		// Conditions that can never be met are rejected.
+		err := objstore.UploadIf(ctx, bkt, "lock", strings.NewReader("a"), objstore.UploadCondition{IfNotExists: true, IfMatch: "etag"})
+		testutil.NotOk(t, err)
+		testutil.Assert(t, !objstore.IsPreconditionFailedErr(err), "expected invalid condition error got %s", err)
+
+		// Only the first of concurrent writers succeeds.
+		testutil.Ok(t, objstore.UploadIf(ctx, bkt, "lock", strings.NewReader("a"), objstore.UploadCondition{IfNotExists: true}))
+		err = objstore.UploadIf(ctx, bkt, "lock", strings.NewReader("b"), objstore.UploadCondition{IfNotExists: true})
+		testutil.NotOk(t, err)
+		testutil.Assert(t, objstore.IsPreconditionFailedErr(err), "expected precondition failed error got %s", err)
+		testutil.Equals(t, "a", read("lock"))
+
+		// Uploads without condition always apply.
+		testutil.Ok(t, objstore.UploadIf(ctx, bkt, "lock", strings.NewReader("c"), objstore.UploadCondition{}))
+		testutil.Equals(t, "c", read("lock"))
+
+		attrs, err := bkt.Attributes(ctx, "lock")
+		testutil.Ok(t, err)
+		if attrs.ETag == "" {
+			err := objstore.UploadIf(ctx, bkt, "lock", strings.NewReader("d"), objstore.UploadCondition{IfMatch: "etag"})
+			testutil.Equals(t, objstore.ErrConditionalUploadNotSupported, errors.Cause(err))
+			return
+		}
+
+		// Uploads of writers having seen the latest version succeed.
+		testutil.Ok(t, objstore.UploadIf(ctx, bkt, "lock", strings.NewReader("d"), objstore.UploadCondition{IfMatch: attrs.ETag}))
+		testutil.Equals(t, "d", read("lock"))
+
+		err = objstore.UploadIf(ctx, bkt, "lock", strings.NewReader("e"), objstore.UploadCondition{IfMatch: attrs.ETag})
+		testutil.NotOk(t, err)
+		testutil.Assert(t, objstore.IsPreconditionFailedErr(err), "expected precondition failed error got %s", err)
+		testutil.Equals(t, "d", read("lock"))
+
+		err = objstore.UploadIf(ctx, bkt, "missing", strings.NewReader("e"), objstore.UploadCondition{IfMatch: attrs.ETag})
+		testutil.NotOk(t, err)
+		testutil.Assert(t, objstore.IsPreconditionFailedErr(err), "expected precondition failed error got %s", err)
+
+		testutil.Ok(t, bkt.Delete(ctx, "lock"))
+	})
+}
+
+// TestObjStore_DeleteMultiple_e2e tests that batched deletes remove all given objects of all implementations,
+// whether they support batched deletes or not.
+func TestObjStore_DeleteMultiple_e2e(t *testing.T) {
+	ForeachStore(t, func(t *testing.T, bkt objstore.Bucket) {
+		ctx := context.Background()
+
+		names := []string{"dir/obj1", "dir/obj2", "dir/sub/obj3", "obj4"}
+		for _, name := range names {
+			testutil.Ok(t, bkt.Upload(ctx, name, strings.NewReader("@test-data@")))
+		}
+
+		// Objects that do not exist are ignored.
+		testutil.Ok(t, objstore.DeleteMultiple(ctx, bkt, append([]string{"dir/missing"}, names[:3]...)))
+		for _, name := range names[:3] {
+			ok, err := bkt.Exists(ctx, name)
+			testutil.Ok(t, err)
+			testutil.Assert(t, !ok, "object %s should be deleted", name)
+		}
+		ok, err := bkt.Exists(ctx, "obj4")
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "object obj4 should not be deleted")
+
+		testutil.Ok(t, bkt.Delete(ctx, "obj4"))
+	})
+}
+
+// TestObjStore_Copy_e2e tests that objects are copied within the bucket by all implementations, whether they
+// support server-side copies or not.
+func TestObjStore_Copy_e2e(t *testing.T) {
+	ForeachStore(t, func(t *testing.T, bkt objstore.Bucket) {
+		ctx := context.Background()
+
+		testutil.Ok(t, bkt.Upload(ctx, "src/obj", strings.NewReader("@test-data@")))
+		testutil.Ok(t, objstore.Copy(ctx, bkt, "src/obj", "dst/obj"))
+
+		rc, err := bkt.Get(ctx, "dst/obj")
+		testutil.Ok(t, err)
+		content, err := ioutil.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, "@test-data@", string(content))
+
+		// The source is kept.
+		ok, err := bkt.Exists(ctx, "src/obj")
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "object src/obj should not be deleted")
+
+		testutil.Ok(t, objstore.DeleteMultiple(ctx, bkt, []string{"src/obj", "dst/obj"}))
+	})
+}
+
+// bucketReader hides all methods of the wrapped bucket not part of the BucketReader interface.
+type bucketReader struct {
+	objstore.BucketReader
+}
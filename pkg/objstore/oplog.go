@@ -0,0 +1,166 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// BucketWithOperationLog takes a bucket and logs every operation run against the bucket with its parameters
+// and result, e.g. to audit the access patterns of a component against a real bucket.
+// If dryRun is true, writes and deletions are logged but not run against the bucket, and reported as successful.
+// The contents of skipped uploads are read and discarded. Reads are always run.
+func BucketWithOperationLog(logger log.Logger, b Bucket, dryRun bool) Bucket {
+	return &opLogBucket{logger: log.With(logger, "bucket", b.Name()), bkt: b, dryRun: dryRun}
+}
+
+type opLogBucket struct {
+	logger log.Logger
+	bkt    Bucket
+	dryRun bool
+}
+
+func (b *opLogBucket) log(op string, err error, keyvals ...interface{}) {
+	keyvals = append([]interface{}{"msg", "bucket operation", "operation", op}, keyvals...)
+	if err != nil {
+		keyvals = append(keyvals, "err", err)
+	}
+	level.Info(b.logger).Log(keyvals...)
+}
+
+// skip logs a write skipped in dry-run mode, after consuming the given reader, if any.
+func (b *opLogBucket) skip(op string, r io.Reader, keyvals ...interface{}) error {
+	if r != nil {
+		n, err := io.Copy(ioutil.Discard, r)
+		if err != nil {
+			err = errors.Wrapf(err, "read contents of skipped %s", op)
+			b.log(op, err, append(keyvals, "dry_run", true)...)
+			return err
+		}
+		keyvals = append(keyvals, "size", n)
+	}
+	b.log(op, nil, append(keyvals, "dry_run", true)...)
+	return nil
+}
+
+func (b *opLogBucket) Iter(ctx context.Context, dir string, f func(name string) error, options ...IterOption) error {
+	err := b.bkt.Iter(ctx, dir, f, options...)
+	b.log(iterOp, err, "dir", dir, "recursive", ApplyIterOptions(options...).Recursive)
+	return err
+}
+
+func (b *opLogBucket) IterWithAttributes(ctx context.Context, dir string, f func(name string, attrs ObjectAttributes) error, options ...IterOption) error {
+	err := IterWithAttributes(ctx, b.bkt, dir, f, options...)
+	b.log(iterAttrOp, err, "dir", dir, "recursive", ApplyIterOptions(options...).Recursive)
+	return err
+}
+
+func (b *opLogBucket) ObjectSize(ctx context.Context, name string) (uint64, error) {
+	size, err := b.bkt.ObjectSize(ctx, name)
+	b.log(sizeOp, err, "name", name, "size", size)
+	return size, err
+}
+
+func (b *opLogBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	attrs, err := b.bkt.Attributes(ctx, name)
+	b.log(attrOp, err, "name", name, "size", attrs.Size)
+	return attrs, err
+}
+
+func (b *opLogBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, err := b.bkt.Get(ctx, name)
+	b.log(getOp, err, "name", name)
+	return rc, err
+}
+
+func (b *opLogBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	rc, err := b.bkt.GetRange(ctx, name, off, length)
+	b.log(getRangeOp, err, "name", name, "offset", off, "length", length)
+	return rc, err
+}
+
+func (b *opLogBucket) Exists(ctx context.Context, name string) (bool, error) {
+	ok, err := b.bkt.Exists(ctx, name)
+	b.log(existsOp, err, "name", name, "exists", ok)
+	return ok, err
+}
+
+func (b *opLogBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if b.dryRun {
+		return b.skip(uploadOp, r, "name", name)
+	}
+	cr := &countingReader{Reader: r}
+	err := b.bkt.Upload(ctx, name, cr)
+	b.log(uploadOp, err, "name", name, "size", cr.n)
+	return err
+}
+
+func (b *opLogBucket) UploadIf(ctx context.Context, name string, r io.Reader, cond UploadCondition) error {
+	if _, ok := b.bkt.(ConditionalUploader); ok && b.dryRun {
+		return b.skip(uploadIfOp, r, "name", name, "if_not_exists", cond.IfNotExists, "if_match", cond.IfMatch)
+	}
+	cr := &countingReader{Reader: r}
+	err := UploadIf(ctx, b.bkt, name, cr, cond)
+	b.log(uploadIfOp, err, "name", name, "if_not_exists", cond.IfNotExists, "if_match", cond.IfMatch, "size", cr.n)
+	return err
+}
+
+func (b *opLogBucket) UploadWithMetadata(ctx context.Context, name string, r io.Reader, md ObjectMetadata) error {
+	if b.dryRun {
+		return b.skip(uploadOp, r, "name", name, "content_type", md.ContentType, "cache_control", md.CacheControl)
+	}
+	cr := &countingReader{Reader: r}
+	err := UploadWithMetadata(ctx, b.bkt, name, cr, md)
+	b.log(uploadOp, err, "name", name, "content_type", md.ContentType, "cache_control", md.CacheControl, "size", cr.n)
+	return err
+}
+
+func (b *opLogBucket) Delete(ctx context.Context, name string) error {
+	if b.dryRun {
+		return b.skip(deleteOp, nil, "name", name)
+	}
+	err := b.bkt.Delete(ctx, name)
+	b.log(deleteOp, err, "name", name)
+	return err
+}
+
+func (b *opLogBucket) DeleteMultiple(ctx context.Context, names []string) error {
+	if b.dryRun {
+		return b.skip(deleteMultipleOp, nil, "names", names)
+	}
+	err := DeleteMultiple(ctx, b.bkt, names)
+	b.log(deleteMultipleOp, err, "names", names)
+	return err
+}
+
+func (b *opLogBucket) Copy(ctx context.Context, src, dst string) error {
+	if b.dryRun {
+		return b.skip(copyOp, nil, "src", src, "dst", dst)
+	}
+	err := Copy(ctx, b.bkt, src, dst)
+	b.log(copyOp, err, "src", src, "dst", dst)
+	return err
+}
+
+func (b *opLogBucket) IsObjNotFoundErr(err error) bool {
+	return b.bkt.IsObjNotFoundErr(err)
+}
+
+func (b *opLogBucket) Close() error {
+	return b.bkt.Close()
+}
+
+func (b *opLogBucket) Name() string {
+	return b.bkt.Name()
+}
+
+func (b *opLogBucket) SupportedOperations() []Operation {
+	return SupportedOperations(b.bkt)
+}
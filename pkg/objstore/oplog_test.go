@@ -0,0 +1,93 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestBucketWithOperationLog(t *testing.T) {
+	ctx := context.Background()
+
+	for _, dryRun := range []bool{false, true} {
+		inner := inmem.NewBucket()
+		testutil.Ok(t, inner.Upload(ctx, "dir/existing", strings.NewReader("existing")))
+
+		var logs bytes.Buffer
+		bkt := objstore.BucketWithOperationLog(log.NewLogfmtLogger(&logs), inner, dryRun)
+
+		// lastLog returns the log line of the last operation and resets the logs.
+		lastLog := func() string {
+			lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+			logs.Reset()
+			return lines[len(lines)-1]
+		}
+
+		testutil.Ok(t, bkt.Upload(ctx, "dir/obj", strings.NewReader("some content")))
+		line := lastLog()
+		testutil.Assert(t, strings.Contains(line, "operation=upload name=dir/obj"), "unexpected log %s", line)
+		testutil.Assert(t, strings.Contains(line, "size=12"), "unexpected log %s", line)
+		testutil.Equals(t, dryRun, strings.Contains(line, "dry_run=true"))
+
+		ok, err := inner.Exists(ctx, "dir/obj")
+		testutil.Ok(t, err)
+		testutil.Equals(t, !dryRun, ok)
+
+		// Reads always pass through.
+		rc, err := bkt.Get(ctx, "dir/existing")
+		testutil.Ok(t, err)
+		b, err := ioutil.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, "existing", string(b))
+		testutil.Assert(t, strings.Contains(lastLog(), "operation=get name=dir/existing"), "get not logged")
+
+		ok, err = bkt.Exists(ctx, "dir/existing")
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "existing object not found")
+		testutil.Assert(t, strings.Contains(lastLog(), "operation=exists name=dir/existing exists=true"), "exists not logged")
+
+		var names []string
+		testutil.Ok(t, bkt.Iter(ctx, "dir/", func(name string) error {
+			names = append(names, name)
+			return nil
+		}))
+		if dryRun {
+			testutil.Equals(t, []string{"dir/existing"}, names)
+		} else {
+			testutil.Equals(t, []string{"dir/existing", "dir/obj"}, names)
+		}
+		testutil.Assert(t, strings.Contains(lastLog(), "operation=iter dir=dir/ recursive=false"), "iter not logged")
+
+		_, err = bkt.Get(ctx, "dir/missing")
+		testutil.NotOk(t, err)
+		testutil.Assert(t, bkt.IsObjNotFoundErr(err), "unexpected error %s", err)
+		testutil.Assert(t, strings.Contains(lastLog(), "err="), "failed get not logged with error")
+
+		testutil.Ok(t, bkt.Delete(ctx, "dir/existing"))
+		line = lastLog()
+		testutil.Assert(t, strings.Contains(line, "operation=delete name=dir/existing"), "unexpected log %s", line)
+		testutil.Equals(t, dryRun, strings.Contains(line, "dry_run=true"))
+
+		testutil.Ok(t, objstore.UploadIf(ctx, bkt, "dir/cond", strings.NewReader("cond"), objstore.UploadCondition{IfNotExists: true}))
+		line = lastLog()
+		testutil.Assert(t, strings.Contains(line, "operation=upload_if name=dir/cond if_not_exists=true"), "unexpected log %s", line)
+
+		ok, err = inner.Exists(ctx, "dir/existing")
+		testutil.Ok(t, err)
+		testutil.Equals(t, dryRun, ok)
+		ok, err = inner.Exists(ctx, "dir/cond")
+		testutil.Ok(t, err)
+		testutil.Equals(t, !dryRun, ok)
+	}
+}
@@ -130,6 +130,26 @@ func (b *Bucket) Delete(ctx context.Context, name string) error {
 	return nil
 }
 
+// Attributes returns the attributes of the specified object.
+func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	m, err := b.bucket.GetObjectMeta(name)
+	if err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	size, err := strconv.ParseInt(m.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return objstore.ObjectAttributes{}, errors.Wrap(err, "convert content-length")
+	}
+	mod, err := http.ParseTime(m.Get("Last-Modified"))
+	if err != nil {
+		return objstore.ObjectAttributes{}, errors.Wrap(err, "parse last-modified")
+	}
+	return objstore.ObjectAttributes{
+		Size:         size,
+		LastModified: mod,
+	}, nil
+}
+
 // ObjectSize returns the size of the specified object.
 func (b *Bucket) ObjectSize(ctx context.Context, name string) (uint64, error) {
 	// refer to https://github.com/aliyun/aliyun-oss-go-sdk/blob/cee409f5b4d75d7ad077cacb7e6f4590a7f2e172/oss/bucket.go#L668.
@@ -181,19 +201,25 @@ func NewBucket(logger log.Logger, conf []byte, component string) (*Bucket, error
 	return bkt, nil
 }
 
-// Iter calls f for each entry in the given directory (not recursive). The argument to f is the full
+// Iter calls f for each entry in the given directory. The argument to f is the full
 // object name including the prefix of the inspected directory.
-func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
 	if dir != "" {
 		dir = strings.TrimSuffix(dir, objstore.DirDelim) + objstore.DirDelim
 	}
 
+	// Recursive listings are not delimited.
+	delimiter := alioss.Delimiter(objstore.DirDelim)
+	if objstore.ApplyIterOptions(options...).Recursive {
+		delimiter = alioss.Delimiter("")
+	}
+
 	marker := alioss.Marker("")
 	for {
 		if err := ctx.Err(); err != nil {
 			return errors.Wrap(err, "context closed while iterating bucket")
 		}
-		objects, err := b.bucket.ListObjects(alioss.Prefix(dir), alioss.Delimiter(objstore.DirDelim), marker)
+		objects, err := b.bucket.ListObjects(alioss.Prefix(dir), delimiter, marker)
 		if err != nil {
 			return errors.Wrap(err, "listing aliyun oss bucket failed")
 		}
@@ -222,6 +248,11 @@ func (b *Bucket) Name() string {
 	return b.name
 }
 
+// SupportedOperations returns the optional operations supported by the bucket, none of which are supported natively.
+func (b *Bucket) SupportedOperations() []objstore.Operation {
+	return nil
+}
+
 func NewTestBucketFromConfig(t testing.TB, c Config, reuseBucket bool) (objstore.Bucket, func(), error) {
 	if c.Bucket == "" {
 		src := rand.NewSource(time.Now().UnixNano())
@@ -26,7 +26,9 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/version"
+	terrors "github.com/prometheus/prometheus/tsdb/errors"
 	"github.com/thanos-io/thanos/pkg/objstore"
+	objcredentials "github.com/thanos-io/thanos/pkg/objstore/credentials"
 	"github.com/thanos-io/thanos/pkg/runutil"
 	"gopkg.in/yaml.v2"
 )
@@ -60,6 +62,8 @@ type Config struct {
 	TraceConfig     TraceConfig       `yaml:"trace"`
 	// PartSize used for multipart upload. Only used if uploaded object size is known and larger than configured PartSize.
 	PartSize uint64 `yaml:"part_size"`
+	// Credentials selects the provider of the credentials instead of access_key and secret_key.
+	Credentials objcredentials.Config `yaml:"credentials"`
 }
 
 type TraceConfig struct {
@@ -105,18 +109,37 @@ func NewBucket(logger log.Logger, conf []byte, component string) (*Bucket, error
 
 // NewBucketWithConfig returns a new Bucket using the provided s3 config values.
 func NewBucketWithConfig(logger log.Logger, config Config, component string) (*Bucket, error) {
-	var chain []credentials.Provider
+	var (
+		chain []credentials.Provider
+		creds *credentials.Credentials
+	)
 
 	if err := validate(config); err != nil {
 		return nil, err
 	}
-	if config.AccessKey != "" {
-		signature := credentials.SignatureV4
-		// TODO(bwplotka): Don't do flags, use actual v2, v4 params.
-		if config.SignatureV2 {
-			signature = credentials.SignatureV2
-		}
+	signature := credentials.SignatureV4
+	// TODO(bwplotka): Don't do flags, use actual v2, v4 params.
+	if config.SignatureV2 {
+		signature = credentials.SignatureV2
+	}
 
+	switch {
+	case config.Credentials.Type == objcredentials.IAM:
+		chain = []credentials.Provider{
+			&credentials.IAM{
+				Client: &http.Client{
+					Transport: http.DefaultTransport,
+				},
+			},
+		}
+	case config.Credentials.Enabled():
+		provided, err := objcredentials.NewCredentials(logger, config.Credentials)
+		if err != nil {
+			return nil, errors.Wrap(err, "initialize s3 credentials")
+		}
+		// Not chained, so that failures to retrieve credentials are returned instead of falling back to anonymous ones.
+		creds = credentials.New(&providedCredentials{creds: provided, signature: signature})
+	case config.AccessKey != "":
 		chain = []credentials.Provider{&credentials.Static{
 			Value: credentials.Value{
 				AccessKeyID:     config.AccessKey,
@@ -124,7 +147,7 @@ func NewBucketWithConfig(logger log.Logger, config Config, component string) (*B
 				SignerType:      signature,
 			},
 		}}
-	} else {
+	default:
 		chain = []credentials.Provider{
 			&credentials.EnvAWS{},
 			&credentials.FileAWSCredentials{},
@@ -136,7 +159,11 @@ func NewBucketWithConfig(logger log.Logger, config Config, component string) (*B
 		}
 	}
 
-	client, err := minio.NewWithCredentials(config.Endpoint, credentials.NewChainCredentials(chain), !config.Insecure, config.Region)
+	if creds == nil {
+		creds = credentials.NewChainCredentials(chain)
+	}
+
+	client, err := minio.NewWithCredentials(config.Endpoint, creds, !config.Insecure, config.Region)
 	if err != nil {
 		return nil, errors.Wrap(err, "initialize s3 client")
 	}
@@ -193,6 +220,16 @@ func (b *Bucket) Name() string {
 	return b.name
 }
 
+// SupportedOperations returns the optional operations supported by the bucket.
+func (b *Bucket) SupportedOperations() []objstore.Operation {
+	return []objstore.Operation{
+		objstore.OpUploadWithMetadata,
+		objstore.OpDeleteMultiple,
+		objstore.OpIterWithAttributes,
+		objstore.OpCopy,
+	}
+}
+
 // validate checks to see the config options are set.
 func validate(conf Config) error {
 	if conf.Endpoint == "" {
@@ -206,9 +243,37 @@ func validate(conf Config) error {
 	if conf.AccessKey != "" && conf.SecretKey == "" {
 		return errors.New("no s3 secret_key specified while access_key is present in config file; either both should be present in config or envvars/IAM should be used.")
 	}
+
+	if conf.Credentials.Enabled() && conf.AccessKey != "" {
+		return errors.New("s3 access_key and secret_key cannot be specified together with a credentials provider")
+	}
 	return nil
 }
 
+// providedCredentials adapts credentials retrieved from a configured provider to the minio client, which retrieves
+// them again once they are due to be refreshed.
+type providedCredentials struct {
+	creds     *objcredentials.Credentials
+	signature credentials.SignatureType
+}
+
+func (c *providedCredentials) Retrieve() (credentials.Value, error) {
+	v, err := c.creds.Get(context.Background())
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	return credentials.Value{
+		AccessKeyID:     v.AccessKey,
+		SecretAccessKey: v.SecretKey,
+		SessionToken:    v.Token,
+		SignerType:      c.signature,
+	}, nil
+}
+
+func (c *providedCredentials) IsExpired() bool {
+	return c.creds.Expired()
+}
+
 // ValidateForTests checks to see the config options for tests are set.
 func ValidateForTests(conf Config) error {
 	if conf.Endpoint == "" ||
@@ -221,14 +286,24 @@ func ValidateForTests(conf Config) error {
 
 // Iter calls f for each entry in the given directory. The argument to f is the full
 // object name including the prefix of the inspected directory.
-func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	return b.IterWithAttributes(ctx, dir, func(name string, _ objstore.ObjectAttributes) error {
+		return f(name)
+	}, options...)
+}
+
+// IterWithAttributes calls f for each entry in the given directory with the entry's attributes
+// returned by the same listing call. The argument to f is the full object name including the
+// prefix of the inspected directory.
+func (b *Bucket) IterWithAttributes(ctx context.Context, dir string, f func(string, objstore.ObjectAttributes) error, options ...objstore.IterOption) error {
 	// Ensure the object name actually ends with a dir suffix. Otherwise we'll just iterate the
 	// object itself as one prefix item.
 	if dir != "" {
 		dir = strings.TrimSuffix(dir, DirDelim) + DirDelim
 	}
 
-	for object := range b.client.ListObjects(b.name, dir, false, ctx.Done()) {
+	recursive := objstore.ApplyIterOptions(options...).Recursive
+	for object := range b.client.ListObjects(b.name, dir, recursive, ctx.Done()) {
 		// Catch the error when failed to list objects.
 		if object.Err != nil {
 			return object.Err
@@ -241,7 +316,10 @@ func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error) err
 		if object.Key == dir {
 			continue
 		}
-		if err := f(object.Key); err != nil {
+		if err := f(object.Key, objstore.ObjectAttributes{
+			Size:         object.Size,
+			LastModified: object.LastModified,
+		}); err != nil {
 			return err
 		}
 	}
@@ -302,6 +380,11 @@ func (b *Bucket) Exists(_ context.Context, name string) (bool, error) {
 
 // Upload the contents of the reader as an object into the bucket.
 func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	return b.UploadWithMetadata(ctx, name, r, objstore.ObjectMetadata{})
+}
+
+// UploadWithMetadata uploads the object with the given content type and cache control.
+func (b *Bucket) UploadWithMetadata(ctx context.Context, name string, r io.Reader, md objstore.ObjectMetadata) error {
 	// TODO(https://github.com/thanos-io/thanos/issues/678): Remove guessing length when minio provider will support multipart upload without this.
 	size, err := objstore.TryToGetSize(r)
 	if err != nil {
@@ -324,6 +407,8 @@ func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
 			PartSize:             partSize,
 			ServerSideEncryption: b.sse,
 			UserMetadata:         b.putUserMetadata,
+			ContentType:          md.ContentType,
+			CacheControl:         md.CacheControl,
 		},
 	); err != nil {
 		return errors.Wrap(err, "upload s3 object")
@@ -332,6 +417,18 @@ func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
 	return nil
 }
 
+// Attributes returns the attributes of the specified object.
+func (b *Bucket) Attributes(_ context.Context, name string) (objstore.ObjectAttributes, error) {
+	objInfo, err := b.client.StatObject(b.name, name, minio.StatObjectOptions{})
+	if err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	return objstore.ObjectAttributes{
+		Size:         objInfo.Size,
+		LastModified: objInfo.LastModified,
+	}, nil
+}
+
 // ObjectSize returns the size of the specified object.
 func (b *Bucket) ObjectSize(_ context.Context, name string) (uint64, error) {
 	objInfo, err := b.client.StatObject(b.name, name, minio.StatObjectOptions{})
@@ -346,6 +443,51 @@ func (b *Bucket) Delete(_ context.Context, name string) error {
 	return b.client.RemoveObject(b.name, name)
 }
 
+// DeleteMultiple removes the objects with the given names using as few DeleteObjects requests as possible,
+// each deleting up to 1000 objects.
+func (b *Bucket) DeleteMultiple(ctx context.Context, names []string) error {
+	objectsCh := make(chan string, len(names))
+	for _, name := range names {
+		objectsCh <- name
+	}
+	close(objectsCh)
+
+	var (
+		errs    = map[string]error{}
+		reqErrs terrors.MultiError
+	)
+	for rerr := range b.client.RemoveObjectsWithContext(ctx, b.name, objectsCh) {
+		switch {
+		case b.IsObjNotFoundErr(rerr.Err):
+		case rerr.ObjectName == "":
+			// Failure of a whole DeleteObjects request.
+			reqErrs.Add(rerr.Err)
+		default:
+			errs[rerr.ObjectName] = rerr.Err
+		}
+	}
+	if err := reqErrs.Err(); err != nil {
+		return errors.Wrap(err, "delete objects")
+	}
+	if len(errs) > 0 {
+		return &objstore.DeleteMultipleError{Errs: errs}
+	}
+	return nil
+}
+
+// Copy copies the object src to dst server-side with a CopyObject request, or multipart copy requests for objects
+// larger than 5GiB. The minio client does not take a context for copies, so ctx is only checked before copying.
+func (b *Bucket) Copy(ctx context.Context, src, dst string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	dstInfo, err := minio.NewDestinationInfo(b.name, dst, b.sse, nil)
+	if err != nil {
+		return errors.Wrapf(err, "copy destination %s", dst)
+	}
+	return b.client.ComposeObject(dstInfo, []minio.SourceInfo{minio.NewSourceInfo(b.name, src, nil)})
+}
+
 // IsObjNotFoundErr returns true if error means that object is not found. Relevant to Get operations.
 func (b *Bucket) IsObjNotFoundErr(err error) bool {
 	return minio.ToErrorResponse(err).Code == "NoSuchKey"
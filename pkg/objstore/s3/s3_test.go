@@ -4,9 +4,19 @@
 package s3
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/thanos-io/thanos/pkg/objstore/credentials"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
 
@@ -136,3 +146,87 @@ http_config:
 	testutil.Ok(t, err)
 	testutil.Assert(t, cfg2.PartSize == 1024*1024*100, "when part size should be set to 100MiB")
 }
+
+func TestValidate_Credentials(t *testing.T) {
+	cfg, err := parseConfig([]byte(`bucket: "bucket-name"
+endpoint: "s3-endpoint"
+credentials:
+  type: VAULT
+  config:
+    address: "http://vault:8200"
+    token: "token"
+    path: "aws/creds/thanos"`))
+	testutil.Ok(t, err)
+	testutil.Ok(t, validate(cfg))
+	testutil.Equals(t, credentials.VAULT, cfg.Credentials.Type)
+
+	cfg.AccessKey, cfg.SecretKey = "access_key", "secret_key"
+	testutil.NotOk(t, validate(cfg))
+}
+
+func TestBucket_RotatedCredentials(t *testing.T) {
+	// Vault issues new credentials with every lease of two seconds.
+	var (
+		mtx    sync.Mutex
+		leases int
+	)
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		leases++
+		fmt.Fprintf(w, `{"lease_duration":2,"data":{"access_key":"key-%d","secret_key":"secret-%d","security_token":"token-%d"}}`, leases, leases, leases)
+	}))
+	defer vault.Close()
+
+	// The object storage records the credentials of the requests to it.
+	var (
+		credentialRe = regexp.MustCompile(`Credential=([^/]+)/`)
+		used         []string
+	)
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		m := credentialRe.FindStringSubmatch(r.Header.Get("Authorization"))
+		if m == nil || r.Header.Get("X-Amz-Security-Token") != "token-"+m[1][len("key-"):] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		used = append(used, m[1])
+		w.Header().Set("Content-Length", "0")
+		w.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+	}))
+	defer s3.Close()
+
+	u, err := url.Parse(s3.URL)
+	testutil.Ok(t, err)
+	cfg := DefaultConfig
+	cfg.Bucket = "bucket"
+	cfg.Endpoint = u.Host
+	cfg.Region = "us-east-1"
+	cfg.Insecure = true
+	cfg.Credentials = credentials.Config{
+		Type:          credentials.VAULT,
+		RefreshBefore: model.Duration(time.Second),
+		Config:        map[string]string{"address": vault.URL, "token": "token", "path": "aws/creds/thanos"},
+	}
+	bkt, err := NewBucketWithConfig(log.NewNopLogger(), cfg, "test")
+	testutil.Ok(t, err)
+
+	ok, err := bkt.Exists(context.Background(), "obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "expected object to exist")
+	ok, err = bkt.Exists(context.Background(), "obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "expected object to exist")
+
+	// Operations continue with new credentials once the current ones are due to be refreshed.
+	time.Sleep(1100 * time.Millisecond)
+	ok, err = bkt.Exists(context.Background(), "obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "expected object to exist")
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	testutil.Equals(t, []string{"key-1", "key-1", "key-2"}, used)
+}
@@ -0,0 +1,290 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// BucketWithStagingCache takes a bucket and stages the objects read with Get in the given local directory, so that
+// later reads of the same objects, e.g. by the next operation downloading the same block, are served from disk.
+// Only the objects for which stage returns true are staged; they must not change while staged, as only writes through
+// the returned bucket invalidate them. Staged objects are served for the given TTL at most, and the least recently
+// used objects are evicted once the staged objects are larger than maxSize. The directory is emptied on creation.
+func BucketWithStagingCache(logger log.Logger, reg prometheus.Registerer, b Bucket, dir string, maxSize int64, ttl time.Duration, stage func(name string) bool) (Bucket, error) {
+	if maxSize <= 0 {
+		return nil, errors.Errorf("staging cache size must be positive (got %d)", maxSize)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, errors.Wrap(err, "clean staging dir")
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, errors.Wrap(err, "create staging dir")
+	}
+
+	return &stagingBucket{
+		logger:  logger,
+		bkt:     b,
+		dir:     dir,
+		maxSize: maxSize,
+		ttl:     ttl,
+		stage:   stage,
+		now:     time.Now,
+		lru:     list.New(),
+		objects: map[string]*list.Element{},
+		requests: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_objstore_staging_cache_requests_total",
+			Help: "Total number of reads of objects that are staged in the local staging cache.",
+		}),
+		hits: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_objstore_staging_cache_hits_total",
+			Help: "Total number of reads of objects served from the local staging cache.",
+		}),
+		evictions: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_objstore_staging_cache_evictions_total",
+			Help: "Total number of objects evicted from the local staging cache to stay within its size.",
+		}),
+		sizeBytes: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_objstore_staging_cache_size_bytes",
+			Help: "Size of the objects in the local staging cache.",
+		}),
+	}, nil
+}
+
+type stagingBucket struct {
+	logger  log.Logger
+	bkt     Bucket
+	dir     string
+	maxSize int64
+	ttl     time.Duration
+	stage   func(name string) bool
+	now     func() time.Time
+
+	mtx     sync.Mutex
+	size    int64
+	lru     *list.List
+	objects map[string]*list.Element
+
+	requests  prometheus.Counter
+	hits      prometheus.Counter
+	evictions prometheus.Counter
+	sizeBytes prometheus.Gauge
+}
+
+type stagedObject struct {
+	name   string
+	path   string
+	size   int64
+	staged time.Time
+}
+
+// open opens the staged file of the given object, or returns nil if the object is not staged.
+func (b *stagingBucket) open(name string) *os.File {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	e, ok := b.objects[name]
+	if !ok {
+		return nil
+	}
+	o := e.Value.(*stagedObject)
+	if b.ttl > 0 && b.now().Sub(o.staged) > b.ttl {
+		b.remove(e)
+		return nil
+	}
+	// Removed files stay readable while open, so evictions do not affect running reads.
+	f, err := os.Open(o.path)
+	if err != nil {
+		level.Warn(b.logger).Log("msg", "failed to open staged object", "name", name, "err", err)
+		b.remove(e)
+		return nil
+	}
+	b.lru.MoveToFront(e)
+	return f
+}
+
+// add adds the staged file of an object, evicting the least recently used objects to stay within the size.
+func (b *stagingBucket) add(name, path string, size int64) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if e, ok := b.objects[name]; ok {
+		b.remove(e)
+	}
+	b.objects[name] = b.lru.PushFront(&stagedObject{name: name, path: path, size: size, staged: b.now()})
+	b.size += size
+	for b.size > b.maxSize {
+		b.remove(b.lru.Back())
+		b.evictions.Inc()
+	}
+	b.sizeBytes.Set(float64(b.size))
+}
+
+// invalidate removes the given object from the staging cache, if staged.
+func (b *stagingBucket) invalidate(names ...string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for _, name := range names {
+		if e, ok := b.objects[name]; ok {
+			b.remove(e)
+		}
+	}
+	b.sizeBytes.Set(float64(b.size))
+}
+
+// remove removes the given element. It must be called with the lock held.
+func (b *stagingBucket) remove(e *list.Element) {
+	o := b.lru.Remove(e).(*stagedObject)
+	delete(b.objects, o.name)
+	b.size -= o.size
+	if err := os.Remove(o.path); err != nil && !os.IsNotExist(err) {
+		level.Warn(b.logger).Log("msg", "failed to remove staged object", "name", o.name, "err", err)
+	}
+}
+
+func (b *stagingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if !b.stage(name) {
+		return b.bkt.Get(ctx, name)
+	}
+	b.requests.Inc()
+	if f := b.open(name); f != nil {
+		b.hits.Inc()
+		return f, nil
+	}
+
+	rc, err := b.bkt.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer runutil.CloseWithLogOnErr(b.logger, rc, "staged object reader")
+
+	f, err := ioutil.TempFile(b.dir, "staged-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create staging file")
+	}
+	size, err := io.Copy(f, rc)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		runutil.CloseWithLogOnErr(b.logger, f, "staging file")
+		if rerr := os.Remove(f.Name()); rerr != nil {
+			level.Warn(b.logger).Log("msg", "failed to remove staging file", "file", f.Name(), "err", rerr)
+		}
+		return nil, errors.Wrapf(err, "stage object %s", name)
+	}
+	// Objects larger than the cache are evicted right away, after they were read from the open file.
+	b.add(name, f.Name(), size)
+	return f, nil
+}
+
+func (b *stagingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if !b.stage(name) {
+		return b.bkt.GetRange(ctx, name, off, length)
+	}
+	b.requests.Inc()
+	f := b.open(name)
+	if f == nil {
+		// Ranges are only read from the staged objects, as staging would download the whole object.
+		return b.bkt.GetRange(ctx, name, off, length)
+	}
+	b.hits.Inc()
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		runutil.CloseWithLogOnErr(b.logger, f, "staged object")
+		return nil, errors.Wrapf(err, "seek staged object %s", name)
+	}
+	if length == -1 {
+		return f, nil
+	}
+	return &stagedRangeReader{Reader: io.LimitReader(f, length), f: f}, nil
+}
+
+type stagedRangeReader struct {
+	io.Reader
+	f *os.File
+}
+
+func (r *stagedRangeReader) Close() error {
+	return r.f.Close()
+}
+
+func (b *stagingBucket) Iter(ctx context.Context, dir string, f func(name string) error, options ...IterOption) error {
+	return b.bkt.Iter(ctx, dir, f, options...)
+}
+
+func (b *stagingBucket) IterWithAttributes(ctx context.Context, dir string, f func(name string, attrs ObjectAttributes) error, options ...IterOption) error {
+	return IterWithAttributes(ctx, b.bkt, dir, f, options...)
+}
+
+func (b *stagingBucket) ObjectSize(ctx context.Context, name string) (uint64, error) {
+	return b.bkt.ObjectSize(ctx, name)
+}
+
+func (b *stagingBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	return b.bkt.Attributes(ctx, name)
+}
+
+func (b *stagingBucket) Exists(ctx context.Context, name string) (bool, error) {
+	return b.bkt.Exists(ctx, name)
+}
+
+func (b *stagingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.invalidate(name)
+	return b.bkt.Upload(ctx, name, r)
+}
+
+func (b *stagingBucket) UploadIf(ctx context.Context, name string, r io.Reader, cond UploadCondition) error {
+	b.invalidate(name)
+	return UploadIf(ctx, b.bkt, name, r, cond)
+}
+
+func (b *stagingBucket) UploadWithMetadata(ctx context.Context, name string, r io.Reader, md ObjectMetadata) error {
+	b.invalidate(name)
+	return UploadWithMetadata(ctx, b.bkt, name, r, md)
+}
+
+func (b *stagingBucket) Delete(ctx context.Context, name string) error {
+	b.invalidate(name)
+	return b.bkt.Delete(ctx, name)
+}
+
+func (b *stagingBucket) DeleteMultiple(ctx context.Context, names []string) error {
+	b.invalidate(names...)
+	return DeleteMultiple(ctx, b.bkt, names)
+}
+
+func (b *stagingBucket) Copy(ctx context.Context, src, dst string) error {
+	b.invalidate(dst)
+	return Copy(ctx, b.bkt, src, dst)
+}
+
+func (b *stagingBucket) IsObjNotFoundErr(err error) bool {
+	return b.bkt.IsObjNotFoundErr(err)
+}
+
+func (b *stagingBucket) Close() error {
+	return b.bkt.Close()
+}
+
+func (b *stagingBucket) Name() string {
+	return b.bkt.Name()
+}
+
+func (b *stagingBucket) SupportedOperations() []Operation {
+	return SupportedOperations(b.bkt)
+}
@@ -0,0 +1,185 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// getCountingBucket counts the reads of every object.
+type getCountingBucket struct {
+	objstore.Bucket
+
+	mtx  sync.Mutex
+	gets map[string]int
+}
+
+func (b *getCountingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.mtx.Lock()
+	b.gets[name]++
+	b.mtx.Unlock()
+	return b.Bucket.Get(ctx, name)
+}
+
+func (b *getCountingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	b.mtx.Lock()
+	b.gets[name]++
+	b.mtx.Unlock()
+	return b.Bucket.GetRange(ctx, name, off, length)
+}
+
+func (b *getCountingBucket) count(name string) int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.gets[name]
+}
+
+func TestBucketWithStagingCache(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-staging-cache")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	const blockID = "01DTVP434PA9VFXSW2JKB3392D"
+	var (
+		index  = path.Join(blockID, "index")
+		chunks = path.Join(blockID, "chunks", "000001")
+		meta   = path.Join(blockID, "meta.json")
+	)
+	inner := &getCountingBucket{Bucket: inmem.NewBucket(), gets: map[string]int{}}
+	testutil.Ok(t, inner.Upload(ctx, index, strings.NewReader("index-content")))
+	testutil.Ok(t, inner.Upload(ctx, chunks, strings.NewReader("chunks-content")))
+	testutil.Ok(t, inner.Upload(ctx, meta, strings.NewReader("{}")))
+
+	reg := prometheus.NewRegistry()
+	bkt, err := objstore.BucketWithStagingCache(log.NewNopLogger(), reg, inner, filepath.Join(tmpDir, "staging"), 1024, time.Hour, func(name string) bool {
+		return path.Base(name) != "meta.json"
+	})
+	testutil.Ok(t, err)
+
+	download := func(dir string) {
+		dst := filepath.Join(tmpDir, dir)
+		testutil.Ok(t, objstore.DownloadDir(ctx, log.NewNopLogger(), bkt, blockID, dst))
+		b, err := ioutil.ReadFile(filepath.Join(dst, "index"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, "index-content", string(b))
+		b, err = ioutil.ReadFile(filepath.Join(dst, "chunks", "000001"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, "chunks-content", string(b))
+	}
+
+	// The second operation downloading the block reuses the staged index and chunks.
+	download("compact")
+	download("downsample")
+	testutil.Equals(t, 1, inner.count(index))
+	testutil.Equals(t, 1, inner.count(chunks))
+	testutil.Equals(t, 2, inner.count(meta))
+	testutil.Ok(t, promtest.GatherAndCompare(reg, strings.NewReader(`
+# HELP thanos_objstore_staging_cache_hits_total Total number of reads of objects served from the local staging cache.
+# TYPE thanos_objstore_staging_cache_hits_total counter
+thanos_objstore_staging_cache_hits_total 2
+# HELP thanos_objstore_staging_cache_requests_total Total number of reads of objects that are staged in the local staging cache.
+# TYPE thanos_objstore_staging_cache_requests_total counter
+thanos_objstore_staging_cache_requests_total 4
+# HELP thanos_objstore_staging_cache_size_bytes Size of the objects in the local staging cache.
+# TYPE thanos_objstore_staging_cache_size_bytes gauge
+thanos_objstore_staging_cache_size_bytes 27
+`), "thanos_objstore_staging_cache_hits_total", "thanos_objstore_staging_cache_requests_total", "thanos_objstore_staging_cache_size_bytes"))
+
+	// Ranges are read from staged objects.
+	rc, err := bkt.GetRange(ctx, index, 6, 3)
+	testutil.Ok(t, err)
+	b, err := ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "con", string(b))
+	testutil.Equals(t, 1, inner.count(index))
+
+	// Writes through the bucket invalidate the staged objects.
+	testutil.Ok(t, bkt.Upload(ctx, index, strings.NewReader("new-index-content")))
+	rc, err = bkt.Get(ctx, index)
+	testutil.Ok(t, err)
+	b, err = ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "new-index-content", string(b))
+	testutil.Equals(t, 2, inner.count(index))
+
+	testutil.Ok(t, bkt.Delete(ctx, chunks))
+	_, err = bkt.Get(ctx, chunks)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, bkt.IsObjNotFoundErr(err), "expected not found error, got %s", err)
+}
+
+func TestBucketWithStagingCache_Eviction(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-staging-cache-eviction")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	inner := &getCountingBucket{Bucket: inmem.NewBucket(), gets: map[string]int{}}
+	for _, name := range []string{"a", "b", "c"} {
+		testutil.Ok(t, inner.Upload(ctx, name, strings.NewReader("0123456789")))
+	}
+
+	bkt, err := objstore.BucketWithStagingCache(log.NewNopLogger(), nil, inner, tmpDir, 20, 200*time.Millisecond, func(string) bool { return true })
+	testutil.Ok(t, err)
+
+	get := func(name string) {
+		rc, err := bkt.Get(ctx, name)
+		testutil.Ok(t, err)
+		b, err := ioutil.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, "0123456789", string(b))
+	}
+
+	// Only two objects fit, so the least recently used one is evicted.
+	get("a")
+	get("b")
+	get("a")
+	get("c")
+	get("a")
+	testutil.Equals(t, 1, inner.count("a"))
+	get("b")
+	testutil.Equals(t, 2, inner.count("b"))
+
+	// Staged objects expire after the TTL.
+	time.Sleep(300 * time.Millisecond)
+	get("b")
+	testutil.Equals(t, 3, inner.count("b"))
+
+	// Objects larger than the cache are not kept.
+	testutil.Ok(t, inner.Upload(ctx, "large", strings.NewReader(strings.Repeat("x", 21))))
+	for i := 0; i < 2; i++ {
+		rc, err := bkt.Get(ctx, "large")
+		testutil.Ok(t, err)
+		b, err := ioutil.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, 21, len(b))
+	}
+	testutil.Equals(t, 2, inner.count("large"))
+
+	_, err = objstore.BucketWithStagingCache(log.NewNopLogger(), nil, inner, tmpDir, 0, time.Hour, nil)
+	testutil.NotOk(t, err)
+}
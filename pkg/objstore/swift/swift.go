@@ -5,14 +5,19 @@
 package swift
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
 	"github.com/gophercloud/gophercloud/openstack/objectstorage/v1/containers"
@@ -41,12 +46,24 @@ type SwiftConfig struct {
 	ProjectDomainName string `yaml:"project_domain_name"`
 	RegionName        string `yaml:"region_name"`
 	ContainerName     string `yaml:"container_name"`
+	// LargeObjectSegmentSize enables uploading objects larger than it as Static Large Objects, split into
+	// segments of at most this size. Disabled if 0.
+	LargeObjectSegmentSize int64 `yaml:"large_object_segment_size"`
+	// LargeObjectSegmentsContainer is the container the segments of large objects are uploaded to.
+	// Defaults to the container name with a "_segments" suffix.
+	LargeObjectSegmentsContainer string `yaml:"large_object_segments_container"`
 }
 
+// maxObjectSize is the default maximum size of a single object in Swift, 5GiB.
+const maxObjectSize = 5 * 1024 * 1024 * 1024
+
 type Container struct {
 	logger log.Logger
 	client *gophercloud.ServiceClient
 	name   string
+
+	segmentSize       int64
+	segmentsContainer string
 }
 
 func NewContainer(logger log.Logger, conf []byte) (*Container, error) {
@@ -72,10 +89,17 @@ func NewContainer(logger log.Logger, conf []byte) (*Container, error) {
 		return nil, err
 	}
 
+	segmentsContainer := sc.LargeObjectSegmentsContainer
+	if segmentsContainer == "" {
+		segmentsContainer = sc.ContainerName + "_segments"
+	}
+
 	return &Container{
-		logger: logger,
-		client: client,
-		name:   sc.ContainerName,
+		logger:            logger,
+		client:            client,
+		name:              sc.ContainerName,
+		segmentSize:       sc.LargeObjectSegmentSize,
+		segmentsContainer: segmentsContainer,
 	}, nil
 }
 
@@ -84,17 +108,26 @@ func (c *Container) Name() string {
 	return c.name
 }
 
+// SupportedOperations returns the optional operations supported by the container, none of which are supported natively.
+func (c *Container) SupportedOperations() []objstore.Operation {
+	return nil
+}
+
 // Iter calls f for each entry in the given directory. The argument to f is the full
 // object name including the prefix of the inspected directory.
-func (c *Container) Iter(ctx context.Context, dir string, f func(string) error) error {
+func (c *Container) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
 	// Ensure the object name actually ends with a dir suffix. Otherwise we'll just iterate the
 	// object itself as one prefix item.
 	if dir != "" {
 		dir = strings.TrimSuffix(dir, DirDelim) + DirDelim
 	}
 
-	options := &objects.ListOpts{Full: false, Prefix: dir, Delimiter: DirDelim}
-	return objects.List(c.client, c.name, options).EachPage(func(page pagination.Page) (bool, error) {
+	listOpts := &objects.ListOpts{Full: false, Prefix: dir, Delimiter: DirDelim}
+	if objstore.ApplyIterOptions(options...).Recursive {
+		// Recursive listings are not delimited.
+		listOpts.Delimiter = ""
+	}
+	return objects.List(c.client, c.name, listOpts).EachPage(func(page pagination.Page) (bool, error) {
 		objectNames, err := objects.ExtractNames(page)
 		if err != nil {
 			return false, err
@@ -128,6 +161,19 @@ func (c *Container) GetRange(ctx context.Context, name string, off, length int64
 	return response.Body, response.Err
 }
 
+// Attributes returns the attributes of the specified object.
+func (c *Container) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	response := objects.Get(c.client, c.name, name, nil)
+	headers, err := response.Extract()
+	if err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	return objstore.ObjectAttributes{
+		Size:         headers.ContentLength,
+		LastModified: headers.LastModified,
+	}, nil
+}
+
 // ObjectSize returns the size of the specified object.
 func (c *Container) ObjectSize(ctx context.Context, name string) (uint64, error) {
 	response := objects.Get(c.client, c.name, name, nil)
@@ -159,14 +205,100 @@ func (c *Container) IsObjNotFoundErr(err error) bool {
 }
 
 // Upload writes the contents of the reader as an object into the container.
+// If large objects are enabled, objects larger than the segment size are uploaded as Static Large Objects,
+// given their size can be determined upfront.
 func (c *Container) Upload(ctx context.Context, name string, r io.Reader) error {
+	if c.segmentSize > 0 {
+		if size, err := objstore.TryToGetSize(r); err == nil && size > c.segmentSize {
+			return c.uploadLargeObject(name, r, size)
+		}
+	}
 	options := &objects.CreateOpts{Content: r}
 	res := objects.Create(c.client, c.name, name, options)
 	return res.Err
 }
 
+// sloSegment is an entry of a Static Large Object manifest.
+type sloSegment struct {
+	Path      string `json:"path"`
+	Etag      string `json:"etag"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// uploadLargeObject uploads the contents of the reader as segments into the segments container, followed by
+// the manifest referencing them. The object only becomes visible once the manifest is uploaded.
+func (c *Container) uploadLargeObject(name string, r io.Reader, size int64) (err error) {
+	if err := containers.Create(c.client, c.segmentsContainer, nil).Err; err != nil {
+		return errors.Wrapf(err, "create segments container %s", c.segmentsContainer)
+	}
+
+	var (
+		prefix   = fmt.Sprintf("%s/slo/%d/%d/%d", name, time.Now().UnixNano(), size, c.segmentSize)
+		manifest []sloSegment
+	)
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, s := range manifest {
+			segment := strings.TrimPrefix(s.Path, "/"+c.segmentsContainer+"/")
+			if derr := objects.Delete(c.client, c.segmentsContainer, segment, nil).Err; derr != nil {
+				level.Warn(c.logger).Log("msg", "failed to delete segment of failed upload", "segment", segment, "err", derr)
+			}
+		}
+	}()
+
+	// Segments of files are read as sections, so that their checksum is calculated without buffering them.
+	ra, isReaderAt := r.(io.ReaderAt)
+	for off, i := int64(0), 0; off < size; off, i = off+c.segmentSize, i+1 {
+		length := c.segmentSize
+		if off+length > size {
+			length = size - off
+		}
+		var content io.Reader = io.LimitReader(r, length)
+		if isReaderAt {
+			content = io.NewSectionReader(ra, off, length)
+		}
+
+		segment := fmt.Sprintf("%s/%08d", prefix, i)
+		res, err := objects.Create(c.client, c.segmentsContainer, segment, &objects.CreateOpts{Content: content}).Extract()
+		if err != nil {
+			return errors.Wrapf(err, "upload segment %s", segment)
+		}
+		manifest = append(manifest, sloSegment{
+			Path:      "/" + path.Join(c.segmentsContainer, segment),
+			Etag:      strings.Trim(res.ETag, `"`),
+			SizeBytes: length,
+		})
+	}
+
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "marshal manifest")
+	}
+	if err := objects.Create(c.client, c.name, name, &objects.CreateOpts{
+		Content:           bytes.NewReader(b),
+		MultipartManifest: "put",
+		// The ETag of a manifest is the checksum of the concatenated ETags of its segments, not of its content.
+		NoETag: true,
+	}).Err; err != nil {
+		return errors.Wrap(err, "upload manifest")
+	}
+	return nil
+}
+
 // Delete removes the object with the given name.
+// The segments of large objects are removed together with their manifest.
 func (c *Container) Delete(ctx context.Context, name string) error {
+	if c.segmentSize > 0 {
+		headers, err := objects.Get(c.client, c.name, name, nil).Extract()
+		if err != nil {
+			return err
+		}
+		if headers.StaticLargeObject {
+			return objects.Delete(c.client, c.name, name, objects.DeleteOpts{MultipartManifest: "delete"}).Err
+		}
+	}
 	return objects.Delete(c.client, c.name, name, nil).Err
 }
 
@@ -177,8 +309,13 @@ func (*Container) Close() error {
 
 func parseConfig(conf []byte) (*SwiftConfig, error) {
 	var sc SwiftConfig
-	err := yaml.UnmarshalStrict(conf, &sc)
-	return &sc, err
+	if err := yaml.UnmarshalStrict(conf, &sc); err != nil {
+		return nil, err
+	}
+	if sc.LargeObjectSegmentSize < 0 || sc.LargeObjectSegmentSize > maxObjectSize {
+		return nil, errors.Errorf("large_object_segment_size must be between 0 and %d bytes", int64(maxObjectSize))
+	}
+	return &sc, nil
 }
 
 func authOptsFromConfig(sc *SwiftConfig) (gophercloud.AuthOptions, error) {
@@ -4,8 +4,22 @@
 package swift
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/gophercloud/gophercloud"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
 
@@ -53,3 +67,196 @@ func TestAuthOptsFromConfig(t *testing.T) {
 	testutil.Equals(t, "projectDomain", authOpts.Scope.DomainName)
 	testutil.Equals(t, "thanosProject", authOpts.Scope.ProjectName)
 }
+
+func TestParseConfig_LargeObjectSegmentSize(t *testing.T) {
+	cfg, err := parseConfig([]byte(`large_object_segment_size: 1073741824`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(1073741824), cfg.LargeObjectSegmentSize)
+
+	_, err = parseConfig([]byte(`large_object_segment_size: -1`))
+	testutil.NotOk(t, err)
+
+	_, err = parseConfig([]byte(`large_object_segment_size: 5368709121`))
+	testutil.NotOk(t, err)
+}
+
+// swiftEmulator is a minimal in-memory emulation of the Swift object API including Static Large Objects.
+type swiftEmulator struct {
+	mtx       sync.Mutex
+	objects   map[string][]byte
+	manifests map[string][]sloSegment
+	// puts records the paths of all uploaded objects in order.
+	puts []string
+}
+
+func newSwiftEmulator() *swiftEmulator {
+	return &swiftEmulator{objects: map[string][]byte{}, manifests: map[string][]sloSegment{}}
+}
+
+func md5Hex(b []byte) string {
+	sum := md5.Sum(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func (e *swiftEmulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	p := r.URL.Path
+	if strings.Count(p, "/") == 1 {
+		// Container request.
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		e.puts = append(e.puts, p)
+
+		if r.URL.Query().Get("multipart-manifest") != "put" {
+			if etag := r.Header.Get("ETag"); etag != "" && etag != md5Hex(b) {
+				http.Error(w, "etag mismatch", http.StatusUnprocessableEntity)
+				return
+			}
+			e.objects[p] = b
+			delete(e.manifests, p)
+			w.Header().Set("ETag", md5Hex(b))
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		var (
+			manifest []sloSegment
+			content  []byte
+			etags    string
+		)
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, s := range manifest {
+			seg, ok := e.objects[s.Path]
+			if !ok || int64(len(seg)) != s.SizeBytes || md5Hex(seg) != s.Etag {
+				http.Error(w, "invalid segment "+s.Path, http.StatusBadRequest)
+				return
+			}
+			content = append(content, seg...)
+			etags += s.Etag
+		}
+		if etag := r.Header.Get("ETag"); etag != "" && etag != md5Hex([]byte(etags)) {
+			http.Error(w, "etag mismatch", http.StatusUnprocessableEntity)
+			return
+		}
+		e.objects[p] = content
+		e.manifests[p] = manifest
+		w.WriteHeader(http.StatusCreated)
+
+	case http.MethodGet, http.MethodHead:
+		b, ok := e.objects[p]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if _, ok := e.manifests[p]; ok {
+			w.Header().Set("X-Static-Large-Object", "True")
+		}
+		w.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+
+	case http.MethodDelete:
+		if _, ok := e.objects[p]; !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		manifest, isSLO := e.manifests[p]
+		if r.URL.Query().Get("multipart-manifest") == "delete" {
+			if !isSLO {
+				http.Error(w, "Not an SLO manifest", http.StatusBadRequest)
+				return
+			}
+			for _, s := range manifest {
+				delete(e.objects, s.Path)
+			}
+		}
+		delete(e.objects, p)
+		delete(e.manifests, p)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestContainer_LargeObjects(t *testing.T) {
+	e := newSwiftEmulator()
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	c := &Container{
+		logger:            log.NewNopLogger(),
+		client:            &gophercloud.ServiceClient{ProviderClient: &gophercloud.ProviderClient{}, Endpoint: srv.URL + "/"},
+		name:              "thanos",
+		segmentSize:       10,
+		segmentsContainer: "thanos_segments",
+	}
+	ctx := context.Background()
+	content := "0123456789abcdefghijklmnopqrstu"
+
+	for _, tcase := range []struct {
+		name string
+		r    io.Reader
+	}{
+		{name: "sections", r: strings.NewReader(content)},
+		{name: "stream", r: bytes.NewBufferString(content)},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			e.puts = nil
+			testutil.Ok(t, c.Upload(ctx, "dir/obj", tcase.r))
+
+			// Segments are uploaded first, the manifest last.
+			testutil.Equals(t, 5, len(e.puts))
+			for _, p := range e.puts[:4] {
+				testutil.Assert(t, strings.HasPrefix(p, "/thanos_segments/dir/obj/slo/"), "unexpected segment path %s", p)
+			}
+			testutil.Equals(t, "/thanos/dir/obj", e.puts[4])
+			testutil.Equals(t, 4, len(e.manifests["/thanos/dir/obj"]))
+
+			rc, err := c.Get(ctx, "dir/obj")
+			testutil.Ok(t, err)
+			b, err := ioutil.ReadAll(rc)
+			testutil.Ok(t, err)
+			testutil.Ok(t, rc.Close())
+			testutil.Equals(t, content, string(b))
+
+			rc, err = c.GetRange(ctx, "dir/obj", 8, 5)
+			testutil.Ok(t, err)
+			b, err = ioutil.ReadAll(rc)
+			testutil.Ok(t, err)
+			testutil.Ok(t, rc.Close())
+			testutil.Equals(t, content[8:13], string(b))
+
+			size, err := c.ObjectSize(ctx, "dir/obj")
+			testutil.Ok(t, err)
+			testutil.Equals(t, uint64(len(content)), size)
+
+			// Deleting the manifest deletes the segments.
+			testutil.Ok(t, c.Delete(ctx, "dir/obj"))
+			testutil.Equals(t, 0, len(e.objects))
+		})
+	}
+
+	t.Run("small object", func(t *testing.T) {
+		e.puts = nil
+		testutil.Ok(t, c.Upload(ctx, "dir/small", strings.NewReader(content[:10])))
+		testutil.Equals(t, []string{"/thanos/dir/small"}, e.puts)
+		testutil.Equals(t, 0, len(e.manifests))
+
+		testutil.Ok(t, c.Delete(ctx, "dir/small"))
+		testutil.Equals(t, 0, len(e.objects))
+	})
+}
@@ -0,0 +1,186 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// OperationTimeouts are the timeouts of the operations against a bucket by type of operation. Zero disables the
+// timeout of a type of operation.
+type OperationTimeouts struct {
+	// Metadata is the timeout of ObjectSize, Attributes and Exists operations.
+	Metadata time.Duration
+	// Iter is the timeout of Iter and IterWithAttributes operations, including the calls of the given function.
+	Iter time.Duration
+	// Read is the timeout of Get and GetRange operations, until the returned reader is closed.
+	Read time.Duration
+	// Write is the timeout of uploads and copies.
+	Write time.Duration
+	// Delete is the timeout of Delete and DeleteMultiple operations.
+	Delete time.Duration
+}
+
+// BucketWithTimeouts takes a bucket and runs every operation against it with a context deadline set by the timeout
+// of its type of operation, so that small metadata requests can fail fast without cutting off large transfers.
+// Operations exceeding their timeout fail with an error whose cause is context.DeadlineExceeded.
+func BucketWithTimeouts(b Bucket, timeouts OperationTimeouts) Bucket {
+	return &timeoutBucket{bkt: b, timeouts: timeouts}
+}
+
+type timeoutBucket struct {
+	bkt      Bucket
+	timeouts OperationTimeouts
+}
+
+// withTimeout returns the context of an operation with the given timeout, if any.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timeoutErr annotates the error of an operation that failed because its own timeout was exceeded.
+func timeoutErr(ctx context.Context, err error, op string, timeout time.Duration) error {
+	if err != nil && timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+		return errors.Wrapf(err, "%s operation exceeded timeout of %s", op, timeout)
+	}
+	return err
+}
+
+func (b *timeoutBucket) Iter(ctx context.Context, dir string, f func(name string) error, options ...IterOption) error {
+	ctx, cancel := withTimeout(ctx, b.timeouts.Iter)
+	defer cancel()
+
+	return timeoutErr(ctx, b.bkt.Iter(ctx, dir, f, options...), iterOp, b.timeouts.Iter)
+}
+
+func (b *timeoutBucket) IterWithAttributes(ctx context.Context, dir string, f func(name string, attrs ObjectAttributes) error, options ...IterOption) error {
+	ctx, cancel := withTimeout(ctx, b.timeouts.Iter)
+	defer cancel()
+
+	return timeoutErr(ctx, IterWithAttributes(ctx, b.bkt, dir, f, options...), iterAttrOp, b.timeouts.Iter)
+}
+
+func (b *timeoutBucket) ObjectSize(ctx context.Context, name string) (uint64, error) {
+	ctx, cancel := withTimeout(ctx, b.timeouts.Metadata)
+	defer cancel()
+
+	size, err := b.bkt.ObjectSize(ctx, name)
+	return size, timeoutErr(ctx, err, sizeOp, b.timeouts.Metadata)
+}
+
+func (b *timeoutBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	ctx, cancel := withTimeout(ctx, b.timeouts.Metadata)
+	defer cancel()
+
+	attrs, err := b.bkt.Attributes(ctx, name)
+	return attrs, timeoutErr(ctx, err, attrOp, b.timeouts.Metadata)
+}
+
+func (b *timeoutBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	ctx, cancel := withTimeout(ctx, b.timeouts.Read)
+	rc, err := b.bkt.Get(ctx, name)
+	if err != nil {
+		cancel()
+		return nil, timeoutErr(ctx, err, getOp, b.timeouts.Read)
+	}
+	return &cancelingReadCloser{ReadCloser: rc, cancel: cancel}, nil
+}
+
+func (b *timeoutBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	ctx, cancel := withTimeout(ctx, b.timeouts.Read)
+	rc, err := b.bkt.GetRange(ctx, name, off, length)
+	if err != nil {
+		cancel()
+		return nil, timeoutErr(ctx, err, getRangeOp, b.timeouts.Read)
+	}
+	return &cancelingReadCloser{ReadCloser: rc, cancel: cancel}, nil
+}
+
+func (b *timeoutBucket) Exists(ctx context.Context, name string) (bool, error) {
+	ctx, cancel := withTimeout(ctx, b.timeouts.Metadata)
+	defer cancel()
+
+	ok, err := b.bkt.Exists(ctx, name)
+	return ok, timeoutErr(ctx, err, existsOp, b.timeouts.Metadata)
+}
+
+func (b *timeoutBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	ctx, cancel := withTimeout(ctx, b.timeouts.Write)
+	defer cancel()
+
+	return timeoutErr(ctx, b.bkt.Upload(ctx, name, r), uploadOp, b.timeouts.Write)
+}
+
+func (b *timeoutBucket) UploadIf(ctx context.Context, name string, r io.Reader, cond UploadCondition) error {
+	ctx, cancel := withTimeout(ctx, b.timeouts.Write)
+	defer cancel()
+
+	return timeoutErr(ctx, UploadIf(ctx, b.bkt, name, r, cond), uploadIfOp, b.timeouts.Write)
+}
+
+func (b *timeoutBucket) UploadWithMetadata(ctx context.Context, name string, r io.Reader, md ObjectMetadata) error {
+	ctx, cancel := withTimeout(ctx, b.timeouts.Write)
+	defer cancel()
+
+	return timeoutErr(ctx, UploadWithMetadata(ctx, b.bkt, name, r, md), uploadOp, b.timeouts.Write)
+}
+
+func (b *timeoutBucket) Delete(ctx context.Context, name string) error {
+	ctx, cancel := withTimeout(ctx, b.timeouts.Delete)
+	defer cancel()
+
+	return timeoutErr(ctx, b.bkt.Delete(ctx, name), deleteOp, b.timeouts.Delete)
+}
+
+func (b *timeoutBucket) DeleteMultiple(ctx context.Context, names []string) error {
+	ctx, cancel := withTimeout(ctx, b.timeouts.Delete)
+	defer cancel()
+
+	return timeoutErr(ctx, DeleteMultiple(ctx, b.bkt, names), deleteMultipleOp, b.timeouts.Delete)
+}
+
+func (b *timeoutBucket) Copy(ctx context.Context, src, dst string) error {
+	ctx, cancel := withTimeout(ctx, b.timeouts.Write)
+	defer cancel()
+
+	return timeoutErr(ctx, Copy(ctx, b.bkt, src, dst), copyOp, b.timeouts.Write)
+}
+
+func (b *timeoutBucket) IsObjNotFoundErr(err error) bool {
+	return b.bkt.IsObjNotFoundErr(err)
+}
+
+func (b *timeoutBucket) Close() error {
+	return b.bkt.Close()
+}
+
+func (b *timeoutBucket) Name() string {
+	return b.bkt.Name()
+}
+
+func (b *timeoutBucket) SupportedOperations() []Operation {
+	return SupportedOperations(b.bkt)
+}
+
+// cancelingReadCloser cancels the context of a read operation once the reader is closed.
+type cancelingReadCloser struct {
+	io.ReadCloser
+
+	once   sync.Once
+	cancel context.CancelFunc
+}
+
+func (rc *cancelingReadCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	rc.once.Do(rc.cancel)
+	return err
+}
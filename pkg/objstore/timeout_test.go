@@ -0,0 +1,160 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// slowBucket delays every operation by the given duration, or until the context of the operation is done.
+type slowBucket struct {
+	objstore.Bucket
+	delay time.Duration
+}
+
+func (b *slowBucket) wait(ctx context.Context) error {
+	select {
+	case <-time.After(b.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *slowBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	if err := b.wait(ctx); err != nil {
+		return err
+	}
+	return b.Bucket.Iter(ctx, dir, f, options...)
+}
+
+func (b *slowBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.wait(ctx); err != nil {
+		return false, err
+	}
+	return b.Bucket.Exists(ctx, name)
+}
+
+func (b *slowBucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	if err := b.wait(ctx); err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	return b.Bucket.Attributes(ctx, name)
+}
+
+func (b *slowBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.wait(ctx); err != nil {
+		return nil, err
+	}
+	return b.Bucket.Get(ctx, name)
+}
+
+func (b *slowBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.wait(ctx); err != nil {
+		return err
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func (b *slowBucket) Delete(ctx context.Context, name string) error {
+	if err := b.wait(ctx); err != nil {
+		return err
+	}
+	return b.Bucket.Delete(ctx, name)
+}
+
+func TestBucketWithTimeouts(t *testing.T) {
+	ctx := context.Background()
+
+	ops := map[string]func(bkt objstore.Bucket) error{
+		"metadata": func(bkt objstore.Bucket) error {
+			if _, err := bkt.Exists(ctx, "obj"); err != nil {
+				return err
+			}
+			_, err := bkt.Attributes(ctx, "obj")
+			return err
+		},
+		"iter": func(bkt objstore.Bucket) error {
+			return bkt.Iter(ctx, "", func(string) error { return nil })
+		},
+		"read": func(bkt objstore.Bucket) error {
+			rc, err := bkt.Get(ctx, "obj")
+			if err != nil {
+				return err
+			}
+			return rc.Close()
+		},
+		"write": func(bkt objstore.Bucket) error {
+			return bkt.Upload(ctx, "obj", strings.NewReader("content"))
+		},
+		"delete": func(bkt objstore.Bucket) error {
+			return bkt.Delete(ctx, "other")
+		},
+	}
+
+	const timeout = 10 * time.Millisecond
+	for _, tcase := range []struct {
+		timedOut string
+		timeouts objstore.OperationTimeouts
+	}{
+		{timedOut: "metadata", timeouts: objstore.OperationTimeouts{Metadata: timeout}},
+		{timedOut: "iter", timeouts: objstore.OperationTimeouts{Iter: timeout}},
+		{timedOut: "read", timeouts: objstore.OperationTimeouts{Read: timeout}},
+		{timedOut: "write", timeouts: objstore.OperationTimeouts{Write: timeout}},
+		{timedOut: "delete", timeouts: objstore.OperationTimeouts{Delete: timeout}},
+	} {
+		t.Run(tcase.timedOut, func(t *testing.T) {
+			inner := &slowBucket{Bucket: inmem.NewBucket(), delay: 50 * time.Millisecond}
+			testutil.Ok(t, inner.Bucket.Upload(ctx, "obj", strings.NewReader("content")))
+			testutil.Ok(t, inner.Bucket.Upload(ctx, "other", strings.NewReader("content")))
+			bkt := objstore.BucketWithTimeouts(inner, tcase.timeouts)
+
+			// Only the operations of the type with a timeout fail, the slow operations of other types complete.
+			for name, op := range ops {
+				err := op(bkt)
+				if name != tcase.timedOut {
+					testutil.Ok(t, err)
+					continue
+				}
+				testutil.NotOk(t, err)
+				testutil.Equals(t, context.DeadlineExceeded, errors.Cause(err))
+				testutil.Assert(t, strings.Contains(err.Error(), "exceeded timeout of 10ms"), "unexpected error %s", err)
+			}
+		})
+	}
+
+	t.Run("timeout of reads lasts until the reader is closed", func(t *testing.T) {
+		inner := &ctxCapturingBucket{Bucket: inmem.NewBucket()}
+		testutil.Ok(t, inner.Upload(ctx, "obj", strings.NewReader("content")))
+		bkt := objstore.BucketWithTimeouts(inner, objstore.OperationTimeouts{Read: time.Hour})
+
+		rc, err := bkt.Get(ctx, "obj")
+		testutil.Ok(t, err)
+		_, ok := inner.ctx.Deadline()
+		testutil.Assert(t, ok, "expected deadline on read context")
+		testutil.Ok(t, inner.ctx.Err())
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, context.Canceled, inner.ctx.Err())
+	})
+}
+
+// ctxCapturingBucket captures the context of the last Get operation.
+type ctxCapturingBucket struct {
+	objstore.Bucket
+	ctx context.Context
+}
+
+func (b *ctxCapturingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.ctx = ctx
+	return b.Bucket.Get(ctx, name)
+}
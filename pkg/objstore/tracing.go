@@ -0,0 +1,239 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/thanos-io/thanos/pkg/tracing"
+)
+
+// BucketWithTracing takes a bucket and creates a tracing span for every operation run against the bucket.
+// Spans are children of the span found in the context given to the operation, and are created by the
+// tracer propagated in the context, if any.
+func BucketWithTracing(b Bucket) Bucket {
+	return &tracingBucket{bkt: b}
+}
+
+type tracingBucket struct {
+	bkt Bucket
+}
+
+func (b *tracingBucket) startSpan(ctx context.Context, op string) (opentracing.Span, context.Context) {
+	span, ctx := tracing.StartSpan(ctx, "bucket_"+op)
+	span.SetTag("bucket", b.bkt.Name())
+	return span, ctx
+}
+
+// finishSpan finishes the given span, tagging it as failed if err is not nil.
+func finishSpan(span opentracing.Span, err error) {
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.SetTag("err", err.Error())
+	}
+	span.Finish()
+}
+
+func (b *tracingBucket) Iter(ctx context.Context, dir string, f func(name string) error, options ...IterOption) (err error) {
+	span, ctx := b.startSpan(ctx, iterOp)
+	span.SetTag("dir", dir)
+	defer func() { finishSpan(span, err) }()
+
+	return b.bkt.Iter(ctx, dir, f, options...)
+}
+
+func (b *tracingBucket) IterWithAttributes(ctx context.Context, dir string, f func(name string, attrs ObjectAttributes) error, options ...IterOption) (err error) {
+	span, ctx := b.startSpan(ctx, iterAttrOp)
+	span.SetTag("dir", dir)
+	defer func() { finishSpan(span, err) }()
+
+	return IterWithAttributes(ctx, b.bkt, dir, f, options...)
+}
+
+func (b *tracingBucket) ObjectSize(ctx context.Context, name string) (size uint64, err error) {
+	span, ctx := b.startSpan(ctx, sizeOp)
+	span.SetTag("name", name)
+	defer func() {
+		span.SetTag("size", size)
+		finishSpan(span, err)
+	}()
+
+	return b.bkt.ObjectSize(ctx, name)
+}
+
+func (b *tracingBucket) Attributes(ctx context.Context, name string) (attrs ObjectAttributes, err error) {
+	span, ctx := b.startSpan(ctx, attrOp)
+	span.SetTag("name", name)
+	defer func() {
+		span.SetTag("size", attrs.Size)
+		finishSpan(span, err)
+	}()
+
+	return b.bkt.Attributes(ctx, name)
+}
+
+func (b *tracingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	span, ctx := b.startSpan(ctx, getOp)
+	span.SetTag("name", name)
+
+	rc, err := b.bkt.Get(ctx, name)
+	if err != nil {
+		finishSpan(span, err)
+		return nil, err
+	}
+	return &tracingReadCloser{ReadCloser: rc, span: span}, nil
+}
+
+func (b *tracingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	span, ctx := b.startSpan(ctx, getRangeOp)
+	span.SetTag("name", name)
+	span.SetTag("offset", off)
+	span.SetTag("length", length)
+
+	rc, err := b.bkt.GetRange(ctx, name, off, length)
+	if err != nil {
+		finishSpan(span, err)
+		return nil, err
+	}
+	return &tracingReadCloser{ReadCloser: rc, span: span}, nil
+}
+
+func (b *tracingBucket) Exists(ctx context.Context, name string) (ok bool, err error) {
+	span, ctx := b.startSpan(ctx, existsOp)
+	span.SetTag("name", name)
+	defer func() {
+		span.SetTag("exists", ok)
+		finishSpan(span, err)
+	}()
+
+	return b.bkt.Exists(ctx, name)
+}
+
+func (b *tracingBucket) Upload(ctx context.Context, name string, r io.Reader) (err error) {
+	span, ctx := b.startSpan(ctx, uploadOp)
+	span.SetTag("name", name)
+	cr := &countingReader{Reader: r}
+	defer func() {
+		span.SetTag("size", cr.n)
+		finishSpan(span, err)
+	}()
+
+	return b.bkt.Upload(ctx, name, cr)
+}
+
+func (b *tracingBucket) UploadIf(ctx context.Context, name string, r io.Reader, cond UploadCondition) (err error) {
+	span, ctx := b.startSpan(ctx, uploadIfOp)
+	span.SetTag("name", name)
+	span.SetTag("if_not_exists", cond.IfNotExists)
+	span.SetTag("if_match", cond.IfMatch)
+	cr := &countingReader{Reader: r}
+	defer func() {
+		span.SetTag("size", cr.n)
+		finishSpan(span, err)
+	}()
+
+	return UploadIf(ctx, b.bkt, name, cr, cond)
+}
+
+func (b *tracingBucket) UploadWithMetadata(ctx context.Context, name string, r io.Reader, md ObjectMetadata) (err error) {
+	span, ctx := b.startSpan(ctx, uploadOp)
+	span.SetTag("name", name)
+	span.SetTag("content_type", md.ContentType)
+	span.SetTag("cache_control", md.CacheControl)
+	cr := &countingReader{Reader: r}
+	defer func() {
+		span.SetTag("size", cr.n)
+		finishSpan(span, err)
+	}()
+
+	return UploadWithMetadata(ctx, b.bkt, name, cr, md)
+}
+
+func (b *tracingBucket) Delete(ctx context.Context, name string) (err error) {
+	span, ctx := b.startSpan(ctx, deleteOp)
+	span.SetTag("name", name)
+	defer func() { finishSpan(span, err) }()
+
+	return b.bkt.Delete(ctx, name)
+}
+
+func (b *tracingBucket) DeleteMultiple(ctx context.Context, names []string) (err error) {
+	span, ctx := b.startSpan(ctx, deleteMultipleOp)
+	span.SetTag("objects", len(names))
+	defer func() { finishSpan(span, err) }()
+
+	return DeleteMultiple(ctx, b.bkt, names)
+}
+
+func (b *tracingBucket) Copy(ctx context.Context, src, dst string) (err error) {
+	span, ctx := b.startSpan(ctx, copyOp)
+	span.SetTag("src", src)
+	span.SetTag("dst", dst)
+	defer func() { finishSpan(span, err) }()
+
+	return Copy(ctx, b.bkt, src, dst)
+}
+
+func (b *tracingBucket) IsObjNotFoundErr(err error) bool {
+	return b.bkt.IsObjNotFoundErr(err)
+}
+
+func (b *tracingBucket) Close() error {
+	return b.bkt.Close()
+}
+
+func (b *tracingBucket) Name() string {
+	return b.bkt.Name()
+}
+
+func (b *tracingBucket) SupportedOperations() []Operation {
+	return SupportedOperations(b.bkt)
+}
+
+// tracingReadCloser finishes the span of a read operation once the reader is closed,
+// tagging it with the number of bytes read.
+type tracingReadCloser struct {
+	io.ReadCloser
+
+	span opentracing.Span
+	n    int64
+	err  error
+}
+
+func (rc *tracingReadCloser) Read(b []byte) (n int, err error) {
+	n, err = rc.ReadCloser.Read(b)
+	rc.n += int64(n)
+	if err != nil && err != io.EOF && rc.err == nil {
+		rc.err = err
+	}
+	return n, err
+}
+
+func (rc *tracingReadCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	if rc.span != nil {
+		if rc.err == nil {
+			rc.err = err
+		}
+		rc.span.SetTag("size", rc.n)
+		finishSpan(rc.span, rc.err)
+		rc.span = nil
+	}
+	return err
+}
+
+// countingReader counts the bytes read from the wrapped reader.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (n int, err error) {
+	n, err = r.Reader.Read(b)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,89 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/tracing"
+)
+
+func TestBucketWithTracing(t *testing.T) {
+	tracer := mocktracer.New()
+	parent := tracer.StartSpan("parent")
+	ctx := opentracing.ContextWithSpan(tracing.ContextWithTracer(context.Background(), tracer), parent)
+
+	bkt := objstore.BucketWithTracing(inmem.NewBucket())
+
+	// lastSpan returns the last finished span, checking it is a child of the parent span.
+	lastSpan := func(op string) *mocktracer.MockSpan {
+		spans := tracer.FinishedSpans()
+		testutil.Assert(t, len(spans) > 0, "no finished spans")
+		span := spans[len(spans)-1]
+		testutil.Equals(t, "bucket_"+op, span.OperationName)
+		testutil.Equals(t, parent.Context().(mocktracer.MockSpanContext).SpanID, span.ParentID)
+		testutil.Equals(t, "inmem", span.Tag("bucket"))
+		return span
+	}
+
+	testutil.Ok(t, bkt.Upload(ctx, "dir/obj", bytes.NewReader([]byte("some content"))))
+	span := lastSpan("upload")
+	testutil.Equals(t, "dir/obj", span.Tag("name"))
+	testutil.Equals(t, int64(12), span.Tag("size"))
+
+	rc, err := bkt.Get(ctx, "dir/obj")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(tracer.FinishedSpans()), "the span of a read must only finish once the reader is closed")
+	_, err = ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	span = lastSpan("get")
+	testutil.Equals(t, "dir/obj", span.Tag("name"))
+	testutil.Equals(t, int64(12), span.Tag("size"))
+
+	rc, err = bkt.GetRange(ctx, "dir/obj", 5, 4)
+	testutil.Ok(t, err)
+	_, err = ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	span = lastSpan("get_range")
+	testutil.Equals(t, "dir/obj", span.Tag("name"))
+	testutil.Equals(t, int64(5), span.Tag("offset"))
+	testutil.Equals(t, int64(4), span.Tag("length"))
+	testutil.Equals(t, int64(4), span.Tag("size"))
+
+	testutil.Ok(t, bkt.Iter(ctx, "dir/", func(string) error { return nil }))
+	testutil.Equals(t, "dir/", lastSpan("iter").Tag("dir"))
+
+	ok, err := bkt.Exists(ctx, "dir/obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "object should exist")
+	span = lastSpan("exists")
+	testutil.Equals(t, "dir/obj", span.Tag("name"))
+	testutil.Equals(t, true, span.Tag("exists"))
+
+	attrs, err := bkt.Attributes(ctx, "dir/obj")
+	testutil.Ok(t, err)
+	span = lastSpan("attributes")
+	testutil.Equals(t, "dir/obj", span.Tag("name"))
+	testutil.Equals(t, attrs.Size, span.Tag("size"))
+
+	testutil.Ok(t, bkt.Delete(ctx, "dir/obj"))
+	testutil.Equals(t, "dir/obj", lastSpan("delete").Tag("name"))
+
+	// Failed operations are tagged as errors.
+	_, err = bkt.Get(ctx, "dir/obj")
+	testutil.NotOk(t, err)
+	span = lastSpan("get")
+	testutil.Equals(t, true, span.Tag("error"))
+	testutil.Equals(t, err.Error(), span.Tag("err"))
+}
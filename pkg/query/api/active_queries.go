@@ -0,0 +1,95 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// activeQuery is a query currently being evaluated.
+type activeQuery struct {
+	Query string `json:"query"`
+	// Type is either instant or range.
+	Type   string    `json:"type"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Step   float64   `json:"step,omitempty"`
+	Tenant string    `json:"tenant,omitempty"`
+	// StartedAt is the time at which the evaluation of the query started.
+	StartedAt      time.Time `json:"startedAt"`
+	ElapsedSeconds float64   `json:"elapsedSeconds"`
+}
+
+// activeQueryTracker keeps track of the queries currently evaluated by the API handlers.
+// A nil tracker tracks no queries.
+type activeQueryTracker struct {
+	now func() time.Time
+
+	mtx     sync.Mutex
+	nextID  uint64
+	queries map[uint64]activeQuery
+}
+
+func newActiveQueryTracker() *activeQueryTracker {
+	return &activeQueryTracker{now: time.Now, queries: map[uint64]activeQuery{}}
+}
+
+// insert tracks the given query as active, setting its start time. The returned function must be called once
+// its evaluation is done.
+func (t *activeQueryTracker) insert(q activeQuery) (done func()) {
+	if t == nil {
+		return func() {}
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	id := t.nextID
+	t.nextID++
+	q.StartedAt = t.now()
+	t.queries[id] = q
+
+	return func() {
+		t.mtx.Lock()
+		defer t.mtx.Unlock()
+		delete(t.queries, id)
+	}
+}
+
+// list returns the active queries of the given tenant, or of all tenants if it is empty, with their elapsed
+// durations, longest running first.
+func (t *activeQueryTracker) list(tenant string) []activeQuery {
+	res := []activeQuery{}
+	if t == nil {
+		return res
+	}
+
+	t.mtx.Lock()
+	now := t.now()
+	for _, q := range t.queries {
+		if tenant != "" && q.Tenant != tenant {
+			continue
+		}
+		q.ElapsedSeconds = now.Sub(q.StartedAt).Seconds()
+		res = append(res, q)
+	}
+	t.mtx.Unlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].StartedAt.Before(res[j].StartedAt) })
+	return res
+}
+
+func (api *API) activeQueries(r *http.Request) (interface{}, []error, *ApiError) {
+	tenant, apiErr := api.tenantMatcher(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+	if tenant == nil {
+		return api.activeQueryTracker.list(""), nil, nil
+	}
+	return api.activeQueryTracker.list(tenant.Value), nil, nil
+}
@@ -0,0 +1,84 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// DownsamplingThreshold selects the max source resolution of range queries whose step or time range reaches a
+// minimum, when the max source resolution is chosen automatically.
+type DownsamplingThreshold struct {
+	// Range makes the threshold apply to the time range of queries instead of their step.
+	Range bool
+	// Min is the minimum step or time range of the queries the threshold applies to.
+	Min time.Duration
+	// Resolution is the max source resolution of the queries the threshold applies to.
+	Resolution time.Duration
+}
+
+// ParseDownsamplingThreshold parses a downsampling threshold of the form "<step|range>:<min>=<resolution>",
+// e.g. "step:25m=5m" or "range:14d=1h".
+func ParseDownsamplingThreshold(s string) (DownsamplingThreshold, error) {
+	var t DownsamplingThreshold
+
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return t, errors.Errorf("invalid downsampling threshold %q, expected <step|range>:<min>=<resolution>", s)
+	}
+	switch parts[0] {
+	case "step":
+	case "range":
+		t.Range = true
+	default:
+		return t, errors.Errorf("invalid downsampling threshold %q, expected step or range, got %q", s, parts[0])
+	}
+
+	bounds := strings.SplitN(parts[1], "=", 2)
+	if len(bounds) != 2 {
+		return t, errors.Errorf("invalid downsampling threshold %q, expected <step|range>:<min>=<resolution>", s)
+	}
+	min, err := model.ParseDuration(bounds[0])
+	if err != nil {
+		return t, errors.Wrapf(err, "minimum of downsampling threshold %q", s)
+	}
+	res, err := model.ParseDuration(bounds[1])
+	if err != nil {
+		return t, errors.Wrapf(err, "resolution of downsampling threshold %q", s)
+	}
+	t.Min, t.Resolution = time.Duration(min), time.Duration(res)
+	return t, nil
+}
+
+func (t DownsamplingThreshold) String() string {
+	dim := "step"
+	if t.Range {
+		dim = "range"
+	}
+	return fmt.Sprintf("%s:%s=%s", dim, model.Duration(t.Min), model.Duration(t.Resolution))
+}
+
+// DownsamplingThresholds select the max source resolution of range queries chosen automatically.
+type DownsamplingThresholds []DownsamplingThreshold
+
+// maxSourceResolution returns the highest resolution of the thresholds reached by the given step and time range
+// of a query, or zero, i.e. raw data only, if none is reached.
+func (ts DownsamplingThresholds) maxSourceResolution(step, rng time.Duration) time.Duration {
+	var res time.Duration
+	for _, t := range ts {
+		v := step
+		if t.Range {
+			v = rng
+		}
+		if v >= t.Min && t.Resolution > res {
+			res = t.Resolution
+		}
+	}
+	return res
+}
@@ -0,0 +1,71 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"testing"
+	"time"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestParseDownsamplingThreshold(t *testing.T) {
+	for _, tcase := range []struct {
+		input    string
+		expected DownsamplingThreshold
+		err      bool
+	}{
+		{input: "step:25m=5m", expected: DownsamplingThreshold{Min: 25 * time.Minute, Resolution: 5 * time.Minute}},
+		{input: "range:10d=1h", expected: DownsamplingThreshold{Range: true, Min: 10 * 24 * time.Hour, Resolution: time.Hour}},
+		{input: "step:0s=0s", expected: DownsamplingThreshold{}},
+		{input: "", err: true},
+		{input: "25m=5m", err: true},
+		{input: "time:25m=5m", err: true},
+		{input: "step:25m", err: true},
+		{input: "step:foo=5m", err: true},
+		{input: "step:25m=foo", err: true},
+	} {
+		t.Run(tcase.input, func(t *testing.T) {
+			th, err := ParseDownsamplingThreshold(tcase.input)
+			if tcase.err {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, th)
+			testutil.Equals(t, tcase.input, th.String())
+		})
+	}
+}
+
+func TestDownsamplingThresholds_MaxSourceResolution(t *testing.T) {
+	parse := func(s string) DownsamplingThreshold {
+		th, err := ParseDownsamplingThreshold(s)
+		testutil.Ok(t, err)
+		return th
+	}
+	ts := DownsamplingThresholds{
+		parse("step:5m=5m"),
+		parse("step:1h=1h"),
+		parse("range:7d=5m"),
+		parse("range:30d=1h"),
+	}
+
+	for _, tcase := range []struct {
+		step, rng time.Duration
+		expected  time.Duration
+	}{
+		{step: time.Minute, rng: time.Hour, expected: 0},
+		{step: 5 * time.Minute, rng: time.Hour, expected: 5 * time.Minute},
+		{step: 2 * time.Hour, rng: time.Hour, expected: time.Hour},
+		{step: time.Minute, rng: 7 * 24 * time.Hour, expected: 5 * time.Minute},
+		// The highest resolution of the reached thresholds is used.
+		{step: 5 * time.Minute, rng: 30 * 24 * time.Hour, expected: time.Hour},
+		{step: time.Hour, rng: 7 * 24 * time.Hour, expected: time.Hour},
+	} {
+		testutil.Equals(t, tcase.expected, ts.maxSourceResolution(tcase.step, tcase.rng), "step %v, range %v", tcase.step, tcase.rng)
+	}
+
+	testutil.Equals(t, time.Duration(0), DownsamplingThresholds(nil).maxSourceResolution(time.Hour, 30*24*time.Hour))
+}
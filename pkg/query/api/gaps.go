@@ -0,0 +1,93 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/value"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// gapPoint is a point of a gapSeries. Missing points are encoded as null, while NaN and infinite values are encoded
+// as the strings "NaN", "+Inf" and "-Inf" like all other values.
+type gapPoint struct {
+	promql.Point
+	missing bool
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p gapPoint) MarshalJSON() ([]byte, error) {
+	if p.missing {
+		return json.Marshal([...]interface{}{float64(p.T) / 1000, nil})
+	}
+	return p.Point.MarshalJSON()
+}
+
+// gapSeries is a series with explicit gaps.
+type gapSeries struct {
+	Metric labels.Labels `json:"metric"`
+	Points []gapPoint    `json:"values"`
+}
+
+// gapMatrix is a matrix whose series carry a null value for the points without sample, instead of leaving them out,
+// so that clients can tell missing points from NaN samples. It is encoded like a matrix otherwise.
+type gapMatrix []gapSeries
+
+func (m gapMatrix) Type() promql.ValueType { return promql.ValueTypeMatrix }
+
+func (m gapMatrix) String() string {
+	strs := make([]string, 0, len(m))
+	for _, s := range m {
+		vals := make([]string, 0, len(s.Points))
+		for _, p := range s.Points {
+			if p.missing {
+				vals = append(vals, fmt.Sprintf("null @[%v]", p.T))
+				continue
+			}
+			vals = append(vals, p.Point.String())
+		}
+		strs = append(strs, s.Metric.String()+" =>\n"+strings.Join(vals, "\n"))
+	}
+	return strings.Join(strs, "\n")
+}
+
+// fillStepGaps returns the given range query result with a null point at every step between start and end
+// (in milliseconds) without a point.
+func fillStepGaps(m promql.Matrix, start, end, step int64) gapMatrix {
+	res := make(gapMatrix, 0, len(m))
+	for _, s := range m {
+		gs := gapSeries{Metric: s.Metric, Points: make([]gapPoint, 0, (end-start)/step+1)}
+		i := 0
+		for t := start; t <= end; t += step {
+			for i < len(s.Points) && s.Points[i].T < t {
+				i++
+			}
+			if i < len(s.Points) && s.Points[i].T == t {
+				gs.Points = append(gs.Points, gapPoint{Point: s.Points[i]})
+				continue
+			}
+			gs.Points = append(gs.Points, gapPoint{Point: promql.Point{T: t}, missing: true})
+		}
+		res = append(res, gs)
+	}
+	return res
+}
+
+// markStaleGaps returns the given raw samples with the staleness markers, which end a series e.g. once its target
+// disappears, as null points. Otherwise they are indistinguishable from NaN samples.
+func markStaleGaps(m promql.Matrix) gapMatrix {
+	res := make(gapMatrix, 0, len(m))
+	for _, s := range m {
+		gs := gapSeries{Metric: s.Metric, Points: make([]gapPoint, 0, len(s.Points))}
+		for _, p := range s.Points {
+			gs.Points = append(gs.Points, gapPoint{Point: p, missing: value.IsStaleNaN(p.V)})
+		}
+		res = append(res, gs)
+	}
+	return res
+}
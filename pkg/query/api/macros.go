@@ -0,0 +1,145 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultMacrosMaxExpandedLength is the maximum length of a query after macro expansion if none is configured.
+const DefaultMacrosMaxExpandedLength = 64 * 1024
+
+// MacrosConfig is the YAML configuration of the query macros.
+type MacrosConfig struct {
+	// Macros maps macro names to the PromQL fragments they expand to. Fragments can use other macros.
+	Macros map[string]string `yaml:"macros"`
+	// MaxExpandedLength is the maximum length of a query after expansion. Longer queries are rejected.
+	MaxExpandedLength int `yaml:"max_expanded_length"`
+}
+
+// QueryMacros expands the named PromQL fragments referenced as $<name> in queries before they are parsed.
+// Each reference is replaced by its fragment in parentheses, so the fragment is evaluated as a whole.
+// References inside string literals are not expanded.
+type QueryMacros struct {
+	macros    map[string]string
+	maxLength int
+}
+
+// NewQueryMacros parses the given YAML macros configuration and returns the macros it defines.
+// Recursive macros and macros exceeding the maximum expanded length are rejected.
+func NewQueryMacros(confYAML []byte) (*QueryMacros, error) {
+	var conf MacrosConfig
+	if err := yaml.UnmarshalStrict(confYAML, &conf); err != nil {
+		return nil, errors.Wrap(err, "parse macros config")
+	}
+	if conf.MaxExpandedLength < 0 {
+		return nil, errors.Errorf("max_expanded_length cannot be lower than 0 (got %d)", conf.MaxExpandedLength)
+	}
+
+	m := &QueryMacros{macros: conf.Macros, maxLength: conf.MaxExpandedLength}
+	if m.maxLength == 0 {
+		m.maxLength = DefaultMacrosMaxExpandedLength
+	}
+
+	names := make([]string, 0, len(conf.Macros))
+	for name := range conf.Macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !isMacroName(name) {
+			return nil, errors.Errorf("invalid macro name %q", name)
+		}
+		// Expand each macro once, to reject recursive and oversized macros on load rather than at query time.
+		if _, err := m.Expand("$" + name); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Expand returns the query with all macro references expanded. A nil QueryMacros returns the query as is.
+func (m *QueryMacros) Expand(query string) (string, error) {
+	if m == nil || !strings.Contains(query, "$") {
+		return query, nil
+	}
+	return m.expand(query, nil)
+}
+
+// expand expands the given query, where stack holds the names of the macros being expanded.
+func (m *QueryMacros) expand(query string, stack []string) (string, error) {
+	var (
+		b     strings.Builder
+		quote rune
+	)
+	for i := 0; i < len(query); i++ {
+		c := rune(query[i])
+		switch {
+		case quote != 0:
+			b.WriteByte(query[i])
+			if c == '\\' && quote != '`' && i+1 < len(query) {
+				i++
+				b.WriteByte(query[i])
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+			b.WriteByte(query[i])
+			continue
+		case c != '$':
+			b.WriteByte(query[i])
+			continue
+		}
+
+		end := i + 1
+		for end < len(query) && isMacroNameChar(query[end], end == i+1) {
+			end++
+		}
+		name := query[i+1 : end]
+		fragment, ok := m.macros[name]
+		if !ok {
+			return "", errors.Errorf("unknown macro $%s", name)
+		}
+		for _, s := range stack {
+			if s == name {
+				return "", errors.Errorf("recursive macro $%s: $%s", name, strings.Join(append(stack, name), " -> $"))
+			}
+		}
+		expanded, err := m.expand(fragment, append(stack, name))
+		if err != nil {
+			return "", err
+		}
+		b.WriteString("(" + expanded + ")")
+		if b.Len() > m.maxLength {
+			return "", errors.Errorf("query exceeds the maximum length of %d after macro expansion", m.maxLength)
+		}
+		i = end - 1
+	}
+	if b.Len() > m.maxLength {
+		return "", errors.Errorf("query exceeds the maximum length of %d after macro expansion", m.maxLength)
+	}
+	return b.String(), nil
+}
+
+func isMacroName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isMacroNameChar(s[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func isMacroNameChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
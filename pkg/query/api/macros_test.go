@@ -0,0 +1,172 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/common/route"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/thanos-io/thanos/pkg/component"
+	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
+	"github.com/thanos-io/thanos/pkg/query"
+	"github.com/thanos-io/thanos/pkg/store"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestQueryMacros_Expand(t *testing.T) {
+	m, err := NewQueryMacros([]byte(`
+macros:
+  requests: 'sum(rate(http_requests_total[5m]))'
+  errors: 'sum(rate(http_requests_total{code=~"5.."}[5m]))'
+  error_ratio: '$errors / $requests'
+max_expanded_length: 150
+`))
+	testutil.Ok(t, err)
+
+	for _, tcase := range []struct {
+		query    string
+		expected string
+		err      string
+	}{
+		{query: `up`, expected: `up`},
+		{query: `$requests`, expected: `(sum(rate(http_requests_total[5m])))`},
+		{query: `$error_ratio > 0.1`, expected: `((sum(rate(http_requests_total{code=~"5.."}[5m]))) / (sum(rate(http_requests_total[5m])))) > 0.1`},
+		// References in string literals are not expanded.
+		{query: `up{job="$requests", path=~'a\'$b'}`, expected: `up{job="$requests", path=~'a\'$b'}`},
+		{query: "label_replace(up, \"a\", `$requests`, \"b\", \".*\")", expected: "label_replace(up, \"a\", `$requests`, \"b\", \".*\")"},
+		{query: `$unknown + 1`, err: "unknown macro $unknown"},
+		{query: `1 + $`, err: "unknown macro $"},
+		{query: `$error_ratio + $error_ratio`, err: "query exceeds the maximum length of 150 after macro expansion"},
+	} {
+		t.Run(tcase.query, func(t *testing.T) {
+			res, err := m.Expand(tcase.query)
+			if tcase.err != "" {
+				testutil.NotOk(t, err)
+				testutil.Equals(t, tcase.err, err.Error())
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, res)
+		})
+	}
+
+	// A nil QueryMacros does not expand anything.
+	var nilMacros *QueryMacros
+	res, err := nilMacros.Expand(`$requests`)
+	testutil.Ok(t, err)
+	testutil.Equals(t, `$requests`, res)
+}
+
+func TestNewQueryMacros_Invalid(t *testing.T) {
+	for _, tcase := range []struct {
+		conf string
+		err  string
+	}{
+		{
+			conf: "macros:\n  a: '$a + 1'\n",
+			err:  "recursive macro $a: $a -> $a",
+		},
+		{
+			conf: "macros:\n  a: '$b'\n  b: 'rate($c[5m])'\n  c: 'sum($a)'\n",
+			err:  "recursive macro $a: $a -> $b -> $c -> $a",
+		},
+		{
+			conf: "macros:\n  a: '$b'\n",
+			err:  "unknown macro $b",
+		},
+		{
+			conf: "macros:\n  a: 'up'\n  b: '$a + $a + $a'\nmax_expanded_length: 10\n",
+			err:  "query exceeds the maximum length of 10 after macro expansion",
+		},
+		{
+			conf: "macros:\n  1a: 'up'\n",
+			err:  `invalid macro name "1a"`,
+		},
+		{
+			conf: "max_expanded_length: -1\n",
+			err:  "max_expanded_length cannot be lower than 0 (got -1)",
+		},
+	} {
+		_, err := NewQueryMacros([]byte(tcase.conf))
+		testutil.NotOk(t, err)
+		testutil.Equals(t, tcase.err, err.Error())
+	}
+}
+
+func TestQueryMacros_API(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	for _, lset := range []labels.Labels{
+		labels.FromStrings("__name__", "test_metric", "instance", "a"),
+		labels.FromStrings("__name__", "test_metric", "instance", "b"),
+	} {
+		_, err := app.Add(lset, 0, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	macros, err := NewQueryMacros([]byte("macros:\n  total: 'sum(test_metric)'\n"))
+	testutil.Ok(t, err)
+
+	api := &API{
+		queryableCreate: query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), nil, 0, 0, nil),
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       100 * time.Second,
+		}),
+		macros: macros,
+		now:    func() time.Time { return time.Unix(0, 0) },
+	}
+	r := route.New()
+	api.Register(r, &opentracing.NoopTracer{}, log.NewNopLogger(), extpromhttp.NewNopInstrumentationMiddleware())
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	get := func(path, query string) (int, string) {
+		resp, err := http.Get(s.URL + path + "?" + url.Values{
+			"query": []string{query},
+			"time":  []string{"0"},
+			"start": []string{"0"},
+			"end":   []string{"0"},
+			"step":  []string{"15"},
+		}.Encode())
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, resp.Body.Close()) }()
+
+		var res struct {
+			Data  json.RawMessage `json:"data"`
+			Error string          `json:"error"`
+		}
+		testutil.Ok(t, json.NewDecoder(resp.Body).Decode(&res))
+		if res.Error != "" {
+			return resp.StatusCode, res.Error
+		}
+		return resp.StatusCode, string(res.Data)
+	}
+
+	for _, path := range []string{"/query", "/query_range"} {
+		code, body := get(path, `$total * 2`)
+		testutil.Equals(t, http.StatusOK, code)
+		testutil.Assert(t, strings.Contains(body, `"4"`), "unexpected result %s", body)
+
+		code, body = get(path, `$unknown`)
+		testutil.Equals(t, http.StatusBadRequest, code)
+		testutil.Equals(t, "unknown macro $unknown", body)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// checkRangePoints rejects range queries whose series would have more than the maximum number of points per series
+// before they are run. A maximum of zero disables the check.
+func (api *API) checkRangePoints(start, end time.Time, step time.Duration) *ApiError {
+	if api.maxPointsPerSeries <= 0 {
+		return nil
+	}
+	if points := int64(end.Sub(start)/step) + 1; points > int64(api.maxPointsPerSeries) {
+		return &ApiError{errorBadData, errors.Errorf("query would return %d points per series, more than the maximum of %d allowed. Try decreasing the query resolution (?step=XX) or time range", points, api.maxPointsPerSeries)}
+	}
+	return nil
+}
+
+// checkResultPoints fails query results with more than the maximum number of points per series or in total, before
+// the response is serialized. Maximums of zero disable the respective check.
+func (api *API) checkResultPoints(v promql.Value) *ApiError {
+	if api.maxPointsPerSeries <= 0 && api.maxPoints <= 0 {
+		return nil
+	}
+
+	var total int
+	switch v := v.(type) {
+	case promql.Matrix:
+		for _, s := range v {
+			if api.maxPointsPerSeries > 0 && len(s.Points) > api.maxPointsPerSeries {
+				return &ApiError{errorExec, errors.Errorf("query result has %d points for series %s, more than the maximum of %d points per series allowed", len(s.Points), s.Metric, api.maxPointsPerSeries)}
+			}
+			total += len(s.Points)
+		}
+	case promql.Vector:
+		total = len(v)
+	default:
+		return nil
+	}
+	if api.maxPoints > 0 && total > api.maxPoints {
+		return &ApiError{errorExec, errors.Errorf("query result has %d points, more than the maximum of %d allowed. Try decreasing the query resolution (?step=XX) or the number of selected series", total, api.maxPoints)}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// replicaResult is the result of a query evaluated against the series of a single replica.
+type replicaResult struct {
+	// Replica is the replica label and its value.
+	Replica labels.Labels `json:"replica"`
+	Result  promql.Value  `json:"result"`
+}
+
+// replicaQueryData is the response of a query evaluated once per replica instead of deduplicated.
+type replicaQueryData struct {
+	ResultType promql.ValueType `json:"resultType"`
+	Replicas   []replicaResult  `json:"replicas"`
+}
+
+func (api *API) parseVerifyReplicasParam(r *http.Request) (verifyReplicas bool, _ *ApiError) {
+	const verifyReplicasParam = "verify_replicas"
+
+	val := r.FormValue(verifyReplicasParam)
+	if val == "" {
+		return false, nil
+	}
+	verifyReplicas, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, &ApiError{errorBadData, errors.Wrapf(err, "'%s' parameter", verifyReplicasParam)}
+	}
+	if verifyReplicas && !api.enableReplicaVerification {
+		return false, &ApiError{errorBadData, errors.Errorf("'%s' parameter: replica verification is disabled", verifyReplicasParam)}
+	}
+	return verifyReplicas, nil
+}
+
+// queryReplicas evaluates the query created by newQuery once per value of every replica label, instead of
+// deduplicating the replicas. Every evaluation only selects the series of its replica and the series without
+// the replica label, so the results of HA replicas can be compared side by side. A non-nil tenant matcher
+// restricts all evaluations to the series of the tenant.
+func (api *API) queryReplicas(
+	ctx context.Context,
+	tenant *labels.Matcher,
+	replicaLabels []string,
+	maxSourceResolution int64,
+	partialResponse, freshStoresOnly bool,
+	newQuery func(storage.Queryable) (promql.Query, error),
+) (interface{}, []error, *ApiError) {
+	if len(replicaLabels) == 0 {
+		return nil, nil, &ApiError{errorBadData, errors.New("replica verification requires at least one replica label")}
+	}
+
+	replicas, warnings, err := api.replicas(ctx, tenant, replicaLabels, partialResponse)
+	if err != nil {
+		return nil, nil, &ApiError{errorExec, err}
+	}
+
+	res := &replicaQueryData{Replicas: []replicaResult{}}
+	for _, replica := range replicas {
+		qry, err := newQuery(withMatchers(
+			api.queryableCreate(true, replicaLabels, maxSourceResolution, partialResponse, false, freshStoresOnly),
+			tenant,
+			// A replica also sees the series without replica label, as they would be part of a deduplicated result.
+			labels.MustNewMatcher(labels.MatchRegexp, replica.Name, regexp.QuoteMeta(replica.Value)+"|"),
+		))
+		if err != nil {
+			return nil, nil, &ApiError{errorBadData, err}
+		}
+
+		r := qry.Exec(ctx)
+		if r.Err != nil {
+			switch r.Err.(type) {
+			case promql.ErrQueryCanceled:
+				return nil, nil, &ApiError{errorCanceled, r.Err}
+			case promql.ErrQueryTimeout:
+				return nil, nil, &ApiError{errorTimeout, r.Err}
+			case promql.ErrStorage:
+				return nil, nil, &ApiError{ErrorInternal, r.Err}
+			}
+			return nil, nil, &ApiError{errorExec, r.Err}
+		}
+		res.ResultType = r.Value.Type()
+		res.Replicas = append(res.Replicas, replicaResult{Replica: labels.Labels{replica}, Result: r.Value})
+		warnings = append(warnings, r.Warnings...)
+	}
+	return res, warnings, nil
+}
+
+// replicas returns the existing values of the given replica labels within the series of the tenant, if any.
+func (api *API) replicas(ctx context.Context, tenant *labels.Matcher, replicaLabels []string, partialResponse bool) ([]labels.Label, []error, error) {
+	q, err := withMatchers(api.queryableCreate(false, nil, 0, partialResponse, true, false), tenant).Querier(ctx, math.MinInt64, math.MaxInt64)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer runutil.CloseWithLogOnErr(api.logger, q, "queryable replicas")
+
+	var (
+		replicas []labels.Label
+		warnings []error
+	)
+	for _, name := range replicaLabels {
+		vals, warns, err := q.LabelValues(name)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "get values of replica label %s", name)
+		}
+		for _, v := range vals {
+			replicas = append(replicas, labels.Label{Name: name, Value: v})
+		}
+		warnings = append(warnings, warns...)
+	}
+	return replicas, warnings, nil
+}
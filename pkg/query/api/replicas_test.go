@@ -0,0 +1,127 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/query"
+	"github.com/thanos-io/thanos/pkg/store"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestQueryReplicas(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	for i := int64(0); i < 10; i++ {
+		_, err := app.Add(labels.FromStrings("__name__", "up", "job", "a", "replica", "a"), i*60000, float64(i))
+		testutil.Ok(t, err)
+		// The second replica diverges from the first one.
+		_, err = app.Add(labels.FromStrings("__name__", "up", "job", "a", "replica", "b"), i*60000, float64(2*i))
+		testutil.Ok(t, err)
+		_, err = app.Add(labels.FromStrings("__name__", "up", "job", "b"), i*60000, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	api := &API{
+		queryableCreate: query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), nil, 0, 0, nil),
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       100 * time.Second,
+		}),
+		replicaLabels:             []string{"replica"},
+		enableReplicaVerification: true,
+		now:                       func() time.Time { return time.Unix(0, 0) },
+	}
+
+	newRequest := func(t *testing.T, query url.Values) *http.Request {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "http://example.com?"+query.Encode(), nil)
+		testutil.Ok(t, err)
+		return req
+	}
+
+	t.Run("instant", func(t *testing.T) {
+		sample := func(job string, v float64) promql.Sample {
+			return promql.Sample{Metric: labels.FromStrings("__name__", "up", "job", job), Point: promql.Point{T: 540000, V: v}}
+		}
+		for _, tcase := range []struct {
+			query    string
+			expected []replicaResult
+		}{
+			{
+				query: `up{job="a"}`,
+				expected: []replicaResult{
+					{Replica: labels.FromStrings("replica", "a"), Result: promql.Vector{sample("a", 9)}},
+					{Replica: labels.FromStrings("replica", "b"), Result: promql.Vector{sample("a", 18)}},
+				},
+			},
+			{
+				// Series without replica label are part of the results of all replicas.
+				query: `up{job="b"}`,
+				expected: []replicaResult{
+					{Replica: labels.FromStrings("replica", "a"), Result: promql.Vector{sample("b", 1)}},
+					{Replica: labels.FromStrings("replica", "b"), Result: promql.Vector{sample("b", 1)}},
+				},
+			},
+		} {
+			res, _, apiErr := api.query(newRequest(t, url.Values{
+				"query":           []string{tcase.query},
+				"time":            []string{"540"},
+				"verify_replicas": []string{"true"},
+			}))
+			testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+			testutil.Equals(t, &replicaQueryData{ResultType: promql.ValueTypeVector, Replicas: tcase.expected}, res)
+		}
+	})
+
+	t.Run("range", func(t *testing.T) {
+		res, _, apiErr := api.queryRange(newRequest(t, url.Values{
+			"query":           []string{`up{job="a"}`},
+			"start":           []string{"0"},
+			"end":             []string{"60"},
+			"step":            []string{"60"},
+			"verify_replicas": []string{"true"},
+		}))
+		testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+
+		series := func(v float64) promql.Matrix {
+			return promql.Matrix{{
+				Metric: labels.FromStrings("__name__", "up", "job", "a"),
+				Points: []promql.Point{{T: 0, V: 0}, {T: 60000, V: v}},
+			}}
+		}
+		testutil.Equals(t, &replicaQueryData{
+			ResultType: promql.ValueTypeMatrix,
+			Replicas: []replicaResult{
+				{Replica: labels.FromStrings("replica", "a"), Result: series(1)},
+				{Replica: labels.FromStrings("replica", "b"), Result: series(2)},
+			},
+		}, res)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		api.enableReplicaVerification = false
+		defer func() { api.enableReplicaVerification = true }()
+
+		_, _, apiErr := api.query(newRequest(t, url.Values{
+			"query":           []string{"up"},
+			"verify_replicas": []string{"true"},
+		}))
+		testutil.Assert(t, apiErr != nil, "expected error")
+		testutil.Equals(t, errorBadData, apiErr.Typ)
+	})
+}
@@ -0,0 +1,187 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/thanos-io/thanos/pkg/query"
+)
+
+// DefaultTenantHeader is the default header designating the tenant of a request.
+const DefaultTenantHeader = "THANOS-TENANT"
+
+// TenancyConfig configures how the tenant of a request is determined and enforced.
+type TenancyConfig struct {
+	// Header is the HTTP header designating the tenant of a request.
+	Header string
+	// DefaultTenant is the tenant of requests without tenant header.
+	DefaultTenant string
+	// LabelName is the name of the label holding the tenant of series. If set, queries and metadata requests
+	// only see the series of their tenant, and requests without tenant fail. Empty does not enforce tenants.
+	LabelName string
+	// MaxSeries overrides the maximum number of series a single query can select for the given tenants.
+	// 0 disables the limit for a tenant.
+	MaxSeries map[string]int
+}
+
+// tenant returns the tenant of the request, falling back to the default tenant if the request has none.
+func (api *API) tenant(r *http.Request) string {
+	if api.tenancy.Header != "" {
+		if tenant := r.Header.Get(api.tenancy.Header); tenant != "" {
+			return tenant
+		}
+	}
+	return api.tenancy.DefaultTenant
+}
+
+// withTenantLimits returns a new context whose queries are subject to the limits of the tenant of the request.
+func (api *API) withTenantLimits(ctx context.Context, r *http.Request) context.Context {
+	if maxSeries, ok := api.tenancy.MaxSeries[api.tenant(r)]; ok {
+		return query.ContextWithMaxSeries(ctx, maxSeries)
+	}
+	return ctx
+}
+
+// tenantMatcher returns the matcher restricting the request to the series of its tenant, or nil if tenants
+// are not enforced.
+func (api *API) tenantMatcher(r *http.Request) (*labels.Matcher, *ApiError) {
+	if api.tenancy.LabelName == "" {
+		return nil, nil
+	}
+	tenant := api.tenant(r)
+	if tenant == "" {
+		return nil, &ApiError{errorBadData, errors.Errorf("no tenant given in the %s header and no default tenant configured", api.tenancy.Header)}
+	}
+	return labels.MustNewMatcher(labels.MatchEqual, api.tenancy.LabelName, tenant), nil
+}
+
+// withMatchers returns a queryable selecting only the series of the given queryable matching all of the
+// given matchers. Nil matchers are ignored.
+func withMatchers(q storage.Queryable, matchers ...*labels.Matcher) storage.Queryable {
+	var ms []*labels.Matcher
+	for _, m := range matchers {
+		if m != nil {
+			ms = append(ms, m)
+		}
+	}
+	if len(ms) == 0 {
+		return q
+	}
+	return &matcherQueryable{Queryable: q, matchers: ms}
+}
+
+// withTenantLabels returns a queryable whose label names and values are the ones of the series of the tenant
+// matched by the given matcher. They are served from the given labels cache, if any, keyed by tenant. A nil
+// matcher returns the given queryable.
+func withTenantLabels(q storage.Queryable, tenant *labels.Matcher, labelsCache *query.LabelsCache, partialResponse bool) storage.Queryable {
+	if tenant == nil {
+		return q
+	}
+	return &matcherQueryable{
+		Queryable:       q,
+		matchers:        []*labels.Matcher{tenant},
+		labelsCache:     labelsCache,
+		partialResponse: partialResponse,
+		scope:           tenant.String(),
+	}
+}
+
+type matcherQueryable struct {
+	storage.Queryable
+	matchers []*labels.Matcher
+
+	labelsCache     *query.LabelsCache
+	partialResponse bool
+	// scope keys the label names and values of the matching series in the labels cache.
+	scope string
+}
+
+func (q *matcherQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.Queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &matcherQuerier{
+		Querier:         querier,
+		matchers:        q.matchers,
+		mint:            mint,
+		maxt:            maxt,
+		labelsCache:     q.labelsCache,
+		partialResponse: q.partialResponse,
+		scope:           q.scope,
+	}, nil
+}
+
+type matcherQuerier struct {
+	storage.Querier
+	matchers   []*labels.Matcher
+	mint, maxt int64
+
+	labelsCache     *query.LabelsCache
+	partialResponse bool
+	scope           string
+}
+
+func (q *matcherQuerier) Select(params *storage.SelectParams, ms ...*labels.Matcher) (storage.SeriesSet, storage.Warnings, error) {
+	return q.Querier.Select(params, append(append([]*labels.Matcher{}, ms...), q.matchers...)...)
+}
+
+// LabelValues returns the values of the label within the matching series. Stores cannot restrict label values
+// to the ones of matching series, so they are collected from the series themselves.
+func (q *matcherQuerier) LabelValues(name string) ([]string, storage.Warnings, error) {
+	return q.labelsCache.Labels(q.scope, name, q.partialResponse, q.mint, q.maxt, func() ([]string, storage.Warnings, error) {
+		values := map[string]struct{}{}
+		warns, err := q.each(func(lset labels.Labels) {
+			values[lset.Get(name)] = struct{}{}
+		}, labels.MustNewMatcher(labels.MatchRegexp, name, ".+"))
+		if err != nil {
+			return nil, nil, err
+		}
+		return sortedKeys(values), warns, nil
+	})
+}
+
+// LabelNames returns the label names of the matching series. Like label values, they are collected from the
+// series themselves.
+func (q *matcherQuerier) LabelNames() ([]string, storage.Warnings, error) {
+	return q.labelsCache.Labels(q.scope, "", q.partialResponse, q.mint, q.maxt, func() ([]string, storage.Warnings, error) {
+		names := map[string]struct{}{}
+		warns, err := q.each(func(lset labels.Labels) {
+			for _, l := range lset {
+				names[l.Name] = struct{}{}
+			}
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return sortedKeys(names), warns, nil
+	})
+}
+
+// each calls f with the labels of every matching series that also matches the given matchers.
+func (q *matcherQuerier) each(f func(labels.Labels), ms ...*labels.Matcher) (storage.Warnings, error) {
+	set, warns, err := q.Select(nil, ms...)
+	if err != nil {
+		return nil, err
+	}
+	for set.Next() {
+		f(set.At().Labels())
+	}
+	return warns, set.Err()
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,222 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/route"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/query"
+	"github.com/thanos-io/thanos/pkg/store"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+	"google.golang.org/grpc"
+)
+
+// tenantMetadataClient serves the metric metadata of each tenant.
+type tenantMetadataClient map[string][]prompb.MetricMetadata
+
+func (c tenantMetadataClient) Metadata(_ context.Context, r *storepb.MetadataRequest, _ ...grpc.CallOption) (*storepb.MetadataResponse, error) {
+	if r.Tenant != "" {
+		return &storepb.MetadataResponse{Metadata: c[r.Tenant]}, nil
+	}
+	var mds []prompb.MetricMetadata
+	for _, tmds := range c {
+		mds = append(mds, tmds...)
+	}
+	return &storepb.MetadataResponse{Metadata: mds}, nil
+}
+
+func TestTenancy(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	_, err = app.Add(labels.FromStrings("__name__", "up", "job", "a", "tenant", "team-a"), 0, 1)
+	testutil.Ok(t, err)
+	_, err = app.Add(labels.FromStrings("__name__", "up", "job", "b", "tenant", "team-b"), 0, 2)
+	testutil.Ok(t, err)
+	_, err = app.Add(labels.FromStrings("__name__", "late", "tenant", "team-b", "zone", "eu"), 3600*1000, 3)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	api := &API{
+		queryableCreate: query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), nil, 0, 0, nil),
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       100 * time.Second,
+		}),
+		tenancy: TenancyConfig{
+			Header:        DefaultTenantHeader,
+			DefaultTenant: "team-a",
+			LabelName:     "tenant",
+		},
+		now: func() time.Time { return time.Unix(0, 0) },
+	}
+
+	newRequest := func(t *testing.T, tenant string, query url.Values) *http.Request {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "http://example.com?"+query.Encode(), nil)
+		testutil.Ok(t, err)
+		if tenant != "" {
+			req.Header.Set(DefaultTenantHeader, tenant)
+		}
+		return req
+	}
+	up := func(job, tenant string, v float64) promql.Vector {
+		return promql.Vector{{Metric: labels.FromStrings("__name__", "up", "job", job, "tenant", tenant), Point: promql.Point{T: 0, V: v}}}
+	}
+
+	t.Run("query", func(t *testing.T) {
+		for _, tcase := range []struct {
+			tenant   string
+			expected promql.Vector
+		}{
+			// Requests without tenant header belong to the default tenant.
+			{tenant: "", expected: up("a", "team-a", 1)},
+			{tenant: "team-b", expected: up("b", "team-b", 2)},
+			{tenant: "team-c", expected: promql.Vector{}},
+		} {
+			res, _, apiErr := api.query(newRequest(t, tcase.tenant, url.Values{"query": []string{"up"}, "time": []string{"0"}}))
+			testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+			testutil.Equals(t, tcase.expected, res.(*queryData).Result)
+		}
+	})
+
+	t.Run("series", func(t *testing.T) {
+		res, _, apiErr := api.series(newRequest(t, "team-b", url.Values{"match[]": []string{"up"}}))
+		testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+		testutil.Equals(t, []labels.Labels{labels.FromStrings("__name__", "up", "job", "b", "tenant", "team-b")}, res)
+	})
+
+	labelNames := func(t *testing.T, tenant string, query url.Values) interface{} {
+		t.Helper()
+		res, _, apiErr := api.labelNames(newRequest(t, tenant, query))
+		testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+		return res
+	}
+
+	t.Run("labels", func(t *testing.T) {
+		testutil.Equals(t, []string{"__name__", "job", "tenant", "zone"}, labelNames(t, "team-b", nil))
+		// Label names of series outside of the requested time range are not returned.
+		testutil.Equals(t, []string{"__name__", "job", "tenant"}, labelNames(t, "team-b", url.Values{"end": []string{"60"}}))
+
+		req := newRequest(t, "", nil)
+		req = req.WithContext(route.WithParam(context.Background(), "name", "job"))
+		res, _, apiErr := api.labelValues(req)
+		testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+		testutil.Equals(t, []string{"a"}, res)
+	})
+
+	t.Run("labels cache", func(t *testing.T) {
+		api.labelsCache = query.NewLabelsCache(nil, time.Hour, time.Millisecond)
+		defer func() { api.labelsCache = nil }()
+
+		testutil.Equals(t, []string{"__name__", "job", "tenant"}, labelNames(t, "team-a", nil))
+		testutil.Equals(t, []string{"__name__", "job", "tenant", "zone"}, labelNames(t, "team-b", nil))
+
+		// Cached responses are served per tenant, even after new label names were written.
+		app := db.Appender()
+		_, err := app.Add(labels.FromStrings("__name__", "down", "job", "a", "tenant", "team-a", "instance", "x"), 0, 4)
+		testutil.Ok(t, err)
+		testutil.Ok(t, app.Commit())
+
+		testutil.Equals(t, []string{"__name__", "job", "tenant"}, labelNames(t, "team-a", nil))
+		testutil.Equals(t, []string{"__name__", "job", "tenant", "zone"}, labelNames(t, "team-b", nil))
+		testutil.Equals(t, []string{"__name__", "instance", "job", "tenant"}, labelNames(t, "team-a", url.Values{"end": []string{"60"}}))
+	})
+
+	t.Run("metadata", func(t *testing.T) {
+		client := tenantMetadataClient{
+			"team-a": {{MetricFamilyName: "up", Type: prompb.MetricMetadata_GAUGE, Help: "Team A."}},
+			"team-b": {{MetricFamilyName: "up", Type: prompb.MetricMetadata_GAUGE, Help: "Team B."}},
+		}
+		api.metadataFetcher = query.NewMetadataFetcher(nil, func() []storepb.MetadataClient { return []storepb.MetadataClient{client} })
+		defer func() { api.metadataFetcher = nil }()
+
+		for _, tcase := range []struct {
+			tenant   string
+			expected string
+		}{
+			// Requests without tenant header belong to the default tenant.
+			{tenant: "", expected: "Team A."},
+			{tenant: "team-b", expected: "Team B."},
+		} {
+			res, _, apiErr := api.metadata(newRequest(t, tcase.tenant, nil))
+			testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+			testutil.Equals(t, map[string][]metricMetadata{"up": {{Type: "gauge", Help: tcase.expected}}}, res)
+		}
+	})
+
+	t.Run("active queries", func(t *testing.T) {
+		api.activeQueryTracker = newActiveQueryTracker()
+		defer func() { api.activeQueryTracker = nil }()
+
+		defer api.activeQueryTracker.insert(activeQuery{Query: "up", Tenant: "team-a"})()
+		defer api.activeQueryTracker.insert(activeQuery{Query: "up", Tenant: "team-b"})()
+
+		for _, tcase := range []struct {
+			tenant   string
+			expected string
+		}{
+			// Requests without tenant header belong to the default tenant.
+			{tenant: "", expected: "team-a"},
+			{tenant: "team-b", expected: "team-b"},
+		} {
+			res, _, apiErr := api.activeQueries(newRequest(t, tcase.tenant, nil))
+			testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+			testutil.Equals(t, 1, len(res.([]activeQuery)))
+			testutil.Equals(t, tcase.expected, res.([]activeQuery)[0].Tenant)
+		}
+	})
+
+	t.Run("no tenant", func(t *testing.T) {
+		api.tenancy.DefaultTenant = ""
+		defer func() { api.tenancy.DefaultTenant = "team-a" }()
+
+		_, _, apiErr := api.query(newRequest(t, "", url.Values{"query": []string{"up"}, "time": []string{"0"}}))
+		testutil.Assert(t, apiErr != nil, "expected error")
+		testutil.Equals(t, errorBadData, apiErr.Typ)
+	})
+
+	t.Run("series limit", func(t *testing.T) {
+		queryableCreate := api.queryableCreate
+		api.queryableCreate = query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), nil, 1, 0, nil)
+		api.tenancy.LabelName = ""
+		api.tenancy.MaxSeries = map[string]int{"team-b": 0}
+		defer func() {
+			api.queryableCreate = queryableCreate
+			api.tenancy.LabelName = "tenant"
+			api.tenancy.MaxSeries = nil
+		}()
+
+		_, _, apiErr := api.query(newRequest(t, "team-a", url.Values{"query": []string{"up"}, "time": []string{"0"}}))
+		testutil.Assert(t, apiErr != nil, "expected error")
+
+		// The limit is disabled for team-b.
+		res, _, apiErr := api.query(newRequest(t, "team-b", url.Values{"query": []string{"up"}, "time": []string{"0"}}))
+		testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+		testutil.Equals(t, 2, len(res.(*queryData).Result.(promql.Vector)))
+	})
+
+	t.Run("not enforced", func(t *testing.T) {
+		api.tenancy.LabelName = ""
+		defer func() { api.tenancy.LabelName = "tenant" }()
+
+		res, _, apiErr := api.series(newRequest(t, "team-b", url.Values{"match[]": []string{"up"}}))
+		testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+		testutil.Equals(t, 2, len(res.([]labels.Labels)))
+	})
+}
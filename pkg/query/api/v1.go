@@ -20,12 +20,14 @@
 package v1
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
 	"math"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
@@ -39,9 +41,13 @@ import (
 	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/util/stats"
+	"github.com/thanos-io/thanos/pkg/extprom"
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
+	"github.com/thanos-io/thanos/pkg/gate"
 	"github.com/thanos-io/thanos/pkg/query"
 	"github.com/thanos-io/thanos/pkg/runutil"
+	"github.com/thanos-io/thanos/pkg/store"
 	"github.com/thanos-io/thanos/pkg/tracing"
 )
 
@@ -108,6 +114,24 @@ type API struct {
 	replicaLabels                          []string
 	reg                                    prometheus.Registerer
 	defaultInstantQueryMaxSourceResolution time.Duration
+	instantQueryFreshStoresOnly            bool
+	maxRawSamples                          int
+	metadataFetcher                        *query.MetadataFetcher
+	labelsCache                            *query.LabelsCache
+	activeQueryTracker                     *activeQueryTracker
+	enableReplicaVerification              bool
+	tenancy                                TenancyConfig
+	macros                                 *QueryMacros
+	metadataGate                           gate.Gater
+	maxMatchersPerSelector                 int
+	maxMatchersPerQuery                    int
+	storeSessionHeader                     string
+	unsortedMetadata                       bool
+	defaultTimeout                         time.Duration
+	maxTimeout                             time.Duration
+	downsamplingThresholds                 DownsamplingThresholds
+	maxPointsPerSeries                     int
+	maxPoints                              int
 
 	now func() time.Time
 }
@@ -122,7 +146,33 @@ func NewAPI(
 	enablePartialResponse bool,
 	replicaLabels []string,
 	defaultInstantQueryMaxSourceResolution time.Duration,
+	instantQueryFreshStoresOnly bool,
+	maxRawSamples int,
+	metadataFetcher *query.MetadataFetcher,
+	labelsCache *query.LabelsCache,
+	enableReplicaVerification bool,
+	tenancy TenancyConfig,
+	macros *QueryMacros,
+	maxConcurrentMetadataRequests int,
+	maxMatchersPerSelector int,
+	maxMatchersPerQuery int,
+	storeSessionHeader string,
+	unsortedMetadata bool,
+	defaultTimeout time.Duration,
+	maxTimeout time.Duration,
+	downsamplingThresholds DownsamplingThresholds,
+	maxPointsPerSeries int,
+	maxPoints int,
 ) *API {
+	var metadataGate gate.Gater
+	if maxConcurrentMetadataRequests > 0 {
+		var gateReg prometheus.Registerer
+		if reg != nil {
+			gateReg = extprom.WrapRegistererWithPrefix("thanos_query_metadata_", reg)
+		}
+		metadataGate = gate.NewGate(maxConcurrentMetadataRequests, gateReg)
+	}
+
 	return &API{
 		logger:                                 logger,
 		queryEngine:                            qe,
@@ -132,6 +182,24 @@ func NewAPI(
 		replicaLabels:                          replicaLabels,
 		reg:                                    reg,
 		defaultInstantQueryMaxSourceResolution: defaultInstantQueryMaxSourceResolution,
+		instantQueryFreshStoresOnly:            instantQueryFreshStoresOnly,
+		maxRawSamples:                          maxRawSamples,
+		metadataFetcher:                        metadataFetcher,
+		labelsCache:                            labelsCache,
+		activeQueryTracker:                     newActiveQueryTracker(),
+		enableReplicaVerification:              enableReplicaVerification,
+		tenancy:                                tenancy,
+		macros:                                 macros,
+		metadataGate:                           metadataGate,
+		maxMatchersPerSelector:                 maxMatchersPerSelector,
+		maxMatchersPerQuery:                    maxMatchersPerQuery,
+		storeSessionHeader:                     storeSessionHeader,
+		unsortedMetadata:                       unsortedMetadata,
+		defaultTimeout:                         defaultTimeout,
+		maxTimeout:                             maxTimeout,
+		downsamplingThresholds:                 downsamplingThresholds,
+		maxPointsPerSeries:                     maxPointsPerSeries,
+		maxPoints:                              maxPoints,
 
 		now: time.Now,
 	}
@@ -142,8 +210,14 @@ func (api *API) Register(r *route.Router, tracer opentracing.Tracer, logger log.
 	instr := func(name string, f ApiFunc) http.HandlerFunc {
 		hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			SetCORS(w)
+			if api.storeSessionHeader != "" {
+				// Requests of a session see the Stores pinned by its first request.
+				r = r.WithContext(store.ContextWithStoreSession(r.Context(), r.Header.Get(api.storeSessionHeader)))
+			}
 			if data, warnings, err := f(r); err != nil {
 				RespondError(w, err, data)
+			} else if qd, ok := data.(*queryData); ok && qd.stream {
+				respondStream(w, qd, warnings)
 			} else if data != nil {
 				Respond(w, data, warnings)
 			} else {
@@ -161,6 +235,9 @@ func (api *API) Register(r *route.Router, tracer opentracing.Tracer, logger log.
 	r.Get("/query_range", instr("query_range", api.queryRange))
 	r.Post("/query_range", instr("query_range", api.queryRange))
 
+	r.Get("/query_raw", instr("query_raw", api.queryRaw))
+	r.Post("/query_raw", instr("query_raw", api.queryRaw))
+
 	r.Get("/label/:name/values", instr("label_values", api.labelValues))
 
 	r.Get("/series", instr("series", api.series))
@@ -168,6 +245,10 @@ func (api *API) Register(r *route.Router, tracer opentracing.Tracer, logger log.
 
 	r.Get("/labels", instr("label_names", api.labelNames))
 	r.Post("/labels", instr("label_names", api.labelNames))
+
+	r.Get("/metadata", instr("metadata", api.metadata))
+
+	r.Get("/status/active_queries", instr("active_queries", api.activeQueries))
 }
 
 type queryData struct {
@@ -176,6 +257,81 @@ type queryData struct {
 
 	// Additional Thanos Response field.
 	Warnings []error `json:"warnings,omitempty"`
+
+	// Stats is set if the client asked for query stats with the stats parameter.
+	Stats *queryStats `json:"stats,omitempty"`
+
+	// Stores are the stores queried, set if the client asked for them with the stores parameter.
+	Stores []queryStore `json:"stores,omitempty"`
+
+	// PartialResponseGaps are the parts of the query time range stores failed to return data for, if the
+	// response is partial.
+	PartialResponseGaps []partialResponseGap `json:"partialResponseGaps,omitempty"`
+
+	// stream is set if the client asked for the result to be streamed.
+	stream bool
+}
+
+// queryStats are the stats of an instant or range query: the timings of its evaluation and the series, chunks and
+// bytes fetched, in total and per store.
+type queryStats struct {
+	*stats.QueryStats
+	store.StoreSeriesStats
+	Stores []store.StoreSeriesStats `json:"stores"`
+}
+
+func newQueryStats(qry promql.Query, seriesStats *store.SeriesStats) *queryStats {
+	return &queryStats{
+		QueryStats:       stats.NewQueryStats(qry.Stats()),
+		StoreSeriesStats: seriesStats.Total(),
+		Stores:           seriesStats.Stores(),
+	}
+}
+
+// queryStore is a store a query sent Series requests to, along with whether it returned any series.
+type queryStore struct {
+	Store       string `json:"store"`
+	Contributed bool   `json:"contributed"`
+}
+
+func newQueryStores(seriesStats *store.SeriesStats) []queryStore {
+	contributed := map[string]bool{}
+	for _, st := range seriesStats.Stores() {
+		contributed[st.Store] = st.Series > 0
+	}
+	var res []queryStore
+	for _, addr := range seriesStats.QueriedStores() {
+		res = append(res, queryStore{Store: addr, Contributed: contributed[addr]})
+	}
+	return res
+}
+
+// partialResponseGap is the part of the time range of a query a store failed to return data for, along with the
+// partial response warning it caused.
+type partialResponseGap struct {
+	Store     string              `json:"store"`
+	LabelSets []map[string]string `json:"labelSets,omitempty"`
+	Start     time.Time           `json:"start"`
+	End       time.Time           `json:"end"`
+	Warning   string              `json:"warning"`
+}
+
+func newPartialResponseGaps(gaps *store.PartialResponseGaps) []partialResponseGap {
+	var res []partialResponseGap
+	for _, g := range gaps.Gaps() {
+		var lsets []map[string]string
+		for _, lset := range g.LabelSets {
+			lsets = append(lsets, lset.Map())
+		}
+		res = append(res, partialResponseGap{
+			Store:     g.Store,
+			LabelSets: lsets,
+			Start:     timestamp.Time(g.MinTime).UTC(),
+			End:       timestamp.Time(g.MaxTime).UTC(),
+			Warning:   g.Warning,
+		})
+	}
+	return res
 }
 
 func (api *API) parseEnableDedupParam(r *http.Request) (enableDeduplication bool, _ *ApiError) {
@@ -244,6 +400,148 @@ func (api *API) parsePartialResponseParam(r *http.Request) (enablePartialRespons
 	return enablePartialResponse, nil
 }
 
+// parseUnsortedParam returns whether the series, label names and label values responses of the request may be
+// unsorted, skipping the cost of sorting the merged results of the stores.
+func (api *API) parseUnsortedParam(r *http.Request) (unsorted bool, _ *ApiError) {
+	const unsortedParam = "unsorted"
+	unsorted = api.unsortedMetadata
+
+	// Overwrite the cli flag when provided as a query parameter.
+	if val := r.FormValue(unsortedParam); val != "" {
+		var err error
+		unsorted, err = strconv.ParseBool(val)
+		if err != nil {
+			return false, &ApiError{errorBadData, errors.Wrapf(err, "'%s' parameter", unsortedParam)}
+		}
+	}
+	return unsorted, nil
+}
+
+func (api *API) parseStreamParam(r *http.Request) (stream bool, _ *ApiError) {
+	const streamParam = "stream"
+
+	if val := r.FormValue(streamParam); val != "" {
+		var err error
+		stream, err = strconv.ParseBool(val)
+		if err != nil {
+			return false, &ApiError{errorBadData, errors.Wrapf(err, "'%s' parameter", streamParam)}
+		}
+	}
+	return stream, nil
+}
+
+// parseExplicitGapsParam returns true if missing points were requested to be encoded as null with 'explicit_gaps'.
+func (api *API) parseExplicitGapsParam(r *http.Request) (explicitGaps bool, _ *ApiError) {
+	const explicitGapsParam = "explicit_gaps"
+
+	if val := r.FormValue(explicitGapsParam); val != "" {
+		var err error
+		explicitGaps, err = strconv.ParseBool(val)
+		if err != nil {
+			return false, &ApiError{errorBadData, errors.Wrapf(err, "'%s' parameter", explicitGapsParam)}
+		}
+	}
+	return explicitGaps, nil
+}
+
+// parseStatsParam returns true if query stats were requested with 'stats=all'.
+func (api *API) parseStatsParam(r *http.Request) (enableStats bool, _ *ApiError) {
+	const statsParam = "stats"
+
+	switch val := r.FormValue(statsParam); val {
+	case "":
+		return false, nil
+	case "all":
+		return true, nil
+	default:
+		return false, &ApiError{errorBadData, errors.Errorf("'%s' parameter must be 'all', got %q", statsParam, val)}
+	}
+}
+
+// parseStoresParam returns true if the stores queried were requested with the stores param.
+func (api *API) parseStoresParam(r *http.Request) (listStores bool, _ *ApiError) {
+	const storesParam = "stores"
+
+	if val := r.FormValue(storesParam); val != "" {
+		var err error
+		listStores, err = strconv.ParseBool(val)
+		if err != nil {
+			return false, &ApiError{errorBadData, errors.Wrapf(err, "'%s' parameter", storesParam)}
+		}
+	}
+	return listStores, nil
+}
+
+// TimeoutHeader is the HTTP header of query requests requesting their own timeout, if no timeout param is specified.
+const TimeoutHeader = "X-Thanos-Query-Timeout"
+
+// parseTimeout returns the timeout of the query requested with the timeout param or header, or the default timeout
+// if none is requested. Requested timeouts longer than the maximum are lowered to the maximum with a warning.
+// Zero means no timeout besides the timeout of the engine.
+func (api *API) parseTimeout(r *http.Request) (time.Duration, []error, *ApiError) {
+	const timeoutParam = "timeout"
+
+	to := r.FormValue(timeoutParam)
+	if to == "" {
+		to = r.Header.Get(TimeoutHeader)
+	}
+	if to == "" {
+		return api.defaultTimeout, nil, nil
+	}
+	timeout, err := parseDuration(to)
+	if err != nil {
+		return 0, nil, &ApiError{errorBadData, errors.Wrapf(err, "param %s", timeoutParam)}
+	}
+
+	maxTimeout := api.maxTimeout
+	if maxTimeout < api.defaultTimeout {
+		maxTimeout = api.defaultTimeout
+	}
+	if maxTimeout > 0 && timeout > maxTimeout {
+		return maxTimeout, []error{errors.Errorf("requested timeout %s exceeds the maximum, lowered to %s", timeout, maxTimeout)}, nil
+	}
+	return timeout, nil, nil
+}
+
+// checkQueryMatchers checks the label matchers of the selectors of the given PromQL query against the limits.
+// Queries that do not parse are left to the engine to reject.
+func (api *API) checkQueryMatchers(query string) *ApiError {
+	if api.maxMatchersPerSelector <= 0 && api.maxMatchersPerQuery <= 0 {
+		return nil
+	}
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		return nil
+	}
+	var matcherSets [][]*labels.Matcher
+	promql.Inspect(expr, func(node promql.Node, _ []promql.Node) error {
+		switch n := node.(type) {
+		case *promql.VectorSelector:
+			matcherSets = append(matcherSets, n.LabelMatchers)
+		case *promql.MatrixSelector:
+			matcherSets = append(matcherSets, n.LabelMatchers)
+		}
+		return nil
+	})
+	return api.checkMatchers(matcherSets)
+}
+
+// checkMatchers rejects selectors with more label matchers than the limit per selector, and sets of selectors with
+// more label matchers in total than the limit per query, as every matcher adds a postings lookup in the Stores.
+func (api *API) checkMatchers(matcherSets [][]*labels.Matcher) *ApiError {
+	total := 0
+	for _, matchers := range matcherSets {
+		if api.maxMatchersPerSelector > 0 && len(matchers) > api.maxMatchersPerSelector {
+			return &ApiError{errorBadData, errors.Errorf("selector has %d label matchers, more than the maximum of %d allowed", len(matchers), api.maxMatchersPerSelector)}
+		}
+		total += len(matchers)
+	}
+	if api.maxMatchersPerQuery > 0 && total > api.maxMatchersPerQuery {
+		return &ApiError{errorBadData, errors.Errorf("query has %d label matchers, more than the maximum of %d allowed", total, api.maxMatchersPerQuery)}
+	}
+	return nil
+}
+
 func (api *API) options(r *http.Request) (interface{}, []error, *ApiError) {
 	return nil, nil, nil
 }
@@ -260,14 +558,13 @@ func (api *API) query(r *http.Request) (interface{}, []error, *ApiError) {
 		ts = api.now()
 	}
 
-	ctx := r.Context()
-	if to := r.FormValue("timeout"); to != "" {
+	ctx := api.withTenantLimits(r.Context(), r)
+	timeout, timeoutWarnings, apiErr := api.parseTimeout(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+	if timeout > 0 {
 		var cancel context.CancelFunc
-		timeout, err := parseDuration(to)
-		if err != nil {
-			return nil, nil, &ApiError{errorBadData, err}
-		}
-
 		ctx, cancel = context.WithTimeout(ctx, timeout)
 		defer cancel()
 	}
@@ -292,16 +589,74 @@ func (api *API) query(r *http.Request) (interface{}, []error, *ApiError) {
 		return nil, nil, apiErr
 	}
 
+	stream, apiErr := api.parseStreamParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	enableStats, apiErr := api.parseStatsParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	listStores, apiErr := api.parseStoresParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	verifyReplicas, apiErr := api.parseVerifyReplicasParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	tenant, apiErr := api.tenantMatcher(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	qs, err := api.macros.Expand(r.FormValue("query"))
+	if err != nil {
+		return nil, nil, &ApiError{errorBadData, err}
+	}
+	if apiErr := api.checkQueryMatchers(qs); apiErr != nil {
+		return nil, nil, apiErr
+	}
+
 	// We are starting promQL tracing span here, because we have no control over promQL code.
 	span, ctx := tracing.StartSpan(ctx, "promql_instant_query")
 	defer span.Finish()
 
-	qry, err := api.queryEngine.NewInstantQuery(api.queryableCreate(enableDedup, replicaLabels, maxSourceResolution, enablePartialResponse, false), r.FormValue("query"), ts)
+	active := activeQuery{
+		Query:  qs,
+		Type:   "instant",
+		Start:  ts,
+		End:    ts,
+		Tenant: api.tenant(r),
+	}
+	if verifyReplicas {
+		defer api.activeQueryTracker.insert(active)()
+		data, warnings, apiErr := api.queryReplicas(ctx, tenant, replicaLabels, maxSourceResolution, enablePartialResponse, api.instantQueryFreshStoresOnly, func(q storage.Queryable) (promql.Query, error) {
+			return api.queryEngine.NewInstantQuery(q, qs, ts)
+		})
+		return data, append(timeoutWarnings, warnings...), apiErr
+	}
+
+	qry, err := api.queryEngine.NewInstantQuery(withMatchers(api.queryableCreate(enableDedup, replicaLabels, maxSourceResolution, enablePartialResponse, false, api.instantQueryFreshStoresOnly), tenant), qs, ts)
 	if err != nil {
 		return nil, nil, &ApiError{errorBadData, err}
 	}
 
+	var seriesStats *store.SeriesStats
+	if enableStats || listStores {
+		seriesStats = store.NewSeriesStats()
+		ctx = store.ContextWithSeriesStats(ctx, seriesStats)
+	}
+	gaps := store.NewPartialResponseGaps()
+	ctx = store.ContextWithPartialResponseGaps(ctx, gaps)
+
+	done := api.activeQueryTracker.insert(active)
 	res := qry.Exec(ctx)
+	done()
 	if res.Err != nil {
 		switch res.Err.(type) {
 		case promql.ErrQueryCanceled:
@@ -313,11 +668,23 @@ func (api *API) query(r *http.Request) (interface{}, []error, *ApiError) {
 		}
 		return nil, nil, &ApiError{errorExec, res.Err}
 	}
+	if apiErr := api.checkResultPoints(res.Value); apiErr != nil {
+		return nil, nil, apiErr
+	}
 
-	return &queryData{
-		ResultType: res.Value.Type(),
-		Result:     res.Value,
-	}, res.Warnings, nil
+	qd := &queryData{
+		ResultType:          res.Value.Type(),
+		Result:              res.Value,
+		PartialResponseGaps: newPartialResponseGaps(gaps),
+		stream:              stream,
+	}
+	if enableStats {
+		qd.Stats = newQueryStats(qry, seriesStats)
+	}
+	if listStores {
+		qd.Stores = newQueryStores(seriesStats)
+	}
+	return qd, append(timeoutWarnings, partialResponseWarnings(qs, res.Warnings)...), nil
 }
 
 func (api *API) queryRange(r *http.Request) (interface{}, []error, *ApiError) {
@@ -350,15 +717,17 @@ func (api *API) queryRange(r *http.Request) (interface{}, []error, *ApiError) {
 		err := errors.New("exceeded maximum resolution of 11,000 points per timeseries. Try decreasing the query resolution (?step=XX)")
 		return nil, nil, &ApiError{errorBadData, err}
 	}
+	if apiErr := api.checkRangePoints(start, end, step); apiErr != nil {
+		return nil, nil, apiErr
+	}
 
-	ctx := r.Context()
-	if to := r.FormValue("timeout"); to != "" {
+	ctx := api.withTenantLimits(r.Context(), r)
+	timeout, timeoutWarnings, apiErr := api.parseTimeout(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+	if timeout > 0 {
 		var cancel context.CancelFunc
-		timeout, err := parseDuration(to)
-		if err != nil {
-			return nil, nil, &ApiError{errorBadData, err}
-		}
-
 		ctx, cancel = context.WithTimeout(ctx, timeout)
 		defer cancel()
 	}
@@ -373,8 +742,12 @@ func (api *API) queryRange(r *http.Request) (interface{}, []error, *ApiError) {
 		return nil, nil, apiErr
 	}
 
-	// If no max_source_resolution is specified fit at least 5 samples between steps.
-	maxSourceResolution, apiErr := api.parseDownsamplingParamMillis(r, step/5)
+	// If no max_source_resolution is specified fit at least 5 samples between steps, unless thresholds select it.
+	autoResolution := step / 5
+	if len(api.downsamplingThresholds) > 0 {
+		autoResolution = api.downsamplingThresholds.maxSourceResolution(step, end.Sub(start))
+	}
+	maxSourceResolution, apiErr := api.parseDownsamplingParamMillis(r, autoResolution)
 	if apiErr != nil {
 		return nil, nil, apiErr
 	}
@@ -384,13 +757,67 @@ func (api *API) queryRange(r *http.Request) (interface{}, []error, *ApiError) {
 		return nil, nil, apiErr
 	}
 
+	stream, apiErr := api.parseStreamParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	enableStats, apiErr := api.parseStatsParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	listStores, apiErr := api.parseStoresParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	verifyReplicas, apiErr := api.parseVerifyReplicasParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	explicitGaps, apiErr := api.parseExplicitGapsParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	tenant, apiErr := api.tenantMatcher(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	qs, err := api.macros.Expand(r.FormValue("query"))
+	if err != nil {
+		return nil, nil, &ApiError{errorBadData, err}
+	}
+	if apiErr := api.checkQueryMatchers(qs); apiErr != nil {
+		return nil, nil, apiErr
+	}
+
 	// We are starting promQL tracing span here, because we have no control over promQL code.
 	span, ctx := tracing.StartSpan(ctx, "promql_range_query")
 	defer span.Finish()
 
+	active := activeQuery{
+		Query:  qs,
+		Type:   "range",
+		Start:  start,
+		End:    end,
+		Step:   step.Seconds(),
+		Tenant: api.tenant(r),
+	}
+	if verifyReplicas {
+		defer api.activeQueryTracker.insert(active)()
+		data, warnings, apiErr := api.queryReplicas(ctx, tenant, replicaLabels, maxSourceResolution, enablePartialResponse, false, func(q storage.Queryable) (promql.Query, error) {
+			return api.queryEngine.NewRangeQuery(q, qs, start, end, step)
+		})
+		return data, append(timeoutWarnings, warnings...), apiErr
+	}
+
 	qry, err := api.queryEngine.NewRangeQuery(
-		api.queryableCreate(enableDedup, replicaLabels, maxSourceResolution, enablePartialResponse, false),
-		r.FormValue("query"),
+		withMatchers(api.queryableCreate(enableDedup, replicaLabels, maxSourceResolution, enablePartialResponse, false, false), tenant),
+		qs,
 		start,
 		end,
 		step,
@@ -399,7 +826,17 @@ func (api *API) queryRange(r *http.Request) (interface{}, []error, *ApiError) {
 		return nil, nil, &ApiError{errorBadData, err}
 	}
 
+	var seriesStats *store.SeriesStats
+	if enableStats || listStores {
+		seriesStats = store.NewSeriesStats()
+		ctx = store.ContextWithSeriesStats(ctx, seriesStats)
+	}
+	gaps := store.NewPartialResponseGaps()
+	ctx = store.ContextWithPartialResponseGaps(ctx, gaps)
+
+	done := api.activeQueryTracker.insert(active)
 	res := qry.Exec(ctx)
+	done()
 	if res.Err != nil {
 		switch res.Err.(type) {
 		case promql.ErrQueryCanceled:
@@ -409,11 +846,70 @@ func (api *API) queryRange(r *http.Request) (interface{}, []error, *ApiError) {
 		}
 		return nil, nil, &ApiError{errorExec, res.Err}
 	}
+	if apiErr := api.checkResultPoints(res.Value); apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	qd := &queryData{
+		ResultType:          res.Value.Type(),
+		Result:              res.Value,
+		PartialResponseGaps: newPartialResponseGaps(gaps),
+		stream:              stream,
+	}
+	if m, ok := res.Value.(promql.Matrix); ok && explicitGaps {
+		qd.Result = fillStepGaps(m, timestamp.FromTime(start), timestamp.FromTime(end), int64(step/time.Millisecond))
+	}
+	if enableStats {
+		qd.Stats = newQueryStats(qry, seriesStats)
+	}
+	if listStores {
+		qd.Stores = newQueryStores(seriesStats)
+	}
+	return qd, append(timeoutWarnings, partialResponseWarnings(qs, res.Warnings)...), nil
+}
 
-	return &queryData{
-		ResultType: res.Value.Type(),
-		Result:     res.Value,
-	}, res.Warnings, nil
+var (
+	// errAbsentUnverified is added to the warnings of partial responses to queries relying on the absence of series.
+	errAbsentUnverified = errors.New("absent() and absent_over_time() results are unverified: not all stores responded, and the series reported as absent might exist in one of them")
+	// errVectorMatchingIncomplete is added to the warnings of partial responses to queries matching vectors.
+	errVectorMatchingIncomplete = errors.New("vector matching results might be incomplete: not all stores responded, and series missing on one side of a binary operation drop or change their matches on the other side")
+)
+
+// partialResponseWarnings returns the given warnings of a query, annotated with the ways a partial response
+// might change its result: errAbsentUnverified if the query calls absent() or absent_over_time(), and
+// errVectorMatchingIncomplete if it has a binary operation between two vectors, with or without on(), ignoring()
+// and group_left()/group_right(). Warnings are only returned for partial responses, in which case a series
+// might be missing just because the store having it failed.
+func partialResponseWarnings(query string, warnings []error) []error {
+	if len(warnings) == 0 {
+		return warnings
+	}
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		return warnings
+	}
+	absent, vectorMatching := false, false
+	promql.Inspect(expr, func(node promql.Node, _ []promql.Node) error {
+		switch n := node.(type) {
+		case *promql.Call:
+			if n.Func.Name == "absent" || n.Func.Name == "absent_over_time" {
+				absent = true
+			}
+		case *promql.BinaryExpr:
+			// The parser only sets vector matching for operations between two vectors.
+			if n.VectorMatching != nil {
+				vectorMatching = true
+			}
+		}
+		return nil
+	})
+	if absent {
+		warnings = append(warnings, errAbsentUnverified)
+	}
+	if vectorMatching {
+		warnings = append(warnings, errVectorMatchingIncomplete)
+	}
+	return warnings
 }
 
 func (api *API) labelValues(r *http.Request) (interface{}, []error, *ApiError) {
@@ -429,7 +925,32 @@ func (api *API) labelValues(r *http.Request) (interface{}, []error, *ApiError) {
 		return nil, nil, apiErr
 	}
 
-	q, err := api.queryableCreate(true, nil, 0, enablePartialResponse, false).Querier(ctx, math.MinInt64, math.MaxInt64)
+	start, end, apiErr := parseMetadataTimeRange(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	tenant, apiErr := api.tenantMatcher(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	done, apiErr := api.waitMetadataTurn(ctx)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+	defer done()
+
+	unsorted, apiErr := api.parseUnsortedParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+	if unsorted {
+		ctx = store.ContextWithUnsortedLabels(ctx)
+	}
+
+	q, err := withTenantLabels(api.queryableCreate(true, nil, 0, enablePartialResponse, true, false), tenant, api.labelsCache, enablePartialResponse).
+		Querier(ctx, timestamp.FromTime(start), timestamp.FromTime(end))
 	if err != nil {
 		return nil, nil, &ApiError{errorExec, err}
 	}
@@ -450,6 +971,25 @@ var (
 	maxTime = time.Unix(math.MaxInt64/1000-62135596801, 999999999)
 )
 
+// parseMetadataTimeRange returns the time range given by the start and end parameters of a series or labels
+// request. Missing parameters default to the whole time range.
+func parseMetadataTimeRange(r *http.Request) (start, end time.Time, _ *ApiError) {
+	start, end = minTime, maxTime
+	if t := r.FormValue("start"); t != "" {
+		var err error
+		if start, err = parseTime(t); err != nil {
+			return time.Time{}, time.Time{}, &ApiError{errorBadData, err}
+		}
+	}
+	if t := r.FormValue("end"); t != "" {
+		var err error
+		if end, err = parseTime(t); err != nil {
+			return time.Time{}, time.Time{}, &ApiError{errorBadData, err}
+		}
+	}
+	return start, end, nil
+}
+
 func (api *API) series(r *http.Request) (interface{}, []error, *ApiError) {
 	if err := r.ParseForm(); err != nil {
 		return nil, nil, &ApiError{ErrorInternal, errors.Wrap(err, "parse form")}
@@ -459,26 +999,142 @@ func (api *API) series(r *http.Request) (interface{}, []error, *ApiError) {
 		return nil, nil, &ApiError{errorBadData, errors.New("no match[] parameter provided")}
 	}
 
-	var start time.Time
+	start, end, apiErr := parseMetadataTimeRange(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	var matcherSets [][]*labels.Matcher
+	for _, s := range r.Form["match[]"] {
+		matchers, err := promql.ParseMetricSelector(s)
+		if err != nil {
+			return nil, nil, &ApiError{errorBadData, err}
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+	if apiErr := api.checkMatchers(matcherSets); apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	enableDedup, apiErr := api.parseEnableDedupParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	replicaLabels, apiErr := api.parseReplicaLabelsParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	enablePartialResponse, apiErr := api.parsePartialResponseParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	unsorted, apiErr := api.parseUnsortedParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	tenant, apiErr := api.tenantMatcher(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	done, apiErr := api.waitMetadataTurn(r.Context())
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+	defer done()
+
+	q, err := withMatchers(api.queryableCreate(enableDedup, replicaLabels, math.MaxInt64, enablePartialResponse, true, false), tenant).
+		Querier(api.withTenantLimits(r.Context(), r), timestamp.FromTime(start), timestamp.FromTime(end))
+	if err != nil {
+		return nil, nil, &ApiError{errorExec, err}
+	}
+	defer runutil.CloseWithLogOnErr(api.logger, q, "queryable series")
+
+	var (
+		warnings []error
+		metrics  = []labels.Labels{}
+		sets     []storage.SeriesSet
+	)
+	for _, mset := range matcherSets {
+		s, warns, err := q.Select(nil, mset...)
+		if err != nil {
+			return nil, nil, &ApiError{errorExec, err}
+		}
+		warnings = append(warnings, warns...)
+		sets = append(sets, s)
+	}
+
+	if unsorted {
+		// The series of the matcher sets are concatenated instead of merged, only removing duplicates, which a single
+		// matcher set cannot have.
+		var seen map[string]struct{}
+		if len(sets) > 1 {
+			seen = map[string]struct{}{}
+		}
+		for _, set := range sets {
+			for set.Next() {
+				lset := set.At().Labels()
+				if seen != nil {
+					key := lset.String()
+					if _, ok := seen[key]; ok {
+						continue
+					}
+					seen[key] = struct{}{}
+				}
+				metrics = append(metrics, lset)
+			}
+			if set.Err() != nil {
+				return nil, nil, &ApiError{errorExec, set.Err()}
+			}
+		}
+		return metrics, warnings, nil
+	}
+
+	set := storage.NewMergeSeriesSet(sets, nil)
+	for set.Next() {
+		metrics = append(metrics, set.At().Labels())
+	}
+	if set.Err() != nil {
+		return nil, nil, &ApiError{errorExec, set.Err()}
+	}
+	return metrics, warnings, nil
+}
+
+// queryRaw returns the raw samples of the series matching the given selectors within the given time range as
+// stored, without evaluating them at aligned steps or applying the lookback delta.
+func (api *API) queryRaw(r *http.Request) (interface{}, []error, *ApiError) {
+	if err := r.ParseForm(); err != nil {
+		return nil, nil, &ApiError{ErrorInternal, errors.Wrap(err, "parse form")}
+	}
+
+	if len(r.Form["match[]"]) == 0 {
+		return nil, nil, &ApiError{errorBadData, errors.New("no match[] parameter provided")}
+	}
+
+	start := minTime
 	if t := r.FormValue("start"); t != "" {
 		var err error
 		start, err = parseTime(t)
 		if err != nil {
 			return nil, nil, &ApiError{errorBadData, err}
 		}
-	} else {
-		start = minTime
 	}
 
-	var end time.Time
+	end := maxTime
 	if t := r.FormValue("end"); t != "" {
 		var err error
 		end, err = parseTime(t)
 		if err != nil {
 			return nil, nil, &ApiError{errorBadData, err}
 		}
-	} else {
-		end = maxTime
+	}
+	if end.Before(start) {
+		err := errors.New("end timestamp must not be before start time")
+		return nil, nil, &ApiError{errorBadData, err}
 	}
 
 	var matcherSets [][]*labels.Matcher
@@ -489,6 +1145,9 @@ func (api *API) series(r *http.Request) (interface{}, []error, *ApiError) {
 		}
 		matcherSets = append(matcherSets, matchers)
 	}
+	if apiErr := api.checkMatchers(matcherSets); apiErr != nil {
+		return nil, nil, apiErr
+	}
 
 	enableDedup, apiErr := api.parseEnableDedupParam(r)
 	if apiErr != nil {
@@ -505,16 +1164,31 @@ func (api *API) series(r *http.Request) (interface{}, []error, *ApiError) {
 		return nil, nil, apiErr
 	}
 
-	q, err := api.queryableCreate(enableDedup, replicaLabels, math.MaxInt64, enablePartialResponse, true).
-		Querier(r.Context(), timestamp.FromTime(start), timestamp.FromTime(end))
+	stream, apiErr := api.parseStreamParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	explicitGaps, apiErr := api.parseExplicitGapsParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	tenant, apiErr := api.tenantMatcher(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	// Raw samples are only available in the raw resolution.
+	q, err := withMatchers(api.queryableCreate(enableDedup, replicaLabels, 0, enablePartialResponse, false, false), tenant).
+		Querier(api.withTenantLimits(r.Context(), r), timestamp.FromTime(start), timestamp.FromTime(end))
 	if err != nil {
 		return nil, nil, &ApiError{errorExec, err}
 	}
-	defer runutil.CloseWithLogOnErr(api.logger, q, "queryable series")
+	defer runutil.CloseWithLogOnErr(api.logger, q, "queryable raw")
 
 	var (
 		warnings []error
-		metrics  = []labels.Labels{}
 		sets     []storage.SeriesSet
 	)
 	for _, mset := range matcherSets {
@@ -526,14 +1200,41 @@ func (api *API) series(r *http.Request) (interface{}, []error, *ApiError) {
 		sets = append(sets, s)
 	}
 
-	set := storage.NewMergeSeriesSet(sets, nil)
+	var (
+		matrix  = promql.Matrix{}
+		samples int
+		set     = storage.NewMergeSeriesSet(sets, nil)
+	)
 	for set.Next() {
-		metrics = append(metrics, set.At().Labels())
+		series := promql.Series{Metric: set.At().Labels()}
+		it := set.At().Iterator()
+		for it.Next() {
+			if samples++; api.maxRawSamples > 0 && samples > api.maxRawSamples {
+				return nil, nil, &ApiError{errorExec, errors.Errorf("raw query selects more than %d samples, the maximum allowed", api.maxRawSamples)}
+			}
+			t, v := it.At()
+			series.Points = append(series.Points, promql.Point{T: t, V: v})
+		}
+		if it.Err() != nil {
+			return nil, nil, &ApiError{errorExec, it.Err()}
+		}
+		if len(series.Points) > 0 {
+			matrix = append(matrix, series)
+		}
 	}
 	if set.Err() != nil {
 		return nil, nil, &ApiError{errorExec, set.Err()}
 	}
-	return metrics, warnings, nil
+
+	qd := &queryData{
+		ResultType: promql.ValueTypeMatrix,
+		Result:     matrix,
+		stream:     stream,
+	}
+	if explicitGaps {
+		qd.Result = markStaleGaps(matrix)
+	}
+	return qd, warnings, nil
 }
 
 func Respond(w http.ResponseWriter, data interface{}, warnings []error) {
@@ -553,6 +1254,118 @@ func Respond(w http.ResponseWriter, data interface{}, warnings []error) {
 	_ = json.NewEncoder(w).Encode(resp)
 }
 
+// respondStream writes the same response as Respond, but serializes the result matrix or vector one element
+// at a time, so that only a single series of the result is encoded in memory at once instead of the whole
+// response. Elements are released as soon as they are written. Results of other types are written by Respond.
+func respondStream(w http.ResponseWriter, data *queryData, warnings []error) {
+	var (
+		n      int
+		encode func(i int) ([]byte, error)
+	)
+	switch v := data.Result.(type) {
+	case promql.Matrix:
+		if v != nil {
+			n = len(v)
+			encode = func(i int) ([]byte, error) {
+				b, err := json.Marshal(v[i])
+				v[i] = promql.Series{}
+				return b, err
+			}
+		}
+	case promql.Vector:
+		if v != nil {
+			n = len(v)
+			encode = func(i int) ([]byte, error) {
+				b, err := json.Marshal(v[i])
+				v[i] = promql.Sample{}
+				return b, err
+			}
+		}
+	case gapMatrix:
+		n = len(v)
+		encode = func(i int) ([]byte, error) {
+			b, err := json.Marshal(v[i])
+			v[i] = gapSeries{}
+			return b, err
+		}
+	}
+	if encode == nil || len(data.Warnings) > 0 || len(data.PartialResponseGaps) > 0 {
+		Respond(w, data, warnings)
+		return
+	}
+
+	resultType, err := json.Marshal(data.ResultType)
+	if err != nil {
+		RespondError(w, &ApiError{ErrorInternal, errors.Wrap(err, "marshal result type")}, nil)
+		return
+	}
+	var statsJSON []byte
+	if data.Stats != nil {
+		if statsJSON, err = json.Marshal(data.Stats); err != nil {
+			RespondError(w, &ApiError{ErrorInternal, errors.Wrap(err, "marshal stats")}, nil)
+			return
+		}
+	}
+	var storesJSON []byte
+	if len(data.Stores) > 0 {
+		if storesJSON, err = json.Marshal(data.Stores); err != nil {
+			RespondError(w, &ApiError{ErrorInternal, errors.Wrap(err, "marshal stores")}, nil)
+			return
+		}
+	}
+	var warns []string
+	for _, warn := range warnings {
+		warns = append(warns, warn.Error())
+	}
+	var warnsJSON []byte
+	if len(warns) > 0 {
+		if warnsJSON, err = json.Marshal(warns); err != nil {
+			RespondError(w, &ApiError{ErrorInternal, errors.Wrap(err, "marshal warnings")}, nil)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(warnings) > 0 {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	// The status is already sent, so errors past this point can only be signaled to the client by an incomplete response.
+	bw := bufio.NewWriter(w)
+	_, _ = bw.WriteString(`{"status":"` + string(statusSuccess) + `","data":{"resultType":`)
+	_, _ = bw.Write(resultType)
+	_, _ = bw.WriteString(`,"result":[`)
+	for i := 0; i < n; i++ {
+		b, err := encode(i)
+		if err != nil {
+			return
+		}
+		if i > 0 {
+			_ = bw.WriteByte(',')
+		}
+		if _, err := bw.Write(b); err != nil {
+			return
+		}
+	}
+	_ = bw.WriteByte(']')
+	if len(statsJSON) > 0 {
+		_, _ = bw.WriteString(`,"stats":`)
+		_, _ = bw.Write(statsJSON)
+	}
+	if len(storesJSON) > 0 {
+		_, _ = bw.WriteString(`,"stores":`)
+		_, _ = bw.Write(storesJSON)
+	}
+	_ = bw.WriteByte('}')
+	if len(warnsJSON) > 0 {
+		_, _ = bw.WriteString(`,"warnings":`)
+		_, _ = bw.Write(warnsJSON)
+	}
+	_, _ = bw.WriteString("}\n")
+	_ = bw.Flush()
+}
+
 func RespondError(w http.ResponseWriter, apiErr *ApiError, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "no-store")
@@ -605,6 +1418,18 @@ func parseDuration(s string) (time.Duration, error) {
 	return 0, errors.Errorf("cannot parse %q to a valid duration", s)
 }
 
+// waitMetadataTurn waits until the label names, label values or series request of the given context may run, if
+// their concurrency is limited. The returned function must be called once the request is done.
+func (api *API) waitMetadataTurn(ctx context.Context) (func(), *ApiError) {
+	if api.metadataGate == nil {
+		return func() {}, nil
+	}
+	if err := api.metadataGate.IsMyTurn(ctx); err != nil {
+		return nil, &ApiError{errorCanceled, errors.Wrap(err, "wait for metadata request concurrency")}
+	}
+	return api.metadataGate.Done, nil
+}
+
 func (api *API) labelNames(r *http.Request) (interface{}, []error, *ApiError) {
 	ctx := r.Context()
 
@@ -613,7 +1438,32 @@ func (api *API) labelNames(r *http.Request) (interface{}, []error, *ApiError) {
 		return nil, nil, apiErr
 	}
 
-	q, err := api.queryableCreate(true, nil, 0, enablePartialResponse, false).Querier(ctx, math.MinInt64, math.MaxInt64)
+	start, end, apiErr := parseMetadataTimeRange(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	tenant, apiErr := api.tenantMatcher(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	done, apiErr := api.waitMetadataTurn(ctx)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+	defer done()
+
+	unsorted, apiErr := api.parseUnsortedParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+	if unsorted {
+		ctx = store.ContextWithUnsortedLabels(ctx)
+	}
+
+	q, err := withTenantLabels(api.queryableCreate(true, nil, 0, enablePartialResponse, true, false), tenant, api.labelsCache, enablePartialResponse).
+		Querier(ctx, timestamp.FromTime(start), timestamp.FromTime(end))
 	if err != nil {
 		return nil, nil, &ApiError{errorExec, err}
 	}
@@ -626,3 +1476,48 @@ func (api *API) labelNames(r *http.Request) (interface{}, []error, *ApiError) {
 
 	return names, warnings, nil
 }
+
+// metricMetadata is the metadata of a metric as returned by the metadata endpoint.
+type metricMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+func (api *API) metadata(r *http.Request) (interface{}, []error, *ApiError) {
+	limit := 0
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil {
+			return nil, nil, &ApiError{errorBadData, errors.New("limit must be a number")}
+		}
+	}
+
+	tenantMatcher, apiErr := api.tenantMatcher(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+	var tenant string
+	if tenantMatcher != nil {
+		tenant = tenantMatcher.Value
+	}
+
+	res := map[string][]metricMetadata{}
+	if api.metadataFetcher == nil {
+		return res, nil, nil
+	}
+	families, warnings, err := api.metadataFetcher.Metadata(r.Context(), tenant, r.FormValue("metric"), limit)
+	if err != nil {
+		return nil, nil, &ApiError{errorExec, err}
+	}
+	for name, mds := range families {
+		for _, md := range mds {
+			res[name] = append(res[name], metricMetadata{
+				Type: strings.ToLower(md.Type.String()),
+				Help: md.Help,
+				Unit: md.Unit,
+			})
+		}
+	}
+	return res, warnings, nil
+}
@@ -22,11 +22,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -38,12 +40,16 @@ import (
 	"github.com/prometheus/common/route"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/pkg/value"
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
 	"github.com/thanos-io/thanos/pkg/compact"
 	"github.com/thanos-io/thanos/pkg/component"
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
 	"github.com/thanos-io/thanos/pkg/query"
+	"github.com/thanos-io/thanos/pkg/runutil"
 	"github.com/thanos-io/thanos/pkg/store"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/testutil"
 	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
 )
@@ -101,7 +107,7 @@ func TestEndpoints(t *testing.T) {
 
 	now := time.Now()
 	api := &API{
-		queryableCreate: query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil)),
+		queryableCreate: query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), nil, 0, 0, nil),
 		queryEngine: promql.NewEngine(promql.EngineOpts{
 			Logger:        nil,
 			Reg:           nil,
@@ -543,6 +549,38 @@ func TestEndpoints(t *testing.T) {
 				labels.FromStrings("__name__", "test_metric2", "foo", "boo"),
 			},
 		},
+		// Series of several matcher sets are sorted, unless unsorted results are allowed.
+		{
+			endpoint: api.series,
+			query: url.Values{
+				"match[]": []string{`test_metric2`, `test_metric1`, `test_metric2`},
+			},
+			response: []labels.Labels{
+				labels.FromStrings("__name__", "test_metric1", "foo", "bar"),
+				labels.FromStrings("__name__", "test_metric1", "foo", "boo"),
+				labels.FromStrings("__name__", "test_metric2", "foo", "boo"),
+			},
+		},
+		{
+			endpoint: api.series,
+			query: url.Values{
+				"match[]":  []string{`test_metric2`, `test_metric1`, `test_metric2`},
+				"unsorted": []string{"true"},
+			},
+			response: []labels.Labels{
+				labels.FromStrings("__name__", "test_metric2", "foo", "boo"),
+				labels.FromStrings("__name__", "test_metric1", "foo", "bar"),
+				labels.FromStrings("__name__", "test_metric1", "foo", "boo"),
+			},
+		},
+		{
+			endpoint: api.series,
+			query: url.Values{
+				"match[]":  []string{`test_metric2`},
+				"unsorted": []string{"maybe"},
+			},
+			errType: errorBadData,
+		},
 		// Series that does not exist should return an empty array.
 		{
 			endpoint: api.series,
@@ -840,6 +878,896 @@ func TestEndpoints(t *testing.T) {
 	}
 }
 
+// partialStoreServer serves the series of its underlying store together with a warning,
+// like the proxy does with partial response enabled when one of its stores is down.
+type partialStoreServer struct {
+	storepb.StoreServer
+}
+
+func (s *partialStoreServer) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	if err := srv.Send(storepb.NewWarnSeriesResponse(errors.New("store unavailable"))); err != nil {
+		return err
+	}
+	return s.StoreServer.Series(r, srv)
+}
+
+func TestQueryPartialResponseWarnings(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	for i := int64(0); i < 10; i++ {
+		_, err := app.Add(labels.FromStrings("__name__", "test_metric1", "foo", "bar"), i*60000, float64(i))
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	newAPI := func(s storepb.StoreServer) *API {
+		return &API{
+			queryableCreate: query.NewQueryableCreator(nil, s, nil, 0, 0, nil),
+			queryEngine: promql.NewEngine(promql.EngineOpts{
+				MaxConcurrent: 20,
+				MaxSamples:    10000,
+				Timeout:       100 * time.Second,
+			}),
+			now: func() time.Time { return time.Unix(0, 0) },
+		}
+	}
+	tsdbStore := store.NewTSDBStore(nil, nil, db, component.Query, nil)
+	complete := newAPI(tsdbStore)
+	partial := newAPI(&partialStoreServer{StoreServer: tsdbStore})
+
+	for _, tc := range []struct {
+		name     string
+		api      *API
+		query    string
+		warnings []error
+	}{
+		{
+			name:  "absent with all stores responding",
+			api:   complete,
+			query: `absent(test_metric2)`,
+		},
+		{
+			name:     "absent with partial response",
+			api:      partial,
+			query:    `absent(test_metric2)`,
+			warnings: []error{errors.New("store unavailable"), errAbsentUnverified},
+		},
+		{
+			name:     "nested absent_over_time with partial response",
+			api:      partial,
+			query:    `sum(absent_over_time(test_metric1[5m])) or vector(1)`,
+			warnings: []error{errors.New("store unavailable"), errAbsentUnverified, errVectorMatchingIncomplete},
+		},
+		{
+			name:     "query without absent with partial response",
+			api:      partial,
+			query:    `test_metric1`,
+			warnings: []error{errors.New("store unavailable")},
+		},
+		{
+			name:  "vector matching with all stores responding",
+			api:   complete,
+			query: `test_metric1 / on(foo) group_left test_metric1`,
+		},
+		{
+			name:  "vector matching with partial response",
+			api:   partial,
+			query: `test_metric1 / on(foo) group_left test_metric1`,
+			// Every selection of the partial store warns about it.
+			warnings: []error{errors.New("store unavailable"), errors.New("store unavailable"), errVectorMatchingIncomplete},
+		},
+		{
+			name:     "nested vector matching with partial response",
+			api:      partial,
+			query:    `sum(test_metric1 * ignoring(foo) test_metric1) or absent(test_metric2)`,
+			warnings: []error{errors.New("store unavailable"), errors.New("store unavailable"), errors.New("store unavailable"), errAbsentUnverified, errVectorMatchingIncomplete},
+		},
+		{
+			name:     "scalar binary operation with partial response",
+			api:      partial,
+			query:    `test_metric1 * 2`,
+			warnings: []error{errors.New("store unavailable")},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, endpoint := range []ApiFunc{tc.api.query, tc.api.queryRange} {
+				req, err := http.NewRequest("GET", "http://example.com?"+url.Values{
+					"query":            []string{tc.query},
+					"time":             []string{"300"},
+					"start":            []string{"0"},
+					"end":              []string{"300"},
+					"step":             []string{"60"},
+					"partial_response": []string{"true"},
+				}.Encode(), nil)
+				testutil.Ok(t, err)
+
+				_, warnings, apiErr := endpoint(req)
+				testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+				testutil.Equals(t, len(tc.warnings), len(warnings))
+				for i := range tc.warnings {
+					testutil.Equals(t, tc.warnings[i].Error(), warnings[i].Error())
+				}
+			}
+		})
+	}
+}
+
+func TestQueryStream(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	for i := 0; i < 1000; i++ {
+		lset := labels.FromStrings("__name__", "test_metric", "instance", fmt.Sprintf("instance-%d", i), "job", "test")
+		for j := int64(0); j < 60; j++ {
+			_, err := app.Add(lset, j*15000, rand.Float64())
+			testutil.Ok(t, err)
+		}
+	}
+	testutil.Ok(t, app.Commit())
+
+	tsdbStore := store.NewTSDBStore(nil, nil, db, component.Query, nil)
+	for _, tc := range []struct {
+		name  string
+		store storepb.StoreServer
+		path  string
+		query string
+	}{
+		{name: "range query", store: tsdbStore, path: "/query_range", query: `test_metric`},
+		{name: "instant query", store: tsdbStore, path: "/query", query: `test_metric`},
+		{name: "empty result", store: tsdbStore, path: "/query_range", query: `test_metric2`},
+		{name: "scalar", store: tsdbStore, path: "/query", query: `scalar(count(test_metric))`},
+		{name: "partial response", store: &partialStoreServer{StoreServer: tsdbStore}, path: "/query_range", query: `test_metric`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			api := &API{
+				queryableCreate: query.NewQueryableCreator(nil, tc.store, nil, 0, 0, nil),
+				queryEngine: promql.NewEngine(promql.EngineOpts{
+					MaxConcurrent: 20,
+					MaxSamples:    1000000,
+					Timeout:       100 * time.Second,
+				}),
+				now: func() time.Time { return time.Unix(0, 0) },
+			}
+			r := route.New()
+			api.Register(r, &opentracing.NoopTracer{}, log.NewNopLogger(), extpromhttp.NewNopInstrumentationMiddleware())
+			s := httptest.NewServer(r)
+			defer s.Close()
+
+			get := func(stream bool) string {
+				resp, err := http.Get(s.URL + tc.path + "?" + url.Values{
+					"query":            []string{tc.query},
+					"time":             []string{"900"},
+					"start":            []string{"0"},
+					"end":              []string{"900"},
+					"step":             []string{"15"},
+					"partial_response": []string{"true"},
+					"stream":           []string{fmt.Sprint(stream)},
+				}.Encode())
+				testutil.Ok(t, err)
+				defer func() { testutil.Ok(t, resp.Body.Close()) }()
+				testutil.Equals(t, http.StatusOK, resp.StatusCode)
+				testutil.Equals(t, "application/json", resp.Header.Get("Content-Type"))
+
+				body, err := ioutil.ReadAll(resp.Body)
+				testutil.Ok(t, err)
+				return string(body)
+			}
+			buffered := get(false)
+			testutil.Equals(t, buffered, get(true))
+
+			var res response
+			testutil.Ok(t, json.Unmarshal([]byte(buffered), &res))
+			testutil.Equals(t, statusSuccess, res.Status)
+		})
+	}
+}
+
+func TestQueryStats(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	for i := 0; i < 3; i++ {
+		lset := labels.FromStrings("__name__", "test_metric", "instance", fmt.Sprintf("instance-%d", i))
+		for j := int64(0); j < 60; j++ {
+			_, err := app.Add(lset, j*15000, float64(j))
+			testutil.Ok(t, err)
+		}
+	}
+	testutil.Ok(t, app.Commit())
+
+	api := &API{
+		queryableCreate: query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), nil, 0, 0, nil),
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       100 * time.Second,
+		}),
+		now: func() time.Time { return time.Unix(0, 0) },
+	}
+	r := route.New()
+	api.Register(r, &opentracing.NoopTracer{}, log.NewNopLogger(), extpromhttp.NewNopInstrumentationMiddleware())
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	get := func(path, query, stats string, stream bool) (int, map[string]interface{}) {
+		resp, err := http.Get(s.URL + path + "?" + url.Values{
+			"query":  []string{query},
+			"time":   []string{"900"},
+			"start":  []string{"0"},
+			"end":    []string{"900"},
+			"step":   []string{"15"},
+			"stats":  []string{stats},
+			"stream": []string{fmt.Sprint(stream)},
+		}.Encode())
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, resp.Body.Close()) }()
+
+		var res struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		testutil.Ok(t, json.NewDecoder(resp.Body).Decode(&res))
+		return resp.StatusCode, res.Data
+	}
+
+	for _, path := range []string{"/query", "/query_range"} {
+		for _, stream := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s stream=%v", path, stream), func(t *testing.T) {
+				code, data := get(path, `test_metric{instance!="instance-2"}`, "", stream)
+				testutil.Equals(t, http.StatusOK, code)
+				_, ok := data["stats"]
+				testutil.Assert(t, !ok, "stats returned without being requested")
+
+				code, data = get(path, `test_metric{instance!="instance-2"}`, "all", stream)
+				testutil.Equals(t, http.StatusOK, code)
+				stats, ok := data["stats"].(map[string]interface{})
+				testutil.Assert(t, ok, "no stats returned: %v", data)
+
+				// Two series with a single chunk each are selected, the TSDB store is not a proxy of other stores.
+				testutil.Equals(t, 2.0, stats["series"])
+				testutil.Equals(t, 2.0, stats["chunks"])
+				testutil.Assert(t, stats["bytes"].(float64) > 0, "no bytes counted")
+				testutil.Equals(t, map[string]interface{}{"raw": 2.0}, stats["resolutions"])
+				testutil.Equals(t, []interface{}{}, stats["stores"])
+				timings, ok := stats["timings"].(map[string]interface{})
+				testutil.Assert(t, ok, "no timings returned: %v", stats)
+				testutil.Assert(t, timings["execTotalTime"].(float64) > 0, "no execution time recorded")
+			})
+		}
+	}
+
+	code, _ := get("/query", "test_metric", "true", false)
+	testutil.Equals(t, http.StatusBadRequest, code)
+}
+
+// blockingStoreServer serves the series of its underlying store once it is released.
+type blockingStoreServer struct {
+	storepb.StoreServer
+	release chan struct{}
+}
+
+func (s *blockingStoreServer) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	<-s.release
+	return s.StoreServer.Series(r, srv)
+}
+
+func TestMetadataConcurrencyLimit(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	_, err = app.Add(labels.FromStrings("__name__", "test_metric", "instance", "a"), 0, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	api := NewAPI(nil, nil, promql.NewEngine(promql.EngineOpts{
+		MaxConcurrent: 1,
+		MaxSamples:    10000,
+		Timeout:       100 * time.Second,
+	}), query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), nil, 0, 0, nil), false, false, nil, 0, false, 0, nil, nil, false, TenancyConfig{}, nil, 1, 0, 0, "", false, 0, 0, nil, 0, 0)
+	api.now = func() time.Time { return time.Unix(0, 0) }
+
+	request := func(ctx context.Context, path string) *http.Request {
+		r, err := http.NewRequest("GET", "http://example.com"+path+"?"+url.Values{
+			"query":   []string{"test_metric"},
+			"match[]": []string{"test_metric"},
+			"time":    []string{"0"},
+		}.Encode(), nil)
+		testutil.Ok(t, err)
+		return r.WithContext(route.WithParam(ctx, "name", "instance"))
+	}
+	metadataEndpoints := map[string]ApiFunc{
+		"/labels":                api.labelNames,
+		"/label/instance/values": api.labelValues,
+		"/series":                api.series,
+	}
+
+	for path, f := range metadataEndpoints {
+		_, _, apiErr := f(request(context.Background(), path))
+		testutil.Assert(t, apiErr == nil, "%s: unexpected error %v", path, apiErr)
+	}
+
+	// Occupy the only metadata request slot.
+	testutil.Ok(t, api.metadataGate.IsMyTurn(context.Background()))
+
+	for path, f := range metadataEndpoints {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, _, apiErr := f(request(ctx, path))
+		cancel()
+		testutil.Assert(t, apiErr != nil, "%s: expected metadata request to wait for the limit", path)
+		testutil.Equals(t, errorCanceled, apiErr.Typ)
+	}
+
+	// Queries are not limited by the metadata limit.
+	_, _, apiErr := api.query(request(context.Background(), "/query"))
+	testutil.Assert(t, apiErr == nil, "unexpected query error %v", apiErr)
+
+	api.metadataGate.Done()
+	for path, f := range metadataEndpoints {
+		_, _, apiErr := f(request(context.Background(), path))
+		testutil.Assert(t, apiErr == nil, "%s: unexpected error %v", path, apiErr)
+	}
+
+	// Without limit, no gate is used.
+	api = NewAPI(nil, nil, nil, nil, false, false, nil, 0, false, 0, nil, nil, false, TenancyConfig{}, nil, 0, 0, 0, "", false, 0, 0, nil, 0, 0)
+	testutil.Assert(t, api.metadataGate == nil, "expected no metadata gate without limit")
+}
+
+func TestActiveQueries(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	s := &blockingStoreServer{StoreServer: store.NewTSDBStore(nil, nil, db, component.Query, nil), release: make(chan struct{})}
+	api := &API{
+		queryableCreate: query.NewQueryableCreator(nil, s, nil, 0, 0, nil),
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       100 * time.Second,
+		}),
+		activeQueryTracker: newActiveQueryTracker(),
+		tenancy:            TenancyConfig{Header: DefaultTenantHeader},
+		now:                func() time.Time { return time.Unix(0, 0) },
+	}
+	r := route.New()
+	api.Register(r, &opentracing.NoopTracer{}, log.NewNopLogger(), extpromhttp.NewNopInstrumentationMiddleware())
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	list := func() []activeQuery {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/status/active_queries")
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, resp.Body.Close()) }()
+		testutil.Equals(t, http.StatusOK, resp.StatusCode)
+
+		var res struct {
+			Status status        `json:"status"`
+			Data   []activeQuery `json:"data"`
+		}
+		testutil.Ok(t, json.NewDecoder(resp.Body).Decode(&res))
+		testutil.Equals(t, statusSuccess, res.Status)
+		return res.Data
+	}
+	testutil.Equals(t, []activeQuery{}, list())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req, err := http.NewRequest("GET", srv.URL+"/query_range?"+url.Values{
+			"query": []string{"test_metric"},
+			"start": []string{"0"},
+			"end":   []string{"300"},
+			"step":  []string{"60"},
+		}.Encode(), nil)
+		testutil.Ok(t, err)
+		req.Header.Set(DefaultTenantHeader, "team-a")
+		resp, err := http.DefaultClient.Do(req)
+		testutil.Ok(t, err)
+		testutil.Ok(t, resp.Body.Close())
+		testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	}()
+
+	testutil.Ok(t, runutil.Retry(10*time.Millisecond, context.Background().Done(), func() error {
+		if len(api.activeQueryTracker.list("")) == 0 {
+			return errors.New("query not active yet")
+		}
+		return nil
+	}))
+	active := list()
+	testutil.Equals(t, 1, len(active))
+	testutil.Assert(t, active[0].ElapsedSeconds >= 0, "unexpected elapsed duration %v", active[0].ElapsedSeconds)
+	testutil.Equals(t, activeQuery{
+		Query:          "test_metric",
+		Type:           "range",
+		Start:          time.Unix(0, 0).UTC(),
+		End:            time.Unix(300, 0).UTC(),
+		Step:           60,
+		Tenant:         "team-a",
+		StartedAt:      active[0].StartedAt,
+		ElapsedSeconds: active[0].ElapsedSeconds,
+	}, active[0])
+
+	// Finished queries are not active anymore.
+	close(s.release)
+	<-done
+	testutil.Equals(t, []activeQuery{}, list())
+}
+
+func TestQueryRaw(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	// Scrape timestamps are jittered, so that they are not aligned to any step.
+	var (
+		lset = labels.FromStrings("__name__", "test_metric", "job", "test")
+		exp  []promql.Point
+		app  = db.Appender()
+	)
+	for i := int64(0); i < 10; i++ {
+		p := promql.Point{T: 1234 + i*15017, V: float64(i)}
+		_, err := app.Add(lset, p.T, p.V)
+		testutil.Ok(t, err)
+		exp = append(exp, p)
+	}
+	_, err = app.Add(labels.FromStrings("__name__", "other_metric"), 1000, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	api := &API{
+		logger:          log.NewNopLogger(),
+		queryableCreate: query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), nil, 0, 0, nil),
+		maxRawSamples:   10,
+	}
+
+	for _, tc := range []struct {
+		name     string
+		query    url.Values
+		expected promql.Matrix
+		errType  ErrorType
+	}{
+		{
+			name:     "raw samples",
+			query:    url.Values{"match[]": []string{`test_metric`}},
+			expected: promql.Matrix{{Metric: lset, Points: exp}},
+		},
+		{
+			name: "range",
+			query: url.Values{
+				"match[]": []string{`test_metric`},
+				"start":   []string{"16"},
+				"end":     []string{"47"},
+			},
+			expected: promql.Matrix{{Metric: lset, Points: exp[1:4]}},
+		},
+		{
+			name:     "overlapping selectors",
+			query:    url.Values{"match[]": []string{`test_metric`, `{job="test"}`}},
+			expected: promql.Matrix{{Metric: lset, Points: exp}},
+		},
+		{
+			name:    "too many samples",
+			query:   url.Values{"match[]": []string{`{__name__=~".+"}`}},
+			errType: errorExec,
+		},
+		{
+			name:    "no matchers",
+			query:   url.Values{},
+			errType: errorBadData,
+		},
+		{
+			name: "end before start",
+			query: url.Values{
+				"match[]": []string{`test_metric`},
+				"start":   []string{"10"},
+				"end":     []string{"5"},
+			},
+			errType: errorBadData,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://example.com?"+tc.query.Encode(), nil)
+			testutil.Ok(t, err)
+
+			resp, _, apiErr := api.queryRaw(req)
+			if tc.errType != errorNone {
+				testutil.Assert(t, apiErr != nil, "expected error")
+				testutil.Equals(t, tc.errType, apiErr.Typ)
+				return
+			}
+			testutil.Assert(t, apiErr == nil, "unexpected error: %v", apiErr)
+			testutil.Equals(t, &queryData{ResultType: promql.ValueTypeMatrix, Result: tc.expected}, resp)
+		})
+	}
+}
+
+func TestExplicitGaps(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	// The series ends with a staleness marker, after which the range query has no points.
+	app := db.Appender()
+	lset := labels.FromStrings("__name__", "test_metric", "job", "test")
+	for _, s := range []struct {
+		t int64
+		v float64
+	}{
+		{t: 0, v: 1},
+		{t: 15000, v: math.NaN()},
+		{t: 30000, v: math.Inf(1)},
+		{t: 45000, v: math.Inf(-1)},
+		{t: 60000, v: math.Float64frombits(value.StaleNaN)},
+	} {
+		_, err := app.Add(lset, s.t, s.v)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	api := &API{
+		logger:          log.NewNopLogger(),
+		queryableCreate: query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), nil, 0, 0, nil),
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       100 * time.Second,
+		}),
+		now: func() time.Time { return time.Unix(0, 0) },
+	}
+	r := route.New()
+	api.Register(r, &opentracing.NoopTracer{}, log.NewNopLogger(), extpromhttp.NewNopInstrumentationMiddleware())
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	for _, tc := range []struct {
+		name         string
+		path         string
+		query        url.Values
+		explicitGaps bool
+		expected     string
+	}{
+		{
+			name:     "range query",
+			path:     "/query_range",
+			query:    url.Values{"query": []string{"test_metric"}, "start": []string{"0"}, "end": []string{"90"}, "step": []string{"15"}},
+			expected: `[[0,"1"],[15,"NaN"],[30,"+Inf"],[45,"-Inf"]]`,
+		},
+		{
+			name:         "range query with explicit gaps",
+			path:         "/query_range",
+			query:        url.Values{"query": []string{"test_metric"}, "start": []string{"0"}, "end": []string{"90"}, "step": []string{"15"}},
+			explicitGaps: true,
+			expected:     `[[0,"1"],[15,"NaN"],[30,"+Inf"],[45,"-Inf"],[60,null],[75,null],[90,null]]`,
+		},
+		{
+			name:     "raw query",
+			path:     "/query_raw",
+			query:    url.Values{"match[]": []string{"test_metric"}},
+			expected: `[[0,"1"],[15,"NaN"],[30,"+Inf"],[45,"-Inf"],[60,"NaN"]]`,
+		},
+		{
+			name:         "raw query with explicit gaps",
+			path:         "/query_raw",
+			query:        url.Values{"match[]": []string{"test_metric"}},
+			explicitGaps: true,
+			expected:     `[[0,"1"],[15,"NaN"],[30,"+Inf"],[45,"-Inf"],[60,null]]`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			get := func(stream bool) string {
+				q := url.Values{"stream": []string{fmt.Sprint(stream)}, "explicit_gaps": []string{fmt.Sprint(tc.explicitGaps)}}
+				for k, v := range tc.query {
+					q[k] = v
+				}
+				resp, err := http.Get(s.URL + tc.path + "?" + q.Encode())
+				testutil.Ok(t, err)
+				defer func() { testutil.Ok(t, resp.Body.Close()) }()
+				testutil.Equals(t, http.StatusOK, resp.StatusCode)
+
+				body, err := ioutil.ReadAll(resp.Body)
+				testutil.Ok(t, err)
+				return string(body)
+			}
+			body := get(false)
+			testutil.Equals(t, body, get(true))
+
+			var res struct {
+				Data struct {
+					Result []struct {
+						Values json.RawMessage `json:"values"`
+					} `json:"result"`
+				} `json:"data"`
+			}
+			testutil.Ok(t, json.Unmarshal([]byte(body), &res))
+			testutil.Equals(t, 1, len(res.Data.Result))
+			testutil.Equals(t, tc.expected, string(res.Data.Result[0].Values))
+		})
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com?explicit_gaps=maybe&match[]=test_metric", nil)
+	testutil.Ok(t, err)
+	_, _, apiErr := api.queryRaw(req)
+	testutil.Assert(t, apiErr != nil, "expected error")
+	testutil.Equals(t, errorBadData, apiErr.Typ)
+}
+
+func TestMatchersLimits(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	_, err = app.Add(labels.FromStrings("__name__", "test_metric", "job", "test", "instance", "a"), 0, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	api := &API{
+		logger:          log.NewNopLogger(),
+		queryableCreate: query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), nil, 0, 0, nil),
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       100 * time.Second,
+		}),
+		maxRawSamples:          10,
+		maxMatchersPerSelector: 3,
+		maxMatchersPerQuery:    5,
+		now:                    func() time.Time { return time.Unix(0, 0) },
+	}
+
+	for _, tc := range []struct {
+		name     string
+		endpoint ApiFunc
+		query    url.Values
+		rejected bool
+	}{
+		{
+			name:     "instant query within limits",
+			endpoint: api.query,
+			query:    url.Values{"query": []string{`test_metric{job="test", instance="a"}`}},
+		},
+		{
+			name:     "instant query over selector limit",
+			endpoint: api.query,
+			query:    url.Values{"query": []string{`test_metric{job="test", instance="a", foo!="bar"}`}},
+			rejected: true,
+		},
+		{
+			name:     "range query over selector limit in range selector",
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query": []string{`rate(test_metric{job="test", instance="a", foo!="bar"}[5m])`},
+				"start": []string{"0"},
+				"end":   []string{"60"},
+				"step":  []string{"15"},
+			},
+			rejected: true,
+		},
+		{
+			name:     "range query over query limit",
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query": []string{`test_metric{job="test", instance="a"} / on(job) test_metric{job="test", instance="a"}`},
+				"start": []string{"0"},
+				"end":   []string{"60"},
+				"step":  []string{"15"},
+			},
+			rejected: true,
+		},
+		{
+			name:     "raw query within limits",
+			endpoint: api.queryRaw,
+			query:    url.Values{"match[]": []string{`test_metric{job="test"}`, `{instance="a"}`}},
+		},
+		{
+			name:     "raw query over selector limit",
+			endpoint: api.queryRaw,
+			query:    url.Values{"match[]": []string{`test_metric{job="test", instance="a", foo!="bar"}`}},
+			rejected: true,
+		},
+		{
+			name:     "series over query limit",
+			endpoint: api.series,
+			query:    url.Values{"match[]": []string{`test_metric{job="test", instance="a"}`, `test_metric{job="test", instance="a"}`}},
+			rejected: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://example.com?"+tc.query.Encode(), nil)
+			testutil.Ok(t, err)
+
+			_, _, apiErr := tc.endpoint(req)
+			if !tc.rejected {
+				testutil.Assert(t, apiErr == nil, "unexpected error: %v", apiErr)
+				return
+			}
+			testutil.Assert(t, apiErr != nil, "expected error")
+			testutil.Equals(t, errorBadData, apiErr.Typ)
+			testutil.Assert(t, strings.Contains(apiErr.Err.Error(), "label matchers"), "unexpected error: %v", apiErr.Err)
+		})
+	}
+}
+
+func TestPointsLimits(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	for _, instance := range []string{"a", "b"} {
+		lset := labels.FromStrings("__name__", "test_metric", "instance", instance)
+		for ts := int64(0); ts <= 3600; ts += 15 {
+			_, err = app.Add(lset, ts*1000, float64(ts))
+			testutil.Ok(t, err)
+		}
+	}
+	testutil.Ok(t, app.Commit())
+
+	api := &API{
+		logger:          log.NewNopLogger(),
+		queryableCreate: query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), nil, 0, 0, nil),
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       100 * time.Second,
+		}),
+		maxPointsPerSeries: 100,
+		maxPoints:          150,
+		now:                func() time.Time { return time.Unix(3600, 0) },
+	}
+
+	for _, tc := range []struct {
+		name     string
+		endpoint ApiFunc
+		query    url.Values
+		errType  ErrorType
+		errMsg   string
+	}{
+		{
+			name:     "instant query within limits",
+			endpoint: api.query,
+			query:    url.Values{"query": []string{`test_metric[10m]`}},
+		},
+		{
+			name:     "instant query over series limit",
+			endpoint: api.query,
+			query:    url.Values{"query": []string{`test_metric{instance="a"}[1h]`}},
+			errType:  errorExec,
+			errMsg:   "more than the maximum of 100 points per series allowed",
+		},
+		{
+			name:     "range query within limits",
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query": []string{`test_metric`},
+				"start": []string{"0"},
+				"end":   []string{"3600"},
+				"step":  []string{"60"},
+			},
+		},
+		{
+			name:     "dense range query over series limit",
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query": []string{`test_metric{instance="a"}`},
+				"start": []string{"0"},
+				"end":   []string{"3600"},
+				"step":  []string{"15"},
+			},
+			errType: errorBadData,
+			errMsg:  "query would return 241 points per series, more than the maximum of 100 allowed",
+		},
+		{
+			name:     "range query over total limit",
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query": []string{`test_metric`},
+				"start": []string{"0"},
+				"end":   []string{"3600"},
+				"step":  []string{"45"},
+			},
+			errType: errorExec,
+			errMsg:  "query result has 162 points, more than the maximum of 150 allowed",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://example.com?"+tc.query.Encode(), nil)
+			testutil.Ok(t, err)
+
+			_, _, apiErr := tc.endpoint(req)
+			if tc.errMsg == "" {
+				testutil.Assert(t, apiErr == nil, "unexpected error: %v", apiErr)
+				return
+			}
+			testutil.Assert(t, apiErr != nil, "expected error")
+			testutil.Equals(t, tc.errType, apiErr.Typ)
+			testutil.Assert(t, strings.Contains(apiErr.Err.Error(), tc.errMsg), "unexpected error: %v", apiErr.Err)
+		})
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	var deadline time.Time
+	api := &API{
+		queryableCreate: func(bool, []string, int64, bool, bool, bool) storage.Queryable {
+			return storage.QueryableFunc(func(ctx context.Context, _, _ int64) (storage.Querier, error) {
+				deadline, _ = ctx.Deadline()
+				return storage.NoopQuerier(), nil
+			})
+		},
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       time.Hour,
+		}),
+		defaultTimeout: time.Minute,
+		maxTimeout:     10 * time.Minute,
+		now:            func() time.Time { return time.Unix(0, 0) },
+	}
+
+	for _, tc := range []struct {
+		name     string
+		param    string
+		header   string
+		timeout  time.Duration
+		warnings int
+	}{
+		{name: "default without requested timeout", timeout: time.Minute},
+		{name: "shorter timeout param", param: "30s", timeout: 30 * time.Second},
+		{name: "longer timeout param", param: "5m", timeout: 5 * time.Minute},
+		{name: "timeout header", header: "5m", timeout: 5 * time.Minute},
+		{name: "timeout param takes precedence over header", param: "30s", header: "5m", timeout: 30 * time.Second},
+		{name: "timeout over the maximum", param: "2h", timeout: 10 * time.Minute, warnings: 1},
+		{name: "timeout header over the maximum", header: "2h", timeout: 10 * time.Minute, warnings: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, endpoint := range []ApiFunc{api.query, api.queryRange} {
+				values := url.Values{
+					"query": []string{"test_metric"},
+					"start": []string{"0"},
+					"end":   []string{"60"},
+					"step":  []string{"15"},
+				}
+				if tc.param != "" {
+					values.Set("timeout", tc.param)
+				}
+				req, err := http.NewRequest(http.MethodGet, "http://example.com?"+values.Encode(), nil)
+				testutil.Ok(t, err)
+				if tc.header != "" {
+					req.Header.Set(TimeoutHeader, tc.header)
+				}
+
+				deadline = time.Time{}
+				start := time.Now()
+				_, warnings, apiErr := endpoint(req)
+				testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+				testutil.Equals(t, tc.warnings, len(warnings))
+
+				testutil.Assert(t, !deadline.IsZero(), "expected query deadline")
+				timeout := deadline.Sub(start)
+				testutil.Assert(t, timeout >= tc.timeout && timeout < tc.timeout+5*time.Second, "expected timeout of %v, got %v", tc.timeout, timeout)
+			}
+		})
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com?"+url.Values{"query": []string{"test_metric"}, "timeout": []string{"foo"}}.Encode(), nil)
+	testutil.Ok(t, err)
+	_, _, apiErr := api.query(req)
+	testutil.Assert(t, apiErr != nil, "expected error for invalid timeout")
+	testutil.Equals(t, errorBadData, apiErr.Typ)
+}
+
 func TestRespondSuccess(t *testing.T) {
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		Respond(w, "test", nil)
@@ -1152,3 +2080,209 @@ func TestParseDownsamplingParamMillis(t *testing.T) {
 
 	}
 }
+
+func TestStoreSessionHeader(t *testing.T) {
+	var session string
+	api := &API{
+		queryableCreate: func(bool, []string, int64, bool, bool, bool) storage.Queryable {
+			return storage.QueryableFunc(func(ctx context.Context, _, _ int64) (storage.Querier, error) {
+				session = store.StoreSessionFromContext(ctx)
+				return storage.NoopQuerier(), nil
+			})
+		},
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       time.Minute,
+		}),
+		storeSessionHeader: "X-Session",
+		now:                func() time.Time { return time.Unix(0, 0) },
+	}
+	r := route.New()
+	api.Register(r, &opentracing.NoopTracer{}, log.NewNopLogger(), extpromhttp.NewNopInstrumentationMiddleware())
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	for _, token := range []string{"session-1", ""} {
+		session = "unset"
+		req, err := http.NewRequest(http.MethodGet, s.URL+"/query?query=test_metric", nil)
+		testutil.Ok(t, err)
+		if token != "" {
+			req.Header.Set("X-Session", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		testutil.Ok(t, err)
+		testutil.Ok(t, resp.Body.Close())
+		testutil.Equals(t, http.StatusOK, resp.StatusCode)
+		testutil.Equals(t, token, session)
+	}
+}
+
+func TestQueryPartialResponseGaps(t *testing.T) {
+	gap := store.PartialResponseGap{Store: "store-1", LabelSets: []labels.Labels{labels.FromStrings("cluster", "eu-1")}, MinTime: 0, MaxTime: 30000, Warning: "fetch series for store-1: connection refused"}
+	var fail bool
+	api := &API{
+		queryableCreate: func(bool, []string, int64, bool, bool, bool) storage.Queryable {
+			return storage.QueryableFunc(func(ctx context.Context, _, _ int64) (storage.Querier, error) {
+				if fail {
+					store.PartialResponseGapsFromContext(ctx).Add(gap)
+				}
+				return storage.NoopQuerier(), nil
+			})
+		},
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       time.Minute,
+		}),
+		now: func() time.Time { return time.Unix(0, 0) },
+	}
+
+	values := url.Values{
+		"query": []string{"test_metric"},
+		"start": []string{"0"},
+		"end":   []string{"60"},
+		"step":  []string{"15"},
+	}
+	for _, endpoint := range []ApiFunc{api.query, api.queryRange} {
+		req, err := http.NewRequest(http.MethodGet, "http://example.com?"+values.Encode(), nil)
+		testutil.Ok(t, err)
+
+		fail = false
+		data, _, apiErr := endpoint(req)
+		testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+		testutil.Equals(t, 0, len(data.(*queryData).PartialResponseGaps))
+
+		fail = true
+		data, _, apiErr = endpoint(req)
+		testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+		testutil.Equals(t, []partialResponseGap{{
+			Store:     "store-1",
+			LabelSets: []map[string]string{{"cluster": "eu-1"}},
+			Start:     time.Unix(0, 0).UTC(),
+			End:       time.Unix(30, 0).UTC(),
+			Warning:   "fetch series for store-1: connection refused",
+		}}, data.(*queryData).PartialResponseGaps)
+	}
+}
+
+func TestQueryRangeDownsamplingThresholds(t *testing.T) {
+	var maxSourceResolution int64
+	api := &API{
+		queryableCreate: func(_ bool, _ []string, maxResolutionMillis int64, _, _, _ bool) storage.Queryable {
+			maxSourceResolution = maxResolutionMillis
+			return storage.QueryableFunc(func(context.Context, int64, int64) (storage.Querier, error) {
+				return storage.NoopQuerier(), nil
+			})
+		},
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       time.Minute,
+		}),
+		downsamplingThresholds: DownsamplingThresholds{
+			{Min: time.Hour, Resolution: time.Hour},
+			{Range: true, Min: 7 * 24 * time.Hour, Resolution: 5 * time.Minute},
+		},
+		now: func() time.Time { return time.Unix(0, 0) },
+	}
+
+	for _, tc := range []struct {
+		name     string
+		param    string
+		end      time.Duration
+		step     time.Duration
+		expected time.Duration
+	}{
+		{name: "no threshold reached", param: "auto", end: time.Hour, step: 30 * time.Minute, expected: 0},
+		{name: "step threshold", param: "auto", end: 24 * time.Hour, step: time.Hour, expected: time.Hour},
+		{name: "range threshold", param: "auto", end: 7 * 24 * time.Hour, step: 30 * time.Minute, expected: 5 * time.Minute},
+		{name: "highest threshold", param: "auto", end: 7 * 24 * time.Hour, step: time.Hour, expected: time.Hour},
+		{name: "explicit max source resolution", param: "5m", end: 24 * time.Hour, step: time.Hour, expected: 5 * time.Minute},
+		{name: "auto downsampling disabled", end: 24 * time.Hour, step: time.Hour, expected: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			values := url.Values{
+				"query": []string{"test_metric"},
+				"start": []string{"0"},
+				"end":   []string{strconv.FormatInt(int64(tc.end/time.Second), 10)},
+				"step":  []string{strconv.FormatInt(int64(tc.step/time.Second), 10)},
+			}
+			if tc.param != "" {
+				values.Set("max_source_resolution", tc.param)
+			}
+			req, err := http.NewRequest(http.MethodGet, "http://example.com?"+values.Encode(), nil)
+			testutil.Ok(t, err)
+
+			maxSourceResolution = -1
+			_, _, apiErr := api.queryRange(req)
+			testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+			testutil.Equals(t, int64(tc.expected/time.Millisecond), maxSourceResolution)
+		})
+	}
+}
+
+func TestQueryStores(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	withData, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, withData.Close()) }()
+	testutil.Ok(t, err)
+	app := withData.Appender()
+	for j := int64(0); j < 60; j++ {
+		_, err := app.Add(labels.FromStrings("__name__", "test_metric", "instance", "a"), j*15000, float64(j))
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	empty, err := e2eutil.NewTSDB()
+	defer func() { testutil.Ok(t, empty.Close()) }()
+	testutil.Ok(t, err)
+
+	stores := []store.Client{
+		store.NewLocalClient(store.NewTSDBStore(nil, nil, withData, component.Query, nil), "store-with-data", nil, 0, 900000),
+		store.NewLocalClient(store.NewTSDBStore(nil, nil, empty, component.Query, nil), "store-without-data", nil, 0, 900000),
+		// Not queried, its data is outside of the time range of the query.
+		store.NewLocalClient(store.NewTSDBStore(nil, nil, withData, component.Query, nil), "store-out-of-range", nil, 2000000, 3000000),
+	}
+	proxy := store.NewProxyStore(nil, nil, func() []store.Client { return stores }, component.Query, nil, 0, 0, nil, nil, nil)
+	api := &API{
+		queryableCreate: query.NewQueryableCreator(nil, proxy, nil, 0, 0, nil),
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       100 * time.Second,
+		}),
+		now: func() time.Time { return time.Unix(0, 0) },
+	}
+
+	for _, endpoint := range []ApiFunc{api.query, api.queryRange} {
+		request := func(stores string) *http.Request {
+			req, err := http.NewRequest(http.MethodGet, "http://example.com?"+url.Values{
+				"query":  []string{"test_metric"},
+				"time":   []string{"900"},
+				"start":  []string{"0"},
+				"end":    []string{"900"},
+				"step":   []string{"15"},
+				"stores": []string{stores},
+			}.Encode(), nil)
+			testutil.Ok(t, err)
+			return req
+		}
+
+		data, _, apiErr := endpoint(request(""))
+		testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+		testutil.Equals(t, 0, len(data.(*queryData).Stores))
+
+		data, _, apiErr = endpoint(request("true"))
+		testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+		testutil.Equals(t, []queryStore{
+			{Store: "store-with-data", Contributed: true},
+			{Store: "store-without-data", Contributed: false},
+		}, data.(*queryData).Stores)
+
+		_, _, apiErr = endpoint(request("foo"))
+		testutil.Assert(t, apiErr != nil, "expected error for invalid stores param")
+		testutil.Equals(t, errorBadData, apiErr.Typ)
+	}
+}
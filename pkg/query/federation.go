@@ -0,0 +1,131 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"sort"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"google.golang.org/grpc"
+)
+
+// federatedStoreSpec is the store spec of a downstream querier federated into this one.
+type federatedStoreSpec struct {
+	grpcStoreSpec
+	cluster storepb.Label
+}
+
+// NewGRPCFederatedStoreSpec creates store spec for the StoreAPI of a downstream querier, e.g. the querier of another
+// cluster. The given cluster label is set on all label sets and series of the downstream querier, replacing labels of
+// the same name, so that the results of federated queriers are distinguishable and can be selected by the label.
+func NewGRPCFederatedStoreSpec(addr string, cluster storepb.Label) StoreSpec {
+	return &federatedStoreSpec{grpcStoreSpec: grpcStoreSpec{addr: addr}, cluster: cluster}
+}
+
+func (s *federatedStoreSpec) wrapClient(c storepb.StoreClient) storepb.StoreClient {
+	return &federatedStoreClient{StoreClient: c, cluster: s.cluster}
+}
+
+// storeClientWrapper is implemented by store specs wrapping the client of their StoreAPI.
+type storeClientWrapper interface {
+	wrapClient(c storepb.StoreClient) storepb.StoreClient
+}
+
+// federatedStoreClient is the client of a federated downstream querier setting its cluster label.
+type federatedStoreClient struct {
+	storepb.StoreClient
+	cluster storepb.Label
+}
+
+func (c *federatedStoreClient) Info(ctx context.Context, r *storepb.InfoRequest, opts ...grpc.CallOption) (*storepb.InfoResponse, error) {
+	resp, err := c.StoreClient.Info(ctx, r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.LabelSets) == 0 && len(resp.Labels) > 0 {
+		resp.LabelSets = []storepb.LabelSet{{Labels: resp.Labels}}
+	}
+	if len(resp.LabelSets) == 0 {
+		resp.LabelSets = []storepb.LabelSet{{}}
+	}
+	for i := range resp.LabelSets {
+		resp.LabelSets[i].Labels = withLabel(resp.LabelSets[i].Labels, c.cluster)
+	}
+	resp.Labels = nil
+	return resp, nil
+}
+
+func (c *federatedStoreClient) Series(ctx context.Context, r *storepb.SeriesRequest, opts ...grpc.CallOption) (storepb.Store_SeriesClient, error) {
+	// The downstream querier does not know the cluster label. Requests are only sent to it if the matchers on the
+	// label match its value, so they can be dropped. Requests need at least one matcher, so requests selecting the
+	// whole cluster select all series of the downstream querier instead.
+	req := *r
+	req.Matchers = make([]storepb.LabelMatcher, 0, len(r.Matchers))
+	for _, m := range r.Matchers {
+		if m.Name != c.cluster.Name {
+			req.Matchers = append(req.Matchers, m)
+		}
+	}
+	if len(req.Matchers) == 0 {
+		req.Matchers = append(req.Matchers, storepb.LabelMatcher{Type: storepb.LabelMatcher_RE, Name: labels.MetricName, Value: ".+"})
+	}
+	sc, err := c.StoreClient.Series(ctx, &req, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &federatedSeriesClient{Store_SeriesClient: sc, cluster: c.cluster}, nil
+}
+
+func (c *federatedStoreClient) LabelNames(ctx context.Context, r *storepb.LabelNamesRequest, opts ...grpc.CallOption) (*storepb.LabelNamesResponse, error) {
+	resp, err := c.StoreClient.LabelNames(ctx, r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	i := sort.SearchStrings(resp.Names, c.cluster.Name)
+	if i == len(resp.Names) || resp.Names[i] != c.cluster.Name {
+		resp.Names = append(resp.Names, "")
+		copy(resp.Names[i+1:], resp.Names[i:])
+		resp.Names[i] = c.cluster.Name
+	}
+	return resp, nil
+}
+
+func (c *federatedStoreClient) LabelValues(ctx context.Context, r *storepb.LabelValuesRequest, opts ...grpc.CallOption) (*storepb.LabelValuesResponse, error) {
+	if r.Label == c.cluster.Name {
+		return &storepb.LabelValuesResponse{Values: []string{c.cluster.Value}}, nil
+	}
+	return c.StoreClient.LabelValues(ctx, r, opts...)
+}
+
+type federatedSeriesClient struct {
+	storepb.Store_SeriesClient
+	cluster storepb.Label
+}
+
+func (c *federatedSeriesClient) Recv() (*storepb.SeriesResponse, error) {
+	resp, err := c.Store_SeriesClient.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if s := resp.GetSeries(); s != nil {
+		s.Labels = withLabel(s.Labels, c.cluster)
+	}
+	return resp, nil
+}
+
+// withLabel returns the given sorted labels with the given label set, replacing a label of the same name.
+func withLabel(lset []storepb.Label, l storepb.Label) []storepb.Label {
+	i := sort.Search(len(lset), func(i int) bool { return lset[i].Name >= l.Name })
+	if i < len(lset) && lset[i].Name == l.Name {
+		res := append([]storepb.Label(nil), lset...)
+		res[i] = l
+		return res
+	}
+	res := make([]storepb.Label, 0, len(lset)+1)
+	res = append(res, lset[:i]...)
+	res = append(res, l)
+	return append(res, lset[i:]...)
+}
@@ -0,0 +1,182 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/store"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"google.golang.org/grpc"
+)
+
+// downstreamQuerier is the StoreAPI client of a downstream querier serving fixed responses.
+type downstreamQuerier struct {
+	storepb.StoreClient
+
+	labelSets []storepb.LabelSet
+	resps     []*storepb.SeriesResponse
+	names     []string
+	reqs      []*storepb.SeriesRequest
+}
+
+func (c *downstreamQuerier) Info(context.Context, *storepb.InfoRequest, ...grpc.CallOption) (*storepb.InfoResponse, error) {
+	return &storepb.InfoResponse{LabelSets: c.labelSets, MinTime: math.MinInt64, MaxTime: math.MaxInt64, StoreType: storepb.StoreType_QUERY}, nil
+}
+
+func (c *downstreamQuerier) Series(ctx context.Context, r *storepb.SeriesRequest, _ ...grpc.CallOption) (storepb.Store_SeriesClient, error) {
+	c.reqs = append(c.reqs, r)
+	return &downstreamSeriesClient{ctx: ctx, resps: c.resps}, nil
+}
+
+func (c *downstreamQuerier) LabelNames(context.Context, *storepb.LabelNamesRequest, ...grpc.CallOption) (*storepb.LabelNamesResponse, error) {
+	return &storepb.LabelNamesResponse{Names: append([]string(nil), c.names...)}, nil
+}
+
+type downstreamSeriesClient struct {
+	grpc.ClientStream
+
+	ctx   context.Context
+	resps []*storepb.SeriesResponse
+}
+
+func (c *downstreamSeriesClient) Recv() (*storepb.SeriesResponse, error) {
+	if len(c.resps) == 0 {
+		return nil, io.EOF
+	}
+	resp := c.resps[0]
+	c.resps = c.resps[1:]
+	return resp, nil
+}
+
+func (c *downstreamSeriesClient) Context() context.Context {
+	return c.ctx
+}
+
+// federatedStore is a federated downstream querier as used by the proxy.
+type federatedStore struct {
+	storepb.StoreClient
+	labelSets []storepb.LabelSet
+}
+
+func (s *federatedStore) LabelSets() []storepb.LabelSet { return s.labelSets }
+func (s *federatedStore) TimeRange() (int64, int64)     { return math.MinInt64, math.MaxInt64 }
+func (s *federatedStore) String() string                { return fmt.Sprintf("%v", s.labelSets) }
+func (s *federatedStore) Addr() string                  { return s.String() }
+
+func newFederatedStore(t *testing.T, cluster string, c storepb.StoreClient) *federatedStore {
+	wrapped := NewGRPCFederatedStoreSpec(cluster, storepb.Label{Name: "cluster", Value: cluster}).(storeClientWrapper).wrapClient(c)
+	info, err := wrapped.Info(context.Background(), &storepb.InfoRequest{})
+	testutil.Ok(t, err)
+	return &federatedStore{StoreClient: wrapped, labelSets: info.LabelSets}
+}
+
+func TestFederation(t *testing.T) {
+	eu := &downstreamQuerier{
+		labelSets: []storepb.LabelSet{{Labels: []storepb.Label{{Name: "region", Value: "west"}}}},
+		// A HA pair of Prometheus instances of the cluster.
+		resps: []*storepb.SeriesResponse{
+			storeSeriesResponse(t, labels.FromStrings("__name__", "up", "job", "a", "replica", "0"), []sample{{10000, 1}, {20000, 1}, {30000, 1}}),
+			storeSeriesResponse(t, labels.FromStrings("__name__", "up", "job", "a", "replica", "1"), []sample{{10000, 1}, {20000, 1}, {30000, 1}}),
+		},
+		names: []string{"__name__", "job", "replica"},
+	}
+	us := &downstreamQuerier{
+		resps: []*storepb.SeriesResponse{
+			// The cluster label of the downstream series is replaced.
+			storeSeriesResponse(t, labels.FromStrings("__name__", "up", "cluster", "other", "job", "a", "replica", "0"), []sample{{10000, 0}, {20000, 0}}),
+		},
+		names: []string{"__name__", "cluster", "job"},
+	}
+	stores := []store.Client{newFederatedStore(t, "eu", eu), newFederatedStore(t, "us", us)}
+
+	testutil.Equals(t, []storepb.LabelSet{{Labels: []storepb.Label{{Name: "cluster", Value: "eu"}, {Name: "region", Value: "west"}}}}, stores[0].LabelSets())
+	testutil.Equals(t, []storepb.LabelSet{{Labels: []storepb.Label{{Name: "cluster", Value: "us"}}}}, stores[1].LabelSets())
+
+	proxy := store.NewProxyStore(nil, nil, func() []store.Client { return stores }, component.Query, nil, 0, 0, nil, nil, nil)
+
+	for _, tcase := range []struct {
+		name     string
+		matchers []*labels.Matcher
+		expected []labels.Labels
+		samples  [][]sample
+	}{
+		{
+			name:     "all clusters",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")},
+			expected: []labels.Labels{
+				labels.FromStrings("__name__", "up", "cluster", "eu", "job", "a"),
+				labels.FromStrings("__name__", "up", "cluster", "us", "job", "a"),
+			},
+			samples: [][]sample{{{10000, 1}, {20000, 1}, {30000, 1}}, {{10000, 0}, {20000, 0}}},
+		},
+		{
+			name: "single cluster",
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, "__name__", "up"),
+				labels.MustNewMatcher(labels.MatchEqual, "cluster", "us"),
+			},
+			expected: []labels.Labels{labels.FromStrings("__name__", "up", "cluster", "us", "job", "a")},
+			samples:  [][]sample{{{10000, 0}, {20000, 0}}},
+		},
+		{
+			name:     "whole cluster",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "cluster", "us")},
+			expected: []labels.Labels{labels.FromStrings("__name__", "up", "cluster", "us", "job", "a")},
+			samples:  [][]sample{{{10000, 0}, {20000, 0}}},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			eu.reqs, us.reqs = nil, nil
+
+			q := newQuerier(context.Background(), nil, 1, 100000, []string{"replica"}, proxy, true, 0, false, false, false, nil, 0, 0, nil)
+			defer func() { testutil.Ok(t, q.Close()) }()
+
+			res, _, err := q.Select(&storage.SelectParams{}, tcase.matchers...)
+			testutil.Ok(t, err)
+
+			var (
+				lsets   []labels.Labels
+				samples [][]sample
+			)
+			for res.Next() {
+				lsets = append(lsets, res.At().Labels())
+				samples = append(samples, expandSeries(t, res.At().Iterator()))
+			}
+			testutil.Ok(t, res.Err())
+			testutil.Equals(t, tcase.expected, lsets)
+			testutil.Equals(t, tcase.samples, samples)
+
+			// Downstream queriers never see matchers on the cluster label, but always some matchers.
+			for _, r := range append(eu.reqs, us.reqs...) {
+				testutil.Assert(t, len(r.Matchers) > 0, "no matchers sent downstream")
+				for _, m := range r.Matchers {
+					testutil.Assert(t, m.Name != "cluster", "unexpected matcher on cluster label sent downstream")
+				}
+			}
+		})
+	}
+
+	t.Run("labels", func(t *testing.T) {
+		names, err := stores[0].LabelNames(context.Background(), &storepb.LabelNamesRequest{})
+		testutil.Ok(t, err)
+		testutil.Equals(t, []string{"__name__", "cluster", "job", "replica"}, names.Names)
+
+		names, err = stores[1].LabelNames(context.Background(), &storepb.LabelNamesRequest{})
+		testutil.Ok(t, err)
+		testutil.Equals(t, []string{"__name__", "cluster", "job"}, names.Names)
+
+		values, err := stores[0].LabelValues(context.Background(), &storepb.LabelValuesRequest{Label: "cluster"})
+		testutil.Ok(t, err)
+		testutil.Equals(t, []string{"eu"}, values.Values)
+	})
+}
@@ -332,6 +332,8 @@ func (it *chunkSeriesIterator) Err() error {
 type dedupSeriesSet struct {
 	set           storage.SeriesSet
 	replicaLabels map[string]struct{}
+	// precedence maps replica label values to their rank, lower ranks taking precedence.
+	precedence map[string]int
 
 	replicas []storage.Series
 	lset     labels.Labels
@@ -339,8 +341,19 @@ type dedupSeriesSet struct {
 	ok       bool
 }
 
-func newDedupSeriesSet(set storage.SeriesSet, replicaLabels map[string]struct{}) storage.SeriesSet {
+// newDedupSeriesSet returns a series set deduplicating the series of the given set along the replica labels.
+// If replicaPrecedence is not empty, the samples of the replica whose replica label value comes first in it are
+// used, and the samples of the following replicas only fill its gaps. Replicas not listed come last.
+func newDedupSeriesSet(set storage.SeriesSet, replicaLabels map[string]struct{}, replicaPrecedence []string) storage.SeriesSet {
 	s := &dedupSeriesSet{set: set, replicaLabels: replicaLabels}
+	if len(replicaPrecedence) > 0 {
+		s.precedence = make(map[string]int, len(replicaPrecedence))
+		for i, v := range replicaPrecedence {
+			if _, ok := s.precedence[v]; !ok {
+				s.precedence[v] = i
+			}
+		}
+	}
 	s.ok = s.set.Next()
 	if s.ok {
 		s.peek = s.set.At()
@@ -404,7 +417,41 @@ func (s *dedupSeriesSet) At() storage.Series {
 	// before advancing.
 	repl := make([]storage.Series, len(s.replicas))
 	copy(repl, s.replicas)
-	return newDedupSeries(s.lset, repl...)
+	if s.precedence == nil {
+		return newDedupSeries(s.lset, repl...)
+	}
+
+	ranks := make([]int, len(repl))
+	for i, r := range repl {
+		ranks[i] = s.rank(r.Labels())
+	}
+	sort.Stable(replicasByRank{replicas: repl, ranks: ranks})
+	return &dedupSeries{lset: s.lset, replicas: repl, ranks: ranks}
+}
+
+// rank returns the rank of the replica with the given labels, i.e. the lowest rank of its replica label values.
+// Replicas without any value listed in the precedence come last.
+func (s *dedupSeriesSet) rank(lset labels.Labels) int {
+	rank := len(s.precedence)
+	// The replica labels are at the end of the label set, after the labels of the deduplicated series.
+	for _, l := range lset[len(s.lset):] {
+		if r, ok := s.precedence[l.Value]; ok && r < rank {
+			rank = r
+		}
+	}
+	return rank
+}
+
+type replicasByRank struct {
+	replicas []storage.Series
+	ranks    []int
+}
+
+func (r replicasByRank) Len() int           { return len(r.replicas) }
+func (r replicasByRank) Less(i, j int) bool { return r.ranks[i] < r.ranks[j] }
+func (r replicasByRank) Swap(i, j int) {
+	r.replicas[i], r.replicas[j] = r.replicas[j], r.replicas[i]
+	r.ranks[i], r.ranks[j] = r.ranks[j], r.ranks[i]
 }
 
 func (s *dedupSeriesSet) Err() error {
@@ -421,6 +468,9 @@ func (s seriesWithLabels) Labels() labels.Labels { return s.lset }
 type dedupSeries struct {
 	lset     labels.Labels
 	replicas []storage.Series
+	// ranks holds the precedence rank of every replica if a replica precedence is configured, in which case the
+	// replicas are sorted by rank.
+	ranks []int
 }
 
 func newDedupSeries(lset labels.Labels, replicas ...storage.Series) *dedupSeries {
@@ -433,12 +483,22 @@ func (s *dedupSeries) Labels() labels.Labels {
 
 func (s *dedupSeries) Iterator() (it storage.SeriesIterator) {
 	it = s.replicas[0].Iterator()
-	for _, o := range s.replicas[1:] {
+	for i, o := range s.replicas[1:] {
+		if s.ranks != nil && s.ranks[0] < s.ranks[i+1] {
+			// The replicas merged so far include one taking precedence over this one.
+			it = newPreferringDedupSeriesIterator(it, o.Iterator())
+			continue
+		}
 		it = newDedupSeriesIterator(it, o.Iterator())
 	}
 	return it
 }
 
+// initialPenalty is the penalty applied to the series not picked if the delta between samples is not known yet.
+// It is based on the knowledge that timestamps are in milliseconds and sampling frequencies typically multiple
+// seconds long.
+const initialPenalty = 5000
+
 type dedupSeriesIterator struct {
 	a, b storage.SeriesIterator
 
@@ -446,6 +506,11 @@ type dedupSeriesIterator struct {
 	lastT      int64
 	penA, penB int64
 	useA       bool
+
+	// preferA is true if the samples of a are used whenever a has no gap, b only filling the gaps of a.
+	preferA bool
+	// deltaA is the delta between the last two samples used from a, or 0 if not known yet.
+	deltaA int64
 }
 
 func newDedupSeriesIterator(a, b storage.SeriesIterator) *dedupSeriesIterator {
@@ -458,6 +523,14 @@ func newDedupSeriesIterator(a, b storage.SeriesIterator) *dedupSeriesIterator {
 	}
 }
 
+// newPreferringDedupSeriesIterator returns a dedupSeriesIterator that uses the samples of a, and the samples of b only
+// while a has a gap.
+func newPreferringDedupSeriesIterator(a, b storage.SeriesIterator) *dedupSeriesIterator {
+	it := newDedupSeriesIterator(a, b)
+	it.preferA = true
+	return it
+}
+
 func (it *dedupSeriesIterator) Next() bool {
 	// Advance both iterators to at least the next highest timestamp plus the potential penalty.
 	if it.aok {
@@ -482,43 +555,62 @@ func (it *dedupSeriesIterator) Next() bool {
 		return true
 	}
 	// General case where both iterators still have data. We pick the one
-	// with the smaller timestamp.
+	// with the smaller timestamp, or a unless it has a gap if a is preferred.
 	// The applied penalty potentially already skipped potential samples already
 	// that would have resulted in exaggerated sampling frequency.
 	ta, _ := it.a.At()
 	tb, _ := it.b.At()
 
-	it.useA = ta <= tb
+	usedA := it.useA
+	if it.preferA {
+		it.useA = it.aHasNoGap(ta, tb)
+	} else {
+		it.useA = ta <= tb
+	}
 
 	// For the series we didn't pick, add a penalty twice as high as the delta of the last two
 	// samples to the next seek against it.
 	// This ensures that we don't pick a sample too close, which would increase the overall
 	// sample frequency. It also guards against clock drift and inaccuracies during
 	// timestamp assignment.
-	// If we don't know a delta yet, we pick 5000 as a constant, which is based on the knowledge
-	// that timestamps are in milliseconds and sampling frequencies typically multiple seconds long.
-	const initialPenality = 5000
-
+	// If we don't know a delta yet, we pick the initial penalty.
+	// If a is preferred, it is never penalized so that it is used again as soon as its gap ends.
 	if it.useA {
 		if it.lastT != math.MinInt64 {
+			if usedA {
+				it.deltaA = ta - it.lastT
+			}
 			it.penB = 2 * (ta - it.lastT)
 		} else {
-			it.penB = initialPenality
+			it.penB = initialPenalty
 		}
 		it.penA = 0
 		it.lastT = ta
 		return true
 	}
-	if it.lastT != math.MinInt64 {
+	switch {
+	case it.preferA:
+		it.penA = 0
+	case it.lastT != math.MinInt64:
 		it.penA = 2 * (tb - it.lastT)
-	} else {
-		it.penA = initialPenality
+	default:
+		it.penA = initialPenalty
 	}
 	it.penB = 0
 	it.lastT = tb
 	return true
 }
 
+// aHasNoGap reports whether the next sample of the preferred series a is used rather than the one of b. This is the
+// case unless b has an earlier sample while a has a gap, i.e. its next sample is more than twice its delta after the
+// last sample used. Samples of a at most the initial penalty after the sample of b are always used.
+func (it *dedupSeriesIterator) aHasNoGap(ta, tb int64) bool {
+	if ta <= tb+initialPenalty {
+		return true
+	}
+	return it.lastT != math.MinInt64 && it.deltaA > 0 && ta-it.lastT <= 2*it.deltaA
+}
+
 func (it *dedupSeriesIterator) Seek(t int64) bool {
 	for {
 		ts, _ := it.At()
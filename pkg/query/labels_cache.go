@@ -0,0 +1,136 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// LabelsCache is a short lived, in-memory cache of label names and values responses shared across the requests of
+// a single querier process. Each querier replica has its own cache. It is meant to reduce the fan-out to all StoreAPIs for repeated, identical label requests, like
+// the ones issued by autocompletion in dashboards.
+type LabelsCache struct {
+	ttl         time.Duration
+	granularity int64
+	now         func() time.Time
+
+	mtx       sync.Mutex
+	entries   map[string]labelsCacheEntry
+	lastSweep time.Time
+
+	hits   *prometheus.CounterVec
+	misses *prometheus.CounterVec
+}
+
+type labelsCacheEntry struct {
+	values  []string
+	expires time.Time
+}
+
+// NewLabelsCache returns a new LabelsCache which keeps responses for the given TTL. The time range
+// of requests is aligned to the given granularity, so that requests of slightly different time ranges
+// share the same cache entry.
+func NewLabelsCache(reg prometheus.Registerer, ttl, granularity time.Duration) *LabelsCache {
+	if granularity <= 0 {
+		granularity = time.Millisecond
+	}
+	c := &LabelsCache{
+		ttl:         ttl,
+		granularity: int64(granularity / time.Millisecond),
+		now:         time.Now,
+		entries:     map[string]labelsCacheEntry{},
+	}
+	c.hits = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_query_labels_cache_hits_total",
+		Help: "Total number of label names and values requests served from the labels cache.",
+	}, []string{"operation"})
+	c.misses = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_query_labels_cache_misses_total",
+		Help: "Total number of label names and values requests not found in the labels cache.",
+	}, []string{"operation"})
+	return c
+}
+
+const (
+	labelsCacheOpLabelNames  = "label_names"
+	labelsCacheOpLabelValues = "label_values"
+)
+
+// key returns the cache key of a request of the given operation and label name within the given time range. The
+// scope distinguishes requests restricted to different series and is empty for unrestricted requests.
+func (c *LabelsCache) key(op, name, scope string, partialResponse bool, mint, maxt int64) string {
+	return fmt.Sprintf("%s:%s:%t:%d:%d:%s", op, name, partialResponse, mint/c.granularity, maxt/c.granularity, scope)
+}
+
+// Labels returns the label names, or the values of the given label name if it is not empty, of a request
+// restricted to the series of the given scope, e.g. a tenant. On a miss they are fetched and cached, unless
+// the response has warnings. A nil cache always fetches.
+func (c *LabelsCache) Labels(
+	scope, name string,
+	partialResponse bool,
+	mint, maxt int64,
+	fetch func() ([]string, storage.Warnings, error),
+) ([]string, storage.Warnings, error) {
+	if c == nil {
+		return fetch()
+	}
+	op := labelsCacheOpLabelNames
+	if name != "" {
+		op = labelsCacheOpLabelValues
+	}
+	key := c.key(op, name, scope, partialResponse, mint, maxt)
+	if values, ok := c.get(op, key); ok {
+		return values, nil, nil
+	}
+
+	values, warns, err := fetch()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(warns) == 0 {
+		c.set(key, values)
+	}
+	return values, warns, nil
+}
+
+func (c *LabelsCache) get(op, key string) ([]string, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, ok := c.entries[key]
+	if ok && c.now().After(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		c.misses.WithLabelValues(op).Inc()
+		return nil, false
+	}
+	c.hits.WithLabelValues(op).Inc()
+	return e.values, true
+}
+
+func (c *LabelsCache) set(key string, values []string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	now := c.now()
+	// Sweep expired entries at most once per TTL so the cache does not grow unbounded with
+	// entries that are never requested again.
+	if now.Sub(c.lastSweep) > c.ttl {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.entries[key] = labelsCacheEntry{values: values, expires: now.Add(c.ttl)}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+type labelsStoreServer struct {
+	// This field just exist to pseudo-implement the unused methods of the interface.
+	storepb.StoreServer
+
+	warnings []string
+
+	labelNamesCalls  int
+	labelValuesCalls map[string]int
+}
+
+func (s *labelsStoreServer) LabelNames(context.Context, *storepb.LabelNamesRequest) (*storepb.LabelNamesResponse, error) {
+	s.labelNamesCalls++
+	return &storepb.LabelNamesResponse{Names: []string{"a", "b"}, Warnings: s.warnings}, nil
+}
+
+func (s *labelsStoreServer) LabelValues(_ context.Context, r *storepb.LabelValuesRequest) (*storepb.LabelValuesResponse, error) {
+	s.labelValuesCalls[r.Label]++
+	return &storepb.LabelValuesResponse{Values: []string{r.Label + "-1", r.Label + "-2"}, Warnings: s.warnings}, nil
+}
+
+func TestLabelsCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cache := NewLabelsCache(prometheus.NewRegistry(), time.Minute, 5*time.Minute)
+	cache.now = func() time.Time { return now }
+
+	s := &labelsStoreServer{labelValuesCalls: map[string]int{}}
+	queryable := NewQueryableCreator(nil, s, cache, 0, 0, nil)(false, nil, 0, true, false, false)
+
+	labelValues := func(name string, mint, maxt int64) []string {
+		q, err := queryable.Querier(context.Background(), mint, maxt)
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		values, _, err := q.LabelValues(name)
+		testutil.Ok(t, err)
+		return values
+	}
+	labelNames := func(mint, maxt int64) []string {
+		q, err := queryable.Querier(context.Background(), mint, maxt)
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		names, _, err := q.LabelNames()
+		testutil.Ok(t, err)
+		return names
+	}
+	hits := func(op string) float64 { return promtestutil.ToFloat64(cache.hits.WithLabelValues(op)) }
+	misses := func(op string) float64 { return promtestutil.ToFloat64(cache.misses.WithLabelValues(op)) }
+
+	t.Run("identical requests hit the cache", func(t *testing.T) {
+		testutil.Equals(t, []string{"a-1", "a-2"}, labelValues("a", 0, 1000))
+		testutil.Equals(t, []string{"a-1", "a-2"}, labelValues("a", 0, 1000))
+		testutil.Equals(t, 1, s.labelValuesCalls["a"])
+		testutil.Equals(t, 1.0, hits(labelsCacheOpLabelValues))
+		testutil.Equals(t, 1.0, misses(labelsCacheOpLabelValues))
+
+		testutil.Equals(t, []string{"a", "b"}, labelNames(0, 1000))
+		testutil.Equals(t, []string{"a", "b"}, labelNames(0, 1000))
+		testutil.Equals(t, 1, s.labelNamesCalls)
+		testutil.Equals(t, 1.0, hits(labelsCacheOpLabelNames))
+		testutil.Equals(t, 1.0, misses(labelsCacheOpLabelNames))
+	})
+	t.Run("requests within the same time bucket hit the cache", func(t *testing.T) {
+		testutil.Equals(t, []string{"a-1", "a-2"}, labelValues("a", 10, 2000))
+		testutil.Equals(t, 1, s.labelValuesCalls["a"])
+		testutil.Equals(t, 2.0, hits(labelsCacheOpLabelValues))
+	})
+	t.Run("changed label name misses the cache", func(t *testing.T) {
+		testutil.Equals(t, []string{"b-1", "b-2"}, labelValues("b", 0, 1000))
+		testutil.Equals(t, 1, s.labelValuesCalls["a"])
+		testutil.Equals(t, 1, s.labelValuesCalls["b"])
+		testutil.Equals(t, 2.0, misses(labelsCacheOpLabelValues))
+	})
+	t.Run("changed time bucket misses the cache", func(t *testing.T) {
+		testutil.Equals(t, []string{"a-1", "a-2"}, labelValues("a", 0, int64(time.Hour/time.Millisecond)))
+		testutil.Equals(t, 2, s.labelValuesCalls["a"])
+		testutil.Equals(t, 3.0, misses(labelsCacheOpLabelValues))
+	})
+	t.Run("expired entries miss the cache", func(t *testing.T) {
+		now = now.Add(2 * time.Minute)
+		testutil.Equals(t, []string{"a-1", "a-2"}, labelValues("a", 0, 1000))
+		testutil.Equals(t, 3, s.labelValuesCalls["a"])
+		testutil.Equals(t, 4.0, misses(labelsCacheOpLabelValues))
+	})
+	t.Run("partial responses are not cached", func(t *testing.T) {
+		s.warnings = []string{"store unavailable"}
+		labelValues("c", 0, 1000)
+		labelValues("c", 0, 1000)
+		testutil.Equals(t, 2, s.labelValuesCalls["c"])
+	})
+}
@@ -0,0 +1,97 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MetadataFetcher fetches metric metadata from all stores serving the metadata API, e.g. receivers, and merges it.
+type MetadataFetcher struct {
+	logger  log.Logger
+	clients func() []storepb.MetadataClient
+}
+
+// NewMetadataFetcher returns a MetadataFetcher fetching metric metadata from the given clients.
+func NewMetadataFetcher(logger log.Logger, clients func() []storepb.MetadataClient) *MetadataFetcher {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &MetadataFetcher{logger: logger, clients: clients}
+}
+
+// Metadata returns the distinct metadata of all stores by metric family name. If tenant is not empty, only the
+// metadata written by that tenant is returned. If metric is not empty, only the metadata of that metric family
+// is returned. If limit is positive, the metadata of at most that many metric families is returned.
+// Failures of single stores are returned as warnings, stores not serving the metadata API are skipped.
+func (f *MetadataFetcher) Metadata(ctx context.Context, tenant, metric string, limit int) (map[string][]prompb.MetricMetadata, storage.Warnings, error) {
+	var (
+		mtx   sync.Mutex
+		wg    sync.WaitGroup
+		warns storage.Warnings
+		set   = map[prompb.MetricMetadata]struct{}{}
+	)
+	for _, c := range f.clients() {
+		wg.Add(1)
+		go func(c storepb.MetadataClient) {
+			defer wg.Done()
+
+			resp, err := c.Metadata(ctx, &storepb.MetadataRequest{Tenant: tenant, Metric: metric, Limit: int64(limit)})
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			if err != nil {
+				if status.Code(err) != codes.Unimplemented {
+					warns = append(warns, errors.Wrap(err, "fetch metadata"))
+				}
+				return
+			}
+			for _, md := range resp.Metadata {
+				set[md] = struct{}{}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	families := map[string][]prompb.MetricMetadata{}
+	for md := range set {
+		families[md.MetricFamilyName] = append(families[md.MetricFamilyName], md)
+	}
+	for _, mds := range families {
+		sort.Slice(mds, func(i, j int) bool {
+			if mds[i].Type != mds[j].Type {
+				return mds[i].Type < mds[j].Type
+			}
+			if mds[i].Help != mds[j].Help {
+				return mds[i].Help < mds[j].Help
+			}
+			return mds[i].Unit < mds[j].Unit
+		})
+	}
+	if limit > 0 && len(families) > limit {
+		names := make([]string, 0, len(families))
+		for name := range families {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names[limit:] {
+			delete(families, name)
+		}
+	}
+	return families, warns, nil
+}
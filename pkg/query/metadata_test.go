@@ -0,0 +1,108 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type metadataClient struct {
+	tenant   string
+	metadata []prompb.MetricMetadata
+	err      error
+}
+
+func (c *metadataClient) Metadata(_ context.Context, r *storepb.MetadataRequest, _ ...grpc.CallOption) (*storepb.MetadataResponse, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	var mds []prompb.MetricMetadata
+	if r.Tenant != "" && r.Tenant != c.tenant {
+		return &storepb.MetadataResponse{}, nil
+	}
+	for _, md := range c.metadata {
+		if r.Metric == "" || md.MetricFamilyName == r.Metric {
+			mds = append(mds, md)
+		}
+	}
+	return &storepb.MetadataResponse{Metadata: mds}, nil
+}
+
+func TestMetadataFetcher(t *testing.T) {
+	var (
+		up      = prompb.MetricMetadata{MetricFamilyName: "up", Type: prompb.MetricMetadata_GAUGE, Help: "Up."}
+		upOther = prompb.MetricMetadata{MetricFamilyName: "up", Type: prompb.MetricMetadata_GAUGE, Help: "Target up."}
+		reqs    = prompb.MetricMetadata{MetricFamilyName: "http_requests_total", Type: prompb.MetricMetadata_COUNTER, Help: "Requests."}
+		mem     = prompb.MetricMetadata{MetricFamilyName: "process_resident_memory_bytes", Type: prompb.MetricMetadata_GAUGE, Help: "Memory.", Unit: "bytes"}
+	)
+	clients := []storepb.MetadataClient{
+		&metadataClient{tenant: "team-a", metadata: []prompb.MetricMetadata{up, reqs}},
+		&metadataClient{tenant: "team-b", metadata: []prompb.MetricMetadata{upOther, up, mem}},
+		// Stores not serving the metadata API are skipped.
+		&metadataClient{err: status.Error(codes.Unimplemented, "unknown service thanos.Metadata")},
+	}
+	f := NewMetadataFetcher(nil, func() []storepb.MetadataClient { return clients })
+
+	for _, tcase := range []struct {
+		name   string
+		tenant string
+		metric string
+		limit  int
+		exp    map[string][]prompb.MetricMetadata
+	}{
+		{
+			name: "all",
+			exp: map[string][]prompb.MetricMetadata{
+				"up":                            {upOther, up},
+				"http_requests_total":           {reqs},
+				"process_resident_memory_bytes": {mem},
+			},
+		},
+		{
+			name:   "metric",
+			metric: "up",
+			exp:    map[string][]prompb.MetricMetadata{"up": {upOther, up}},
+		},
+		{
+			name:   "tenant",
+			tenant: "team-a",
+			exp: map[string][]prompb.MetricMetadata{
+				"up":                  {up},
+				"http_requests_total": {reqs},
+			},
+		},
+		{
+			name:  "limit",
+			limit: 2,
+			exp: map[string][]prompb.MetricMetadata{
+				"http_requests_total":           {reqs},
+				"process_resident_memory_bytes": {mem},
+			},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			res, warns, err := f.Metadata(context.Background(), tcase.tenant, tcase.metric, tcase.limit)
+			testutil.Ok(t, err)
+			testutil.Equals(t, 0, len(warns))
+			testutil.Equals(t, tcase.exp, res)
+		})
+	}
+
+	t.Run("failing store", func(t *testing.T) {
+		clients = append(clients, &metadataClient{err: errors.New("connection refused")})
+		res, warns, err := f.Metadata(context.Background(), "", "http_requests_total", 0)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(warns))
+		testutil.Equals(t, map[string][]prompb.MetricMetadata{"http_requests_total": {reqs}}, res)
+	})
+}
@@ -7,14 +7,18 @@ import (
 	"context"
 	"sort"
 	"strings"
+	"sync/atomic"
 
 	"github.com/go-kit/kit/log"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/storage"
+	"github.com/thanos-io/thanos/pkg/store"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/tracing"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // QueryableCreator returns implementation of promql.Queryable that fetches data from the proxy store API endpoints.
@@ -23,11 +27,18 @@ import (
 // replicaLabels at query time.
 // maxResolutionMillis controls downsampling resolution that is allowed (specified in milliseconds).
 // partialResponse controls `partialResponseDisabled` option of StoreAPI and partial response behaviour of proxy.
-type QueryableCreator func(deduplicate bool, replicaLabels []string, maxResolutionMillis int64, partialResponse, skipChunks bool) storage.Queryable
+type QueryableCreator func(deduplicate bool, replicaLabels []string, maxResolutionMillis int64, partialResponse, skipChunks, freshStoresOnly bool) storage.Queryable
 
 // NewQueryableCreator creates QueryableCreator.
-func NewQueryableCreator(logger log.Logger, proxy storepb.StoreServer) QueryableCreator {
-	return func(deduplicate bool, replicaLabels []string, maxResolutionMillis int64, partialResponse, skipChunks bool) storage.Queryable {
+// If labelsCache is not nil, label names and values responses are cached in it.
+// If maxSeries is positive, queries selecting more series in total fail before any chunks are fetched. Series of
+// different replicas are counted once if deduplication is enabled. The limit of a query is overridden by the one
+// of its context, if any.
+// If maxBytes is positive, queries fetching more bytes of series and chunks in total fail with ResourceExhausted.
+// If replicaPrecedence is not empty, deduplication uses the samples of the replica whose replica label value comes
+// first in it, the samples of the following replicas only filling its gaps.
+func NewQueryableCreator(logger log.Logger, proxy storepb.StoreServer, labelsCache *LabelsCache, maxSeries int, maxBytes int64, replicaPrecedence []string) QueryableCreator {
+	return func(deduplicate bool, replicaLabels []string, maxResolutionMillis int64, partialResponse, skipChunks, freshStoresOnly bool) storage.Queryable {
 		return &queryable{
 			logger:              logger,
 			replicaLabels:       replicaLabels,
@@ -36,6 +47,11 @@ func NewQueryableCreator(logger log.Logger, proxy storepb.StoreServer) Queryable
 			maxResolutionMillis: maxResolutionMillis,
 			partialResponse:     partialResponse,
 			skipChunks:          skipChunks,
+			freshStoresOnly:     freshStoresOnly,
+			labelsCache:         labelsCache,
+			maxSeries:           maxSeries,
+			maxBytes:            maxBytes,
+			replicaPrecedence:   replicaPrecedence,
 		}
 	}
 }
@@ -48,14 +64,26 @@ type queryable struct {
 	maxResolutionMillis int64
 	partialResponse     bool
 	skipChunks          bool
+	freshStoresOnly     bool
+	labelsCache         *LabelsCache
+	maxSeries           int
+	maxBytes            int64
+	replicaPrecedence   []string
 }
 
 // Querier returns a new storage querier against the underlying proxy store API.
 func (q *queryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
-	return newQuerier(ctx, q.logger, mint, maxt, q.replicaLabels, q.proxy, q.deduplicate, int64(q.maxResolutionMillis), q.partialResponse, q.skipChunks), nil
+	return newQuerier(ctx, q.logger, mint, maxt, q.replicaLabels, q.proxy, q.deduplicate, int64(q.maxResolutionMillis), q.partialResponse, q.skipChunks, q.freshStoresOnly, q.labelsCache, q.maxSeries, q.maxBytes, q.replicaPrecedence), nil
 }
 
 type querier struct {
+	// selectedSeries is the number of series selected so far by all Select calls of the querier.
+	// It is accessed atomically and kept first in the struct to be 64-bit aligned.
+	selectedSeries int64
+	// fetchedBytes is the size of the series and chunks fetched so far by all Select calls of the querier.
+	// It is accessed atomically and kept first in the struct to be 64-bit aligned.
+	fetchedBytes int64
+
 	ctx                 context.Context
 	logger              log.Logger
 	cancel              func()
@@ -66,6 +94,11 @@ type querier struct {
 	maxResolutionMillis int64
 	partialResponse     bool
 	skipChunks          bool
+	freshStoresOnly     bool
+	labelsCache         *LabelsCache
+	maxSeries           int
+	maxBytes            int64
+	replicaPrecedence   []string
 }
 
 // newQuerier creates implementation of storage.Querier that fetches data from the proxy
@@ -80,6 +113,11 @@ func newQuerier(
 	maxResolutionMillis int64,
 	partialResponse bool,
 	skipChunks bool,
+	freshStoresOnly bool,
+	labelsCache *LabelsCache,
+	maxSeries int,
+	maxBytes int64,
+	replicaPrecedence []string,
 ) *querier {
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -102,6 +140,11 @@ func newQuerier(
 		maxResolutionMillis: maxResolutionMillis,
 		partialResponse:     partialResponse,
 		skipChunks:          skipChunks,
+		freshStoresOnly:     freshStoresOnly,
+		labelsCache:         labelsCache,
+		maxSeries:           maxSeries,
+		maxBytes:            maxBytes,
+		replicaPrecedence:   replicaPrecedence,
 	}
 }
 
@@ -116,6 +159,13 @@ type seriesServer struct {
 
 	seriesSet []storepb.Series
 	warnings  []string
+
+	// addBytes accounts the size of each received series, if not nil. Once it fails, the error is kept in limitErr.
+	addBytes func(n int64) error
+	limitErr error
+
+	// stats records each received series, if not nil.
+	stats *store.SeriesStats
 }
 
 func (s *seriesServer) Send(r *storepb.SeriesResponse) error {
@@ -127,6 +177,13 @@ func (s *seriesServer) Send(r *storepb.SeriesResponse) error {
 	if r.GetSeries() == nil {
 		return errors.New("no seriesSet")
 	}
+	if s.addBytes != nil {
+		if err := s.addBytes(int64(r.GetSeries().Size())); err != nil {
+			s.limitErr = err
+			return err
+		}
+	}
+	s.stats.Add(r.GetSeries())
 	s.seriesSet = append(s.seriesSet, *r.GetSeries())
 	return nil
 }
@@ -195,8 +252,7 @@ func (q *querier) Select(params *storage.SelectParams, ms ...*labels.Matcher) (s
 
 	queryAggrs, resAggr := aggrsFromFunc(params.Func)
 
-	resp := &seriesServer{ctx: ctx}
-	if err := q.proxy.Series(&storepb.SeriesRequest{
+	req := &storepb.SeriesRequest{
 		MinTime:                 params.Start,
 		MaxTime:                 params.End,
 		Matchers:                sms,
@@ -204,9 +260,37 @@ func (q *querier) Select(params *storage.SelectParams, ms ...*labels.Matcher) (s
 		Aggregates:              queryAggrs,
 		PartialResponseDisabled: !q.partialResponse,
 		SkipChunks:              q.skipChunks,
-	}, resp); err != nil {
+		FreshStoresOnly:         q.freshStoresOnly,
+	}
+	maxSeries := q.maxSeries
+	if n, ok := maxSeriesFromContext(ctx); ok {
+		maxSeries = n
+	}
+	if maxSeries > 0 && !q.skipChunks {
+		if err := q.checkSeriesLimit(ctx, *req, matchers, maxSeries); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	resp := &seriesServer{ctx: ctx, stats: store.SeriesStatsFromContext(ctx)}
+	if q.maxBytes > 0 {
+		resp.addBytes = func(n int64) error { return q.addFetchedBytes(n, matchers) }
+	}
+	if err := q.proxy.Series(req, resp); err != nil {
+		if resp.limitErr != nil {
+			return nil, nil, resp.limitErr
+		}
 		return nil, nil, errors.Wrap(err, "proxy Series()")
 	}
+	if maxSeries > 0 && q.skipChunks {
+		counter := newSeriesCounter(q.dedupReplicaLabels())
+		for _, s := range resp.seriesSet {
+			counter.add(s.Labels)
+		}
+		if err := q.addSelectedSeries(counter.count, matchers, maxSeries); err != nil {
+			return nil, nil, err
+		}
+	}
 
 	var warns storage.Warnings
 	for _, w := range resp.warnings {
@@ -237,7 +321,129 @@ func (q *querier) Select(params *storage.SelectParams, ms ...*labels.Matcher) (s
 	// The merged series set assembles all potentially-overlapping time ranges
 	// of the same series into a single one. The series are ordered so that equal series
 	// from different replicas are sequential. We can now deduplicate those.
-	return newDedupSeriesSet(set, q.replicaLabels), warns, nil
+	return newDedupSeriesSet(set, q.replicaLabels, q.replicaPrecedence), warns, nil
+}
+
+// checkSeriesLimit estimates the number of series selected by the given request by requesting them without
+// chunks first. It returns an error if the series selected by the querier would exceed the given series limit.
+func (q *querier) checkSeriesLimit(ctx context.Context, req storepb.SeriesRequest, matchers []string, maxSeries int) error {
+	span, ctx := tracing.StartSpan(ctx, "querier_select_series_limit")
+	defer span.Finish()
+
+	req.SkipChunks = true
+	req.Aggregates = nil
+	// The series are only counted, they are not fetched by the query.
+	ctx = store.ContextWithSeriesStats(ctx, nil)
+
+	// Stop streaming series as soon as the limit is exceeded.
+	limit := maxSeries - int(atomic.LoadInt64(&q.selectedSeries))
+	resp := &seriesCountServer{ctx: ctx, limit: limit, counter: newSeriesCounter(q.dedupReplicaLabels())}
+	if err := q.proxy.Series(&req, resp); err != nil && resp.counter.count <= limit {
+		return errors.Wrap(err, "proxy Series() without chunks")
+	}
+	return q.addSelectedSeries(resp.counter.count, matchers, maxSeries)
+}
+
+// addSelectedSeries adds the given number of selected series to the querier total and returns
+// an error if the total exceeds the given series limit.
+func (q *querier) addSelectedSeries(n int, matchers []string, maxSeries int) error {
+	if total := atomic.AddInt64(&q.selectedSeries, int64(n)); total > int64(maxSeries) {
+		return errors.Errorf("query selects more than %d series, the maximum allowed (selector: {%s})", maxSeries, strings.Join(matchers, ","))
+	}
+	return nil
+}
+
+// dedupReplicaLabels returns the replica labels series are deduplicated along, or nil if deduplication is disabled.
+func (q *querier) dedupReplicaLabels() map[string]struct{} {
+	if !q.isDedupEnabled() {
+		return nil
+	}
+	return q.replicaLabels
+}
+
+type maxSeriesContextKey struct{}
+
+// ContextWithMaxSeries returns a new context whose queries select at most the given number of series, overriding
+// the series limit of the querier. 0 disables the limit.
+func ContextWithMaxSeries(ctx context.Context, maxSeries int) context.Context {
+	return context.WithValue(ctx, maxSeriesContextKey{}, maxSeries)
+}
+
+func maxSeriesFromContext(ctx context.Context) (int, bool) {
+	maxSeries, ok := ctx.Value(maxSeriesContextKey{}).(int)
+	return maxSeries, ok
+}
+
+// addFetchedBytes adds the given size of fetched series and chunks to the querier total and returns
+// a ResourceExhausted error if the total exceeds the bytes limit.
+func (q *querier) addFetchedBytes(n int64, matchers []string) error {
+	if total := atomic.AddInt64(&q.fetchedBytes, n); total > q.maxBytes {
+		return status.Errorf(codes.ResourceExhausted, "query fetches more than %d bytes of series and chunks, the maximum allowed (selector: {%s})", q.maxBytes, strings.Join(matchers, ","))
+	}
+	return nil
+}
+
+var errSeriesLimitExceeded = errors.New("series limit exceeded")
+
+// seriesCountServer counts series sent by a Series request without keeping them.
+type seriesCountServer struct {
+	// This field just exist to pseudo-implement the unused methods of the interface.
+	storepb.Store_SeriesServer
+	ctx context.Context
+
+	limit   int
+	counter *seriesCounter
+}
+
+func (s *seriesCountServer) Send(r *storepb.SeriesResponse) error {
+	if r.GetSeries() == nil {
+		return nil
+	}
+	s.counter.add(r.GetSeries().Labels)
+	if s.counter.count > s.limit {
+		return errSeriesLimitExceeded
+	}
+	return nil
+}
+
+func (s *seriesCountServer) Context() context.Context {
+	return s.ctx
+}
+
+// seriesCounter counts distinct series, the series of different replicas being counted once if replica labels
+// are given.
+type seriesCounter struct {
+	replicaLabels map[string]struct{}
+	seen          map[uint64]struct{}
+	count         int
+}
+
+func newSeriesCounter(replicaLabels map[string]struct{}) *seriesCounter {
+	c := &seriesCounter{replicaLabels: replicaLabels}
+	if len(replicaLabels) > 0 {
+		c.seen = map[uint64]struct{}{}
+	}
+	return c
+}
+
+func (c *seriesCounter) add(lset []storepb.Label) {
+	if c.seen == nil {
+		c.count++
+		return
+	}
+	dedupLset := make(labels.Labels, 0, len(lset))
+	for _, l := range lset {
+		if _, ok := c.replicaLabels[l.Name]; ok {
+			continue
+		}
+		dedupLset = append(dedupLset, labels.Label{Name: l.Name, Value: l.Value})
+	}
+	h := dedupLset.Hash()
+	if _, ok := c.seen[h]; ok {
+		return
+	}
+	c.seen[h] = struct{}{}
+	c.count++
 }
 
 // sortDedupLabels re-sorts the set so that the same series with different replica
@@ -267,6 +473,14 @@ func (q *querier) LabelValues(name string) ([]string, storage.Warnings, error) {
 	span, ctx := tracing.StartSpan(q.ctx, "querier_label_values")
 	defer span.Finish()
 
+	var key string
+	if q.labelsCache != nil {
+		key = q.labelsCache.key(labelsCacheOpLabelValues, name, "", q.partialResponse, q.mint, q.maxt)
+		if values, ok := q.labelsCache.get(labelsCacheOpLabelValues, key); ok {
+			return values, nil, nil
+		}
+	}
+
 	resp, err := q.proxy.LabelValues(ctx, &storepb.LabelValuesRequest{Label: name, PartialResponseDisabled: !q.partialResponse})
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "proxy LabelValues()")
@@ -277,6 +491,11 @@ func (q *querier) LabelValues(name string) ([]string, storage.Warnings, error) {
 		warns = append(warns, errors.New(w))
 	}
 
+	// Partial responses are not cached, so that a recovered store is visible in the next request. Unsorted values
+	// are not cached either, as they would be returned to requests expecting sorted values.
+	if q.labelsCache != nil && len(warns) == 0 && !store.UnsortedLabelsFromContext(ctx) {
+		q.labelsCache.set(key, resp.Values)
+	}
 	return resp.Values, warns, nil
 }
 
@@ -285,6 +504,14 @@ func (q *querier) LabelNames() ([]string, storage.Warnings, error) {
 	span, ctx := tracing.StartSpan(q.ctx, "querier_label_names")
 	defer span.Finish()
 
+	var key string
+	if q.labelsCache != nil {
+		key = q.labelsCache.key(labelsCacheOpLabelNames, "", "", q.partialResponse, q.mint, q.maxt)
+		if names, ok := q.labelsCache.get(labelsCacheOpLabelNames, key); ok {
+			return names, nil, nil
+		}
+	}
+
 	resp, err := q.proxy.LabelNames(ctx, &storepb.LabelNamesRequest{PartialResponseDisabled: !q.partialResponse})
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "proxy LabelNames()")
@@ -295,6 +522,9 @@ func (q *querier) LabelNames() ([]string, storage.Warnings, error) {
 		warns = append(warns, errors.New(w))
 	}
 
+	if q.labelsCache != nil && len(warns) == 0 && !store.UnsortedLabelsFromContext(ctx) {
+		q.labelsCache.set(key, resp.Names)
+	}
 	return resp.Names, warns, nil
 }
 
@@ -11,6 +11,7 @@ import (
 	"math/rand"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 
 	"time"
@@ -23,15 +24,17 @@ import (
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestQueryableCreator_MaxResolution(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 	testProxy := &storeServer{resps: []*storepb.SeriesResponse{}}
-	queryableCreator := NewQueryableCreator(nil, testProxy)
+	queryableCreator := NewQueryableCreator(nil, testProxy, nil, 0, 0, nil)
 
 	oneHourMillis := int64(1*time.Hour) / int64(time.Millisecond)
-	queryable := queryableCreator(false, nil, oneHourMillis, false, false)
+	queryable := queryableCreator(false, nil, oneHourMillis, false, false, false)
 
 	q, err := queryable.Querier(context.Background(), 0, 42)
 	testutil.Ok(t, err)
@@ -58,7 +61,7 @@ func TestQuerier_DownsampledData(t *testing.T) {
 		},
 	}
 
-	q := NewQueryableCreator(nil, testProxy)(false, nil, 9999999, false, false)
+	q := NewQueryableCreator(nil, testProxy, nil, 0, 0, nil)(false, nil, 9999999, false, false, false)
 
 	engine := promql.NewEngine(
 		promql.EngineOpts{
@@ -179,7 +182,7 @@ func TestQuerier_Series(t *testing.T) {
 
 	// Querier clamps the range to [1,300], which should drop some samples of the result above.
 	// The store API allows endpoints to send more data then initially requested.
-	q := newQuerier(context.Background(), nil, 1, 300, []string{""}, testProxy, false, 0, true, false)
+	q := newQuerier(context.Background(), nil, 1, 300, []string{""}, testProxy, false, 0, true, false, false, nil, 0, 0, nil)
 	defer func() { testutil.Ok(t, q.Close()) }()
 
 	res, _, err := q.Select(&storage.SelectParams{})
@@ -220,6 +223,180 @@ func TestQuerier_Series(t *testing.T) {
 	testutil.Equals(t, len(expected), i)
 }
 
+func TestQuerier_MaxSeries(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	newProxy := func() *matchingStoreServer {
+		return &matchingStoreServer{
+			series: []labels.Labels{
+				labels.FromStrings("a", "1", "b", "1"),
+				labels.FromStrings("a", "1", "b", "2"),
+				labels.FromStrings("a", "2", "b", "1"),
+			},
+		}
+	}
+	selectSeries := func(q *querier, ms ...*labels.Matcher) (int, error) {
+		res, _, err := q.Select(&storage.SelectParams{}, ms...)
+		if err != nil {
+			return 0, err
+		}
+		n := 0
+		for res.Next() {
+			n++
+		}
+		return n, res.Err()
+	}
+
+	t.Run("broad selector exceeds the limit before chunks are fetched", func(t *testing.T) {
+		proxy := newProxy()
+		q := newQuerier(context.Background(), nil, 0, 100, nil, proxy, false, 0, true, false, false, nil, 2, 0, nil)
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		_, err := selectSeries(q, labels.MustNewMatcher(labels.MatchRegexp, "a", ".+"))
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "more than 2 series"), "unexpected error %s", err)
+		testutil.Equals(t, []bool{true}, proxy.skipChunks)
+	})
+	t.Run("narrow selector within the limit", func(t *testing.T) {
+		proxy := newProxy()
+		q := newQuerier(context.Background(), nil, 0, 100, nil, proxy, false, 0, true, false, false, nil, 2, 0, nil)
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		n, err := selectSeries(q, labels.MustNewMatcher(labels.MatchEqual, "a", "1"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, 2, n)
+		testutil.Equals(t, []bool{true, false}, proxy.skipChunks)
+	})
+	t.Run("limit applies to all selectors of a query", func(t *testing.T) {
+		proxy := newProxy()
+		q := newQuerier(context.Background(), nil, 0, 100, nil, proxy, false, 0, true, false, false, nil, 2, 0, nil)
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		_, err := selectSeries(q, labels.MustNewMatcher(labels.MatchEqual, "a", "1"))
+		testutil.Ok(t, err)
+		_, err = selectSeries(q, labels.MustNewMatcher(labels.MatchEqual, "a", "2"))
+		testutil.NotOk(t, err)
+	})
+	t.Run("series without chunks are counted without an extra request", func(t *testing.T) {
+		proxy := newProxy()
+		q := newQuerier(context.Background(), nil, 0, 100, nil, proxy, false, 0, true, true, false, nil, 2, 0, nil)
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		_, err := selectSeries(q, labels.MustNewMatcher(labels.MatchRegexp, "a", ".+"))
+		testutil.NotOk(t, err)
+		testutil.Equals(t, []bool{true}, proxy.skipChunks)
+	})
+	t.Run("series of different replicas are counted once", func(t *testing.T) {
+		proxy := newProxy()
+		q := newQuerier(context.Background(), nil, 0, 100, []string{"b"}, proxy, true, 0, true, false, false, nil, 2, 0, nil)
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		n, err := selectSeries(q, labels.MustNewMatcher(labels.MatchRegexp, "a", ".+"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, 2, n)
+	})
+	t.Run("series of different replicas without chunks are counted once", func(t *testing.T) {
+		proxy := newProxy()
+		q := newQuerier(context.Background(), nil, 0, 100, []string{"b"}, proxy, true, 0, true, true, false, nil, 2, 0, nil)
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		n, err := selectSeries(q, labels.MustNewMatcher(labels.MatchRegexp, "a", ".+"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, 2, n)
+	})
+	t.Run("limit of the context overrides the limit of the querier", func(t *testing.T) {
+		proxy := newProxy()
+		q := newQuerier(ContextWithMaxSeries(context.Background(), 1), nil, 0, 100, nil, proxy, false, 0, true, false, false, nil, 5, 0, nil)
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		_, err := selectSeries(q, labels.MustNewMatcher(labels.MatchEqual, "a", "1"))
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "more than 1 series"), "unexpected error %s", err)
+	})
+	t.Run("context disables the limit of the querier", func(t *testing.T) {
+		proxy := newProxy()
+		q := newQuerier(ContextWithMaxSeries(context.Background(), 0), nil, 0, 100, nil, proxy, false, 0, true, false, false, nil, 2, 0, nil)
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		n, err := selectSeries(q, labels.MustNewMatcher(labels.MatchRegexp, "a", ".+"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, 3, n)
+		testutil.Equals(t, []bool{false}, proxy.skipChunks)
+	})
+	t.Run("no limit", func(t *testing.T) {
+		proxy := newProxy()
+		q := newQuerier(context.Background(), nil, 0, 100, nil, proxy, false, 0, true, false, false, nil, 0, 0, nil)
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		n, err := selectSeries(q, labels.MustNewMatcher(labels.MatchRegexp, "a", ".+"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, 3, n)
+		testutil.Equals(t, []bool{false}, proxy.skipChunks)
+	})
+}
+
+func TestQuerier_MaxBytes(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	proxy := &matchingStoreServer{
+		series: []labels.Labels{
+			labels.FromStrings("a", "1", "b", "1"),
+			labels.FromStrings("a", "1", "b", "2"),
+			labels.FromStrings("a", "2", "b", "1"),
+		},
+	}
+	// All series have the same size, allow fetching two of them.
+	maxBytes := int64(2 * (&storepb.Series{Labels: storepb.PromLabelsToLabels(proxy.series[0])}).Size())
+
+	selectSeries := func(q *querier, ms ...*labels.Matcher) (int, error) {
+		res, _, err := q.Select(&storage.SelectParams{}, ms...)
+		if err != nil {
+			return 0, err
+		}
+		n := 0
+		for res.Next() {
+			n++
+		}
+		return n, res.Err()
+	}
+
+	t.Run("wide selector exceeds the limit", func(t *testing.T) {
+		q := newQuerier(context.Background(), nil, 0, 100, nil, proxy, false, 0, true, false, false, nil, 0, maxBytes, nil)
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		_, err := selectSeries(q, labels.MustNewMatcher(labels.MatchRegexp, "a", ".+"))
+		testutil.NotOk(t, err)
+		testutil.Equals(t, codes.ResourceExhausted, status.Code(err))
+		testutil.Assert(t, strings.Contains(err.Error(), fmt.Sprintf("more than %d bytes", maxBytes)), "unexpected error %s", err)
+	})
+	t.Run("narrow selector within the limit", func(t *testing.T) {
+		q := newQuerier(context.Background(), nil, 0, 100, nil, proxy, false, 0, true, false, false, nil, 0, maxBytes, nil)
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		n, err := selectSeries(q, labels.MustNewMatcher(labels.MatchEqual, "a", "1"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, 2, n)
+	})
+	t.Run("limit applies to all selectors of a query", func(t *testing.T) {
+		q := newQuerier(context.Background(), nil, 0, 100, nil, proxy, false, 0, true, false, false, nil, 0, maxBytes, nil)
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		_, err := selectSeries(q, labels.MustNewMatcher(labels.MatchEqual, "a", "1"))
+		testutil.Ok(t, err)
+		_, err = selectSeries(q, labels.MustNewMatcher(labels.MatchEqual, "a", "2"))
+		testutil.NotOk(t, err)
+		testutil.Equals(t, codes.ResourceExhausted, status.Code(err))
+	})
+	t.Run("no limit", func(t *testing.T) {
+		q := newQuerier(context.Background(), nil, 0, 100, nil, proxy, false, 0, true, false, false, nil, 0, 0, nil)
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		n, err := selectSeries(q, labels.MustNewMatcher(labels.MatchRegexp, "a", ".+"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, 3, n)
+	})
+}
+
 func TestSortReplicaLabel(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 
@@ -552,7 +729,7 @@ func TestDedupSeriesSet(t *testing.T) {
 				maxt: math.MaxInt64,
 				set:  newStoreSeriesSet(series),
 			}
-			dedupSet := newDedupSeriesSet(set, test.dedupLabels)
+			dedupSet := newDedupSeriesSet(set, test.dedupLabels, nil)
 
 			i := 0
 			for dedupSet.Next() {
@@ -612,6 +789,109 @@ func TestDedupSeriesIterator(t *testing.T) {
 	}
 }
 
+func TestPreferringDedupSeriesIterator(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	cases := []struct {
+		a, b, exp []sample
+	}{
+		{ // Prefer a even if b starts slightly earlier.
+			a:   []sample{{10100, 1}, {20100, 1}, {30100, 1}, {40100, 1}},
+			b:   []sample{{10000, 2}, {20000, 2}, {30000, 2}, {40000, 2}},
+			exp: []sample{{10100, 1}, {20100, 1}, {30100, 1}, {40100, 1}},
+		},
+		{ // Don't fill a single delta sized gap.
+			a:   []sample{{10000, 1}, {20000, 1}, {40000, 1}},
+			b:   []sample{{15000, 2}, {25000, 2}, {35000, 2}, {45000, 2}},
+			exp: []sample{{10000, 1}, {20000, 1}, {40000, 1}},
+		},
+		{ // Fill bigger gaps with b and switch back to a once its gap ends.
+			a:   []sample{{10000, 1}, {20000, 1}, {30000, 1}, {80000, 1}, {90000, 1}},
+			b:   []sample{{10100, 2}, {20100, 2}, {30100, 2}, {40100, 2}, {50100, 2}, {60100, 2}, {70100, 2}, {80100, 2}, {90100, 2}},
+			exp: []sample{{10000, 1}, {20000, 1}, {30000, 1}, {50100, 2}, {60100, 2}, {80000, 1}, {90000, 1}},
+		},
+		{ // Use b while a has not started yet.
+			a:   []sample{{40000, 1}, {50000, 1}, {60000, 1}},
+			b:   []sample{{10000, 2}, {20000, 2}, {30000, 2}, {40000, 2}, {50000, 2}, {60000, 2}},
+			exp: []sample{{10000, 2}, {20000, 2}, {30000, 2}, {40000, 1}, {50000, 1}, {60000, 1}},
+		},
+	}
+	for i, c := range cases {
+		t.Logf("case %d:", i)
+		it := newPreferringDedupSeriesIterator(
+			&SampleIterator{l: c.a, i: -1},
+			&SampleIterator{l: c.b, i: -1},
+		)
+		res := expandSeries(t, it)
+		testutil.Equals(t, c.exp, res)
+	}
+}
+
+func TestDedupSeriesSet_ReplicaPrecedence(t *testing.T) {
+	input := []struct {
+		lset labels.Labels
+		vals []sample
+	}{
+		{
+			lset: labels.Labels{{Name: "a", Value: "1"}, {Name: "replica", Value: "r1"}},
+			vals: []sample{{10000, 1}, {20000, 1}, {30000, 1}, {80000, 1}, {90000, 1}},
+		}, {
+			lset: labels.Labels{{Name: "a", Value: "1"}, {Name: "replica", Value: "r2"}},
+			vals: []sample{{10000, 2}, {20000, 2}, {30000, 2}, {40000, 2}, {50000, 2}, {60000, 2}, {70000, 2}, {80000, 2}, {90000, 2}},
+		}, {
+			lset: labels.Labels{{Name: "a", Value: "1"}, {Name: "replica", Value: "r3"}},
+			vals: []sample{{10000, 3}, {20000, 3}, {30000, 3}, {40000, 3}, {50000, 3}, {60000, 3}, {70000, 3}, {80000, 3}, {90000, 3}},
+		},
+	}
+	for _, tcase := range []struct {
+		precedence []string
+		exp        []sample
+	}{
+		{
+			// Without precedence, the replica starting first is used.
+			exp: []sample{{10000, 1}, {20000, 1}, {30000, 1}, {60000, 2}, {70000, 2}, {80000, 2}, {90000, 2}},
+		},
+		{
+			precedence: []string{"r3"},
+			exp:        []sample{{10000, 3}, {20000, 3}, {30000, 3}, {40000, 3}, {50000, 3}, {60000, 3}, {70000, 3}, {80000, 3}, {90000, 3}},
+		},
+		{
+			// The gap of the first replica is filled by the next replica in the precedence.
+			precedence: []string{"r1", "r3", "r2"},
+			exp:        []sample{{10000, 1}, {20000, 1}, {30000, 1}, {60000, 3}, {80000, 1}, {90000, 1}},
+		},
+	} {
+		t.Run(strings.Join(tcase.precedence, ","), func(t *testing.T) {
+			var series []storepb.Series
+			for _, c := range input {
+				chk := chunkenc.NewXORChunk()
+				app, _ := chk.Appender()
+				for _, s := range c.vals {
+					app.Append(s.t, s.v)
+				}
+				series = append(series, storepb.Series{
+					Labels: storepb.PromLabelsToLabels(c.lset),
+					Chunks: []storepb.AggrChunk{
+						{Raw: &storepb.Chunk{Type: storepb.Chunk_XOR, Data: chk.Bytes()}},
+					},
+				})
+			}
+			set := &promSeriesSet{
+				mint: 1,
+				maxt: math.MaxInt64,
+				set:  newStoreSeriesSet(series),
+			}
+			dedupSet := newDedupSeriesSet(set, map[string]struct{}{"replica": {}}, tcase.precedence)
+
+			testutil.Assert(t, dedupSet.Next(), "expected a series")
+			testutil.Equals(t, labels.Labels{{Name: "a", Value: "1"}}, dedupSet.At().Labels())
+			testutil.Equals(t, tcase.exp, expandSeries(t, dedupSet.At().Iterator()))
+			testutil.Assert(t, !dedupSet.Next(), "expected a single series")
+			testutil.Ok(t, dedupSet.Err())
+		})
+	}
+}
+
 func BenchmarkDedupSeriesIterator(b *testing.B) {
 	run := func(b *testing.B, s1, s2 []sample) {
 		it := newDedupSeriesIterator(
@@ -720,6 +1000,47 @@ func (s *storeServer) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesS
 	return nil
 }
 
+// matchingStoreServer sends the series matching the requested matchers and records
+// whether chunks were requested.
+type matchingStoreServer struct {
+	// This field just exist to pseudo-implement the unused methods of the interface.
+	storepb.StoreServer
+
+	series     []labels.Labels
+	skipChunks []bool
+}
+
+func (s *matchingStoreServer) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	s.skipChunks = append(s.skipChunks, r.SkipChunks)
+
+	var ms []*labels.Matcher
+	for _, m := range r.Matchers {
+		t := labels.MatchEqual
+		switch m.Type {
+		case storepb.LabelMatcher_NEQ:
+			t = labels.MatchNotEqual
+		case storepb.LabelMatcher_RE:
+			t = labels.MatchRegexp
+		case storepb.LabelMatcher_NRE:
+			t = labels.MatchNotRegexp
+		}
+		ms = append(ms, labels.MustNewMatcher(t, m.Name, m.Value))
+	}
+
+Outer:
+	for _, lset := range s.series {
+		for _, m := range ms {
+			if !m.Matches(lset.Get(m.Name)) {
+				continue Outer
+			}
+		}
+		if err := srv.Send(storepb.NewSeriesResponse(&storepb.Series{Labels: storepb.PromLabelsToLabels(lset)})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // storeSeriesResponse creates test storepb.SeriesResponse that includes series with single chunk that stores all the given samples.
 func storeSeriesResponse(t testing.TB, lset labels.Labels, smplChunks ...[]sample) *storepb.SeriesResponse {
 	var s storepb.Series
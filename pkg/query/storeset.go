@@ -91,9 +91,11 @@ type storeSetNodeCollector struct {
 	mtx             sync.Mutex
 	storeNodes      map[component.StoreAPI]map[string]int
 	storePerExtLset map[string]int
+	health          *storeSetHealth
 
 	connectionsDesc *prometheus.Desc
 	nodeInfoDesc    *prometheus.Desc
+	endpointsDesc   *prometheus.Desc
 }
 
 func newStoreSetNodeCollector() *storeSetNodeCollector {
@@ -111,6 +113,11 @@ func newStoreSetNodeCollector() *storeSetNodeCollector {
 			"Deprecated, use thanos_store_nodes_grpc_connections instead.",
 			[]string{"external_labels"}, nil,
 		),
+		endpointsDesc: prometheus.NewDesc(
+			"thanos_store_nodes_endpoints",
+			"Number of discovered store API endpoints and of the healthy ones among them in the last update, by the store type they last advertised.",
+			[]string{"store_type", "state"}, nil,
+		),
 	}
 }
 
@@ -132,9 +139,17 @@ func (c *storeSetNodeCollector) Update(nodes map[component.StoreAPI]map[string]i
 	c.storePerExtLset = storePerExtLset
 }
 
+// UpdateHealth updates the endpoint health exposed by the collector.
+func (c *storeSetNodeCollector) UpdateHealth(health *storeSetHealth) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.health = health
+}
+
 func (c *storeSetNodeCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.connectionsDesc
 	ch <- c.nodeInfoDesc
+	ch <- c.endpointsDesc
 }
 
 func (c *storeSetNodeCollector) Collect(ch chan<- prometheus.Metric) {
@@ -153,6 +168,18 @@ func (c *storeSetNodeCollector) Collect(ch chan<- prometheus.Metric) {
 	for externalLabels, occur := range c.storePerExtLset {
 		ch <- prometheus.MustNewConstMetric(c.nodeInfoDesc, prometheus.GaugeValue, float64(occur), externalLabels)
 	}
+	if c.health == nil {
+		return
+	}
+	// Expose all store types, so that missing stores of a type can be alerted on.
+	for storeType := range newStoreAPIStats() {
+		var storeTypeStr string
+		if storeType != nil {
+			storeTypeStr = storeType.String()
+		}
+		ch <- prometheus.MustNewConstMetric(c.endpointsDesc, prometheus.GaugeValue, float64(c.health.discoveredByType[storeType]), storeTypeStr, "discovered")
+		ch <- prometheus.MustNewConstMetric(c.endpointsDesc, prometheus.GaugeValue, float64(c.health.healthyByType[storeType]), storeTypeStr, "healthy")
+	}
 }
 
 // StoreSet maintains a set of active stores. It is backed up by Store Specifications that are dynamically fetched on
@@ -173,10 +200,18 @@ type StoreSet struct {
 	// Main map of stores currently used for fanout.
 	stores       map[string]*storeRef
 	storesMetric *storeSetNodeCollector
+	// Endpoint health of the last update, nil before the first update.
+	health *storeSetHealth
 
 	// Map of statuses used only by UI.
 	storeStatuses         map[string]*StoreStatus
 	unhealthyStoreTimeout time.Duration
+
+	// Maximum number of stores that are not strict static to connect to, unlimited if 0.
+	maxStores     int
+	droppedStores prometheus.Gauge
+	// Addresses of the stores dropped in the last update because of the limit.
+	lastDropped string
 }
 
 // NewStoreSet returns a new set of stores from cluster peers and statically configured ones.
@@ -186,10 +221,15 @@ func NewStoreSet(
 	storeSpecs func() []StoreSpec,
 	dialOpts []grpc.DialOption,
 	unhealthyStoreTimeout time.Duration,
+	maxStores int,
 ) *StoreSet {
 	storesMetric := newStoreSetNodeCollector()
+	droppedStores := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_store_nodes_limit_dropped",
+		Help: "Number of store nodes not connected to in the last update, because more stores than the store limit were discovered.",
+	})
 	if reg != nil {
-		reg.MustRegister(storesMetric)
+		reg.MustRegister(storesMetric, droppedStores)
 	}
 
 	if logger == nil {
@@ -208,6 +248,8 @@ func NewStoreSet(
 		stores:                make(map[string]*storeRef),
 		storeStatuses:         make(map[string]*StoreStatus),
 		unhealthyStoreTimeout: unhealthyStoreTimeout,
+		maxStores:             maxStores,
+		droppedStores:         droppedStores,
 	}
 	return ss
 }
@@ -342,7 +384,7 @@ func (s *StoreSet) Update(ctx context.Context) {
 
 	level.Debug(s.logger).Log("msg", "starting updating storeAPIs", "cachedStores", len(stores))
 
-	activeStores := s.getActiveStores(ctx, stores)
+	activeStores, health := s.getActiveStores(ctx, stores)
 	level.Debug(s.logger).Log("msg", "checked requested storeAPIs", "activeStores", len(activeStores), "cachedStores", len(stores))
 
 	stats := newStoreAPIStats()
@@ -385,23 +427,46 @@ func (s *StoreSet) Update(ctx context.Context) {
 	}
 
 	s.storesMetric.Update(stats)
+	s.storesMetric.UpdateHealth(health)
 	s.storesMtx.Lock()
 	s.stores = stores
+	s.health = health
 	s.storesMtx.Unlock()
 
 	s.cleanUpStoreStatuses(stores)
 }
 
-func (s *StoreSet) getActiveStores(ctx context.Context, stores map[string]*storeRef) map[string]*storeRef {
+// storeSetHealth is the health of the discovered store endpoints.
+type storeSetHealth struct {
+	// Number of unique store specs.
+	discovered int
+	// Number of stores with successful Info calls.
+	healthy int
+	// Number of discovered and healthy stores by store type. The type of unhealthy stores is the one they advertised
+	// in their last successful Info call, or nil if there was none.
+	discoveredByType map[component.StoreAPI]int
+	healthyByType    map[component.StoreAPI]int
+}
+
+func newStoreSetHealth() *storeSetHealth {
+	return &storeSetHealth{
+		discoveredByType: map[component.StoreAPI]int{},
+		healthyByType:    map[component.StoreAPI]int{},
+	}
+}
+
+// getActiveStores returns the stores to keep for the current store specs, along with the health of their endpoints.
+func (s *StoreSet) getActiveStores(ctx context.Context, stores map[string]*storeRef) (map[string]*storeRef, *storeSetHealth) {
 	var (
 		unique       = make(map[string]struct{})
 		activeStores = make(map[string]*storeRef, len(stores))
+		health       = newStoreSetHealth()
 		mtx          sync.Mutex
 		wg           sync.WaitGroup
 	)
 
 	// Gather active stores map concurrently. Build new store if does not exist already.
-	for _, storeSpec := range s.storeSpecs() {
+	for _, storeSpec := range s.limitStoreSpecs(s.storeSpecs()) {
 		if _, ok := unique[storeSpec.Addr()]; ok {
 			level.Warn(s.logger).Log("msg", "duplicated address in store nodes", "address", storeSpec.Addr())
 			continue
@@ -422,20 +487,33 @@ func (s *StoreSet) getActiveStores(ctx context.Context, stores map[string]*store
 				// New store or was unactive and was removed in the past - create new one.
 				conn, err := grpc.DialContext(ctx, addr, s.dialOpts...)
 				if err != nil {
+					mtx.Lock()
+					health.discoveredByType[s.lastStoreType(addr)]++
+					mtx.Unlock()
+
 					s.updateStoreStatus(&storeRef{addr: addr}, err)
 					level.Warn(s.logger).Log("msg", "update of store node failed", "err", errors.Wrap(err, "dialing connection"), "address", addr)
 					return
 				}
 				st = &storeRef{StoreClient: storepb.NewStoreClient(conn), cc: conn, addr: addr, logger: s.logger}
+				if w, ok := spec.(storeClientWrapper); ok {
+					st.StoreClient = w.wrapClient(st.StoreClient)
+				}
 			}
 
 			// Check existing or new store. Is it healthy? What are current metadata?
 			labelSets, minTime, maxTime, storeType, err := spec.Metadata(ctx, st.StoreClient)
 			if err != nil {
+				lastStoreType := st.StoreType()
 				if !seenAlready {
 					// Close only if new. Unactive `s.stores` will be closed later on.
 					st.Close()
+					lastStoreType = s.lastStoreType(addr)
 				}
+				mtx.Lock()
+				health.discoveredByType[lastStoreType]++
+				mtx.Unlock()
+
 				s.updateStoreStatus(st, err)
 				level.Warn(s.logger).Log("msg", "update of store node failed", "err", errors.Wrap(err, "getting metadata"), "address", addr)
 
@@ -458,11 +536,90 @@ func (s *StoreSet) getActiveStores(ctx context.Context, stores map[string]*store
 			defer mtx.Unlock()
 
 			activeStores[addr] = st
+			health.healthy++
+			health.discoveredByType[storeType]++
+			health.healthyByType[storeType]++
 		}(storeSpec)
 	}
 	wg.Wait()
 
-	return activeStores
+	health.discovered = len(unique)
+	return activeStores, health
+}
+
+// HasMinStores returns true if, in the last update, at least minStores stores and at least the given ratio of the
+// discovered stores had successful Info calls. It returns false before the first update.
+func (s *StoreSet) HasMinStores(minStores int, minRatio float64) bool {
+	s.storesMtx.RLock()
+	defer s.storesMtx.RUnlock()
+
+	if s.health == nil {
+		return false
+	}
+	return s.health.healthy >= minStores && float64(s.health.healthy) >= minRatio*float64(s.health.discovered)
+}
+
+// WaitForMinStores blocks until the store set has the minimum stores as defined by HasMinStores, checking it every
+// interval. It returns an error if the stores are still missing after the timeout, or once the context is done.
+func WaitForMinStores(ctx context.Context, stores *StoreSet, minStores int, minRatio float64, interval, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return runutil.Retry(interval, ctx.Done(), func() error {
+		if !stores.HasMinStores(minStores, minRatio) {
+			return errors.Errorf("less than %d stores or %v of the discovered stores are healthy", minStores, minRatio)
+		}
+		return nil
+	})
+}
+
+// limitStoreSpecs returns the given specs with at most maxStores specs of stores that are not strict static.
+// Specs are sorted by address, so that the same stores are kept on every update. Strict static stores are always kept.
+func (s *StoreSet) limitStoreSpecs(specs []StoreSpec) []StoreSpec {
+	if s.maxStores <= 0 {
+		return specs
+	}
+
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Addr() < specs[j].Addr() })
+
+	var (
+		limited = make([]StoreSpec, 0, len(specs))
+		kept    = map[string]struct{}{}
+		dropped []string
+	)
+	for _, spec := range specs {
+		if _, ok := kept[spec.Addr()]; ok || spec.StrictStatic() {
+			limited = append(limited, spec)
+			continue
+		}
+		if len(kept) >= s.maxStores {
+			dropped = append(dropped, spec.Addr())
+			continue
+		}
+		kept[spec.Addr()] = struct{}{}
+		limited = append(limited, spec)
+	}
+
+	s.droppedStores.Set(float64(len(dropped)))
+	if d := strings.Join(dropped, ","); d != s.lastDropped {
+		s.lastDropped = d
+		if len(dropped) > 0 {
+			level.Warn(s.logger).Log("msg", "more stores than the store limit discovered, dropping stores", "limit", s.maxStores, "dropped", d)
+		}
+	}
+	return limited
+}
+
+// lastStoreType returns the store type of the last successful Info call of the store with the given address,
+// or nil if there was none.
+func (s *StoreSet) lastStoreType(addr string) component.StoreAPI {
+	s.storesStatusesMtx.RLock()
+	defer s.storesStatusesMtx.RUnlock()
+
+	if status, ok := s.storeStatuses[addr]; ok {
+		return status.StoreType
+	}
+	return nil
 }
 
 func (s *StoreSet) updateStoreStatus(store *storeRef, err error) {
@@ -516,6 +673,19 @@ func (s *StoreSet) Get() []store.Client {
 	return stores
 }
 
+// MetadataClients returns clients of the metric metadata API of all active stores.
+// Stores not serving the metadata API return the Unimplemented status code.
+func (s *StoreSet) MetadataClients() []storepb.MetadataClient {
+	s.storesMtx.RLock()
+	defer s.storesMtx.RUnlock()
+
+	clients := make([]storepb.MetadataClient, 0, len(s.stores))
+	for _, st := range s.stores {
+		clients = append(clients, storepb.NewMetadataClient(st.cc))
+	}
+	return clients
+}
+
 func (s *StoreSet) Close() {
 	s.storesMtx.Lock()
 	defer s.storesMtx.Unlock()
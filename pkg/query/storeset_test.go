@@ -8,10 +8,15 @@ import (
 	"fmt"
 	"math"
 	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/fortytw2/leaktest"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/store"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
@@ -184,7 +189,7 @@ func TestStoreSet_Update(t *testing.T) {
 			specs = append(specs, NewGRPCStoreSpec(addr, false))
 		}
 		return specs
-	}, testGRPCOpts, time.Minute)
+	}, testGRPCOpts, time.Minute, 0)
 	storeSet.gRPCInfoCallTimeout = 2 * time.Second
 	defer storeSet.Close()
 
@@ -532,7 +537,7 @@ func TestStoreSet_Update_NoneAvailable(t *testing.T) {
 			specs = append(specs, NewGRPCStoreSpec(addr, false))
 		}
 		return specs
-	}, testGRPCOpts, time.Minute)
+	}, testGRPCOpts, time.Minute, 0)
 	storeSet.gRPCInfoCallTimeout = 2 * time.Second
 
 	// Should not matter how many of these we run.
@@ -546,6 +551,203 @@ func TestStoreSet_Update_NoneAvailable(t *testing.T) {
 	testutil.Equals(t, expected, storeSet.storesMetric.storeNodes)
 }
 
+func TestStoreSet_HasMinStores(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	metas := make([]testStoreMeta, 3)
+	for i := range metas {
+		metas[i] = testStoreMeta{
+			extlsetFn: func(addr string) []storepb.LabelSet {
+				return []storepb.LabelSet{{Labels: []storepb.Label{{Name: "addr", Value: addr}}}}
+			},
+			storeType: component.Sidecar,
+		}
+	}
+	st, err := startTestStores(metas)
+	testutil.Ok(t, err)
+	defer st.Close()
+
+	addrs := st.StoreAddresses()
+	st.CloseOne(addrs[2])
+
+	storeSet := NewStoreSet(nil, nil, func() (specs []StoreSpec) {
+		for _, addr := range addrs {
+			specs = append(specs, NewGRPCStoreSpec(addr, false))
+		}
+		return specs
+	}, testGRPCOpts, time.Minute, 0)
+	storeSet.gRPCInfoCallTimeout = 1 * time.Second
+	defer storeSet.Close()
+
+	testutil.Assert(t, !storeSet.HasMinStores(0, 0), "expected no minimum stores before the first update")
+
+	storeSet.Update(context.Background())
+
+	for _, tcase := range []struct {
+		minStores int
+		minRatio  float64
+		expected  bool
+	}{
+		{minStores: 2, expected: true},
+		{minStores: 3, expected: false},
+		{minRatio: 0.6, expected: true},
+		{minRatio: 0.7, expected: false},
+		{minStores: 2, minRatio: 0.7, expected: false},
+	} {
+		testutil.Equals(t, tcase.expected, storeSet.HasMinStores(tcase.minStores, tcase.minRatio), "min stores %d, min ratio %v", tcase.minStores, tcase.minRatio)
+	}
+}
+
+// failingStoreSpec is a store spec whose Info calls fail while failing is set.
+type failingStoreSpec struct {
+	StoreSpec
+
+	failing *bool
+}
+
+func (s failingStoreSpec) Metadata(ctx context.Context, client storepb.StoreClient) ([]storepb.LabelSet, int64, int64, component.StoreAPI, error) {
+	if *s.failing {
+		return nil, 0, 0, nil, errors.New("failing")
+	}
+	return s.StoreSpec.Metadata(ctx, client)
+}
+
+func TestStoreSet_EndpointsMetric(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	var metas []testStoreMeta
+	for _, storeType := range []component.StoreAPI{component.Sidecar, component.Sidecar, component.Store} {
+		metas = append(metas, testStoreMeta{
+			extlsetFn: func(addr string) []storepb.LabelSet {
+				return []storepb.LabelSet{{Labels: []storepb.Label{{Name: "addr", Value: addr}}}}
+			},
+			storeType: storeType,
+		})
+	}
+	st, err := startTestStores(metas)
+	testutil.Ok(t, err)
+	defer st.Close()
+
+	var (
+		addrs   = st.StoreAddresses()
+		failing = make([]bool, len(addrs))
+	)
+	reg := prometheus.NewRegistry()
+	storeSet := NewStoreSet(nil, reg, func() (specs []StoreSpec) {
+		for i, addr := range addrs {
+			specs = append(specs, failingStoreSpec{StoreSpec: NewGRPCStoreSpec(addr, false), failing: &failing[i]})
+		}
+		return specs
+	}, testGRPCOpts, time.Minute, 0)
+	storeSet.gRPCInfoCallTimeout = 1 * time.Second
+	defer storeSet.Close()
+
+	expected := func(sidecars, healthySidecars, stores, healthyStores, unknown int) string {
+		return fmt.Sprintf(`
+# HELP thanos_store_nodes_endpoints Number of discovered store API endpoints and of the healthy ones among them in the last update, by the store type they last advertised.
+# TYPE thanos_store_nodes_endpoints gauge
+thanos_store_nodes_endpoints{state="discovered",store_type=""} %d
+thanos_store_nodes_endpoints{state="discovered",store_type="query"} 0
+thanos_store_nodes_endpoints{state="discovered",store_type="receive"} 0
+thanos_store_nodes_endpoints{state="discovered",store_type="rule"} 0
+thanos_store_nodes_endpoints{state="discovered",store_type="sidecar"} %d
+thanos_store_nodes_endpoints{state="discovered",store_type="store"} %d
+thanos_store_nodes_endpoints{state="healthy",store_type=""} 0
+thanos_store_nodes_endpoints{state="healthy",store_type="query"} 0
+thanos_store_nodes_endpoints{state="healthy",store_type="receive"} 0
+thanos_store_nodes_endpoints{state="healthy",store_type="rule"} 0
+thanos_store_nodes_endpoints{state="healthy",store_type="sidecar"} %d
+thanos_store_nodes_endpoints{state="healthy",store_type="store"} %d
+`, unknown, sidecars, stores, healthySidecars, healthyStores)
+	}
+
+	// Stores that never were healthy have no known store type.
+	failing[1] = true
+	storeSet.Update(context.Background())
+	testutil.Ok(t, promtest.GatherAndCompare(reg, strings.NewReader(expected(1, 1, 1, 1, 1)), "thanos_store_nodes_endpoints"))
+
+	failing[1] = false
+	storeSet.Update(context.Background())
+	testutil.Ok(t, promtest.GatherAndCompare(reg, strings.NewReader(expected(2, 2, 1, 1, 0)), "thanos_store_nodes_endpoints"))
+
+	// Unhealthy stores keep the store type they advertised last.
+	failing[1], failing[2] = true, true
+	storeSet.Update(context.Background())
+	testutil.Ok(t, promtest.GatherAndCompare(reg, strings.NewReader(expected(2, 1, 1, 0, 0)), "thanos_store_nodes_endpoints"))
+
+	// The store type is also kept once the connection of an unhealthy store was closed.
+	storeSet.Update(context.Background())
+	testutil.Ok(t, promtest.GatherAndCompare(reg, strings.NewReader(expected(2, 1, 1, 0, 0)), "thanos_store_nodes_endpoints"))
+
+	failing[1], failing[2] = false, false
+	storeSet.Update(context.Background())
+	testutil.Ok(t, promtest.GatherAndCompare(reg, strings.NewReader(expected(2, 2, 1, 1, 0)), "thanos_store_nodes_endpoints"))
+}
+
+func TestWaitForMinStores(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	metas := make([]testStoreMeta, 2)
+	for i := range metas {
+		metas[i] = testStoreMeta{
+			extlsetFn: func(addr string) []storepb.LabelSet {
+				return []storepb.LabelSet{{Labels: []storepb.Label{{Name: "addr", Value: addr}}}}
+			},
+			storeType: component.Sidecar,
+		}
+	}
+	st, err := startTestStores(metas)
+	testutil.Ok(t, err)
+	defer st.Close()
+
+	var (
+		mtx   sync.Mutex
+		addrs = st.StoreAddresses()[:1]
+	)
+	storeSet := NewStoreSet(nil, nil, func() (specs []StoreSpec) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		for _, addr := range addrs {
+			specs = append(specs, NewGRPCStoreSpec(addr, false))
+		}
+		return specs
+	}, testGRPCOpts, time.Minute, 0)
+	defer storeSet.Close()
+
+	storeSet.Update(context.Background())
+
+	t.Run("timeout", func(t *testing.T) {
+		start := time.Now()
+		testutil.NotOk(t, WaitForMinStores(context.Background(), storeSet, 2, 0, 10*time.Millisecond, 100*time.Millisecond))
+		testutil.Assert(t, time.Since(start) >= 100*time.Millisecond, "expected to wait for the timeout")
+	})
+
+	t.Run("ready once the minimum stores are healthy", func(t *testing.T) {
+		done := make(chan error, 1)
+		go func() {
+			done <- WaitForMinStores(context.Background(), storeSet, 2, 0, 10*time.Millisecond, 5*time.Second)
+		}()
+
+		select {
+		case err := <-done:
+			t.Fatalf("expected to wait for the minimum stores, got %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		mtx.Lock()
+		addrs = st.StoreAddresses()
+		mtx.Unlock()
+		storeSet.Update(context.Background())
+
+		select {
+		case err := <-done:
+			testutil.Ok(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the minimum stores to be healthy")
+		}
+	})
+}
+
 // TestQuerierStrict tests what happens when the strict mode is enabled/disabled.
 func TestQuerierStrict(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 5*time.Second)()
@@ -596,7 +798,7 @@ func TestQuerierStrict(t *testing.T) {
 			NewGRPCStoreSpec(st.StoreAddresses()[0], true),
 			NewGRPCStoreSpec(st.StoreAddresses()[1], false),
 		}
-	}, testGRPCOpts, time.Minute)
+	}, testGRPCOpts, time.Minute, 0)
 	defer storeSet.Close()
 	storeSet.gRPCInfoCallTimeout = 1 * time.Second
 
@@ -624,3 +826,122 @@ func TestQuerierStrict(t *testing.T) {
 	testutil.Equals(t, curMax, storeSet.stores[staticStoreAddr].maxTime, "minimum time reported by the store node is different")
 	testutil.NotOk(t, storeSet.storeStatuses[staticStoreAddr].LastError)
 }
+
+func TestStoreSet_limitStoreSpecs(t *testing.T) {
+	addrs := func(specs []StoreSpec) (res []string) {
+		for _, spec := range specs {
+			res = append(res, spec.Addr())
+		}
+		return res
+	}
+
+	for _, tcase := range []struct {
+		name            string
+		maxStores       int
+		specs           []StoreSpec
+		expected        []string
+		expectedDropped float64
+	}{
+		{
+			name:      "no limit",
+			maxStores: 0,
+			specs: []StoreSpec{
+				NewGRPCStoreSpec("c:10901", false),
+				NewGRPCStoreSpec("a:10901", false),
+			},
+			expected: []string{"c:10901", "a:10901"},
+		},
+		{
+			name:      "within limit",
+			maxStores: 2,
+			specs: []StoreSpec{
+				NewGRPCStoreSpec("c:10901", false),
+				NewGRPCStoreSpec("a:10901", false),
+			},
+			expected: []string{"a:10901", "c:10901"},
+		},
+		{
+			name:      "stores beyond limit in address order are dropped",
+			maxStores: 2,
+			specs: []StoreSpec{
+				NewGRPCStoreSpec("d:10901", false),
+				NewGRPCStoreSpec("b:10901", false),
+				NewGRPCStoreSpec("a:10901", false),
+				NewGRPCStoreSpec("c:10901", false),
+			},
+			expected:        []string{"a:10901", "b:10901"},
+			expectedDropped: 2,
+		},
+		{
+			name:      "strict static stores are kept",
+			maxStores: 1,
+			specs: []StoreSpec{
+				NewGRPCStoreSpec("c:10901", true),
+				NewGRPCStoreSpec("b:10901", false),
+				NewGRPCStoreSpec("a:10901", false),
+			},
+			expected:        []string{"a:10901", "c:10901"},
+			expectedDropped: 1,
+		},
+		{
+			name:      "duplicates count once",
+			maxStores: 1,
+			specs: []StoreSpec{
+				NewGRPCStoreSpec("a:10901", false),
+				NewGRPCStoreSpec("b:10901", false),
+				NewGRPCStoreSpec("a:10901", false),
+			},
+			expected:        []string{"a:10901", "a:10901"},
+			expectedDropped: 1,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			storeSet := NewStoreSet(nil, nil, nil, testGRPCOpts, time.Minute, tcase.maxStores)
+			testutil.Equals(t, tcase.expected, addrs(storeSet.limitStoreSpecs(tcase.specs)))
+			testutil.Equals(t, tcase.expectedDropped, promtest.ToFloat64(storeSet.droppedStores))
+
+			// The same stores are kept regardless of the order they are discovered in.
+			for i, j := 0, len(tcase.specs)-1; i < j; i, j = i+1, j-1 {
+				tcase.specs[i], tcase.specs[j] = tcase.specs[j], tcase.specs[i]
+			}
+			if tcase.maxStores > 0 {
+				testutil.Equals(t, tcase.expected, addrs(storeSet.limitStoreSpecs(tcase.specs)))
+			}
+		})
+	}
+}
+
+func TestStoreSet_Update_ReusesConnections(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	st, err := startTestStores([]testStoreMeta{
+		{
+			extlsetFn: func(addr string) []storepb.LabelSet {
+				return []storepb.LabelSet{{Labels: []storepb.Label{{Name: "addr", Value: addr}}}}
+			},
+			storeType: component.Sidecar,
+		},
+	})
+	testutil.Ok(t, err)
+	defer st.Close()
+
+	addr := st.StoreAddresses()[0]
+	storeSet := NewStoreSet(nil, nil, func() []StoreSpec {
+		return []StoreSpec{NewGRPCStoreSpec(addr, false)}
+	}, testGRPCOpts, time.Minute, 0)
+	defer storeSet.Close()
+
+	storeSet.Update(context.Background())
+	testutil.Equals(t, 1, len(storeSet.stores))
+	conn := storeSet.stores[addr].cc
+
+	// The connection of a known store is kept across updates and queries, instead of being dialed again.
+	for i := 0; i < 3; i++ {
+		storeSet.Update(context.Background())
+		testutil.Equals(t, 1, len(storeSet.stores))
+		testutil.Assert(t, conn == storeSet.stores[addr].cc, "expected the connection to be reused")
+
+		_, err := storeSet.Get()[0].Info(context.Background(), &storepb.InfoRequest{})
+		testutil.Ok(t, err)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// backpressureReasonHeader is the header holding the reason of write requests rejected by backpressure.
+	backpressureReasonHeader = "X-Thanos-Backpressure-Reason"
+
+	backpressureReasonInflight = "inflight-requests"
+	backpressureReasonMemory   = "memory"
+
+	// heapCheckInterval is the minimum interval between two reads of the heap size, as they briefly stop the world.
+	heapCheckInterval = time.Second
+)
+
+// backpressure rejects write requests while the receiver is overloaded, i.e. while the number of write requests
+// being appended or the size of the heap exceeds its limit, so clients back off before retrying.
+// All methods of a nil backpressure are no-ops.
+type backpressure struct {
+	// inflight is accessed atomically and must be 64-bit aligned, so it comes first.
+	inflight int64
+
+	maxInflight  int64
+	maxHeapBytes uint64
+	retryAfter   time.Duration
+
+	mtx       sync.Mutex
+	heapBytes uint64
+	lastCheck time.Time
+	readHeap  func() uint64
+	now       func() time.Time
+
+	rejections *prometheus.CounterVec
+}
+
+// newBackpressure returns a new backpressure rejecting requests while more than maxInflight write requests are
+// being appended or the heap in use is larger than maxHeapBytes, asking clients to retry after the given duration.
+// A limit of zero disables it, and nil is returned if both are disabled.
+func newBackpressure(reg prometheus.Registerer, maxInflight int, maxHeapBytes uint64, retryAfter time.Duration) *backpressure {
+	if maxInflight <= 0 && maxHeapBytes == 0 {
+		return nil
+	}
+	return &backpressure{
+		maxInflight:  int64(maxInflight),
+		maxHeapBytes: maxHeapBytes,
+		retryAfter:   retryAfter,
+		readHeap: func() uint64 {
+			var ms runtime.MemStats
+			runtime.ReadMemStats(&ms)
+			return ms.HeapInuse
+		},
+		now: time.Now,
+		rejections: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_receive_backpressure_rejections_total",
+			Help: "Total number of write requests rejected because the receiver was overloaded, by reason.",
+		}, []string{"reason"}),
+	}
+}
+
+// start registers a write request being appended. The returned function must be called once it is done.
+func (b *backpressure) start() func() {
+	if b == nil {
+		return func() {}
+	}
+	atomic.AddInt64(&b.inflight, 1)
+	return func() { atomic.AddInt64(&b.inflight, -1) }
+}
+
+// check returns the reason to reject a write request registered with start, or an empty string if it is admitted.
+func (b *backpressure) check() string {
+	if b == nil {
+		return ""
+	}
+	if b.maxInflight > 0 && atomic.LoadInt64(&b.inflight) > b.maxInflight {
+		b.rejections.WithLabelValues(backpressureReasonInflight).Inc()
+		return backpressureReasonInflight
+	}
+	if b.maxHeapBytes > 0 && b.heapInUse() > b.maxHeapBytes {
+		b.rejections.WithLabelValues(backpressureReasonMemory).Inc()
+		return backpressureReasonMemory
+	}
+	return ""
+}
+
+func (b *backpressure) heapInUse() uint64 {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if now := b.now(); now.Sub(b.lastCheck) >= heapCheckInterval {
+		b.heapBytes = b.readHeap()
+		b.lastCheck = now
+	}
+	return b.heapBytes
+}
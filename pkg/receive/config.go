@@ -26,14 +26,102 @@ var (
 	errParseConfigurationFile = errors.New("configuration file is not parsable")
 	// An errEmptyConfigurationFile is returned by the ConfigWatcher when attempting to load an empty configuration file.
 	errEmptyConfigurationFile = errors.New("configuration file is empty")
+	// An errInvalidConfigurationFile is returned by the ConfigWatcher when the configuration contains invalid values.
+	errInvalidConfigurationFile = errors.New("configuration file is not valid")
 )
 
+// WriteQuorum determines how many replicas of a write request
+// must succeed before the request is acknowledged.
+type WriteQuorum string
+
+const (
+	// WriteQuorumOne acknowledges a write request as soon as one replica succeeded.
+	WriteQuorumOne WriteQuorum = "one"
+	// WriteQuorumMajority acknowledges a write request once a majority of replicas succeeded.
+	// This is the default.
+	WriteQuorumMajority WriteQuorum = "majority"
+	// WriteQuorumAll acknowledges a write request only once all replicas succeeded.
+	WriteQuorumAll WriteQuorum = "all"
+)
+
+// threshold returns the number of replicas that need to succeed
+// to satisfy the quorum for the given replication factor.
+func (q WriteQuorum) threshold(replicationFactor uint64) uint64 {
+	switch q {
+	case WriteQuorumOne:
+		return 1
+	case WriteQuorumAll:
+		return replicationFactor
+	default:
+		return replicationFactor/2 + 1
+	}
+}
+
+// validate returns an error if the write quorum is not known.
+func (q WriteQuorum) validate() error {
+	switch q {
+	case "", WriteQuorumOne, WriteQuorumMajority, WriteQuorumAll:
+		return nil
+	}
+	return errors.Errorf("unknown write quorum %q, must be one of %q, %q or %q", q, WriteQuorumOne, WriteQuorumMajority, WriteQuorumAll)
+}
+
+// HashringAlgorithm is the algorithm distributing the time series of a hashring to its endpoints.
+type HashringAlgorithm string
+
+const (
+	// AlgorithmHashmod assigns time series to endpoints by their hash modulo the number of endpoints.
+	// Adding or removing an endpoint moves most time series to other endpoints. This is the default.
+	AlgorithmHashmod HashringAlgorithm = "hashmod"
+	// AlgorithmKetama assigns time series to endpoints with consistent hashing. Adding or removing an endpoint
+	// only moves the time series of its share of the ring.
+	AlgorithmKetama HashringAlgorithm = "ketama"
+)
+
+// validate returns an error if the algorithm is not known.
+func (a HashringAlgorithm) validate() error {
+	switch a {
+	case "", AlgorithmHashmod, AlgorithmKetama:
+		return nil
+	}
+	return errors.Errorf("unknown hashring algorithm %q, must be one of %q or %q", a, AlgorithmHashmod, AlgorithmKetama)
+}
+
+// orDefault returns the algorithm, or the default algorithm if none is set.
+func (a HashringAlgorithm) orDefault() HashringAlgorithm {
+	if a == "" {
+		return AlgorithmHashmod
+	}
+	return a
+}
+
 // HashringConfig represents the configuration for a hashring
 // a receive node knows about.
 type HashringConfig struct {
 	Hashring  string   `json:"hashring,omitempty"`
 	Tenants   []string `json:"tenants,omitempty"`
 	Endpoints []string `json:"endpoints"`
+	// Algorithm distributes the time series of the hashring to its endpoints. Defaults to hashmod.
+	Algorithm HashringAlgorithm `json:"algorithm,omitempty"`
+	// WriteQuorum is the number of replicas that need to succeed before a write is acknowledged.
+	// Write requests are still forwarded to all replicas. Defaults to majority.
+	WriteQuorum WriteQuorum `json:"write_quorum,omitempty"`
+	// SeriesLimit is the maximum number of active series of each tenant of the hashring on every receive node.
+	// Samples of new series over the limit are rejected. Defaults to no limit.
+	SeriesLimit uint64 `json:"series_limit,omitempty"`
+	// RequestBodySizeLimit is the maximum decompressed size in bytes of a write request of each tenant of the hashring,
+	// overriding --receive.request-body-size-limit. Larger requests are rejected.
+	RequestBodySizeLimit uint64 `json:"request_body_size_limit,omitempty"`
+	// RequestSeriesLimit is the maximum number of time series of a write request of each tenant of the hashring,
+	// overriding --receive.request-series-limit. Requests with more series are rejected.
+	RequestSeriesLimit uint64 `json:"request_series_limit,omitempty"`
+	// MirrorTenants are the tenants whose writes are mirrored to the hashring in addition to the hashring handling
+	// them, e.g. to keep a copy of their data in a more durable tier. Hashrings mirroring tenants must be named.
+	// Hashrings without tenants but with mirror tenants only receive mirrored writes.
+	MirrorTenants []string `json:"mirror_tenants,omitempty"`
+	// MirrorRequired makes write requests fail if mirroring them to the hashring fails. By default, write requests
+	// are acknowledged without waiting for their mirroring, whose failures are only logged.
+	MirrorRequired bool `json:"mirror_required,omitempty"`
 }
 
 // ConfigWatcher is able to watch a file containing a hashring configuration
@@ -197,6 +285,26 @@ func (cw *ConfigWatcher) loadConfig() ([]HashringConfig, float64, error) {
 		return nil, 0, errors.Wrapf(errEmptyConfigurationFile, "failed to load configuration file, path: %s", cw.path)
 	}
 
+	mirrors := map[string]struct{}{}
+	for _, c := range config {
+		if err := c.WriteQuorum.validate(); err != nil {
+			return nil, 0, errors.Wrapf(errInvalidConfigurationFile, "hashring %q: %v", c.Hashring, err)
+		}
+		if err := c.Algorithm.validate(); err != nil {
+			return nil, 0, errors.Wrapf(errInvalidConfigurationFile, "hashring %q: %v", c.Hashring, err)
+		}
+		if len(c.MirrorTenants) == 0 {
+			continue
+		}
+		if c.Hashring == "" {
+			return nil, 0, errors.Wrap(errInvalidConfigurationFile, "hashrings with mirror tenants must be named")
+		}
+		if _, ok := mirrors[c.Hashring]; ok {
+			return nil, 0, errors.Wrapf(errInvalidConfigurationFile, "hashring %q: duplicate name of hashring with mirror tenants", c.Hashring)
+		}
+		mirrors[c.Hashring] = struct{}{}
+	}
+
 	return config, hashAsMetricValue(cfgContent), nil
 }
 
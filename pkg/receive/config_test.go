@@ -42,6 +42,86 @@ func TestValidateConfig(t *testing.T) {
 			},
 			err: nil, // means it's valid.
 		},
+		{
+			name: "valid write quorum",
+			cfg: []HashringConfig{
+				{
+					Endpoints:   []string{"node1"},
+					WriteQuorum: WriteQuorumAll,
+				},
+			},
+			err: nil, // means it's valid.
+		},
+		{
+			name: "valid algorithm",
+			cfg: []HashringConfig{
+				{
+					Endpoints: []string{"node1"},
+					Algorithm: AlgorithmKetama,
+				},
+			},
+			err: nil, // means it's valid.
+		},
+		{
+			name: "invalid algorithm",
+			cfg: []HashringConfig{
+				{
+					Endpoints: []string{"node1"},
+					Algorithm: "random",
+				},
+			},
+			err: errInvalidConfigurationFile,
+		},
+		{
+			name: "invalid write quorum",
+			cfg: []HashringConfig{
+				{
+					Endpoints:   []string{"node1"},
+					WriteQuorum: "some",
+				},
+			},
+			err: errInvalidConfigurationFile,
+		},
+		{
+			name: "valid mirror hashring",
+			cfg: []HashringConfig{
+				{
+					Endpoints: []string{"node1"},
+				},
+				{
+					Hashring:      "durable",
+					Endpoints:     []string{"node2"},
+					MirrorTenants: []string{"tenant"},
+				},
+			},
+			err: nil, // means it's valid.
+		},
+		{
+			name: "unnamed mirror hashring",
+			cfg: []HashringConfig{
+				{
+					Endpoints:     []string{"node1"},
+					MirrorTenants: []string{"tenant"},
+				},
+			},
+			err: errInvalidConfigurationFile,
+		},
+		{
+			name: "duplicate mirror hashring",
+			cfg: []HashringConfig{
+				{
+					Hashring:      "durable",
+					Endpoints:     []string{"node1"},
+					MirrorTenants: []string{"tenant"},
+				},
+				{
+					Hashring:      "durable",
+					Endpoints:     []string{"node2"},
+					MirrorTenants: []string{"other"},
+				},
+			},
+			err: errInvalidConfigurationFile,
+		},
 	} {
 		var content []byte
 		var err error
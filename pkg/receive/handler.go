@@ -6,13 +6,17 @@ package receive
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	stdlog "log"
+	"math"
 	"net"
 	"net/http"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -24,11 +28,15 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/route"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/storage"
 	terrors "github.com/prometheus/prometheus/tsdb/errors"
 	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb/writev2"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
@@ -42,6 +50,10 @@ const (
 	DefaultTenantHeader = "THANOS-TENANT"
 	// DefaultReplicaHeader is the default header used to designate the replica count of a write request.
 	DefaultReplicaHeader = "THANOS-REPLICA"
+
+	// mirrorHashringMetadataKey is the gRPC metadata key naming the mirror hashring of write requests forwarded
+	// between receivers.
+	mirrorHashringMetadataKey = "thanos-mirror-hashring"
 )
 
 // conflictErr is returned whenever an operation fails due to any conflict-type error.
@@ -49,18 +61,55 @@ var conflictErr = errors.New("conflict")
 
 var errBadReplica = errors.New("replica count exceeds replication factor")
 
+// errSeriesLimit is returned whenever new series of a tenant are rejected because the tenant reached its series limit.
+var errSeriesLimit = errors.New("tenant series limit exceeded")
+
+// errRequestTooLarge is returned whenever a write request exceeds the body size or series limit of its tenant.
+var errRequestTooLarge = errors.New("write request too large")
+
 // Options for the web Handler.
 type Options struct {
-	Writer            *Writer
-	ListenAddress     string
-	Registry          prometheus.Registerer
-	TenantHeader      string
-	ReplicaHeader     string
-	Endpoint          string
-	ReplicationFactor uint64
-	Tracer            opentracing.Tracer
-	TLSConfig         *tls.Config
-	DialOpts          []grpc.DialOption
+	Writer             *Writer
+	ListenAddress      string
+	Registry           prometheus.Registerer
+	TenantHeader       string
+	ReplicaHeader      string
+	Endpoint           string
+	ReplicationFactor  uint64
+	ReplicationTimeout time.Duration
+	Tracer             opentracing.Tracer
+	TLSConfig          *tls.Config
+	DialOpts           []grpc.DialOption
+	SeriesIdleTimeout  time.Duration
+	// IdempotencyKeyHeader is the header holding the idempotency key of write requests.
+	// Retries of requests with the same key are not applied again. Empty disables deduplication.
+	IdempotencyKeyHeader    string
+	IdempotencyKeyTTL       time.Duration
+	IdempotencyKeyCacheSize int
+	// MetadataLimit is the maximum number of metric metadata entries stored per tenant. Zero disables the limit.
+	MetadataLimit int
+	// RequestLogSampleRatio is the ratio of write requests logged with their tenant, size, duration and outcome,
+	// between 0 and 1. Zero disables request logging.
+	RequestLogSampleRatio float64
+	// RequestBodySizeLimit is the maximum decompressed size in bytes of a write request. Zero disables the limit.
+	// It is overridden by the limit of the hashring of the tenant, if any.
+	RequestBodySizeLimit uint64
+	// RequestSeriesLimit is the maximum number of time series of a write request. Zero disables the limit.
+	// It is overridden by the limit of the hashring of the tenant, if any.
+	RequestSeriesLimit uint64
+	// BackpressureMaxInflightRequests is the maximum number of write requests appended concurrently. HTTP write
+	// requests over the limit are rejected with 503 and a Retry-After header. Zero disables the limit.
+	BackpressureMaxInflightRequests int
+	// BackpressureMaxHeapBytes is the heap size in use above which HTTP write requests are rejected with 503 and a
+	// Retry-After header. Zero disables the limit.
+	BackpressureMaxHeapBytes uint64
+	// BackpressureRetryAfter is the duration clients are asked to wait before retrying rejected write requests.
+	BackpressureRetryAfter time.Duration
+	// TenantHeartbeat enables exposing the time of the last successful write of every tenant.
+	TenantHeartbeat bool
+	// TenantHeartbeatStaleTimeout is the duration after which the heartbeat series of a tenant that stopped writing
+	// is removed. Zero never removes heartbeat series.
+	TenantHeartbeatStaleTimeout time.Duration
 }
 
 // Handler serves a Prometheus remote write receiving HTTP endpoint.
@@ -73,10 +122,21 @@ type Handler struct {
 
 	mtx      sync.RWMutex
 	hashring Hashring
-	peers    *peerGroup
+	// hashringVersion is incremented every time the hashring is set.
+	hashringVersion uint64
+	peers           *peerGroup
+	limiter         *seriesLimiter
+	metadata        *metadataStore
+
+	idempotency    *idempotencyCache
+	requestLog     *requestLogger
+	replicationLag *replicationLagTracker
+	backpressure   *backpressure
+	heartbeat      *tenantHeartbeat
 
 	// Metrics.
 	forwardRequestsTotal *prometheus.CounterVec
+	mirrorRequestsTotal  *prometheus.CounterVec
 }
 
 func NewHandler(logger log.Logger, o *Options) *Handler {
@@ -85,17 +145,36 @@ func NewHandler(logger log.Logger, o *Options) *Handler {
 	}
 
 	h := &Handler{
-		logger:  logger,
-		writer:  o.Writer,
-		router:  route.New(),
-		options: o,
-		peers:   newPeerGroup(o.DialOpts...),
+		logger:   logger,
+		writer:   o.Writer,
+		router:   route.New(),
+		options:  o,
+		peers:    newPeerGroup(o.DialOpts...),
+		limiter:  newSeriesLimiter(o.Registry, o.SeriesIdleTimeout),
+		metadata: newMetadataStore(o.Registry, o.MetadataLimit),
+
+		replicationLag: newReplicationLagTracker(o.Registry),
 		forwardRequestsTotal: promauto.With(o.Registry).NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "thanos_receive_forward_requests_total",
 				Help: "The number of forward requests.",
 			}, []string{"result"},
 		),
+		mirrorRequestsTotal: promauto.With(o.Registry).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "thanos_receive_mirror_requests_total",
+				Help: "The number of write requests mirrored to the mirror hashrings of their tenant.",
+			}, []string{"hashring", "result"},
+		),
+	}
+
+	h.requestLog = newRequestLogger(logger, o.RequestLogSampleRatio)
+	h.backpressure = newBackpressure(o.Registry, o.BackpressureMaxInflightRequests, o.BackpressureMaxHeapBytes, o.BackpressureRetryAfter)
+	if o.TenantHeartbeat {
+		h.heartbeat = newTenantHeartbeat(o.Registry, o.TenantHeartbeatStaleTimeout)
+	}
+	if o.IdempotencyKeyHeader != "" {
+		h.idempotency = newIdempotencyCache(o.Registry, o.IdempotencyKeyTTL, o.IdempotencyKeyCacheSize)
 	}
 
 	ins := extpromhttp.NewNopInstrumentationMiddleware()
@@ -112,6 +191,7 @@ func NewHandler(logger log.Logger, o *Options) *Handler {
 	}
 
 	h.router.Post("/api/v1/receive", instrf("receive", readyf(h.receiveHTTP)))
+	h.router.Get("/api/v1/hashring", instrf("hashring", readyf(h.hashringHTTP)))
 
 	return h
 }
@@ -134,6 +214,7 @@ func (h *Handler) Hashring(hashring Hashring) {
 	h.mtx.Lock()
 	defer h.mtx.Unlock()
 	h.hashring = hashring
+	h.hashringVersion++
 }
 
 // Verifies whether the server is ready or not.
@@ -224,25 +305,200 @@ func (h *Handler) handleRequest(ctx context.Context, rep uint64, tenant string,
 		r.n--
 	}
 
+	// Write requests received from clients are mirrored to the mirror hashrings of their tenant alongside.
+	mirrored := func() error { return nil }
+	if !r.replicated && mirrorHashringFromContext(ctx) == "" {
+		mirrored = h.mirror(ctx, tenant, wreq)
+	}
+
 	// Forward any time series as necessary. All time series
 	// destined for the local node will be written to the receiver.
 	// Time series will be replicated as necessary.
-	if err := h.forward(ctx, tenant, r, wreq); err != nil {
+	err := h.forward(ctx, tenant, r, wreq)
+	if merr := mirrored(); err == nil {
+		err = merr
+	}
+	if err != nil {
 		if countCause(err, isConflict) > 0 {
 			return conflictErr
 		}
+		if countCause(err, isSeriesLimit) > 0 {
+			if errs, ok := err.(terrors.MultiError); ok && len(errs) == 1 {
+				err = errs[0]
+			}
+			if errors.Cause(err) != errSeriesLimit {
+				err = errors.Wrap(errSeriesLimit, err.Error())
+			}
+			return err
+		}
 		return err
 	}
 	return nil
 }
 
+// mirror writes the given request to the mirror hashrings of the tenant concurrently. The returned function waits
+// for the hashrings whose mirroring is required and returns their errors. Mirroring to other hashrings is not
+// waited for and outlives the request.
+func (h *Handler) mirror(ctx context.Context, tenant string, wreq *prompb.WriteRequest) func() error {
+	var mirrors []mirror
+	h.mtx.RLock()
+	if m, ok := h.hashring.(mirrorer); ok {
+		mirrors = m.mirrorsOf(tenant)
+	}
+	h.mtx.RUnlock()
+
+	var required int
+	ec := make(chan error, len(mirrors))
+	for _, m := range mirrors {
+		mctx, cancel := ctx, context.CancelFunc(func() {})
+		if m.required {
+			required++
+		} else {
+			mctx, cancel = h.replicationContext(ctx)
+		}
+		// Hashing sorts the labels of the time series, so every hashring gets its own copy of them.
+		go func(m mirror, ctx context.Context, cancel context.CancelFunc, wreq *prompb.WriteRequest) {
+			defer cancel()
+			err := h.forward(contextWithMirrorHashring(ctx, m.name), tenant, replica{}, wreq)
+			if err != nil {
+				level.Error(h.logger).Log("msg", "mirroring request", "err", err, "hashring", m.name, "tenant", tenant)
+				h.mirrorRequestsTotal.WithLabelValues(m.name, "error").Inc()
+				err = errors.Wrapf(err, "mirror request to hashring %s", m.name)
+			} else {
+				h.mirrorRequestsTotal.WithLabelValues(m.name, "success").Inc()
+			}
+			if m.required {
+				ec <- err
+			}
+		}(m, mctx, cancel, copyLabels(wreq))
+	}
+
+	return func() error {
+		var errs terrors.MultiError
+		for ; required > 0; required-- {
+			if err := <-ec; err != nil {
+				errs.Add(err)
+			}
+		}
+		return errs.Err()
+	}
+}
+
+// copyLabels returns a copy of the write request with copies of the labels of its time series.
+func copyLabels(wreq *prompb.WriteRequest) *prompb.WriteRequest {
+	res := &prompb.WriteRequest{Timeseries: make([]prompb.TimeSeries, len(wreq.Timeseries)), Metadata: wreq.Metadata}
+	for i, ts := range wreq.Timeseries {
+		res.Timeseries[i] = ts
+		res.Timeseries[i].Labels = append([]prompb.Label(nil), ts.Labels...)
+	}
+	return res
+}
+
+// hashringFor returns the hashring the write requests of the given context are written to: the mirror hashring
+// named by the context, if any, or the hashring of the handler otherwise. The handler's hashring must be set and
+// its lock held.
+func (h *Handler) hashringFor(ctx context.Context) (Hashring, error) {
+	name := mirrorHashringFromContext(ctx)
+	if name == "" {
+		return h.hashring, nil
+	}
+	if m, ok := h.hashring.(mirrorer); ok {
+		if hashring, ok := m.mirrorHashring(name); ok {
+			return hashring, nil
+		}
+	}
+	return nil, errors.Errorf("no mirror hashring named %q", name)
+}
+
+type mirrorHashringContextKey struct{}
+
+// contextWithMirrorHashring returns a new context whose write requests are written to the mirror hashring with
+// the given name. An empty name writes them to the hashring handling their tenant.
+func contextWithMirrorHashring(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, mirrorHashringContextKey{}, name)
+}
+
+// mirrorHashringFromContext returns the name of the mirror hashring of the context, or an empty string if none.
+func mirrorHashringFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(mirrorHashringContextKey{}).(string)
+	return name
+}
+
+// requestLimits returns the limits of write requests of the given tenant: the limits of its hashring,
+// falling back to the limits of the options.
+func (h *Handler) requestLimits(tenant string) RequestLimits {
+	limits := RequestLimits{BodySizeBytes: h.options.RequestBodySizeLimit, Series: h.options.RequestSeriesLimit}
+
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	if h.hashring == nil {
+		return limits
+	}
+	l := h.hashring.RequestLimits(tenant)
+	if l.BodySizeBytes > 0 {
+		limits.BodySizeBytes = l.BodySizeBytes
+	}
+	if l.Series > 0 {
+		limits.Series = l.Series
+	}
+	return limits
+}
+
+// checkSize returns errRequestTooLarge if the given decompressed size of a write request exceeds the limit.
+func (l RequestLimits) checkSize(size int) error {
+	if l.BodySizeBytes > 0 && uint64(size) > l.BodySizeBytes {
+		return errors.Wrapf(errRequestTooLarge, "decompressed size of %d bytes exceeds the limit of %d bytes", size, l.BodySizeBytes)
+	}
+	return nil
+}
+
+// checkSeries returns errRequestTooLarge if the given number of time series of a write request exceeds the limit.
+func (l RequestLimits) checkSeries(series int) error {
+	if l.Series > 0 && uint64(series) > l.Series {
+		return errors.Wrapf(errRequestTooLarge, "%d series exceed the limit of %d series", series, l.Series)
+	}
+	return nil
+}
+
 func (h *Handler) receiveHTTP(w http.ResponseWriter, r *http.Request) {
-	compressed, err := ioutil.ReadAll(r.Body)
+	done := h.backpressure.start()
+	defer done()
+	if reason := h.backpressure.check(); reason != "" {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(h.options.BackpressureRetryAfter.Seconds()))))
+		w.Header().Set(backpressureReasonHeader, reason)
+		http.Error(w, fmt.Sprintf("receiver overloaded (%s), retry later", reason), http.StatusServiceUnavailable)
+		return
+	}
+
+	tenant := r.Header.Get(h.options.TenantHeader)
+	limits := h.requestLimits(tenant)
+
+	msg, err := remoteWriteProto(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body := io.Reader(r.Body)
+	// Bodies longer than the maximum snappy encoded length of the size limit cannot be within the limit,
+	// so there is no need to read them any further: their header tells their decompressed size already.
+	if n := snappy.MaxEncodedLen(int(limits.BodySizeBytes)); limits.BodySizeBytes > 0 && n >= 0 {
+		body = io.LimitReader(r.Body, int64(n)+1)
+	}
+	compressed, err := ioutil.ReadAll(body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// Check the size before decompressing the body. Invalid bodies fail decoding below.
+	if size, err := snappy.DecodedLen(compressed); err == nil {
+		if err := limits.checkSize(size); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
 	reqBuf, err := snappy.Decode(nil, compressed)
 	if err != nil {
 		level.Error(h.logger).Log("msg", "snappy decode error", "err", err)
@@ -251,8 +507,27 @@ func (h *Handler) receiveHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var wreq prompb.WriteRequest
-	if err := proto.Unmarshal(reqBuf, &wreq); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	switch msg {
+	case remoteWriteV2Proto:
+		var req writev2.Request
+		if err := proto.Unmarshal(reqBuf, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		converted, err := fromWriteV2(&req)
+		if err != nil {
+			http.Error(w, errors.Wrap(err, "decode remote write 2.0 request").Error(), http.StatusBadRequest)
+			return
+		}
+		wreq = *converted
+	default:
+		if err := proto.Unmarshal(reqBuf, &wreq); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := limits.checkSeries(len(wreq.Timeseries)); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
 		return
 	}
 
@@ -265,22 +540,102 @@ func (h *Handler) receiveHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	tenant := r.Header.Get(h.options.TenantHeader)
+	var key string
+	if h.options.IdempotencyKeyHeader != "" {
+		key = r.Header.Get(h.options.IdempotencyKeyHeader)
+	}
 
-	err = h.handleRequest(r.Context(), rep, tenant, &wreq)
-	switch err {
+	start := time.Now()
+	err = h.idempotency.do(r.Context(), tenant, key, func() error {
+		return h.handleRequest(r.Context(), rep, tenant, &wreq)
+	})
+	h.requestLog.log(tenant, rep, &wreq, len(reqBuf), time.Since(start), err)
+	switch errors.Cause(err) {
 	case nil:
+		if msg == remoteWriteV2Proto {
+			samples := 0
+			for _, ts := range wreq.Timeseries {
+				samples += len(ts.Samples)
+			}
+			// Native histograms are rejected and exemplars cannot be stored, so only samples are written.
+			w.Header().Set(samplesWrittenHeader, strconv.Itoa(samples))
+			w.Header().Set(histogramsWrittenHeader, "0")
+			w.Header().Set(exemplarsWrittenHeader, "0")
+		}
 		return
 	case conflictErr:
 		http.Error(w, err.Error(), http.StatusConflict)
 	case errBadReplica:
 		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errSeriesLimit:
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
 	default:
 		level.Error(h.logger).Log("err", err, "msg", "internal server error")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// hashringResponse is the response of the hashring endpoint.
+type hashringResponse struct {
+	// Version is incremented every time the hashring configuration is reloaded.
+	Version   uint64         `json:"version"`
+	Hashrings []HashringView `json:"hashrings"`
+	// Owners are the endpoints the write of the requested series is sent to, one per replica.
+	Owners []string `json:"owners,omitempty"`
+}
+
+// hashringHTTP returns the current hashring membership and, if a series is given as a selector of equality
+// matchers in the series parameter, the endpoints owning the writes of the series for the tenant parameter.
+func (h *Handler) hashringHTTP(w http.ResponseWriter, r *http.Request) {
+	var ts *prompb.TimeSeries
+	if s := r.FormValue("series"); s != "" {
+		matchers, err := promql.ParseMetricSelector(s)
+		if err != nil {
+			http.Error(w, errors.Wrap(err, "parse series").Error(), http.StatusBadRequest)
+			return
+		}
+		ts = &prompb.TimeSeries{}
+		for _, m := range matchers {
+			if m.Type != labels.MatchEqual {
+				http.Error(w, fmt.Sprintf("series must only have equality matchers, got %s", m), http.StatusBadRequest)
+				return
+			}
+			ts.Labels = append(ts.Labels, prompb.Label{Name: m.Name, Value: m.Value})
+		}
+	}
+
+	// It is possible that hashring is ready in testReady() but unready now,
+	// so need to lock here.
+	h.mtx.RLock()
+	if h.hashring == nil {
+		h.mtx.RUnlock()
+		http.Error(w, "hashring is not ready", http.StatusServiceUnavailable)
+		return
+	}
+	res := hashringResponse{Version: h.hashringVersion}
+	if v, ok := h.hashring.(viewer); ok {
+		res.Hashrings = v.view()
+	}
+	// Writes are forwarded to the first endpoint and replicated to the following ones, see forward and replicate.
+	if ts != nil {
+		for i := uint64(0); i == 0 || i < h.options.ReplicationFactor; i++ {
+			endpoint, err := h.hashring.GetN(r.FormValue("tenant"), ts, i)
+			if err != nil {
+				h.mtx.RUnlock()
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res.Owners = append(res.Owners, endpoint)
+		}
+	}
+	h.mtx.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		level.Error(h.logger).Log("msg", "failed to write hashring response", "err", err)
+	}
+}
+
 // forward accepts a write request, batches its time series by
 // corresponding endpoint, and forwards them in parallel to the
 // correct endpoint. Requests destined for the local node are written
@@ -300,6 +655,11 @@ func (h *Handler) forward(ctx context.Context, tenant string, r replica, wreq *p
 		h.mtx.RUnlock()
 		return errors.New("hashring is not ready")
 	}
+	hashring, err := h.hashringFor(ctx)
+	if err != nil {
+		h.mtx.RUnlock()
+		return err
+	}
 
 	// Batch all of the time series in the write request
 	// into several smaller write requests that are
@@ -309,7 +669,7 @@ func (h *Handler) forward(ctx context.Context, tenant string, r replica, wreq *p
 	// to every other node in the hashring, rather than
 	// one request per time series.
 	for i := range wreq.Timeseries {
-		endpoint, err := h.hashring.GetN(tenant, &wreq.Timeseries[i], r.n)
+		endpoint, err := hashring.GetN(tenant, &wreq.Timeseries[i], r.n)
 		if err != nil {
 			h.mtx.RUnlock()
 			return err
@@ -321,6 +681,19 @@ func (h *Handler) forward(ctx context.Context, tenant string, r replica, wreq *p
 		wr := wreqs[endpoint]
 		wr.Timeseries = append(wr.Timeseries, wreq.Timeseries[i])
 	}
+	for i := range wreq.Metadata {
+		endpoint, err := hashring.GetN(tenant, metadataSeries(&wreq.Metadata[i]), r.n)
+		if err != nil {
+			h.mtx.RUnlock()
+			return err
+		}
+		if _, ok := wreqs[endpoint]; !ok {
+			wreqs[endpoint] = &prompb.WriteRequest{}
+			replicas[endpoint] = r
+		}
+		wr := wreqs[endpoint]
+		wr.Metadata = append(wr.Metadata, wreq.Metadata[i])
+	}
 	h.mtx.RUnlock()
 
 	return h.parallelizeRequests(ctx, tenant, replicas, wreqs)
@@ -330,16 +703,35 @@ func (h *Handler) forward(ctx context.Context, tenant string, r replica, wreq *p
 // The function only returns when all requests have finished
 // or the context is canceled.
 func (h *Handler) parallelizeRequests(ctx context.Context, tenant string, replicas map[string]replica, wreqs map[string]*prompb.WriteRequest) error {
-	ec := make(chan error)
-	defer close(ec)
+	ec := h.fanoutRequests(ctx, tenant, replicas, wreqs)
+
+	// Collect any errors from forwarding the time series.
+	// Rather than doing a wg.Wait here, we decrement a counter
+	// for every error received on the chan. This simplifies
+	// error collection and avoids data races with a separate
+	// error collection goroutine.
+	var errs terrors.MultiError
+	for n := len(wreqs); n > 0; n-- {
+		if err := <-ec; err != nil {
+			errs.Add(err)
+		}
+	}
+
+	return errs.Err()
+}
+
+// fanoutRequests sends every given write request in its own goroutine.
+// The result of every request is sent on the returned chan.
+// The chan is buffered so that requests never block on sending their result,
+// which allows callers to stop collecting results early.
+func (h *Handler) fanoutRequests(ctx context.Context, tenant string, replicas map[string]replica, wreqs map[string]*prompb.WriteRequest) <-chan error {
 	// We don't wan't to use a sync.WaitGroup here because that
 	// introduces an unnecessary second synchronization mechanism,
 	// the first being the error chan. Plus, it saves us a goroutine
 	// as in order to collect errors while doing wg.Wait, we would
 	// need a separate error collection goroutine.
-	var n int
+	ec := make(chan error, len(wreqs))
 	for endpoint := range wreqs {
-		n++
 		// If the request is not yet replicated, let's replicate it.
 		// If the replication factor isn't greater than 1, let's
 		// just forward the requests.
@@ -362,11 +754,25 @@ func (h *Handler) parallelizeRequests(ctx context.Context, tenant string, replic
 				if h.writer == nil {
 					err = errors.New("storage is not ready")
 				} else {
+					var limit uint64
+					if h.hashring != nil {
+						if hashring, err := h.hashringFor(ctx); err == nil {
+							limit = hashring.SeriesLimit(tenant)
+						}
+					}
+					wreq, rejected := h.limiter.filter(tenant, limit, wreqs[endpoint])
+					if dropped := h.metadata.add(tenant, wreqs[endpoint].Metadata); dropped > 0 {
+						level.Warn(h.logger).Log("msg", "dropped new metric metadata over the limit of the tenant", "tenant", tenant, "dropped", dropped, "limit", h.options.MetadataLimit)
+					}
+
 					// Create a span to track writing the request into TSDB.
 					tracing.DoInSpan(ctx, "receive_tsdb_write", func(ctx context.Context) {
 
-						err = h.writer.Write(wreqs[endpoint])
+						err = h.writer.Write(wreq)
 					})
+					if err == nil && len(wreq.Timeseries) > 0 {
+						h.heartbeat.record(tenant)
+					}
 					// When a MultiError is added to another MultiError, the error slices are concatenated, not nested.
 					// To avoid breaking the counting logic, we need to flatten the error.
 					if errs, ok := err.(terrors.MultiError); ok {
@@ -376,6 +782,13 @@ func (h *Handler) parallelizeRequests(ctx context.Context, tenant string, replic
 							err = errors.New(errs.Error())
 						}
 					}
+					// Rejected series take precedence, as retrying the request cannot succeed for them either.
+					if rejected > 0 {
+						if err != nil {
+							level.Error(h.logger).Log("msg", "storing locally", "err", err, "endpoint", endpoint)
+						}
+						err = errors.Wrapf(errSeriesLimit, "rejected %d new series of tenant %q over the limit of %d active series", rejected, tenant, limit)
+					}
 				}
 				h.mtx.RUnlock()
 				if err != nil {
@@ -409,8 +822,13 @@ func (h *Handler) parallelizeRequests(ctx context.Context, tenant string, replic
 			tracing.DoInSpan(ctx, "receive_forward", func(ctx context.Context) {
 				// Actually make the request against the endpoint
 				// we determined should handle these time series.
+				// Receivers of mirrored requests write them to the same mirror hashring.
+				if name := mirrorHashringFromContext(ctx); name != "" {
+					ctx = metadata.AppendToOutgoingContext(ctx, mirrorHashringMetadataKey, name)
+				}
 				_, err = cl.RemoteWrite(ctx, &storepb.WriteRequest{
 					Timeseries: wreqs[endpoint].Timeseries,
+					Metadata:   wreqs[endpoint].Metadata,
 					Tenant:     tenant,
 					Replica:    int64(replicas[endpoint].n + 1), // increment replica since on-the-wire format is 1-indexed and 0 indicates unreplicated.
 				})
@@ -423,26 +841,15 @@ func (h *Handler) parallelizeRequests(ctx context.Context, tenant string, replic
 			})
 		}(endpoint)
 	}
-
-	// Collect any errors from forwarding the time series.
-	// Rather than doing a wg.Wait here, we decrement a counter
-	// for every error received on the chan. This simplifies
-	// error collection and avoids data races with a separate
-	// error collection goroutine.
-	var errs terrors.MultiError
-	for ; n > 0; n-- {
-		if err := <-ec; err != nil {
-			errs.Add(err)
-		}
-	}
-
-	return errs.Err()
+	return ec
 }
 
 // replicate replicates a write request to (replication-factor) nodes
 // selected by the tenant and time series.
-// The function only returns when all replication requests have finished
-// or the context is canceled.
+// The write request is sent to all replicas, but the function returns
+// as soon as the write quorum configured for the tenant is met or can no
+// longer be met. Replication requests that are still in flight at that
+// point are not canceled.
 func (h *Handler) replicate(ctx context.Context, tenant string, wreq *prompb.WriteRequest) error {
 	wreqs := make(map[string]*prompb.WriteRequest)
 	replicas := make(map[string]replica)
@@ -455,9 +862,21 @@ func (h *Handler) replicate(ctx context.Context, tenant string, wreq *prompb.Wri
 		h.mtx.RUnlock()
 		return errors.New("hashring is not ready")
 	}
+	hashring, err := h.hashringFor(ctx)
+	if err != nil {
+		h.mtx.RUnlock()
+		return err
+	}
 
+	// All time series and metadata of the request are distributed to the same nodes, so any of them selects the replicas.
+	ts := &prompb.TimeSeries{}
+	if len(wreq.Timeseries) > 0 {
+		ts = &wreq.Timeseries[0]
+	} else if len(wreq.Metadata) > 0 {
+		ts = metadataSeries(&wreq.Metadata[0])
+	}
 	for i = 0; i < h.options.ReplicationFactor; i++ {
-		endpoint, err := h.hashring.GetN(tenant, &wreq.Timeseries[0], i)
+		endpoint, err := hashring.GetN(tenant, ts, i)
 		if err != nil {
 			h.mtx.RUnlock()
 			return err
@@ -465,36 +884,152 @@ func (h *Handler) replicate(ctx context.Context, tenant string, wreq *prompb.Wri
 		wreqs[endpoint] = wreq
 		replicas[endpoint] = replica{i, true}
 	}
+	quorum := hashring.WriteQuorum(tenant).threshold(h.options.ReplicationFactor)
 	h.mtx.RUnlock()
 
-	err := h.parallelizeRequests(ctx, tenant, replicas, wreqs)
-	if errs, ok := err.(terrors.MultiError); ok {
-		if uint64(countCause(errs, isConflict)) >= (h.options.ReplicationFactor+1)/2 {
-			return errors.Wrap(conflictErr, "did not meet replication threshold")
+	newest, hasSamples := newestSampleTimestamp(wreq)
+	if hasSamples {
+		h.replicationLag.received(tenant, newest)
+	}
+
+	// Replication requests may outlive this call once the quorum is met,
+	// so they must not be canceled together with the incoming request.
+	rctx, cancel := h.replicationContext(ctx)
+	ec := h.fanoutRequests(rctx, tenant, replicas, wreqs)
+
+	var (
+		errs      terrors.MultiError
+		successes uint64
+		pending   = len(wreqs)
+	)
+	// Wait until either enough replicas succeeded or
+	// so many failed that the quorum cannot be met anymore.
+	for ; pending > 0 && successes < quorum && uint64(len(errs)) <= h.options.ReplicationFactor-quorum; pending-- {
+		if err := <-ec; err != nil {
+			errs.Add(err)
+			continue
 		}
-		if uint64(len(errs)) >= (h.options.ReplicationFactor+1)/2 {
-			return errors.Wrap(err, "did not meet replication threshold")
+		successes++
+	}
+	// Wait for the remaining replicas to track when the request is replicated to all of them.
+	go func(pending int, successes uint64) {
+		defer cancel()
+		for ; pending > 0; pending-- {
+			if err := <-ec; err == nil {
+				successes++
+			}
+		}
+		if hasSamples && successes == uint64(len(wreqs)) {
+			h.replicationLag.replicated(tenant, newest)
 		}
+	}(pending, successes)
+
+	if successes >= quorum {
 		return nil
 	}
-	return errors.Wrap(err, "could not replicate write request")
+	if uint64(countCause(errs, isConflict)) > h.options.ReplicationFactor-quorum {
+		return errors.Wrap(conflictErr, "did not meet replication threshold")
+	}
+	if uint64(countCause(errs, isSeriesLimit)) > h.options.ReplicationFactor-quorum {
+		return errors.Wrap(errSeriesLimit, "did not meet replication threshold")
+	}
+	return errors.Wrap(errs, "did not meet replication threshold")
+}
+
+// replicationContext returns a context that carries all values of the given
+// context, but is not canceled when the given context is. The returned context
+// times out after the configured replication timeout, if any.
+func (h *Handler) replicationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx = detachedContext{parent: ctx}
+	if h.options.ReplicationTimeout > 0 {
+		return context.WithTimeout(ctx, h.options.ReplicationTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// detachedContext is a context that carries the values of its parent,
+// but never inherits its deadline or cancellation.
+type detachedContext struct {
+	parent context.Context
 }
 
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
 // RemoteWrite implements the gRPC remote write handler for storepb.WriteableStore.
+// Requests are handled the same way as HTTP remote write requests. The tenant and
+// replica of a request can either be set in the request itself, as done when
+// forwarding requests between receivers, or in the gRPC metadata keys named like
+// the HTTP headers. The idempotency key is read from the metadata key named like its header.
 func (h *Handler) RemoteWrite(ctx context.Context, r *storepb.WriteRequest) (*storepb.WriteResponse, error) {
-	err := h.handleRequest(ctx, uint64(r.Replica), r.Tenant, &prompb.WriteRequest{Timeseries: r.Timeseries})
-	switch err {
+	if !h.isReady() {
+		return nil, status.Error(codes.Unavailable, "service unavailable")
+	}
+
+	var key, mirrorHashring string
+	tenant, rep := r.Tenant, uint64(r.Replica)
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(mirrorHashringMetadataKey); len(v) > 0 {
+			mirrorHashring = v[0]
+		}
+		if v := md.Get(h.options.IdempotencyKeyHeader); h.options.IdempotencyKeyHeader != "" && len(v) > 0 {
+			key = v[0]
+		}
+		if v := md.Get(h.options.TenantHeader); tenant == "" && len(v) > 0 {
+			tenant = v[0]
+		}
+		// If the metadata is empty, we assume the request is not yet replicated.
+		if v := md.Get(h.options.ReplicaHeader); rep == 0 && len(v) > 0 && v[0] != "" {
+			var err error
+			if rep, err = strconv.ParseUint(v[0], 10, 64); err != nil {
+				return nil, status.Error(codes.InvalidArgument, "could not parse replica metadata")
+			}
+		}
+	}
+
+	ctx = contextWithMirrorHashring(ctx, mirrorHashring)
+
+	// Write requests of other receivers are not rejected, but count towards the write requests being appended.
+	done := h.backpressure.start()
+	defer done()
+
+	limits := h.requestLimits(tenant)
+	if err := limits.checkSize(r.Size()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := limits.checkSeries(len(r.Timeseries)); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	wreq := &prompb.WriteRequest{Timeseries: r.Timeseries, Metadata: r.Metadata}
+	start := time.Now()
+	err := h.idempotency.do(ctx, tenant, key, func() error {
+		return h.handleRequest(ctx, rep, tenant, wreq)
+	})
+	h.requestLog.log(tenant, rep, wreq, r.Size(), time.Since(start), err)
+	switch errors.Cause(err) {
 	case nil:
 		return &storepb.WriteResponse{}, nil
 	case conflictErr:
 		return nil, status.Error(codes.AlreadyExists, err.Error())
 	case errBadReplica:
 		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case errSeriesLimit:
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
 	default:
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 }
 
+// Metadata implements the gRPC metadata handler for storepb.Metadata.
+// It returns the metric metadata stored by this node for the requested tenant, or for all tenants if none is given.
+func (h *Handler) Metadata(_ context.Context, r *storepb.MetadataRequest) (*storepb.MetadataResponse, error) {
+	return &storepb.MetadataResponse{Metadata: h.metadata.metadata(r.Tenant, r.Metric, int(r.Limit))}, nil
+}
+
 // countCause counts the number of errors within the given error
 // whose causes satisfy the given function.
 // countCause will inspect the error's cause or, if the error is a MultiError,
@@ -526,6 +1061,16 @@ func isConflict(err error) bool {
 		status.Code(err) == codes.AlreadyExists
 }
 
+// isSeriesLimit returns whether or not the given error represents rejected series of a tenant over its series limit.
+func isSeriesLimit(err error) bool {
+	if err == nil {
+		return false
+	}
+	return err == errSeriesLimit ||
+		err.Error() == strconv.Itoa(http.StatusTooManyRequests) ||
+		status.Code(err) == codes.ResourceExhausted
+}
+
 func newPeerGroup(dialOpts ...grpc.DialOption) *peerGroup {
 	return &peerGroup{
 		dialOpts: dialOpts,
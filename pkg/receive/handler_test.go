@@ -6,24 +6,33 @@ package receive
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
 	"github.com/pkg/errors"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/storage"
 	terrors "github.com/prometheus/prometheus/tsdb/errors"
+	"github.com/thanos-io/thanos/pkg/runutil"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb/writev2"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func TestCountCause(t *testing.T) {
@@ -137,10 +146,11 @@ func TestCountCause(t *testing.T) {
 	}
 }
 
-func newHandlerHashring(appendables []*fakeAppendable, replicationFactor uint64) ([]*Handler, Hashring) {
+func newHandlerHashring(appendables []*fakeAppendable, replicationFactor uint64, quorum WriteQuorum) ([]*Handler, Hashring) {
 	cfg := []HashringConfig{
 		{
-			Hashring: "test",
+			Hashring:    "test",
+			WriteQuorum: quorum,
 		},
 	}
 	var handlers []*Handler
@@ -163,7 +173,7 @@ func newHandlerHashring(appendables []*fakeAppendable, replicationFactor uint64)
 			TenantHeader:      DefaultTenantHeader,
 			ReplicaHeader:     DefaultReplicaHeader,
 			ReplicationFactor: replicationFactor,
-			Writer:            NewWriter(log.NewNopLogger(), appendables[i]),
+			Writer:            NewWriter(log.NewNopLogger(), nil, appendables[i], 0, LabelLimits{}),
 		})
 		handlers = append(handlers, h)
 		h.peers = peers
@@ -172,7 +182,7 @@ func newHandlerHashring(appendables []*fakeAppendable, replicationFactor uint64)
 		cfg[0].Endpoints = append(cfg[0].Endpoints, h.options.Endpoint)
 		peers.cache[addr] = &fakeRemoteWriteGRPCServer{h: h}
 	}
-	hashring := newMultiHashring(cfg)
+	hashring := newMultiHashring(cfg, nil)
 	for _, h := range handlers {
 		h.Hashring(hashring)
 	}
@@ -472,7 +482,7 @@ func TestReceive(t *testing.T) {
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
-			handlers, hashring := newHandlerHashring(tc.appendables, tc.replicationFactor)
+			handlers, hashring := newHandlerHashring(tc.appendables, tc.replicationFactor, "")
 			tenant := "test"
 			// Test from the point of view of every node
 			// so that we know status code does not depend
@@ -489,6 +499,10 @@ func TestReceive(t *testing.T) {
 			}
 			// Test that each time series is stored
 			// the correct amount of times in each fake DB.
+			// Replicas beyond the write quorum may still be in flight
+			// once a request is acknowledged, so allow them to catch up.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
 			for _, ts := range tc.wreq.Timeseries {
 				lset := make(labels.Labels, len(ts.Labels))
 				for j := range ts.Labels {
@@ -499,15 +513,21 @@ func TestReceive(t *testing.T) {
 				}
 				for j, a := range tc.appendables {
 					var expected int
-					n := a.appender.(*fakeAppender).samples[lset.String()]
-					got := uint64(len(n))
 					if a.appenderErr == nil && endpointHit(t, hashring, tc.replicationFactor, handlers[j].options.Endpoint, tenant, &ts) {
 						// We have len(handlers) copies of each sample because the test case
 						// is run once for each handler and they all use the same appender.
 						expected = len(handlers) * len(ts.Samples)
 					}
-					if uint64(expected) != got {
-						t.Errorf("handler: %d, labels %q: expected %d samples, got %d", j, lset.String(), expected, got)
+					if err := runutil.Retry(10*time.Millisecond, ctx.Done(), func() error {
+						app := a.appender.(*fakeAppender)
+						app.Lock()
+						defer app.Unlock()
+						if got := len(app.samples[lset.String()]); expected != got {
+							return errors.Errorf("expected %d samples, got %d", expected, got)
+						}
+						return nil
+					}); err != nil {
+						t.Errorf("handler: %d, labels %q: %v", j, lset.String(), err)
 					}
 				}
 			}
@@ -515,6 +535,1073 @@ func TestReceive(t *testing.T) {
 	}
 }
 
+func TestReceiveWriteQuorum(t *testing.T) {
+	commitErrFn := func() error { return errors.New("failed to commit") }
+	wreq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels:  []prompb.Label{{Name: "foo", Value: "bar"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+			},
+		},
+	}
+	for _, tc := range []struct {
+		name   string
+		quorum WriteQuorum
+		// faulty is the number of replicas failing to commit.
+		faulty int
+		// slow is the number of replicas blocking until released.
+		slow   int
+		status int
+	}{
+		{name: "one", quorum: WriteQuorumOne, status: http.StatusOK},
+		{name: "one with two faulty", quorum: WriteQuorumOne, faulty: 2, status: http.StatusOK},
+		{name: "one with all faulty", quorum: WriteQuorumOne, faulty: 3, status: http.StatusInternalServerError},
+		{name: "one with two slow", quorum: WriteQuorumOne, slow: 2, status: http.StatusOK},
+		{name: "majority", quorum: WriteQuorumMajority, status: http.StatusOK},
+		{name: "majority with one faulty", quorum: WriteQuorumMajority, faulty: 1, status: http.StatusOK},
+		{name: "majority with two faulty", quorum: WriteQuorumMajority, faulty: 2, status: http.StatusInternalServerError},
+		{name: "majority with one slow", quorum: WriteQuorumMajority, slow: 1, status: http.StatusOK},
+		{name: "majority with two slow", quorum: WriteQuorumMajority, slow: 2, status: http.StatusOK},
+		{name: "default with one faulty", faulty: 1, status: http.StatusOK},
+		{name: "all", quorum: WriteQuorumAll, status: http.StatusOK},
+		{name: "all with one faulty", quorum: WriteQuorumAll, faulty: 1, status: http.StatusInternalServerError},
+		{name: "all with one slow", quorum: WriteQuorumAll, slow: 1, status: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			release := make(chan struct{})
+			blockFn := func() error {
+				<-release
+				return nil
+			}
+			appendables := make([]*fakeAppendable, 3)
+			for i := range appendables {
+				switch {
+				case i < tc.faulty:
+					appendables[i] = &fakeAppendable{appender: newFakeAppender(nil, nil, commitErrFn, nil)}
+				case i < tc.faulty+tc.slow:
+					appendables[i] = &fakeAppendable{appender: newFakeAppender(nil, nil, blockFn, nil)}
+				default:
+					appendables[i] = &fakeAppendable{appender: newFakeAppender(nil, nil, nil, nil)}
+				}
+			}
+			handlers, _ := newHandlerHashring(appendables, 3, tc.quorum)
+
+			statusc := make(chan int, 1)
+			go func() {
+				status, err := makeRequest(handlers[0], "test", wreq)
+				if err != nil {
+					t.Errorf("unexpectedly failed making HTTP request: %v", err)
+				}
+				statusc <- status
+			}()
+
+			// The request must only be answered before the slow replicas are released
+			// if the outcome does not depend on them.
+			threshold := tc.quorum.threshold(3)
+			early := uint64(len(appendables)-tc.slow-tc.faulty) >= threshold || uint64(tc.faulty) > 3-threshold
+			if !early {
+				select {
+				case status := <-statusc:
+					t.Fatalf("request acknowledged before quorum was met, status %d", status)
+				case <-time.After(100 * time.Millisecond):
+				}
+				close(release)
+			}
+			select {
+			case status := <-statusc:
+				if status != tc.status {
+					t.Errorf("got unexpected HTTP status code: expected %d, got %d", tc.status, status)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for request to be acknowledged")
+			}
+			if early {
+				close(release)
+			}
+
+			// Even if the request was acknowledged early,
+			// every replica must eventually receive the samples.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			for i, a := range appendables {
+				if err := runutil.Retry(10*time.Millisecond, ctx.Done(), func() error {
+					app := a.appender.(*fakeAppender)
+					app.Lock()
+					defer app.Unlock()
+					if n := len(app.samples[`{foo="bar"}`]); n != len(wreq.Timeseries[0].Samples) {
+						return errors.Errorf("expected %d samples, got %d", len(wreq.Timeseries[0].Samples), n)
+					}
+					return nil
+				}); err != nil {
+					t.Errorf("replica %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReceiveSeriesLimit(t *testing.T) {
+	series := func(names ...string) *prompb.WriteRequest {
+		wreq := &prompb.WriteRequest{}
+		for _, name := range names {
+			wreq.Timeseries = append(wreq.Timeseries, prompb.TimeSeries{
+				Labels:  []prompb.Label{{Name: "name", Value: name}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: int64(len(wreq.Timeseries))}},
+			})
+		}
+		return wreq
+	}
+	for _, tc := range []struct {
+		name              string
+		nodes             int
+		replicationFactor uint64
+	}{
+		{name: "single node", nodes: 1, replicationFactor: 1},
+		{name: "replicated", nodes: 3, replicationFactor: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			appendables := make([]*fakeAppendable, tc.nodes)
+			for i := range appendables {
+				appendables[i] = &fakeAppendable{appender: newFakeAppender(nil, nil, nil, nil)}
+			}
+			handlers, _ := newHandlerHashring(appendables, tc.replicationFactor, "")
+			setLimit := func(limit uint64) {
+				cfg := []HashringConfig{{Hashring: "test", SeriesLimit: limit}}
+				for _, h := range handlers {
+					cfg[0].Endpoints = append(cfg[0].Endpoints, h.options.Endpoint)
+				}
+				hashring := newMultiHashring(cfg, nil)
+				for _, h := range handlers {
+					h.Hashring(hashring)
+				}
+			}
+			write := func(tenant string, wreq *prompb.WriteRequest) int {
+				status, err := makeRequest(handlers[0], tenant, wreq)
+				if err != nil {
+					t.Fatalf("unexpectedly failed making HTTP request: %v", err)
+				}
+				return status
+			}
+			expect := func(exp, got int) {
+				if exp != got {
+					t.Fatalf("expected status %d, got %d", exp, got)
+				}
+			}
+
+			setLimit(2)
+			expect(http.StatusOK, write("test", series("a", "b")))
+			expect(http.StatusOK, write("test", series("b", "a")))
+			expect(http.StatusTooManyRequests, write("test", series("c")))
+			expect(http.StatusTooManyRequests, write("test", series("a", "c")))
+			if code := makeGRPCRequest(handlers[0], "test", "", series("d")); code != codes.ResourceExhausted {
+				t.Fatalf("expected gRPC code %s, got %s", codes.ResourceExhausted, code)
+			}
+			// Other tenants have their own limit.
+			expect(http.StatusOK, write("other", series("c", "d")))
+
+			if tc.nodes == 1 {
+				samples := appendables[0].appender.(*fakeAppender).samples
+				if n := len(samples[labels.FromStrings("name", "a").String()]); n != 3 {
+					t.Errorf("expected all 3 samples of the existing series to be appended, got %d", n)
+				}
+				if n := len(samples[labels.FromStrings("name", "c").String()]); n != 1 {
+					t.Errorf("expected only the sample of the other tenant to be appended for the new series, got %d", n)
+				}
+				if v := promtestutil.ToFloat64(handlers[0].limiter.activeSeries.WithLabelValues("test")); v != 2 {
+					t.Errorf("expected 2 active series, got %v", v)
+				}
+				if v := promtestutil.ToFloat64(handlers[0].limiter.limitHits.WithLabelValues("test")); v != 3 {
+					t.Errorf("expected 3 series limit hits, got %v", v)
+				}
+			}
+
+			// The limit is reloaded with the hashring configuration.
+			setLimit(3)
+			expect(http.StatusOK, write("test", series("a", "c")))
+			expect(http.StatusTooManyRequests, write("test", series("d")))
+			setLimit(0)
+			expect(http.StatusOK, write("test", series("d")))
+		})
+	}
+}
+
+func TestReceiveRequestLimits(t *testing.T) {
+	series := func(n int) *prompb.WriteRequest {
+		wreq := &prompb.WriteRequest{}
+		for i := 0; i < n; i++ {
+			wreq.Timeseries = append(wreq.Timeseries, prompb.TimeSeries{
+				Labels:  []prompb.Label{{Name: "name", Value: strconv.Itoa(i)}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+			})
+		}
+		return wreq
+	}
+	expect := func(exp, got int) {
+		t.Helper()
+		if exp != got {
+			t.Fatalf("expected status %d, got %d", exp, got)
+		}
+	}
+	expectGRPC := func(exp, got codes.Code) {
+		t.Helper()
+		if exp != got {
+			t.Fatalf("expected gRPC code %s, got %s", exp, got)
+		}
+	}
+	write := func(h *Handler, tenant string, wreq *prompb.WriteRequest) int {
+		t.Helper()
+		status, err := makeRequest(h, tenant, wreq)
+		if err != nil {
+			t.Fatalf("unexpectedly failed making HTTP request: %v", err)
+		}
+		return status
+	}
+
+	t.Run("series", func(t *testing.T) {
+		appendable := &fakeAppendable{appender: newFakeAppender(nil, nil, nil, nil)}
+		handlers, _ := newHandlerHashring([]*fakeAppendable{appendable}, 1, "")
+		h := handlers[0]
+		h.options.RequestSeriesLimit = 2
+
+		expect(http.StatusOK, write(h, "test", series(2)))
+		expect(http.StatusRequestEntityTooLarge, write(h, "test", series(3)))
+		expectGRPC(codes.OK, makeGRPCRequest(h, "test", "", series(2)))
+		expectGRPC(codes.InvalidArgument, makeGRPCRequest(h, "test", "", series(3)))
+		if n := len(appendable.appender.(*fakeAppender).samples); n != 2 {
+			t.Errorf("expected only the series of the requests within the limit to be appended, got %d", n)
+		}
+	})
+
+	t.Run("body size", func(t *testing.T) {
+		handlers, _ := newHandlerHashring([]*fakeAppendable{{appender: newFakeAppender(nil, nil, nil, nil)}}, 1, "")
+		h := handlers[0]
+		h.options.RequestBodySizeLimit = uint64(series(2).Size())
+
+		expect(http.StatusOK, write(h, "test", series(2)))
+		expect(http.StatusRequestEntityTooLarge, write(h, "test", series(3)))
+		expectGRPC(codes.InvalidArgument, makeGRPCRequest(h, "test", "", series(3)))
+
+		// Bodies far larger than the limit are rejected without reading them as a whole.
+		raw := make([]byte, 100*int(h.options.RequestBodySizeLimit))
+		rand.Read(raw)
+		req, err := http.NewRequest("POST", h.options.Endpoint, bytes.NewBuffer(snappy.Encode(nil, raw)))
+		if err != nil {
+			t.Fatalf("unexpectedly failed creating HTTP request: %v", err)
+		}
+		rec := httptest.NewRecorder()
+		h.receiveHTTP(rec, req)
+		expect(http.StatusRequestEntityTooLarge, rec.Code)
+	})
+
+	t.Run("hashring override", func(t *testing.T) {
+		handlers, _ := newHandlerHashring([]*fakeAppendable{{appender: newFakeAppender(nil, nil, nil, nil)}}, 1, "")
+		h := handlers[0]
+		h.options.RequestSeriesLimit = 2
+		h.Hashring(newMultiHashring([]HashringConfig{
+			{Hashring: "big", Tenants: []string{"big"}, Endpoints: []string{h.options.Endpoint}, RequestSeriesLimit: 3, RequestBodySizeLimit: 1 << 20},
+			{Hashring: "default", Endpoints: []string{h.options.Endpoint}},
+		}, nil))
+
+		expect(http.StatusOK, write(h, "big", series(3)))
+		expect(http.StatusRequestEntityTooLarge, write(h, "big", series(4)))
+		// Tenants of hashrings without limits use the limits of the options.
+		expect(http.StatusRequestEntityTooLarge, write(h, "other", series(3)))
+	})
+}
+
+func TestReceiveBackpressure(t *testing.T) {
+	wreq := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "name", Value: "a"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+	}}}
+	// write makes an HTTP write request and returns its response.
+	write := func(h *Handler) *httptest.ResponseRecorder {
+		t.Helper()
+		buf, err := proto.Marshal(wreq)
+		if err != nil {
+			t.Fatalf("unexpectedly failed marshaling request: %v", err)
+		}
+		req, err := http.NewRequest("POST", h.options.Endpoint, bytes.NewBuffer(snappy.Encode(nil, buf)))
+		if err != nil {
+			t.Fatalf("unexpectedly failed creating HTTP request: %v", err)
+		}
+		req.Header.Add(h.options.TenantHeader, "test")
+		rec := httptest.NewRecorder()
+		h.receiveHTTP(rec, req)
+		return rec
+	}
+	expectRejected := func(rec *httptest.ResponseRecorder, reason, retryAfter string) {
+		t.Helper()
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+		}
+		if got := rec.Header().Get(backpressureReasonHeader); got != reason {
+			t.Errorf("expected backpressure reason %q, got %q", reason, got)
+		}
+		if got := rec.Header().Get("Retry-After"); got != retryAfter {
+			t.Errorf("expected Retry-After %q, got %q", retryAfter, got)
+		}
+	}
+	expectOK := func(rec *httptest.ResponseRecorder) {
+		t.Helper()
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get(backpressureReasonHeader); got != "" {
+			t.Errorf("expected no backpressure reason, got %q", got)
+		}
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		if b := newBackpressure(nil, 0, 0, time.Second); b != nil {
+			t.Fatalf("expected backpressure to be disabled without limits")
+		}
+	})
+
+	t.Run("inflight requests", func(t *testing.T) {
+		handlers, _ := newHandlerHashring([]*fakeAppendable{{appender: newFakeAppender(nil, nil, nil, nil)}}, 1, "")
+		h := handlers[0]
+		h.options.BackpressureRetryAfter = 1500 * time.Millisecond
+		h.backpressure = newBackpressure(nil, 1, 0, h.options.BackpressureRetryAfter)
+
+		expectOK(write(h))
+
+		// Simulate a write request being appended while the next one arrives.
+		done := h.backpressure.start()
+		expectRejected(write(h), backpressureReasonInflight, "2")
+		// Write requests of other receivers are not rejected.
+		if code := makeGRPCRequest(h, "test", "", wreq); code != codes.OK {
+			t.Errorf("expected gRPC code %s, got %s", codes.OK, code)
+		}
+		done()
+		expectOK(write(h))
+
+		if got := promtestutil.ToFloat64(h.backpressure.rejections.WithLabelValues(backpressureReasonInflight)); got != 1 {
+			t.Errorf("expected 1 rejection, got %v", got)
+		}
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		handlers, _ := newHandlerHashring([]*fakeAppendable{{appender: newFakeAppender(nil, nil, nil, nil)}}, 1, "")
+		h := handlers[0]
+		h.options.BackpressureRetryAfter = 10 * time.Second
+		h.backpressure = newBackpressure(nil, 0, 1000, h.options.BackpressureRetryAfter)
+
+		now := time.Now()
+		heap := uint64(2000)
+		h.backpressure.now = func() time.Time { return now }
+		h.backpressure.readHeap = func() uint64 { return heap }
+
+		expectRejected(write(h), backpressureReasonMemory, "10")
+
+		// The heap size is only read again after the check interval.
+		heap = 500
+		expectRejected(write(h), backpressureReasonMemory, "10")
+		now = now.Add(heapCheckInterval)
+		expectOK(write(h))
+
+		if got := promtestutil.ToFloat64(h.backpressure.rejections.WithLabelValues(backpressureReasonMemory)); got != 2 {
+			t.Errorf("expected 2 rejections, got %v", got)
+		}
+	})
+}
+
+func TestReceiveIdempotencyKey(t *testing.T) {
+	const keyHeader = "Idempotency-Key"
+
+	appendable := &fakeAppendable{appender: newFakeAppender(nil, nil, nil, nil)}
+	handlers, _ := newHandlerHashring([]*fakeAppendable{appendable}, 1, "")
+	h := handlers[0]
+	h.options.IdempotencyKeyHeader = keyHeader
+	h.idempotency = newIdempotencyCache(nil, time.Minute, 10)
+
+	wreq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels:  []prompb.Label{{Name: "foo", Value: "bar"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+			},
+		},
+	}
+	write := func(tenant, key string) {
+		buf, err := proto.Marshal(wreq)
+		if err != nil {
+			t.Fatalf("unexpectedly failed marshaling request: %v", err)
+		}
+		req, err := http.NewRequest("POST", h.options.Endpoint, bytes.NewBuffer(snappy.Encode(nil, buf)))
+		if err != nil {
+			t.Fatalf("unexpectedly failed creating HTTP request: %v", err)
+		}
+		req.Header.Add(h.options.TenantHeader, tenant)
+		if key != "" {
+			req.Header.Add(keyHeader, key)
+		}
+
+		rec := httptest.NewRecorder()
+		h.receiveHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+		}
+	}
+	writeGRPC := func(tenant, key string) {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(h.options.TenantHeader, tenant, keyHeader, key))
+		if _, err := h.RemoteWrite(ctx, &storepb.WriteRequest{Timeseries: wreq.Timeseries, Metadata: wreq.Metadata}); err != nil {
+			t.Fatalf("unexpectedly failed gRPC request: %v", err)
+		}
+	}
+	expectSamples := func(exp int) {
+		t.Helper()
+		if n := len(appendable.appender.(*fakeAppender).samples[labels.FromStrings("foo", "bar").String()]); n != exp {
+			t.Fatalf("expected %d appended samples, got %d", exp, n)
+		}
+	}
+
+	write("test", "1")
+	expectSamples(1)
+	// Retries with the same key are not appended again.
+	write("test", "1")
+	writeGRPC("test", "1")
+	expectSamples(1)
+	// Distinct keys, keys of other tenants and requests without a key are processed normally.
+	write("test", "2")
+	writeGRPC("test", "3")
+	write("other", "1")
+	write("test", "")
+	expectSamples(5)
+
+	if v := promtestutil.ToFloat64(h.idempotency.duplicates.WithLabelValues("test")); v != 2 {
+		t.Errorf("expected 2 duplicate requests, got %v", v)
+	}
+}
+
+func TestReceiveTenantHeartbeat(t *testing.T) {
+	appendable := &fakeAppendable{appender: newFakeAppender(nil, nil, nil, nil)}
+	handlers, _ := newHandlerHashring([]*fakeAppendable{appendable}, 1, "")
+	h := handlers[0]
+	now := time.Unix(1000, 0)
+	h.heartbeat = newTenantHeartbeat(nil, time.Hour)
+	h.heartbeat.now = func() time.Time { return now }
+
+	buf, err := proto.Marshal(&prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels:  []prompb.Label{{Name: "foo", Value: "bar"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpectedly failed marshaling request: %v", err)
+	}
+	write := func(tenant string) {
+		req, err := http.NewRequest("POST", h.options.Endpoint, bytes.NewBuffer(snappy.Encode(nil, buf)))
+		if err != nil {
+			t.Fatalf("unexpectedly failed creating HTTP request: %v", err)
+		}
+		req.Header.Add(h.options.TenantHeader, tenant)
+
+		rec := httptest.NewRecorder()
+		h.receiveHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+		}
+	}
+	expectHeartbeat := func(tenant string, exp float64) {
+		t.Helper()
+		if v := promtestutil.ToFloat64(h.heartbeat.lastWriteTimestamp.WithLabelValues(tenant)); v != exp {
+			t.Errorf("expected last write of tenant %q at %v, got %v", tenant, exp, v)
+		}
+	}
+
+	write("test")
+	expectHeartbeat("test", 1000)
+	now = now.Add(time.Minute)
+	write("test")
+	expectHeartbeat("test", 1060)
+
+	// The heartbeat of a tenant that stopped writing goes stale, while the heartbeats of other tenants are kept.
+	now = now.Add(30 * time.Minute)
+	write("other")
+	now = now.Add(31 * time.Minute)
+	if n := promtestutil.CollectAndCount(h.heartbeat); n != 1 {
+		t.Errorf("expected 1 heartbeat series, got %d", n)
+	}
+	expectHeartbeat("other", 2860)
+}
+
+func TestReceiveMirrorHashring(t *testing.T) {
+	wreq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{Labels: []prompb.Label{{Name: "name", Value: "a"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}},
+			{Labels: []prompb.Label{{Name: "name", Value: "b"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}},
+			{Labels: []prompb.Label{{Name: "name", Value: "c"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}},
+		},
+	}
+	samples := func(appendables []*fakeAppendable) int {
+		var n int
+		for _, a := range appendables {
+			app := a.appender.(*fakeAppender)
+			app.Lock()
+			for _, s := range app.samples {
+				n += len(s)
+			}
+			app.Unlock()
+		}
+		return n
+	}
+
+	for _, tc := range []struct {
+		name              string
+		replicationFactor uint64
+		mirrorRequired    bool
+		mirrorFails       bool
+		status            int
+	}{
+		{name: "mirrored", replicationFactor: 1, status: http.StatusOK},
+		{name: "mirrored with replication", replicationFactor: 2, status: http.StatusOK},
+		{name: "mirror failure ignored", replicationFactor: 1, mirrorFails: true, status: http.StatusOK},
+		{name: "required mirror", replicationFactor: 2, mirrorRequired: true, status: http.StatusOK},
+		{name: "required mirror failure", replicationFactor: 1, mirrorRequired: true, mirrorFails: true, status: http.StatusInternalServerError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mirrorErr func() error
+			if tc.mirrorFails {
+				mirrorErr = func() error { return errors.New("failed to get appender") }
+			}
+			var primary, mirrored []*fakeAppendable
+			for i := 0; i < 3; i++ {
+				primary = append(primary, &fakeAppendable{appender: newFakeAppender(nil, nil, nil, nil)})
+				mirrored = append(mirrored, &fakeAppendable{appender: newFakeAppender(nil, nil, nil, nil), appenderErr: mirrorErr})
+			}
+
+			cfg := []HashringConfig{
+				{Hashring: "primary"},
+				{Hashring: "durable", MirrorTenants: []string{"mirrored"}, MirrorRequired: tc.mirrorRequired},
+			}
+			peers := &peerGroup{
+				cache: map[string]storepb.WriteableStoreClient{},
+				dialer: func(context.Context, string, ...grpc.DialOption) (*grpc.ClientConn, error) {
+					return nil, errors.New("unexpected dial called in testing")
+				},
+			}
+			var handlers []*Handler
+			for i, appendables := range [][]*fakeAppendable{primary, mirrored} {
+				for _, a := range appendables {
+					h := NewHandler(nil, &Options{
+						TenantHeader:      DefaultTenantHeader,
+						ReplicaHeader:     DefaultReplicaHeader,
+						ReplicationFactor: tc.replicationFactor,
+						Writer:            NewWriter(log.NewNopLogger(), nil, a, 0, LabelLimits{}),
+					})
+					h.peers = peers
+					h.options.Endpoint = randomAddr()
+					cfg[i].Endpoints = append(cfg[i].Endpoints, h.options.Endpoint)
+					peers.cache[h.options.Endpoint] = &fakeRemoteWriteGRPCServer{h: h}
+					handlers = append(handlers, h)
+				}
+			}
+			hashring := newMultiHashring(cfg, nil)
+			for _, h := range handlers {
+				h.Hashring(hashring)
+			}
+
+			expectSamples := func(exp int, appendables []*fakeAppendable) {
+				if got := samples(appendables); got != exp {
+					t.Fatalf("expected %d samples to be appended, got %d", exp, got)
+				}
+			}
+			write := func(tenant string, exp int) {
+				status, err := makeRequest(handlers[0], tenant, wreq)
+				if err != nil {
+					t.Fatalf("unexpectedly failed making HTTP request: %v", err)
+				}
+				if status != exp {
+					t.Fatalf("expected status %d, got %d", exp, status)
+				}
+			}
+
+			// Writes of mirrored tenants reach both hashrings.
+			write("mirrored", tc.status)
+			expectSamples(3*int(tc.replicationFactor), primary)
+
+			result := "success"
+			if tc.mirrorFails {
+				result = "error"
+			}
+			// Mirroring is not waited for unless it is required.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := runutil.Retry(10*time.Millisecond, ctx.Done(), func() error {
+				if v := promtestutil.ToFloat64(handlers[0].mirrorRequestsTotal.WithLabelValues("durable", result)); v != 1 {
+					return errors.Errorf("expected 1 mirrored request with result %s, got %v", result, v)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if !tc.mirrorFails {
+				expectSamples(3*int(tc.replicationFactor), mirrored)
+			}
+
+			// Writes of other tenants are not mirrored.
+			write("other", http.StatusOK)
+			expectSamples(6*int(tc.replicationFactor), primary)
+			if !tc.mirrorFails {
+				expectSamples(3*int(tc.replicationFactor), mirrored)
+			}
+		})
+	}
+}
+
+func TestHashringEndpoint(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		nodes             int
+		replicationFactor uint64
+	}{
+		{name: "no replication", nodes: 3, replicationFactor: 1},
+		// With a majority quorum, writes only succeed once both replicas are written.
+		{name: "replicated", nodes: 4, replicationFactor: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			appendables := make([]*fakeAppendable, tc.nodes)
+			for i := range appendables {
+				appendables[i] = &fakeAppendable{appender: newFakeAppender(nil, nil, nil, nil)}
+			}
+			handlers, _ := newHandlerHashring(appendables, tc.replicationFactor, "")
+
+			get := func(query string) (int, hashringResponse) {
+				rec := httptest.NewRecorder()
+				handlers[0].hashringHTTP(rec, httptest.NewRequest("GET", "/api/v1/hashring?"+query, nil))
+
+				var res hashringResponse
+				if rec.Code == http.StatusOK {
+					if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+						t.Fatalf("unexpectedly failed decoding response: %v", err)
+					}
+				}
+				return rec.Code, res
+			}
+
+			code, res := get("")
+			if code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+			}
+			if res.Version != 1 {
+				t.Errorf("expected version 1, got %d", res.Version)
+			}
+			if len(res.Hashrings) != 1 || res.Hashrings[0].Hashring != "test" || len(res.Hashrings[0].Endpoints) != tc.nodes {
+				t.Errorf("unexpected hashrings %v", res.Hashrings)
+			}
+			if len(res.Owners) != 0 {
+				t.Errorf("expected no owners without series, got %v", res.Owners)
+			}
+
+			// The owners of series must be the nodes writes of the series are appended on.
+			for i := 0; i < 10; i++ {
+				tenant := fmt.Sprintf("tenant-%d", i%2)
+				lset := labels.FromStrings("__name__", "up", "instance", strconv.Itoa(i))
+
+				code, res := get(url.Values{"tenant": []string{tenant}, "series": []string{lset.String()}}.Encode())
+				if code != http.StatusOK {
+					t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+				}
+				if uint64(len(res.Owners)) != tc.replicationFactor {
+					t.Fatalf("expected %d owners, got %v", tc.replicationFactor, res.Owners)
+				}
+
+				ts := prompb.TimeSeries{Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}}
+				for _, l := range lset {
+					ts.Labels = append(ts.Labels, prompb.Label{Name: l.Name, Value: l.Value})
+				}
+				wreq := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{ts}}
+				if status, err := makeRequest(handlers[i%tc.nodes], tenant, wreq); err != nil || status != http.StatusOK {
+					t.Fatalf("unexpectedly failed write: status %d, err %v", status, err)
+				}
+
+				owners := map[string]struct{}{}
+				for _, o := range res.Owners {
+					owners[o] = struct{}{}
+				}
+				for j, h := range handlers {
+					_, owner := owners[h.options.Endpoint]
+					appended := len(appendables[j].appender.(*fakeAppender).samples[lset.String()]) > 0
+					if owner != appended {
+						t.Errorf("series %s of tenant %s: node %d is owner %v, but appended %v", lset, tenant, j, owner, appended)
+					}
+				}
+			}
+
+			for _, query := range []string{`series={instance=~"1"}`, "series={"} {
+				if code, _ := get(query); code != http.StatusBadRequest {
+					t.Errorf("query %q: expected status %d, got %d", query, http.StatusBadRequest, code)
+				}
+			}
+
+			// The version changes with every hashring update.
+			handlers[0].Hashring(handlers[0].hashring)
+			if _, res := get(""); res.Version != 2 {
+				t.Errorf("expected version 2, got %d", res.Version)
+			}
+		})
+	}
+}
+
+func TestReceiveGRPC(t *testing.T) {
+	conflictErrFn := func() error { return storage.ErrOutOfBounds }
+	commitErrFn := func() error { return errors.New("failed to commit") }
+	wreq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels:  []prompb.Label{{Name: "foo", Value: "bar"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1}, {Value: 2, Timestamp: 2}},
+			},
+			{
+				Labels:  []prompb.Label{{Name: "foo", Value: "baz"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+			},
+		},
+	}
+	for _, tc := range []struct {
+		name              string
+		code              codes.Code
+		replicationFactor uint64
+		replica           string
+		appendables       []*fakeAppendable
+	}{
+		{
+			name:              "size 1 success",
+			code:              codes.OK,
+			replicationFactor: 1,
+			appendables: []*fakeAppendable{
+				{appender: newFakeAppender(nil, nil, nil, nil)},
+			},
+		},
+		{
+			name:              "size 3 success",
+			code:              codes.OK,
+			replicationFactor: 1,
+			appendables: []*fakeAppendable{
+				{appender: newFakeAppender(nil, nil, nil, nil)},
+				{appender: newFakeAppender(nil, nil, nil, nil)},
+				{appender: newFakeAppender(nil, nil, nil, nil)},
+			},
+		},
+		{
+			name:              "size 3 success with replication",
+			code:              codes.OK,
+			replicationFactor: 3,
+			appendables: []*fakeAppendable{
+				{appender: newFakeAppender(nil, nil, nil, nil)},
+				{appender: newFakeAppender(nil, nil, nil, nil)},
+				{appender: newFakeAppender(nil, nil, nil, nil)},
+			},
+		},
+		{
+			name:              "size 3 commit error",
+			code:              codes.Internal,
+			replicationFactor: 1,
+			appendables: []*fakeAppendable{
+				{appender: newFakeAppender(nil, nil, commitErrFn, nil)},
+				{appender: newFakeAppender(nil, nil, commitErrFn, nil)},
+				{appender: newFakeAppender(nil, nil, commitErrFn, nil)},
+			},
+		},
+		{
+			name:              "size 3 conflict with replication",
+			code:              codes.AlreadyExists,
+			replicationFactor: 3,
+			appendables: []*fakeAppendable{
+				{appender: newFakeAppender(conflictErrFn, nil, nil, nil)},
+				{appender: newFakeAppender(conflictErrFn, nil, nil, nil)},
+				{appender: newFakeAppender(conflictErrFn, nil, nil, nil)},
+			},
+		},
+		{
+			name:              "replica exceeds replication factor",
+			code:              codes.InvalidArgument,
+			replicationFactor: 1,
+			replica:           "2",
+			appendables: []*fakeAppendable{
+				{appender: newFakeAppender(nil, nil, nil, nil)},
+			},
+		},
+		{
+			name:              "invalid replica",
+			code:              codes.InvalidArgument,
+			replicationFactor: 1,
+			replica:           "foo",
+			appendables: []*fakeAppendable{
+				{appender: newFakeAppender(nil, nil, nil, nil)},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handlers, hashring := newHandlerHashring(tc.appendables, tc.replicationFactor, "")
+			tenant := "test"
+			for i, handler := range handlers {
+				if code := makeGRPCRequest(handler, tenant, tc.replica, wreq); code != tc.code {
+					t.Errorf("handler %d: got unexpected gRPC status code: expected %s, got %s", i, tc.code, code)
+				}
+			}
+			if tc.code != codes.OK {
+				return
+			}
+			// Test that each time series is stored on the nodes
+			// selected by the tenant given in the request metadata.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			for _, ts := range wreq.Timeseries {
+				lset := labels.Labels{{Name: ts.Labels[0].Name, Value: ts.Labels[0].Value}}
+				for j, a := range tc.appendables {
+					var expected int
+					if endpointHit(t, hashring, tc.replicationFactor, handlers[j].options.Endpoint, tenant, &ts) {
+						expected = len(handlers) * len(ts.Samples)
+					}
+					if err := runutil.Retry(10*time.Millisecond, ctx.Done(), func() error {
+						app := a.appender.(*fakeAppender)
+						app.Lock()
+						defer app.Unlock()
+						if got := len(app.samples[lset.String()]); expected != got {
+							return errors.Errorf("expected %d samples, got %d", expected, got)
+						}
+						return nil
+					}); err != nil {
+						t.Errorf("handler: %d, labels %q: %v", j, lset.String(), err)
+					}
+				}
+			}
+		})
+	}
+
+	t.Run("not ready", func(t *testing.T) {
+		h := NewHandler(nil, &Options{
+			TenantHeader:      DefaultTenantHeader,
+			ReplicaHeader:     DefaultReplicaHeader,
+			ReplicationFactor: 1,
+		})
+		if code := makeGRPCRequest(h, "test", "", wreq); code != codes.Unavailable {
+			t.Errorf("got unexpected gRPC status code: expected %s, got %s", codes.Unavailable, code)
+		}
+	})
+}
+
+func TestReceiveMetadata(t *testing.T) {
+	wreq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels:  []prompb.Label{{Name: labels.MetricName, Value: "up"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+			},
+		},
+	}
+	for i := 0; i < 10; i++ {
+		wreq.Metadata = append(wreq.Metadata, prompb.MetricMetadata{
+			MetricFamilyName: fmt.Sprintf("metric_%d", i),
+			Type:             prompb.MetricMetadata_COUNTER,
+			Help:             fmt.Sprintf("Help of metric %d.", i),
+		})
+	}
+	for _, tc := range []struct {
+		name              string
+		nodes             int
+		replicationFactor uint64
+	}{
+		{name: "single node", nodes: 1, replicationFactor: 1},
+		{name: "distributed", nodes: 3, replicationFactor: 1},
+		{name: "replicated", nodes: 3, replicationFactor: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			appendables := make([]*fakeAppendable, tc.nodes)
+			for i := range appendables {
+				appendables[i] = &fakeAppendable{appender: newFakeAppender(nil, nil, nil, nil)}
+			}
+			handlers, hashring := newHandlerHashring(appendables, tc.replicationFactor, "")
+
+			status, err := makeRequest(handlers[0], "test", wreq)
+			if err != nil {
+				t.Fatalf("unexpectedly failed making HTTP request: %v", err)
+			}
+			if status != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, status)
+			}
+			// Requests with metadata only are accepted as well.
+			if code := makeGRPCRequest(handlers[0], "test", "", &prompb.WriteRequest{Metadata: wreq.Metadata[:1]}); code != codes.OK {
+				t.Fatalf("expected gRPC code %s, got %s", codes.OK, code)
+			}
+
+			// Every node stores the metadata of the metric families the hashring selects it for.
+			found := map[string]int{}
+			for _, h := range handlers {
+				resp, err := h.Metadata(context.Background(), &storepb.MetadataRequest{})
+				if err != nil {
+					t.Fatalf("unexpectedly failed getting metadata: %v", err)
+				}
+				for _, md := range resp.Metadata {
+					if !endpointHit(t, hashring, tc.replicationFactor, h.options.Endpoint, "test", metadataSeries(&md)) {
+						t.Errorf("metadata of %q unexpectedly stored by node %s", md.MetricFamilyName, h.options.Endpoint)
+					}
+					found[md.MetricFamilyName]++
+				}
+			}
+			for _, md := range wreq.Metadata {
+				if n := found[md.MetricFamilyName]; uint64(n) != tc.replicationFactor {
+					t.Errorf("expected metadata of %q to be stored by %d nodes, got %d", md.MetricFamilyName, tc.replicationFactor, n)
+				}
+			}
+		})
+	}
+}
+
+func TestReceiveRemoteWriteV2(t *testing.T) {
+	wreq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels:  []prompb.Label{{Name: labels.MetricName, Value: "http_requests_total"}, {Name: "code", Value: "200"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1}, {Value: 2, Timestamp: 2}},
+			},
+			{
+				Labels:  []prompb.Label{{Name: labels.MetricName, Value: "http_requests_total"}, {Name: "code", Value: "500"}},
+				Samples: []prompb.Sample{{Value: 3, Timestamp: 1}},
+			},
+			{
+				Labels:  []prompb.Label{{Name: labels.MetricName, Value: "up"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+			},
+		},
+		Metadata: []prompb.MetricMetadata{
+			{MetricFamilyName: "http_requests_total", Type: prompb.MetricMetadata_COUNTER, Help: "Total HTTP requests.", Unit: "requests"},
+		},
+	}
+	// v2req is the remote write 2.0 equivalent of wreq.
+	v2req := &writev2.Request{
+		Symbols: []string{"", labels.MetricName, "http_requests_total", "code", "200", "500", "up", "Total HTTP requests.", "requests", "trace_id", "abc"},
+		Timeseries: []writev2.TimeSeries{
+			{
+				LabelsRefs: []uint32{1, 2, 3, 4},
+				Samples:    []writev2.Sample{{Value: 1, Timestamp: 1}, {Value: 2, Timestamp: 2}},
+				Exemplars:  []writev2.Exemplar{{LabelsRefs: []uint32{9, 10}, Value: 1, Timestamp: 1}},
+				Metadata:   writev2.Metadata{Type: writev2.Metadata_METRIC_TYPE_COUNTER, HelpRef: 7, UnitRef: 8},
+			},
+			{
+				LabelsRefs: []uint32{1, 2, 3, 5},
+				Samples:    []writev2.Sample{{Value: 3, Timestamp: 1}},
+				Metadata:   writev2.Metadata{Type: writev2.Metadata_METRIC_TYPE_COUNTER, HelpRef: 7, UnitRef: 8},
+			},
+			{
+				LabelsRefs: []uint32{1, 6},
+				Samples:    []writev2.Sample{{Value: 1, Timestamp: 1}},
+			},
+		},
+	}
+
+	write := func(h *Handler, contentType string, msg proto.Message) *httptest.ResponseRecorder {
+		buf, err := proto.Marshal(msg)
+		if err != nil {
+			t.Fatalf("unexpectedly failed marshaling request: %v", err)
+		}
+		req, err := http.NewRequest("POST", h.options.Endpoint, bytes.NewBuffer(snappy.Encode(nil, buf)))
+		if err != nil {
+			t.Fatalf("unexpectedly failed creating request: %v", err)
+		}
+		req.Header.Add(h.options.TenantHeader, "test")
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rec := httptest.NewRecorder()
+		h.receiveHTTP(rec, req)
+		return rec
+	}
+	ingested := func(h *Handler, a *fakeAppendable) (map[string][]prompb.Sample, []prompb.MetricMetadata) {
+		resp, err := h.Metadata(context.Background(), &storepb.MetadataRequest{})
+		if err != nil {
+			t.Fatalf("unexpectedly failed getting metadata: %v", err)
+		}
+		app := a.appender.(*fakeAppender)
+		app.Lock()
+		defer app.Unlock()
+		return app.samples, resp.Metadata
+	}
+
+	v1Appendable := &fakeAppendable{appender: newFakeAppender(nil, nil, nil, nil)}
+	v2Appendable := &fakeAppendable{appender: newFakeAppender(nil, nil, nil, nil)}
+	v1Handlers, _ := newHandlerHashring([]*fakeAppendable{v1Appendable}, 1, "")
+	v2Handlers, _ := newHandlerHashring([]*fakeAppendable{v2Appendable}, 1, "")
+
+	// Requests without protobuf content type are remote write 1.0 requests, like before remote write 2.0.
+	for _, contentType := range []string{"", "application/x-protobuf", "application/x-protobuf;proto=prometheus.WriteRequest", "application/octet-stream", "invalid"} {
+		if rec := write(v1Handlers[0], contentType, wreq); rec.Code != http.StatusOK {
+			t.Fatalf("content type %q: expected status %d, got %d: %s", contentType, http.StatusOK, rec.Code, rec.Body.String())
+		}
+	}
+	rec := write(v2Handlers[0], "application/x-protobuf;proto=io.prometheus.write.v2.Request", v2req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	for header, exp := range map[string]string{samplesWrittenHeader: "4", histogramsWrittenHeader: "0", exemplarsWrittenHeader: "0"} {
+		if got := rec.Header().Get(header); got != exp {
+			t.Errorf("expected header %s to be %q, got %q", header, exp, got)
+		}
+	}
+
+	v1Samples, v1Metadata := ingested(v1Handlers[0], v1Appendable)
+	v2Samples, v2Metadata := ingested(v2Handlers[0], v2Appendable)
+	for _, ts := range wreq.Timeseries {
+		lset := storepb.LabelsToPromLabels(storepb.PrompbLabelsToLabels(ts.Labels)).String()
+		// The remote write 1.0 request was sent once per content type.
+		if n := len(v1Samples[lset]); n != 5*len(ts.Samples) {
+			t.Errorf("series %s: expected %d samples written with remote write 1.0, got %d", lset, 5*len(ts.Samples), n)
+		}
+		if got := v2Samples[lset]; fmt.Sprint(got) != fmt.Sprint(ts.Samples) {
+			t.Errorf("series %s: expected samples %v written with remote write 2.0, got %v", lset, ts.Samples, got)
+		}
+	}
+	if fmt.Sprint(v1Metadata) != fmt.Sprint(v2Metadata) || len(v2Metadata) != 1 {
+		t.Errorf("expected remote write 2.0 metadata %v to equal remote write 1.0 metadata %v", v2Metadata, v1Metadata)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		req         *writev2.Request
+		status      int
+	}{
+		{
+			name:        "unknown proto",
+			contentType: "application/x-protobuf;proto=io.prometheus.write.v3.Request",
+			req:         v2req,
+			status:      http.StatusUnsupportedMediaType,
+		},
+		{
+			name: "symbol reference out of range",
+			req: &writev2.Request{
+				Symbols:    []string{"", labels.MetricName},
+				Timeseries: []writev2.TimeSeries{{LabelsRefs: []uint32{1, 2}, Samples: []writev2.Sample{{Value: 1, Timestamp: 1}}}},
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "native histograms",
+			req: &writev2.Request{
+				Symbols:    []string{"", labels.MetricName, "up"},
+				Timeseries: []writev2.TimeSeries{{LabelsRefs: []uint32{1, 2}, Histograms: [][]byte{{1}}}},
+			},
+			status: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			contentType := tc.contentType
+			if contentType == "" {
+				contentType = "application/x-protobuf;proto=io.prometheus.write.v2.Request"
+			}
+			if rec := write(v2Handlers[0], contentType, tc.req); rec.Code != tc.status {
+				t.Errorf("expected status %d, got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
 // endpointHit is a helper to determine if a given endpoint in a hashring would be selected
 // for a given time series, tenant, and replication factor.
 func endpointHit(t *testing.T, h Hashring, rf uint64, endpoint, tenant string, timeSeries *prompb.TimeSeries) bool {
@@ -565,6 +1652,19 @@ func makeRequest(h *Handler, tenant string, wreq *prompb.WriteRequest) (int, err
 	return rec.Code, nil
 }
 
+// makeGRPCRequest is a helper to make a gRPC remote write request against a handler, passing
+// the tenant and replica in the request metadata like a client outside of the hashring would.
+func makeGRPCRequest(h *Handler, tenant, replica string, wreq *prompb.WriteRequest) codes.Code {
+	md := metadata.Pairs(h.options.TenantHeader, tenant)
+	if replica != "" {
+		md.Set(h.options.ReplicaHeader, replica)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+
+	_, err := h.RemoteWrite(ctx, &storepb.WriteRequest{Timeseries: wreq.Timeseries, Metadata: wreq.Metadata})
+	return status.Code(err)
+}
+
 func randomAddr() string {
 	return fmt.Sprintf("http://%d.%d.%d.%d:%d", rand.Intn(256), rand.Intn(256), rand.Intn(256), rand.Intn(256), rand.Intn(35000)+30000)
 }
@@ -574,5 +1674,9 @@ type fakeRemoteWriteGRPCServer struct {
 }
 
 func (f *fakeRemoteWriteGRPCServer) RemoteWrite(ctx context.Context, in *storepb.WriteRequest, opts ...grpc.CallOption) (*storepb.WriteResponse, error) {
+	// The metadata sent by the client is received by the server.
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		ctx = metadata.NewIncomingContext(ctx, md)
+	}
 	return f.h.RemoteWrite(ctx, in)
 }
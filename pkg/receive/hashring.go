@@ -7,7 +7,9 @@ import (
 	"context"
 	"fmt"
 	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/cespare/xxhash"
 	"github.com/pkg/errors"
@@ -16,6 +18,9 @@ import (
 
 const sep = '\xff'
 
+// ketamaSections is the number of sections of the ring of a ketama hashring owned by each endpoint.
+const ketamaSections = 200
+
 // insufficientNodesError is returned when a hashring does not
 // have enough nodes to satisfy a request for a node.
 type insufficientNodesError struct {
@@ -36,6 +41,49 @@ type Hashring interface {
 	Get(tenant string, timeSeries *prompb.TimeSeries) (string, error)
 	// GetN returns the nth node that should handle the given tenant and time series.
 	GetN(tenant string, timeSeries *prompb.TimeSeries, n uint64) (string, error)
+	// WriteQuorum returns the write quorum to use for the given tenant.
+	WriteQuorum(tenant string) WriteQuorum
+	// SeriesLimit returns the maximum number of active series of the given tenant, or zero if there is no limit.
+	SeriesLimit(tenant string) uint64
+	// RequestLimits returns the limits of single write requests of the given tenant.
+	RequestLimits(tenant string) RequestLimits
+}
+
+// RequestLimits are the limits of a single write request. Zero values fall back to the limits
+// given on the command line.
+type RequestLimits struct {
+	// BodySizeBytes is the maximum decompressed size of a write request in bytes.
+	BodySizeBytes uint64
+	// Series is the maximum number of time series of a write request.
+	Series uint64
+}
+
+// HashringView describes the membership of a hashring.
+type HashringView struct {
+	Hashring  string   `json:"hashring,omitempty"`
+	Tenants   []string `json:"tenants,omitempty"`
+	Endpoints []string `json:"endpoints"`
+}
+
+// viewer is implemented by hashrings able to describe their membership.
+type viewer interface {
+	view() []HashringView
+}
+
+// mirror is a hashring the writes of a tenant are mirrored to, in addition to the hashring handling the tenant.
+type mirror struct {
+	name     string
+	hashring Hashring
+	// required makes write requests fail if mirroring them fails.
+	required bool
+}
+
+// mirrorer is implemented by hashrings mirroring the writes of tenants to further hashrings.
+type mirrorer interface {
+	// mirrorsOf returns the hashrings the writes of the given tenant are mirrored to.
+	mirrorsOf(tenant string) []mirror
+	// mirrorHashring returns the hashring with the given name that writes are mirrored to.
+	mirrorHashring(name string) (Hashring, bool)
 }
 
 // hash returns a hash for the given tenant and time series.
@@ -71,6 +119,25 @@ func (s SingleNodeHashring) GetN(_ string, _ *prompb.TimeSeries, n uint64) (stri
 	return string(s), nil
 }
 
+// WriteQuorum implements the Hashring interface.
+func (s SingleNodeHashring) WriteQuorum(_ string) WriteQuorum {
+	return WriteQuorumMajority
+}
+
+// SeriesLimit implements the Hashring interface.
+func (s SingleNodeHashring) SeriesLimit(_ string) uint64 {
+	return 0
+}
+
+// RequestLimits implements the Hashring interface.
+func (s SingleNodeHashring) RequestLimits(_ string) RequestLimits {
+	return RequestLimits{}
+}
+
+func (s SingleNodeHashring) view() []HashringView {
+	return []HashringView{{Endpoints: []string{string(s)}}}
+}
+
 // simpleHashring represents a group of nodes handling write requests.
 type simpleHashring []string
 
@@ -87,13 +154,143 @@ func (s simpleHashring) GetN(tenant string, ts *prompb.TimeSeries, n uint64) (st
 	return s[(hash(tenant, ts)+n)%uint64(len(s))], nil
 }
 
+// WriteQuorum returns the default write quorum.
+func (s simpleHashring) WriteQuorum(_ string) WriteQuorum {
+	return WriteQuorumMajority
+}
+
+// SeriesLimit returns no limit.
+func (s simpleHashring) SeriesLimit(_ string) uint64 {
+	return 0
+}
+
+// RequestLimits returns no limits.
+func (s simpleHashring) RequestLimits(_ string) RequestLimits {
+	return RequestLimits{}
+}
+
+// ketamaHashring represents a group of nodes handling write requests, assigning time series to nodes
+// with consistent hashing: each node owns many sections of a ring of hashes, and time series are handled
+// by the node owning the section their hash falls into.
+type ketamaHashring struct {
+	endpoints []string
+	sections  []ketamaSection
+}
+
+type ketamaSection struct {
+	hash     uint64
+	endpoint int
+}
+
+func newKetamaHashring(endpoints []string) *ketamaHashring {
+	k := &ketamaHashring{
+		endpoints: endpoints,
+		sections:  make([]ketamaSection, 0, len(endpoints)*ketamaSections),
+	}
+	for i, e := range endpoints {
+		for j := 0; j < ketamaSections; j++ {
+			k.sections = append(k.sections, ketamaSection{hash: xxhash.Sum64String(e + ":" + strconv.Itoa(j)), endpoint: i})
+		}
+	}
+	sort.Slice(k.sections, func(i, j int) bool { return k.sections[i].hash < k.sections[j].hash })
+	return k
+}
+
+// Get returns a target to handle the given tenant and time series.
+func (k *ketamaHashring) Get(tenant string, ts *prompb.TimeSeries) (string, error) {
+	return k.GetN(tenant, ts, 0)
+}
+
+// GetN returns the nth target to handle the given tenant and time series, which is the nth distinct
+// node following the hash of the time series on the ring.
+func (k *ketamaHashring) GetN(tenant string, ts *prompb.TimeSeries, n uint64) (string, error) {
+	if n >= uint64(len(k.endpoints)) {
+		return "", &insufficientNodesError{have: uint64(len(k.endpoints)), want: n + 1}
+	}
+	h := hash(tenant, ts)
+	i := sort.Search(len(k.sections), func(i int) bool { return k.sections[i].hash >= h })
+
+	// n is the replication factor at most, so the distinct nodes seen so far fit a small array and are
+	// searched linearly, without allocating for every time series.
+	var buf [8]int
+	seen := buf[:0]
+	for ; ; i++ {
+		s := k.sections[i%len(k.sections)]
+		if containsEndpoint(seen, s.endpoint) {
+			continue
+		}
+		if uint64(len(seen)) == n {
+			return k.endpoints[s.endpoint], nil
+		}
+		seen = append(seen, s.endpoint)
+	}
+}
+
+func containsEndpoint(endpoints []int, e int) bool {
+	for _, s := range endpoints {
+		if s == e {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteQuorum returns the default write quorum.
+func (k *ketamaHashring) WriteQuorum(_ string) WriteQuorum {
+	return WriteQuorumMajority
+}
+
+// SeriesLimit returns no limit.
+func (k *ketamaHashring) SeriesLimit(_ string) uint64 {
+	return 0
+}
+
+// RequestLimits returns no limits.
+func (k *ketamaHashring) RequestLimits(_ string) RequestLimits {
+	return RequestLimits{}
+}
+
+// quorumHashring is a hashring with a configured write quorum and limits.
+type quorumHashring struct {
+	Hashring
+	quorum        WriteQuorum
+	seriesLimit   uint64
+	requestLimits RequestLimits
+}
+
+// WriteQuorum returns the configured write quorum, falling back to
+// the default if none was configured.
+func (q quorumHashring) WriteQuorum(_ string) WriteQuorum {
+	if q.quorum == "" {
+		return WriteQuorumMajority
+	}
+	return q.quorum
+}
+
+// SeriesLimit returns the configured series limit.
+func (q quorumHashring) SeriesLimit(_ string) uint64 {
+	return q.seriesLimit
+}
+
+// RequestLimits returns the configured request limits.
+func (q quorumHashring) RequestLimits(_ string) RequestLimits {
+	return q.requestLimits
+}
+
 // multiHashring represents a set of hashrings.
 // Which hashring to use for a tenant is determined
 // by the tenants field of the hashring configuration.
 type multiHashring struct {
-	cache      map[string]Hashring
+	cache      map[string]int
 	hashrings  []Hashring
 	tenantSets []map[string]struct{}
+	views      []HashringView
+
+	mirrors       []mirror
+	mirrorTenants []map[string]struct{}
+	// transitions are the previous hashrings of the hashrings with the same index, if their algorithm changed
+	// recently. Writes are mirrored to the previous hashring until the transition ends.
+	transitions []*mirror
 
 	// We need a mutex to guard concurrent access
 	// to the cache map, as this is both written to
@@ -108,11 +305,87 @@ func (m *multiHashring) Get(tenant string, ts *prompb.TimeSeries) (string, error
 
 // GetN returns the nth target to handle the given tenant and time series.
 func (m *multiHashring) GetN(tenant string, ts *prompb.TimeSeries, n uint64) (string, error) {
+	h, err := m.hashring(tenant)
+	if err != nil {
+		return "", err
+	}
+	return h.GetN(tenant, ts, n)
+}
+
+// WriteQuorum returns the write quorum of the hashring handling the given tenant.
+func (m *multiHashring) WriteQuorum(tenant string) WriteQuorum {
+	h, err := m.hashring(tenant)
+	if err != nil {
+		return WriteQuorumMajority
+	}
+	return h.WriteQuorum(tenant)
+}
+
+// SeriesLimit returns the series limit of the hashring handling the given tenant.
+func (m *multiHashring) SeriesLimit(tenant string) uint64 {
+	h, err := m.hashring(tenant)
+	if err != nil {
+		return 0
+	}
+	return h.SeriesLimit(tenant)
+}
+
+// RequestLimits returns the request limits of the hashring handling the given tenant.
+func (m *multiHashring) RequestLimits(tenant string) RequestLimits {
+	h, err := m.hashring(tenant)
+	if err != nil {
+		return RequestLimits{}
+	}
+	return h.RequestLimits(tenant)
+}
+
+func (m *multiHashring) view() []HashringView {
+	return m.views
+}
+
+func (m *multiHashring) mirrorsOf(tenant string) []mirror {
+	var res []mirror
+	for i, t := range m.mirrorTenants {
+		if _, ok := t[tenant]; ok {
+			res = append(res, m.mirrors[i])
+		}
+	}
+	if i, err := m.index(tenant); err == nil && m.transitions[i] != nil {
+		res = append(res, *m.transitions[i])
+	}
+	return res
+}
+
+func (m *multiHashring) mirrorHashring(name string) (Hashring, bool) {
+	for _, mr := range m.mirrors {
+		if mr.name == name {
+			return mr.hashring, true
+		}
+	}
+	for _, mr := range m.transitions {
+		if mr != nil && mr.name == name {
+			return mr.hashring, true
+		}
+	}
+	return nil, false
+}
+
+// hashring returns the hashring responsible for the given tenant.
+func (m *multiHashring) hashring(tenant string) (Hashring, error) {
+	i, err := m.index(tenant)
+	if err != nil {
+		return nil, err
+	}
+	return m.hashrings[i], nil
+}
+
+// index returns the index of the hashring responsible for the given tenant.
+func (m *multiHashring) index(tenant string) (int, error) {
 	m.mu.RLock()
-	h, ok := m.cache[tenant]
+	i, ok := m.cache[tenant]
 	m.mu.RUnlock()
 	if ok {
-		return h.GetN(tenant, ts, n)
+		return i, nil
 	}
 	var found bool
 	// If the tenant is not in the cache, then we need to check
@@ -127,25 +400,108 @@ func (m *multiHashring) GetN(tenant string, ts *prompb.TimeSeries, n uint64) (st
 		}
 		if found {
 			m.mu.Lock()
-			m.cache[tenant] = m.hashrings[i]
+			m.cache[tenant] = i
 			m.mu.Unlock()
-			return m.hashrings[i].GetN(tenant, ts, n)
+			return i, nil
 		}
 	}
-	return "", errors.New("no matching hashring to handle tenant")
+	return 0, errors.New("no matching hashring to handle tenant")
+}
+
+// newHashring creates the hashring of a single hashring configuration.
+func newHashring(h HashringConfig) Hashring {
+	var hashring Hashring = simpleHashring(h.Endpoints)
+	if h.Algorithm.orDefault() == AlgorithmKetama {
+		hashring = newKetamaHashring(h.Endpoints)
+	}
+	return quorumHashring{
+		Hashring:    hashring,
+		quorum:      h.WriteQuorum,
+		seriesLimit: h.SeriesLimit,
+		requestLimits: RequestLimits{
+			BodySizeBytes: h.RequestBodySizeLimit,
+			Series:        h.RequestSeriesLimit,
+		},
+	}
+}
+
+// hashringTransition is the transition of a hashring from a previous algorithm to its current algorithm.
+type hashringTransition struct {
+	// previous is the configuration of the hashring before its algorithm changed.
+	previous HashringConfig
+	// until is the end of the transition.
+	until time.Time
+}
+
+// mirror returns the mirror writing to the hashring of the previous configuration during the transition.
+func (t hashringTransition) mirror() *mirror {
+	return &mirror{
+		name:     t.previous.Hashring + "@" + string(t.previous.Algorithm.orDefault()),
+		hashring: newHashring(t.previous),
+	}
+}
+
+// updateTransitions returns the hashring transitions after reloading the hashring configuration from prev
+// to cfg. Hashrings whose algorithm changes start a transition of the given period, unless the period is zero.
+// Changing the algorithm of a hashring in transition again starts a new transition from the algorithm in between.
+// Transitions of hashrings removed from the configuration end.
+// Expired transitions are dropped.
+func updateTransitions(transitions map[string]hashringTransition, prev, cfg []HashringConfig, now time.Time, period time.Duration) map[string]hashringTransition {
+	previous := make(map[string]HashringConfig, len(prev))
+	for _, h := range prev {
+		previous[h.Hashring] = h
+	}
+
+	res := make(map[string]hashringTransition, len(transitions))
+	for _, h := range cfg {
+		if t, ok := transitions[h.Hashring]; ok && t.previous.Algorithm.orDefault() != h.Algorithm.orDefault() {
+			res[h.Hashring] = t
+		}
+		if p, ok := previous[h.Hashring]; ok && period > 0 && p.Algorithm.orDefault() != h.Algorithm.orDefault() {
+			res[h.Hashring] = hashringTransition{previous: p, until: now.Add(period)}
+		}
+	}
+	for name, t := range res {
+		if !now.Before(t.until) {
+			delete(res, name)
+		}
+	}
+	return res
 }
 
 // newMultiHashring creates a multi-tenant hashring for a given slice of
 // groups.
 // Which hashring to use for a tenant is determined
 // by the tenants field of the hashring configuration.
-func newMultiHashring(cfg []HashringConfig) Hashring {
+// Writes to hashrings in transition are mirrored to their previous hashring.
+func newMultiHashring(cfg []HashringConfig, transitions map[string]hashringTransition) Hashring {
 	m := &multiHashring{
-		cache: make(map[string]Hashring),
+		cache: make(map[string]int),
 	}
 
 	for _, h := range cfg {
-		m.hashrings = append(m.hashrings, simpleHashring(h.Endpoints))
+		hashring := newHashring(h)
+		m.views = append(m.views, HashringView{Hashring: h.Hashring, Tenants: h.Tenants, Endpoints: h.Endpoints})
+
+		if len(h.MirrorTenants) != 0 {
+			t := make(map[string]struct{}, len(h.MirrorTenants))
+			for _, tenant := range h.MirrorTenants {
+				t[tenant] = struct{}{}
+			}
+			m.mirrors = append(m.mirrors, mirror{name: h.Hashring, hashring: hashring, required: h.MirrorRequired})
+			m.mirrorTenants = append(m.mirrorTenants, t)
+			// Hashrings only mirroring tenants do not handle any tenant themselves.
+			if len(h.Tenants) == 0 {
+				continue
+			}
+		}
+
+		m.hashrings = append(m.hashrings, hashring)
+		var transition *mirror
+		if t, ok := transitions[h.Hashring]; ok {
+			transition = t.mirror()
+		}
+		m.transitions = append(m.transitions, transition)
 		var t map[string]struct{}
 		if len(h.Tenants) != 0 {
 			t = make(map[string]struct{})
@@ -164,20 +520,57 @@ func newMultiHashring(cfg []HashringConfig) Hashring {
 // Hashrings are returned on the updates channel.
 // Which hashring to use for a tenant is determined
 // by the tenants field of the hashring configuration.
+// When the algorithm of a hashring changes, writes to the hashring are
+// mirrored to the hashring with its previous algorithm for the given transition
+// period, so both own the time series of the hashring during the transition.
+// A new hashring is returned once the transition ends.
 // The updates chan is closed before exiting.
-func HashringFromConfig(ctx context.Context, updates chan<- Hashring, cw *ConfigWatcher) error {
+func HashringFromConfig(ctx context.Context, updates chan<- Hashring, cw *ConfigWatcher, transitionPeriod time.Duration) error {
 	defer close(updates)
 	go cw.Run(ctx)
 
+	var (
+		current     []HashringConfig
+		transitions map[string]hashringTransition
+		timer       = time.NewTimer(0)
+	)
+	// Drain the timer, so it only fires once transitions are in progress.
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+
 	for {
+		prev := current
 		select {
 		case cfg, ok := <-cw.C():
 			if !ok {
 				return errors.New("hashring config watcher stopped unexpectedly")
 			}
-			updates <- newMultiHashring(cfg)
+			current = cfg
+		case <-timer.C:
 		case <-ctx.Done():
 			return ctx.Err()
 		}
+
+		now := time.Now()
+		transitions = updateTransitions(transitions, prev, current, now, transitionPeriod)
+		updates <- newMultiHashring(current, transitions)
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		var next time.Time
+		for _, t := range transitions {
+			if next.IsZero() || t.until.Before(next) {
+				next = t.until
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(next.Sub(now))
+		}
 	}
 }
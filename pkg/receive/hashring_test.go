@@ -4,8 +4,15 @@
 package receive
 
 import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/prometheus/common/model"
 	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
 )
 
@@ -153,7 +160,7 @@ func TestHashringGet(t *testing.T) {
 			},
 		},
 	} {
-		hs := newMultiHashring(tc.cfg)
+		hs := newMultiHashring(tc.cfg, nil)
 		h, err := hs.Get(tc.tenant, ts)
 		if tc.nodes != nil {
 			if err != nil {
@@ -170,3 +177,210 @@ func TestHashringGet(t *testing.T) {
 		}
 	}
 }
+
+func TestHashringWriteQuorum(t *testing.T) {
+	cfg := []HashringConfig{
+		{
+			Endpoints:   []string{"node1", "node2", "node3"},
+			Tenants:     []string{"tenant1"},
+			WriteQuorum: WriteQuorumOne,
+		},
+		{
+			Endpoints:   []string{"node4", "node5", "node6"},
+			Tenants:     []string{"tenant2"},
+			WriteQuorum: WriteQuorumAll,
+		},
+		{
+			Endpoints: []string{"node7", "node8", "node9"},
+		},
+	}
+
+	for _, tc := range []struct {
+		tenant    string
+		quorum    WriteQuorum
+		threshold uint64
+	}{
+		{tenant: "tenant1", quorum: WriteQuorumOne, threshold: 1},
+		{tenant: "tenant2", quorum: WriteQuorumAll, threshold: 3},
+		{tenant: "tenant3", quorum: WriteQuorumMajority, threshold: 2},
+	} {
+		hs := newMultiHashring(cfg, nil)
+		q := hs.WriteQuorum(tc.tenant)
+		if q != tc.quorum {
+			t.Errorf("tenant %q: expected write quorum %q, got %q", tc.tenant, tc.quorum, q)
+		}
+		if n := q.threshold(3); n != tc.threshold {
+			t.Errorf("tenant %q: expected threshold %d, got %d", tc.tenant, tc.threshold, n)
+		}
+	}
+}
+
+func TestKetamaHashringGetN(t *testing.T) {
+	endpoints := []string{"node1", "node2", "node3", "node4"}
+	h := newKetamaHashring(endpoints)
+	// Without node4, only the series node4 handled move to other nodes.
+	smaller := newKetamaHashring(endpoints[:3])
+
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		ts := &prompb.TimeSeries{Labels: []prompb.Label{{Name: "series", Value: strconv.Itoa(i)}}}
+
+		seen := map[string]struct{}{}
+		for n := uint64(0); n < uint64(len(endpoints)); n++ {
+			node, err := h.GetN("tenant", ts, n)
+			if err != nil {
+				t.Fatalf("series %d: unexpected error getting node %d: %v", i, n, err)
+			}
+			if _, ok := seen[node]; ok {
+				t.Errorf("series %d: node %q returned more than once", i, node)
+			}
+			seen[node] = struct{}{}
+		}
+		if _, err := h.GetN("tenant", ts, uint64(len(endpoints))); err == nil {
+			t.Errorf("series %d: expected error getting more nodes than the hashring has", i)
+		}
+
+		before, _ := h.Get("tenant", ts)
+		after, _ := smaller.Get("tenant", ts)
+		if before == after {
+			continue
+		}
+		if before != "node4" {
+			t.Errorf("series %d: moved from %q to %q", i, before, after)
+		}
+		moved++
+	}
+	if moved == 0 || moved > 400 {
+		t.Errorf("expected about a quarter of the series to move, got %d", moved)
+	}
+
+	ts := &prompb.TimeSeries{Labels: []prompb.Label{{Name: "series", Value: "1"}}}
+	// Walking the ring does not allocate beyond hashing the time series.
+	hashAllocs := testing.AllocsPerRun(100, func() { _ = hash("tenant", ts) })
+	if allocs := testing.AllocsPerRun(100, func() { _, _ = h.GetN("tenant", ts, 3) }); allocs > hashAllocs {
+		t.Errorf("expected %v allocations of hashing, got %v", hashAllocs, allocs)
+	}
+}
+
+func TestUpdateTransitions(t *testing.T) {
+	hashmod := []HashringConfig{{Hashring: "a", Endpoints: []string{"node1"}}, {Hashring: "b", Endpoints: []string{"node2"}}}
+	ketama := []HashringConfig{{Hashring: "a", Endpoints: []string{"node1"}, Algorithm: AlgorithmKetama}, {Hashring: "b", Endpoints: []string{"node2"}}}
+	now := time.Now()
+
+	transitions := updateTransitions(nil, hashmod, ketama, now, time.Minute)
+	if len(transitions) != 1 || transitions["a"].until != now.Add(time.Minute) || transitions["a"].previous.Algorithm != "" {
+		t.Fatalf("expected transition of hashring a from hashmod, got %v", transitions)
+	}
+	// Reloads without changes of the algorithm keep the transition until it expires.
+	if res := updateTransitions(transitions, ketama, ketama, now.Add(time.Second), time.Minute); len(res) != 1 {
+		t.Errorf("expected transition to be kept, got %v", res)
+	}
+	if res := updateTransitions(transitions, ketama, ketama, now.Add(time.Minute), time.Minute); len(res) != 0 {
+		t.Errorf("expected expired transition to be dropped, got %v", res)
+	}
+	// Changing the algorithm again starts a new transition from the algorithm in between.
+	if res := updateTransitions(transitions, ketama, hashmod, now.Add(time.Second), time.Minute); len(res) != 1 || res["a"].previous.Algorithm != AlgorithmKetama {
+		t.Errorf("expected transition of hashring a from ketama, got %v", res)
+	}
+	// Transitions of removed hashrings end.
+	if res := updateTransitions(transitions, ketama, ketama[1:], now.Add(time.Second), time.Minute); len(res) != 0 {
+		t.Errorf("expected transition of removed hashring to end, got %v", res)
+	}
+	// Without a transition period hashrings switch algorithms immediately.
+	if res := updateTransitions(nil, hashmod, ketama, now, 0); len(res) != 0 {
+		t.Errorf("expected no transition without transition period, got %v", res)
+	}
+}
+
+func TestHashringFromConfigAlgorithmTransition(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	endpoints := []string{"node1", "node2", "node3"}
+	tmpfile, err := ioutil.TempFile("", "hashring_test.*.json")
+	if err != nil {
+		t.Fatalf("unexpectedly failed creating the temp file: %v", err)
+	}
+	defer os.Remove(tmpfile.Name())
+	if err := tmpfile.Close(); err != nil {
+		t.Fatalf("unexpectedly failed closing the temp file: %v", err)
+	}
+	writeConfig := func(algorithm HashringAlgorithm) {
+		content, err := json.Marshal([]HashringConfig{{Hashring: "hashring", Endpoints: endpoints, Algorithm: algorithm}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(tmpfile.Name(), content, 0666); err != nil {
+			t.Fatalf("unexpectedly failed writing the config: %v", err)
+		}
+	}
+	writeConfig(AlgorithmHashmod)
+
+	cw, err := NewConfigWatcher(nil, nil, tmpfile.Name(), model.Duration(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unexpectedly failed creating config watcher: %v", err)
+	}
+	updates := make(chan Hashring, 1)
+	go func() { _ = HashringFromConfig(ctx, updates, cw, 500*time.Millisecond) }()
+
+	next := func() Hashring {
+		select {
+		case h := <-updates:
+			return h
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for hashring update")
+			return nil
+		}
+	}
+	// routes returns whether all series are routed to the same nodes as by the given hashring.
+	routes := func(h, expected Hashring) bool {
+		for i := 0; i < 100; i++ {
+			ts := &prompb.TimeSeries{Labels: []prompb.Label{{Name: "series", Value: strconv.Itoa(i)}}}
+			for n := uint64(0); n < uint64(len(endpoints)); n++ {
+				got, _ := h.GetN("tenant", ts, n)
+				exp, _ := expected.GetN("tenant", ts, n)
+				if got != exp {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	h := next()
+	if mirrors := h.(mirrorer).mirrorsOf("tenant"); len(mirrors) != 0 {
+		t.Errorf("expected no mirrors before the algorithm changed, got %v", mirrors)
+	}
+	if !routes(h, simpleHashring(endpoints)) {
+		t.Errorf("expected series to be routed with hashmod")
+	}
+
+	// During the transition, writes are routed with the new algorithm and mirrored to the previous one.
+	writeConfig(AlgorithmKetama)
+	h = next()
+	if !routes(h, newKetamaHashring(endpoints)) {
+		t.Errorf("expected series to be routed with ketama during the transition")
+	}
+	mirrors := h.(mirrorer).mirrorsOf("tenant")
+	if len(mirrors) != 1 || mirrors[0].name != "hashring@hashmod" || mirrors[0].required {
+		t.Fatalf("expected optional mirror to the previous hashring during the transition, got %v", mirrors)
+	}
+	if !routes(mirrors[0].hashring, simpleHashring(endpoints)) {
+		t.Errorf("expected series to be mirrored with hashmod during the transition")
+	}
+	if _, ok := h.(mirrorer).mirrorHashring("hashring@hashmod"); !ok {
+		t.Errorf("expected previous hashring to be known by name during the transition")
+	}
+
+	// Once the transition ended, writes are only routed with the new algorithm.
+	h = next()
+	if mirrors := h.(mirrorer).mirrorsOf("tenant"); len(mirrors) != 0 {
+		t.Errorf("expected no mirrors after the transition, got %v", mirrors)
+	}
+	if _, ok := h.(mirrorer).mirrorHashring("hashring@hashmod"); ok {
+		t.Errorf("expected previous hashring to be unknown after the transition")
+	}
+	if !routes(h, newKetamaHashring(endpoints)) {
+		t.Errorf("expected series to be routed with ketama after the transition")
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tenantHeartbeat exposes the time of the last successful write of every tenant, so tenants that stopped sending
+// data entirely can be alerted on. The series of a tenant is removed once the tenant did not write for longer than
+// the stale timeout, after which it goes stale in Prometheus.
+// A nil tenantHeartbeat records nothing.
+type tenantHeartbeat struct {
+	staleTimeout time.Duration
+	now          func() time.Time
+
+	mtx       sync.Mutex
+	lastWrite map[string]time.Time
+
+	lastWriteTimestamp *prometheus.GaugeVec
+}
+
+// newTenantHeartbeat returns a new tenantHeartbeat registered with the given registerer, removing the series of
+// tenants after the given stale timeout. A stale timeout of zero never removes series.
+func newTenantHeartbeat(reg prometheus.Registerer, staleTimeout time.Duration) *tenantHeartbeat {
+	h := &tenantHeartbeat{
+		staleTimeout: staleTimeout,
+		now:          time.Now,
+		lastWrite:    map[string]time.Time{},
+		lastWriteTimestamp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_receive_tenant_last_write_timestamp_seconds",
+			Help: "Unix timestamp of the last successful write of the tenant.",
+		}, []string{"tenant"}),
+	}
+	if reg != nil {
+		reg.MustRegister(h)
+	}
+	return h
+}
+
+// record records a successful write of the tenant.
+func (h *tenantHeartbeat) record(tenant string) {
+	if h == nil {
+		return
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	now := h.now()
+	h.lastWrite[tenant] = now
+	h.lastWriteTimestamp.WithLabelValues(tenant).Set(float64(now.UnixNano()) / 1e9)
+}
+
+// evict removes the series of the tenants that did not write for longer than the stale timeout.
+func (h *tenantHeartbeat) evict() {
+	if h.staleTimeout <= 0 {
+		return
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	now := h.now()
+	for tenant, last := range h.lastWrite {
+		if now.Sub(last) > h.staleTimeout {
+			delete(h.lastWrite, tenant)
+			h.lastWriteTimestamp.DeleteLabelValues(tenant)
+		}
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (h *tenantHeartbeat) Describe(ch chan<- *prometheus.Desc) {
+	h.lastWriteTimestamp.Describe(ch)
+}
+
+// Collect implements prometheus.Collector. Stale tenants are evicted on collection, so their series go stale even
+// if no tenant writes anymore.
+func (h *tenantHeartbeat) Collect(ch chan<- prometheus.Metric) {
+	h.evict()
+	h.lastWriteTimestamp.Collect(ch)
+}
@@ -0,0 +1,53 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"testing"
+	"time"
+
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestTenantHeartbeat(t *testing.T) {
+	now := time.Unix(1000, 0)
+	h := newTenantHeartbeat(nil, time.Hour)
+	h.now = func() time.Time { return now }
+
+	h.record("a")
+	now = now.Add(time.Minute)
+	h.record("b")
+	testutil.Equals(t, 2, promtestutil.CollectAndCount(h))
+	testutil.Equals(t, 1000.0, promtestutil.ToFloat64(h.lastWriteTimestamp.WithLabelValues("a")))
+	testutil.Equals(t, 1060.0, promtestutil.ToFloat64(h.lastWriteTimestamp.WithLabelValues("b")))
+
+	// Heartbeats are updated on every write.
+	now = now.Add(30 * time.Minute)
+	h.record("a")
+	testutil.Equals(t, 2860.0, promtestutil.ToFloat64(h.lastWriteTimestamp.WithLabelValues("a")))
+
+	// Heartbeats of tenants that stopped writing keep their last write time until they are stale.
+	now = now.Add(40 * time.Minute)
+	testutil.Equals(t, 1, promtestutil.CollectAndCount(h))
+	testutil.Equals(t, 2860.0, promtestutil.ToFloat64(h.lastWriteTimestamp.WithLabelValues("a")))
+
+	now = now.Add(time.Hour)
+	testutil.Equals(t, 0, promtestutil.CollectAndCount(h))
+
+	// Tenants writing again are exposed again.
+	h.record("b")
+	testutil.Equals(t, 1, promtestutil.CollectAndCount(h))
+
+	// Without stale timeout, heartbeats never go stale.
+	h = newTenantHeartbeat(nil, 0)
+	h.now = func() time.Time { return now }
+	h.record("a")
+	now = now.Add(365 * 24 * time.Hour)
+	testutil.Equals(t, 1, promtestutil.CollectAndCount(h))
+
+	// A nil heartbeat records nothing.
+	h = nil
+	h.record("a")
+}
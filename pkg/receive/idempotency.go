@@ -0,0 +1,102 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/simplelru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// idempotencyCache remembers the idempotency keys of recent write requests per tenant, so that retries
+// of requests that were already applied are not appended again.
+// Only successful requests are remembered, failed ones are processed again when retried.
+type idempotencyCache struct {
+	ttl  time.Duration
+	size int
+	now  func() time.Time
+
+	mtx     sync.Mutex
+	tenants map[string]*lru.LRU
+
+	duplicates *prometheus.CounterVec
+}
+
+type idempotencyEntry struct {
+	// done is closed once the request finished and err is set.
+	done    chan struct{}
+	err     error
+	expires time.Time
+}
+
+// newIdempotencyCache returns a new idempotencyCache remembering the keys of up to size requests
+// per tenant for the given TTL.
+func newIdempotencyCache(reg prometheus.Registerer, ttl time.Duration, size int) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:     ttl,
+		size:    size,
+		now:     time.Now,
+		tenants: map[string]*lru.LRU{},
+		duplicates: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_receive_duplicate_requests_total",
+			Help: "Total number of write requests not applied because a request with the same idempotency key was applied before.",
+		}, []string{"tenant"}),
+	}
+}
+
+// do runs f for the write request of the tenant with the given idempotency key, unless a request
+// with the same key succeeded within the TTL. In that case nil is returned without running f.
+// Requests with the same key as an in-flight request wait for its result.
+func (c *idempotencyCache) do(ctx context.Context, tenant, key string, f func() error) error {
+	if c == nil || key == "" {
+		return f()
+	}
+
+	c.mtx.Lock()
+	keys, ok := c.tenants[tenant]
+	if !ok {
+		// Size is validated by the flags, so NewLRU does not fail.
+		keys, _ = lru.NewLRU(c.size, nil)
+		c.tenants[tenant] = keys
+	}
+	if v, ok := keys.Get(key); ok {
+		e := v.(*idempotencyEntry)
+		if e.expires.IsZero() || c.now().Before(e.expires) {
+			c.mtx.Unlock()
+
+			select {
+			case <-e.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if e.err == nil {
+				c.duplicates.WithLabelValues(tenant).Inc()
+			}
+			return e.err
+		}
+	}
+	e := &idempotencyEntry{done: make(chan struct{})}
+	keys.Add(key, e)
+	c.mtx.Unlock()
+
+	err := f()
+
+	c.mtx.Lock()
+	e.err = err
+	if err != nil {
+		// Let retries of failed requests through.
+		if v, ok := keys.Peek(key); ok && v.(*idempotencyEntry) == e {
+			keys.Remove(key)
+		}
+	} else {
+		e.expires = c.now().Add(c.ttl)
+	}
+	c.mtx.Unlock()
+	close(e.done)
+	return err
+}
@@ -0,0 +1,105 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	c := newIdempotencyCache(nil, time.Minute, 2)
+	c.now = func() time.Time { return now }
+
+	var runs int
+	write := func(tenant, key string, err error) error {
+		return c.do(ctx, tenant, key, func() error {
+			runs++
+			return err
+		})
+	}
+	expectRuns := func(exp int) {
+		t.Helper()
+		testutil.Equals(t, exp, runs)
+		runs = 0
+	}
+
+	// Retries of successful requests are not run again, while distinct keys are.
+	testutil.Ok(t, write("a", "1", nil))
+	testutil.Ok(t, write("a", "1", nil))
+	testutil.Ok(t, write("a", "2", nil))
+	expectRuns(2)
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(c.duplicates.WithLabelValues("a")))
+
+	// Keys are per tenant.
+	testutil.Ok(t, write("b", "1", nil))
+	expectRuns(1)
+
+	// Requests without a key are always run.
+	testutil.Ok(t, write("a", "", nil))
+	testutil.Ok(t, write("a", "", nil))
+	expectRuns(2)
+
+	// Retries of failed requests are run again.
+	testutil.NotOk(t, write("b", "2", errors.New("failed")))
+	testutil.Ok(t, write("b", "2", nil))
+	testutil.Ok(t, write("b", "2", nil))
+	expectRuns(2)
+
+	// Keys are forgotten after the TTL.
+	now = now.Add(2 * time.Minute)
+	testutil.Ok(t, write("a", "1", nil))
+	expectRuns(1)
+
+	// The number of keys per tenant is bounded, forgetting the least recently used ones.
+	testutil.Ok(t, write("a", "3", nil))
+	testutil.Ok(t, write("a", "4", nil))
+	expectRuns(2)
+	testutil.Ok(t, write("a", "1", nil))
+	expectRuns(1)
+}
+
+func TestIdempotencyCache_InFlight(t *testing.T) {
+	ctx := context.Background()
+	c := newIdempotencyCache(nil, time.Minute, 10)
+
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+		first   = make(chan error)
+	)
+	go func() {
+		first <- c.do(ctx, "a", "1", func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	// A retry of an in-flight request waits for its result.
+	retried := make(chan error)
+	go func() {
+		retried <- c.do(ctx, "a", "1", func() error {
+			t.Error("retry of an in-flight request should not run")
+			return nil
+		})
+	}()
+
+	// A retry of an in-flight request gives up with its context.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	testutil.Equals(t, context.Canceled, c.do(cctx, "a", "1", func() error { return nil }))
+
+	close(release)
+	testutil.Ok(t, <-first)
+	testutil.Ok(t, <-retried)
+}
@@ -0,0 +1,119 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+)
+
+// seriesLimiter limits the number of active series per tenant.
+// A series is active from its first sample on until it did not receive any samples for longer
+// than the idle timeout, after which it is evicted and no longer counts towards the limit of its tenant.
+// Only new series are limited, samples of active series are always admitted.
+// Tenants are locked independently, so that the writes of a tenant never wait for the ones of others.
+type seriesLimiter struct {
+	idleTimeout time.Duration
+	now         func() time.Time
+
+	mtx     sync.RWMutex
+	tenants map[string]*tenantSeries
+
+	activeSeries *prometheus.GaugeVec
+	limitHits    *prometheus.CounterVec
+}
+
+type tenantSeries struct {
+	mtx sync.Mutex
+	// lastSeen holds the time of the last sample of every active series by its hash.
+	lastSeen     map[uint64]time.Time
+	lastEviction time.Time
+}
+
+// newSeriesLimiter returns a new seriesLimiter evicting series after the given idle timeout.
+// An idle timeout of zero never evicts series.
+func newSeriesLimiter(reg prometheus.Registerer, idleTimeout time.Duration) *seriesLimiter {
+	return &seriesLimiter{
+		idleTimeout: idleTimeout,
+		now:         time.Now,
+		tenants:     map[string]*tenantSeries{},
+		activeSeries: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_receive_tenant_active_series",
+			Help: "Number of active series per tenant.",
+		}, []string{"tenant"}),
+		limitHits: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_receive_tenant_series_limit_hits_total",
+			Help: "Total number of new series rejected because their tenant reached its series limit.",
+		}, []string{"tenant"}),
+	}
+}
+
+// filter returns a write request with the time series of the given one that are admitted for the tenant
+// under the given limit of active series, and the number of rejected new series. A limit of zero admits all series,
+// tracking them only if the tenant has active series already, e.g. because it was limited before.
+func (l *seriesLimiter) filter(tenant string, limit uint64, wreq *prompb.WriteRequest) (*prompb.WriteRequest, int) {
+	l.mtx.RLock()
+	t, ok := l.tenants[tenant]
+	l.mtx.RUnlock()
+	if !ok {
+		if limit == 0 {
+			return wreq, 0
+		}
+		l.mtx.Lock()
+		if t, ok = l.tenants[tenant]; !ok {
+			t = &tenantSeries{lastSeen: map[uint64]time.Time{}}
+			l.tenants[tenant] = t
+		}
+		l.mtx.Unlock()
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if limit == 0 && len(t.lastSeen) == 0 {
+		return wreq, 0
+	}
+	now := l.now()
+	// Evicting requires a pass over all series of the tenant, so only do it a few times per idle timeout.
+	if l.idleTimeout > 0 && now.Sub(t.lastEviction) > l.idleTimeout/4 {
+		for h, seen := range t.lastSeen {
+			if now.Sub(seen) > l.idleTimeout {
+				delete(t.lastSeen, h)
+			}
+		}
+		t.lastEviction = now
+	}
+
+	if limit == 0 {
+		for i := range wreq.Timeseries {
+			t.lastSeen[hash(tenant, &wreq.Timeseries[i])] = now
+		}
+		l.activeSeries.WithLabelValues(tenant).Set(float64(len(t.lastSeen)))
+		return wreq, 0
+	}
+
+	var (
+		admitted = &prompb.WriteRequest{Timeseries: make([]prompb.TimeSeries, 0, len(wreq.Timeseries))}
+		rejected int
+	)
+	for i := range wreq.Timeseries {
+		h := hash(tenant, &wreq.Timeseries[i])
+		if _, ok := t.lastSeen[h]; !ok && uint64(len(t.lastSeen)) >= limit {
+			rejected++
+			continue
+		}
+		t.lastSeen[h] = now
+		admitted.Timeseries = append(admitted.Timeseries, wreq.Timeseries[i])
+	}
+
+	l.activeSeries.WithLabelValues(tenant).Set(float64(len(t.lastSeen)))
+	if rejected > 0 {
+		l.limitHits.WithLabelValues(tenant).Add(float64(rejected))
+	}
+	return admitted, rejected
+}
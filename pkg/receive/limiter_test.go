@@ -0,0 +1,92 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestSeriesLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newSeriesLimiter(prometheus.NewRegistry(), time.Hour)
+	l.now = func() time.Time { return now }
+
+	series := func(names ...string) *prompb.WriteRequest {
+		wreq := &prompb.WriteRequest{}
+		for _, name := range names {
+			wreq.Timeseries = append(wreq.Timeseries, prompb.TimeSeries{Labels: []prompb.Label{{Name: "name", Value: name}}})
+		}
+		return wreq
+	}
+	filter := func(tenant string, limit uint64, names ...string) []string {
+		wreq, rejected := l.filter(tenant, limit, series(names...))
+		var admitted []string
+		for _, ts := range wreq.Timeseries {
+			admitted = append(admitted, ts.Labels[0].Value)
+		}
+		testutil.Equals(t, len(names)-len(admitted), rejected)
+		return admitted
+	}
+	active := func(tenant string) float64 { return promtestutil.ToFloat64(l.activeSeries.WithLabelValues(tenant)) }
+	hits := func(tenant string) float64 { return promtestutil.ToFloat64(l.limitHits.WithLabelValues(tenant)) }
+
+	testutil.Equals(t, []string{"a", "b"}, filter("test", 2, "a", "b", "c"))
+	testutil.Equals(t, 2.0, active("test"))
+	testutil.Equals(t, 1.0, hits("test"))
+
+	// Active series are always admitted.
+	testutil.Equals(t, []string{"b", "a"}, filter("test", 2, "d", "b", "a"))
+	testutil.Equals(t, 2.0, hits("test"))
+	// Tenants are limited independently.
+	testutil.Equals(t, []string{"c", "d"}, filter("other", 2, "c", "d"))
+	testutil.Equals(t, 2.0, active("other"))
+	// No limit admits all series, but still tracks them.
+	testutil.Equals(t, []string{"c", "d", "e"}, filter("test", 0, "c", "d", "e"))
+	testutil.Equals(t, 5.0, active("test"))
+
+	// Series are evicted once idle for longer than the timeout.
+	now = now.Add(40 * time.Minute)
+	testutil.Equals(t, []string{"a", "b"}, filter("test", 5, "a", "b"))
+	now = now.Add(40 * time.Minute)
+	testutil.Equals(t, []string{"f"}, filter("test", 3, "f"))
+	testutil.Equals(t, 3.0, active("test"))
+	testutil.Equals(t, 2.0, hits("test"))
+
+	// Tenants that were never limited are not tracked.
+	wreq := series("a", "b")
+	res, rejected := l.filter("unlimited", 0, wreq)
+	testutil.Equals(t, wreq, res)
+	testutil.Equals(t, 0, rejected)
+	_, ok := l.tenants["unlimited"]
+	testutil.Assert(t, !ok, "expected tenant without limit not to be tracked")
+}
+
+func TestSeriesLimiter_Concurrent(t *testing.T) {
+	l := newSeriesLimiter(prometheus.NewRegistry(), time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(tenant string) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				wreq := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{Labels: []prompb.Label{{Name: "name", Value: strconv.Itoa(j)}}}}}
+				l.filter(tenant, 50, wreq)
+			}
+		}(strconv.Itoa(i % 3))
+	}
+	wg.Wait()
+
+	for _, tenant := range []string{"0", "1", "2"} {
+		testutil.Equals(t, 50.0, promtestutil.ToFloat64(l.activeSeries.WithLabelValues(tenant)))
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+)
+
+// metadataStore stores the metric metadata received per tenant.
+// The number of distinct metadata entries, i.e. combinations of metric family name, type, help and unit,
+// is limited per tenant. New entries of a tenant over its limit are dropped.
+type metadataStore struct {
+	limit int
+
+	mtx     sync.RWMutex
+	tenants map[string]map[prompb.MetricMetadata]struct{}
+
+	entries *prometheus.GaugeVec
+	dropped *prometheus.CounterVec
+}
+
+// newMetadataStore returns a new metadataStore storing up to limit entries per tenant.
+// A limit of zero stores all entries.
+func newMetadataStore(reg prometheus.Registerer, limit int) *metadataStore {
+	return &metadataStore{
+		limit:   limit,
+		tenants: map[string]map[prompb.MetricMetadata]struct{}{},
+		entries: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_receive_tenant_metadata_entries",
+			Help: "Number of metric metadata entries stored per tenant.",
+		}, []string{"tenant"}),
+		dropped: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_receive_tenant_metadata_dropped_total",
+			Help: "Total number of new metric metadata entries dropped because their tenant reached its metadata limit.",
+		}, []string{"tenant"}),
+	}
+}
+
+// add stores the given metadata for the tenant and returns the number of dropped new entries.
+func (s *metadataStore) add(tenant string, mds []prompb.MetricMetadata) int {
+	if len(mds) == 0 {
+		return 0
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	t, ok := s.tenants[tenant]
+	if !ok {
+		t = map[prompb.MetricMetadata]struct{}{}
+		s.tenants[tenant] = t
+	}
+	var dropped int
+	for _, md := range mds {
+		if _, ok := t[md]; ok {
+			continue
+		}
+		if s.limit > 0 && len(t) >= s.limit {
+			dropped++
+			continue
+		}
+		t[md] = struct{}{}
+	}
+
+	s.entries.WithLabelValues(tenant).Set(float64(len(t)))
+	if dropped > 0 {
+		s.dropped.WithLabelValues(tenant).Add(float64(dropped))
+	}
+	return dropped
+}
+
+// metadata returns the distinct metadata entries of the given tenant, or of all tenants if it is empty, sorted by
+// metric family name. If metric is not empty, only entries of that metric family are returned.
+// If limit is positive, entries of at most limit metric families are returned.
+func (s *metadataStore) metadata(tenant, metric string, limit int) []prompb.MetricMetadata {
+	s.mtx.RLock()
+	set := map[prompb.MetricMetadata]struct{}{}
+	for name, t := range s.tenants {
+		if tenant != "" && name != tenant {
+			continue
+		}
+		for md := range t {
+			if metric != "" && md.MetricFamilyName != metric {
+				continue
+			}
+			set[md] = struct{}{}
+		}
+	}
+	s.mtx.RUnlock()
+
+	res := make([]prompb.MetricMetadata, 0, len(set))
+	for md := range set {
+		res = append(res, md)
+	}
+	sortMetadata(res)
+
+	if limit <= 0 {
+		return res
+	}
+	families := 0
+	for i := range res {
+		if i == 0 || res[i].MetricFamilyName != res[i-1].MetricFamilyName {
+			families++
+		}
+		if families > limit {
+			return res[:i]
+		}
+	}
+	return res
+}
+
+// sortMetadata sorts metadata entries by metric family name, type, help and unit.
+func sortMetadata(mds []prompb.MetricMetadata) {
+	sort.Slice(mds, func(i, j int) bool {
+		a, b := mds[i], mds[j]
+		if a.MetricFamilyName != b.MetricFamilyName {
+			return a.MetricFamilyName < b.MetricFamilyName
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Help != b.Help {
+			return a.Help < b.Help
+		}
+		return a.Unit < b.Unit
+	})
+}
+
+// metadataSeries returns the series the metadata of a metric family is distributed by in the hashring.
+// Routing metadata like a series with only the metric name keeps all metadata of a metric family on the same nodes.
+func metadataSeries(md *prompb.MetricMetadata) *prompb.TimeSeries {
+	return &prompb.TimeSeries{Labels: []prompb.Label{{Name: labels.MetricName, Value: md.MetricFamilyName}}}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestMetadataStore(t *testing.T) {
+	s := newMetadataStore(prometheus.NewRegistry(), 3)
+
+	md := func(name string, typ prompb.MetricMetadata_MetricType, help string) prompb.MetricMetadata {
+		return prompb.MetricMetadata{MetricFamilyName: name, Type: typ, Help: help}
+	}
+	entries := func(tenant string) float64 { return promtestutil.ToFloat64(s.entries.WithLabelValues(tenant)) }
+	dropped := func(tenant string) float64 { return promtestutil.ToFloat64(s.dropped.WithLabelValues(tenant)) }
+
+	var (
+		up       = md("up", prompb.MetricMetadata_GAUGE, "Up.")
+		reqs     = md("http_requests_total", prompb.MetricMetadata_COUNTER, "Requests.")
+		reqsHelp = md("http_requests_total", prompb.MetricMetadata_COUNTER, "HTTP requests.")
+		latency  = md("http_request_duration_seconds", prompb.MetricMetadata_HISTOGRAM, "Latency.")
+		mem      = md("process_resident_memory_bytes", prompb.MetricMetadata_GAUGE, "Memory.")
+	)
+
+	testutil.Equals(t, 0, s.add("test", []prompb.MetricMetadata{up, reqs, up}))
+	testutil.Equals(t, 2.0, entries("test"))
+
+	// Entries differing in help are distinct, new entries over the limit are dropped.
+	testutil.Equals(t, 1, s.add("test", []prompb.MetricMetadata{reqsHelp, latency}))
+	testutil.Equals(t, 3.0, entries("test"))
+	testutil.Equals(t, 1.0, dropped("test"))
+	// Existing entries are always stored.
+	testutil.Equals(t, 0, s.add("test", []prompb.MetricMetadata{up, reqs}))
+	// Tenants are limited independently.
+	testutil.Equals(t, 0, s.add("other", []prompb.MetricMetadata{up, latency, mem}))
+	testutil.Equals(t, 3.0, entries("other"))
+
+	// Entries are merged across tenants.
+	testutil.Equals(t, []prompb.MetricMetadata{latency, reqsHelp, reqs, mem, up}, s.metadata("", "", 0))
+	testutil.Equals(t, []prompb.MetricMetadata{reqsHelp, reqs}, s.metadata("", "http_requests_total", 0))
+	testutil.Equals(t, []prompb.MetricMetadata{}, s.metadata("", "unknown", 0))
+	// Entries are restricted to the requested tenant.
+	testutil.Equals(t, []prompb.MetricMetadata{latency, mem, up}, s.metadata("other", "", 0))
+	testutil.Equals(t, []prompb.MetricMetadata{}, s.metadata("unknown", "", 0))
+	// The limit applies to metric families, not to entries.
+	testutil.Equals(t, []prompb.MetricMetadata{latency, reqsHelp, reqs}, s.metadata("", "", 2))
+
+	// No limit stores all entries.
+	s = newMetadataStore(prometheus.NewRegistry(), 0)
+	testutil.Equals(t, 0, s.add("test", []prompb.MetricMetadata{up, reqs, reqsHelp, latency, mem}))
+	testutil.Equals(t, 5, len(s.metadata("", "", 0)))
+}
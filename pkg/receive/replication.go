@@ -0,0 +1,125 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+)
+
+// replicationLagStaleTimeout is the duration after which a tenant that stopped writing is forgotten.
+const replicationLagStaleTimeout = 15 * time.Minute
+
+// replicationLagTracker tracks per tenant the lag between the newest sample received for replication and the newest
+// sample acknowledged by all of its replicas, so that replication falling behind, e.g. because of a slow replica,
+// can be alerted on. The series of a tenant is removed once the tenant did not write for longer than
+// replicationLagStaleTimeout.
+type replicationLagTracker struct {
+	now func() time.Time
+
+	mtx     sync.Mutex
+	tenants map[string]*tenantReplication
+
+	lag *prometheus.GaugeVec
+}
+
+type tenantReplication struct {
+	// Newest sample timestamps in milliseconds.
+	received, replicated int64
+	// lastWrite is the time the last write request of the tenant was received.
+	lastWrite time.Time
+}
+
+func newReplicationLagTracker(reg prometheus.Registerer) *replicationLagTracker {
+	t := &replicationLagTracker{
+		now:     time.Now,
+		tenants: map[string]*tenantReplication{},
+		lag: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_receive_replication_lag_seconds",
+			Help: "Difference between the timestamps of the newest sample received for replication and the newest sample replicated to all replicas, per tenant.",
+		}, []string{"tenant"}),
+	}
+	if reg != nil {
+		reg.MustRegister(t)
+	}
+	return t
+}
+
+// received records that a write request of the tenant with the given newest sample timestamp is being replicated.
+func (t *replicationLagTracker) received(tenant string, ts int64) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	r, ok := t.tenants[tenant]
+	if !ok {
+		// Until a first request is replicated, the lag starts growing with newer samples only.
+		r = &tenantReplication{received: ts, replicated: ts}
+		t.tenants[tenant] = r
+	}
+	r.lastWrite = t.now()
+	if ts > r.received {
+		r.received = ts
+	}
+	t.lag.WithLabelValues(tenant).Set(float64(r.received-r.replicated) / 1000)
+}
+
+// replicated records that a write request of the tenant with the given newest sample timestamp was acknowledged by
+// all of its replicas.
+func (t *replicationLagTracker) replicated(tenant string, ts int64) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	r, ok := t.tenants[tenant]
+	if !ok || ts <= r.replicated {
+		return
+	}
+	r.replicated = ts
+	t.lag.WithLabelValues(tenant).Set(float64(r.received-r.replicated) / 1000)
+}
+
+// evict removes the tenants that did not write for longer than replicationLagStaleTimeout.
+func (t *replicationLagTracker) evict() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	now := t.now()
+	for tenant, r := range t.tenants {
+		if now.Sub(r.lastWrite) > replicationLagStaleTimeout {
+			delete(t.tenants, tenant)
+			t.lag.DeleteLabelValues(tenant)
+		}
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (t *replicationLagTracker) Describe(ch chan<- *prometheus.Desc) {
+	t.lag.Describe(ch)
+}
+
+// Collect implements prometheus.Collector. Stale tenants are evicted on collection, so their series go stale even
+// if no tenant writes anymore.
+func (t *replicationLagTracker) Collect(ch chan<- prometheus.Metric) {
+	t.evict()
+	t.lag.Collect(ch)
+}
+
+// newestSampleTimestamp returns the timestamp of the newest sample of the write request. It returns false if the
+// request holds no samples.
+func newestSampleTimestamp(wreq *prompb.WriteRequest) (int64, bool) {
+	var (
+		newest int64
+		ok     bool
+	)
+	for _, ts := range wreq.Timeseries {
+		for _, s := range ts.Samples {
+			if !ok || s.Timestamp > newest {
+				newest, ok = s.Timestamp, true
+			}
+		}
+	}
+	return newest, ok
+}
@@ -0,0 +1,129 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/thanos/pkg/runutil"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestReplicationLag(t *testing.T) {
+	// The commits of the last replica block while it is slow.
+	var (
+		mtx     sync.Mutex
+		release chan struct{}
+	)
+	slowCommit := func() error {
+		mtx.Lock()
+		c := release
+		mtx.Unlock()
+		if c != nil {
+			<-c
+		}
+		return nil
+	}
+	appendables := []*fakeAppendable{
+		{appender: newFakeAppender(nil, nil, nil, nil)},
+		{appender: newFakeAppender(nil, nil, nil, nil)},
+		{appender: newFakeAppender(nil, nil, slowCommit, nil)},
+	}
+	handlers, _ := newHandlerHashring(appendables, 3, "")
+	h := handlers[0]
+
+	write := func(ts int64) {
+		t.Helper()
+		wreq := &prompb.WriteRequest{
+			Timeseries: []prompb.TimeSeries{
+				{
+					Labels:  []prompb.Label{{Name: "foo", Value: "bar"}},
+					Samples: []prompb.Sample{{Value: 1, Timestamp: ts - 1000}, {Value: 2, Timestamp: ts}},
+				},
+			},
+		}
+		status, err := makeRequest(h, "test", wreq)
+		testutil.Ok(t, err)
+		testutil.Equals(t, http.StatusOK, status)
+	}
+	lag := func() float64 { return promtestutil.ToFloat64(h.replicationLag.lag.WithLabelValues("test")) }
+	waitForLag := func(expected float64) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		testutil.Ok(t, runutil.Retry(10*time.Millisecond, ctx.Done(), func() error {
+			if l := lag(); l != expected {
+				return errors.Errorf("expected lag %v, got %v", expected, l)
+			}
+			return nil
+		}))
+	}
+
+	write(10000)
+	waitForLag(0)
+
+	// The write quorum is still met with a slow replica, but replication falls behind.
+	mtx.Lock()
+	release = make(chan struct{})
+	mtx.Unlock()
+	write(14000)
+	testutil.Equals(t, 4.0, lag())
+	write(20000)
+	testutil.Equals(t, 10.0, lag())
+
+	// Once the replica caught up, the lag recovers.
+	mtx.Lock()
+	close(release)
+	release = nil
+	mtx.Unlock()
+	waitForLag(0)
+
+	// Other tenants are tracked separately.
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(h.replicationLag.lag.WithLabelValues("other")))
+}
+
+func TestReplicationLag_StaleTenants(t *testing.T) {
+	tr := newReplicationLagTracker(prometheus.NewRegistry())
+	now := time.Unix(0, 0)
+	tr.now = func() time.Time { return now }
+
+	tr.received("a", 10000)
+	tr.received("b", 10000)
+	tr.replicated("b", 10000)
+	testutil.Equals(t, 2, promtestutil.CollectAndCount(tr))
+
+	// Tenants that stopped writing are removed, with their series.
+	now = now.Add(replicationLagStaleTimeout / 2)
+	tr.received("a", 20000)
+	now = now.Add(replicationLagStaleTimeout)
+	testutil.Equals(t, 1, promtestutil.CollectAndCount(tr))
+	testutil.Equals(t, 1, len(tr.tenants))
+	testutil.Equals(t, 10.0, promtestutil.ToFloat64(tr.lag.WithLabelValues("a")))
+
+	// Replications of removed tenants are ignored.
+	tr.replicated("b", 20000)
+	testutil.Equals(t, 1, len(tr.tenants))
+}
+
+func TestNewestSampleTimestamp(t *testing.T) {
+	_, ok := newestSampleTimestamp(&prompb.WriteRequest{Metadata: []prompb.MetricMetadata{{MetricFamilyName: "foo"}}})
+	testutil.Assert(t, !ok, "expected no samples")
+
+	ts, ok := newestSampleTimestamp(&prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{Samples: []prompb.Sample{{Timestamp: 3}, {Timestamp: 5}}},
+			{Samples: []prompb.Sample{{Timestamp: 4}}},
+		},
+	})
+	testutil.Assert(t, ok, "expected samples")
+	testutil.Equals(t, int64(5), ts)
+}
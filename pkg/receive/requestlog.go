@@ -0,0 +1,88 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+)
+
+// Outcomes of logged write requests.
+const (
+	requestOutcomeSuccess = "success"
+	// requestOutcomePartial is the outcome of requests of which some samples or series were rejected, while the rest
+	// was appended.
+	requestOutcomePartial  = "partial"
+	requestOutcomeRejected = "rejected"
+	requestOutcomeFailed   = "failed"
+)
+
+// requestLogger logs a sample of the processed write requests with their tenant, size, duration and outcome.
+type requestLogger struct {
+	logger      log.Logger
+	sampleRatio float64
+	random      func() float64
+}
+
+// newRequestLogger returns a new requestLogger logging the given ratio of write requests, between 0 and 1.
+// It returns nil, logging no requests, if the ratio is not positive.
+func newRequestLogger(logger log.Logger, sampleRatio float64) *requestLogger {
+	if sampleRatio <= 0 {
+		return nil
+	}
+	return &requestLogger{
+		logger:      logger,
+		sampleRatio: sampleRatio,
+		random:      rand.Float64,
+	}
+}
+
+// log logs the given write request of the tenant if it is sampled. The size is the decompressed size of the request
+// in bytes, err the result of appending it.
+func (l *requestLogger) log(tenant string, rep uint64, wreq *prompb.WriteRequest, size int, duration time.Duration, err error) {
+	if l == nil || (l.sampleRatio < 1 && l.random() >= l.sampleRatio) {
+		return
+	}
+
+	samples := 0
+	for _, ts := range wreq.Timeseries {
+		samples += len(ts.Samples)
+	}
+	keyvals := []interface{}{
+		"msg", "write request",
+		"tenant", tenant,
+		"replica", rep,
+		"series", len(wreq.Timeseries),
+		"samples", samples,
+		"metadata", len(wreq.Metadata),
+		"size_bytes", size,
+		"duration", duration,
+		"outcome", requestOutcome(err),
+	}
+	if err != nil {
+		keyvals = append(keyvals, "reason", err)
+	}
+	level.Info(l.logger).Log(keyvals...)
+}
+
+// requestOutcome returns the outcome of a write request that was processed with the given error.
+func requestOutcome(err error) string {
+	switch errors.Cause(err) {
+	case nil:
+		return requestOutcomeSuccess
+	case conflictErr, errSeriesLimit:
+		// The writer appends all valid samples of conflicting requests, and the limiter only drops new series.
+		return requestOutcomePartial
+	case errBadReplica:
+		return requestOutcomeRejected
+	default:
+		return requestOutcomeFailed
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gogo/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestRequestLogger(t *testing.T) {
+	appendable := &fakeAppendable{appender: newFakeAppender(nil, nil, nil, nil)}
+	handlers, _ := newHandlerHashring([]*fakeAppendable{appendable}, 1, "")
+	h := handlers[0]
+
+	var logged []map[string]string
+	h.requestLog = newRequestLogger(log.LoggerFunc(func(keyvals ...interface{}) error {
+		m := map[string]string{}
+		for i := 0; i < len(keyvals); i += 2 {
+			m[fmt.Sprint(keyvals[i])] = fmt.Sprint(keyvals[i+1])
+		}
+		logged = append(logged, m)
+		return nil
+	}), 1)
+
+	wreq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels:  []prompb.Label{{Name: "foo", Value: "bar"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1}, {Value: 2, Timestamp: 2}},
+			},
+			{
+				Labels:  []prompb.Label{{Name: "foo", Value: "baz"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+			},
+		},
+		Metadata: []prompb.MetricMetadata{{MetricFamilyName: "foo", Type: prompb.MetricMetadata_GAUGE}},
+	}
+	size := fmt.Sprint(proto.Size(wreq))
+
+	expectLogged := func(outcome string, extra map[string]string) {
+		t.Helper()
+		testutil.Equals(t, 1, len(logged))
+		l := logged[0]
+		logged = nil
+
+		_, err := time.ParseDuration(l["duration"])
+		testutil.Ok(t, err)
+		delete(l, "duration")
+		expected := map[string]string{
+			"level":      "info",
+			"msg":        "write request",
+			"tenant":     "test",
+			"series":     "2",
+			"samples":    "3",
+			"metadata":   "1",
+			"size_bytes": size,
+			"outcome":    outcome,
+		}
+		for k, v := range extra {
+			expected[k] = v
+		}
+		testutil.Equals(t, expected, l)
+	}
+
+	status, err := makeRequest(h, "test", wreq)
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusOK, status)
+	expectLogged(requestOutcomeSuccess, map[string]string{"replica": "0"})
+
+	makeGRPCRequest(h, "test", "", wreq)
+	expectLogged(requestOutcomeSuccess, map[string]string{"replica": "0"})
+
+	makeGRPCRequest(h, "test", "5", wreq)
+	expectLogged(requestOutcomeRejected, map[string]string{"replica": "5", "reason": errBadReplica.Error()})
+
+	// Only sampled requests are logged.
+	h.requestLog.sampleRatio = 0.5
+	h.requestLog.random = func() float64 { return 0.7 }
+	makeGRPCRequest(h, "test", "", wreq)
+	testutil.Equals(t, 0, len(logged))
+	h.requestLog.random = func() float64 { return 0.2 }
+	makeGRPCRequest(h, "test", "", wreq)
+	testutil.Equals(t, 1, len(logged))
+}
+
+func TestRequestOutcome(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected string
+	}{
+		{err: nil, expected: requestOutcomeSuccess},
+		{err: conflictErr, expected: requestOutcomePartial},
+		{err: errors.Wrap(errSeriesLimit, "did not meet replication threshold"), expected: requestOutcomePartial},
+		{err: errBadReplica, expected: requestOutcomeRejected},
+		{err: errors.New("hashring is not ready"), expected: requestOutcomeFailed},
+	} {
+		testutil.Equals(t, tc.expected, requestOutcome(tc.err))
+	}
+}
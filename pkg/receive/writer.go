@@ -4,12 +4,17 @@
 package receive
 
 import (
+	"math"
 	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/prometheus/storage"
 	terrors "github.com/prometheus/prometheus/tsdb/errors"
 
@@ -21,16 +26,75 @@ type Appendable interface {
 	Appender() (storage.Appender, error)
 }
 
+// LabelLimits are the limits of the labels of a series, like the label limits of Prometheus scrapes.
+// Zero disables a limit.
+type LabelLimits struct {
+	// LabelsPerSeries is the maximum number of labels of a series.
+	LabelsPerSeries int
+	// LabelNameLength is the maximum length of a label name.
+	LabelNameLength int
+	// LabelValueLength is the maximum length of a label value.
+	LabelValueLength int
+	// LabelSetSize is the maximum total length of all label names and values of a series.
+	LabelSetSize int
+}
+
+// exceeded returns the limit exceeded by the given labels, or an empty string if none is.
+func (l LabelLimits) exceeded(lset []prompb.Label) string {
+	if l.LabelsPerSeries > 0 && len(lset) > l.LabelsPerSeries {
+		return "labels_per_series"
+	}
+	size := 0
+	for _, lbl := range lset {
+		if l.LabelNameLength > 0 && len(lbl.Name) > l.LabelNameLength {
+			return "label_name_length"
+		}
+		if l.LabelValueLength > 0 && len(lbl.Value) > l.LabelValueLength {
+			return "label_value_length"
+		}
+		size += len(lbl.Name) + len(lbl.Value)
+	}
+	if l.LabelSetSize > 0 && size > l.LabelSetSize {
+		return "label_set_size"
+	}
+	return ""
+}
+
 type Writer struct {
-	logger log.Logger
-	append Appendable
+	logger         log.Logger
+	append         Appendable
+	tooFarInFuture time.Duration
+	labelLimits    LabelLimits
+	now            func() time.Time
+
+	samplesTooFarInFuture prometheus.Counter
+	seriesLabelLimits     *prometheus.CounterVec
 }
 
-func NewWriter(logger log.Logger, app Appendable) *Writer {
-	return &Writer{
-		logger: logger,
-		append: app,
+// NewWriter returns a new Writer appending to the given appendable. Samples with timestamps later than
+// tooFarInFuture after the current time are rejected, while the other samples of the request are still appended.
+// A tooFarInFuture of 0 disables the check. Likewise, series whose labels exceed the given label limits are
+// rejected, while the other series of the request are still appended.
+func NewWriter(logger log.Logger, reg prometheus.Registerer, app Appendable, tooFarInFuture time.Duration, labelLimits LabelLimits) *Writer {
+	w := &Writer{
+		logger:         logger,
+		append:         app,
+		tooFarInFuture: tooFarInFuture,
+		labelLimits:    labelLimits,
+		now:            time.Now,
+		samplesTooFarInFuture: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_receive_samples_too_far_in_future_total",
+			Help: "Total number of samples rejected because their timestamp was too far in the future.",
+		}),
+		seriesLabelLimits: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_receive_series_label_limit_rejections_total",
+			Help: "Total number of series rejected because their labels exceeded a label limit, by limit.",
+		}, []string{"reason"}),
 	}
+	for _, reason := range []string{"labels_per_series", "label_name_length", "label_value_length", "label_set_size"} {
+		w.seriesLabelLimits.WithLabelValues(reason)
+	}
+	return w
 }
 
 func (r *Writer) Write(wreq *prompb.WriteRequest) error {
@@ -38,7 +102,13 @@ func (r *Writer) Write(wreq *prompb.WriteRequest) error {
 		numOutOfOrder  = 0
 		numDuplicates  = 0
 		numOutOfBounds = 0
+		numFuture      = 0
+		numLabelLimits = 0
+		maxTimestamp   = int64(math.MaxInt64)
 	)
+	if r.tooFarInFuture > 0 {
+		maxTimestamp = timestamp.FromTime(r.now().Add(r.tooFarInFuture))
+	}
 
 	app, err := r.append.Appender()
 	if err != nil {
@@ -47,6 +117,13 @@ func (r *Writer) Write(wreq *prompb.WriteRequest) error {
 
 	var errs terrors.MultiError
 	for _, t := range wreq.Timeseries {
+		if reason := r.labelLimits.exceeded(t.Labels); reason != "" {
+			numLabelLimits++
+			r.seriesLabelLimits.WithLabelValues(reason).Inc()
+			level.Debug(r.logger).Log("msg", "Series exceeding label limit", "limit", reason, "num_labels", len(t.Labels))
+			continue
+		}
+
 		lset := make(labels.Labels, len(t.Labels))
 		for j := range t.Labels {
 			lset[j] = labels.Label{
@@ -57,6 +134,11 @@ func (r *Writer) Write(wreq *prompb.WriteRequest) error {
 
 		// Append as many valid samples as possible, but keep track of the errors.
 		for _, s := range t.Samples {
+			if s.Timestamp > maxTimestamp {
+				numFuture++
+				level.Debug(r.logger).Log("msg", "Sample too far in the future", "lset", lset.String(), "sample", s.String())
+				continue
+			}
 			_, err = app.Add(lset, s.Timestamp, s.Value)
 			switch err {
 			case nil:
@@ -86,6 +168,17 @@ func (r *Writer) Write(wreq *prompb.WriteRequest) error {
 		level.Warn(r.logger).Log("msg", "Error on ingesting samples that are too old or are too far into the future", "num_dropped", numOutOfBounds)
 		errs.Add(errors.Wrapf(storage.ErrOutOfBounds, "failed to non-fast add %d samples", numOutOfBounds))
 	}
+	if numFuture > 0 {
+		r.samplesTooFarInFuture.Add(float64(numFuture))
+		level.Warn(r.logger).Log("msg", "Error on ingesting samples too far in the future", "num_dropped", numFuture, "max_time", maxTimestamp)
+		errs.Add(errors.Wrapf(storage.ErrOutOfBounds, "failed to add %d samples too far in the future", numFuture))
+	}
+
+	if numLabelLimits > 0 {
+		level.Warn(r.logger).Log("msg", "Error on ingesting series exceeding label limits", "num_dropped", numLabelLimits)
+		// They are reported as a conflict, so the request fails without being retried.
+		errs.Add(errors.Wrapf(conflictErr, "failed to add %d series exceeding label limits", numLabelLimits))
+	}
 
 	if err := app.Commit(); err != nil {
 		errs.Add(errors.Wrap(err, "commit samples"))
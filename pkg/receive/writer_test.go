@@ -0,0 +1,122 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestWriter_TooFarInFuture(t *testing.T) {
+	now := time.Unix(1000, 0)
+	nowMillis := timestamp.FromTime(now)
+
+	wreq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels: []prompb.Label{{Name: "a", Value: "1"}},
+				Samples: []prompb.Sample{
+					{Timestamp: nowMillis - 1000, Value: 1},
+					{Timestamp: nowMillis + 60*1000, Value: 2},
+					{Timestamp: nowMillis + 61*1000, Value: 3},
+				},
+			},
+			{
+				Labels:  []prompb.Label{{Name: "a", Value: "2"}},
+				Samples: []prompb.Sample{{Timestamp: nowMillis + 3600*1000, Value: 4}},
+			},
+		},
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		app := newFakeAppender(nil, nil, nil, nil)
+		w := NewWriter(log.NewNopLogger(), nil, &fakeAppendable{appender: app}, 0, LabelLimits{})
+		w.now = func() time.Time { return now }
+
+		testutil.Ok(t, w.Write(wreq))
+		testutil.Equals(t, 3, len(app.samples[labels.FromStrings("a", "1").String()]))
+		testutil.Equals(t, 1, len(app.samples[labels.FromStrings("a", "2").String()]))
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		app := newFakeAppender(nil, nil, nil, nil)
+		w := NewWriter(log.NewNopLogger(), nil, &fakeAppendable{appender: app}, time.Minute, LabelLimits{})
+		w.now = func() time.Time { return now }
+
+		// Samples too far in the future are dropped, while the other samples are appended.
+		err := w.Write(wreq)
+		testutil.NotOk(t, err)
+		// They are reported as out of bounds, so the request fails with a conflict that is not retried.
+		testutil.Equals(t, 1, countCause(err, func(err error) bool { return err == storage.ErrOutOfBounds }))
+		testutil.Equals(t, []prompb.Sample{
+			{Timestamp: nowMillis - 1000, Value: 1},
+			{Timestamp: nowMillis + 60*1000, Value: 2},
+		}, app.samples[labels.FromStrings("a", "1").String()])
+		testutil.Equals(t, 0, len(app.samples[labels.FromStrings("a", "2").String()]))
+		testutil.Equals(t, 2.0, promtest.ToFloat64(w.samplesTooFarInFuture))
+	})
+}
+
+func TestWriter_LabelLimits(t *testing.T) {
+	var (
+		compliant = []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}}
+		tooMany   = []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "a", Value: "1"}, {Name: "b", Value: "2"}, {Name: "c", Value: "3"}}
+		longName  = []prompb.Label{{Name: "__name__", Value: "up"}, {Name: strings.Repeat("n", 20), Value: "1"}}
+		longValue = []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: strings.Repeat("v", 20)}}
+		tooLarge  = []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "instance", Value: "host:9100"}, {Name: "job", Value: "node"}}
+	)
+	wreq := &prompb.WriteRequest{}
+	for _, lset := range [][]prompb.Label{compliant, tooMany, longName, longValue, tooLarge} {
+		wreq.Timeseries = append(wreq.Timeseries, prompb.TimeSeries{Labels: lset, Samples: []prompb.Sample{{Timestamp: 1, Value: 1}}})
+	}
+	key := func(lset []prompb.Label) string {
+		var res labels.Labels
+		for _, l := range lset {
+			res = append(res, labels.Label{Name: l.Name, Value: l.Value})
+		}
+		return res.String()
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		app := newFakeAppender(nil, nil, nil, nil)
+		w := NewWriter(log.NewNopLogger(), nil, &fakeAppendable{appender: app}, 0, LabelLimits{})
+
+		testutil.Ok(t, w.Write(wreq))
+		testutil.Equals(t, 5, len(app.samples))
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		app := newFakeAppender(nil, nil, nil, nil)
+		w := NewWriter(log.NewNopLogger(), nil, &fakeAppendable{appender: app}, 0, LabelLimits{
+			LabelsPerSeries:  3,
+			LabelNameLength:  10,
+			LabelValueLength: 10,
+			LabelSetSize:     30,
+		})
+
+		// Series exceeding a label limit are dropped, while the compliant series are appended.
+		err := w.Write(wreq)
+		testutil.NotOk(t, err)
+		// They are reported as a conflict, so the request fails without being retried.
+		testutil.Equals(t, 1, countCause(err, isConflict))
+		testutil.Equals(t, map[string][]prompb.Sample{key(compliant): {{Timestamp: 1, Value: 1}}}, app.samples)
+		for reason, n := range map[string]float64{
+			"labels_per_series":  1,
+			"label_name_length":  1,
+			"label_value_length": 1,
+			"label_set_size":     1,
+		} {
+			testutil.Equals(t, n, promtest.ToFloat64(w.seriesLabelLimits.WithLabelValues(reason)))
+		}
+	})
+}
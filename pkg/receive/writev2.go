@@ -0,0 +1,137 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package receive
+
+import (
+	"mime"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb/writev2"
+)
+
+const (
+	// remoteWriteV1Proto and remoteWriteV2Proto are the proto parameters of the content type designating the
+	// message of remote write 1.0 and 2.0 requests.
+	remoteWriteV1Proto = "prometheus.WriteRequest"
+	remoteWriteV2Proto = "io.prometheus.write.v2.Request"
+
+	// Response headers of remote write 2.0 requests, telling the client what was written.
+	samplesWrittenHeader    = "X-Prometheus-Remote-Write-Samples-Written"
+	histogramsWrittenHeader = "X-Prometheus-Remote-Write-Histograms-Written"
+	exemplarsWrittenHeader  = "X-Prometheus-Remote-Write-Exemplars-Written"
+)
+
+var errUnsupportedContentType = errors.New("unsupported content type")
+
+// remoteWriteProto returns the message of a remote write request with the given content type. Requests without
+// protobuf content type or proto parameter are remote write 1.0 requests, as the content type was never checked
+// before remote write 2.0 and clients may not set it. Only protobuf content types of unknown messages are rejected.
+func remoteWriteProto(contentType string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/x-protobuf" {
+		return remoteWriteV1Proto, nil
+	}
+	switch p := strings.TrimSpace(params["proto"]); p {
+	case "", remoteWriteV1Proto:
+		return remoteWriteV1Proto, nil
+	case remoteWriteV2Proto:
+		return remoteWriteV2Proto, nil
+	default:
+		return "", errors.Wrapf(errUnsupportedContentType, "unknown proto %q", p)
+	}
+}
+
+// fromWriteV2 converts a remote write 2.0 request into the equivalent remote write 1.0 request, with the
+// metadata of every metric family once. Native histograms are not supported and fail the conversion. Exemplars
+// are validated, but cannot be stored and are dropped.
+func fromWriteV2(req *writev2.Request) (*prompb.WriteRequest, error) {
+	symbol := func(ref uint32) (string, error) {
+		if int(ref) >= len(req.Symbols) {
+			return "", errors.Errorf("symbol reference %d out of range of %d symbols", ref, len(req.Symbols))
+		}
+		return req.Symbols[ref], nil
+	}
+	symbolLabels := func(refs []uint32) ([]prompb.Label, error) {
+		if len(refs)%2 != 0 {
+			return nil, errors.Errorf("odd number of %d label references", len(refs))
+		}
+		lset := make([]prompb.Label, 0, len(refs)/2)
+		for i := 0; i < len(refs); i += 2 {
+			name, err := symbol(refs[i])
+			if err != nil {
+				return nil, err
+			}
+			value, err := symbol(refs[i+1])
+			if err != nil {
+				return nil, err
+			}
+			lset = append(lset, prompb.Label{Name: name, Value: value})
+		}
+		return lset, nil
+	}
+
+	var (
+		wreq     = &prompb.WriteRequest{Timeseries: make([]prompb.TimeSeries, 0, len(req.Timeseries))}
+		families = map[string]struct{}{}
+	)
+	for i, ts := range req.Timeseries {
+		if len(ts.Histograms) > 0 {
+			return nil, errors.Errorf("series %d: native histograms are not supported", i)
+		}
+		lset, err := symbolLabels(ts.LabelsRefs)
+		if err != nil {
+			return nil, errors.Wrapf(err, "series %d labels", i)
+		}
+		for j, e := range ts.Exemplars {
+			if _, err := symbolLabels(e.LabelsRefs); err != nil {
+				return nil, errors.Wrapf(err, "series %d exemplar %d labels", i, j)
+			}
+		}
+
+		samples := make([]prompb.Sample, 0, len(ts.Samples))
+		for _, s := range ts.Samples {
+			samples = append(samples, prompb.Sample{Value: s.Value, Timestamp: s.Timestamp})
+		}
+		wreq.Timeseries = append(wreq.Timeseries, prompb.TimeSeries{Labels: lset, Samples: samples})
+
+		md := ts.Metadata
+		if md.Type == writev2.Metadata_METRIC_TYPE_UNSPECIFIED && md.HelpRef == 0 && md.UnitRef == 0 {
+			continue
+		}
+		family := labelValue(lset, labels.MetricName)
+		if _, ok := families[family]; ok || family == "" {
+			continue
+		}
+		families[family] = struct{}{}
+
+		help, err := symbol(md.HelpRef)
+		if err != nil {
+			return nil, errors.Wrapf(err, "series %d metadata help", i)
+		}
+		unit, err := symbol(md.UnitRef)
+		if err != nil {
+			return nil, errors.Wrapf(err, "series %d metadata unit", i)
+		}
+		// Both protocols number the metric types the same.
+		wreq.Metadata = append(wreq.Metadata, prompb.MetricMetadata{
+			Type:             prompb.MetricMetadata_MetricType(md.Type),
+			MetricFamilyName: family,
+			Help:             help,
+			Unit:             unit,
+		})
+	}
+	return wreq, nil
+}
+
+func labelValue(lset []prompb.Label, name string) string {
+	for _, l := range lset {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
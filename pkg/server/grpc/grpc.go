@@ -19,6 +19,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/extgrpc"
 	"github.com/thanos-io/thanos/pkg/prober"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/tracing"
@@ -64,6 +65,10 @@ func New(logger log.Logger, reg prometheus.Registerer, tracer opentracing.Tracer
 
 	grpcOpts := []grpc.ServerOption{
 		grpc.MaxSendMsgSize(math.MaxInt32),
+		// Compressors of all extgrpc.Compressions are registered, so compressed requests are answered in kind.
+		grpc.StatsHandler(extgrpc.NewPayloadStatsHandler(reg, "server")),
+		// Accept the keepalive pings of clients keeping their idle connections alive, see extgrpc.KeepaliveConfig.
+		extgrpc.ServerKeepaliveEnforcement(),
 		grpc_middleware.WithUnaryServerChain(
 			met.UnaryServerInterceptor(),
 			tracing.UnaryServerInterceptor(tracer),
@@ -82,6 +87,9 @@ func New(logger log.Logger, reg prometheus.Registerer, tracer opentracing.Tracer
 	s := grpc.NewServer(grpcOpts...)
 
 	storepb.RegisterStoreServer(s, storeSrv)
+	if options.metadataSrv != nil {
+		storepb.RegisterMetadataServer(s, options.metadataSrv)
+	}
 	met.InitializeMetrics(s)
 	reg.MustRegister(met)
 
@@ -6,6 +6,8 @@ package grpc
 import (
 	"crypto/tls"
 	"time"
+
+	"github.com/thanos-io/thanos/pkg/store/storepb"
 )
 
 type options struct {
@@ -13,6 +15,8 @@ type options struct {
 	listen      string
 
 	tlsConfig *tls.Config
+
+	metadataSrv storepb.MetadataServer
 }
 
 // Option overrides behavior of Server.
@@ -48,3 +52,10 @@ func WithTLSConfig(cfg *tls.Config) Option {
 		o.tlsConfig = cfg
 	})
 }
+
+// WithMetadataServer registers the given server of the metric metadata API with the gRPC server.
+func WithMetadataServer(srv storepb.MetadataServer) Option {
+	return optionFunc(func(o *options) {
+		o.metadataSrv = srv
+	})
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/prometheus/tsdb/chunks"
 	"github.com/prometheus/prometheus/tsdb/encoding"
@@ -95,8 +96,14 @@ type bucketStoreMetrics struct {
 	resultSeriesCount     prometheus.Summary
 	chunkSizeBytes        prometheus.Histogram
 	queriesDropped        prometheus.Counter
+	queriesDroppedChunks  prometheus.Counter
+	queriesDroppedBlocks  prometheus.Counter
+	seriesGaps            prometheus.Counter
 	queriesLimit          prometheus.Gauge
 	seriesRefetches       prometheus.Counter
+	seriesBatchSize       prometheus.Summary
+	blocksMarkedExcluded  prometheus.Counter
+	indexHeaderCache      *prometheus.CounterVec
 
 	cachedPostingsCompressions           *prometheus.CounterVec
 	cachedPostingsCompressionErrors      *prometheus.CounterVec
@@ -124,6 +131,14 @@ func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
 		Name: "thanos_bucket_store_block_drop_failures_total",
 		Help: "Total number of local blocks that failed to be dropped.",
 	})
+	m.blocksMarkedExcluded = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_blocks_excluded_deletion_mark_total",
+		Help: "Total number of times loaded blocks were excluded from requests because they were marked for deletion for longer than the ignore deletion marks delay.",
+	})
+	m.indexHeaderCache = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_index_header_disk_cache_lookups_total",
+		Help: "Total number of lookups of index-headers in the local directory on block load, by result: hit, miss (no cached index-header) or stale (cached index-header of a different block meta).",
+	}, []string{"result"})
 	m.blocksLoaded = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
 		Name: "thanos_bucket_store_blocks_loaded",
 		Help: "Number of currently loaded blocks.",
@@ -178,6 +193,18 @@ func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
 		Name: "thanos_bucket_store_queries_dropped_total",
 		Help: "Number of queries that were dropped due to the sample limit.",
 	})
+	m.queriesDroppedChunks = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_queries_dropped_chunks_per_series_total",
+		Help: "Number of queries that were dropped due to the limit of chunks touched per series.",
+	})
+	m.queriesDroppedBlocks = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_queries_dropped_blocks_total",
+		Help: "Number of queries that were dropped due to the limit of blocks queried per request.",
+	})
+	m.seriesGaps = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_series_gaps_total",
+		Help: "Number of time ranges of Series calls that were not covered by any block, reported if enabled.",
+	})
 	m.queriesLimit = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
 		Name: "thanos_bucket_store_queries_concurrent_max",
 		Help: "Number of maximum concurrent queries.",
@@ -187,6 +214,11 @@ func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
 		Help: fmt.Sprintf("Total number of cases where %v bytes was not enough was to fetch series from index, resulting in refetch.", maxSeriesSize),
 	})
 
+	m.seriesBatchSize = promauto.With(reg).NewSummary(prometheus.SummaryOpts{
+		Name: "thanos_bucket_store_series_batch_size",
+		Help: "Number of series of a block loaded at once for a single series request.",
+	})
+
 	m.cachedPostingsCompressions = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
 		Name: "thanos_bucket_store_cached_postings_compressions_total",
 		Help: "Number of postings compressions before storing to index cache.",
@@ -242,7 +274,11 @@ type BucketStore struct {
 
 	// samplesLimiter limits the number of samples per each Series() call.
 	samplesLimiter SampleLimiter
-	partitioner    partitioner
+	// chunksLimiter limits the number of chunks touched per series of a block in each Series() call.
+	chunksLimiter SampleLimiter
+	// blocksLimiter limits the number of blocks queried by each Series() call.
+	blocksLimiter SampleLimiter
+	partitioner   partitioner
 
 	filterConfig             *FilterConfig
 	advLabelSets             []storepb.LabelSet
@@ -253,6 +289,31 @@ type BucketStore struct {
 	// This makes them smaller, but takes extra CPU and memory.
 	// When used with in-memory cache, memory usage should decrease overall, thanks to postings being smaller.
 	enablePostingsCompression bool
+
+	// ignoreDeletionMarkFilter provides the deletion marks of the synced blocks, if set. Blocks marked for deletion
+	// for longer than its delay are excluded from requests, even before they are dropped on the next sync.
+	ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter
+
+	// quarantine excludes blocks repeatedly failing to load or to be read from syncs and requests.
+	quarantine *blockQuarantine
+	// indexHeaderFailures tracks the blocks whose index-header is failing to load.
+	indexHeaderFailures *indexHeaderFailures
+
+	// seriesBatchSize is the maximum number of series of a block loaded at once for a series request,
+	// further series are loaded while the previous ones are sent. All series of a block are loaded at once if 0.
+	seriesBatchSize int
+
+	// seriesRelabelConfig is applied to the labels of the series of blocks, without their external labels, as they
+	// are returned by Series, LabelNames and LabelValues. Series dropped by it are not returned.
+	seriesRelabelConfig []*relabel.Config
+
+	// chunksPrefetch prefetches the chunks of the time range following series requests, if set.
+	chunksPrefetch *chunksPrefetch
+
+	// reportGaps enables warnings about the time ranges of series requests not covered by any block.
+	reportGaps bool
+	// decodeConcurrency is the number of goroutines decoding the postings and series of a block within a request.
+	decodeConcurrency int
 }
 
 // NewBucketStore creates a new bucket backed store that implements the store API against
@@ -273,6 +334,16 @@ func NewBucketStore(
 	enableCompatibilityLabel bool,
 	enableIndexHeader bool,
 	enablePostingsCompression bool,
+	ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter,
+	quarantineFailures int,
+	quarantineRetryInterval time.Duration,
+	seriesBatchSize int,
+	seriesRelabelConfig []*relabel.Config,
+	maxChunksPerSeries uint64,
+	chunksPrefetchMaxBytes uint64,
+	maxBlocks uint64,
+	reportGaps bool,
+	decodeConcurrency int,
 ) (*BucketStore, error) {
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -281,11 +352,21 @@ func NewBucketStore(
 	if maxConcurrent < 0 {
 		return nil, errors.Errorf("max concurrency value cannot be lower than 0 (got %v)", maxConcurrent)
 	}
+	if seriesBatchSize < 0 {
+		return nil, errors.Errorf("series batch size cannot be lower than 0 (got %v)", seriesBatchSize)
+	}
+	if decodeConcurrency < 0 {
+		return nil, errors.Errorf("decode concurrency cannot be lower than 0 (got %v)", decodeConcurrency)
+	}
 
 	chunkPool, err := pool.NewBucketedBytesPool(maxChunkSize, 50e6, 2, maxChunkPoolBytes)
 	if err != nil {
 		return nil, errors.Wrap(err, "create chunk pool")
 	}
+	chunksPrefetch, err := newChunksPrefetch(logger, reg, bucket, chunksPrefetchMaxBytes)
+	if err != nil {
+		return nil, err
+	}
 
 	metrics := newBucketStoreMetrics(reg)
 	s := &BucketStore{
@@ -305,10 +386,20 @@ func NewBucketStore(
 			extprom.WrapRegistererWithPrefix("thanos_bucket_store_series_", reg),
 		),
 		samplesLimiter:            NewLimiter(maxSampleCount, metrics.queriesDropped),
+		chunksLimiter:             NewLimiter(maxChunksPerSeries, metrics.queriesDroppedChunks),
+		blocksLimiter:             NewLimiter(maxBlocks, metrics.queriesDroppedBlocks),
 		partitioner:               gapBasedPartitioner{maxGapSize: partitionerMaxGapSize},
 		enableCompatibilityLabel:  enableCompatibilityLabel,
 		enableIndexHeader:         enableIndexHeader,
 		enablePostingsCompression: enablePostingsCompression,
+		ignoreDeletionMarkFilter:  ignoreDeletionMarkFilter,
+		quarantine:                newBlockQuarantine(logger, reg, quarantineFailures, quarantineRetryInterval),
+		indexHeaderFailures:       newIndexHeaderFailures(logger, reg, func(err error) bool { return bucket.IsObjNotFoundErr(err) }),
+		seriesBatchSize:           seriesBatchSize,
+		seriesRelabelConfig:       seriesRelabelConfig,
+		chunksPrefetch:            chunksPrefetch,
+		reportGaps:                reportGaps,
+		decodeConcurrency:         decodeConcurrency,
 	}
 	s.metrics = metrics
 
@@ -323,6 +414,8 @@ func NewBucketStore(
 
 // Close the store.
 func (s *BucketStore) Close() (err error) {
+	s.chunksPrefetch.close()
+
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
@@ -332,6 +425,28 @@ func (s *BucketStore) Close() (err error) {
 	return err
 }
 
+// excludedByDeletionMark returns true if the block was marked for deletion for longer than the ignore deletion
+// marks delay. Such blocks are excluded from requests, even though they are only dropped on the next sync.
+// It must be called with the read lock held.
+func (s *BucketStore) excludedByDeletionMark(b *bucketBlock) bool {
+	if b.deletionTime == 0 || time.Since(time.Unix(b.deletionTime, 0)) <= s.ignoreDeletionMarkFilter.Delay() {
+		return false
+	}
+	s.metrics.blocksMarkedExcluded.Inc()
+	return true
+}
+
+// withoutExcludedBlocks returns the given blocks without the ones excluded by their deletion mark or quarantined.
+func (s *BucketStore) withoutExcludedBlocks(blocks []*bucketBlock) []*bucketBlock {
+	res := blocks[:0]
+	for _, b := range blocks {
+		if !s.excludedByDeletionMark(b) && !s.quarantine.quarantined(b.meta.ULID) {
+			res = append(res, b)
+		}
+	}
+	return res
+}
+
 // SyncBlocks synchronizes the stores state with the Bucket bucket.
 // It will reuse disk space as persistent cache based on s.dir param.
 func (s *BucketStore) SyncBlocks(ctx context.Context) error {
@@ -349,8 +464,12 @@ func (s *BucketStore) SyncBlocks(ctx context.Context) error {
 		go func() {
 			for meta := range blockc {
 				if err := s.addBlock(ctx, meta); err != nil {
+					if ctx.Err() == nil {
+						s.quarantine.failed(meta.ULID, err)
+					}
 					continue
 				}
+				s.quarantine.loaded(meta.ULID)
 			}
 			wg.Done()
 		}()
@@ -360,6 +479,9 @@ func (s *BucketStore) SyncBlocks(ctx context.Context) error {
 		if b := s.getBlock(id); b != nil {
 			continue
 		}
+		if s.quarantine.quarantined(id) {
+			continue
+		}
 		select {
 		case <-ctx.Done():
 		case blockc <- meta:
@@ -372,6 +494,20 @@ func (s *BucketStore) SyncBlocks(ctx context.Context) error {
 	if metaFetchErr != nil {
 		return metaFetchErr
 	}
+	s.quarantine.forgetMissing(metas)
+	s.indexHeaderFailures.forgetMissing(metas)
+
+	if s.ignoreDeletionMarkFilter != nil {
+		marks := s.ignoreDeletionMarkFilter.DeletionMarkBlocks()
+		s.mtx.Lock()
+		for id, b := range s.blocks {
+			b.deletionTime = 0
+			if m, ok := marks[id]; ok {
+				b.deletionTime = m.DeletionTime
+			}
+		}
+		s.mtx.Unlock()
+	}
 
 	// Drop all blocks that are no longer present in the bucket.
 	for id := range s.blocks {
@@ -434,6 +570,46 @@ func (s *BucketStore) InitialSync(ctx context.Context) error {
 	return nil
 }
 
+// checkCachedIndexHeader checks whether the index-header (or index cache) in the given local block directory, persisted
+// by a previous load of the block, can be reused. A cached index-header is valid only if the meta.json stored next to it
+// matches the given meta of the block in the bucket; otherwise the index-header is removed, so it is rebuilt.
+func (s *BucketStore) checkCachedIndexHeader(dir string, meta *metadata.Meta) (bool, error) {
+	fn := filepath.Join(dir, block.IndexHeaderFilename)
+	if !s.enableIndexHeader {
+		fn = filepath.Join(dir, block.IndexCacheFilename)
+	}
+	if _, err := os.Stat(fn); err != nil {
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+		s.metrics.indexHeaderCache.WithLabelValues("miss").Inc()
+		return false, nil
+	}
+
+	local, err := metadata.Read(dir)
+	if err == nil && sameIndexMeta(local, meta) {
+		s.metrics.indexHeaderCache.WithLabelValues("hit").Inc()
+		return true, nil
+	}
+
+	level.Info(s.logger).Log("msg", "cached index-header is stale; rebuilding", "id", meta.ULID, "path", fn, "err", err)
+	s.metrics.indexHeaderCache.WithLabelValues("stale").Inc()
+	if err := os.Remove(fn); err != nil {
+		return false, errors.Wrap(err, "remove stale index-header")
+	}
+	return false, nil
+}
+
+// sameIndexMeta returns true if both metas describe the same block index.
+func sameIndexMeta(a, b *metadata.Meta) bool {
+	return a.ULID == b.ULID &&
+		a.MinTime == b.MinTime &&
+		a.MaxTime == b.MaxTime &&
+		a.Stats == b.Stats &&
+		a.Compaction.Level == b.Compaction.Level &&
+		a.Thanos.Downsample.Resolution == b.Thanos.Downsample.Resolution
+}
+
 func (s *BucketStore) getBlock(id ulid.ULID) *bucketBlock {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
@@ -461,24 +637,39 @@ func (s *BucketStore) addBlock(ctx context.Context, meta *metadata.Meta) (err er
 	lset := labels.FromMap(meta.Thanos.Labels)
 	h := lset.Hash()
 
+	cached, err := s.checkCachedIndexHeader(dir, meta)
+	if err != nil {
+		return errors.Wrap(err, "check cached index header")
+	}
+
 	var indexHeaderReader indexheader.Reader
 	if s.enableIndexHeader {
 		indexHeaderReader, err = indexheader.NewBinaryReader(ctx, s.logger, s.bkt, s.dir, meta.ULID)
-		if err != nil {
-			return errors.Wrap(err, "create index header reader")
-		}
+		err = errors.Wrap(err, "create index header reader")
 	} else {
 		indexHeaderReader, err = indexheader.NewJSONReader(ctx, s.logger, s.bkt, s.dir, meta.ULID)
-		if err != nil {
-			return errors.Wrap(err, "create index cache reader")
+		err = errors.Wrap(err, "create index cache reader")
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			s.indexHeaderFailures.failed(meta.ULID, err)
 		}
+		return err
 	}
+	s.indexHeaderFailures.loaded(meta.ULID)
 	defer func() {
 		if err != nil {
 			runutil.CloseWithErrCapture(&err, indexHeaderReader, "index-header")
 		}
 	}()
 
+	if !cached {
+		// Store the meta the index-header was built for, so it can be validated on the next load, e.g. after restart.
+		if err = metadata.Write(s.logger, dir, meta); err != nil {
+			return errors.Wrap(err, "write local meta")
+		}
+	}
+
 	b, err := newBucketBlock(
 		ctx,
 		log.With(s.logger, "block", meta.ULID),
@@ -491,6 +682,7 @@ func (s *BucketStore) addBlock(ctx context.Context, meta *metadata.Meta) (err er
 		s.partitioner,
 		s.metrics.seriesRefetches,
 		s.enablePostingsCompression,
+		s.decodeConcurrency,
 	)
 	if err != nil {
 		return errors.Wrap(err, "new bucket block")
@@ -658,6 +850,10 @@ func blockSeries(
 	matchers []*labels.Matcher,
 	req *storepb.SeriesRequest,
 	samplesLimiter SampleLimiter,
+	chunksLimiter SampleLimiter,
+	batchSize int,
+	batchSizes prometheus.Observer,
+	relabelConfig []*relabel.Config,
 ) (storepb.SeriesSet, *queryStats, error) {
 	ps, err := indexr.ExpandedPostings(matchers)
 	if err != nil {
@@ -668,11 +864,58 @@ func blockSeries(
 		return storepb.EmptySeriesSet(), indexr.stats, nil
 	}
 
+	// Relabeling may change the order of the series, so they are sorted again which requires loading them at once.
+	if batchSize <= 0 || len(ps) <= batchSize || len(relabelConfig) > 0 {
+		batchSizes.Observe(float64(len(ps)))
+		res, err := loadSeriesBatch(extLset, indexr, chunkr, ps, req, samplesLimiter, chunksLimiter, false, relabelConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newBucketSeriesSet(res), indexr.stats.merge(chunkr.stats), nil
+	}
+
+	// Load the series in batches, only the first one right away. Chunks are copied out of the pooled
+	// buffers, so that the readers can release them before loading the next batch.
+	set := &batchedSeriesSet{
+		postings: ps,
+		load: func(ps []uint64) ([]seriesEntry, error) {
+			batchSizes.Observe(float64(len(ps)))
+			defer indexr.resetLoadedSeries()
+			defer chunkr.reset()
+			return loadSeriesBatch(extLset, indexr, chunkr, ps, req, samplesLimiter, chunksLimiter, true, nil)
+		},
+		batchSize: batchSize,
+		cur:       newBucketSeriesSet(nil),
+	}
+	if err := set.loadNext(); err != nil {
+		return nil, nil, err
+	}
+	// Stats of the following batches are gathered from new stats of the readers once the set is iterated.
+	stats := indexr.stats.merge(chunkr.stats)
+	indexr.stats, chunkr.stats = &queryStats{}, &queryStats{}
+	set.stats = func() *queryStats { return indexr.stats.merge(chunkr.stats) }
+	return set, stats, nil
+}
+
+// loadSeriesBatch loads the series with the given IDs and their chunks overlapping the requested time range.
+// If copyChunks is true, the chunks are copied, so that they stay valid after the chunk reader is reset or closed.
+// If a relabel config is given, it is applied to the series labels, and identical relabeled series are merged.
+// Loading fails if more chunks of a single series overlap the time range than allowed by the chunks limiter.
+func loadSeriesBatch(
+	extLset map[string]string,
+	indexr *bucketIndexReader,
+	chunkr *bucketChunkReader,
+	ps []uint64,
+	req *storepb.SeriesRequest,
+	samplesLimiter SampleLimiter,
+	chunksLimiter SampleLimiter,
+	copyChunks bool,
+	relabelConfig []*relabel.Config,
+) ([]seriesEntry, error) {
 	// Preload all series index data.
-	// TODO(bwplotka): Consider not keeping all series in memory all the time.
 	// TODO(bwplotka): Do lazy loading in one step as `ExpandingPostings` method.
 	if err := indexr.PreloadSeries(ps); err != nil {
-		return nil, nil, errors.Wrap(err, "preload series")
+		return nil, errors.Wrap(err, "preload series")
 	}
 
 	// Transform all series into the response types and mark their relevant chunks
@@ -681,10 +924,27 @@ func blockSeries(
 		res  []seriesEntry
 		lset labels.Labels
 		chks []chunks.Meta
+
+		decodedLsets []labels.Labels
+		decodedChks  [][]chunks.Meta
 	)
-	for _, id := range ps {
-		if err := indexr.LoadedSeries(id, &lset, &chks); err != nil {
-			return nil, nil, errors.Wrap(err, "read series")
+	// Series are decoded upfront if they are decoded concurrently, otherwise one by one reusing the same buffers.
+	if indexr.block.decodeConcurrency > 1 {
+		var err error
+		if decodedLsets, decodedChks, err = indexr.decodeLoadedSeries(ps); err != nil {
+			return nil, errors.Wrap(err, "read series")
+		}
+	}
+	for i, id := range ps {
+		if decodedLsets != nil {
+			lset, chks = decodedLsets[i], decodedChks[i]
+		} else if err := indexr.LoadedSeries(id, &lset, &chks); err != nil {
+			return nil, errors.Wrap(err, "read series")
+		}
+		if len(relabelConfig) > 0 {
+			if lset = relabel.Process(lset, relabelConfig...); lset == nil {
+				continue
+			}
 		}
 		s := seriesEntry{
 			lset: make([]storepb.Label, 0, len(lset)+len(extLset)),
@@ -719,13 +979,18 @@ func blockSeries(
 			if meta.MinTime > req.MaxTime {
 				break
 			}
+			// Abort before preloading the chunks of a series with an unexpectedly high number of chunks, e.g. due to churn.
+			if err := chunksLimiter.Check(uint64(len(s.chks) + 1)); err != nil {
+				return nil, limitExceededError{errors.Wrapf(err, "exceeded chunks limit for series %s", lset)}
+			}
 
 			if err := chunkr.addPreload(meta.Ref); err != nil {
-				return nil, nil, errors.Wrap(err, "add chunk preload")
+				return nil, errors.Wrap(err, "add chunk preload")
 			}
 			s.chks = append(s.chks, storepb.AggrChunk{
-				MinTime: meta.MinTime,
-				MaxTime: meta.MaxTime,
+				MinTime:    meta.MinTime,
+				MaxTime:    meta.MaxTime,
+				Resolution: chunkr.block.meta.Thanos.Downsample.Resolution,
 			})
 			s.refs = append(s.refs, meta.Ref)
 		}
@@ -733,10 +998,13 @@ func blockSeries(
 			res = append(res, s)
 		}
 	}
+	if len(relabelConfig) > 0 {
+		res = mergeSeriesEntries(res)
+	}
 
 	// Preload all chunks that were marked in the previous stage.
 	if err := chunkr.preload(samplesLimiter); err != nil {
-		return nil, nil, errors.Wrap(err, "preload chunks")
+		return nil, errors.Wrap(err, "preload chunks")
 	}
 
 	// Transform all chunks into the response format.
@@ -744,15 +1012,90 @@ func blockSeries(
 		for i, ref := range s.refs {
 			chk, err := chunkr.Chunk(ref)
 			if err != nil {
-				return nil, nil, errors.Wrap(err, "get chunk")
+				return nil, errors.Wrap(err, "get chunk")
+			}
+			if raw, ok := chk.(rawChunk); ok && copyChunks {
+				chk = append(rawChunk(nil), raw...)
 			}
 			if err := populateChunk(&s.chks[i], chk, req.Aggregates); err != nil {
-				return nil, nil, errors.Wrap(err, "populate chunk")
+				return nil, errors.Wrap(err, "populate chunk")
+			}
+		}
+	}
+	return res, nil
+}
+
+// mergeSeriesEntries sorts the given series entries by their labels, merging the chunks of entries with equal labels.
+func mergeSeriesEntries(entries []seriesEntry) []seriesEntry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return storepb.CompareLabels(entries[i].lset, entries[j].lset) < 0
+	})
+
+	res := entries[:0]
+	for _, e := range entries {
+		if n := len(res); n > 0 && storepb.CompareLabels(res[n-1].lset, e.lset) == 0 {
+			res[n-1].refs = append(res[n-1].refs, e.refs...)
+			res[n-1].chks = append(res[n-1].chks, e.chks...)
+			continue
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+// batchedSeriesSet is a series set of a block loading its series in batches while it is iterated,
+// so that only the data of a single batch is held in memory at a time.
+type batchedSeriesSet struct {
+	postings  []uint64
+	load      func(ps []uint64) ([]seriesEntry, error)
+	batchSize int
+
+	cur *bucketSeriesSet
+	err error
+
+	// stats returns the stats of loading the batches after the first one.
+	stats func() *queryStats
+	// failed is called with the error of loading a batch, if set.
+	failed func(err error)
+}
+
+// loadNext loads the next batch of series.
+func (s *batchedSeriesSet) loadNext() error {
+	n := s.batchSize
+	if n > len(s.postings) {
+		n = len(s.postings)
+	}
+	res, err := s.load(s.postings[:n])
+	if err != nil {
+		return err
+	}
+	s.postings = s.postings[n:]
+	s.cur = newBucketSeriesSet(res)
+	return nil
+}
+
+func (s *batchedSeriesSet) Next() bool {
+	for !s.cur.Next() {
+		if s.err != nil || len(s.postings) == 0 {
+			return false
+		}
+		if err := s.loadNext(); err != nil {
+			s.err = errors.Wrap(err, "load series batch")
+			if s.failed != nil {
+				s.failed(err)
 			}
+			return false
 		}
 	}
+	return true
+}
+
+func (s *batchedSeriesSet) At() ([]storepb.Label, []storepb.AggrChunk) {
+	return s.cur.At()
+}
 
-	return newBucketSeriesSet(res), indexr.stats.merge(chunkr.stats), nil
+func (s *batchedSeriesSet) Err() error {
+	return s.err
 }
 
 func populateChunk(out *storepb.AggrChunk, in chunkenc.Chunk, aggrs []storepb.Aggr) error {
@@ -860,34 +1203,77 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 		ctx     = srv.Context()
 		stats   = &queryStats{}
 		res     []storepb.SeriesSet
+		batched []*batchedSeriesSet
 		mtx     sync.Mutex
-		g, gctx = errgroup.WithContext(ctx)
+		g       errgroup.Group
+
+		// readCtx is cancelled once reading any block failed. Unlike the context of an errgroup, it stays valid
+		// after all first batches were loaded, as the following batches of a block are loaded while merging.
+		readCtx, cancelReads = context.WithCancel(ctx)
+
+		// prefetchBlocks are the blocks covering the time range following the request.
+		prefetchBlocks []*bucketBlock
+		prefetchMint   int64
+		prefetchMaxt   int64
+		prefetch       bool
 	)
+	defer cancelReads()
+	if s.chunksPrefetch != nil && !req.SkipChunks {
+		prefetchMint, prefetchMaxt, prefetch = adjacentRange(req.MinTime, req.MaxTime)
+	}
 
 	s.mtx.RLock()
 
+	// All blocks are selected before any is read, so that requests querying more blocks than allowed are aborted
+	// before loading anything.
+	type blockSelection struct {
+		matchers []*labels.Matcher
+		blocks   []*bucketBlock
+	}
+	var (
+		selected []blockSelection
+		gaps     []error
+	)
 	for _, bs := range s.blockSets {
 		blockMatchers, ok := bs.labelMatchers(matchers...)
 		if !ok {
 			continue
 		}
 
-		blocks := bs.getFor(req.MinTime, req.MaxTime, req.MaxResolutionWindow)
-
-		mtx.Lock()
+		blocks := s.withoutExcludedBlocks(bs.getFor(req.MinTime, req.MaxTime, req.MaxResolutionWindow))
+		if prefetch {
+			for _, b := range bs.getFor(prefetchMint, prefetchMaxt, req.MaxResolutionWindow) {
+				if b.deletionTime == 0 && !s.quarantine.quarantined(b.meta.ULID) {
+					prefetchBlocks = append(prefetchBlocks, b)
+				}
+			}
+		}
 		stats.blocksQueried += len(blocks)
-		mtx.Unlock()
 
 		if s.debugLogging {
 			debugFoundBlockSetOverview(s.logger, req.MinTime, req.MaxTime, req.MaxResolutionWindow, bs.labels, blocks)
 		}
+		if s.reportGaps {
+			for _, r := range bs.uncoveredRanges(req.MinTime, req.MaxTime, blocks) {
+				gaps = append(gaps, errors.Errorf(uncoveredRangeWarning, r.mint, r.maxt, bs.labels))
+			}
+		}
+		selected = append(selected, blockSelection{matchers: blockMatchers, blocks: blocks})
+	}
 
-		for _, b := range blocks {
+	if err := s.blocksLimiter.Check(uint64(stats.blocksQueried)); err != nil {
+		s.mtx.RUnlock()
+		return status.Error(codes.Aborted, errors.Wrap(err, "exceeded blocks limit, narrow the time range or query a downsampled resolution").Error())
+	}
+
+	for _, sel := range selected {
+		blockMatchers := sel.matchers
+		for _, b := range sel.blocks {
 			b := b
 
 			// We must keep the readers open until all their data has been sent.
-			indexr := b.indexReader(gctx)
-			chunkr := b.chunkReader(gctx)
+			indexr := b.indexReader(readCtx)
+			chunkr := b.chunkReader(readCtx)
 
 			// Defer all closes to the end of Series method.
 			defer runutil.CloseWithLogOnErr(s.logger, indexr, "series block")
@@ -901,10 +1287,28 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 					blockMatchers,
 					req,
 					s.samplesLimiter,
+					s.chunksLimiter,
+					s.seriesBatchSize,
+					s.metrics.seriesBatchSize,
+					s.seriesRelabelConfig,
 				)
 				if err != nil {
+					if isBlockReadFailure(readCtx, err) {
+						s.quarantine.failed(b.meta.ULID, err)
+					}
+					cancelReads()
 					return errors.Wrapf(err, "fetch series for block %s", b.meta.ULID)
 				}
+				if bs, ok := part.(*batchedSeriesSet); ok {
+					bs.failed = func(err error) {
+						if isBlockReadFailure(readCtx, err) {
+							s.quarantine.failed(b.meta.ULID, err)
+						}
+					}
+					mtx.Lock()
+					batched = append(batched, bs)
+					mtx.Unlock()
+				}
 
 				mtx.Lock()
 				res = append(res, part)
@@ -944,6 +1348,12 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 		level.Debug(s.logger).Log("msg", "stats query processed",
 			"stats", fmt.Sprintf("%+v", stats), "err", err)
 	}()
+	defer func() {
+		// Series batches after the first one of a block are loaded while merging, add their stats once all are sent.
+		for _, bs := range batched {
+			stats = stats.merge(bs.stats())
+		}
+	}()
 
 	// Concurrently get data from all blocks.
 	{
@@ -958,6 +1368,13 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 		s.metrics.seriesGetAllDuration.Observe(stats.getAllDuration.Seconds())
 		s.metrics.seriesBlocksQueried.Observe(float64(stats.blocksQueried))
 	}
+	// Report the gaps before the series, so that clients can tell missing blocks apart from empty results.
+	s.metrics.seriesGaps.Add(float64(len(gaps)))
+	for _, gap := range gaps {
+		if err = srv.Send(storepb.NewWarnSeriesResponse(gap)); err != nil {
+			return status.Error(codes.Unknown, errors.Wrap(err, "send warning response").Error())
+		}
+	}
 	// Merge the sub-results from each selected block.
 	tracing.DoInSpan(ctx, "bucket_store_merge_all", func(ctx context.Context) {
 		begin := time.Now()
@@ -994,6 +1411,9 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 
 		err = nil
 	})
+	if err == nil {
+		s.chunksPrefetch.start(prefetchBlocks)
+	}
 	return err
 }
 
@@ -1005,7 +1425,12 @@ func chunksSize(chks []storepb.AggrChunk) (size int) {
 }
 
 // LabelNames implements the storepb.StoreServer interface.
-func (s *BucketStore) LabelNames(ctx context.Context, _ *storepb.LabelNamesRequest) (*storepb.LabelNamesResponse, error) {
+func (s *BucketStore) LabelNames(ctx context.Context, req *storepb.LabelNamesRequest) (*storepb.LabelNamesResponse, error) {
+	matchers, err := translateMatchers(req.Matchers)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	g, gctx := errgroup.WithContext(ctx)
 
 	s.mtx.RLock()
@@ -1014,13 +1439,44 @@ func (s *BucketStore) LabelNames(ctx context.Context, _ *storepb.LabelNamesReque
 	var sets [][]string
 
 	for _, b := range s.blocks {
+		b := b
+		if s.excludedByDeletionMark(b) {
+			continue
+		}
+
+		blockMatchers, ok := b.labelMatchers(matchers...)
+		if !ok {
+			continue
+		}
+
+		// Relabeled label names are only known from the series.
+		if len(blockMatchers) == 0 && len(s.seriesRelabelConfig) == 0 {
+			// Without matchers all label names are known from the index header. There is no need
+			// to touch postings or series, so the block is only guarded against being closed.
+			b.pendingReaders.Add(1)
+			g.Go(func() error {
+				defer b.pendingReaders.Done()
+
+				res := b.indexHeaderReader.LabelNames()
+				sort.Strings(res)
+
+				mtx.Lock()
+				sets = append(sets, res)
+				mtx.Unlock()
+
+				return nil
+			})
+			continue
+		}
+
 		indexr := b.indexReader(gctx)
 		g.Go(func() error {
 			defer runutil.CloseWithLogOnErr(s.logger, indexr, "label names")
 
-			// Do it via index reader to have pending reader registered correctly.
-			res := indexr.block.indexHeaderReader.LabelNames()
-			sort.Strings(res)
+			res, err := blockLabelNames(indexr, blockMatchers, s.seriesRelabelConfig)
+			if err != nil {
+				return errors.Wrapf(err, "fetch label names for block %s", b.meta.ULID)
+			}
 
 			mtx.Lock()
 			sets = append(sets, res)
@@ -1040,6 +1496,85 @@ func (s *BucketStore) LabelNames(ctx context.Context, _ *storepb.LabelNamesReque
 	}, nil
 }
 
+// blockLabelNames returns the sorted label names of all series of the block matching the given matchers,
+// after applying the given relabel config to them.
+func blockLabelNames(indexr *bucketIndexReader, matchers []*labels.Matcher, relabelConfig []*relabel.Config) ([]string, error) {
+	names := map[string]struct{}{}
+	if err := forEachBlockSeriesLabels(indexr, matchers, relabelConfig, func(lset labels.Labels) {
+		for _, l := range lset {
+			names[l.Name] = struct{}{}
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	res := make([]string, 0, len(names))
+	for n := range names {
+		res = append(res, n)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// blockLabelValues returns the sorted values of the given label of all series of the block, after applying the
+// given relabel config to them.
+func blockLabelValues(indexr *bucketIndexReader, name string, relabelConfig []*relabel.Config) ([]string, error) {
+	values := map[string]struct{}{}
+	if err := forEachBlockSeriesLabels(indexr, nil, relabelConfig, func(lset labels.Labels) {
+		if v := lset.Get(name); v != "" {
+			values[v] = struct{}{}
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0, len(values))
+	for v := range values {
+		res = append(res, v)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// forEachBlockSeriesLabels calls f with the labels of each series of the block matching the given matchers, after
+// applying the given relabel config to them. All series are selected without matchers. Series dropped by the relabel
+// config are skipped.
+func forEachBlockSeriesLabels(indexr *bucketIndexReader, matchers []*labels.Matcher, relabelConfig []*relabel.Config, f func(labels.Labels)) error {
+	if len(matchers) == 0 {
+		matchers = []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "", ".*")}
+	}
+	ps, err := indexr.ExpandedPostings(matchers)
+	if err != nil {
+		return errors.Wrap(err, "expanded matching posting")
+	}
+	if len(ps) == 0 {
+		return nil
+	}
+	if err := indexr.PreloadSeries(ps); err != nil {
+		return errors.Wrap(err, "preload series")
+	}
+
+	var (
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+	for _, id := range ps {
+		if err := indexr.LoadedSeries(id, &lset, &chks); err != nil {
+			return errors.Wrap(err, "read series")
+		}
+		if len(relabelConfig) > 0 {
+			if lset = relabel.Process(lset, relabelConfig...); lset == nil {
+				continue
+			}
+		}
+		f(lset)
+	}
+	return nil
+}
+
 // LabelValues implements the storepb.StoreServer interface.
 func (s *BucketStore) LabelValues(ctx context.Context, req *storepb.LabelValuesRequest) (*storepb.LabelValuesResponse, error) {
 	g, gctx := errgroup.WithContext(ctx)
@@ -1050,14 +1585,29 @@ func (s *BucketStore) LabelValues(ctx context.Context, req *storepb.LabelValuesR
 	var sets [][]string
 
 	for _, b := range s.blocks {
+		if s.excludedByDeletionMark(b) {
+			continue
+		}
 		indexr := b.indexReader(gctx)
 		g.Go(func() error {
 			defer runutil.CloseWithLogOnErr(s.logger, indexr, "label values")
 
-			// Do it via index reader to have pending reader registered correctly.
-			res, err := indexr.block.indexHeaderReader.LabelValues(req.Label)
-			if err != nil {
-				return errors.Wrap(err, "index header label values")
+			var (
+				res []string
+				err error
+			)
+			if len(s.seriesRelabelConfig) > 0 {
+				// Relabeled label values are only known from the series.
+				res, err = blockLabelValues(indexr, req.Label, s.seriesRelabelConfig)
+				if err != nil {
+					return errors.Wrapf(err, "fetch label values for block %s", indexr.block.meta.ULID)
+				}
+			} else {
+				// Do it via index reader to have pending reader registered correctly.
+				res, err = indexr.block.indexHeaderReader.LabelValues(req.Label)
+				if err != nil {
+					return errors.Wrap(err, "index header label values")
+				}
 			}
 
 			mtx.Lock()
@@ -1087,8 +1637,8 @@ type bucketBlockSet struct {
 	blocks      [][]*bucketBlock // Ordered buckets for the existing resolutions.
 }
 
-// newBucketBlockSet initializes a new set with the known downsampling windows hard-configured.
-// The set currently does not support arbitrary ranges.
+// newBucketBlockSet initializes a new set with the standard downsampling windows. Blocks of other
+// resolutions add their resolution to the set.
 func newBucketBlockSet(lset labels.Labels) *bucketBlockSet {
 	return &bucketBlockSet{
 		labels:      lset,
@@ -1104,9 +1654,16 @@ func (s *bucketBlockSet) add(b *bucketBlock) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	i := int64index(s.resolutions, b.meta.Thanos.Downsample.Resolution)
+	res := b.meta.Thanos.Downsample.Resolution
+	if res < 0 {
+		return errors.Errorf("unsupported downsampling resolution %d", res)
+	}
+	i := int64index(s.resolutions, res)
 	if i < 0 {
-		return errors.Errorf("unsupported downsampling resolution %d", b.meta.Thanos.Downsample.Resolution)
+		// Keep the resolutions ordered from high to low.
+		i = sort.Search(len(s.resolutions), func(j int) bool { return s.resolutions[j] < res })
+		s.resolutions = append(s.resolutions[:i], append([]int64{res}, s.resolutions[i:]...)...)
+		s.blocks = append(s.blocks[:i], append([][]*bucketBlock{nil}, s.blocks[i:]...)...)
 	}
 	bs := append(s.blocks[i], b)
 	s.blocks[i] = bs
@@ -1190,6 +1747,67 @@ func (s *bucketBlockSet) getFor(mint, maxt, maxResolutionMillis int64) (bs []*bu
 	return bs
 }
 
+// timeRange is a closed time range in milliseconds.
+type timeRange struct {
+	mint, maxt int64
+}
+
+// uncoveredRanges returns the sub-ranges of [mint, maxt] not covered by any of the given blocks of the set.
+// Only the time range between the oldest and the newest block of the set is considered, so that time ranges outside
+// the retention or not uploaded yet are not reported.
+func (s *bucketBlockSet) uncoveredRanges(mint, maxt int64, bs []*bucketBlock) []timeRange {
+	s.mtx.RLock()
+	setMint, setMaxt := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, blocks := range s.blocks {
+		for _, b := range blocks {
+			if b.meta.MinTime < setMint {
+				setMint = b.meta.MinTime
+			}
+			if b.meta.MaxTime > setMaxt {
+				setMaxt = b.meta.MaxTime
+			}
+		}
+	}
+	s.mtx.RUnlock()
+
+	// NOTE: Block intervals are half-open: [b.MinTime, b.MaxTime).
+	if mint < setMint {
+		mint = setMint
+	}
+	if maxt > setMaxt-1 {
+		maxt = setMaxt - 1
+	}
+	if mint > maxt {
+		return nil
+	}
+
+	sorted := make([]*bucketBlock, len(bs))
+	copy(sorted, bs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].meta.MinTime < sorted[j].meta.MinTime })
+
+	var res []timeRange
+	start := mint
+	for _, b := range sorted {
+		if start > maxt {
+			return res
+		}
+		if b.meta.MinTime > start {
+			end := b.meta.MinTime - 1
+			if end > maxt {
+				end = maxt
+			}
+			res = append(res, timeRange{mint: start, maxt: end})
+		}
+		if b.meta.MaxTime > start {
+			start = b.meta.MaxTime
+		}
+	}
+	if start <= maxt {
+		res = append(res, timeRange{mint: start, maxt: maxt})
+	}
+	return res
+}
+
 // labelMatchers verifies whether the block set matches the given matchers and returns a new
 // set of matchers that is equivalent when querying data within the block.
 func (s *bucketBlockSet) labelMatchers(matchers ...*labels.Matcher) ([]*labels.Matcher, bool) {
@@ -1208,6 +1826,24 @@ func (s *bucketBlockSet) labelMatchers(matchers ...*labels.Matcher) ([]*labels.M
 	return res, true
 }
 
+// labelMatchers verifies whether the block can contain series matching the given matchers based on its
+// external labels. It returns the matchers that still need to be applied to the block's series.
+func (b *bucketBlock) labelMatchers(matchers ...*labels.Matcher) ([]*labels.Matcher, bool) {
+	res := make([]*labels.Matcher, 0, len(matchers))
+
+	for _, m := range matchers {
+		v, ok := b.meta.Thanos.Labels[m.Name]
+		if !ok || v == "" {
+			res = append(res, m)
+			continue
+		}
+		if !m.Matches(v) {
+			return nil, false
+		}
+	}
+	return res, true
+}
+
 // bucketBlock represents a block that is located in a bucket. It holds intermediate
 // state for the block on local disk.
 type bucketBlock struct {
@@ -1229,6 +1865,13 @@ type bucketBlock struct {
 	seriesRefetches prometheus.Counter
 
 	enablePostingsCompression bool
+	// decodeConcurrency is the number of goroutines decoding postings and series within a request. Decoding is
+	// sequential if it is 1 or lower.
+	decodeConcurrency int
+
+	// deletionTime is the unix time in seconds the block was marked for deletion, 0 if it is not marked.
+	// It is updated on every sync with the store's lock held.
+	deletionTime int64
 }
 
 func newBucketBlock(
@@ -1243,6 +1886,7 @@ func newBucketBlock(
 	p partitioner,
 	seriesRefetches prometheus.Counter,
 	enablePostingsCompression bool,
+	decodeConcurrency int,
 ) (b *bucketBlock, err error) {
 	b = &bucketBlock{
 		logger:                    logger,
@@ -1255,6 +1899,7 @@ func newBucketBlock(
 		indexHeaderReader:         indexHeadReader,
 		seriesRefetches:           seriesRefetches,
 		enablePostingsCompression: enablePostingsCompression,
+		decodeConcurrency:         decodeConcurrency,
 	}
 
 	// Get object handles for all chunk files.
@@ -1554,35 +2199,13 @@ func (r *bucketIndexReader) fetchPostings(keys []labels.Label) ([]index.Postings
 	// Iterate over all groups and fetch posting from cache.
 	// If we have a miss, mark key to be fetched in `ptrs` slice.
 	// Overlaps are well handled by partitioner, so we don't need to deduplicate keys.
+	var cached []int
 	for ix, key := range keys {
 		// Get postings for the given key from cache first.
 		if b, ok := fromCache[key]; ok {
 			r.stats.postingsTouched++
 			r.stats.postingsTouchedSizeSum += len(b)
-
-			// Even if this instance is not using compression, there may be compressed
-			// entries in the cache written by other stores.
-			var (
-				l   index.Postings
-				err error
-			)
-			if isDiffVarintSnappyEncodedPostings(b) {
-				s := time.Now()
-				l, err = diffVarintSnappyDecode(b)
-				r.stats.cachedPostingsDecompressions += 1
-				r.stats.cachedPostingsDecompressionTimeSum += time.Since(s)
-				if err != nil {
-					r.stats.cachedPostingsDecompressionErrors += 1
-				}
-			} else {
-				_, l, err = r.dec.Postings(b)
-			}
-
-			if err != nil {
-				return nil, errors.Wrap(err, "decode postings")
-			}
-
-			output[ix] = l
+			cached = append(cached, ix)
 			continue
 		}
 
@@ -1602,6 +2225,41 @@ func (r *bucketIndexReader) fetchPostings(keys []labels.Label) ([]index.Postings
 		ptrs = append(ptrs, postingPtr{ptr: ptr, keyID: ix})
 	}
 
+	// Decode the postings found in the cache. Every key is decoded by a single goroutine, writing its own output entry.
+	if err := runConcurrently(len(cached), r.block.decodeConcurrency, func(i int) error {
+		ix := cached[i]
+		b := fromCache[keys[ix]]
+
+		// Even if this instance is not using compression, there may be compressed
+		// entries in the cache written by other stores.
+		var (
+			l   index.Postings
+			err error
+		)
+		if isDiffVarintSnappyEncodedPostings(b) {
+			s := time.Now()
+			l, err = diffVarintSnappyDecode(b)
+			r.mtx.Lock()
+			r.stats.cachedPostingsDecompressions += 1
+			r.stats.cachedPostingsDecompressionTimeSum += time.Since(s)
+			if err != nil {
+				r.stats.cachedPostingsDecompressionErrors += 1
+			}
+			r.mtx.Unlock()
+		} else {
+			_, l, err = r.dec.Postings(b)
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "decode postings")
+		}
+
+		output[ix] = l
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
 	sort.Slice(ptrs, func(i, j int) bool {
 		return ptrs[i].ptr.Start < ptrs[j].ptr.Start
 	})
@@ -1885,6 +2543,70 @@ func (r *bucketIndexReader) LoadedSeries(ref uint64, lset *labels.Labels, chks *
 	return r.dec.Series(b, lset, chks)
 }
 
+// decodeLoadedSeries decodes the labels and chunk metas of the loaded series with the given references, using
+// the decode concurrency of the block.
+// Returns ErrNotFound if a ref does not resolve to a known series.
+func (r *bucketIndexReader) decodeLoadedSeries(refs []uint64) ([]labels.Labels, [][]chunks.Meta, error) {
+	for _, ref := range refs {
+		b, ok := r.loadedSeries[ref]
+		if !ok {
+			return nil, nil, errors.Errorf("series %d not found", ref)
+		}
+		r.stats.seriesTouched++
+		r.stats.seriesTouchedSizeSum += len(b)
+	}
+
+	lsets := make([]labels.Labels, len(refs))
+	chks := make([][]chunks.Meta, len(refs))
+	if err := runConcurrently(len(refs), r.block.decodeConcurrency, func(i int) error {
+		return r.dec.Series(r.loadedSeries[refs[i]], &lsets[i], &chks[i])
+	}); err != nil {
+		return nil, nil, err
+	}
+	return lsets, chks, nil
+}
+
+// runConcurrently calls f for every index from 0 to n-1 in at most the given number of goroutines, each working on
+// a consecutive range of indexes. It returns the first error of f.
+func runConcurrently(n, concurrency int, f func(i int) error) error {
+	if concurrency > n {
+		concurrency = n
+	}
+	if concurrency <= 1 {
+		for i := 0; i < n; i++ {
+			if err := f(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var g errgroup.Group
+	step := (n + concurrency - 1) / concurrency
+	for from := 0; from < n; from += step {
+		from, to := from, from+step
+		if to > n {
+			to = n
+		}
+		g.Go(func() error {
+			for i := from; i < to; i++ {
+				if err := f(i); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// resetLoadedSeries releases the series data loaded by PreloadSeries.
+func (r *bucketIndexReader) resetLoadedSeries() {
+	r.mtx.Lock()
+	r.loadedSeries = map[uint64][]byte{}
+	r.mtx.Unlock()
+}
+
 // Close released the underlying resources of the reader.
 func (r *bucketIndexReader) Close() error {
 	r.block.pendingReaders.Done()
@@ -1897,8 +2619,10 @@ type bucketChunkReader struct {
 	stats *queryStats
 
 	preloads [][]uint32
-	mtx      sync.Mutex
-	chunks   map[uint64]chunkenc.Chunk
+	// preloaded is the number of chunks preloaded by all calls to preload.
+	preloaded uint64
+	mtx       sync.Mutex
+	chunks    map[uint64]chunkenc.Chunk
 
 	// Byte slice to return to the chunk pool on close.
 	chunkBytes []*[]byte
@@ -1927,6 +2651,24 @@ func (r *bucketChunkReader) addPreload(id uint64) error {
 	return nil
 }
 
+// limitExceededError is returned if loading the data of a request exceeds a limit.
+type limitExceededError struct {
+	error
+}
+
+// isBlockReadFailure returns true if the given error of reading from a block is not caused by the request,
+// i.e. by its cancellation or its limits.
+func isBlockReadFailure(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	cause := errors.Cause(err)
+	if _, ok := cause.(limitExceededError); ok {
+		return false
+	}
+	return cause != context.Canceled && cause != context.DeadlineExceeded
+}
+
 // preload all added chunk IDs. Must be called before the first call to Chunk is made.
 func (r *bucketChunkReader) preload(samplesLimiter SampleLimiter) error {
 	g, ctx := errgroup.WithContext(r.ctx)
@@ -1937,8 +2679,9 @@ func (r *bucketChunkReader) preload(samplesLimiter SampleLimiter) error {
 			numChunks++
 		}
 	}
-	if err := samplesLimiter.Check(numChunks * maxSamplesPerChunk); err != nil {
-		return errors.Wrap(err, "exceeded samples limit")
+	r.preloaded += numChunks
+	if err := samplesLimiter.Check(r.preloaded * maxSamplesPerChunk); err != nil {
+		return limitExceededError{errors.Wrap(err, "exceeded samples limit")}
 	}
 
 	for seq, offsets := range r.preloads {
@@ -2034,6 +2777,20 @@ func (b rawChunk) NumSamples() int {
 	panic("invalid call")
 }
 
+// reset releases all preloaded chunks, so that the chunks of further series can be preloaded.
+// Chunks returned before must not be used anymore.
+func (r *bucketChunkReader) reset() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for _, b := range r.chunkBytes {
+		r.block.chunkPool.Put(b)
+	}
+	r.chunkBytes = nil
+	r.preloads = make([][]uint32, len(r.block.chunkObjs))
+	r.chunks = map[uint64]chunkenc.Chunk{}
+}
+
 func (r *bucketChunkReader) Close() error {
 	r.block.pendingReaders.Done()
 
@@ -4,16 +4,28 @@
 package store
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/relabel"
 	"github.com/prometheus/prometheus/pkg/timestamp"
@@ -27,6 +39,9 @@ import (
 	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/testutil"
 	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v2"
 )
 
 var (
@@ -169,6 +184,16 @@ func prepareStoreWithTestBlocks(t testing.TB, dir string, bkt objstore.Bucket, m
 		true,
 		true,
 		true,
+		nil,
+		0,
+		0,
+		0,
+		nil,
+		0,
+		0,
+		0,
+		false,
+		0,
 	)
 	testutil.Ok(t, err)
 	s.store = store
@@ -194,6 +219,45 @@ func testBucketStore_e2e(t *testing.T, ctx context.Context, s *storeSuite) {
 	testutil.Ok(t, err)
 	testutil.Equals(t, []string{"1", "2"}, vals.Values)
 
+	for _, tcase := range []struct {
+		matchers []storepb.LabelMatcher
+		expected []string
+	}{
+		{
+			expected: []string{"a", "b", "c"},
+		},
+		{
+			matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "b", Value: "1"}},
+			expected: []string{"a", "b"},
+		},
+		{
+			matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: "1|2"}},
+			expected: []string{"a", "b", "c"},
+		},
+		{
+			matchers: []storepb.LabelMatcher{
+				{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "2"},
+				{Type: storepb.LabelMatcher_NEQ, Name: "c", Value: ""},
+			},
+			expected: []string{"a", "c"},
+		},
+		{
+			// Matches external labels of the blocks only.
+			matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "ext2", Value: "value2"}},
+			expected: []string{"a", "c"},
+		},
+		{
+			matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "3"}},
+			expected: []string{},
+		},
+	} {
+		t.Run(fmt.Sprintf("label names %v", tcase.matchers), func(t *testing.T) {
+			resp, err := s.store.LabelNames(ctx, &storepb.LabelNamesRequest{Matchers: tcase.matchers})
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, resp.Names)
+		})
+	}
+
 	// TODO(bwplotka): Add those test cases to TSDB querier_test.go as well, there are no tests for matching.
 	for i, tcase := range []struct {
 		req              *storepb.SeriesRequest
@@ -456,6 +520,28 @@ func TestBucketStore_e2e(t *testing.T) {
 		}); !ok {
 			return
 		}
+
+		if ok := t.Run("with decode concurrency", func(t *testing.T) {
+			for _, b := range s.store.blocks {
+				b.decodeConcurrency = 3
+			}
+			defer func() {
+				for _, b := range s.store.blocks {
+					b.decodeConcurrency = 0
+				}
+			}()
+			indexCache, err := storecache.NewInMemoryIndexCacheWithConfig(s.logger, nil, storecache.InMemoryIndexCacheConfig{
+				MaxItemSize: 1e5,
+				MaxSize:     2e5,
+			})
+			testutil.Ok(t, err)
+			s.cache.SwapWith(indexCache)
+			// Postings are decoded from the cache from the second run on.
+			testBucketStore_e2e(t, ctx, s)
+			testBucketStore_e2e(t, ctx, s)
+		}); !ok {
+			return
+		}
 	})
 }
 
@@ -494,6 +580,124 @@ func TestBucketStore_ManyParts_e2e(t *testing.T) {
 	})
 }
 
+func TestBucketStore_SeriesBatches_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bkt := inmem.NewBucket()
+
+	dir, err := ioutil.TempDir("", "test_bucket_series_batches_e2e")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	s := prepareStoreWithTestBlocks(t, dir, bkt, false, 0, emptyRelabelConfig, allowAllFilterConf)
+	s.cache.SwapWith(noopCache{})
+
+	// Each block contains 4 series.
+	for _, batchSize := range []int{0, 1, 2, 3, 1000} {
+		if ok := t.Run(fmt.Sprintf("batch size %d", batchSize), func(t *testing.T) {
+			s.store.seriesBatchSize = batchSize
+			s.store.metrics.seriesBatchSize = prometheus.NewSummary(prometheus.SummaryOpts{Name: "series_batch_size"})
+
+			testBucketStore_e2e(t, ctx, s)
+
+			m := &dto.Metric{}
+			testutil.Ok(t, s.store.metrics.seriesBatchSize.Write(m))
+			testutil.Assert(t, m.GetSummary().GetSampleCount() > 0, "expected loaded batches to be observed")
+			if batchSize > 0 {
+				avg := m.GetSummary().GetSampleSum() / float64(m.GetSummary().GetSampleCount())
+				testutil.Assert(t, avg <= float64(batchSize), "average batch size %v exceeds %d", avg, batchSize)
+			}
+		}); !ok {
+			return
+		}
+	}
+
+	t.Run("samples limit applies to all batches of a block", func(t *testing.T) {
+		// Every series has a single chunk per block, the limit allows for two of the four chunks of a block.
+		s.store.seriesBatchSize = 1
+		s.store.samplesLimiter = NewLimiter(2*maxSamplesPerChunk+1, s.store.metrics.queriesDropped)
+
+		srv := newStoreSeriesServer(ctx)
+		err := s.store.Series(&storepb.SeriesRequest{
+			Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"}},
+			MinTime:  s.minTime,
+			MaxTime:  s.maxTime,
+		}, srv)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "exceeded samples limit"), "unexpected error: %v", err)
+	})
+}
+
+// ctxBucket is a bucket failing reads once their context is done, like remote object storages do, and failing
+// the chunk reads after the first failAfter ones.
+type ctxBucket struct {
+	objstore.Bucket
+
+	mtx        sync.Mutex
+	chunkReads int
+	failAfter  int
+}
+
+func (b *ctxBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if strings.Contains(name, "/chunks/") {
+		b.mtx.Lock()
+		b.chunkReads++
+		fail := b.failAfter > 0 && b.chunkReads > b.failAfter
+		b.mtx.Unlock()
+		if fail {
+			return nil, errors.New("injected chunk read failure")
+		}
+	}
+	return b.Bucket.GetRange(ctx, name, off, length)
+}
+
+func TestBucketStore_SeriesBatches_Quarantine(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bkt := &ctxBucket{Bucket: inmem.NewBucket()}
+
+	dir, err := ioutil.TempDir("", "test_bucket_series_batches_quarantine")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	s := prepareStoreWithTestBlocks(t, dir, bkt, false, 0, emptyRelabelConfig, allowAllFilterConf)
+	s.cache.SwapWith(noopCache{})
+	s.store.seriesBatchSize = 1
+	s.store.quarantine = newBlockQuarantine(s.logger, nil, 1, time.Hour)
+
+	// The first time slot is covered by two blocks with two matching series each, so that both load two batches.
+	req := &storepb.SeriesRequest{
+		Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"}},
+		MinTime:  s.minTime,
+		MaxTime:  s.minTime + int64(time.Hour/time.Millisecond),
+	}
+	var blocks []*bucketBlock
+	for _, bs := range s.store.blockSets {
+		blocks = append(blocks, bs.getFor(req.MinTime, req.MaxTime, 0)...)
+	}
+	testutil.Equals(t, 2, len(blocks))
+
+	// Batches after the first one are loaded once all first batches were loaded.
+	srv := newStoreSeriesServer(ctx)
+	testutil.Ok(t, s.store.Series(req, srv))
+	testutil.Equals(t, 4, len(srv.SeriesSet))
+
+	// Failures to read following batches quarantine their block.
+	bkt.chunkReads, bkt.failAfter = 0, 2
+	testutil.NotOk(t, s.store.Series(req, newStoreSeriesServer(ctx)))
+
+	var quarantined int
+	for _, b := range blocks {
+		if s.store.quarantine.quarantined(b.meta.ULID) {
+			quarantined++
+		}
+	}
+	testutil.Equals(t, 1, quarantined)
+}
+
 func TestBucketStore_TimePartitioning_e2e(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -545,3 +749,654 @@ func TestBucketStore_TimePartitioning_e2e(t *testing.T) {
 		testutil.Equals(t, 1, len(s.Chunks))
 	}
 }
+
+func TestBucketStore_DeletionMarks_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test_bucket_store_deletion_marks")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var (
+		logger = log.NewNopLogger()
+		bkt    = inmem.NewBucket()
+		now    = time.Now()
+		ids    []ulid.ULID
+	)
+	for _, lset := range []labels.Labels{labels.FromStrings("a", "1"), labels.FromStrings("a", "2")} {
+		id, err := e2eutil.CreateBlock(ctx, dir, []labels.Labels{lset}, 10, timestamp.FromTime(now.Add(-2*time.Hour)), timestamp.FromTime(now), labels.FromStrings("ext1", "value1"), 0)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String())))
+		testutil.Ok(t, os.RemoveAll(filepath.Join(dir, id.String())))
+		ids = append(ids, id)
+	}
+
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(logger, bkt, time.Hour)
+	metaFetcher, err := block.NewMetaFetcher(logger, 20, bkt, dir, nil, []block.MetadataFilter{ignoreDeletionMarkFilter}, nil)
+	testutil.Ok(t, err)
+
+	store, err := NewBucketStore(logger, nil, bkt, metaFetcher, dir, noopCache{}, 0, 0, 20, false, 20, allowAllFilterConf, true, true, true, ignoreDeletionMarkFilter, 0, 0, 0, nil, 0, 0, 0, false, 0)
+	testutil.Ok(t, err)
+
+	queried := func() []string {
+		srv := newStoreSeriesServer(ctx)
+		testutil.Ok(t, store.Series(&storepb.SeriesRequest{
+			Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"}},
+			MinTime:  timestamp.FromTime(now.Add(-2 * time.Hour)),
+			MaxTime:  timestamp.FromTime(now),
+		}, srv))
+
+		var series []string
+		for _, s := range srv.SeriesSet {
+			series = append(series, storepb.LabelsToPromLabels(s.Labels).String())
+		}
+
+		vals, err := store.LabelValues(ctx, &storepb.LabelValuesRequest{Label: "a"})
+		testutil.Ok(t, err)
+		testutil.Equals(t, len(series), len(vals.Values))
+		return series
+	}
+
+	// Blocks marked for deletion within the delay are still queried.
+	testutil.Ok(t, block.MarkForDeletion(ctx, logger, bkt, ids[0]))
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	testutil.Equals(t, []string{`{a="1", ext1="value1"}`, `{a="2", ext1="value1"}`}, queried())
+	testutil.Equals(t, 0.0, promtest.ToFloat64(store.metrics.blocksMarkedExcluded))
+
+	// Once the delay passed, the block is excluded from requests before it is dropped on the next sync.
+	store.mtx.Lock()
+	store.blocks[ids[0]].deletionTime = now.Add(-2 * time.Hour).Unix()
+	store.mtx.Unlock()
+	testutil.Equals(t, []string{`{a="2", ext1="value1"}`}, queried())
+	testutil.Equals(t, 2.0, promtest.ToFloat64(store.metrics.blocksMarkedExcluded))
+	testutil.Equals(t, 2, len(store.blocks))
+}
+
+func TestBucketStore_Quarantine_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test_bucket_store_quarantine")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var (
+		logger = log.NewNopLogger()
+		bkt    = inmem.NewBucket()
+		now    = time.Now()
+		ids    []ulid.ULID
+	)
+	for _, lset := range []labels.Labels{labels.FromStrings("a", "1"), labels.FromStrings("a", "2"), labels.FromStrings("a", "3")} {
+		id, err := e2eutil.CreateBlock(ctx, dir, []labels.Labels{lset}, 10, timestamp.FromTime(now.Add(-2*time.Hour)), timestamp.FromTime(now), labels.FromStrings("ext1", "value1"), 0)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String())))
+		testutil.Ok(t, os.RemoveAll(filepath.Join(dir, id.String())))
+		ids = append(ids, id)
+	}
+	// The first block fails to load, the second one fails to be read.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ids[0].String(), block.IndexFilename), strings.NewReader("corrupted")))
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(ids[1].String(), block.ChunksDirname, "000001")))
+
+	metaFetcher, err := block.NewMetaFetcher(logger, 20, bkt, dir, nil, nil, nil)
+	testutil.Ok(t, err)
+
+	store, err := NewBucketStore(logger, nil, bkt, metaFetcher, dir, noopCache{}, 0, 0, 20, false, 20, allowAllFilterConf, true, true, true, nil, 2, time.Hour, 0, nil, 0, 0, 0, false, 0)
+	testutil.Ok(t, err)
+
+	series := func() ([]string, error) {
+		srv := newStoreSeriesServer(ctx)
+		err := store.Series(&storepb.SeriesRequest{
+			Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"}},
+			MinTime:  timestamp.FromTime(now.Add(-2 * time.Hour)),
+			MaxTime:  timestamp.FromTime(now),
+		}, srv)
+
+		var res []string
+		for _, s := range srv.SeriesSet {
+			res = append(res, storepb.LabelsToPromLabels(s.Labels).String())
+		}
+		return res, err
+	}
+
+	// Failures below the threshold do not quarantine blocks.
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	_, err = series()
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 2, len(store.blocks))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(store.quarantine.quarantines))
+	testutil.Assert(t, !store.quarantine.quarantined(ids[0]), "block failing to load should not be quarantined yet")
+	testutil.Assert(t, !store.quarantine.quarantined(ids[1]), "block failing to be read should not be quarantined yet")
+
+	// Once the blocks failed repeatedly, they are quarantined and the healthy block keeps serving.
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	_, err = series()
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 2.0, promtest.ToFloat64(store.quarantine.quarantines))
+	testutil.Assert(t, store.quarantine.quarantined(ids[0]), "block failing to load should be quarantined")
+	testutil.Assert(t, store.quarantine.quarantined(ids[1]), "block failing to be read should be quarantined")
+
+	res, err := series()
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{`{a="3", ext1="value1"}`}, res)
+
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	res, err = series()
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{`{a="3", ext1="value1"}`}, res)
+	testutil.Equals(t, 2, len(store.blocks))
+
+	// After the retry interval the blocks are retried and quarantined right away if they still fail.
+	store.quarantine.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	testutil.Equals(t, 3.0, promtest.ToFloat64(store.quarantine.quarantines))
+	_, err = series()
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 4.0, promtest.ToFloat64(store.quarantine.quarantines))
+
+	// Quarantined blocks are forgotten once they are deleted.
+	testutil.Ok(t, block.Delete(ctx, logger, bkt, ids[0]))
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	testutil.Assert(t, !store.quarantine.quarantined(ids[0]), "deleted block should not be quarantined")
+}
+
+func TestBucketStore_IndexHeaderFailures_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test_bucket_store_indexheader_failures")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var (
+		logger = log.NewNopLogger()
+		bkt    = inmem.NewBucket()
+		now    = time.Now()
+		ids    []ulid.ULID
+	)
+	for _, lset := range []labels.Labels{labels.FromStrings("a", "1"), labels.FromStrings("a", "2"), labels.FromStrings("a", "3")} {
+		id, err := e2eutil.CreateBlock(ctx, dir, []labels.Labels{lset}, 10, timestamp.FromTime(now.Add(-2*time.Hour)), timestamp.FromTime(now), labels.FromStrings("ext1", "value1"), 0)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String())))
+		testutil.Ok(t, os.RemoveAll(filepath.Join(dir, id.String())))
+		ids = append(ids, id)
+	}
+	// The index of the first block is corrupted, the index of the second one is missing.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ids[0].String(), block.IndexFilename), strings.NewReader("corrupted")))
+	index := path.Join(ids[1].String(), block.IndexFilename)
+	rc, err := bkt.Get(ctx, index)
+	testutil.Ok(t, err)
+	indexContent, err := ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Ok(t, bkt.Delete(ctx, index))
+
+	metaFetcher, err := block.NewMetaFetcher(logger, 20, bkt, dir, nil, nil, nil)
+	testutil.Ok(t, err)
+
+	store, err := NewBucketStore(logger, nil, bkt, metaFetcher, dir, noopCache{}, 0, 0, 20, false, 20, allowAllFilterConf, true, true, true, nil, 0, time.Hour, 0, nil, 0, 0, 0, false, 0)
+	testutil.Ok(t, err)
+
+	failures := func() []IndexHeaderFailure {
+		w := httptest.NewRecorder()
+		store.IndexHeaderFailuresHandler()(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		testutil.Equals(t, http.StatusOK, w.Code)
+
+		var res []IndexHeaderFailure
+		testutil.Ok(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return res
+	}
+
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	testutil.Equals(t, 1, len(store.blocks))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(store.indexHeaderFailures.failures.WithLabelValues(indexHeaderFailureOther)))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(store.indexHeaderFailures.failures.WithLabelValues(indexHeaderFailureNotFound)))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(store.indexHeaderFailures.failures.WithLabelValues(indexHeaderFailureDisk)))
+
+	res := failures()
+	testutil.Equals(t, 2, len(res))
+	expected := map[ulid.ULID]string{ids[0]: indexHeaderFailureOther, ids[1]: indexHeaderFailureNotFound}
+	for _, f := range res {
+		testutil.Equals(t, expected[f.Block], f.Reason)
+		testutil.Equals(t, 2, f.Failures)
+		testutil.Assert(t, f.Error != "", "expected the error of block %s", f.Block)
+	}
+
+	// Blocks are forgotten once their index-header loads, or once they are deleted.
+	testutil.Ok(t, bkt.Upload(ctx, index, bytes.NewReader(indexContent)))
+	testutil.Ok(t, block.Delete(ctx, logger, bkt, ids[0]))
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	testutil.Equals(t, 2, len(store.blocks))
+	testutil.Equals(t, []IndexHeaderFailure{}, failures())
+}
+
+func TestBucketStore_IndexHeaderDiskCache_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test_bucket_store_index_header_disk_cache")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var (
+		logger = log.NewNopLogger()
+		bkt    = inmem.NewBucket()
+		now    = time.Now()
+		ids    []ulid.ULID
+	)
+	for _, lset := range []labels.Labels{labels.FromStrings("a", "1"), labels.FromStrings("a", "2")} {
+		id, err := e2eutil.CreateBlock(ctx, dir, []labels.Labels{lset}, 10, timestamp.FromTime(now.Add(-2*time.Hour)), timestamp.FromTime(now), labels.FromStrings("ext1", "value1"), 0)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String())))
+		testutil.Ok(t, os.RemoveAll(filepath.Join(dir, id.String())))
+		ids = append(ids, id)
+	}
+
+	// start starts a new store gateway on the same local directory, as after a restart.
+	start := func() *BucketStore {
+		metaFetcher, err := block.NewMetaFetcher(logger, 20, bkt, dir, nil, nil, nil)
+		testutil.Ok(t, err)
+
+		store, err := NewBucketStore(logger, nil, bkt, metaFetcher, dir, noopCache{}, 0, 0, 20, false, 20, allowAllFilterConf, true, true, true, nil, 0, 0, 0, nil, 0, 0, 0, false, 0)
+		testutil.Ok(t, err)
+		testutil.Ok(t, store.InitialSync(ctx))
+
+		srv := newStoreSeriesServer(ctx)
+		testutil.Ok(t, store.Series(&storepb.SeriesRequest{
+			Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"}},
+			MinTime:  timestamp.FromTime(now.Add(-2 * time.Hour)),
+			MaxTime:  timestamp.FromTime(now),
+		}, srv))
+		var series []string
+		for _, s := range srv.SeriesSet {
+			series = append(series, storepb.LabelsToPromLabels(s.Labels).String())
+		}
+		testutil.Equals(t, []string{`{a="1", ext1="value1"}`, `{a="2", ext1="value1"}`}, series)
+		testutil.Ok(t, store.Close())
+		return store
+	}
+	lookups := func(store *BucketStore, result string) float64 {
+		return promtest.ToFloat64(store.metrics.indexHeaderCache.WithLabelValues(result))
+	}
+
+	// The first start builds all index-headers.
+	store := start()
+	testutil.Equals(t, 2.0, lookups(store, "miss"))
+	testutil.Equals(t, 0.0, lookups(store, "hit"))
+	for _, id := range ids {
+		m, err := metadata.Read(filepath.Join(dir, id.String()))
+		testutil.Ok(t, err)
+		testutil.Equals(t, id, m.ULID)
+	}
+
+	// A restart reuses the valid cached index-headers.
+	store = start()
+	testutil.Equals(t, 0.0, lookups(store, "miss"))
+	testutil.Equals(t, 2.0, lookups(store, "hit"))
+
+	// A cached index-header not matching the block meta is rebuilt. Replace the index-header of the first block
+	// with the one of the second block, which would return wrong series if used.
+	for _, fn := range []string{block.IndexHeaderFilename, block.MetaFilename} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, ids[1].String(), fn))
+		testutil.Ok(t, err)
+		testutil.Ok(t, ioutil.WriteFile(filepath.Join(dir, ids[0].String(), fn), b, os.ModePerm))
+	}
+	store = start()
+	testutil.Equals(t, 1.0, lookups(store, "stale"))
+	testutil.Equals(t, 1.0, lookups(store, "hit"))
+
+	m, err := metadata.Read(filepath.Join(dir, ids[0].String()))
+	testutil.Ok(t, err)
+	testutil.Equals(t, ids[0], m.ULID)
+
+	store = start()
+	testutil.Equals(t, 0.0, lookups(store, "stale"))
+	testutil.Equals(t, 2.0, lookups(store, "hit"))
+}
+
+func TestBucketStore_SeriesRelabel_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test_bucket_store_series_relabel")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var (
+		logger = log.NewNopLogger()
+		bkt    = inmem.NewBucket()
+		now    = time.Now()
+	)
+	for _, series := range [][]labels.Labels{
+		{labels.FromStrings("a", "1", "b", "1", "internal", "x"), labels.FromStrings("a", "2", "b", "2", "internal", "x")},
+		// This series only differs from the first one by its dropped label, so they are merged.
+		{labels.FromStrings("a", "1", "b", "1", "internal", "y"), labels.FromStrings("a", "3", "b", "3")},
+	} {
+		id, err := e2eutil.CreateBlock(ctx, dir, series, 10, timestamp.FromTime(now.Add(-2*time.Hour)), timestamp.FromTime(now), labels.FromStrings("ext1", "value1"), 0)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String())))
+		testutil.Ok(t, os.RemoveAll(filepath.Join(dir, id.String())))
+	}
+
+	var relabelConfig []*relabel.Config
+	testutil.Ok(t, yaml.Unmarshal([]byte(`
+- action: drop
+  source_labels: [a]
+  regex: "3"
+- action: replace
+  source_labels: [b]
+  target_label: c
+- action: labeldrop
+  regex: b|internal
+`), &relabelConfig))
+
+	metaFetcher, err := block.NewMetaFetcher(logger, 20, bkt, dir, nil, nil, nil)
+	testutil.Ok(t, err)
+
+	store, err := NewBucketStore(logger, nil, bkt, metaFetcher, dir, noopCache{}, 0, 0, 20, false, 20, allowAllFilterConf, true, true, true, nil, 0, 0, 1, relabelConfig, 0, 0, 0, false, 0)
+	testutil.Ok(t, err)
+	testutil.Ok(t, store.SyncBlocks(ctx))
+
+	srv := newStoreSeriesServer(ctx)
+	testutil.Ok(t, store.Series(&storepb.SeriesRequest{
+		Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"}},
+		MinTime:  timestamp.FromTime(now.Add(-2 * time.Hour)),
+		MaxTime:  timestamp.FromTime(now),
+	}, srv))
+
+	var (
+		series []string
+		chunks []int
+	)
+	for _, s := range srv.SeriesSet {
+		series = append(series, storepb.LabelsToPromLabels(s.Labels).String())
+		chunks = append(chunks, len(s.Chunks))
+	}
+	testutil.Equals(t, []string{`{a="1", c="1", ext1="value1"}`, `{a="2", c="2", ext1="value1"}`}, series)
+	testutil.Equals(t, []int{2, 1}, chunks)
+
+	names, err := store.LabelNames(ctx, &storepb.LabelNamesRequest{})
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"a", "c"}, names.Names)
+
+	names, err = store.LabelNames(ctx, &storepb.LabelNamesRequest{
+		Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"}},
+	})
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"a", "c"}, names.Names)
+
+	for _, tcase := range []struct {
+		label    string
+		expected []string
+	}{
+		{label: "a", expected: []string{"1", "2"}},
+		{label: "c", expected: []string{"1", "2"}},
+		{label: "b", expected: []string{}},
+		{label: "internal", expected: []string{}},
+	} {
+		values, err := store.LabelValues(ctx, &storepb.LabelValuesRequest{Label: tcase.label})
+		testutil.Ok(t, err)
+		testutil.Equals(t, tcase.expected, values.Values)
+	}
+}
+
+func TestBucketStore_MaxChunksPerSeries_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test_bucket_store_max_chunks_per_series")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var (
+		logger = log.NewNopLogger()
+		bkt    = inmem.NewBucket()
+		now    = time.Now()
+	)
+	// Chunks are cut every 120 samples, so the first series has 9 chunks and the second one a single chunk.
+	for _, tcase := range []struct {
+		series     labels.Labels
+		numSamples int
+	}{
+		{series: labels.FromStrings("a", "many"), numSamples: 1000},
+		{series: labels.FromStrings("a", "few"), numSamples: 10},
+	} {
+		id, err := e2eutil.CreateBlock(ctx, dir, []labels.Labels{tcase.series}, tcase.numSamples, timestamp.FromTime(now.Add(-2*time.Hour)), timestamp.FromTime(now), labels.FromStrings("ext1", "value1"), 0)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String())))
+		testutil.Ok(t, os.RemoveAll(filepath.Join(dir, id.String())))
+	}
+
+	metaFetcher, err := block.NewMetaFetcher(logger, 20, bkt, dir, nil, nil, nil)
+	testutil.Ok(t, err)
+
+	store, err := NewBucketStore(logger, nil, bkt, metaFetcher, dir, noopCache{}, 0, 0, 20, false, 20, allowAllFilterConf, true, true, true, nil, 0, 0, 0, nil, 5, 0, 0, false, 0)
+	testutil.Ok(t, err)
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	store.quarantine = newBlockQuarantine(logger, nil, 1, time.Hour)
+
+	series := func(value string) (*storeSeriesServer, error) {
+		srv := newStoreSeriesServer(ctx)
+		return srv, store.Series(&storepb.SeriesRequest{
+			Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: value}},
+			MinTime:  timestamp.FromTime(now.Add(-2 * time.Hour)),
+			MaxTime:  timestamp.FromTime(now),
+		}, srv)
+	}
+
+	srv, err := series("few")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(srv.SeriesSet))
+	testutil.Equals(t, 1, len(srv.SeriesSet[0].Chunks))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(store.metrics.queriesDroppedChunks))
+
+	_, err = series("many")
+	testutil.NotOk(t, err)
+	testutil.Equals(t, codes.Aborted, status.Code(err))
+	testutil.Assert(t, strings.Contains(err.Error(), `exceeded chunks limit for series {a="many"}: limit 5 violated (got 6)`), "unexpected error %s", err)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(store.metrics.queriesDroppedChunks))
+
+	// Exceeding the limit is caused by the request, not by a broken block.
+	for _, b := range store.blocks {
+		testutil.Assert(t, !store.quarantine.quarantined(b.meta.ULID), "block %s quarantined", b.meta.ULID)
+	}
+
+	// Series calls not touching the series with many chunks are unaffected.
+	srv, err = series("few")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(srv.SeriesSet))
+}
+
+func TestBucketStore_ChunksPrefetch_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test_bucket_store_chunks_prefetch")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var (
+		logger = log.NewNopLogger()
+		bkt    = &recorder{Bucket: inmem.NewBucket()}
+		mint   = int64(0)
+		mid    = int64(2 * time.Hour / time.Millisecond)
+		maxt   = 2 * mid
+	)
+	for _, r := range [][2]int64{{mint, mid}, {mid, maxt}} {
+		id, err := e2eutil.CreateBlock(ctx, dir, []labels.Labels{labels.FromStrings("a", "1")}, 10, r[0], r[1], labels.FromStrings("ext1", "value1"), 0)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String())))
+		testutil.Ok(t, os.RemoveAll(filepath.Join(dir, id.String())))
+	}
+
+	reg := prometheus.NewRegistry()
+	cacheBkt, err := storecache.NewChunksDiskCache(logger, reg, bkt, filepath.Join(dir, "chunks-cache"), 1e6)
+	testutil.Ok(t, err)
+
+	metaFetcher, err := block.NewMetaFetcher(logger, 20, bkt, dir, nil, nil, nil)
+	testutil.Ok(t, err)
+
+	store, err := NewBucketStore(logger, nil, cacheBkt, metaFetcher, dir, noopCache{}, 0, 0, 20, false, 20, allowAllFilterConf, true, true, true, nil, 0, 0, 0, nil, 0, 1e6, 0, false, 0)
+	testutil.Ok(t, err)
+	testutil.Ok(t, store.SyncBlocks(ctx))
+
+	chunkReads := func() (n int) {
+		bkt.mtx.Lock()
+		defer bkt.mtx.Unlock()
+		for _, name := range append(bkt.getTouched, bkt.getRangeTouched...) {
+			if strings.Contains(name, "/chunks/") {
+				n++
+			}
+		}
+		return n
+	}
+	series := func(mint, maxt int64) {
+		srv := newStoreSeriesServer(ctx)
+		testutil.Ok(t, store.Series(&storepb.SeriesRequest{
+			Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"}},
+			MinTime:  mint,
+			MaxTime:  maxt,
+		}, srv))
+		testutil.Equals(t, 1, len(srv.SeriesSet))
+	}
+
+	// Querying the first block prefetches the chunks of the second one.
+	series(mint, mid-1)
+	store.chunksPrefetch.wait()
+	testutil.Equals(t, 2, chunkReads())
+	testutil.Equals(t, 1.0, promtest.ToFloat64(store.chunksPrefetch.prefetches.WithLabelValues("started")))
+
+	// The following time range is served from the chunks disk cache.
+	series(mid, maxt)
+	store.chunksPrefetch.wait()
+	testutil.Equals(t, 2, chunkReads())
+	testutil.Ok(t, promtest.GatherAndCompare(reg, strings.NewReader(`
+# HELP thanos_store_chunks_disk_cache_prefetch_hits_total Total number of prefetched chunk files read before they were evicted.
+# TYPE thanos_store_chunks_disk_cache_prefetch_hits_total counter
+thanos_store_chunks_disk_cache_prefetch_hits_total 1
+`), "thanos_store_chunks_disk_cache_prefetch_hits_total"))
+}
+
+func TestBucketStore_MaxBlocks_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test_bucket_store_max_blocks")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var (
+		logger = log.NewNopLogger()
+		bkt    = inmem.NewBucket()
+		now    = time.Now()
+	)
+	// Four consecutive blocks of two hours each.
+	for i := 0; i < 4; i++ {
+		maxt := now.Add(-time.Duration(i) * 2 * time.Hour)
+		id, err := e2eutil.CreateBlock(ctx, dir, []labels.Labels{labels.FromStrings("a", "1")}, 100, timestamp.FromTime(maxt.Add(-2*time.Hour)), timestamp.FromTime(maxt), labels.FromStrings("ext1", "value1"), 0)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String())))
+		testutil.Ok(t, os.RemoveAll(filepath.Join(dir, id.String())))
+	}
+
+	metaFetcher, err := block.NewMetaFetcher(logger, 20, bkt, dir, nil, nil, nil)
+	testutil.Ok(t, err)
+
+	store, err := NewBucketStore(logger, nil, bkt, metaFetcher, dir, noopCache{}, 0, 0, 20, false, 20, allowAllFilterConf, true, true, true, nil, 0, 0, 0, nil, 0, 0, 2, false, 0)
+	testutil.Ok(t, err)
+	testutil.Ok(t, store.SyncBlocks(ctx))
+
+	series := func(mint, maxt time.Time) (*storeSeriesServer, error) {
+		srv := newStoreSeriesServer(ctx)
+		return srv, store.Series(&storepb.SeriesRequest{
+			Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"}},
+			MinTime:  timestamp.FromTime(mint),
+			MaxTime:  timestamp.FromTime(maxt),
+		}, srv)
+	}
+
+	// Series calls within the time range of at most two blocks are unaffected.
+	srv, err := series(now.Add(-3*time.Hour), now.Add(-time.Hour))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(srv.SeriesSet))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(store.metrics.queriesDroppedBlocks))
+
+	_, err = series(now.Add(-8*time.Hour), now)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, codes.Aborted, status.Code(err))
+	testutil.Assert(t, strings.Contains(err.Error(), "exceeded blocks limit, narrow the time range or query a downsampled resolution: limit 2 violated (got 4)"), "unexpected error %s", err)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(store.metrics.queriesDroppedBlocks))
+
+	srv, err = series(now.Add(-90*time.Minute), now.Add(-30*time.Minute))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(srv.SeriesSet))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(store.metrics.queriesDroppedBlocks))
+}
+
+func TestBucketStore_ReportGaps_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test_bucket_store_report_gaps")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var (
+		logger = log.NewNopLogger()
+		bkt    = inmem.NewBucket()
+		maxt   = (8 * time.Hour).Milliseconds()
+	)
+	// Four consecutive blocks of two hours each, the second one of them is missing.
+	for i := int64(0); i < 4; i++ {
+		if i == 1 {
+			continue
+		}
+		mint := i * (2 * time.Hour).Milliseconds()
+		id, err := e2eutil.CreateBlock(ctx, dir, []labels.Labels{labels.FromStrings("a", "1")}, 100, mint, mint+(2*time.Hour).Milliseconds(), labels.FromStrings("ext1", "value1"), 0)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String())))
+		testutil.Ok(t, os.RemoveAll(filepath.Join(dir, id.String())))
+	}
+
+	metaFetcher, err := block.NewMetaFetcher(logger, 20, bkt, dir, nil, nil, nil)
+	testutil.Ok(t, err)
+
+	store, err := NewBucketStore(logger, nil, bkt, metaFetcher, dir, noopCache{}, 0, 0, 20, false, 20, allowAllFilterConf, true, true, true, nil, 0, 0, 0, nil, 0, 0, 0, true, 0)
+	testutil.Ok(t, err)
+	testutil.Ok(t, store.SyncBlocks(ctx))
+
+	series := func(mint, maxt int64) *storeSeriesServer {
+		srv := newStoreSeriesServer(ctx)
+		testutil.Ok(t, store.Series(&storepb.SeriesRequest{
+			Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"}},
+			MinTime:  mint,
+			MaxTime:  maxt,
+		}, srv))
+		return srv
+	}
+
+	// The time range of the missing block is reported, the time ranges outside of all blocks are not.
+	srv := series(-time.Hour.Milliseconds(), maxt+time.Hour.Milliseconds())
+	testutil.Equals(t, 1, len(srv.SeriesSet))
+	testutil.Equals(t, []string{`no block covers time range 7200000-14399999 of {ext1="value1"}`}, srv.Warnings)
+
+	srv = series(3*time.Hour.Milliseconds(), 5*time.Hour.Milliseconds())
+	testutil.Equals(t, 1, len(srv.SeriesSet))
+	testutil.Equals(t, []string{`no block covers time range 10800000-14399999 of {ext1="value1"}`}, srv.Warnings)
+
+	// Queries covered by blocks and queries not matching the external labels have no gaps.
+	srv = series(0, 2*time.Hour.Milliseconds()-1)
+	testutil.Equals(t, 1, len(srv.SeriesSet))
+	testutil.Equals(t, 0, len(srv.Warnings))
+
+	srv = newStoreSeriesServer(ctx)
+	testutil.Ok(t, store.Series(&storepb.SeriesRequest{
+		Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "ext1", Value: "value2"}},
+		MinTime:  0,
+		MaxTime:  maxt,
+	}, srv))
+	testutil.Equals(t, 0, len(srv.Warnings))
+
+	testutil.Equals(t, 2.0, promtest.ToFloat64(store.metrics.seriesGaps))
+}
@@ -295,6 +295,55 @@ func TestBucketBlockSet_addGet(t *testing.T) {
 	}
 }
 
+func TestBucketBlockSet_customResolutions(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	set := newBucketBlockSet(labels.Labels{})
+
+	const (
+		res1m = int64(60 * 1000)
+		res1d = int64(24 * 60 * 60 * 1000)
+	)
+	newBlock := func(res, mint, maxt int64) *bucketBlock {
+		var m metadata.Meta
+		m.Thanos.Downsample.Resolution = res
+		m.MinTime = mint
+		m.MaxTime = maxt
+		return &bucketBlock{meta: &m}
+	}
+	for _, b := range []*bucketBlock{
+		newBlock(downsample.ResLevel0, 0, 300),
+		newBlock(res1m, 0, 200),
+		newBlock(res1d, 0, 100),
+		newBlock(downsample.ResLevel1, 100, 200),
+	} {
+		testutil.Ok(t, set.add(b))
+	}
+	testutil.NotOk(t, set.add(newBlock(-1, 0, 100)))
+
+	testutil.Equals(t, []int64{res1d, downsample.ResLevel2, downsample.ResLevel1, res1m, downsample.ResLevel0}, set.resolutions)
+
+	for _, c := range []struct {
+		maxResolution int64
+		exp           []*bucketBlock
+	}{
+		{maxResolution: 0, exp: []*bucketBlock{newBlock(downsample.ResLevel0, 0, 300)}},
+		{maxResolution: res1m, exp: []*bucketBlock{newBlock(res1m, 0, 200), newBlock(downsample.ResLevel0, 0, 300)}},
+		{maxResolution: downsample.ResLevel2, exp: []*bucketBlock{
+			newBlock(res1m, 0, 200),
+			newBlock(downsample.ResLevel1, 100, 200),
+			newBlock(downsample.ResLevel0, 0, 300),
+		}},
+		{maxResolution: res1d, exp: []*bucketBlock{
+			newBlock(res1d, 0, 100),
+			newBlock(downsample.ResLevel1, 100, 200),
+			newBlock(downsample.ResLevel0, 0, 300),
+		}},
+	} {
+		testutil.Equals(t, c.exp, set.getFor(0, 300, c.maxResolution))
+	}
+}
+
 func TestBucketBlockSet_remove(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 
@@ -481,6 +530,16 @@ func TestBucketStore_Info(t *testing.T) {
 		true,
 		true,
 		true,
+		nil,
+		0,
+		0,
+		0,
+		nil,
+		0,
+		0,
+		0,
+		false,
+		0,
 	)
 	testutil.Ok(t, err)
 
@@ -733,6 +792,16 @@ func testSharding(t *testing.T, reuseDisk string, bkt objstore.Bucket, all ...ul
 				true,
 				true,
 				true,
+				nil,
+				0,
+				0,
+				0,
+				nil,
+				0,
+				0,
+				0,
+				false,
+				0,
 			)
 			testutil.Ok(t, err)
 
@@ -920,6 +989,202 @@ func BenchmarkBucketIndexReader_ExpandedPostings(b *testing.B) {
 	benchmarkExpandedPostings(tb, bkt, id, r, 50e5)
 }
 
+func TestBucketIndexReader_DecodeConcurrency(t *testing.T) {
+	tb := testutil.NewTB(t)
+
+	tmpDir, err := ioutil.TempDir("", "test-decode-concurrency")
+	testutil.Ok(tb, err)
+	defer func() { testutil.Ok(tb, os.RemoveAll(tmpDir)) }()
+
+	bkt, err := filesystem.NewBucket(filepath.Join(tmpDir, "bkt"))
+	testutil.Ok(tb, err)
+	defer func() { testutil.Ok(tb, bkt.Close()) }()
+
+	id := uploadTestBlock(tb, tmpDir, bkt, 500)
+	r, err := indexheader.NewBinaryReader(context.Background(), log.NewNopLogger(), bkt, tmpDir, id)
+	testutil.Ok(tb, err)
+
+	benchmarkDecodeConcurrency(tb, bkt, id, r)
+}
+
+func BenchmarkBucketIndexReader_DecodeConcurrency(b *testing.B) {
+	tb := testutil.NewTB(b)
+
+	tmpDir, err := ioutil.TempDir("", "bench-decode-concurrency")
+	testutil.Ok(tb, err)
+	defer func() { testutil.Ok(tb, os.RemoveAll(tmpDir)) }()
+
+	bkt, err := filesystem.NewBucket(filepath.Join(tmpDir, "bkt"))
+	testutil.Ok(tb, err)
+	defer func() { testutil.Ok(tb, bkt.Close()) }()
+
+	id := uploadTestBlock(tb, tmpDir, bkt, 50e4)
+	r, err := indexheader.NewBinaryReader(context.Background(), log.NewNopLogger(), bkt, tmpDir, id)
+	testutil.Ok(tb, err)
+
+	benchmarkDecodeConcurrency(tb, bkt, id, r)
+}
+
+// benchmarkDecodeConcurrency decodes the cached postings and the series of broad matchers with different decode
+// concurrencies, checking that the results are the same as with sequential decoding.
+func benchmarkDecodeConcurrency(t testutil.TB, bkt objstore.BucketReader, id ulid.ULID, r indexheader.Reader) {
+	cache, err := storecache.NewInMemoryIndexCacheWithConfig(log.NewNopLogger(), nil, storecache.InMemoryIndexCacheConfig{
+		MaxItemSize: 1e8,
+		MaxSize:     1e9,
+	})
+	testutil.Ok(t, err)
+
+	newBlock := func(concurrency int) *bucketBlock {
+		return &bucketBlock{
+			logger:                    log.NewNopLogger(),
+			indexHeaderReader:         r,
+			indexCache:                cache,
+			bkt:                       bkt,
+			meta:                      &metadata.Meta{BlockMeta: tsdb.BlockMeta{ULID: id}},
+			partitioner:               gapBasedPartitioner{maxGapSize: partitionerMaxGapSize},
+			seriesRefetches:           newBucketStoreMetrics(nil).seriesRefetches,
+			enablePostingsCompression: true,
+			decodeConcurrency:         concurrency,
+		}
+	}
+	decode := func(t testutil.TB, b *bucketBlock, ms []*labels.Matcher) ([]uint64, []labels.Labels, [][]chunks.Meta) {
+		indexr := newBucketIndexReader(context.Background(), b)
+		ps, err := indexr.ExpandedPostings(ms)
+		testutil.Ok(t, err)
+		testutil.Ok(t, indexr.PreloadSeries(ps))
+		lsets, chks, err := indexr.decodeLoadedSeries(ps)
+		testutil.Ok(t, err)
+		return ps, lsets, chks
+	}
+
+	for _, c := range []struct {
+		name     string
+		matchers []*labels.Matcher
+	}{
+		{name: `i=~".+"`, matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "i", "^.+$")}},
+		{name: `i=~"1.+",j="foo"`, matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "i", "^1.+$"), labels.MustNewMatcher(labels.MatchEqual, "j", "foo")}},
+	} {
+		// The first request fills the cache, so that the postings of the following ones are decoded from it.
+		expectedPostings, expectedLsets, expectedChks := decode(t, newBlock(1), c.matchers)
+		testutil.Assert(t, len(expectedPostings) > 0, "expected postings")
+
+		for _, concurrency := range []int{1, 2, 4, 8} {
+			t.Run(fmt.Sprintf("%s/concurrency=%d", c.name, concurrency), func(t testutil.TB) {
+				b := newBlock(concurrency)
+
+				t.ResetTimer()
+				for i := 0; i < t.N(); i++ {
+					ps, lsets, chks := decode(t, b, c.matchers)
+					if i > 0 {
+						continue
+					}
+					testutil.Equals(t, expectedPostings, ps)
+					testutil.Equals(t, expectedLsets, lsets)
+					testutil.Equals(t, expectedChks, chks)
+				}
+			})
+		}
+	}
+}
+
+func TestBucketStore_LabelNames(t *testing.T) {
+	tb := testutil.NewTB(t)
+
+	tmpDir, err := ioutil.TempDir("", "test-label-names")
+	testutil.Ok(tb, err)
+	defer func() { testutil.Ok(tb, os.RemoveAll(tmpDir)) }()
+
+	bkt, err := filesystem.NewBucket(filepath.Join(tmpDir, "bkt"))
+	testutil.Ok(tb, err)
+	defer func() { testutil.Ok(tb, bkt.Close()) }()
+
+	id := uploadTestBlock(tb, tmpDir, bkt, 500)
+
+	r, err := indexheader.NewBinaryReader(context.Background(), log.NewNopLogger(), bkt, tmpDir, id)
+	testutil.Ok(tb, err)
+
+	benchmarkBucketStoreLabelNames(tb, bkt, id, r)
+}
+
+func BenchmarkBucketStore_LabelNames(b *testing.B) {
+	tb := testutil.NewTB(b)
+
+	tmpDir, err := ioutil.TempDir("", "bench-label-names")
+	testutil.Ok(tb, err)
+	defer func() { testutil.Ok(tb, os.RemoveAll(tmpDir)) }()
+
+	bkt, err := filesystem.NewBucket(filepath.Join(tmpDir, "bkt"))
+	testutil.Ok(tb, err)
+	defer func() { testutil.Ok(tb, bkt.Close()) }()
+
+	id := uploadTestBlock(tb, tmpDir, bkt, 50e4)
+	r, err := indexheader.NewBinaryReader(context.Background(), log.NewNopLogger(), bkt, tmpDir, id)
+	testutil.Ok(tb, err)
+
+	benchmarkBucketStoreLabelNames(tb, bkt, id, r)
+}
+
+func benchmarkBucketStoreLabelNames(t testutil.TB, bkt objstore.BucketReader, id ulid.ULID, r indexheader.Reader) {
+	b := &bucketBlock{
+		logger:            log.NewNopLogger(),
+		indexHeaderReader: r,
+		indexCache:        noopCache{},
+		bkt:               bkt,
+		meta: &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: id},
+			Thanos:    metadata.Thanos{Labels: map[string]string{"ext1": "1"}},
+		},
+		partitioner: gapBasedPartitioner{maxGapSize: partitionerMaxGapSize},
+	}
+	s := &BucketStore{
+		logger: log.NewNopLogger(),
+		blocks: map[ulid.ULID]*bucketBlock{id: b},
+	}
+
+	for _, c := range []struct {
+		name     string
+		matchers []storepb.LabelMatcher
+		expected []string
+	}{
+		{name: "no matchers", expected: []string{"i", "j", "n"}},
+		{
+			name:     `ext1="1"`,
+			matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "ext1", Value: "1"}},
+			expected: []string{"i", "j", "n"},
+		},
+		{
+			name:     `ext1="2"`,
+			matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "ext1", Value: "2"}},
+		},
+		{
+			name:     `n="1"`,
+			matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "n", Value: "1" + postingsBenchSuffix}},
+			expected: []string{"i", "j", "n"},
+		},
+		{
+			name:     `n="1",j="foo"`,
+			matchers: []storepb.LabelMatcher{
+				{Type: storepb.LabelMatcher_EQ, Name: "n", Value: "1" + postingsBenchSuffix},
+				{Type: storepb.LabelMatcher_EQ, Name: "j", Value: "foo"},
+			},
+			expected: []string{"i", "j", "n"},
+		},
+		{
+			name:     `n="non-existing"`,
+			matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "n", Value: "non-existing"}},
+		},
+	} {
+		t.Run(c.name, func(t testutil.TB) {
+			t.ResetTimer()
+			for i := 0; i < t.N(); i++ {
+				resp, err := s.LabelNames(context.Background(), &storepb.LabelNamesRequest{Matchers: c.matchers})
+				testutil.Ok(t, err)
+				testutil.Equals(t, c.expected, resp.Names)
+			}
+		})
+	}
+}
+
 // Make entries ~50B in size, to emulate real-world high cardinality.
 const (
 	postingsBenchSuffix = "aaaaaaaaaabbbbbbbbbbccccccccccdddddddddd"
@@ -1319,6 +1584,9 @@ func benchSeries(t testutil.TB, number int, dimension Dimension, cases ...int) {
 		},
 		queryGate:      noopGater{},
 		samplesLimiter: noopLimiter{},
+		chunksLimiter:  noopLimiter{},
+		blocksLimiter:  noopLimiter{},
+		quarantine:     newBlockQuarantine(logger, nil, 0, 0),
 	}
 
 	for _, block := range blocks {
@@ -1564,6 +1832,9 @@ func TestSeries_OneBlock_InMemIndexCacheSegfault(t *testing.T) {
 		},
 		queryGate:      noopGater{},
 		samplesLimiter: noopLimiter{},
+		chunksLimiter:  noopLimiter{},
+		blocksLimiter:  noopLimiter{},
+		quarantine:     newBlockQuarantine(logger, nil, 0, 0),
 	}
 
 	t.Run("invoke series for one block. Fill the cache on the way.", func(t *testing.T) {
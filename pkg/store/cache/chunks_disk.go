@@ -0,0 +1,415 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package storecache
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	lru "github.com/hashicorp/golang-lru/simplelru"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// chunksDiskCacheTmpSuffix is the suffix of chunk files being downloaded into the cache.
+const chunksDiskCacheTmpSuffix = ".tmp"
+
+// ChunksDiskCache is a bucket reader keeping the chunk files of blocks read from the wrapped bucket on local disk,
+// so that chunks of hot blocks are read from disk instead of the object storage. Chunk files are downloaded
+// on their first read and evicted least recently read first to keep the total size of the files below the
+// configured maximum. Reads of all other objects, and of chunk files larger than the maximum, are passed through.
+type ChunksDiskCache struct {
+	objstore.BucketReader
+
+	logger       log.Logger
+	dir          string
+	maxSizeBytes uint64
+
+	mtx     sync.Mutex
+	lru     *lru.LRU
+	curSize uint64
+	// downloads holds a channel for every chunk file being downloaded, closed once the download is done.
+	downloads map[string]chan struct{}
+	// prefetched holds the chunk files downloaded by Prefetch that were not read yet.
+	prefetched map[string]struct{}
+
+	requests      prometheus.Counter
+	hits          prometheus.Counter
+	added         prometheus.Counter
+	evicted       prometheus.Counter
+	files         prometheus.Gauge
+	size          prometheus.Gauge
+	prefetches    prometheus.Counter
+	prefetchHits  prometheus.Counter
+	prefetchBytes prometheus.Counter
+}
+
+// NewChunksDiskCache returns a new ChunksDiskCache keeping chunk files of the given bucket in the given directory,
+// up to maxSizeBytes in total. Chunk files kept in the directory by a previous cache are reused.
+func NewChunksDiskCache(logger log.Logger, reg prometheus.Registerer, bkt objstore.BucketReader, dir string, maxSizeBytes uint64) (*ChunksDiskCache, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	c := &ChunksDiskCache{
+		BucketReader: bkt,
+		logger:       logger,
+		dir:          dir,
+		maxSizeBytes: maxSizeBytes,
+		downloads:    map[string]chan struct{}{},
+		prefetched:   map[string]struct{}{},
+	}
+
+	c.requests = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_store_chunks_disk_cache_requests_total",
+		Help: "Total number of chunk range reads through the chunks disk cache.",
+	})
+	c.hits = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_store_chunks_disk_cache_hits_total",
+		Help: "Total number of chunk range reads served from a chunk file already on disk.",
+	})
+	c.added = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_store_chunks_disk_cache_files_added_total",
+		Help: "Total number of chunk files downloaded into the chunks disk cache.",
+	})
+	c.evicted = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_store_chunks_disk_cache_files_evicted_total",
+		Help: "Total number of chunk files evicted from the chunks disk cache.",
+	})
+	c.files = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_store_chunks_disk_cache_files",
+		Help: "Current number of chunk files in the chunks disk cache.",
+	})
+	c.size = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_store_chunks_disk_cache_size_bytes",
+		Help: "Current size of the chunk files in the chunks disk cache.",
+	})
+	c.prefetches = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_store_chunks_disk_cache_prefetched_files_total",
+		Help: "Total number of chunk files downloaded into the chunks disk cache ahead of their first read.",
+	})
+	c.prefetchHits = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_store_chunks_disk_cache_prefetch_hits_total",
+		Help: "Total number of prefetched chunk files read before they were evicted.",
+	})
+	c.prefetchBytes = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_store_chunks_disk_cache_prefetched_bytes_total",
+		Help: "Total size of the chunk files downloaded into the chunks disk cache ahead of their first read.",
+	})
+	promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_store_chunks_disk_cache_max_size_bytes",
+		Help: "Maximum size of the chunk files in the chunks disk cache.",
+	}).Set(float64(maxSizeBytes))
+
+	// Initialize LRU cache with a high size limit since we will manage evictions ourselves
+	// based on stored size.
+	l, err := lru.NewLRU(maxInt, c.onEvict)
+	if err != nil {
+		return nil, err
+	}
+	c.lru = l
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, errors.Wrap(err, "create chunks disk cache dir")
+	}
+	if err := c.load(); err != nil {
+		return nil, errors.Wrap(err, "load chunks disk cache")
+	}
+	level.Info(logger).Log("msg", "created chunks disk cache", "dir", dir, "maxSizeBytes", maxSizeBytes, "files", c.lru.Len(), "sizeBytes", c.curSize)
+	return c, nil
+}
+
+// load adds the chunk files found in the cache directory to the cache, least recently modified first.
+// Partially downloaded files are removed.
+func (c *ChunksDiskCache) load() error {
+	type file struct {
+		name string
+		fi   os.FileInfo
+	}
+	var files []file
+	if err := filepath.Walk(c.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(p, chunksDiskCacheTmpSuffix) {
+			return os.Remove(p)
+		}
+		rel, err := filepath.Rel(c.dir, p)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); isChunkFile(name) {
+			files = append(files, file{name: name, fi: fi})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].fi.ModTime().Before(files[j].fi.ModTime()) })
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, f := range files {
+		c.add(f.name, uint64(f.fi.Size()))
+	}
+	return nil
+}
+
+// isChunkFile returns true if the object with the given name is a chunk file of a block.
+func isChunkFile(name string) bool {
+	parts := strings.Split(name, objstore.DirDelim)
+	if len(parts) != 3 || parts[1] != block.ChunksDirname {
+		return false
+	}
+	_, err := ulid.Parse(parts[0])
+	return err == nil
+}
+
+// GetRange returns a new range reader for the given object name and range. Ranges of chunk files are read
+// from disk, downloading the chunk file first if it is not on disk yet.
+func (c *ChunksDiskCache) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if !isChunkFile(name) {
+		return c.BucketReader.GetRange(ctx, name, off, length)
+	}
+	c.requests.Inc()
+
+	ok, hit, err := c.fetch(ctx, name)
+	if hit {
+		c.hits.Inc()
+		c.mtx.Lock()
+		if _, ok := c.prefetched[name]; ok {
+			delete(c.prefetched, name)
+			c.prefetchHits.Inc()
+		}
+		c.mtx.Unlock()
+	}
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "failed to download chunk file into disk cache; reading from bucket", "name", name, "err", err)
+	}
+	if !ok {
+		return c.BucketReader.GetRange(ctx, name, off, length)
+	}
+
+	f, err := os.Open(c.path(name))
+	if err != nil {
+		// Evicted in the meantime.
+		return c.BucketReader.GetRange(ctx, name, off, length)
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		runutil.CloseWithLogOnErr(c.logger, f, "close cached chunk file")
+		return nil, errors.Wrapf(err, "seek %s", f.Name())
+	}
+	if length == -1 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+// Prefetch downloads the given chunk files into the cache in the given order, unless they are on disk already, so
+// that their first read, e.g. by the next query of a dashboard, is served from disk. It stops before the downloads
+// exceed maxBytes in total, and returns the size of the downloaded chunk files. Other objects are ignored.
+func (c *ChunksDiskCache) Prefetch(ctx context.Context, names []string, maxBytes uint64) (uint64, error) {
+	var downloaded uint64
+	for _, name := range names {
+		if !isChunkFile(name) || c.cached(name) {
+			continue
+		}
+		size, err := c.BucketReader.ObjectSize(ctx, name)
+		if err != nil {
+			return downloaded, errors.Wrapf(err, "get size of %s", name)
+		}
+		if downloaded+size > maxBytes {
+			break
+		}
+		ok, hit, err := c.fetch(ctx, name)
+		if err != nil {
+			return downloaded, errors.Wrapf(err, "prefetch %s", name)
+		}
+		if !ok || hit {
+			continue
+		}
+		downloaded += size
+
+		c.mtx.Lock()
+		if _, ok := c.lru.Peek(name); ok {
+			c.prefetched[name] = struct{}{}
+		}
+		c.mtx.Unlock()
+		c.prefetches.Inc()
+		c.prefetchBytes.Add(float64(size))
+	}
+	return downloaded, nil
+}
+
+// cached returns true if the given chunk file is on disk or being downloaded, without marking it as read.
+func (c *ChunksDiskCache) cached(name string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if _, ok := c.downloads[name]; ok {
+		return true
+	}
+	return c.lru.Contains(name)
+}
+
+// fetch ensures the given chunk file is on disk, downloading it if needed. It returns false if the chunk file is
+// not cached, e.g. because it is larger than the cache size, and whether the chunk file was on disk already.
+func (c *ChunksDiskCache) fetch(ctx context.Context, name string) (ok bool, hit bool, _ error) {
+	waited := false
+	for {
+		c.mtx.Lock()
+		if _, ok := c.lru.Get(name); ok {
+			c.mtx.Unlock()
+			return true, !waited, nil
+		}
+		done, ok := c.downloads[name]
+		if !ok {
+			break
+		}
+		c.mtx.Unlock()
+
+		// Wait for the concurrent download of the chunk file instead of downloading it again.
+		if waited {
+			return false, false, nil
+		}
+		select {
+		case <-ctx.Done():
+			return false, false, ctx.Err()
+		case <-done:
+		}
+		waited = true
+	}
+	if waited {
+		// The concurrent download did not add the chunk file.
+		c.mtx.Unlock()
+		return false, false, nil
+	}
+	done := make(chan struct{})
+	c.downloads[name] = done
+	c.mtx.Unlock()
+
+	size, err := c.download(ctx, name)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.downloads, name)
+	close(done)
+
+	if err != nil || size == 0 {
+		return false, false, err
+	}
+	c.add(name, size)
+	c.added.Inc()
+	return true, false, nil
+}
+
+// download downloads the given chunk file to disk and returns its size. It returns zero without downloading
+// the chunk file if it is larger than the cache size.
+func (c *ChunksDiskCache) download(ctx context.Context, name string) (_ uint64, err error) {
+	size, err := c.BucketReader.ObjectSize(ctx, name)
+	if err != nil {
+		return 0, errors.Wrap(err, "get size")
+	}
+	if size > c.maxSizeBytes {
+		level.Debug(c.logger).Log("msg", "chunk file larger than chunks disk cache; not caching", "name", name, "size", size)
+		return 0, nil
+	}
+
+	rc, err := c.BucketReader.Get(ctx, name)
+	if err != nil {
+		return 0, errors.Wrap(err, "get")
+	}
+	defer runutil.CloseWithLogOnErr(c.logger, rc, "close chunk file reader")
+
+	p := c.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return 0, err
+	}
+	tmp := p + chunksDiskCacheTmpSuffix
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp)
+		}
+	}()
+
+	n, err := io.Copy(f, rc)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, errors.Wrapf(err, "write %s", tmp)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return 0, err
+	}
+	return uint64(n), nil
+}
+
+// add adds the given chunk file on disk to the cache, evicting the least recently read chunk files to make space.
+// It requires the lock to be held.
+func (c *ChunksDiskCache) add(name string, size uint64) {
+	for c.curSize+size > c.maxSizeBytes && c.lru.Len() > 0 {
+		c.lru.RemoveOldest()
+	}
+	if c.curSize+size > c.maxSizeBytes {
+		c.remove(name)
+		return
+	}
+	c.lru.Add(name, size)
+	c.curSize += size
+	c.files.Set(float64(c.lru.Len()))
+	c.size.Set(float64(c.curSize))
+}
+
+func (c *ChunksDiskCache) onEvict(key, val interface{}) {
+	name := key.(string)
+	c.remove(name)
+	delete(c.prefetched, name)
+	c.curSize -= val.(uint64)
+	c.evicted.Inc()
+	c.files.Set(float64(c.lru.Len()))
+	c.size.Set(float64(c.curSize))
+}
+
+// remove removes the given chunk file from disk, together with the directories of its block if they are empty.
+// Readers of the chunk file can read it until they are closed.
+func (c *ChunksDiskCache) remove(name string) {
+	if err := os.Remove(c.path(name)); err != nil && !os.IsNotExist(err) {
+		level.Warn(c.logger).Log("msg", "failed to remove evicted chunk file", "name", name, "err", err)
+		return
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if files, err := ioutil.ReadDir(c.path(dir)); err != nil || len(files) > 0 {
+			return
+		}
+		_ = os.Remove(c.path(dir))
+	}
+}
+
+func (c *ChunksDiskCache) path(name string) string {
+	return filepath.Join(c.dir, filepath.FromSlash(name))
+}
@@ -0,0 +1,194 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package storecache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/oklog/ulid"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// readCountingBucket counts the reads of objects from the bucket.
+type readCountingBucket struct {
+	objstore.Bucket
+	reads int32
+}
+
+func (b *readCountingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	atomic.AddInt32(&b.reads, 1)
+	return b.Bucket.Get(ctx, name)
+}
+
+func (b *readCountingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	atomic.AddInt32(&b.reads, 1)
+	return b.Bucket.GetRange(ctx, name, off, length)
+}
+
+func TestChunksDiskCache(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "test-chunks-disk-cache")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	id := ulid.MustNew(1, nil).String()
+	chunks1 := path.Join(id, "chunks", "000001")
+	chunks2 := path.Join(id, "chunks", "000002")
+	chunks3 := path.Join(id, "chunks", "000003")
+	index := path.Join(id, "index")
+
+	bkt := &readCountingBucket{Bucket: inmem.NewBucket()}
+	for _, name := range []string{chunks1, chunks2, index} {
+		testutil.Ok(t, bkt.Upload(ctx, name, bytes.NewReader([]byte("0123456789"))))
+	}
+	testutil.Ok(t, bkt.Upload(ctx, chunks3, bytes.NewReader([]byte("0123456789abcdefghijk"))))
+
+	cache, err := NewChunksDiskCache(nil, nil, bkt, dir, 20)
+	testutil.Ok(t, err)
+
+	read := func(t *testing.T, name string, off, length int64) string {
+		t.Helper()
+		rc, err := cache.GetRange(ctx, name, off, length)
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, rc.Close()) }()
+		b, err := ioutil.ReadAll(rc)
+		testutil.Ok(t, err)
+		return string(b)
+	}
+
+	t.Run("second read avoids object store", func(t *testing.T) {
+		testutil.Equals(t, "234", read(t, chunks1, 2, 3))
+		testutil.Equals(t, int32(1), atomic.LoadInt32(&bkt.reads))
+
+		testutil.Equals(t, "789", read(t, chunks1, 7, 3))
+		testutil.Equals(t, "56789", read(t, chunks1, 5, -1))
+		testutil.Equals(t, int32(1), atomic.LoadInt32(&bkt.reads))
+
+		testutil.Equals(t, 3.0, promtest.ToFloat64(cache.requests))
+		testutil.Equals(t, 2.0, promtest.ToFloat64(cache.hits))
+		testutil.Equals(t, 10.0, promtest.ToFloat64(cache.size))
+	})
+
+	t.Run("other objects are not cached", func(t *testing.T) {
+		testutil.Equals(t, "234", read(t, index, 2, 3))
+		testutil.Equals(t, "234", read(t, index, 2, 3))
+		testutil.Equals(t, int32(3), atomic.LoadInt32(&bkt.reads))
+		testutil.Equals(t, 3.0, promtest.ToFloat64(cache.requests))
+	})
+
+	t.Run("files larger than cache are not cached", func(t *testing.T) {
+		testutil.Equals(t, "abc", read(t, chunks3, 10, 3))
+		testutil.Equals(t, "abc", read(t, chunks3, 10, 3))
+		testutil.Equals(t, int32(5), atomic.LoadInt32(&bkt.reads))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(cache.files))
+	})
+
+	t.Run("least recently read files are evicted", func(t *testing.T) {
+		bkt.reads = 0
+		testutil.Equals(t, "0", read(t, chunks2, 0, 1))
+		testutil.Equals(t, 2.0, promtest.ToFloat64(cache.files))
+		testutil.Equals(t, 20.0, promtest.ToFloat64(cache.size))
+
+		// Make space for another file, evicting chunks1 as it was read before chunks2.
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id, "chunks", "000004"), bytes.NewReader([]byte("0123456789"))))
+		testutil.Equals(t, "0", read(t, path.Join(id, "chunks", "000004"), 0, 1))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(cache.evicted))
+		testutil.Equals(t, 20.0, promtest.ToFloat64(cache.size))
+
+		_, err := os.Stat(cache.path(chunks1))
+		testutil.Assert(t, os.IsNotExist(err), "expected evicted chunk file to be removed")
+
+		testutil.Equals(t, "0", read(t, chunks2, 0, 1))
+		testutil.Equals(t, int32(2), atomic.LoadInt32(&bkt.reads))
+	})
+
+	t.Run("concurrent reads download once", func(t *testing.T) {
+		bkt.reads = 0
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rc, err := cache.GetRange(ctx, chunks1, 0, 1)
+				testutil.Ok(t, err)
+				testutil.Ok(t, rc.Close())
+			}()
+		}
+		wg.Wait()
+		testutil.Equals(t, int32(1), atomic.LoadInt32(&bkt.reads))
+	})
+
+	t.Run("files on disk are reused", func(t *testing.T) {
+		bkt.reads = 0
+		reopened, err := NewChunksDiskCache(nil, nil, bkt, dir, 20)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 2.0, promtest.ToFloat64(reopened.files))
+
+		rc, err := reopened.GetRange(ctx, chunks1, 0, 1)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, int32(0), atomic.LoadInt32(&bkt.reads))
+	})
+}
+
+func TestChunksDiskCache_Prefetch(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "test-chunks-disk-cache-prefetch")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	id := ulid.MustNew(1, nil).String()
+	chunks1 := path.Join(id, "chunks", "000001")
+	chunks2 := path.Join(id, "chunks", "000002")
+	chunks3 := path.Join(id, "chunks", "000003")
+	index := path.Join(id, "index")
+
+	bkt := &readCountingBucket{Bucket: inmem.NewBucket()}
+	for _, name := range []string{chunks1, chunks2, chunks3, index} {
+		testutil.Ok(t, bkt.Upload(ctx, name, bytes.NewReader([]byte("0123456789"))))
+	}
+
+	cache, err := NewChunksDiskCache(nil, nil, bkt, dir, 100)
+	testutil.Ok(t, err)
+
+	// The budget only allows two of the chunk files, the index is ignored.
+	n, err := cache.Prefetch(ctx, []string{index, chunks1, chunks2, chunks3}, 25)
+	testutil.Ok(t, err)
+	testutil.Equals(t, uint64(20), n)
+	testutil.Equals(t, int32(2), atomic.LoadInt32(&bkt.reads))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(cache.prefetches))
+	testutil.Equals(t, 20.0, promtest.ToFloat64(cache.prefetchBytes))
+
+	// Files on disk are not downloaded again.
+	n, err = cache.Prefetch(ctx, []string{chunks1, chunks2}, 25)
+	testutil.Ok(t, err)
+	testutil.Equals(t, uint64(0), n)
+	testutil.Equals(t, int32(2), atomic.LoadInt32(&bkt.reads))
+
+	// Reads of prefetched files are served from disk, and only the first read counts as prefetch hit.
+	for i := 0; i < 2; i++ {
+		rc, err := cache.GetRange(ctx, chunks1, 2, 3)
+		testutil.Ok(t, err)
+		b, err := ioutil.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, "234", string(b))
+	}
+	testutil.Equals(t, int32(2), atomic.LoadInt32(&bkt.reads))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(cache.hits))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(cache.prefetchHits))
+}
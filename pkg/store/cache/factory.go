@@ -24,8 +24,10 @@ const (
 
 // IndexCacheConfig specifies the index cache config.
 type IndexCacheConfig struct {
-	Type   IndexCacheProvider `yaml:"type"`
-	Config interface{}        `yaml:"config"`
+	Type IndexCacheProvider `yaml:"type"`
+	// Namespace prefixes the keys of remote caches, isolating the entries of store gateways sharing a cache.
+	Namespace string      `yaml:"namespace"`
+	Config    interface{} `yaml:"config"`
 }
 
 // NewIndexCache initializes and returns new index cache.
@@ -49,7 +51,7 @@ func NewIndexCache(logger log.Logger, confContentYaml []byte, reg prometheus.Reg
 		var memcached cacheutil.MemcachedClient
 		memcached, err = cacheutil.NewMemcachedClient(logger, "index-cache", backendConfig, reg)
 		if err == nil {
-			cache, err = NewMemcachedIndexCache(logger, memcached, reg)
+			cache, err = NewMemcachedIndexCache(logger, memcached, reg, cacheConfig.Namespace)
 		}
 	default:
 		return nil, errors.Errorf("index cache with type %s is not supported", cacheConfig.Type)
@@ -52,9 +52,9 @@ type InMemoryIndexCache struct {
 
 // InMemoryIndexCacheConfig holds the in-memory index cache config.
 type InMemoryIndexCacheConfig struct {
-	// MaxSize represents overall maximum number of bytes cache can contain.
+	// MaxSize represents overall maximum number of bytes cache can contain, including both keys and values.
 	MaxSize model.Bytes `yaml:"max_size"`
-	// MaxItemSize represents maximum size of single item.
+	// MaxItemSize represents maximum size of single item, including its key.
 	MaxItemSize model.Bytes `yaml:"max_item_size"`
 }
 
@@ -180,14 +180,14 @@ func NewInMemoryIndexCacheWithConfig(logger log.Logger, reg prometheus.Registere
 
 func (c *InMemoryIndexCache) onEvict(key, val interface{}) {
 	k := key.(cacheKey).keyType()
-	entrySize := sliceHeaderSize + uint64(len(val.([]byte)))
+	valSize := sliceHeaderSize + uint64(len(val.([]byte)))
 
 	c.evicted.WithLabelValues(string(k)).Inc()
 	c.current.WithLabelValues(string(k)).Dec()
-	c.currentSize.WithLabelValues(string(k)).Sub(float64(entrySize))
-	c.totalCurrentSize.WithLabelValues(string(k)).Sub(float64(entrySize + key.(cacheKey).size()))
+	c.currentSize.WithLabelValues(string(k)).Sub(float64(valSize))
+	c.totalCurrentSize.WithLabelValues(string(k)).Sub(float64(valSize + key.(cacheKey).size()))
 
-	c.curSize -= entrySize
+	c.curSize -= valSize + key.(cacheKey).size()
 }
 
 func (c *InMemoryIndexCache) get(typ string, key cacheKey) ([]byte, bool) {
@@ -205,7 +205,11 @@ func (c *InMemoryIndexCache) get(typ string, key cacheKey) ([]byte, bool) {
 }
 
 func (c *InMemoryIndexCache) set(typ string, key cacheKey, val []byte) {
-	var size = sliceHeaderSize + uint64(len(val))
+	var valSize = sliceHeaderSize + uint64(len(val))
+	// The cost of an entry in the cache is the size of both its value and its key, so that
+	// many small entries whose keys are as big as their values are not undercharged
+	// compared to few big ones.
+	var size = valSize + key.size()
 
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
@@ -226,13 +230,14 @@ func (c *InMemoryIndexCache) set(typ string, key cacheKey, val []byte) {
 	c.lru.Add(key, v)
 
 	c.added.WithLabelValues(typ).Inc()
-	c.currentSize.WithLabelValues(typ).Add(float64(size))
-	c.totalCurrentSize.WithLabelValues(typ).Add(float64(size + key.size()))
+	c.currentSize.WithLabelValues(typ).Add(float64(valSize))
+	c.totalCurrentSize.WithLabelValues(typ).Add(float64(size))
 	c.current.WithLabelValues(typ).Inc()
 	c.curSize += size
 }
 
-// ensureFits tries to make sure that the passed slice will fit into the LRU cache.
+// ensureFits tries to make sure that an entry of the given size will fit into the LRU cache,
+// evicting the least recently used entries until enough bytes are free.
 // Returns true if it will fit.
 func (c *InMemoryIndexCache) ensureFits(size uint64, typ string) bool {
 	if size > c.maxItemSizeBytes {
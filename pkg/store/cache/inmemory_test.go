@@ -9,6 +9,7 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"math/rand"
 	"testing"
 	"time"
 
@@ -55,8 +56,8 @@ func TestInMemoryIndexCache_AvoidsDeadlock(t *testing.T) {
 
 	metrics := prometheus.NewRegistry()
 	cache, err := NewInMemoryIndexCacheWithConfig(log.NewNopLogger(), metrics, InMemoryIndexCacheConfig{
-		MaxItemSize: sliceHeaderSize + 5,
-		MaxSize:     sliceHeaderSize + 5,
+		MaxItemSize: sliceHeaderSize + 5 + 54,
+		MaxSize:     sliceHeaderSize + 5 + 54,
 	})
 	testutil.Ok(t, err)
 
@@ -72,22 +73,23 @@ func TestInMemoryIndexCache_AvoidsDeadlock(t *testing.T) {
 	ctx := context.Background()
 	cache.StorePostings(ctx, ulid.MustNew(0, nil), labels.Label{Name: "test2", Value: "1"}, []byte{42, 33, 14, 67, 11})
 
-	testutil.Equals(t, uint64(sliceHeaderSize+5), cache.curSize)
-	testutil.Equals(t, float64(cache.curSize), promtest.ToFloat64(cache.currentSize.WithLabelValues(cacheTypePostings)))
+	testutil.Equals(t, uint64(sliceHeaderSize+5+54), cache.curSize)
+	testutil.Equals(t, float64(cache.curSize), promtest.ToFloat64(cache.totalCurrentSize.WithLabelValues(cacheTypePostings)))
 	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.current.WithLabelValues(cacheTypePostings)))
 
 	// This triggers deadlock logic.
 	cache.StorePostings(ctx, ulid.MustNew(0, nil), labels.Label{Name: "test1", Value: "1"}, []byte{42})
 
-	testutil.Equals(t, uint64(sliceHeaderSize+1), cache.curSize)
-	testutil.Equals(t, float64(cache.curSize), promtest.ToFloat64(cache.currentSize.WithLabelValues(cacheTypePostings)))
+	testutil.Equals(t, uint64(sliceHeaderSize+1+54), cache.curSize)
+	testutil.Equals(t, float64(cache.curSize), promtest.ToFloat64(cache.totalCurrentSize.WithLabelValues(cacheTypePostings)))
 	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.current.WithLabelValues(cacheTypePostings)))
 }
 
 func TestInMemoryIndexCache_UpdateItem(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 
-	const maxSize = 2 * (sliceHeaderSize + 1)
+	// Fits a single postings entry with a 2 bytes value and its 54 bytes key, but not two of the entries below.
+	const maxSize = sliceHeaderSize + 2 + 54
 
 	var errorLogs []string
 	errorLogger := log.LoggerFunc(func(kvs ...interface{}) error {
@@ -194,8 +196,8 @@ func TestInMemoryIndexCache_MaxNumberOfItemsHit(t *testing.T) {
 
 	metrics := prometheus.NewRegistry()
 	cache, err := NewInMemoryIndexCacheWithConfig(log.NewNopLogger(), metrics, InMemoryIndexCacheConfig{
-		MaxItemSize: 2*sliceHeaderSize + 10,
-		MaxSize:     2*sliceHeaderSize + 10,
+		MaxItemSize: 3 * (sliceHeaderSize + 2 + 55),
+		MaxSize:     3 * (sliceHeaderSize + 2 + 55),
 	})
 	testutil.Ok(t, err)
 
@@ -210,7 +212,7 @@ func TestInMemoryIndexCache_MaxNumberOfItemsHit(t *testing.T) {
 	cache.StorePostings(ctx, id, labels.Label{Name: "test", Value: "124"}, []byte{42, 33})
 	cache.StorePostings(ctx, id, labels.Label{Name: "test", Value: "125"}, []byte{42, 33})
 
-	testutil.Equals(t, uint64(2*sliceHeaderSize+4), cache.curSize)
+	testutil.Equals(t, uint64(2*(sliceHeaderSize+2+55)), cache.curSize)
 	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.overflow.WithLabelValues(cacheTypePostings)))
 	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.overflow.WithLabelValues(cacheTypeSeries)))
 	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.evicted.WithLabelValues(cacheTypePostings)))
@@ -228,8 +230,8 @@ func TestInMemoryIndexCache_Eviction_WithMetrics(t *testing.T) {
 
 	metrics := prometheus.NewRegistry()
 	cache, err := NewInMemoryIndexCacheWithConfig(log.NewNopLogger(), metrics, InMemoryIndexCacheConfig{
-		MaxItemSize: 2*sliceHeaderSize + 5,
-		MaxSize:     2*sliceHeaderSize + 5,
+		MaxItemSize: 2 * (sliceHeaderSize + 55),
+		MaxSize:     2 * (sliceHeaderSize + 55),
 	})
 	testutil.Ok(t, err)
 
@@ -245,9 +247,9 @@ func TestInMemoryIndexCache_Eviction_WithMetrics(t *testing.T) {
 	testutil.Equals(t, emptyPostingsHits, pHits, "no such key")
 	testutil.Equals(t, []labels.Label{lbls}, pMisses)
 
-	// Add sliceHeaderSize + 2 bytes.
+	// Add sliceHeaderSize + 2 bytes and 55 bytes of key.
 	cache.StorePostings(ctx, id, lbls, []byte{42, 33})
-	testutil.Equals(t, uint64(sliceHeaderSize+2), cache.curSize)
+	testutil.Equals(t, uint64(sliceHeaderSize+2+55), cache.curSize)
 	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.current.WithLabelValues(cacheTypePostings)))
 	testutil.Equals(t, float64(sliceHeaderSize+2), promtest.ToFloat64(cache.currentSize.WithLabelValues(cacheTypePostings)))
 	testutil.Equals(t, float64(sliceHeaderSize+2+55), promtest.ToFloat64(cache.totalCurrentSize.WithLabelValues(cacheTypePostings)))
@@ -271,9 +273,9 @@ func TestInMemoryIndexCache_Eviction_WithMetrics(t *testing.T) {
 	testutil.Equals(t, emptyPostingsHits, pHits, "no such key")
 	testutil.Equals(t, []labels.Label{{Name: "test", Value: "124"}}, pMisses)
 
-	// Add sliceHeaderSize + 3 more bytes.
+	// Add sliceHeaderSize + 3 more bytes and 24 bytes of key.
 	cache.StoreSeries(ctx, id, 1234, []byte{222, 223, 224})
-	testutil.Equals(t, uint64(2*sliceHeaderSize+5), cache.curSize)
+	testutil.Equals(t, uint64(2*sliceHeaderSize+5+55+24), cache.curSize)
 	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.current.WithLabelValues(cacheTypePostings)))
 	testutil.Equals(t, float64(sliceHeaderSize+2), promtest.ToFloat64(cache.currentSize.WithLabelValues(cacheTypePostings)))
 	testutil.Equals(t, float64(sliceHeaderSize+2+55), promtest.ToFloat64(cache.totalCurrentSize.WithLabelValues(cacheTypePostings)))
@@ -291,17 +293,17 @@ func TestInMemoryIndexCache_Eviction_WithMetrics(t *testing.T) {
 
 	lbls2 := labels.Label{Name: "test", Value: "124"}
 
-	// Add sliceHeaderSize + 5 + 16 bytes, should fully evict 2 last items.
+	// Add sliceHeaderSize + 5 + (sliceHeaderSize + 50) bytes and 55 bytes of key, should fully evict 2 last items.
 	v := []byte{42, 33, 14, 67, 11}
-	for i := 0; i < sliceHeaderSize; i++ {
+	for i := 0; i < sliceHeaderSize+50; i++ {
 		v = append(v, 3)
 	}
 	cache.StorePostings(ctx, id, lbls2, v)
 
-	testutil.Equals(t, uint64(2*sliceHeaderSize+5), cache.curSize)
+	testutil.Equals(t, uint64(2*(sliceHeaderSize+55)), cache.curSize)
 	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.current.WithLabelValues(cacheTypePostings)))
-	testutil.Equals(t, float64(2*sliceHeaderSize+5), promtest.ToFloat64(cache.currentSize.WithLabelValues(cacheTypePostings)))
-	testutil.Equals(t, float64(2*sliceHeaderSize+5+55), promtest.ToFloat64(cache.totalCurrentSize.WithLabelValues(cacheTypePostings)))
+	testutil.Equals(t, float64(2*sliceHeaderSize+55), promtest.ToFloat64(cache.currentSize.WithLabelValues(cacheTypePostings)))
+	testutil.Equals(t, float64(2*(sliceHeaderSize+55)), promtest.ToFloat64(cache.totalCurrentSize.WithLabelValues(cacheTypePostings)))
 	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.current.WithLabelValues(cacheTypeSeries)))
 	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.currentSize.WithLabelValues(cacheTypeSeries)))
 	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.totalCurrentSize.WithLabelValues(cacheTypeSeries)))
@@ -326,10 +328,10 @@ func TestInMemoryIndexCache_Eviction_WithMetrics(t *testing.T) {
 	// Add same item again.
 	cache.StorePostings(ctx, id, lbls2, v)
 
-	testutil.Equals(t, uint64(2*sliceHeaderSize+5), cache.curSize)
+	testutil.Equals(t, uint64(2*(sliceHeaderSize+55)), cache.curSize)
 	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.current.WithLabelValues(cacheTypePostings)))
-	testutil.Equals(t, float64(2*sliceHeaderSize+5), promtest.ToFloat64(cache.currentSize.WithLabelValues(cacheTypePostings)))
-	testutil.Equals(t, float64(2*sliceHeaderSize+5+55), promtest.ToFloat64(cache.totalCurrentSize.WithLabelValues(cacheTypePostings)))
+	testutil.Equals(t, float64(2*sliceHeaderSize+55), promtest.ToFloat64(cache.currentSize.WithLabelValues(cacheTypePostings)))
+	testutil.Equals(t, float64(2*(sliceHeaderSize+55)), promtest.ToFloat64(cache.totalCurrentSize.WithLabelValues(cacheTypePostings)))
 	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.current.WithLabelValues(cacheTypeSeries)))
 	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.currentSize.WithLabelValues(cacheTypeSeries)))
 	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.totalCurrentSize.WithLabelValues(cacheTypeSeries)))
@@ -344,10 +346,10 @@ func TestInMemoryIndexCache_Eviction_WithMetrics(t *testing.T) {
 
 	// Add too big item.
 	cache.StorePostings(ctx, id, labels.Label{Name: "test", Value: "toobig"}, append(v, 5))
-	testutil.Equals(t, uint64(2*sliceHeaderSize+5), cache.curSize)
+	testutil.Equals(t, uint64(2*(sliceHeaderSize+55)), cache.curSize)
 	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.current.WithLabelValues(cacheTypePostings)))
-	testutil.Equals(t, float64(2*sliceHeaderSize+5), promtest.ToFloat64(cache.currentSize.WithLabelValues(cacheTypePostings)))
-	testutil.Equals(t, float64(2*sliceHeaderSize+5+55), promtest.ToFloat64(cache.totalCurrentSize.WithLabelValues(cacheTypePostings)))
+	testutil.Equals(t, float64(2*sliceHeaderSize+55), promtest.ToFloat64(cache.currentSize.WithLabelValues(cacheTypePostings)))
+	testutil.Equals(t, float64(2*(sliceHeaderSize+55)), promtest.ToFloat64(cache.totalCurrentSize.WithLabelValues(cacheTypePostings)))
 	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.current.WithLabelValues(cacheTypeSeries)))
 	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.currentSize.WithLabelValues(cacheTypeSeries)))
 	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.totalCurrentSize.WithLabelValues(cacheTypeSeries)))
@@ -378,7 +380,7 @@ func TestInMemoryIndexCache_Eviction_WithMetrics(t *testing.T) {
 
 	cache.StorePostings(ctx, id, lbls3, []byte{})
 
-	testutil.Equals(t, uint64(sliceHeaderSize), cache.curSize)
+	testutil.Equals(t, uint64(sliceHeaderSize+55), cache.curSize)
 	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.current.WithLabelValues(cacheTypePostings)))
 	testutil.Equals(t, float64(sliceHeaderSize), promtest.ToFloat64(cache.currentSize.WithLabelValues(cacheTypePostings)))
 	testutil.Equals(t, float64(sliceHeaderSize+55), promtest.ToFloat64(cache.totalCurrentSize.WithLabelValues(cacheTypePostings)))
@@ -398,7 +400,7 @@ func TestInMemoryIndexCache_Eviction_WithMetrics(t *testing.T) {
 	lbls4 := labels.Label{Name: "test", Value: "125"}
 	cache.StorePostings(ctx, id, lbls4, []byte(nil))
 
-	testutil.Equals(t, 2*uint64(sliceHeaderSize), cache.curSize)
+	testutil.Equals(t, 2*uint64(sliceHeaderSize+55), cache.curSize)
 	testutil.Equals(t, float64(2), promtest.ToFloat64(cache.current.WithLabelValues(cacheTypePostings)))
 	testutil.Equals(t, 2*float64(sliceHeaderSize), promtest.ToFloat64(cache.currentSize.WithLabelValues(cacheTypePostings)))
 	testutil.Equals(t, 2*float64(sliceHeaderSize+55), promtest.ToFloat64(cache.totalCurrentSize.WithLabelValues(cacheTypePostings)))
@@ -422,3 +424,41 @@ func TestInMemoryIndexCache_Eviction_WithMetrics(t *testing.T) {
 	testutil.Equals(t, float64(5), promtest.ToFloat64(cache.hits.WithLabelValues(cacheTypePostings)))
 	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.hits.WithLabelValues(cacheTypeSeries)))
 }
+
+func TestInMemoryIndexCache_MixedSizes(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	const maxSize = 64 * 1024
+
+	metrics := prometheus.NewRegistry()
+	cache, err := NewInMemoryIndexCacheWithConfig(log.NewNopLogger(), metrics, InMemoryIndexCacheConfig{
+		MaxItemSize: maxSize / 4,
+		MaxSize:     maxSize,
+	})
+	testutil.Ok(t, err)
+
+	ctx := context.Background()
+	id := ulid.MustNew(0, nil)
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < 2000; i++ {
+		if r.Intn(2) == 0 {
+			cache.StorePostings(ctx, id, labels.Label{Name: "name", Value: fmt.Sprintf("value-%d", i)}, make([]byte, 1024+r.Intn(4*1024)))
+		} else {
+			cache.StoreSeries(ctx, id, uint64(i), make([]byte, 10+r.Intn(100)))
+		}
+
+		// The accounted size must match the actual size of all keys and values in the cache.
+		var size uint64
+		for _, k := range cache.lru.Keys() {
+			v, ok := cache.lru.Peek(k)
+			testutil.Assert(t, ok, "key %v not in cache", k)
+			size += sliceHeaderSize + uint64(len(v.([]byte))) + k.(cacheKey).size()
+		}
+		testutil.Equals(t, size, cache.curSize)
+		testutil.Assert(t, cache.curSize <= maxSize, "cache size %d exceeds budget %d", cache.curSize, maxSize)
+		testutil.Equals(t, float64(size), promtest.ToFloat64(cache.totalCurrentSize.WithLabelValues(cacheTypePostings))+
+			promtest.ToFloat64(cache.totalCurrentSize.WithLabelValues(cacheTypeSeries)))
+	}
+	testutil.Assert(t, promtest.ToFloat64(cache.evicted.WithLabelValues(cacheTypePostings)) > 0, "postings should have been evicted")
+	testutil.Assert(t, promtest.ToFloat64(cache.evicted.WithLabelValues(cacheTypeSeries)) > 0, "series should have been evicted")
+}
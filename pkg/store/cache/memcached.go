@@ -5,11 +5,13 @@ package storecache
 
 import (
 	"context"
+	"regexp"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/prometheus/pkg/labels"
@@ -18,23 +20,44 @@ import (
 
 const (
 	memcachedDefaultTTL = 24 * time.Hour
+
+	// memcachedMaxKeyLength is the maximum length of memcached keys.
+	memcachedMaxKeyLength = 250
+	// maxCacheKeyLength is the length of the longest cache keys, the ones of postings: "P:", the block ULID, ":" and
+	// the base64 encoded hash of the label.
+	maxCacheKeyLength = 72
+	// maxNamespaceLength is the maximum length of namespaces, so that namespaced keys stay within the memcached limit.
+	maxNamespaceLength = memcachedMaxKeyLength - len(":") - maxCacheKeyLength
 )
 
+// namespaceRegexp matches valid key namespaces. Namespaces cannot contain the key separator, so keys of different
+// namespaces never collide.
+var namespaceRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]*$`)
+
 // MemcachedIndexCache is a memcached-based index cache.
 type MemcachedIndexCache struct {
 	logger    log.Logger
 	memcached cacheutil.MemcachedClient
+	namespace string
 
 	// Metrics.
 	requests *prometheus.CounterVec
 	hits     *prometheus.CounterVec
 }
 
-// NewMemcachedIndexCache makes a new MemcachedIndexCache.
-func NewMemcachedIndexCache(logger log.Logger, memcached cacheutil.MemcachedClient, reg prometheus.Registerer) (*MemcachedIndexCache, error) {
+// NewMemcachedIndexCache makes a new MemcachedIndexCache. Keys are prefixed with the given namespace, if not empty,
+// isolating the entries of store gateways sharing memcached servers, e.g. for different buckets.
+func NewMemcachedIndexCache(logger log.Logger, memcached cacheutil.MemcachedClient, reg prometheus.Registerer, namespace string) (*MemcachedIndexCache, error) {
+	if !namespaceRegexp.MatchString(namespace) {
+		return nil, errors.Errorf("invalid namespace %q, only alphanumeric characters, '_', '.' and '-' are allowed", namespace)
+	}
+	if len(namespace) > maxNamespaceLength {
+		return nil, errors.Errorf("namespace %q is longer than %d characters", namespace, maxNamespaceLength)
+	}
 	c := &MemcachedIndexCache{
 		logger:    logger,
 		memcached: memcached,
+		namespace: namespace,
 	}
 
 	c.requests = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
@@ -56,11 +79,19 @@ func NewMemcachedIndexCache(logger log.Logger, memcached cacheutil.MemcachedClie
 	return c, nil
 }
 
+// key returns the memcached key of the given cache key in the namespace of the cache.
+func (c *MemcachedIndexCache) key(k cacheKey) string {
+	if c.namespace == "" {
+		return k.string()
+	}
+	return c.namespace + ":" + k.string()
+}
+
 // StorePostings sets the postings identified by the ulid and label to the value v.
 // The function enqueues the request and returns immediately: the entry will be
 // asynchronously stored in the cache.
 func (c *MemcachedIndexCache) StorePostings(ctx context.Context, blockID ulid.ULID, l labels.Label, v []byte) {
-	key := cacheKey{blockID, cacheKeyPostings(l)}.string()
+	key := c.key(cacheKey{blockID, cacheKeyPostings(l)})
 
 	if err := c.memcached.SetAsync(ctx, key, v, memcachedDefaultTTL); err != nil {
 		level.Error(c.logger).Log("msg", "failed to cache postings in memcached", "err", err)
@@ -77,7 +108,7 @@ func (c *MemcachedIndexCache) FetchMultiPostings(ctx context.Context, blockID ul
 	keysMapping := map[labels.Label]string{}
 
 	for _, lbl := range lbls {
-		key := cacheKey{blockID, cacheKeyPostings(lbl)}.string()
+		key := c.key(cacheKey{blockID, cacheKeyPostings(lbl)})
 
 		keys = append(keys, key)
 		keysMapping[lbl] = key
@@ -120,7 +151,7 @@ func (c *MemcachedIndexCache) FetchMultiPostings(ctx context.Context, blockID ul
 // The function enqueues the request and returns immediately: the entry will be
 // asynchronously stored in the cache.
 func (c *MemcachedIndexCache) StoreSeries(ctx context.Context, blockID ulid.ULID, id uint64, v []byte) {
-	key := cacheKey{blockID, cacheKeySeries(id)}.string()
+	key := c.key(cacheKey{blockID, cacheKeySeries(id)})
 
 	if err := c.memcached.SetAsync(ctx, key, v, memcachedDefaultTTL); err != nil {
 		level.Error(c.logger).Log("msg", "failed to cache series in memcached", "err", err)
@@ -137,7 +168,7 @@ func (c *MemcachedIndexCache) FetchMultiSeries(ctx context.Context, blockID ulid
 	keysMapping := map[uint64]string{}
 
 	for _, id := range ids {
-		key := cacheKey{blockID, cacheKeySeries(id)}.string()
+		key := c.key(cacheKey{blockID, cacheKeySeries(id)})
 
 		keys = append(keys, key)
 		keysMapping[id] = key
@@ -5,6 +5,7 @@ package storecache
 
 import (
 	"context"
+	"strings"
 	"testing"
 	"time"
 
@@ -85,7 +86,7 @@ func TestMemcachedIndexCache_FetchMultiPostings(t *testing.T) {
 	for testName, testData := range tests {
 		t.Run(testName, func(t *testing.T) {
 			memcached := newMockedMemcachedClient(testData.mockedErr)
-			c, err := NewMemcachedIndexCache(log.NewNopLogger(), memcached, nil)
+			c, err := NewMemcachedIndexCache(log.NewNopLogger(), memcached, nil, "")
 			testutil.Ok(t, err)
 
 			// Store the postings expected before running the test.
@@ -175,7 +176,7 @@ func TestMemcachedIndexCache_FetchMultiSeries(t *testing.T) {
 	for testName, testData := range tests {
 		t.Run(testName, func(t *testing.T) {
 			memcached := newMockedMemcachedClient(testData.mockedErr)
-			c, err := NewMemcachedIndexCache(log.NewNopLogger(), memcached, nil)
+			c, err := NewMemcachedIndexCache(log.NewNopLogger(), memcached, nil, "")
 			testutil.Ok(t, err)
 
 			// Store the series expected before running the test.
@@ -198,6 +199,61 @@ func TestMemcachedIndexCache_FetchMultiSeries(t *testing.T) {
 	}
 }
 
+func TestMemcachedIndexCache_Namespace(t *testing.T) {
+	ctx := context.Background()
+	block := ulid.MustNew(1, nil)
+	label := labels.Label{Name: "instance", Value: "a"}
+
+	// Caches of different namespaces share the same memcached servers.
+	memcached := newMockedMemcachedClient(nil)
+	namespaces := []string{"", "bucket-a", "bucket-b", "P", "S"}
+	caches := make([]*MemcachedIndexCache, 0, len(namespaces))
+	for i, ns := range namespaces {
+		c, err := NewMemcachedIndexCache(log.NewNopLogger(), memcached, nil, ns)
+		testutil.Ok(t, err)
+		caches = append(caches, c)
+
+		c.StorePostings(ctx, block, label, []byte{byte(i)})
+		c.StoreSeries(ctx, block, 1, []byte{byte(i)})
+	}
+
+	// Keys of different namespaces never collide, so every cache only sees its own entries.
+	testutil.Equals(t, 2*len(namespaces), len(memcached.cache))
+	for i, c := range caches {
+		postings, misses := c.FetchMultiPostings(ctx, block, []labels.Label{label})
+		testutil.Equals(t, map[labels.Label][]byte{label: {byte(i)}}, postings, "namespace %q", namespaces[i])
+		testutil.Equals(t, 0, len(misses))
+
+		series, missingIDs := c.FetchMultiSeries(ctx, block, []uint64{1, 2})
+		testutil.Equals(t, map[uint64][]byte{1: {byte(i)}}, series, "namespace %q", namespaces[i])
+		testutil.Equals(t, []uint64{2}, missingIDs)
+	}
+
+	// Entries of other namespaces are not found.
+	c, err := NewMemcachedIndexCache(log.NewNopLogger(), memcached, nil, "bucket-c")
+	testutil.Ok(t, err)
+	postings, misses := c.FetchMultiPostings(ctx, block, []labels.Label{label})
+	testutil.Equals(t, 0, len(postings))
+	testutil.Equals(t, []labels.Label{label}, misses)
+
+	// Namespaces cannot contain the key separator or characters invalid in memcached keys.
+	for _, ns := range []string{"a:b", "a b", "a\nb"} {
+		_, err := NewMemcachedIndexCache(log.NewNopLogger(), memcached, nil, ns)
+		testutil.NotOk(t, err)
+	}
+
+	// Namespaced keys stay within the memcached key length limit.
+	postingsKey := cacheKey{block, cacheKeyPostings(label)}.string()
+	testutil.Equals(t, maxCacheKeyLength, len(postingsKey))
+
+	c, err = NewMemcachedIndexCache(log.NewNopLogger(), memcached, nil, strings.Repeat("a", maxNamespaceLength))
+	testutil.Ok(t, err)
+	testutil.Equals(t, memcachedMaxKeyLength, len(c.key(cacheKey{block, cacheKeyPostings(label)})))
+
+	_, err = NewMemcachedIndexCache(log.NewNopLogger(), memcached, nil, strings.Repeat("a", maxNamespaceLength+1))
+	testutil.NotOk(t, err)
+}
+
 type mockedPostings struct {
 	block ulid.ULID
 	label labels.Label
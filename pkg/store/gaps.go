@@ -0,0 +1,159 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+)
+
+// uncoveredRangeWarning is the format of the warnings about time ranges of Series requests not covered by any block.
+const uncoveredRangeWarning = "no block covers time range %d-%d of %s"
+
+var uncoveredRangeWarningRe = regexp.MustCompile(`no block covers time range (-?\d+)-(-?\d+) of `)
+
+type partialResponseGapsContextKey struct{}
+
+// PartialResponseGap is the part of the time range of a Series request a store failed to return all data for,
+// making the response partial.
+type PartialResponseGap struct {
+	// Store is the address of the store.
+	Store string
+	// LabelSets are the label sets of the store.
+	LabelSets []labels.Labels
+	// MinTime and MaxTime are the time range of the request the store holds data for, in milliseconds.
+	MinTime, MaxTime int64
+	// Warning is the partial response warning the gap was reported with.
+	Warning string
+}
+
+// PartialResponseGaps accumulates the gaps of the partial responses to the Series requests of a query.
+// It is passed through the request context, see ContextWithPartialResponseGaps.
+// All methods of a nil PartialResponseGaps are no-ops.
+type PartialResponseGaps struct {
+	mtx  sync.Mutex
+	gaps map[gapKey]PartialResponseGap
+}
+
+// gapKey identifies a PartialResponseGap.
+type gapKey struct {
+	store, labelSets string
+	mint, maxt       int64
+	warning          string
+}
+
+// NewPartialResponseGaps returns new empty PartialResponseGaps.
+func NewPartialResponseGaps() *PartialResponseGaps {
+	return &PartialResponseGaps{gaps: map[gapKey]PartialResponseGap{}}
+}
+
+// ContextWithPartialResponseGaps returns a new context recording the gaps of the partial responses to the Series
+// requests made with it into the given gaps.
+func ContextWithPartialResponseGaps(ctx context.Context, gaps *PartialResponseGaps) context.Context {
+	return context.WithValue(ctx, partialResponseGapsContextKey{}, gaps)
+}
+
+// PartialResponseGapsFromContext returns the PartialResponseGaps of the context, or nil if none.
+func PartialResponseGapsFromContext(ctx context.Context) *PartialResponseGaps {
+	gaps, _ := ctx.Value(partialResponseGapsContextKey{}).(*PartialResponseGaps)
+	return gaps
+}
+
+// Add records a gap. Gaps reported more than once, e.g. by several Series requests of the same query, are only
+// recorded once.
+func (g *PartialResponseGaps) Add(gap PartialResponseGap) {
+	if g == nil {
+		return
+	}
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	key := gapKey{store: gap.Store, mint: gap.MinTime, maxt: gap.MaxTime, warning: gap.Warning}
+	for _, lset := range gap.LabelSets {
+		key.labelSets += lset.String()
+	}
+	g.gaps[key] = gap
+}
+
+// Gaps returns the recorded gaps, sorted by store address and time.
+func (g *PartialResponseGaps) Gaps() []PartialResponseGap {
+	if g == nil {
+		return nil
+	}
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	res := make([]PartialResponseGap, 0, len(g.gaps))
+	for _, gap := range g.gaps {
+		res = append(res, gap)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Store != res[j].Store {
+			return res[i].Store < res[j].Store
+		}
+		if res[i].MinTime != res[j].MinTime {
+			return res[i].MinTime < res[j].MinTime
+		}
+		if res[i].MaxTime != res[j].MaxTime {
+			return res[i].MaxTime < res[j].MaxTime
+		}
+		return res[i].Warning < res[j].Warning
+	})
+	return res
+}
+
+// storeGap returns the gap of the given store failing a Series request for the given time range with the given warning.
+// Warnings about time ranges not covered by any block narrow the gap to that time range.
+func storeGap(st Client, mint, maxt int64, warning string) PartialResponseGap {
+	storeMinTime, storeMaxTime := st.TimeRange()
+	if storeMinTime > mint {
+		mint = storeMinTime
+	}
+	if storeMaxTime < maxt {
+		maxt = storeMaxTime
+	}
+	if warnMinTime, warnMaxTime, ok := uncoveredRange(warning); ok {
+		if warnMinTime > mint {
+			mint = warnMinTime
+		}
+		if warnMaxTime < maxt {
+			maxt = warnMaxTime
+		}
+	}
+
+	lsets := make([]labels.Labels, 0, len(st.LabelSets()))
+	for _, ls := range st.LabelSets() {
+		lsets = append(lsets, storepb.LabelsToPromLabels(ls.Labels))
+	}
+	return PartialResponseGap{
+		Store:     st.Addr(),
+		LabelSets: lsets,
+		MinTime:   mint,
+		MaxTime:   maxt,
+		Warning:   warning,
+	}
+}
+
+// uncoveredRange returns the time range of the given warning about a time range not covered by any block.
+func uncoveredRange(warning string) (mint, maxt int64, ok bool) {
+	m := uncoveredRangeWarningRe.FindStringSubmatch(warning)
+	if m == nil {
+		return 0, 0, false
+	}
+	mint, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	maxt, err = strconv.ParseInt(m[2], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return mint, maxt, true
+}
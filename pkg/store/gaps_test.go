@@ -0,0 +1,71 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestProxyStore_PartialResponseGaps(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	newStore := func(addr string, mint, maxt int64, api *mockedStoreAPI) Client {
+		return &addrClient{
+			addr: addr,
+			testClient: &testClient{
+				StoreClient: api,
+				labelSets:   []storepb.LabelSet{{Labels: []storepb.Label{{Name: "store", Value: addr}}}},
+				minTime:     mint,
+				maxTime:     maxt,
+			},
+		}
+	}
+	series := storeSeriesResponse(t, labels.FromStrings("a", "1"), []sample{{1500, 1}})
+	stores := []Client{
+		// The store of the first part of the range is down.
+		newStore("store-1", 0, 1000, &mockedStoreAPI{RespError: errors.New("connection refused")}),
+		newStore("store-2", 1000, 2000, &mockedStoreAPI{RespSeries: []*storepb.SeriesResponse{series}}),
+		// The store of the last part of the range returns a partial response itself.
+		newStore("store-3", 2000, 3000, &mockedStoreAPI{RespSeries: []*storepb.SeriesResponse{storepb.NewWarnSeriesResponse(errors.New("block unavailable"))}}),
+		// The gap of a store warning about a time range not covered by any block is that time range.
+		newStore("store-5", 0, 3000, &mockedStoreAPI{RespSeries: []*storepb.SeriesResponse{storepb.NewWarnSeriesResponse(errors.New(`no block covers time range 1200-1499 of {store="store-5"}`))}}),
+		// Stores not holding data within the range are not queried and leave no gaps.
+		newStore("store-4", 3000, 4000, &mockedStoreAPI{RespError: errors.New("connection refused")}),
+	}
+	q := NewProxyStore(nil, nil, func() []Client { return stores }, component.Query, nil, 0, 0, nil, nil, nil)
+
+	gaps := NewPartialResponseGaps()
+	for i := 0; i < 2; i++ {
+		s := newStoreSeriesServer(ContextWithPartialResponseGaps(context.Background(), gaps))
+		testutil.Ok(t, q.Series(&storepb.SeriesRequest{
+			MinTime:  500,
+			MaxTime:  2500,
+			Matchers: []storepb.LabelMatcher{{Name: "a", Value: "1", Type: storepb.LabelMatcher_EQ}},
+		}, s))
+		testutil.Equals(t, 1, len(s.SeriesSet))
+		testutil.Equals(t, 3, len(s.Warnings))
+	}
+
+	// Gaps cover the part of the request range the failing stores hold data for, and are recorded once although
+	// both requests failed.
+	testutil.Equals(t, []PartialResponseGap{
+		{Store: "store-1", LabelSets: []labels.Labels{labels.FromStrings("store", "store-1")}, MinTime: 500, MaxTime: 1000, Warning: `fetch series for [name:"store" value:"store-1" ] store-1: connection refused`},
+		{Store: "store-3", LabelSets: []labels.Labels{labels.FromStrings("store", "store-3")}, MinTime: 2000, MaxTime: 2500, Warning: "block unavailable"},
+		{Store: "store-5", LabelSets: []labels.Labels{labels.FromStrings("store", "store-5")}, MinTime: 1200, MaxTime: 1499, Warning: `no block covers time range 1200-1499 of {store="store-5"}`},
+	}, gaps.Gaps())
+
+	// A nil PartialResponseGaps records nothing.
+	var nilGaps *PartialResponseGaps
+	nilGaps.Add(PartialResponseGap{Store: "store-1"})
+	testutil.Equals(t, 0, len(nilGaps.Gaps()))
+}
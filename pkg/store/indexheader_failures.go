@@ -0,0 +1,152 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// Reasons of index-header load failures: the index of the block is missing in the bucket, the index-header could not
+// be read or written on local disk, or any other failure.
+const (
+	indexHeaderFailureNotFound = "not_found"
+	indexHeaderFailureDisk     = "disk"
+	indexHeaderFailureOther    = "other"
+)
+
+// IndexHeaderFailure is the last failure to load the index-header of a block.
+type IndexHeaderFailure struct {
+	Block    ulid.ULID `json:"block"`
+	Reason   string    `json:"reason"`
+	Failures int       `json:"failures"`
+	Time     time.Time `json:"time"`
+	Error    string    `json:"error"`
+}
+
+// indexHeaderFailures tracks the blocks whose index-header failed to load, with their last failure, until they load
+// or are removed from the bucket.
+type indexHeaderFailures struct {
+	logger     log.Logger
+	isNotFound func(error) bool
+	now        func() time.Time
+
+	mtx    sync.Mutex
+	blocks map[ulid.ULID]*IndexHeaderFailure
+
+	failures *prometheus.CounterVec
+}
+
+func newIndexHeaderFailures(logger log.Logger, reg prometheus.Registerer, isNotFound func(error) bool) *indexHeaderFailures {
+	f := &indexHeaderFailures{
+		logger:     logger,
+		isNotFound: isNotFound,
+		now:        time.Now,
+		blocks:     map[ulid.ULID]*IndexHeaderFailure{},
+		failures: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_bucket_store_indexheader_load_failures_total",
+			Help: "Total number of failures to load the index-header of blocks, by reason.",
+		}, []string{"reason"}),
+	}
+	for _, reason := range []string{indexHeaderFailureNotFound, indexHeaderFailureDisk, indexHeaderFailureOther} {
+		f.failures.WithLabelValues(reason)
+	}
+	return f
+}
+
+// failed records a failure to load the index-header of the given block.
+func (f *indexHeaderFailures) failed(id ulid.ULID, err error) {
+	reason := indexHeaderFailureOther
+	switch cause := errors.Cause(err); {
+	case f.isNotFound(cause):
+		reason = indexHeaderFailureNotFound
+	case isDiskErr(cause):
+		reason = indexHeaderFailureDisk
+	}
+	f.failures.WithLabelValues(reason).Inc()
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	b, ok := f.blocks[id]
+	if !ok {
+		b = &IndexHeaderFailure{Block: id}
+		f.blocks[id] = b
+	}
+	b.Reason = reason
+	b.Failures++
+	b.Time = f.now()
+	b.Error = err.Error()
+	level.Warn(f.logger).Log("msg", "failed to load index-header", "block", id, "reason", reason, "failures", b.Failures, "err", err)
+}
+
+func isDiskErr(err error) bool {
+	switch err.(type) {
+	case *os.PathError, *os.LinkError, *os.SyscallError:
+		return true
+	}
+	return false
+}
+
+// loaded forgets the failures of the given block once its index-header was loaded.
+func (f *indexHeaderFailures) loaded(id ulid.ULID) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	delete(f.blocks, id)
+}
+
+// forgetMissing forgets the failures of blocks not present in the given metas, e.g. once they were deleted.
+func (f *indexHeaderFailures) forgetMissing(metas map[ulid.ULID]*metadata.Meta) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	for id := range f.blocks {
+		if _, ok := metas[id]; !ok {
+			delete(f.blocks, id)
+		}
+	}
+}
+
+// list returns the last failure of each block whose index-header is failing to load, sorted by block.
+func (f *indexHeaderFailures) list() []IndexHeaderFailure {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	res := make([]IndexHeaderFailure, 0, len(f.blocks))
+	for _, b := range f.blocks {
+		res = append(res, *b)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Block.Compare(res[j].Block) < 0
+	})
+	return res
+}
+
+// IndexHeaderFailures returns the last failure of each block whose index-header is failing to load, sorted by block.
+func (s *BucketStore) IndexHeaderFailures() []IndexHeaderFailure {
+	return s.indexHeaderFailures.list()
+}
+
+// IndexHeaderFailuresHandler returns a HTTP handler listing the blocks whose index-header is failing to load as JSON.
+func (s *BucketStore) IndexHeaderFailuresHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.IndexHeaderFailures()); err != nil {
+			level.Error(s.logger).Log("msg", "failed to write index-header failures response", "err", err)
+		}
+	}
+}
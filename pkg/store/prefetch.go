@@ -0,0 +1,143 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// ChunksPrefetcher is implemented by bucket readers able to download chunk files ahead of their first read,
+// see storecache.ChunksDiskCache.
+type ChunksPrefetcher interface {
+	// Prefetch downloads the given chunk files in order until the downloads would exceed maxBytes in total,
+	// and returns the size of the downloaded chunk files.
+	Prefetch(ctx context.Context, names []string, maxBytes uint64) (uint64, error)
+}
+
+// chunksPrefetch prefetches the chunk files of the blocks covering the time range that follows a series request,
+// anticipating the next request of e.g. a dashboard scrolling forward in time. At most one prefetch runs at a time,
+// the prefetches of requests completing meanwhile are skipped. All methods of a nil chunksPrefetch are no-ops.
+type chunksPrefetch struct {
+	logger     log.Logger
+	prefetcher ChunksPrefetcher
+	maxBytes   uint64
+
+	// ctx is cancelled on close, abandoning the running prefetch.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running int32
+
+	// mtx guards closed and the start of prefetches, so that none starts once close waits for them.
+	mtx    sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+
+	prefetches *prometheus.CounterVec
+}
+
+// newChunksPrefetch returns a chunksPrefetch downloading up to maxBytes of chunk files after every series request.
+// It returns nil if maxBytes is 0, and an error if the bucket does not implement ChunksPrefetcher.
+func newChunksPrefetch(logger log.Logger, reg prometheus.Registerer, bkt objstore.BucketReader, maxBytes uint64) (*chunksPrefetch, error) {
+	if maxBytes == 0 {
+		return nil, nil
+	}
+	prefetcher, ok := bkt.(ChunksPrefetcher)
+	if !ok {
+		return nil, errors.New("prefetching chunks requires the chunks disk cache")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &chunksPrefetch{
+		logger:     logger,
+		prefetcher: prefetcher,
+		maxBytes:   maxBytes,
+		ctx:        ctx,
+		cancel:     cancel,
+		prefetches: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_bucket_store_chunks_prefetches_total",
+			Help: "Total number of prefetches of the chunks following the time range of series requests, by whether they were started or skipped because another prefetch was running.",
+		}, []string{"result"}),
+	}
+	p.prefetches.WithLabelValues("started")
+	p.prefetches.WithLabelValues("skipped")
+	return p, nil
+}
+
+// adjacentRange returns the time range of the same length immediately following the given one. It returns false
+// if the range cannot be represented, e.g. for requests without upper bound.
+func adjacentRange(mint, maxt int64) (int64, int64, bool) {
+	width := maxt - mint
+	if width <= 0 || maxt > math.MaxInt64-width {
+		return 0, 0, false
+	}
+	return maxt + 1, maxt + width, true
+}
+
+// start prefetches the chunk files of the given blocks in the background, unless a prefetch is running already
+// or the prefetch was closed.
+func (p *chunksPrefetch) start(blocks []*bucketBlock) {
+	if p == nil || len(blocks) == 0 {
+		return
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.closed {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&p.running, 0, 1) {
+		p.prefetches.WithLabelValues("skipped").Inc()
+		return
+	}
+	p.prefetches.WithLabelValues("started").Inc()
+
+	var names []string
+	for _, b := range blocks {
+		names = append(names, b.chunkObjs...)
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer atomic.StoreInt32(&p.running, 0)
+
+		size, err := p.prefetcher.Prefetch(p.ctx, names, p.maxBytes)
+		if err != nil {
+			if p.ctx.Err() != nil {
+				return
+			}
+			level.Warn(p.logger).Log("msg", "failed to prefetch chunks", "err", err)
+		}
+		level.Debug(p.logger).Log("msg", "prefetched chunks", "blocks", len(blocks), "sizeBytes", size)
+	}()
+}
+
+// wait waits for the running prefetch to complete.
+func (p *chunksPrefetch) wait() {
+	if p == nil {
+		return
+	}
+	p.wg.Wait()
+}
+
+// close abandons the running prefetch and waits for it to return. No prefetch is started afterwards.
+func (p *chunksPrefetch) close() {
+	if p == nil {
+		return
+	}
+	p.mtx.Lock()
+	p.closed = true
+	p.mtx.Unlock()
+
+	p.cancel()
+	p.wg.Wait()
+}
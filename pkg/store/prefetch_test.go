@@ -0,0 +1,80 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	"github.com/go-kit/kit/log"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestAdjacentRange(t *testing.T) {
+	for _, tcase := range []struct {
+		mint, maxt   int64
+		expMint      int64
+		expMaxt      int64
+		expAvailable bool
+	}{
+		{mint: 0, maxt: 100, expMint: 101, expMaxt: 200, expAvailable: true},
+		{mint: -50, maxt: 50, expMint: 51, expMaxt: 150, expAvailable: true},
+		{mint: 100, maxt: 100},
+		{mint: 100, maxt: 50},
+		{mint: 0, maxt: math.MaxInt64},
+		{mint: math.MinInt64, maxt: math.MaxInt64},
+	} {
+		mint, maxt, ok := adjacentRange(tcase.mint, tcase.maxt)
+		testutil.Equals(t, tcase.expAvailable, ok)
+		testutil.Equals(t, tcase.expMint, mint)
+		testutil.Equals(t, tcase.expMaxt, maxt)
+	}
+}
+
+func TestNewChunksPrefetch(t *testing.T) {
+	p, err := newChunksPrefetch(nil, nil, inmem.NewBucket(), 0)
+	testutil.Ok(t, err)
+	testutil.Assert(t, p == nil, "expected prefetching to be disabled")
+	p.start([]*bucketBlock{{}})
+	p.wait()
+	p.close()
+
+	_, err = newChunksPrefetch(nil, nil, inmem.NewBucket(), 1024)
+	testutil.NotOk(t, err)
+}
+
+// blockingPrefetcher is a bucket whose prefetches block until their context is cancelled.
+type blockingPrefetcher struct {
+	objstore.Bucket
+	started chan struct{}
+}
+
+func (b *blockingPrefetcher) Prefetch(ctx context.Context, _ []string, _ uint64) (uint64, error) {
+	close(b.started)
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestChunksPrefetch_Close(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	bkt := &blockingPrefetcher{Bucket: inmem.NewBucket(), started: make(chan struct{})}
+	p, err := newChunksPrefetch(log.NewNopLogger(), nil, bkt, 1024)
+	testutil.Ok(t, err)
+
+	p.start([]*bucketBlock{{chunkObjs: []string{"chunks/000001"}}})
+	<-bkt.started
+
+	// Closing abandons the running prefetch, and no prefetch is started afterwards.
+	p.close()
+	p.start([]*bucketBlock{{chunkObjs: []string{"chunks/000001"}}})
+	p.wait()
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(p.prefetches.WithLabelValues("started")))
+}
@@ -246,7 +246,7 @@ func (p *PrometheusStore) handleSampledPrometheusResponse(s storepb.Store_Series
 	span.SetTag("series_count", len(resp.Results[0].Timeseries))
 
 	for _, e := range resp.Results[0].Timeseries {
-		lset := p.translateAndExtendLabels(e.Labels, externalLabels)
+		lset := translateAndExtendLabels(e.Labels, externalLabels)
 
 		if len(e.Samples) == 0 {
 			// As found in https://github.com/thanos-io/thanos/issues/381
@@ -264,7 +264,7 @@ func (p *PrometheusStore) handleSampledPrometheusResponse(s storepb.Store_Series
 		// XOR encoding supports a max size of 2^16 - 1 samples, so we need
 		// to chunk all samples into groups of no more than 2^16 - 1
 		// See: https://github.com/thanos-io/thanos/pull/718.
-		aggregatedChunks, err := p.chunkSamples(e, math.MaxUint16)
+		aggregatedChunks, err := chunkSamples(e, math.MaxUint16)
 		if err != nil {
 			return err
 		}
@@ -350,7 +350,7 @@ func (p *PrometheusStore) handleStreamedPrometheusResponse(s storepb.Store_Serie
 			}
 
 			if err := s.Send(storepb.NewSeriesResponse(&storepb.Series{
-				Labels: p.translateAndExtendLabels(series.Labels, externalLabels),
+				Labels: translateAndExtendLabels(series.Labels, externalLabels),
 				Chunks: thanosChks,
 			})); err != nil {
 				return err
@@ -395,7 +395,7 @@ func (p *PrometheusStore) fetchSampledResponse(ctx context.Context, resp *http.R
 	return &data, nil
 }
 
-func (p *PrometheusStore) chunkSamples(series *prompb.TimeSeries, maxSamplesPerChunk int) (chks []storepb.AggrChunk, err error) {
+func chunkSamples(series *prompb.TimeSeries, maxSamplesPerChunk int) (chks []storepb.AggrChunk, err error) {
 	samples := series.Samples
 
 	for len(samples) > 0 {
@@ -404,7 +404,7 @@ func (p *PrometheusStore) chunkSamples(series *prompb.TimeSeries, maxSamplesPerC
 			chunkSize = maxSamplesPerChunk
 		}
 
-		enc, cb, err := p.encodeChunk(samples[:chunkSize])
+		enc, cb, err := encodeChunk(samples[:chunkSize])
 		if err != nil {
 			return nil, status.Error(codes.Unknown, err.Error())
 		}
@@ -498,7 +498,7 @@ func matchesExternalLabels(ms []storepb.LabelMatcher, externalLabels labels.Labe
 }
 
 // encodeChunk translates the sample pairs into a chunk.
-func (p *PrometheusStore) encodeChunk(ss []prompb.Sample) (storepb.Chunk_Encoding, []byte, error) {
+func encodeChunk(ss []prompb.Sample) (storepb.Chunk_Encoding, []byte, error) {
 	c := chunkenc.NewXORChunk()
 
 	a, err := c.Appender()
@@ -516,7 +516,7 @@ func (p *PrometheusStore) encodeChunk(ss []prompb.Sample) (storepb.Chunk_Encodin
 // Both input labels are expected to be sorted.
 //
 // NOTE(bwplotka): Don't use modify passed slices as we reuse underlying memory.
-func (p *PrometheusStore) translateAndExtendLabels(m []prompb.Label, extend labels.Labels) []storepb.Label {
+func translateAndExtendLabels(m []prompb.Label, extend labels.Labels) []storepb.Label {
 	pbLabels := storepb.PrompbLabelsToLabelsUnsafe(m)
 	pbExtend := storepb.PromLabelsToLabelsUnsafe(extend)
 
@@ -54,11 +54,17 @@ type ProxyStore struct {
 	selectorLabels labels.Labels
 
 	responseTimeout time.Duration
+	requestTimeout  time.Duration
+	router          *StoreRouter
+	slowStores      *SlowStoreDetector
+	sessions        *StoreSessions
 	metrics         *proxyStoreMetrics
 }
 
 type proxyStoreMetrics struct {
 	emptyStreamResponses prometheus.Counter
+	requestTimeouts      prometheus.Counter
+	fallbackRequests     prometheus.Counter
 }
 
 func newProxyStoreMetrics(reg prometheus.Registerer) *proxyStoreMetrics {
@@ -68,12 +74,25 @@ func newProxyStoreMetrics(reg prometheus.Registerer) *proxyStoreMetrics {
 		Name: "thanos_proxy_store_empty_stream_responses_total",
 		Help: "Total number of empty responses received.",
 	})
+	m.requestTimeouts = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_proxy_store_request_timeouts_total",
+		Help: "Total number of Series requests to a single store abandoned because they exceeded the store request timeout.",
+	})
+	m.fallbackRequests = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_proxy_store_fallback_requests_total",
+		Help: "Total number of Series requests sent to the fallback stores because the primary stores failed or returned no series.",
+	})
 
 	return &m
 }
 
 // NewProxyStore returns a new ProxyStore that uses the given clients that implements storeAPI to fan-in all series to the client.
 // Note that there is no deduplication support. Deduplication should be done on the highest level (just before PromQL).
+// A store not sending any data for the response timeout, or not completing its Series request within the request timeout,
+// is abandoned. Zero disables the respective timeout. Series requests are only sent to the stores selected
+// by the given router, if any. The given slow store detector, if any, tracks the latency of Series requests and
+// shortens the request timeout of demoted stores. The given store sessions, if any, pin the stores seen by the
+// Series, LabelNames and LabelValues requests of a client session.
 func NewProxyStore(
 	logger log.Logger,
 	reg prometheus.Registerer,
@@ -81,6 +100,10 @@ func NewProxyStore(
 	component component.StoreAPI,
 	selectorLabels labels.Labels,
 	responseTimeout time.Duration,
+	requestTimeout time.Duration,
+	router *StoreRouter,
+	slowStores *SlowStoreDetector,
+	sessions *StoreSessions,
 ) *ProxyStore {
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -93,6 +116,10 @@ func NewProxyStore(
 		component:       component,
 		selectorLabels:  selectorLabels,
 		responseTimeout: responseTimeout,
+		requestTimeout:  requestTimeout,
+		router:          router,
+		slowStores:      slowStores,
+		sessions:        sessions,
 		metrics:         metrics,
 	}
 	return s
@@ -221,10 +248,10 @@ func (s *ProxyStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesSe
 	)
 
 	g.Go(func() error {
+		defer closeFn()
+
 		var (
-			seriesSet      []storepb.SeriesSet
-			storeDebugMsgs []string
-			r              = &storepb.SeriesRequest{
+			r = &storepb.SeriesRequest{
 				MinTime:                 r.MinTime,
 				MaxTime:                 r.MaxTime,
 				Matchers:                newMatchers,
@@ -232,74 +259,51 @@ func (s *ProxyStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesSe
 				MaxResolutionWindow:     r.MaxResolutionWindow,
 				SkipChunks:              r.SkipChunks,
 				PartialResponseDisabled: r.PartialResponseDisabled,
+				FreshStoresOnly:         r.FreshStoresOnly,
 			}
-			wg = &sync.WaitGroup{}
+			routed            = s.router.Route(r.MinTime, r.MaxTime, r.Matchers)
+			primary, fallback []Client
+			storeDebugMsgs    []string
+			stores            = s.stores()
 		)
-
-		defer func() {
-			wg.Wait()
-			closeFn()
-		}()
-
-		for _, st := range s.stores() {
-			// We might be able to skip the store if its meta information indicates
-			// it cannot have series matching our query.
-			// NOTE: all matchers are validated in matchesExternalLabels method so we explicitly ignore error.
-			var ok bool
-			tracing.DoInSpan(gctx, "store_matches", func(ctx context.Context) {
-				// We can skip error, we already translated matchers once.
-				ok, _ = storeMatches(st, r.MinTime, r.MaxTime, r.Matchers...)
-			})
-			if !ok {
-				storeDebugMsgs = append(storeDebugMsgs, fmt.Sprintf("store %s filtered out", st))
+		s.slowStores.retain(stores)
+		for _, st := range s.sessions.stores(gctx, stores) {
+			if s.router.Fallback(st.Addr()) {
+				fallback = append(fallback, st)
 				continue
 			}
-			storeDebugMsgs = append(storeDebugMsgs, fmt.Sprintf("store %s queried", st))
-
-			// This is used to cancel this stream when one operations takes too long.
-			seriesCtx, closeSeries := context.WithCancel(gctx)
-			seriesCtx = grpc_opentracing.ClientAddContextTags(seriesCtx, opentracing.Tags{
-				"target": st.Addr(),
-			})
-			defer closeSeries()
-
-			sc, err := st.Series(seriesCtx, r)
-			if err != nil {
-				storeID := storepb.LabelSetsToString(st.LabelSets())
-				if storeID == "" {
-					storeID = "Store Gateway"
-				}
-				err = errors.Wrapf(err, "fetch series for %s %s", storeID, st)
-				if r.PartialResponseDisabled {
-					level.Error(s.logger).Log("err", err, "msg", "partial response disabled; aborting request")
-					return err
-				}
-				respSender.send(storepb.NewWarnSeriesResponse(err))
+			if !routed(st.Addr()) {
+				storeDebugMsgs = append(storeDebugMsgs, fmt.Sprintf("store %s not selected by routing rules", st))
 				continue
 			}
+			primary = append(primary, st)
+		}
 
-			// Schedule streamSeriesSet that translates gRPC streamed response
-			// into seriesSet (if series) or respCh if warnings.
-			seriesSet = append(seriesSet, startStreamSeriesSet(seriesCtx, s.logger, closeSeries,
-				wg, sc, respSender, st.String(), !r.PartialResponseDisabled, s.responseTimeout, s.metrics.emptyStreamResponses))
+		queried, sent, err := s.seriesFromStores(gctx, r, primary, respSender, &storeDebugMsgs)
+		if sent == 0 && len(fallback) > 0 {
+			// Fallback stores are only queried if the primary stores failed or returned no series.
+			if err != nil {
+				level.Warn(s.logger).Log("err", err, "msg", "primary stores failed; querying fallback stores")
+			}
+			s.metrics.fallbackRequests.Inc()
+			fallbackQueried, fallbackSent, fallbackErr := s.seriesFromStores(gctx, r, fallback, respSender, &storeDebugMsgs)
+			if fallbackErr != nil || fallbackSent > 0 {
+				err = fallbackErr
+			}
+			queried += fallbackQueried
 		}
 
 		level.Debug(s.logger).Log("msg", strings.Join(storeDebugMsgs, ";"))
-		if len(seriesSet) == 0 {
+		if err != nil {
+			return err
+		}
+		if queried == 0 {
 			// This is indicates that configured StoreAPIs are not the ones end user expects.
 			err := errors.New("No StoreAPIs matched for this query")
 			level.Warn(s.logger).Log("err", err, "stores", strings.Join(storeDebugMsgs, ";"))
 			respSender.send(storepb.NewWarnSeriesResponse(err))
-			return nil
-		}
-
-		mergedSet := storepb.MergeSeriesSets(seriesSet...)
-		for mergedSet.Next() {
-			var series storepb.Series
-			series.Labels, series.Chunks = mergedSet.At()
-			respSender.send(storepb.NewSeriesResponse(&series))
 		}
-		return mergedSet.Err()
+		return nil
 	})
 
 	for resp := range respRecv {
@@ -315,6 +319,113 @@ func (s *ProxyStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesSe
 	return nil
 }
 
+// seriesFromStores sends the merged series of the given stores matching the request to the response sender.
+// It returns the number of stores queried and of series sent.
+func (s *ProxyStore) seriesFromStores(
+	ctx context.Context,
+	r *storepb.SeriesRequest,
+	stores []Client,
+	respSender *ctxRespSender,
+	storeDebugMsgs *[]string,
+) (queried int, sent int, err error) {
+	var (
+		seriesSet []storepb.SeriesSet
+		wg        = &sync.WaitGroup{}
+	)
+	stats := SeriesStatsFromContext(ctx)
+	gaps := PartialResponseGapsFromContext(ctx)
+	// Cancelled to abandon all stores once one of them failed.
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	for _, st := range stores {
+		// We might be able to skip the store if its meta information indicates
+		// it cannot have series matching our query.
+		// NOTE: all matchers are validated in matchesExternalLabels method so we explicitly ignore error.
+		var ok bool
+		tracing.DoInSpan(ctx, "store_matches", func(ctx context.Context) {
+			// We can skip error, we already translated matchers once.
+			ok, _ = storeMatches(st, r.MinTime, r.MaxTime, r.Matchers...)
+		})
+		if !ok {
+			*storeDebugMsgs = append(*storeDebugMsgs, fmt.Sprintf("store %s filtered out", st))
+			continue
+		}
+		if _, storeMaxTime := st.TimeRange(); r.FreshStoresOnly && storeMaxTime < r.MaxTime {
+			*storeDebugMsgs = append(*storeDebugMsgs, fmt.Sprintf("store %s filtered out as its data does not reach the end of the request", st))
+			continue
+		}
+		*storeDebugMsgs = append(*storeDebugMsgs, fmt.Sprintf("store %s queried", st))
+		queried++
+		stats.queriedStore(st.Addr())
+
+		// This is used to cancel this stream when one operations takes too long.
+		// The request timeout applies to every store on its own, bounded by the deadline of the whole request.
+		var (
+			seriesCtx       context.Context
+			closeSeries     context.CancelFunc
+			requestDeadline time.Time
+		)
+		if requestTimeout := s.slowStores.requestTimeout(st.Addr(), s.requestTimeout); requestTimeout > 0 {
+			requestDeadline = time.Now().Add(requestTimeout)
+			seriesCtx, closeSeries = context.WithDeadline(ctx, requestDeadline)
+		} else {
+			seriesCtx, closeSeries = context.WithCancel(ctx)
+		}
+		seriesCtx = grpc_opentracing.ClientAddContextTags(seriesCtx, opentracing.Tags{
+			"target": st.Addr(),
+		})
+		defer closeSeries()
+
+		start, addr, gapStore := time.Now(), st.Addr(), st
+		sc, err := st.Series(seriesCtx, r)
+		if err != nil {
+			storeID := storepb.LabelSetsToString(st.LabelSets())
+			if storeID == "" {
+				storeID = "Store Gateway"
+			}
+			err = errors.Wrapf(err, "fetch series for %s %s", storeID, st)
+			if r.PartialResponseDisabled {
+				level.Error(s.logger).Log("err", err, "msg", "partial response disabled; aborting request")
+				cancel()
+				// Drain the already started streams, so that they are not blocked sending series.
+				for _, set := range seriesSet {
+					for set.Next() {
+					}
+				}
+				return queried, 0, err
+			}
+			respSender.send(storepb.NewWarnSeriesResponse(err))
+			gaps.Add(storeGap(st, r.MinTime, r.MaxTime, err.Error()))
+			continue
+		}
+
+		// Schedule streamSeriesSet that translates gRPC streamed response
+		// into seriesSet (if series) or respCh if warnings.
+		seriesSet = append(seriesSet, startStreamSeriesSet(seriesCtx, s.logger, closeSeries,
+			wg, sc, respSender, st.String(), !r.PartialResponseDisabled, s.responseTimeout, requestDeadline, s.metrics,
+			// Only completed and timed out requests tell about the latency of the store, cancelled ones do not.
+			func() { s.slowStores.observe(addr, time.Since(start)) },
+			func(series *storepb.Series) { stats.addStore(addr, series) },
+			func(warning string) { gaps.Add(storeGap(gapStore, r.MinTime, r.MaxTime, warning)) }))
+	}
+	if len(seriesSet) == 0 {
+		return queried, 0, nil
+	}
+
+	mergedSet := storepb.MergeSeriesSets(seriesSet...)
+	for mergedSet.Next() {
+		var series storepb.Series
+		series.Labels, series.Chunks = mergedSet.At()
+		respSender.send(storepb.NewSeriesResponse(&series))
+		sent++
+	}
+	return queried, sent, mergedSet.Err()
+}
+
 type warnSender interface {
 	send(*storepb.SeriesResponse)
 }
@@ -338,7 +449,10 @@ type streamSeriesSet struct {
 	partialResponse bool
 
 	responseTimeout time.Duration
+	requestDeadline time.Time
 	closeSeries     context.CancelFunc
+	// observeWarning is called with the partial response warnings of the store.
+	observeWarning func(string)
 }
 
 type recvResponse struct {
@@ -366,7 +480,11 @@ func startStreamSeriesSet(
 	name string,
 	partialResponse bool,
 	responseTimeout time.Duration,
-	emptyStreamResponses prometheus.Counter,
+	requestDeadline time.Time,
+	metrics *proxyStoreMetrics,
+	observeLatency func(),
+	observeSeries func(*storepb.Series),
+	observeWarning func(string),
 ) *streamSeriesSet {
 	s := &streamSeriesSet{
 		ctx:             ctx,
@@ -378,6 +496,8 @@ func startStreamSeriesSet(
 		name:            name,
 		partialResponse: partialResponse,
 		responseTimeout: responseTimeout,
+		requestDeadline: requestDeadline,
+		observeWarning:  observeWarning,
 	}
 
 	wg.Add(1)
@@ -388,7 +508,7 @@ func startStreamSeriesSet(
 		numResponses := 0
 		defer func() {
 			if numResponses == 0 {
-				emptyStreamResponses.Inc()
+				metrics.emptyStreamResponses.Inc()
 			}
 		}()
 
@@ -411,15 +531,24 @@ func startStreamSeriesSet(
 			var rr *recvResponse
 			select {
 			case <-ctx.Done():
+				// The deadline of the whole request might be earlier than the one of the request to this store.
+				if ctx.Err() == context.DeadlineExceeded && !s.requestDeadline.IsZero() && !time.Now().Before(s.requestDeadline) {
+					metrics.requestTimeouts.Inc()
+					observeLatency()
+					s.handleErr(errors.Wrapf(ctx.Err(), "store request timeout exceeded; failed to receive all data from %s", s.name), done)
+					return
+				}
 				s.handleErr(errors.Wrapf(ctx.Err(), "failed to receive any data from %s", s.name), done)
 				return
 			case <-frameTimeoutCtx.Done():
+				observeLatency()
 				s.handleErr(errors.Wrapf(frameTimeoutCtx.Err(), "failed to receive any data in %s from %s", s.responseTimeout.String(), s.name), done)
 				return
 			case rr = <-rCh:
 			}
 
 			if rr.err == io.EOF {
+				observeLatency()
 				close(done)
 				return
 			}
@@ -432,8 +561,10 @@ func startStreamSeriesSet(
 
 			if w := rr.r.GetWarning(); w != "" {
 				s.warnCh.send(storepb.NewWarnSeriesResponse(errors.New(w)))
+				s.observeWarning(w)
 				continue
 			}
+			observeSeries(rr.r.GetSeries())
 			s.recvCh <- rr.r.GetSeries()
 		}
 	}()
@@ -447,6 +578,7 @@ func (s *streamSeriesSet) handleErr(err error, done chan struct{}) {
 	if s.partialResponse {
 		level.Warn(s.logger).Log("err", err, "msg", "returning partial response")
 		s.warnCh.send(storepb.NewWarnSeriesResponse(err))
+		s.observeWarning(err.Error())
 		return
 	}
 	s.errMtx.Lock()
@@ -521,6 +653,30 @@ func labelSetMatches(ls storepb.LabelSet, matchers []storepb.LabelMatcher) (bool
 	return true, nil
 }
 
+type unsortedLabelsContextKey struct{}
+
+// ContextWithUnsortedLabels returns a new context whose LabelNames and LabelValues requests return the merged names
+// and values of the stores in no particular order, skipping the cost of sorting them.
+func ContextWithUnsortedLabels(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unsortedLabelsContextKey{}, true)
+}
+
+// UnsortedLabelsFromContext returns true if the LabelNames and LabelValues requests of the context may return
+// unsorted results.
+func UnsortedLabelsFromContext(ctx context.Context) bool {
+	unsorted, _ := ctx.Value(unsortedLabelsContextKey{}).(bool)
+	return unsorted
+}
+
+// mergeLabelStrings merges the label names or values of the stores without duplicates, sorted unless the context
+// allows unsorted results.
+func mergeLabelStrings(ctx context.Context, a [][]string) []string {
+	if UnsortedLabelsFromContext(ctx) {
+		return strutil.MergeUnorderedSlices(a...)
+	}
+	return strutil.MergeUnsortedSlices(a...)
+}
+
 // LabelNames returns all known label names.
 func (s *ProxyStore) LabelNames(ctx context.Context, r *storepb.LabelNamesRequest) (
 	*storepb.LabelNamesResponse, error,
@@ -532,11 +688,21 @@ func (s *ProxyStore) LabelNames(ctx context.Context, r *storepb.LabelNamesReques
 		g, gctx  = errgroup.WithContext(ctx)
 	)
 
-	for _, st := range s.stores() {
+	for _, st := range s.sessions.stores(ctx, s.stores()) {
 		st := st
+		// Stores pass on or ignore the matchers, but stores whose external labels do not match them have no
+		// matching series at all.
+		ok, err := labelSetsMatch(st.LabelSets(), r.Matchers)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if !ok {
+			continue
+		}
 		g.Go(func() error {
 			resp, err := st.LabelNames(gctx, &storepb.LabelNamesRequest{
 				PartialResponseDisabled: r.PartialResponseDisabled,
+				Matchers:                r.Matchers,
 			})
 			if err != nil {
 				err = errors.Wrapf(err, "fetch label names from store %s", st)
@@ -564,7 +730,7 @@ func (s *ProxyStore) LabelNames(ctx context.Context, r *storepb.LabelNamesReques
 	}
 
 	return &storepb.LabelNamesResponse{
-		Names:    strutil.MergeUnsortedSlices(names...),
+		Names:    mergeLabelStrings(ctx, names),
 		Warnings: warnings,
 	}, nil
 }
@@ -580,7 +746,7 @@ func (s *ProxyStore) LabelValues(ctx context.Context, r *storepb.LabelValuesRequ
 		g, gctx  = errgroup.WithContext(ctx)
 	)
 
-	for _, st := range s.stores() {
+	for _, st := range s.sessions.stores(ctx, s.stores()) {
 		store := st
 		g.Go(func() error {
 			resp, err := store.LabelValues(gctx, &storepb.LabelValuesRequest{
@@ -613,7 +779,7 @@ func (s *ProxyStore) LabelValues(ctx context.Context, r *storepb.LabelValuesRequ
 	}
 
 	return &storepb.LabelValuesResponse{
-		Values:   strutil.MergeUnsortedSlices(all...),
+		Values:   mergeLabelStrings(ctx, all),
 		Warnings: warnings,
 	}, nil
 }
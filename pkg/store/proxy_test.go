@@ -9,12 +9,14 @@ import (
 	"io"
 	"os"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/fortytw2/leaktest"
 	"github.com/gogo/protobuf/proto"
 	"github.com/pkg/errors"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
 	"github.com/thanos-io/thanos/pkg/component"
@@ -60,7 +62,7 @@ func TestProxyStore_Info(t *testing.T) {
 		nil,
 		func() []Client { return nil },
 		component.Query,
-		nil, 0*time.Second,
+		nil, 0*time.Second, 0*time.Second, nil, nil, nil,
 	)
 
 	resp, err := q.Info(ctx, &storepb.InfoRequest{})
@@ -310,6 +312,42 @@ func TestProxyStore_Series(t *testing.T) {
 			},
 			expectedWarningsLen: 2,
 		},
+		{
+			title: "fresh stores only",
+			storeAPIs: []Client{
+				&testClient{
+					StoreClient: &mockedStoreAPI{
+						RespSeries: []*storepb.SeriesResponse{
+							storeSeriesResponse(t, labels.FromStrings("a", "a"), []sample{{0, 0}, {2, 1}, {3, 2}}),
+						},
+					},
+					minTime: 1,
+					maxTime: 300,
+				},
+				&testClient{
+					StoreClient: &mockedStoreAPI{
+						RespSeries: []*storepb.SeriesResponse{
+							storeSeriesResponse(t, labels.FromStrings("a", "b"), []sample{{0, 0}, {2, 1}, {3, 2}}),
+						},
+					},
+					// Lagging behind the end of the request.
+					minTime: 1,
+					maxTime: 200,
+				},
+			},
+			req: &storepb.SeriesRequest{
+				MinTime:         1,
+				MaxTime:         300,
+				Matchers:        []storepb.LabelMatcher{{Name: "ext", Value: "1", Type: storepb.LabelMatcher_EQ}},
+				FreshStoresOnly: true,
+			},
+			expectedSeries: []rawSeries{
+				{
+					lset:   []storepb.Label{{Name: "a", Value: "a"}},
+					chunks: [][]sample{{{0, 0}, {2, 1}, {3, 2}}},
+				},
+			},
+		},
 		{
 			title: "same external labels are validated during upload and on querier storeset, proxy does not care",
 			storeAPIs: []Client{
@@ -422,6 +460,10 @@ func TestProxyStore_Series(t *testing.T) {
 				component.Query,
 				tc.selectorLabels,
 				0*time.Second,
+				0*time.Second,
+				nil,
+				nil,
+				nil,
 			)
 
 			s := newStoreSeriesServer(context.Background())
@@ -888,6 +930,10 @@ func TestProxyStore_SeriesSlowStores(t *testing.T) {
 				component.Query,
 				tc.selectorLabels,
 				4*time.Second,
+				0*time.Second,
+				nil,
+				nil,
+				nil,
 			)
 
 			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -915,6 +961,84 @@ func TestProxyStore_SeriesSlowStores(t *testing.T) {
 	}
 }
 
+func TestProxyStore_SeriesRequestTimeout(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	stores := func() []Client {
+		return []Client{
+			&testClient{
+				StoreClient: &mockedStoreAPI{
+					RespSeries: []*storepb.SeriesResponse{
+						storeSeriesResponse(t, labels.FromStrings("a", "b"), []sample{{1, 1}, {2, 2}, {3, 3}}),
+					},
+					// Every response is delayed, so that the store never stops sending data for longer than the delay.
+					RespDuration: 2 * time.Second,
+				},
+				labelSets: []storepb.LabelSet{{Labels: []storepb.Label{{Name: "ext", Value: "1"}}}},
+				minTime:   1,
+				maxTime:   300,
+			},
+			&testClient{
+				StoreClient: &mockedStoreAPI{
+					RespSeries: []*storepb.SeriesResponse{
+						storeSeriesResponse(t, labels.FromStrings("b", "c"), []sample{{1, 1}, {2, 2}, {3, 3}}),
+					},
+				},
+				labelSets: []storepb.LabelSet{{Labels: []storepb.Label{{Name: "ext", Value: "1"}}}},
+				minTime:   1,
+				maxTime:   300,
+			},
+		}
+	}
+	req := func(partialResponseDisabled bool) *storepb.SeriesRequest {
+		return &storepb.SeriesRequest{
+			MinTime:                 1,
+			MaxTime:                 300,
+			Matchers:                []storepb.LabelMatcher{{Name: "ext", Value: "1", Type: storepb.LabelMatcher_EQ}},
+			PartialResponseDisabled: partialResponseDisabled,
+		}
+	}
+
+	t.Run("slow store is dropped with partial response", func(t *testing.T) {
+		q := NewProxyStore(nil, nil, stores, component.Query, nil, 0*time.Second, 500*time.Millisecond, nil, nil, nil)
+		s := newStoreSeriesServer(context.Background())
+
+		t0 := time.Now()
+		testutil.Ok(t, q.Series(req(false), s))
+		testutil.Assert(t, time.Since(t0) < 1500*time.Millisecond, "request took %s, the slow store was not dropped", time.Since(t0))
+
+		seriesEquals(t, []rawSeries{
+			{
+				lset:   []storepb.Label{{Name: "b", Value: "c"}},
+				chunks: [][]sample{{{1, 1}, {2, 2}, {3, 3}}},
+			},
+		}, s.SeriesSet)
+		testutil.Equals(t, 1, len(s.Warnings), "got %v", s.Warnings)
+		testutil.Assert(t, strings.Contains(s.Warnings[0], "store request timeout exceeded"), "unexpected warning %s", s.Warnings[0])
+		testutil.Equals(t, 1.0, promtestutil.ToFloat64(q.metrics.requestTimeouts))
+	})
+	t.Run("slow store fails the request without partial response", func(t *testing.T) {
+		q := NewProxyStore(nil, nil, stores, component.Query, nil, 0*time.Second, 500*time.Millisecond, nil, nil, nil)
+		s := newStoreSeriesServer(context.Background())
+
+		err := q.Series(req(true), s)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "store request timeout exceeded"), "unexpected error %s", err)
+		testutil.Equals(t, 1.0, promtestutil.ToFloat64(q.metrics.requestTimeouts))
+	})
+	t.Run("request timeout is bounded by the deadline of the whole request", func(t *testing.T) {
+		q := NewProxyStore(nil, nil, stores, component.Query, nil, 0*time.Second, time.Minute, nil, nil, nil)
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		s := newStoreSeriesServer(ctx)
+
+		t0 := time.Now()
+		_ = q.Series(req(false), s)
+		testutil.Assert(t, time.Since(t0) < 1500*time.Millisecond, "request took %s, the request timeout was not bounded by the deadline", time.Since(t0))
+		testutil.Equals(t, 0.0, promtestutil.ToFloat64(q.metrics.requestTimeouts))
+	})
+}
+
 func TestProxyStore_Series_RequestParamsProxied(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 
@@ -937,6 +1061,10 @@ func TestProxyStore_Series_RequestParamsProxied(t *testing.T) {
 		component.Query,
 		nil,
 		0*time.Second,
+		0*time.Second,
+		nil,
+		nil,
+		nil,
 	)
 
 	ctx := context.Background()
@@ -997,6 +1125,10 @@ func TestProxyStore_Series_RegressionFillResponseChannel(t *testing.T) {
 		component.Query,
 		labels.FromStrings("fed", "a"),
 		0*time.Second,
+		0*time.Second,
+		nil,
+		nil,
+		nil,
 	)
 
 	ctx := context.Background()
@@ -1036,6 +1168,10 @@ func TestProxyStore_LabelValues(t *testing.T) {
 		component.Query,
 		nil,
 		0*time.Second,
+		0*time.Second,
+		nil,
+		nil,
+		nil,
 	)
 
 	ctx := context.Background()
@@ -1051,6 +1187,45 @@ func TestProxyStore_LabelValues(t *testing.T) {
 	testutil.Equals(t, 1, len(resp.Warnings))
 }
 
+func TestProxyStore_UnsortedLabels(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	cls := []Client{
+		&testClient{StoreClient: &mockedStoreAPI{
+			RespLabelNames:  &storepb.LabelNamesResponse{Names: []string{"c", "a"}},
+			RespLabelValues: &storepb.LabelValuesResponse{Values: []string{"3", "1"}},
+		}},
+		&testClient{StoreClient: &mockedStoreAPI{
+			RespLabelNames:  &storepb.LabelNamesResponse{Names: []string{"b", "a"}},
+			RespLabelValues: &storepb.LabelValuesResponse{Values: []string{"2", "1"}},
+		}},
+	}
+	q := NewProxyStore(nil, nil, func() []Client { return cls }, component.Query, nil, 0, 0, nil, nil, nil)
+
+	// NOTE: Sorting merges sort the responses of the stores in place, so the unsorted case goes first.
+	for _, unsorted := range []bool{true, false} {
+		t.Run(fmt.Sprintf("unsorted=%v", unsorted), func(t *testing.T) {
+			ctx := context.Background()
+			if unsorted {
+				ctx = ContextWithUnsortedLabels(ctx)
+			}
+
+			names, err := q.LabelNames(ctx, &storepb.LabelNamesRequest{})
+			testutil.Ok(t, err)
+			values, err := q.LabelValues(ctx, &storepb.LabelValuesRequest{Label: "a"})
+			testutil.Ok(t, err)
+
+			// Unsorted results have the same names and values without duplicates, in the order the stores responded.
+			testutil.Equals(t, !unsorted, sort.StringsAreSorted(names.Names))
+			testutil.Equals(t, !unsorted, sort.StringsAreSorted(values.Values))
+			sort.Strings(names.Names)
+			sort.Strings(values.Values)
+			testutil.Equals(t, []string{"a", "b", "c"}, names.Names)
+			testutil.Equals(t, []string{"1", "2", "3"}, values.Values)
+		})
+	}
+}
+
 func TestProxyStore_LabelNames(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 
@@ -1131,6 +1306,32 @@ func TestProxyStore_LabelNames(t *testing.T) {
 			expectedNames:       []string{"a", "b"},
 			expectedWarningsLen: 1,
 		},
+		{
+			title: "label_names with matchers skip stores with not matching external labels",
+			storeAPIs: []Client{
+				&testClient{
+					StoreClient: &mockedStoreAPI{
+						RespLabelNames: &storepb.LabelNamesResponse{
+							Names: []string{"a", "b"},
+						},
+					},
+					labelSets: []storepb.LabelSet{{Labels: []storepb.Label{{Name: "ext", Value: "1"}}}},
+				},
+				&testClient{
+					StoreClient: &mockedStoreAPI{
+						RespLabelNames: &storepb.LabelNamesResponse{
+							Names: []string{"a", "c", "d"},
+						},
+					},
+					labelSets: []storepb.LabelSet{{Labels: []storepb.Label{{Name: "ext", Value: "2"}}}},
+				},
+			},
+			req: &storepb.LabelNamesRequest{
+				Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "ext", Value: "2"}},
+			},
+			expectedNames:       []string{"a", "c", "d"},
+			expectedWarningsLen: 0,
+		},
 	} {
 		if ok := t.Run(tc.title, func(t *testing.T) {
 			q := NewProxyStore(
@@ -1140,6 +1341,10 @@ func TestProxyStore_LabelNames(t *testing.T) {
 				component.Query,
 				nil,
 				0*time.Second,
+				0*time.Second,
+				nil,
+				nil,
+				nil,
 			)
 
 			ctx := context.Background()
@@ -0,0 +1,134 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// blockQuarantine tracks blocks repeatedly failing to load or to be read, e.g. because they are corrupted.
+// Blocks failing more than the maximum number of times are quarantined: they are neither loaded nor queried
+// until the retry interval passed. A block failing again after the retry is quarantined right away.
+type blockQuarantine struct {
+	logger        log.Logger
+	maxFailures   int
+	retryInterval time.Duration
+	now           func() time.Time
+
+	mtx    sync.Mutex
+	blocks map[ulid.ULID]*quarantinedBlock
+
+	quarantines prometheus.Counter
+}
+
+type quarantinedBlock struct {
+	failures int
+	// until is the time until which the block is quarantined, zero if it is not quarantined yet.
+	until time.Time
+}
+
+// newBlockQuarantine returns a quarantine for blocks failing more than maxFailures times.
+// The quarantine is disabled if maxFailures is 0.
+func newBlockQuarantine(logger log.Logger, reg prometheus.Registerer, maxFailures int, retryInterval time.Duration) *blockQuarantine {
+	q := &blockQuarantine{
+		logger:        logger,
+		maxFailures:   maxFailures,
+		retryInterval: retryInterval,
+		now:           time.Now,
+		blocks:        map[ulid.ULID]*quarantinedBlock{},
+		quarantines: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_bucket_store_block_quarantines_total",
+			Help: "Total number of times blocks were quarantined after repeatedly failing to load or to be read.",
+		}),
+	}
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "thanos_bucket_store_blocks_quarantined",
+		Help: "Number of blocks currently quarantined after repeatedly failing to load or to be read.",
+	}, func() float64 {
+		q.mtx.Lock()
+		defer q.mtx.Unlock()
+
+		n := 0
+		for _, b := range q.blocks {
+			if q.now().Before(b.until) {
+				n++
+			}
+		}
+		return float64(n)
+	})
+	return q
+}
+
+// failed records a failure to load or read the given block and returns true if the block is quarantined.
+func (q *blockQuarantine) failed(id ulid.ULID, err error) bool {
+	if q.maxFailures <= 0 {
+		return false
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	b, ok := q.blocks[id]
+	if !ok {
+		b = &quarantinedBlock{}
+		q.blocks[id] = b
+	}
+	b.failures++
+	if b.failures < q.maxFailures {
+		return false
+	}
+	if q.now().Before(b.until) {
+		return true
+	}
+	b.until = q.now().Add(q.retryInterval)
+	q.quarantines.Inc()
+	level.Warn(q.logger).Log("msg", "quarantined block after repeated failures", "block", id, "failures", b.failures, "until", b.until, "err", err)
+	return true
+}
+
+// loaded resets the failures of the given block once it was loaded successfully.
+func (q *blockQuarantine) loaded(id ulid.ULID) {
+	if q.maxFailures <= 0 {
+		return
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	b, ok := q.blocks[id]
+	if !ok || q.now().Before(b.until) {
+		return
+	}
+	delete(q.blocks, id)
+}
+
+// quarantined returns true if the given block is currently quarantined.
+func (q *blockQuarantine) quarantined(id ulid.ULID) bool {
+	if q.maxFailures <= 0 {
+		return false
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	b, ok := q.blocks[id]
+	return ok && q.now().Before(b.until)
+}
+
+// forgetMissing removes blocks not present in the given metas from the quarantine, e.g. once they were deleted.
+func (q *blockQuarantine) forgetMissing(metas map[ulid.ULID]*metadata.Meta) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	for id := range q.blocks {
+		if _, ok := metas[id]; !ok {
+			delete(q.blocks, id)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestBlockQuarantine(t *testing.T) {
+	id := ulid.MustNew(1, nil)
+	now := time.Unix(0, 0)
+
+	q := newBlockQuarantine(log.NewNopLogger(), nil, 3, time.Hour)
+	q.now = func() time.Time { return now }
+
+	testutil.Assert(t, !q.failed(id, errors.New("failure")), "block should not be quarantined after 1 failure")
+	testutil.Assert(t, !q.failed(id, errors.New("failure")), "block should not be quarantined after 2 failures")
+	// Loading the block successfully resets its failures.
+	q.loaded(id)
+	testutil.Assert(t, !q.failed(id, errors.New("failure")), "block should not be quarantined after reset")
+	testutil.Assert(t, !q.failed(id, errors.New("failure")), "block should not be quarantined after reset")
+	testutil.Assert(t, q.failed(id, errors.New("failure")), "block should be quarantined after 3 failures")
+	testutil.Assert(t, q.quarantined(id), "block should be quarantined")
+
+	// Loading does not reset quarantined blocks.
+	q.loaded(id)
+	testutil.Assert(t, q.quarantined(id), "block should be quarantined")
+
+	now = now.Add(time.Hour)
+	testutil.Assert(t, !q.quarantined(id), "block should be retried after the retry interval")
+	testutil.Assert(t, q.failed(id, errors.New("failure")), "block should be quarantined right away after failing again")
+	testutil.Equals(t, 2.0, promtest.ToFloat64(q.quarantines))
+
+	disabled := newBlockQuarantine(log.NewNopLogger(), nil, 0, time.Hour)
+	for i := 0; i < 10; i++ {
+		testutil.Assert(t, !disabled.failed(id, errors.New("failure")), "disabled quarantine should not quarantine blocks")
+	}
+	testutil.Assert(t, !disabled.quarantined(id), "disabled quarantine should not quarantine blocks")
+}
@@ -0,0 +1,348 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/exthttp"
+	"github.com/thanos-io/thanos/pkg/runutil"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+	"github.com/thanos-io/thanos/pkg/tracing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v2"
+)
+
+// RemoteReadConfig is the configuration of the remote read endpoints queried as stores.
+type RemoteReadConfig struct {
+	Endpoints []RemoteReadEndpointConfig `yaml:"endpoints"`
+}
+
+// RemoteReadEndpointConfig is the configuration of a single remote read endpoint.
+type RemoteReadEndpointConfig struct {
+	// URL is the URL of the remote read endpoint, e.g. http://prometheus:9090/api/v1/read.
+	URL string `yaml:"url"`
+	// ExternalLabels are attached to all series read from the endpoint, overwriting labels of the same name.
+	ExternalLabels map[string]string `yaml:"external_labels"`
+}
+
+// NewRemoteReadClients parses the given YAML remote read configuration and returns a store client
+// for each of its endpoints.
+func NewRemoteReadClients(logger log.Logger, confYAML []byte) ([]Client, error) {
+	var conf RemoteReadConfig
+	if err := yaml.UnmarshalStrict(confYAML, &conf); err != nil {
+		return nil, errors.Wrap(err, "parse remote read config")
+	}
+
+	clients := make([]Client, 0, len(conf.Endpoints))
+	for i, ec := range conf.Endpoints {
+		if ec.URL == "" {
+			return nil, errors.Errorf("endpoint %d: no url specified", i)
+		}
+		u, err := url.Parse(ec.URL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "endpoint %d: parse url", i)
+		}
+		s := NewRemoteReadStore(logger, nil, u, labels.FromMap(ec.ExternalLabels))
+		clients = append(clients, NewLocalClient(s, ec.URL, s.externalLabels, math.MinInt64, math.MaxInt64))
+	}
+	return clients, nil
+}
+
+// RemoteReadStore implements the store API on top of a Prometheus remote read endpoint. Contrary to the
+// PrometheusStore it relies on the remote read protocol only, so that it can be used with any remote read endpoint.
+type RemoteReadStore struct {
+	logger         log.Logger
+	url            *url.URL
+	client         *http.Client
+	externalLabels labels.Labels
+}
+
+// NewRemoteReadStore returns a new RemoteReadStore that uses the given HTTP client to read from the given
+// remote read URL. It attaches the provided external labels to all results.
+func NewRemoteReadStore(logger log.Logger, client *http.Client, u *url.URL, externalLabels labels.Labels) *RemoteReadStore {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	if client == nil {
+		client = &http.Client{
+			Transport: tracing.HTTPTripperware(logger, exthttp.NewTransport()),
+		}
+	}
+	return &RemoteReadStore{
+		logger:         logger,
+		url:            u,
+		client:         client,
+		externalLabels: externalLabels,
+	}
+}
+
+// Info returns store information about the remote read endpoint. The time range of its data is unknown.
+func (s *RemoteReadStore) Info(context.Context, *storepb.InfoRequest) (*storepb.InfoResponse, error) {
+	res := &storepb.InfoResponse{
+		Labels:    storepb.PromLabelsToLabels(s.externalLabels),
+		StoreType: component.Sidecar.ToProto(),
+		MinTime:   math.MinInt64,
+		MaxTime:   math.MaxInt64,
+		LabelSets: []storepb.LabelSet{},
+	}
+	if len(res.Labels) > 0 {
+		res.LabelSets = append(res.LabelSets, storepb.LabelSet{Labels: res.Labels})
+	}
+	return res, nil
+}
+
+// Series returns all series for a requested time range and label matcher.
+func (s *RemoteReadStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	match, matchers, err := matchesExternalLabels(r.Matchers, s.externalLabels)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !match {
+		return nil
+	}
+	if len(matchers) == 0 {
+		return status.Error(codes.InvalidArgument, "no matchers specified (excluding external labels)")
+	}
+
+	q := &prompb.Query{StartTimestampMs: r.MinTime, EndTimestampMs: r.MaxTime}
+	for _, m := range matchers {
+		pm := &prompb.LabelMatcher{Name: m.Name, Value: m.Value}
+
+		switch m.Type {
+		case storepb.LabelMatcher_EQ:
+			pm.Type = prompb.LabelMatcher_EQ
+		case storepb.LabelMatcher_NEQ:
+			pm.Type = prompb.LabelMatcher_NEQ
+		case storepb.LabelMatcher_RE:
+			pm.Type = prompb.LabelMatcher_RE
+		case storepb.LabelMatcher_NRE:
+			pm.Type = prompb.LabelMatcher_NRE
+		default:
+			return errors.New("unrecognized matcher type")
+		}
+		q.Matchers = append(q.Matchers, pm)
+	}
+
+	resp, err := s.read(srv.Context(), q)
+	if err != nil {
+		return errors.Wrap(err, "remote read")
+	}
+
+	for _, ts := range resp.Results[0].Timeseries {
+		// Remote read endpoints may return samples outside of the requested time range.
+		samples := ts.Samples[:0]
+		for _, smpl := range ts.Samples {
+			if smpl.Timestamp >= r.MinTime && smpl.Timestamp <= r.MaxTime {
+				samples = append(samples, smpl)
+			}
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		ts.Samples = samples
+
+		series := &storepb.Series{Labels: translateAndExtendLabels(ts.Labels, s.externalLabels)}
+		if !r.SkipChunks {
+			// XOR encoding supports a max size of 2^16 - 1 samples, so we need
+			// to chunk all samples into groups of no more than 2^16 - 1.
+			if series.Chunks, err = chunkSamples(ts, math.MaxUint16); err != nil {
+				return err
+			}
+		}
+		if err := srv.Send(storepb.NewSeriesResponse(series)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read sends a remote read request for the given query and returns its sampled response.
+func (s *RemoteReadStore) read(ctx context.Context, q *prompb.Query) (*prompb.ReadResponse, error) {
+	reqb, err := proto.Marshal(&prompb.ReadRequest{
+		Queries:               []*prompb.Query{q},
+		AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{prompb.ReadRequest_SAMPLES},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal read request")
+	}
+
+	req, err := http.NewRequest("POST", s.url.String(), bytes.NewReader(snappy.Encode(nil, reqb)))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create request")
+	}
+	req.Header.Add("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("X-Prometheus-Remote-Read-Version", "0.1.0")
+
+	span, ctx := tracing.StartSpan(ctx, "remote_read_request")
+	defer span.Finish()
+
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "send request")
+	}
+	defer runutil.ExhaustCloseWithLogOnErr(s.logger, resp.Body, "remote read response body")
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "read response")
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, errors.Errorf("request failed with code %s; msg %s", resp.Status, string(b))
+	}
+
+	decomp, err := snappy.Decode(nil, b)
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress response")
+	}
+	var data prompb.ReadResponse
+	if err := proto.Unmarshal(decomp, &data); err != nil {
+		return nil, errors.Wrap(err, "unmarshal response")
+	}
+	if len(data.Results) != 1 {
+		return nil, errors.Errorf("unexpected result size %d", len(data.Results))
+	}
+	return &data, nil
+}
+
+// LabelNames returns the names of the external labels. The remote read protocol has no means
+// to request the label names of series.
+func (s *RemoteReadStore) LabelNames(context.Context, *storepb.LabelNamesRequest) (*storepb.LabelNamesResponse, error) {
+	names := make([]string, 0, len(s.externalLabels))
+	for _, l := range s.externalLabels {
+		names = append(names, l.Name)
+	}
+	sort.Strings(names)
+	return &storepb.LabelNamesResponse{Names: names}, nil
+}
+
+// LabelValues returns the value of the given external label. The remote read protocol has no means
+// to request the label values of series.
+func (s *RemoteReadStore) LabelValues(_ context.Context, r *storepb.LabelValuesRequest) (*storepb.LabelValuesResponse, error) {
+	if v := s.externalLabels.Get(r.Label); v != "" {
+		return &storepb.LabelValuesResponse{Values: []string{v}}, nil
+	}
+	return &storepb.LabelValuesResponse{Values: []string{}}, nil
+}
+
+// localClient is a Client calling a store server within the same process.
+type localClient struct {
+	srv        storepb.StoreServer
+	addr       string
+	labelSets  []storepb.LabelSet
+	mint, maxt int64
+}
+
+// NewLocalClient returns a Client for the given store server running in the same process.
+// The addr identifies the store, e.g. for routing, and the label set and time range are those advertised for it.
+func NewLocalClient(srv storepb.StoreServer, addr string, lset labels.Labels, mint, maxt int64) Client {
+	c := &localClient{srv: srv, addr: addr, mint: mint, maxt: maxt}
+	if len(lset) > 0 {
+		c.labelSets = []storepb.LabelSet{{Labels: storepb.PromLabelsToLabels(lset)}}
+	}
+	return c
+}
+
+func (c *localClient) Info(ctx context.Context, r *storepb.InfoRequest, _ ...grpc.CallOption) (*storepb.InfoResponse, error) {
+	return c.srv.Info(ctx, r)
+}
+
+func (c *localClient) Series(ctx context.Context, r *storepb.SeriesRequest, _ ...grpc.CallOption) (storepb.Store_SeriesClient, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	respCh := make(chan *storepb.SeriesResponse)
+	sc := &localSeriesClient{ctx: ctx, cancel: cancel, respCh: respCh}
+	go func() {
+		sc.err = c.srv.Series(r, &localSeriesServer{ctx: ctx, respCh: respCh})
+		close(respCh)
+	}()
+	return sc, nil
+}
+
+func (c *localClient) LabelNames(ctx context.Context, r *storepb.LabelNamesRequest, _ ...grpc.CallOption) (*storepb.LabelNamesResponse, error) {
+	return c.srv.LabelNames(ctx, r)
+}
+
+func (c *localClient) LabelValues(ctx context.Context, r *storepb.LabelValuesRequest, _ ...grpc.CallOption) (*storepb.LabelValuesResponse, error) {
+	return c.srv.LabelValues(ctx, r)
+}
+
+func (c *localClient) LabelSets() []storepb.LabelSet { return c.labelSets }
+
+func (c *localClient) TimeRange() (mint int64, maxt int64) { return c.mint, c.maxt }
+
+func (c *localClient) String() string { return c.addr }
+
+func (c *localClient) Addr() string { return c.addr }
+
+// localSeriesServer passes the responses of a store server's Series call to a localSeriesClient.
+type localSeriesServer struct {
+	// This field just exist to pseudo-implement the unused methods of the interface.
+	storepb.Store_SeriesServer
+
+	ctx    context.Context
+	respCh chan<- *storepb.SeriesResponse
+}
+
+func (s *localSeriesServer) Send(r *storepb.SeriesResponse) error {
+	select {
+	case s.respCh <- r:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func (s *localSeriesServer) Context() context.Context {
+	return s.ctx
+}
+
+// localSeriesClient receives the responses of a store server's Series call running in the same process.
+type localSeriesClient struct {
+	// This field just exist to pseudo-implement the unused methods of the interface.
+	storepb.Store_SeriesClient
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	respCh <-chan *storepb.SeriesResponse
+	// err is the result of the Series call, set before respCh is closed.
+	err error
+}
+
+func (c *localSeriesClient) Recv() (*storepb.SeriesResponse, error) {
+	r, ok := <-c.respCh
+	if ok {
+		return r, nil
+	}
+	c.cancel()
+	if c.err != nil {
+		return nil, c.err
+	}
+	return nil, io.EOF
+}
+
+func (c *localSeriesClient) Context() context.Context {
+	return c.ctx
+}
+
+func (c *localSeriesClient) CloseSend() error {
+	return nil
+}
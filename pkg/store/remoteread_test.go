@@ -0,0 +1,185 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// remoteReadServer is a mock remote read endpoint recording the received queries.
+type remoteReadServer struct {
+	t       *testing.T
+	series  []prompb.TimeSeries
+	queries []*prompb.Query
+}
+
+func (s *remoteReadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
+	testutil.Ok(s.t, err)
+	testutil.Equals(s.t, "snappy", r.Header.Get("Content-Encoding"))
+
+	decomp, err := snappy.Decode(nil, b)
+	testutil.Ok(s.t, err)
+	var req prompb.ReadRequest
+	testutil.Ok(s.t, proto.Unmarshal(decomp, &req))
+	testutil.Equals(s.t, 1, len(req.Queries))
+	s.queries = append(s.queries, req.Queries[0])
+
+	// Like most remote read endpoints, series are not filtered by the query.
+	resp := &prompb.ReadResponse{Results: []*prompb.QueryResult{{}}}
+	for i := range s.series {
+		resp.Results[0].Timeseries = append(resp.Results[0].Timeseries, &s.series[i])
+	}
+	rb, err := proto.Marshal(resp)
+	testutil.Ok(s.t, err)
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	_, err = w.Write(snappy.Encode(nil, rb))
+	testutil.Ok(s.t, err)
+}
+
+func TestRemoteReadStore_Series(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	srv := &remoteReadServer{
+		t: t,
+		series: []prompb.TimeSeries{
+			{
+				Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}, {Name: "region", Value: "other"}},
+				Samples: []prompb.Sample{{Timestamp: 50, Value: 1}, {Timestamp: 100, Value: 2}, {Timestamp: 200, Value: 3}, {Timestamp: 300, Value: 4}},
+			},
+			{
+				Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "b"}},
+				Samples: []prompb.Sample{{Timestamp: 400, Value: 5}},
+			},
+		},
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL + "/api/v1/read")
+	testutil.Ok(t, err)
+	s := NewRemoteReadStore(nil, nil, u, labels.FromStrings("region", "eu"))
+
+	t.Run("translates matchers and filters samples by time range", func(t *testing.T) {
+		srv.queries = nil
+		res := newStoreSeriesServer(context.Background())
+		testutil.Ok(t, s.Series(&storepb.SeriesRequest{
+			MinTime: 100,
+			MaxTime: 200,
+			Matchers: []storepb.LabelMatcher{
+				{Type: storepb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+				{Type: storepb.LabelMatcher_NEQ, Name: "job", Value: "c"},
+				{Type: storepb.LabelMatcher_RE, Name: "instance", Value: ".+"},
+				{Type: storepb.LabelMatcher_NRE, Name: "env", Value: "dev|test"},
+				{Type: storepb.LabelMatcher_EQ, Name: "region", Value: "eu"},
+			},
+		}, res))
+
+		testutil.Equals(t, []*prompb.Query{{
+			StartTimestampMs: 100,
+			EndTimestampMs:   200,
+			Matchers: []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+				{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "c"},
+				{Type: prompb.LabelMatcher_RE, Name: "instance", Value: ".+"},
+				{Type: prompb.LabelMatcher_NRE, Name: "env", Value: "dev|test"},
+			},
+		}}, srv.queries)
+
+		// The series without samples in the time range is dropped and the external labels overwrite the series labels.
+		seriesEquals(t, []rawSeries{
+			{
+				lset:   []storepb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}, {Name: "region", Value: "eu"}},
+				chunks: [][]sample{{{100, 2}, {200, 3}}},
+			},
+		}, res.SeriesSet)
+	})
+	t.Run("external labels not matching", func(t *testing.T) {
+		srv.queries = nil
+		res := newStoreSeriesServer(context.Background())
+		testutil.Ok(t, s.Series(&storepb.SeriesRequest{
+			MinTime: 0,
+			MaxTime: 1000,
+			Matchers: []storepb.LabelMatcher{
+				{Type: storepb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+				{Type: storepb.LabelMatcher_EQ, Name: "region", Value: "us"},
+			},
+		}, res))
+		testutil.Equals(t, 0, len(srv.queries))
+		testutil.Equals(t, 0, len(res.SeriesSet))
+	})
+	t.Run("skip chunks", func(t *testing.T) {
+		res := newStoreSeriesServer(context.Background())
+		testutil.Ok(t, s.Series(&storepb.SeriesRequest{
+			MinTime:    300,
+			MaxTime:    1000,
+			SkipChunks: true,
+			Matchers:   []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+		}, res))
+		testutil.Equals(t, []storepb.Series{
+			{Labels: []storepb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}, {Name: "region", Value: "eu"}}},
+			{Labels: []storepb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "b"}, {Name: "region", Value: "eu"}}},
+		}, res.SeriesSet)
+	})
+	t.Run("through proxy", func(t *testing.T) {
+		clients, err := NewRemoteReadClients(nil, []byte("endpoints:\n- url: "+u.String()+"\n  external_labels:\n    region: eu\n"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(clients))
+		testutil.Equals(t, u.String(), clients[0].Addr())
+		testutil.Equals(t, []storepb.LabelSet{{Labels: []storepb.Label{{Name: "region", Value: "eu"}}}}, clients[0].LabelSets())
+
+		q := NewProxyStore(nil, nil, func() []Client { return clients }, component.Query, nil, 0*time.Second, 0*time.Second, nil, nil, nil)
+		res := newStoreSeriesServer(context.Background())
+		testutil.Ok(t, q.Series(&storepb.SeriesRequest{
+			MinTime:  0,
+			MaxTime:  150,
+			Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+		}, res))
+		seriesEquals(t, []rawSeries{
+			{
+				lset:   []storepb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}, {Name: "region", Value: "eu"}},
+				chunks: [][]sample{{{50, 1}, {100, 2}}},
+			},
+		}, res.SeriesSet)
+	})
+}
+
+func TestNewRemoteReadClients(t *testing.T) {
+	for _, tcase := range []struct {
+		name string
+		conf string
+		ok   bool
+	}{
+		{name: "valid", conf: "endpoints:\n- url: http://prometheus:9090/api/v1/read\n  external_labels:\n    replica: a\n", ok: true},
+		{name: "empty", conf: "", ok: true},
+		{name: "unknown field", conf: "endpoints:\n- address: http://prometheus:9090/api/v1/read\n"},
+		{name: "no url", conf: "endpoints:\n- external_labels:\n    replica: a\n"},
+		{name: "invalid url", conf: "endpoints:\n- url: '%zz'\n"},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			_, err := NewRemoteReadClients(nil, []byte(tcase.conf))
+			if tcase.ok {
+				testutil.Ok(t, err)
+				return
+			}
+			testutil.NotOk(t, err)
+		})
+	}
+}
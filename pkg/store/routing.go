@@ -0,0 +1,174 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"gopkg.in/yaml.v2"
+)
+
+// RoutingConfig is the configuration of the store routing rules.
+type RoutingConfig struct {
+	// Rules are evaluated in order, the first rule applying to a request selects the stores it is sent to.
+	Rules []RoutingRuleConfig `yaml:"rules"`
+	// Default selects the stores of requests no rule applies to. All stores are selected if empty.
+	Default []string `yaml:"default"`
+	// Fallback are regular expressions matching the addresses of fallback stores. Fallback stores are never
+	// selected by rules, they are only queried if the selected stores fail or return no series.
+	Fallback []string `yaml:"fallback"`
+}
+
+// RoutingRuleConfig is the configuration of a single store routing rule. A rule applies to a request
+// if all of its non-empty conditions hold.
+type RoutingRuleConfig struct {
+	// MinRange and MaxRange bound the time range covered by the request.
+	MinRange model.Duration `yaml:"min_range"`
+	MaxRange model.Duration `yaml:"max_range"`
+	// Matchers is a series selector, e.g. '{tenant_id="team-a"}'. Each of its matchers must match the value of
+	// an equality matcher of the request for the same label name.
+	Matchers string `yaml:"matchers"`
+	// Stores are regular expressions matching the addresses of the stores requests are sent to.
+	Stores []string `yaml:"stores"`
+}
+
+// StoreRouter selects the stores requests are sent to according to routing rules.
+type StoreRouter struct {
+	rules    []routingRule
+	defaults []*regexp.Regexp
+	fallback []*regexp.Regexp
+}
+
+type routingRule struct {
+	minRange, maxRange time.Duration
+	matchers           []*labels.Matcher
+	stores             []*regexp.Regexp
+}
+
+// NewStoreRouter parses the given YAML routing configuration and returns a router for it.
+func NewStoreRouter(confYAML []byte) (*StoreRouter, error) {
+	var conf RoutingConfig
+	if err := yaml.UnmarshalStrict(confYAML, &conf); err != nil {
+		return nil, errors.Wrap(err, "parse routing config")
+	}
+
+	r := &StoreRouter{}
+	for i, rc := range conf.Rules {
+		rule := routingRule{
+			minRange: time.Duration(rc.MinRange),
+			maxRange: time.Duration(rc.MaxRange),
+		}
+		if rule.maxRange > 0 && rule.minRange > rule.maxRange {
+			return nil, errors.Errorf("rule %d: min_range %s is larger than max_range %s", i, rc.MinRange, rc.MaxRange)
+		}
+		if rc.Matchers != "" {
+			ms, err := promql.ParseMetricSelector(rc.Matchers)
+			if err != nil {
+				return nil, errors.Wrapf(err, "rule %d: parse matchers", i)
+			}
+			rule.matchers = ms
+		}
+		if len(rc.Stores) == 0 {
+			return nil, errors.Errorf("rule %d: no stores specified", i)
+		}
+		stores, err := compileStoreRegexps(rc.Stores)
+		if err != nil {
+			return nil, errors.Wrapf(err, "rule %d", i)
+		}
+		rule.stores = stores
+		r.rules = append(r.rules, rule)
+	}
+
+	defaults, err := compileStoreRegexps(conf.Default)
+	if err != nil {
+		return nil, errors.Wrap(err, "default")
+	}
+	r.defaults = defaults
+
+	fallback, err := compileStoreRegexps(conf.Fallback)
+	if err != nil {
+		return nil, errors.Wrap(err, "fallback")
+	}
+	r.fallback = fallback
+	return r, nil
+}
+
+func compileStoreRegexps(exprs []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(exprs))
+	for _, e := range exprs {
+		re, err := regexp.Compile("^(?:" + e + ")$")
+		if err != nil {
+			return nil, errors.Wrapf(err, "compile store regexp %q", e)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// selects returns true if the rule applies to a request for the given time range and matchers.
+func (r routingRule) selects(mint, maxt int64, matchers []storepb.LabelMatcher) bool {
+	rng := time.Duration(maxt-mint) * time.Millisecond
+	if rng < r.minRange || (r.maxRange > 0 && rng > r.maxRange) {
+		return false
+	}
+	for _, rm := range r.matchers {
+		ok := false
+		for _, m := range matchers {
+			if m.Type == storepb.LabelMatcher_EQ && m.Name == rm.Name && rm.Matches(m.Value) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Route returns a function reporting whether a request for the given time range and matchers
+// is sent to the store with the given address. A nil router sends requests to all stores.
+func (r *StoreRouter) Route(mint, maxt int64, matchers []storepb.LabelMatcher) func(addr string) bool {
+	if r == nil {
+		return func(string) bool { return true }
+	}
+
+	stores := r.defaults
+	for _, rule := range r.rules {
+		if rule.selects(mint, maxt, matchers) {
+			stores = rule.stores
+			break
+		}
+	}
+	if len(stores) == 0 {
+		return func(string) bool { return true }
+	}
+	return func(addr string) bool {
+		return matchesAny(stores, addr)
+	}
+}
+
+// Fallback returns true if the store with the given address is a fallback store.
+// A nil router has no fallback stores.
+func (r *StoreRouter) Fallback(addr string) bool {
+	if r == nil {
+		return false
+	}
+	return matchesAny(r.fallback, addr)
+}
+
+func matchesAny(res []*regexp.Regexp, addr string) bool {
+	for _, re := range res {
+		if re.MatchString(addr) {
+			return true
+		}
+	}
+	return false
+}
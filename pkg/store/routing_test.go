@@ -0,0 +1,288 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+const testRoutingConfig = `
+rules:
+- min_range: 7d
+  stores: ["long-term-.*"]
+- matchers: '{tenant_id=~"team-a|team-b"}'
+  max_range: 1d
+  stores: ["team-ab:10901"]
+default: ["recent-.*", "team-ab:10901"]
+`
+
+func TestNewStoreRouter(t *testing.T) {
+	for _, tcase := range []struct {
+		name string
+		conf string
+		ok   bool
+	}{
+		{name: "valid", conf: testRoutingConfig, ok: true},
+		{name: "empty", conf: "", ok: true},
+		{name: "unknown field", conf: "rules:\n- min_range: 1d\n  store: [a]\n"},
+		{name: "no stores", conf: "rules:\n- min_range: 1d\n"},
+		{name: "invalid range", conf: "rules:\n- min_range: 2d\n  max_range: 1d\n  stores: [a]\n"},
+		{name: "invalid matchers", conf: "rules:\n- matchers: '{a=}'\n  stores: [a]\n"},
+		{name: "invalid store regexp", conf: "rules:\n- stores: ['(']\n"},
+		{name: "invalid default store regexp", conf: "default: ['(']\n"},
+		{name: "invalid fallback store regexp", conf: "fallback: ['(']\n"},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			_, err := NewStoreRouter([]byte(tcase.conf))
+			if tcase.ok {
+				testutil.Ok(t, err)
+				return
+			}
+			testutil.NotOk(t, err)
+		})
+	}
+}
+
+func TestStoreRouter_Route(t *testing.T) {
+	r, err := NewStoreRouter([]byte(testRoutingConfig))
+	testutil.Ok(t, err)
+
+	const day = int64(24 * time.Hour / time.Millisecond)
+	var (
+		addrs  = []string{"long-term-1:10901", "long-term-2:10901", "team-ab:10901", "recent-1:10901", "other:10901"}
+		metric = storepb.LabelMatcher{Type: storepb.LabelMatcher_EQ, Name: "__name__", Value: "up"}
+	)
+	for _, tcase := range []struct {
+		name     string
+		mint     int64
+		maxt     int64
+		matchers []storepb.LabelMatcher
+		expected []string
+	}{
+		{
+			name:     "long range",
+			maxt:     8 * day,
+			matchers: []storepb.LabelMatcher{metric},
+			expected: []string{"long-term-1:10901", "long-term-2:10901"},
+		},
+		{
+			name:     "first matching rule wins",
+			maxt:     8 * day,
+			matchers: []storepb.LabelMatcher{metric, {Type: storepb.LabelMatcher_EQ, Name: "tenant_id", Value: "team-a"}},
+			expected: []string{"long-term-1:10901", "long-term-2:10901"},
+		},
+		{
+			name:     "tenant",
+			maxt:     day,
+			matchers: []storepb.LabelMatcher{metric, {Type: storepb.LabelMatcher_EQ, Name: "tenant_id", Value: "team-b"}},
+			expected: []string{"team-ab:10901"},
+		},
+		{
+			name:     "other tenant falls back to default",
+			maxt:     day,
+			matchers: []storepb.LabelMatcher{metric, {Type: storepb.LabelMatcher_EQ, Name: "tenant_id", Value: "team-c"}},
+			expected: []string{"team-ab:10901", "recent-1:10901"},
+		},
+		{
+			name:     "non-equality matchers falls back to default",
+			maxt:     day,
+			matchers: []storepb.LabelMatcher{metric, {Type: storepb.LabelMatcher_RE, Name: "tenant_id", Value: "team-a"}},
+			expected: []string{"team-ab:10901", "recent-1:10901"},
+		},
+		{
+			name:     "too long range for tenant falls back to default",
+			maxt:     2 * day,
+			matchers: []storepb.LabelMatcher{metric, {Type: storepb.LabelMatcher_EQ, Name: "tenant_id", Value: "team-a"}},
+			expected: []string{"team-ab:10901", "recent-1:10901"},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			routed := r.Route(tcase.mint, tcase.maxt, tcase.matchers)
+
+			var got []string
+			for _, addr := range addrs {
+				if routed(addr) {
+					got = append(got, addr)
+				}
+			}
+			testutil.Equals(t, tcase.expected, got)
+		})
+	}
+
+	t.Run("all stores without default", func(t *testing.T) {
+		r, err := NewStoreRouter([]byte("rules:\n- min_range: 7d\n  stores: [long-term-.*]\n"))
+		testutil.Ok(t, err)
+		routed := r.Route(0, 1, []storepb.LabelMatcher{metric})
+		for _, addr := range addrs {
+			testutil.Assert(t, routed(addr), "%s should be routed to", addr)
+		}
+	})
+	t.Run("all stores without router", func(t *testing.T) {
+		var r *StoreRouter
+		routed := r.Route(0, 8*day, []storepb.LabelMatcher{metric})
+		for _, addr := range addrs {
+			testutil.Assert(t, routed(addr), "%s should be routed to", addr)
+		}
+	})
+}
+
+// addrClient is a testClient with the given address.
+type addrClient struct {
+	*testClient
+	addr string
+}
+
+func (c *addrClient) Addr() string { return c.addr }
+
+func (c *addrClient) String() string { return c.addr }
+
+func TestProxyStore_SeriesRouting(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	newStore := func(addr string, lset labels.Labels) Client {
+		return &addrClient{
+			testClient: &testClient{
+				StoreClient: &mockedStoreAPI{
+					RespSeries: []*storepb.SeriesResponse{
+						storeSeriesResponse(t, lset, []sample{{1, 1}}),
+					},
+				},
+				minTime: 0,
+				maxTime: 1000,
+			},
+			addr: addr,
+		}
+	}
+	stores := func() []Client {
+		return []Client{
+			newStore("recent:10901", labels.FromStrings("store", "recent")),
+			newStore("long-term:10901", labels.FromStrings("store", "long-term")),
+		}
+	}
+	r, err := NewStoreRouter([]byte("rules:\n- min_range: 100ms\n  stores: [long-term:10901]\ndefault: [recent:10901]\n"))
+	testutil.Ok(t, err)
+	q := NewProxyStore(nil, nil, stores, component.Query, nil, 0*time.Second, 0*time.Second, r, nil, nil)
+
+	for _, tcase := range []struct {
+		name       string
+		mint, maxt int64
+		expected   string
+	}{
+		{name: "rule", mint: 0, maxt: 500, expected: "long-term"},
+		{name: "default", mint: 450, maxt: 500, expected: "recent"},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			s := newStoreSeriesServer(context.Background())
+			testutil.Ok(t, q.Series(&storepb.SeriesRequest{
+				MinTime:  tcase.mint,
+				MaxTime:  tcase.maxt,
+				Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "b"}},
+			}, s))
+
+			seriesEquals(t, []rawSeries{
+				{
+					lset:   []storepb.Label{{Name: "store", Value: tcase.expected}},
+					chunks: [][]sample{{{1, 1}}},
+				},
+			}, s.SeriesSet)
+		})
+	}
+}
+
+func TestProxyStore_SeriesFallback(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	newStore := func(addr string, series ...labels.Labels) (*mockedStoreAPI, Client) {
+		api := &mockedStoreAPI{}
+		for _, lset := range series {
+			api.RespSeries = append(api.RespSeries, storeSeriesResponse(t, lset, []sample{{1, 1}}))
+		}
+		return api, &addrClient{
+			testClient: &testClient{StoreClient: api, minTime: 0, maxTime: 1000},
+			addr:       addr,
+		}
+	}
+	r, err := NewStoreRouter([]byte("fallback: [long-term:10901]\n"))
+	testutil.Ok(t, err)
+
+	for _, tcase := range []struct {
+		name             string
+		primaryErr       error
+		primarySeries    []labels.Labels
+		partialDisabled  bool
+		expected         []rawSeries
+		expectedWarnings int
+		fallbackQueried  bool
+	}{
+		{
+			name:          "primary has data",
+			primarySeries: []labels.Labels{labels.FromStrings("store", "recent")},
+			expected:      []rawSeries{{lset: []storepb.Label{{Name: "store", Value: "recent"}}, chunks: [][]sample{{{1, 1}}}}},
+		},
+		{
+			name:            "primary has no data",
+			expected:        []rawSeries{{lset: []storepb.Label{{Name: "store", Value: "long-term"}}, chunks: [][]sample{{{1, 1}}}}},
+			fallbackQueried: true,
+		},
+		{
+			name:             "primary fails",
+			primaryErr:       errors.New("unavailable"),
+			expected:         []rawSeries{{lset: []storepb.Label{{Name: "store", Value: "long-term"}}, chunks: [][]sample{{{1, 1}}}}},
+			expectedWarnings: 1,
+			fallbackQueried:  true,
+		},
+		{
+			name:            "primary fails with partial response disabled",
+			primaryErr:      errors.New("unavailable"),
+			partialDisabled: true,
+			expected:        []rawSeries{{lset: []storepb.Label{{Name: "store", Value: "long-term"}}, chunks: [][]sample{{{1, 1}}}}},
+			fallbackQueried: true,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			primaryAPI, primary := newStore("recent:10901", tcase.primarySeries...)
+			primaryAPI.RespError = tcase.primaryErr
+			fallbackAPI, fallback := newStore("long-term:10901", labels.FromStrings("store", "long-term"))
+			q := NewProxyStore(nil, nil, func() []Client { return []Client{fallback, primary} }, component.Query, nil, 0*time.Second, 0*time.Second, r, nil, nil)
+
+			s := newStoreSeriesServer(context.Background())
+			testutil.Ok(t, q.Series(&storepb.SeriesRequest{
+				MinTime:                 0,
+				MaxTime:                 500,
+				Matchers:                []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "b"}},
+				PartialResponseDisabled: tcase.partialDisabled,
+			}, s))
+
+			seriesEquals(t, tcase.expected, s.SeriesSet)
+			testutil.Equals(t, tcase.expectedWarnings, len(s.Warnings))
+			testutil.Assert(t, primaryAPI.LastSeriesReq != nil, "primary store should always be queried")
+			testutil.Equals(t, tcase.fallbackQueried, fallbackAPI.LastSeriesReq != nil)
+		})
+	}
+
+	t.Run("fallback fails after primary failed", func(t *testing.T) {
+		primaryAPI, primary := newStore("recent:10901")
+		primaryAPI.RespError = errors.New("unavailable")
+		fallbackAPI, fallback := newStore("long-term:10901")
+		fallbackAPI.RespError = errors.New("unavailable")
+		q := NewProxyStore(nil, nil, func() []Client { return []Client{primary, fallback} }, component.Query, nil, 0*time.Second, 0*time.Second, r, nil, nil)
+
+		s := newStoreSeriesServer(context.Background())
+		testutil.NotOk(t, q.Series(&storepb.SeriesRequest{
+			MinTime:                 0,
+			MaxTime:                 500,
+			Matchers:                []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "b"}},
+			PartialResponseDisabled: true,
+		}, s))
+	})
+}
@@ -0,0 +1,143 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type storeSessionContextKey struct{}
+
+// ContextWithStoreSession returns a new context whose requests see the stores pinned by the session with the
+// given token. An empty token does not pin any stores.
+func ContextWithStoreSession(ctx context.Context, token string) context.Context {
+	if token == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, storeSessionContextKey{}, token)
+}
+
+// StoreSessionFromContext returns the store session token of the context, or an empty string if none.
+func StoreSessionFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(storeSessionContextKey{}).(string)
+	return token
+}
+
+// storeSessionsSweepInterval is the interval at which expired sessions are removed.
+const storeSessionsSweepInterval = time.Minute
+
+// StoreSessions pins the stores seen by the requests of a client session, so that e.g. a scrolling dashboard
+// does not see data appear and disappear as stores join and leave mid-session. The first request of a session
+// snapshots the addresses of the stores; later requests of the session only see the stores of the snapshot
+// that are still available. Sessions expire after their TTL, starting from their first request. Once the maximum
+// number of sessions is reached, the least recently used session is evicted to make room for new ones.
+type StoreSessions struct {
+	ttl         time.Duration
+	maxSessions int
+	now         func() time.Time
+
+	mtx       sync.Mutex
+	sessions  map[string]*list.Element
+	lru       *list.List // Of *storeSession, most recently used first.
+	lastSweep time.Time
+
+	active  prometheus.Gauge
+	evicted prometheus.Counter
+}
+
+type storeSession struct {
+	token   string
+	addrs   map[string]struct{}
+	expires time.Time
+}
+
+// NewStoreSessions returns StoreSessions pinning the stores of a session for the given TTL, holding at most the
+// given number of sessions. 0 means no limit.
+func NewStoreSessions(reg prometheus.Registerer, ttl time.Duration, maxSessions int) *StoreSessions {
+	return &StoreSessions{
+		ttl:         ttl,
+		maxSessions: maxSessions,
+		now:         time.Now,
+		sessions:    map[string]*list.Element{},
+		lru:         list.New(),
+		active: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_proxy_store_sessions",
+			Help: "Number of client sessions with pinned stores that have not expired.",
+		}),
+		evicted: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_proxy_store_sessions_evicted_total",
+			Help: "Total number of client sessions evicted before they expired, as the maximum number of sessions was reached.",
+		}),
+	}
+}
+
+// stores returns the given stores that are pinned by the session of the context, snapshotting them if the
+// session has none. All given stores are returned if the context has no session or the sessions are nil.
+func (s *StoreSessions) stores(ctx context.Context, stores []Client) []Client {
+	if s == nil {
+		return stores
+	}
+	token := StoreSessionFromContext(ctx)
+	if token == "" {
+		return stores
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	defer func() { s.active.Set(float64(len(s.sessions))) }()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) >= storeSessionsSweepInterval {
+		s.sweep(now)
+	}
+
+	if e, ok := s.sessions[token]; ok {
+		sess := e.Value.(*storeSession)
+		if now.Before(sess.expires) {
+			s.lru.MoveToFront(e)
+
+			pinned := make([]Client, 0, len(stores))
+			for _, st := range stores {
+				if _, ok := sess.addrs[st.Addr()]; ok {
+					pinned = append(pinned, st)
+				}
+			}
+			return pinned
+		}
+		s.remove(e)
+	}
+
+	if s.maxSessions > 0 && s.lru.Len() >= s.maxSessions {
+		s.remove(s.lru.Back())
+		s.evicted.Inc()
+	}
+	sess := &storeSession{token: token, addrs: make(map[string]struct{}, len(stores)), expires: now.Add(s.ttl)}
+	for _, st := range stores {
+		sess.addrs[st.Addr()] = struct{}{}
+	}
+	s.sessions[token] = s.lru.PushFront(sess)
+	return stores
+}
+
+// sweep removes the expired sessions.
+func (s *StoreSessions) sweep(now time.Time) {
+	s.lastSweep = now
+	for e := s.lru.Front(); e != nil; {
+		next := e.Next()
+		if !now.Before(e.Value.(*storeSession).expires) {
+			s.remove(e)
+		}
+		e = next
+	}
+}
+
+func (s *StoreSessions) remove(e *list.Element) {
+	delete(s.sessions, s.lru.Remove(e).(*storeSession).token)
+}
@@ -0,0 +1,115 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestProxyStore_StoreSessions(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	newStore := func(addr string) Client {
+		return &addrClient{
+			testClient: &testClient{
+				StoreClient: &mockedStoreAPI{
+					RespSeries: []*storepb.SeriesResponse{
+						storeSeriesResponse(t, labels.FromStrings("store", addr), []sample{{1, 1}}),
+					},
+					RespLabelValues: &storepb.LabelValuesResponse{Values: []string{addr}},
+				},
+				minTime: 0,
+				maxTime: 1000,
+			},
+			addr: addr,
+		}
+	}
+	stores := []Client{newStore("a"), newStore("b")}
+
+	now := time.Now()
+	sessions := NewStoreSessions(nil, time.Minute, 0)
+	sessions.now = func() time.Time { return now }
+	q := NewProxyStore(nil, nil, func() []Client { return stores }, component.Query, nil, 0, 0, nil, nil, sessions)
+
+	queried := func(token string) []string {
+		s := newStoreSeriesServer(ContextWithStoreSession(context.Background(), token))
+		testutil.Ok(t, q.Series(&storepb.SeriesRequest{
+			MinTime:  0,
+			MaxTime:  100,
+			Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "b"}},
+		}, s))
+		var res []string
+		for _, s := range s.SeriesSet {
+			res = append(res, s.Labels[0].Value)
+		}
+
+		values, err := q.LabelValues(ContextWithStoreSession(context.Background(), token), &storepb.LabelValuesRequest{Label: "store"})
+		testutil.Ok(t, err)
+		testutil.Equals(t, res, values.Values)
+		return res
+	}
+
+	testutil.Equals(t, []string{"a", "b"}, queried("session-1"))
+
+	// Stores joining and leaving mid-session do not change the stores seen by the session, except for stores that
+	// are no longer available.
+	stores = []Client{newStore("b"), newStore("c")}
+	testutil.Equals(t, []string{"b"}, queried("session-1"))
+	stores = []Client{newStore("a"), newStore("b"), newStore("c")}
+	testutil.Equals(t, []string{"a", "b"}, queried("session-1"))
+	testutil.Equals(t, []string{"a", "b"}, queried("session-1"))
+
+	// Other sessions and requests without session see the current stores.
+	testutil.Equals(t, []string{"a", "b", "c"}, queried("session-2"))
+	testutil.Equals(t, []string{"a", "b", "c"}, queried(""))
+
+	// Expired sessions snapshot the current stores again.
+	stores = []Client{newStore("a"), newStore("b"), newStore("c"), newStore("d")}
+	now = now.Add(time.Minute)
+	testutil.Equals(t, []string{"a", "b", "c", "d"}, queried("session-1"))
+	testutil.Equals(t, []string{"a", "b", "c", "d"}, queried("session-2"))
+	stores = []Client{newStore("a")}
+	testutil.Equals(t, []string{"a"}, queried("session-1"))
+}
+
+func TestStoreSessions_MaxSessions(t *testing.T) {
+	now := time.Now()
+	sessions := NewStoreSessions(nil, time.Hour, 2)
+	sessions.now = func() time.Time { return now }
+
+	a, b := &addrClient{addr: "a"}, &addrClient{addr: "b"}
+	storesOf := func(token string, stores ...Client) []string {
+		var res []string
+		for _, st := range sessions.stores(ContextWithStoreSession(context.Background(), token), stores) {
+			res = append(res, st.Addr())
+		}
+		return res
+	}
+
+	testutil.Equals(t, []string{"a"}, storesOf("session-1", a))
+	testutil.Equals(t, []string{"a"}, storesOf("session-2", a))
+	// Using session-1 makes session-2 the least recently used one, evicted by session-3.
+	testutil.Equals(t, []string{"a"}, storesOf("session-1", a, b))
+	testutil.Equals(t, []string{"a", "b"}, storesOf("session-3", a, b))
+	testutil.Equals(t, 2, len(sessions.sessions))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(sessions.evicted))
+
+	testutil.Equals(t, []string{"a"}, storesOf("session-1", a, b))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(sessions.active))
+
+	// Expired sessions are swept.
+	now = now.Add(time.Hour)
+	testutil.Equals(t, []string{"a", "b"}, storesOf("session-4", a, b))
+	testutil.Equals(t, 1, len(sessions.sessions))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(sessions.evicted))
+}
@@ -0,0 +1,220 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// slowStoreWindow is the number of latest Series requests of a store its p99 latency is computed from.
+	slowStoreWindow = 100
+	// slowStoreMinSamples is the number of Series requests a store needs before its latency is compared to its peers.
+	slowStoreMinSamples = 10
+	// slowStoreUpdateInterval is the interval at which the p99 latencies and the demotion of stores are recomputed.
+	slowStoreUpdateInterval = 5 * time.Second
+)
+
+// SlowStoreDetector tracks the p99 latency of the latest Series requests of every store and demotes stores whose
+// p99 latency exceeds the median p99 latency of their peers by the latency factor. Demoted stores stay in rotation,
+// but their Series requests are abandoned after the demoted request timeout. A demoted store whose latency recovers
+// is no longer demoted.
+// Latencies are recorded as requests complete, but the p99 latencies and the demotion of stores are only recomputed
+// once per update interval, off the lock-free path of the requests reading the demoted stores.
+type SlowStoreDetector struct {
+	logger         log.Logger
+	latencyFactor  float64
+	demotedTimeout time.Duration
+	updateInterval time.Duration
+	now            func() time.Time
+
+	mtx        sync.Mutex
+	stores     map[string]*storeLatency
+	lastUpdate time.Time
+
+	// demotedStores holds the map[string]struct{} of the addresses of demoted stores.
+	demotedStores atomic.Value
+
+	p99     *prometheus.GaugeVec
+	demoted *prometheus.GaugeVec
+}
+
+type storeLatency struct {
+	// window holds the latest latencies in a ring, next is the index the next one is written to.
+	window []time.Duration
+	next   int
+	// changed is true if latencies were recorded since the p99 latency was computed.
+	changed bool
+	p99     time.Duration
+	demoted bool
+}
+
+// NewSlowStoreDetector returns a detector demoting stores whose p99 Series latency exceeds latencyFactor times
+// the median p99 latency of the other stores. Series requests to demoted stores time out after demotedTimeout,
+// zero keeps the request timeout of all stores.
+func NewSlowStoreDetector(logger log.Logger, reg prometheus.Registerer, latencyFactor float64, demotedTimeout time.Duration) *SlowStoreDetector {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	d := &SlowStoreDetector{
+		logger:         logger,
+		latencyFactor:  latencyFactor,
+		demotedTimeout: demotedTimeout,
+		updateInterval: slowStoreUpdateInterval,
+		now:            time.Now,
+		stores:         map[string]*storeLatency{},
+		p99: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_proxy_store_series_latency_p99_seconds",
+			Help: "The 99th percentile latency of the latest Series requests of a store.",
+		}, []string{"store"}),
+		demoted: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_proxy_store_demoted",
+			Help: "Whether a store is demoted because its Series latency is too high compared to the other stores.",
+		}, []string{"store"}),
+	}
+	d.demotedStores.Store(map[string]struct{}{})
+	return d
+}
+
+// requestTimeout returns the timeout of Series requests to the store with the given address, given the request
+// timeout of all stores.
+func (d *SlowStoreDetector) requestTimeout(addr string, timeout time.Duration) time.Duration {
+	if d == nil || d.demotedTimeout <= 0 {
+		return timeout
+	}
+	if _, ok := d.demotedStores.Load().(map[string]struct{})[addr]; !ok {
+		return timeout
+	}
+	if timeout > 0 && timeout < d.demotedTimeout {
+		return timeout
+	}
+	return d.demotedTimeout
+}
+
+// observe records the latency of a Series request to the store with the given address, and updates the demotion
+// of all stores if the update interval passed.
+func (d *SlowStoreDetector) observe(addr string, latency time.Duration) {
+	if d == nil {
+		return
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	st, ok := d.stores[addr]
+	if !ok {
+		st = &storeLatency{}
+		d.stores[addr] = st
+	}
+	if len(st.window) < slowStoreWindow {
+		st.window = append(st.window, latency)
+	} else {
+		st.window[st.next] = latency
+	}
+	st.next = (st.next + 1) % slowStoreWindow
+	st.changed = true
+
+	if now := d.now(); now.Sub(d.lastUpdate) >= d.updateInterval {
+		d.lastUpdate = now
+		d.update()
+	}
+}
+
+// update recomputes the p99 latency of the stores with new latencies and the demotion of all stores.
+// It must be called with the lock held.
+func (d *SlowStoreDetector) update() {
+	var peers []time.Duration
+	for addr, st := range d.stores {
+		if st.changed {
+			sorted := append([]time.Duration(nil), st.window...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+			st.p99 = sorted[int(math.Ceil(0.99*float64(len(sorted))))-1]
+			st.changed = false
+			d.p99.WithLabelValues(addr).Set(st.p99.Seconds())
+		}
+		if len(st.window) >= slowStoreMinSamples {
+			peers = append(peers, st.p99)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+
+	demotedStores := map[string]struct{}{}
+	for addr, st := range d.stores {
+		demoted := d.slow(st, peers)
+		if demoted != st.demoted {
+			level.Warn(d.logger).Log("msg", "store demotion changed", "store", addr, "demoted", demoted, "p99", st.p99)
+		}
+		st.demoted = demoted
+		if demoted {
+			demotedStores[addr] = struct{}{}
+			d.demoted.WithLabelValues(addr).Set(1)
+		} else {
+			d.demoted.WithLabelValues(addr).Set(0)
+		}
+	}
+	d.demotedStores.Store(demotedStores)
+}
+
+// retain forgets the latencies and metrics of the stores not among the given ones, so that removed stores neither
+// leak nor are compared to the remaining stores.
+func (d *SlowStoreDetector) retain(stores []Client) {
+	if d == nil {
+		return
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if len(d.stores) == 0 {
+		return
+	}
+	addrs := make(map[string]struct{}, len(stores))
+	for _, st := range stores {
+		addrs[st.Addr()] = struct{}{}
+	}
+	removed := false
+	for addr := range d.stores {
+		if _, ok := addrs[addr]; ok {
+			continue
+		}
+		delete(d.stores, addr)
+		d.p99.DeleteLabelValues(addr)
+		d.demoted.DeleteLabelValues(addr)
+		removed = true
+	}
+	if removed {
+		d.update()
+	}
+}
+
+// slow returns true if the p99 latency of the given store exceeds the median p99 latency of its peers by the
+// latency factor, given the sorted p99 latencies of all stores with enough requests, including the given one.
+// Stores and peers with too few requests are not compared.
+func (d *SlowStoreDetector) slow(st *storeLatency, p99s []time.Duration) bool {
+	if len(st.window) < slowStoreMinSamples || len(p99s) < 2 {
+		return false
+	}
+	// The peers are all p99 latencies but the one of the store.
+	self := sort.Search(len(p99s), func(i int) bool { return p99s[i] >= st.p99 })
+	peer := func(i int) time.Duration {
+		if i >= self {
+			return p99s[i+1]
+		}
+		return p99s[i]
+	}
+	n := len(p99s) - 1
+
+	median := peer(n / 2)
+	if n%2 == 0 {
+		median = (peer(n/2-1) + peer(n/2)) / 2
+	}
+	return float64(st.p99) > d.latencyFactor*float64(median)
+}
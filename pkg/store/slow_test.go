@@ -0,0 +1,151 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestSlowStoreDetector(t *testing.T) {
+	d := NewSlowStoreDetector(nil, prometheus.NewRegistry(), 3, time.Second)
+	d.updateInterval = 0
+	observe := func(addr string, latency time.Duration, n int) {
+		for i := 0; i < n; i++ {
+			d.observe(addr, latency)
+		}
+	}
+	demoted := func(addr string) float64 {
+		return promtestutil.ToFloat64(d.demoted.WithLabelValues(addr))
+	}
+
+	observe("a", 10*time.Millisecond, slowStoreMinSamples)
+	observe("b", 20*time.Millisecond, slowStoreMinSamples)
+	// Stores with too few requests are not demoted.
+	observe("c", time.Second, slowStoreMinSamples-1)
+	testutil.Equals(t, 0.0, demoted("c"))
+	testutil.Equals(t, time.Duration(0), d.requestTimeout("c", 0))
+
+	observe("c", time.Second, 1)
+	testutil.Equals(t, 1.0, demoted("c"))
+	testutil.Equals(t, 0.0, demoted("a"))
+	testutil.Equals(t, 0.0, demoted("b"))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(d.p99.WithLabelValues("c")))
+
+	// Demoted stores time out after the demoted request timeout, bounded by the request timeout.
+	testutil.Equals(t, time.Second, d.requestTimeout("c", 0))
+	testutil.Equals(t, time.Second, d.requestTimeout("c", time.Minute))
+	testutil.Equals(t, time.Millisecond, d.requestTimeout("c", time.Millisecond))
+	testutil.Equals(t, time.Minute, d.requestTimeout("a", time.Minute))
+
+	// A single slow request in the window stays below the p99 latency.
+	observe("c", 30*time.Millisecond, slowStoreWindow-1)
+	testutil.Equals(t, 0.0, demoted("c"))
+	testutil.Equals(t, time.Minute, d.requestTimeout("c", time.Minute))
+
+	// Latencies are compared to the ones of the peers.
+	observe("a", 200*time.Millisecond, slowStoreWindow)
+	observe("b", 200*time.Millisecond, slowStoreWindow)
+	observe("c", 500*time.Millisecond, slowStoreWindow)
+	testutil.Equals(t, 0.0, demoted("c"))
+
+	// Demotion is only recomputed once per update interval.
+	now := time.Now().Add(time.Hour)
+	d.now = func() time.Time { return now }
+	d.updateInterval = time.Minute
+	observe("c", 5*time.Second, slowStoreWindow)
+	testutil.Equals(t, 0.0, demoted("c"))
+	now = now.Add(time.Minute)
+	observe("c", 5*time.Second, 1)
+	testutil.Equals(t, 1.0, demoted("c"))
+	observe("c", 30*time.Millisecond, slowStoreWindow)
+	testutil.Equals(t, 1.0, demoted("c"))
+	testutil.Equals(t, time.Second, d.requestTimeout("c", 0))
+	now = now.Add(time.Minute)
+	observe("c", 30*time.Millisecond, 1)
+	testutil.Equals(t, 0.0, demoted("c"))
+	testutil.Equals(t, time.Duration(0), d.requestTimeout("c", 0))
+
+	// Removed stores are forgotten, with their metrics.
+	d.retain([]Client{&addrClient{addr: "a"}, &addrClient{addr: "b"}})
+	testutil.Equals(t, 2, len(d.stores))
+	testutil.Equals(t, 2, promtestutil.CollectAndCount(d.p99))
+	testutil.Equals(t, 2, promtestutil.CollectAndCount(d.demoted))
+
+	// A nil detector neither tracks nor demotes stores.
+	var nilDetector *SlowStoreDetector
+	nilDetector.observe("a", time.Second)
+	nilDetector.retain(nil)
+	testutil.Equals(t, time.Minute, nilDetector.requestTimeout("a", time.Minute))
+}
+
+func TestProxyStore_SeriesDemotesSlowStore(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	newStore := func(addr string, lset labels.Labels, respDuration time.Duration) Client {
+		return &addrClient{
+			addr: addr,
+			testClient: &testClient{
+				StoreClient: &mockedStoreAPI{
+					RespSeries:   []*storepb.SeriesResponse{storeSeriesResponse(t, lset, []sample{{1, 1}})},
+					RespDuration: respDuration,
+				},
+				labelSets: []storepb.LabelSet{{Labels: []storepb.Label{{Name: "ext", Value: "1"}}}},
+				minTime:   1,
+				maxTime:   300,
+			},
+		}
+	}
+	stores := []Client{
+		newStore("fast-1", labels.FromStrings("a", "1"), 0),
+		newStore("fast-2", labels.FromStrings("a", "2"), 0),
+		newStore("slow", labels.FromStrings("a", "3"), 50*time.Millisecond),
+	}
+	req := &storepb.SeriesRequest{
+		MinTime:  1,
+		MaxTime:  300,
+		Matchers: []storepb.LabelMatcher{{Name: "ext", Value: "1", Type: storepb.LabelMatcher_EQ}},
+	}
+
+	d := NewSlowStoreDetector(nil, prometheus.NewRegistry(), 3, 20*time.Millisecond)
+	d.updateInterval = 0
+	q := NewProxyStore(nil, nil, func() []Client { return stores }, component.Query, nil, 0*time.Second, 0*time.Second, nil, d, nil)
+
+	// The slow store is queried fully until enough requests are observed to demote it.
+	for i := 0; i < slowStoreMinSamples; i++ {
+		s := newStoreSeriesServer(context.Background())
+		testutil.Ok(t, q.Series(req, s))
+		testutil.Equals(t, 3, len(s.SeriesSet))
+		testutil.Equals(t, 0, len(s.Warnings))
+	}
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(d.demoted.WithLabelValues("slow")))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(d.demoted.WithLabelValues("fast-1")))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(d.demoted.WithLabelValues("fast-2")))
+
+	// The demoted store stays in rotation, but is abandoned after the demoted request timeout.
+	s := newStoreSeriesServer(context.Background())
+	testutil.Ok(t, q.Series(req, s))
+	testutil.Equals(t, 2, len(s.SeriesSet))
+	testutil.Equals(t, 1, len(s.Warnings), "got %v", s.Warnings)
+	testutil.Assert(t, strings.Contains(s.Warnings[0], "store request timeout exceeded"), "unexpected warning %s", s.Warnings[0])
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(d.demoted.WithLabelValues("slow")))
+
+	// The removed store is forgotten.
+	stores = stores[:2]
+	s = newStoreSeriesServer(context.Background())
+	testutil.Ok(t, q.Series(req, s))
+	testutil.Equals(t, 2, len(s.SeriesSet))
+	testutil.Equals(t, 0, len(s.Warnings))
+	testutil.Equals(t, 2, promtestutil.CollectAndCount(d.demoted))
+}
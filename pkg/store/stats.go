@@ -0,0 +1,172 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+)
+
+type seriesStatsContextKey struct{}
+
+// SeriesStats accumulates the series, chunks and bytes fetched by the Series requests of a query,
+// in total and per store, along with the stores queried. It is passed through the request context, see
+// ContextWithSeriesStats. All methods of a nil SeriesStats are no-ops.
+type SeriesStats struct {
+	mtx     sync.Mutex
+	total   StoreSeriesStats
+	stores  map[string]*StoreSeriesStats
+	queried map[string]struct{}
+}
+
+// StoreSeriesStats are the stats of the series fetched from one store, or in total if Store is empty.
+type StoreSeriesStats struct {
+	Store  string `json:"store,omitempty"`
+	Series int64  `json:"series"`
+	Chunks int64  `json:"chunks"`
+	Bytes  int64  `json:"bytes"`
+	// Resolutions counts the chunks by the resolution of the data they were read from, e.g. raw, 5m or 1h.
+	// Downsampled chunks of stores not reporting their resolution are counted as unknown.
+	Resolutions map[string]int64 `json:"resolutions,omitempty"`
+}
+
+func (s *StoreSeriesStats) add(series *storepb.Series) {
+	s.Series++
+	s.Chunks += int64(len(series.Chunks))
+	s.Bytes += int64(series.Size())
+	for _, c := range series.Chunks {
+		if s.Resolutions == nil {
+			s.Resolutions = map[string]int64{}
+		}
+		s.Resolutions[chunkResolution(c)]++
+	}
+}
+
+// clone returns a copy of the stats that does not share the resolutions with the original.
+func (s StoreSeriesStats) clone() StoreSeriesStats {
+	if s.Resolutions == nil {
+		return s
+	}
+	res := make(map[string]int64, len(s.Resolutions))
+	for r, n := range s.Resolutions {
+		res[r] = n
+	}
+	s.Resolutions = res
+	return s
+}
+
+func chunkResolution(c storepb.AggrChunk) string {
+	switch {
+	case c.Resolution > 0:
+		return model.Duration(time.Duration(c.Resolution) * time.Millisecond).String()
+	case c.Raw == nil:
+		return "unknown"
+	default:
+		return "raw"
+	}
+}
+
+// NewSeriesStats returns new empty SeriesStats.
+func NewSeriesStats() *SeriesStats {
+	return &SeriesStats{stores: map[string]*StoreSeriesStats{}, queried: map[string]struct{}{}}
+}
+
+// ContextWithSeriesStats returns a new context recording the stats of the Series requests made with it into the given stats.
+func ContextWithSeriesStats(ctx context.Context, stats *SeriesStats) context.Context {
+	return context.WithValue(ctx, seriesStatsContextKey{}, stats)
+}
+
+// SeriesStatsFromContext returns the SeriesStats of the context, or nil if none.
+func SeriesStatsFromContext(ctx context.Context) *SeriesStats {
+	stats, _ := ctx.Value(seriesStatsContextKey{}).(*SeriesStats)
+	return stats
+}
+
+// Add records a series fetched by the query.
+func (s *SeriesStats) Add(series *storepb.Series) {
+	if s == nil || series == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.total.add(series)
+}
+
+// addStore records a series received from the store with the given address.
+func (s *SeriesStats) addStore(addr string, series *storepb.Series) {
+	if s == nil || series == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	st, ok := s.stores[addr]
+	if !ok {
+		st = &StoreSeriesStats{Store: addr}
+		s.stores[addr] = st
+	}
+	st.add(series)
+}
+
+// queriedStore records that the store with the given address was queried.
+func (s *SeriesStats) queriedStore(addr string) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.queried[addr] = struct{}{}
+}
+
+// Total returns the stats of all series fetched by the query.
+func (s *SeriesStats) Total() StoreSeriesStats {
+	if s == nil {
+		return StoreSeriesStats{}
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.total.clone()
+}
+
+// Stores returns the stats of the series received from each store, sorted by store address.
+// The series of a store are counted before they are merged with the series of the other stores.
+func (s *SeriesStats) Stores() []StoreSeriesStats {
+	if s == nil {
+		return nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	res := make([]StoreSeriesStats, 0, len(s.stores))
+	for _, st := range s.stores {
+		res = append(res, st.clone())
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Store < res[j].Store })
+	return res
+}
+
+// QueriedStores returns the addresses of the stores the query sent Series requests to, sorted, including the stores
+// that failed or returned no series.
+func (s *SeriesStats) QueriedStores() []string {
+	if s == nil {
+		return nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	res := make([]string, 0, len(s.queried))
+	for addr := range s.queried {
+		res = append(res, addr)
+	}
+	sort.Strings(res)
+	return res
+}
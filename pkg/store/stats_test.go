@@ -0,0 +1,151 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestProxyStore_SeriesStats(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	newStore := func(addr string, resps ...*storepb.SeriesResponse) Client {
+		return &addrClient{
+			addr: addr,
+			testClient: &testClient{
+				StoreClient: &mockedStoreAPI{RespSeries: resps},
+				labelSets:   []storepb.LabelSet{{Labels: []storepb.Label{{Name: "ext", Value: "1"}}}},
+				minTime:     1,
+				maxTime:     300,
+			},
+		}
+	}
+	a1 := storeSeriesResponse(t, labels.FromStrings("a", "1"), []sample{{1, 1}, {2, 2}}, []sample{{3, 3}})
+	a2 := storeSeriesResponse(t, labels.FromStrings("a", "2"), []sample{{1, 1}})
+	b1 := storeSeriesResponse(t, labels.FromStrings("a", "1"), []sample{{4, 4}})
+	// Both stores have the series a=1, which is merged into one series sent by the proxy.
+	stores := []Client{
+		newStore("store-1", a1, a2),
+		newStore("store-2", b1),
+	}
+	q := NewProxyStore(nil, nil, func() []Client { return stores }, component.Query, nil, 0*time.Second, 0*time.Second, nil, nil, nil)
+
+	stats := NewSeriesStats()
+	s := newStoreSeriesServer(ContextWithSeriesStats(context.Background(), stats))
+	testutil.Ok(t, q.Series(&storepb.SeriesRequest{
+		MinTime:  1,
+		MaxTime:  300,
+		Matchers: []storepb.LabelMatcher{{Name: "ext", Value: "1", Type: storepb.LabelMatcher_EQ}},
+	}, s))
+	testutil.Equals(t, 2, len(s.SeriesSet))
+
+	testutil.Equals(t, []StoreSeriesStats{
+		{Store: "store-1", Series: 2, Chunks: 3, Bytes: int64(a1.GetSeries().Size() + a2.GetSeries().Size()), Resolutions: map[string]int64{"raw": 3}},
+		{Store: "store-2", Series: 1, Chunks: 1, Bytes: int64(b1.GetSeries().Size()), Resolutions: map[string]int64{"raw": 1}},
+	}, stats.Stores())
+	// The total is recorded by the consumer of the proxy.
+	testutil.Equals(t, StoreSeriesStats{}, stats.Total())
+
+	for i := range s.SeriesSet {
+		stats.Add(&s.SeriesSet[i])
+	}
+	total := stats.Total()
+	testutil.Equals(t, int64(2), total.Series)
+	testutil.Equals(t, int64(4), total.Chunks)
+
+	// A nil SeriesStats records nothing.
+	var nilStats *SeriesStats
+	nilStats.Add(a1.GetSeries())
+	testutil.Equals(t, StoreSeriesStats{}, nilStats.Total())
+	testutil.Equals(t, 0, len(nilStats.Stores()))
+}
+
+func TestProxyStore_QueriedStores(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	newStore := func(addr string, minTime int64, err error, resps ...*storepb.SeriesResponse) Client {
+		return &addrClient{
+			addr: addr,
+			testClient: &testClient{
+				StoreClient: &mockedStoreAPI{RespSeries: resps, RespError: err},
+				labelSets:   []storepb.LabelSet{{Labels: []storepb.Label{{Name: "ext", Value: "1"}}}},
+				minTime:     minTime,
+				maxTime:     300,
+			},
+		}
+	}
+	stores := []Client{
+		newStore("store-1", 1, nil, storeSeriesResponse(t, labels.FromStrings("a", "1"), []sample{{1, 1}})),
+		// Queried, but without any series.
+		newStore("store-2", 1, nil),
+		// Filtered out, its data is outside of the time range of the request.
+		newStore("store-3", 500, nil, storeSeriesResponse(t, labels.FromStrings("a", "2"), []sample{{600, 1}})),
+		// Queried, but failed.
+		newStore("store-4", 1, errors.New("unavailable")),
+	}
+	q := NewProxyStore(nil, nil, func() []Client { return stores }, component.Query, nil, 0*time.Second, 0*time.Second, nil, nil, nil)
+
+	stats := NewSeriesStats()
+	s := newStoreSeriesServer(ContextWithSeriesStats(context.Background(), stats))
+	testutil.Ok(t, q.Series(&storepb.SeriesRequest{
+		MinTime:  1,
+		MaxTime:  300,
+		Matchers: []storepb.LabelMatcher{{Name: "ext", Value: "1", Type: storepb.LabelMatcher_EQ}},
+	}, s))
+	testutil.Equals(t, 1, len(s.SeriesSet))
+	testutil.Equals(t, 1, len(s.Warnings))
+
+	testutil.Equals(t, []string{"store-1", "store-2", "store-4"}, stats.QueriedStores())
+	testutil.Equals(t, 1, len(stats.Stores()))
+	testutil.Equals(t, "store-1", stats.Stores()[0].Store)
+
+	var nilStats *SeriesStats
+	nilStats.queriedStore("store-1")
+	testutil.Equals(t, 0, len(nilStats.QueriedStores()))
+}
+
+func TestSeriesStats_Resolutions(t *testing.T) {
+	aggrSeries := func(name string, resolutions ...int64) *storepb.Series {
+		s := &storepb.Series{Labels: []storepb.Label{{Name: "a", Value: name}}}
+		for i, res := range resolutions {
+			s.Chunks = append(s.Chunks, storepb.AggrChunk{
+				MinTime:    int64(i),
+				MaxTime:    int64(i),
+				Count:      &storepb.Chunk{Type: storepb.Chunk_XOR},
+				Resolution: res,
+			})
+		}
+		return s
+	}
+	raw := storeSeriesResponse(t, labels.FromStrings("a", "1"), []sample{{1, 1}}, []sample{{2, 2}}).GetSeries()
+
+	stats := NewSeriesStats()
+	stats.addStore("store-1", raw)
+	stats.addStore("store-2", aggrSeries("1", 5*60*1000, 5*60*1000, 60*60*1000))
+	// Stores not reporting the resolution of downsampled chunks.
+	stats.addStore("store-3", aggrSeries("1", 0))
+	for _, s := range []*storepb.Series{raw, aggrSeries("1", 5*60*1000, 60*60*1000)} {
+		stats.Add(s)
+	}
+
+	stores := stats.Stores()
+	testutil.Equals(t, 3, len(stores))
+	testutil.Equals(t, map[string]int64{"raw": 2}, stores[0].Resolutions)
+	testutil.Equals(t, map[string]int64{"5m": 2, "1h": 1}, stores[1].Resolutions)
+	testutil.Equals(t, map[string]int64{"unknown": 1}, stores[2].Resolutions)
+	testutil.Equals(t, map[string]int64{"raw": 2, "5m": 1, "1h": 1}, stats.Total().Resolutions)
+
+	// The returned stats are copies.
+	stats.Total().Resolutions["raw"] = 10
+	testutil.Equals(t, int64(2), stats.Total().Resolutions["raw"])
+}
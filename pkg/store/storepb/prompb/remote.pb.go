@@ -62,7 +62,8 @@ func (ReadRequest_ResponseType) EnumDescriptor() ([]byte, []int) {
 }
 
 type WriteRequest struct {
-	Timeseries []TimeSeries `protobuf:"bytes,1,rep,name=timeseries,proto3" json:"timeseries"`
+	Timeseries []TimeSeries     `protobuf:"bytes,1,rep,name=timeseries,proto3" json:"timeseries"`
+	Metadata   []MetricMetadata `protobuf:"bytes,3,rep,name=metadata,proto3" json:"metadata"`
 }
 
 func (m *WriteRequest) Reset()         { *m = WriteRequest{} }
@@ -105,6 +106,13 @@ func (m *WriteRequest) GetTimeseries() []TimeSeries {
 	return nil
 }
 
+func (m *WriteRequest) GetMetadata() []MetricMetadata {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
 // ReadRequest represents a remote read request.
 type ReadRequest struct {
 	Queries []*Query `protobuf:"bytes,1,rep,name=queries,proto3" json:"queries,omitempty"`
@@ -392,38 +400,40 @@ func init() {
 func init() { proto.RegisterFile("remote.proto", fileDescriptor_eefc82927d57d89b) }
 
 var fileDescriptor_eefc82927d57d89b = []byte{
-	// 486 bytes of a gzipped FileDescriptorProto
+	// 517 bytes of a gzipped FileDescriptorProto
 	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x93, 0xcd, 0x6e, 0xd3, 0x40,
-	0x10, 0x80, 0xed, 0xa6, 0x6d, 0xd0, 0x38, 0x84, 0x68, 0x0b, 0x34, 0x0a, 0xe0, 0x46, 0x3e, 0x19,
-	0x09, 0x85, 0x2a, 0x20, 0x24, 0xc4, 0x29, 0x2d, 0x41, 0x05, 0x1a, 0xa0, 0xeb, 0x20, 0x10, 0x17,
-	0xcb, 0xb1, 0x47, 0x8d, 0x45, 0xfd, 0xd3, 0xdd, 0xb5, 0x84, 0x0f, 0xbc, 0x03, 0x8f, 0xd5, 0x03,
-	0x87, 0x1e, 0x7b, 0x42, 0x28, 0x79, 0x11, 0xe4, 0x75, 0x1c, 0x6d, 0x08, 0x1c, 0x7a, 0xdb, 0xcc,
-	0x7c, 0xf3, 0xed, 0xce, 0x64, 0x0c, 0x0d, 0x86, 0x51, 0x22, 0xb0, 0x97, 0xb2, 0x44, 0x24, 0xe4,
-	0x56, 0xca, 0x92, 0x08, 0xc5, 0x14, 0x33, 0xee, 0xfa, 0x49, 0x9a, 0x77, 0x0c, 0x91, 0xa7, 0xc8,
-	0xcb, 0x6c, 0xe7, 0xf6, 0x69, 0x72, 0x9a, 0xc8, 0xe3, 0xe3, 0xe2, 0x54, 0x46, 0xad, 0x13, 0x68,
-	0x7c, 0x62, 0xa1, 0x40, 0x8a, 0xe7, 0x19, 0x72, 0x41, 0x06, 0x00, 0x22, 0x8c, 0x90, 0x23, 0x0b,
-	0x91, 0xb7, 0xf5, 0x6e, 0xcd, 0x36, 0xfa, 0xf7, 0x7a, 0x7f, 0x89, 0x7b, 0xe3, 0x30, 0x42, 0x47,
-	0x22, 0x07, 0x9b, 0x17, 0xbf, 0xf6, 0x34, 0xaa, 0x14, 0x59, 0x57, 0x3a, 0x18, 0x14, 0xbd, 0xa0,
-	0x52, 0xee, 0x43, 0xfd, 0x3c, 0x53, 0x7d, 0x77, 0xd7, 0x7c, 0x27, 0x19, 0xb2, 0x9c, 0x56, 0x18,
-	0xf1, 0x60, 0xd7, 0xf3, 0x7d, 0x4c, 0x05, 0x06, 0x2e, 0x43, 0x9e, 0x26, 0x31, 0x47, 0x57, 0xf6,
-	0xd2, 0xde, 0xe8, 0xd6, 0xec, 0x66, 0xff, 0xe1, 0x9a, 0x41, 0xb9, 0xb0, 0x47, 0x17, 0x25, 0xe3,
-	0x3c, 0x45, 0x7a, 0xa7, 0x32, 0xa9, 0x51, 0x6e, 0x3d, 0x85, 0x86, 0x1a, 0x20, 0x06, 0xd4, 0x9d,
-	0xc1, 0xe8, 0xc3, 0xf1, 0xd0, 0x69, 0x69, 0x64, 0x17, 0x76, 0x9c, 0x31, 0x1d, 0x0e, 0x46, 0xc3,
-	0x97, 0xee, 0xe7, 0xf7, 0xd4, 0x3d, 0x3c, 0xfa, 0xf8, 0xee, 0xad, 0xd3, 0xd2, 0xad, 0x57, 0x45,
-	0x95, 0xb7, 0x54, 0x91, 0x67, 0x50, 0x67, 0xc8, 0xb3, 0x33, 0x51, 0xb5, 0x76, 0xff, 0x3f, 0xad,
-	0x49, 0x88, 0x56, 0xb0, 0xf5, 0x53, 0x87, 0x2d, 0x99, 0x20, 0x8f, 0x80, 0x70, 0xe1, 0x31, 0xe1,
-	0xca, 0x01, 0x0a, 0x2f, 0x4a, 0xdd, 0xa8, 0x90, 0xe9, 0x76, 0x8d, 0xb6, 0x64, 0x66, 0x5c, 0x25,
-	0x46, 0x9c, 0xd8, 0xd0, 0xc2, 0x38, 0x58, 0x65, 0x37, 0x24, 0xdb, 0xc4, 0x38, 0x50, 0xc9, 0xe7,
-	0x70, 0x23, 0xf2, 0x84, 0x3f, 0x45, 0xc6, 0xdb, 0x35, 0xf9, 0xb4, 0x07, 0x6b, 0x4f, 0x3b, 0xf6,
-	0x26, 0x78, 0x36, 0x2a, 0x29, 0xba, 0xc4, 0xc9, 0x3e, 0x6c, 0x4d, 0xc3, 0x58, 0xf0, 0xf6, 0x66,
-	0x57, 0xb7, 0x8d, 0x7e, 0xe7, 0x9f, 0xb3, 0x3e, 0x2a, 0x08, 0x5a, 0x82, 0xd6, 0x1b, 0x30, 0x94,
-	0x36, 0xc9, 0x8b, 0x6b, 0xee, 0xd0, 0xca, 0xf6, 0x7c, 0x87, 0x9d, 0xc3, 0x69, 0x16, 0x7f, 0x2d,
-	0xfe, 0x30, 0x65, 0xd2, 0x43, 0x68, 0xfa, 0x65, 0xd8, 0x5d, 0xf1, 0x9a, 0x6b, 0xde, 0x45, 0xf5,
-	0x42, 0x7d, 0xd3, 0x57, 0x7f, 0x92, 0x3d, 0x30, 0x8a, 0x25, 0xcb, 0xdd, 0x30, 0x0e, 0xf0, 0xdb,
-	0x62, 0x76, 0x20, 0x43, 0xaf, 0x8b, 0xc8, 0x41, 0xf7, 0x62, 0x66, 0xea, 0x97, 0x33, 0x53, 0xff,
-	0x3d, 0x33, 0xf5, 0x1f, 0x73, 0x53, 0xbb, 0x9c, 0x9b, 0xda, 0xd5, 0xdc, 0xd4, 0xbe, 0x6c, 0x17,
-	0x17, 0xa5, 0x93, 0xc9, 0xb6, 0xfc, 0x70, 0x9e, 0xfc, 0x09, 0x00, 0x00, 0xff, 0xff, 0x4b, 0x5c,
-	0x76, 0xc3, 0x7c, 0x03, 0x00, 0x00,
+	0x10, 0xc7, 0xe3, 0x24, 0x6d, 0xa2, 0x71, 0x08, 0xd1, 0x16, 0x68, 0x14, 0xc0, 0x89, 0x7c, 0x0a,
+	0x12, 0x0a, 0x55, 0x40, 0x48, 0x88, 0x53, 0x5a, 0x82, 0x4a, 0xa9, 0xf9, 0xd8, 0x04, 0x81, 0xb8,
+	0x58, 0x1b, 0x7b, 0xd4, 0x58, 0xd4, 0x1f, 0xdd, 0x5d, 0x4b, 0xe4, 0xc0, 0x3b, 0x70, 0xe6, 0x89,
+	0x7a, 0xe0, 0xd0, 0x63, 0x4f, 0x08, 0x25, 0x2f, 0x82, 0xbc, 0xb6, 0x2b, 0x87, 0xc0, 0xa1, 0xb7,
+	0xf5, 0x7f, 0x7e, 0xf3, 0xdf, 0x99, 0xd9, 0x31, 0x34, 0x38, 0xfa, 0xa1, 0xc4, 0x41, 0xc4, 0x43,
+	0x19, 0x92, 0x9b, 0x11, 0x0f, 0x7d, 0x94, 0x73, 0x8c, 0x85, 0xed, 0x84, 0xd1, 0xa2, 0xa3, 0xcb,
+	0x45, 0x84, 0x22, 0x8d, 0x76, 0x6e, 0x9d, 0x84, 0x27, 0xa1, 0x3a, 0x3e, 0x4a, 0x4e, 0xa9, 0x6a,
+	0xfe, 0xd0, 0xa0, 0xf1, 0x91, 0x7b, 0x12, 0x29, 0x9e, 0xc5, 0x28, 0x24, 0x19, 0x01, 0x48, 0xcf,
+	0x47, 0x81, 0xdc, 0x43, 0xd1, 0xd6, 0x7a, 0x95, 0xbe, 0x3e, 0xbc, 0x3b, 0xf8, 0xcb, 0x79, 0x30,
+	0xf5, 0x7c, 0x9c, 0x28, 0x64, 0xbf, 0x7a, 0xfe, 0xab, 0x5b, 0xa2, 0x85, 0x24, 0x32, 0x82, 0xba,
+	0x8f, 0x92, 0xb9, 0x4c, 0xb2, 0x76, 0x45, 0x19, 0x74, 0x37, 0x0c, 0x2c, 0x94, 0xdc, 0x73, 0xac,
+	0x0c, 0xcb, 0x4c, 0xae, 0xd2, 0x8e, 0xaa, 0xf5, 0x72, 0xab, 0x62, 0x5e, 0x6a, 0xa0, 0x53, 0x64,
+	0x6e, 0x5e, 0xdb, 0x1e, 0xd4, 0xce, 0xe2, 0x62, 0x61, 0x77, 0x36, 0x7c, 0xdf, 0xc7, 0xc8, 0x17,
+	0x34, 0xc7, 0x08, 0x83, 0x5d, 0xe6, 0x38, 0x18, 0x49, 0x74, 0x6d, 0x8e, 0x22, 0x0a, 0x03, 0x81,
+	0xb6, 0x9a, 0x4a, 0xbb, 0xdc, 0xab, 0xf4, 0x9b, 0xc3, 0x07, 0x1b, 0x0e, 0x85, 0x0b, 0x07, 0x34,
+	0x4b, 0x99, 0x2e, 0x22, 0xa4, 0xb7, 0x73, 0xa7, 0xa2, 0x2a, 0xcc, 0x27, 0xd0, 0x28, 0x0a, 0x44,
+	0x87, 0xda, 0x64, 0x64, 0xbd, 0x3b, 0x1e, 0x4f, 0x5a, 0x25, 0xb2, 0x0b, 0x3b, 0x93, 0x29, 0x1d,
+	0x8f, 0xac, 0xf1, 0x0b, 0xfb, 0xd3, 0x5b, 0x6a, 0x1f, 0x1c, 0x7e, 0x78, 0xf3, 0x7a, 0xd2, 0xd2,
+	0xcc, 0x97, 0xd0, 0x48, 0x2f, 0x4a, 0x33, 0xc9, 0x53, 0xa8, 0x71, 0x14, 0xf1, 0xa9, 0xcc, 0x5b,
+	0xbb, 0xf7, 0x9f, 0xd6, 0x14, 0x44, 0x73, 0xd8, 0xfc, 0xa9, 0xc1, 0x96, 0x0a, 0x90, 0x87, 0x40,
+	0x84, 0x64, 0x5c, 0xda, 0xea, 0x25, 0x24, 0xf3, 0x23, 0xdb, 0x4f, 0xcc, 0xb4, 0x7e, 0x85, 0xb6,
+	0x54, 0x64, 0x9a, 0x07, 0x2c, 0x41, 0xfa, 0xd0, 0xc2, 0xc0, 0x5d, 0x67, 0xcb, 0x8a, 0x6d, 0x62,
+	0xe0, 0x16, 0xc9, 0x67, 0x50, 0xf7, 0x99, 0x74, 0xe6, 0xc8, 0x45, 0xf6, 0x9a, 0xf7, 0x37, 0x4a,
+	0x3b, 0x66, 0x33, 0x3c, 0xb5, 0x52, 0x8a, 0x5e, 0xe1, 0x64, 0x0f, 0xb6, 0xe6, 0x5e, 0x20, 0x45,
+	0xbb, 0xda, 0xd3, 0xfa, 0xfa, 0xb0, 0xf3, 0xcf, 0x59, 0x1f, 0x26, 0x04, 0x4d, 0x41, 0xf3, 0x08,
+	0xf4, 0x42, 0x9b, 0xe4, 0xf9, 0x35, 0x97, 0xb1, 0xb8, 0x86, 0xe6, 0x37, 0xd8, 0x39, 0x98, 0xc7,
+	0xc1, 0x17, 0x74, 0xd7, 0x26, 0x3d, 0x86, 0xa6, 0x93, 0xca, 0xf6, 0x9a, 0xaf, 0xb1, 0xe1, 0x9b,
+	0x65, 0x67, 0xd6, 0x37, 0x9c, 0xe2, 0x27, 0xe9, 0x82, 0x9e, 0x2c, 0xd9, 0xc2, 0xf6, 0x02, 0x17,
+	0xbf, 0x66, 0xb3, 0x03, 0x25, 0xbd, 0x4a, 0x94, 0xfd, 0xde, 0xf9, 0xd2, 0xd0, 0x2e, 0x96, 0x86,
+	0xf6, 0x7b, 0x69, 0x68, 0xdf, 0x57, 0x46, 0xe9, 0x62, 0x65, 0x94, 0x2e, 0x57, 0x46, 0xe9, 0xf3,
+	0x76, 0x72, 0x51, 0x34, 0x9b, 0x6d, 0xab, 0x5f, 0xf0, 0xf1, 0x9f, 0x01, 0x00, 0x80, 0x43, 0xcb,
+	0x08, 0xc6, 0x03, 0x00, 0x00,
 }
 
 func (m *WriteRequest) Marshal() (dAtA []byte, err error) {
@@ -446,6 +456,20 @@ func (m *WriteRequest) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.Metadata) > 0 {
+		for iNdEx := len(m.Metadata) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.Metadata[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintRemote(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x1a
+		}
+	}
 	if len(m.Timeseries) > 0 {
 		for iNdEx := len(m.Timeseries) - 1; iNdEx >= 0; iNdEx-- {
 			{
@@ -716,6 +740,12 @@ func (m *WriteRequest) Size() (n int) {
 			n += 1 + l + sovRemote(uint64(l))
 		}
 	}
+	if len(m.Metadata) > 0 {
+		for _, e := range m.Metadata {
+			l = e.Size()
+			n += 1 + l + sovRemote(uint64(l))
+		}
+	}
 	return n
 }
 
@@ -883,6 +913,40 @@ func (m *WriteRequest) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Metadata", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRemote
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthRemote
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthRemote
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Metadata = append(m.Metadata, MetricMetadata{})
+			if err := m.Metadata[len(m.Metadata)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRemote(dAtA[iNdEx:])
@@ -82,6 +82,49 @@ func (Chunk_Encoding) EnumDescriptor() ([]byte, []int) {
 	return fileDescriptor_d938547f84707355, []int{6, 0}
 }
 
+type MetricMetadata_MetricType int32
+
+const (
+	MetricMetadata_UNKNOWN        MetricMetadata_MetricType = 0
+	MetricMetadata_COUNTER        MetricMetadata_MetricType = 1
+	MetricMetadata_GAUGE          MetricMetadata_MetricType = 2
+	MetricMetadata_HISTOGRAM      MetricMetadata_MetricType = 3
+	MetricMetadata_GAUGEHISTOGRAM MetricMetadata_MetricType = 4
+	MetricMetadata_SUMMARY        MetricMetadata_MetricType = 5
+	MetricMetadata_INFO           MetricMetadata_MetricType = 6
+	MetricMetadata_STATESET       MetricMetadata_MetricType = 7
+)
+
+var MetricMetadata_MetricType_name = map[int32]string{
+	0: "UNKNOWN",
+	1: "COUNTER",
+	2: "GAUGE",
+	3: "HISTOGRAM",
+	4: "GAUGEHISTOGRAM",
+	5: "SUMMARY",
+	6: "INFO",
+	7: "STATESET",
+}
+
+var MetricMetadata_MetricType_value = map[string]int32{
+	"UNKNOWN":        0,
+	"COUNTER":        1,
+	"GAUGE":          2,
+	"HISTOGRAM":      3,
+	"GAUGEHISTOGRAM": 4,
+	"SUMMARY":        5,
+	"INFO":           6,
+	"STATESET":       7,
+}
+
+func (x MetricMetadata_MetricType) String() string {
+	return proto.EnumName(MetricMetadata_MetricType_name, int32(x))
+}
+
+func (MetricMetadata_MetricType) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_d938547f84707355, []int{8, 0}
+}
+
 type Sample struct {
 	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3" json:"value,omitempty"`
 	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
@@ -561,9 +604,78 @@ func (m *ChunkedSeries) GetChunks() []Chunk {
 	return nil
 }
 
+type MetricMetadata struct {
+	Type             MetricMetadata_MetricType `protobuf:"varint,1,opt,name=type,proto3,enum=prometheus_copy.MetricMetadata_MetricType" json:"type,omitempty"`
+	MetricFamilyName string                    `protobuf:"bytes,2,opt,name=metric_family_name,json=metricFamilyName,proto3" json:"metric_family_name,omitempty"`
+	Help             string                    `protobuf:"bytes,4,opt,name=help,proto3" json:"help,omitempty"`
+	Unit             string                    `protobuf:"bytes,5,opt,name=unit,proto3" json:"unit,omitempty"`
+}
+
+func (m *MetricMetadata) Reset()         { *m = MetricMetadata{} }
+func (m *MetricMetadata) String() string { return proto.CompactTextString(m) }
+func (*MetricMetadata) ProtoMessage()    {}
+func (*MetricMetadata) Descriptor() ([]byte, []int) {
+	return fileDescriptor_d938547f84707355, []int{8}
+}
+func (m *MetricMetadata) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *MetricMetadata) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_MetricMetadata.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *MetricMetadata) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MetricMetadata.Merge(m, src)
+}
+func (m *MetricMetadata) XXX_Size() int {
+	return m.Size()
+}
+func (m *MetricMetadata) XXX_DiscardUnknown() {
+	xxx_messageInfo_MetricMetadata.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MetricMetadata proto.InternalMessageInfo
+
+func (m *MetricMetadata) GetType() MetricMetadata_MetricType {
+	if m != nil {
+		return m.Type
+	}
+	return MetricMetadata_UNKNOWN
+}
+
+func (m *MetricMetadata) GetMetricFamilyName() string {
+	if m != nil {
+		return m.MetricFamilyName
+	}
+	return ""
+}
+
+func (m *MetricMetadata) GetHelp() string {
+	if m != nil {
+		return m.Help
+	}
+	return ""
+}
+
+func (m *MetricMetadata) GetUnit() string {
+	if m != nil {
+		return m.Unit
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterEnum("prometheus_copy.LabelMatcher_Type", LabelMatcher_Type_name, LabelMatcher_Type_value)
 	proto.RegisterEnum("prometheus_copy.Chunk_Encoding", Chunk_Encoding_name, Chunk_Encoding_value)
+	proto.RegisterEnum("prometheus_copy.MetricMetadata_MetricType", MetricMetadata_MetricType_name, MetricMetadata_MetricType_value)
 	proto.RegisterType((*Sample)(nil), "prometheus_copy.Sample")
 	proto.RegisterType((*TimeSeries)(nil), "prometheus_copy.TimeSeries")
 	proto.RegisterType((*Label)(nil), "prometheus_copy.Label")
@@ -572,48 +684,57 @@ func init() {
 	proto.RegisterType((*ReadHints)(nil), "prometheus_copy.ReadHints")
 	proto.RegisterType((*Chunk)(nil), "prometheus_copy.Chunk")
 	proto.RegisterType((*ChunkedSeries)(nil), "prometheus_copy.ChunkedSeries")
+	proto.RegisterType((*MetricMetadata)(nil), "prometheus_copy.MetricMetadata")
 }
 
 func init() { proto.RegisterFile("types.proto", fileDescriptor_d938547f84707355) }
 
 var fileDescriptor_d938547f84707355 = []byte{
-	// 561 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x53, 0xc1, 0x6e, 0xd3, 0x40,
-	0x10, 0xcd, 0xda, 0x89, 0x9d, 0x4c, 0x4a, 0x89, 0x56, 0xa5, 0x35, 0x15, 0x72, 0x2d, 0x9f, 0x7c,
-	0x0a, 0xa2, 0xad, 0xe0, 0x82, 0x38, 0x14, 0x45, 0x42, 0xa2, 0x4e, 0xd5, 0x6d, 0x11, 0x88, 0x4b,
-	0xb4, 0x89, 0x17, 0xc7, 0x22, 0x5e, 0x5b, 0xde, 0x0d, 0x6a, 0xd4, 0x9f, 0xe0, 0xcc, 0x5f, 0xc0,
-	0x57, 0xf4, 0xd8, 0x23, 0x27, 0x84, 0x92, 0x1f, 0x41, 0xbb, 0x76, 0x12, 0x44, 0x73, 0xa2, 0xb7,
-	0x99, 0x79, 0x6f, 0xde, 0x3c, 0xef, 0x8c, 0xa1, 0x2d, 0x67, 0x39, 0x13, 0xdd, 0xbc, 0xc8, 0x64,
-	0x86, 0x1f, 0xe6, 0x45, 0x96, 0x32, 0x39, 0x66, 0x53, 0x31, 0x18, 0x65, 0xf9, 0x6c, 0x7f, 0x27,
-	0xce, 0xe2, 0x4c, 0x63, 0x4f, 0x55, 0x54, 0xd2, 0xfc, 0x97, 0x60, 0x5d, 0xd0, 0x34, 0x9f, 0x30,
-	0xbc, 0x03, 0x8d, 0x2f, 0x74, 0x32, 0x65, 0x0e, 0xf2, 0x50, 0x80, 0x48, 0x99, 0xe0, 0x27, 0xd0,
-	0x92, 0x49, 0xca, 0x84, 0xa4, 0x69, 0xee, 0x18, 0x1e, 0x0a, 0x4c, 0xb2, 0x2e, 0xf8, 0xd7, 0x00,
-	0x97, 0x49, 0xca, 0x2e, 0x58, 0x91, 0x30, 0x81, 0x8f, 0xc1, 0x9a, 0xd0, 0x21, 0x9b, 0x08, 0x07,
-	0x79, 0x66, 0xd0, 0x3e, 0xdc, 0xed, 0xfe, 0xe3, 0xa1, 0x7b, 0xaa, 0xe0, 0x93, 0xfa, 0xcd, 0xaf,
-	0x83, 0x1a, 0xa9, 0xb8, 0xf8, 0x05, 0xd8, 0x42, 0x3b, 0x10, 0x8e, 0xa1, 0xdb, 0xf6, 0xee, 0xb4,
-	0x95, 0x0e, 0xab, 0xbe, 0x25, 0xdb, 0x7f, 0x06, 0x0d, 0xad, 0x87, 0x31, 0xd4, 0x39, 0x4d, 0x4b,
-	0xe3, 0x2d, 0xa2, 0xe3, 0xf5, 0xd7, 0x18, 0xba, 0x58, 0x26, 0xfe, 0x2b, 0xb0, 0x4e, 0xcb, 0xa9,
-	0xff, 0xe5, 0xd5, 0xff, 0x86, 0x60, 0x4b, 0xd7, 0x43, 0x2a, 0x47, 0x63, 0x56, 0xe0, 0xe7, 0x50,
-	0x57, 0x8f, 0xae, 0x47, 0x6f, 0x1f, 0xfa, 0x9b, 0x45, 0x2a, 0x72, 0xf7, 0x72, 0x96, 0x33, 0xa2,
-	0xf9, 0x2b, 0xcb, 0xc6, 0x26, 0xcb, 0xe6, 0xdf, 0x96, 0x03, 0xa8, 0xab, 0x3e, 0x6c, 0x81, 0xd1,
-	0x3b, 0xef, 0xd4, 0xb0, 0x0d, 0x66, 0xbf, 0x77, 0xde, 0x41, 0xaa, 0x40, 0x7a, 0x1d, 0x43, 0x17,
-	0x48, 0xaf, 0x63, 0xfa, 0xdf, 0x11, 0xb4, 0x08, 0xa3, 0xd1, 0x9b, 0x84, 0x4b, 0x81, 0xf7, 0xc0,
-	0x16, 0x92, 0xe5, 0x83, 0x54, 0x68, 0x73, 0x26, 0xb1, 0x54, 0x1a, 0x0a, 0x35, 0xfa, 0xd3, 0x94,
-	0x8f, 0x96, 0xa3, 0x55, 0x8c, 0x1f, 0x43, 0x53, 0x48, 0x5a, 0x48, 0xc5, 0x36, 0x35, 0xdb, 0xd6,
-	0x79, 0x28, 0xf0, 0x23, 0xb0, 0x18, 0x8f, 0x14, 0x50, 0xd7, 0x40, 0x83, 0xf1, 0x28, 0x14, 0x78,
-	0x1f, 0x9a, 0x71, 0x91, 0x4d, 0xf3, 0x84, 0xc7, 0x4e, 0xc3, 0x33, 0x83, 0x16, 0x59, 0xe5, 0x78,
-	0x1b, 0x8c, 0xe1, 0xcc, 0xb1, 0x3c, 0x14, 0x34, 0x89, 0x31, 0x9c, 0x29, 0xf5, 0x82, 0xf2, 0x98,
-	0x29, 0x11, 0xbb, 0x54, 0xd7, 0x79, 0x28, 0xfc, 0x1f, 0x08, 0x1a, 0xaf, 0xc7, 0x53, 0xfe, 0x19,
-	0xbb, 0xd0, 0x4e, 0x13, 0x3e, 0x50, 0xb7, 0xb5, 0xf6, 0xdc, 0x4a, 0x13, 0xae, 0x0e, 0x2c, 0x14,
-	0x1a, 0xa7, 0x57, 0x2b, 0xbc, 0x3a, 0xc5, 0x94, 0x5e, 0x55, 0xf8, 0x51, 0xb5, 0x09, 0x53, 0x6f,
-	0xe2, 0xe0, 0xce, 0x26, 0xf4, 0x94, 0x6e, 0x8f, 0x8f, 0xb2, 0x28, 0xe1, 0xf1, 0x7a, 0x0d, 0x11,
-	0x95, 0x54, 0x7f, 0xda, 0x16, 0xd1, 0xb1, 0xef, 0x41, 0x73, 0xc9, 0xc2, 0x6d, 0xb0, 0xdf, 0xf5,
-	0xdf, 0xf6, 0xcf, 0xde, 0xf7, 0xcb, 0x97, 0xff, 0x70, 0x46, 0x3a, 0xc8, 0xbf, 0x86, 0x07, 0x5a,
-	0x8d, 0x45, 0xf7, 0x3a, 0xfc, 0x63, 0xb0, 0x46, 0x4a, 0x66, 0x79, 0xf7, 0xbb, 0x9b, 0x3d, 0x2f,
-	0xbb, 0x4a, 0xee, 0x89, 0x77, 0x33, 0x77, 0xd1, 0xed, 0xdc, 0x45, 0xbf, 0xe7, 0x2e, 0xfa, 0xba,
-	0x70, 0x6b, 0xb7, 0x0b, 0xb7, 0xf6, 0x73, 0xe1, 0xd6, 0x3e, 0x5a, 0xaa, 0x3d, 0x1f, 0x0e, 0x2d,
-	0xfd, 0x67, 0x1f, 0xfd, 0x09, 0x00, 0x00, 0xff, 0xff, 0x73, 0xda, 0x4a, 0x37, 0x0f, 0x04, 0x00,
-	0x00,
+	// 704 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x54, 0xcd, 0x4e, 0xdb, 0x40,
+	0x10, 0xce, 0xfa, 0x37, 0x9e, 0x40, 0x6a, 0xad, 0x28, 0xa4, 0xa8, 0x0a, 0x91, 0x4f, 0x51, 0x55,
+	0xa5, 0x2a, 0xa0, 0xf6, 0x52, 0x21, 0x05, 0x64, 0x7e, 0x54, 0x9c, 0x88, 0x4d, 0xa2, 0xfe, 0x5c,
+	0xa2, 0x4d, 0xb2, 0x24, 0x56, 0xe3, 0x1f, 0x79, 0x9d, 0x8a, 0x88, 0x97, 0xe8, 0xb9, 0xb7, 0x3e,
+	0x42, 0xfb, 0x14, 0x1c, 0x39, 0xf6, 0x54, 0x55, 0xf0, 0x22, 0xd5, 0xae, 0x13, 0x02, 0x85, 0x53,
+	0x7b, 0x9b, 0x99, 0xef, 0x9b, 0x99, 0xcf, 0xb3, 0x9f, 0x0c, 0x85, 0x74, 0x1a, 0x33, 0x5e, 0x8b,
+	0x93, 0x28, 0x8d, 0xf0, 0xa3, 0x38, 0x89, 0x02, 0x96, 0x8e, 0xd8, 0x84, 0x77, 0xfb, 0x51, 0x3c,
+	0x5d, 0x5f, 0x19, 0x46, 0xc3, 0x48, 0x62, 0x2f, 0x44, 0x94, 0xd1, 0x9c, 0x37, 0x60, 0xb4, 0x68,
+	0x10, 0x8f, 0x19, 0x5e, 0x01, 0xfd, 0x33, 0x1d, 0x4f, 0x58, 0x09, 0x55, 0x50, 0x15, 0x91, 0x2c,
+	0xc1, 0x4f, 0xc1, 0x4a, 0xfd, 0x80, 0xf1, 0x94, 0x06, 0x71, 0x49, 0xa9, 0xa0, 0xaa, 0x4a, 0x16,
+	0x05, 0xe7, 0x1c, 0xa0, 0xed, 0x07, 0xac, 0xc5, 0x12, 0x9f, 0x71, 0xbc, 0x0d, 0xc6, 0x98, 0xf6,
+	0xd8, 0x98, 0x97, 0x50, 0x45, 0xad, 0x16, 0x36, 0x57, 0x6b, 0x7f, 0x69, 0xa8, 0x1d, 0x0b, 0x78,
+	0x57, 0xbb, 0xf8, 0xb5, 0x91, 0x23, 0x33, 0x2e, 0x7e, 0x0d, 0x26, 0x97, 0x0a, 0x78, 0x49, 0x91,
+	0x6d, 0x6b, 0xf7, 0xda, 0x32, 0x85, 0xb3, 0xbe, 0x39, 0xdb, 0x79, 0x09, 0xba, 0x9c, 0x87, 0x31,
+	0x68, 0x21, 0x0d, 0x32, 0xe1, 0x16, 0x91, 0xf1, 0xe2, 0x6b, 0x14, 0x59, 0xcc, 0x12, 0x67, 0x07,
+	0x8c, 0xe3, 0x6c, 0xeb, 0x3f, 0x69, 0x75, 0xbe, 0x22, 0x58, 0x92, 0x75, 0x8f, 0xa6, 0xfd, 0x11,
+	0x4b, 0xf0, 0x2b, 0xd0, 0xc4, 0xd1, 0xe5, 0xea, 0xe2, 0xa6, 0xf3, 0xf0, 0x90, 0x19, 0xb9, 0xd6,
+	0x9e, 0xc6, 0x8c, 0x48, 0xfe, 0x8d, 0x64, 0xe5, 0x21, 0xc9, 0xea, 0x6d, 0xc9, 0x55, 0xd0, 0x44,
+	0x1f, 0x36, 0x40, 0x71, 0x4f, 0xec, 0x1c, 0x36, 0x41, 0x6d, 0xb8, 0x27, 0x36, 0x12, 0x05, 0xe2,
+	0xda, 0x8a, 0x2c, 0x10, 0xd7, 0x56, 0x9d, 0xef, 0x08, 0x2c, 0xc2, 0xe8, 0xe0, 0xd0, 0x0f, 0x53,
+	0x8e, 0xd7, 0xc0, 0xe4, 0x29, 0x8b, 0xbb, 0x01, 0x97, 0xe2, 0x54, 0x62, 0x88, 0xd4, 0xe3, 0x62,
+	0xf5, 0xe9, 0x24, 0xec, 0xcf, 0x57, 0x8b, 0x18, 0x3f, 0x81, 0x3c, 0x4f, 0x69, 0x92, 0x0a, 0xb6,
+	0x2a, 0xd9, 0xa6, 0xcc, 0x3d, 0x8e, 0x1f, 0x83, 0xc1, 0xc2, 0x81, 0x00, 0x34, 0x09, 0xe8, 0x2c,
+	0x1c, 0x78, 0x1c, 0xaf, 0x43, 0x7e, 0x98, 0x44, 0x93, 0xd8, 0x0f, 0x87, 0x25, 0xbd, 0xa2, 0x56,
+	0x2d, 0x72, 0x93, 0xe3, 0x22, 0x28, 0xbd, 0x69, 0xc9, 0xa8, 0xa0, 0x6a, 0x9e, 0x28, 0xbd, 0xa9,
+	0x98, 0x9e, 0xd0, 0x70, 0xc8, 0xc4, 0x10, 0x33, 0x9b, 0x2e, 0x73, 0x8f, 0x3b, 0x3f, 0x10, 0xe8,
+	0x7b, 0xa3, 0x49, 0xf8, 0x09, 0x97, 0xa1, 0x10, 0xf8, 0x61, 0x57, 0x78, 0x6b, 0xa1, 0xd9, 0x0a,
+	0xfc, 0x50, 0x18, 0xcc, 0xe3, 0x12, 0xa7, 0x67, 0x37, 0xf8, 0xcc, 0x8a, 0x01, 0x3d, 0x9b, 0xe1,
+	0x5b, 0xb3, 0x97, 0x50, 0xe5, 0x4b, 0x6c, 0xdc, 0x7b, 0x09, 0xb9, 0xa5, 0xe6, 0x86, 0xfd, 0x68,
+	0xe0, 0x87, 0xc3, 0xc5, 0x33, 0x0c, 0x68, 0x4a, 0xe5, 0xa7, 0x2d, 0x11, 0x19, 0x3b, 0x15, 0xc8,
+	0xcf, 0x59, 0xb8, 0x00, 0x66, 0xa7, 0xf1, 0xb6, 0xd1, 0x7c, 0xd7, 0xc8, 0x2e, 0xff, 0xbe, 0x49,
+	0x6c, 0xe4, 0x9c, 0xc3, 0xb2, 0x9c, 0xc6, 0x06, 0xff, 0x65, 0xfc, 0x6d, 0x30, 0xfa, 0x62, 0xcc,
+	0xdc, 0xf7, 0xab, 0x0f, 0x6b, 0x9e, 0x77, 0x65, 0x5c, 0xe7, 0x9b, 0x02, 0x45, 0x8f, 0xa5, 0x89,
+	0xdf, 0xf7, 0x58, 0x4a, 0x85, 0x62, 0xbc, 0x73, 0xc7, 0x84, 0xcf, 0xee, 0x8d, 0xb9, 0x4b, 0x9f,
+	0xa5, 0xb7, 0xcc, 0xf8, 0x1c, 0x70, 0x20, 0x6b, 0xdd, 0x53, 0x1a, 0xf8, 0xe3, 0x69, 0xf7, 0x96,
+	0x35, 0xed, 0x0c, 0xd9, 0x97, 0x40, 0x43, 0xd8, 0x14, 0x83, 0x36, 0x62, 0xe3, 0x58, 0xde, 0xcc,
+	0x22, 0x32, 0x16, 0xb5, 0x49, 0xe8, 0xa7, 0x25, 0x3d, 0xab, 0x89, 0xd8, 0x99, 0x02, 0x2c, 0x36,
+	0xdd, 0xbd, 0x64, 0x01, 0xcc, 0xbd, 0x66, 0xa7, 0xd1, 0x76, 0x89, 0x8d, 0xb0, 0x05, 0xfa, 0x41,
+	0xbd, 0x73, 0x20, 0xac, 0xbc, 0x0c, 0xd6, 0xe1, 0x51, 0xab, 0xdd, 0x3c, 0x20, 0x75, 0xcf, 0x56,
+	0x31, 0x86, 0xa2, 0x44, 0x16, 0x35, 0x4d, 0xb4, 0xb6, 0x3a, 0x9e, 0x57, 0x27, 0x1f, 0x6c, 0x1d,
+	0xe7, 0x41, 0x3b, 0x6a, 0xec, 0x37, 0x6d, 0x03, 0x2f, 0x41, 0xbe, 0xd5, 0xae, 0xb7, 0xdd, 0x96,
+	0xdb, 0xb6, 0xcd, 0xdd, 0xca, 0xc5, 0x55, 0x19, 0x5d, 0x5e, 0x95, 0xd1, 0xef, 0xab, 0x32, 0xfa,
+	0x72, 0x5d, 0xce, 0x5d, 0x5e, 0x97, 0x73, 0x3f, 0xaf, 0xcb, 0xb9, 0x8f, 0x86, 0xb8, 0x4d, 0xdc,
+	0xeb, 0x19, 0xf2, 0xef, 0xb7, 0xf5, 0x67, 0x00, 0x5b, 0xb0, 0xfb, 0xc8, 0x33, 0x05, 0x00, 0x00,
 }
 
 func (m *Sample) Marshal() (dAtA []byte, err error) {
@@ -982,6 +1103,55 @@ func (m *ChunkedSeries) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *MetricMetadata) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *MetricMetadata) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *MetricMetadata) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if len(m.Unit) > 0 {
+		i -= len(m.Unit)
+		copy(dAtA[i:], m.Unit)
+		i = encodeVarintTypes(dAtA, i, uint64(len(m.Unit)))
+		i--
+		dAtA[i] = 0x2a
+	}
+	if len(m.Help) > 0 {
+		i -= len(m.Help)
+		copy(dAtA[i:], m.Help)
+		i = encodeVarintTypes(dAtA, i, uint64(len(m.Help)))
+		i--
+		dAtA[i] = 0x22
+	}
+	if len(m.MetricFamilyName) > 0 {
+		i -= len(m.MetricFamilyName)
+		copy(dAtA[i:], m.MetricFamilyName)
+		i = encodeVarintTypes(dAtA, i, uint64(len(m.MetricFamilyName)))
+		i--
+		dAtA[i] = 0x12
+	}
+	if m.Type != 0 {
+		i = encodeVarintTypes(dAtA, i, uint64(m.Type))
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
 func encodeVarintTypes(dAtA []byte, offset int, v uint64) int {
 	offset -= sovTypes(v)
 	base := offset
@@ -1158,6 +1328,30 @@ func (m *ChunkedSeries) Size() (n int) {
 	return n
 }
 
+func (m *MetricMetadata) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.Type != 0 {
+		n += 1 + sovTypes(uint64(m.Type))
+	}
+	l = len(m.MetricFamilyName)
+	if l > 0 {
+		n += 1 + l + sovTypes(uint64(l))
+	}
+	l = len(m.Help)
+	if l > 0 {
+		n += 1 + l + sovTypes(uint64(l))
+	}
+	l = len(m.Unit)
+	if l > 0 {
+		n += 1 + l + sovTypes(uint64(l))
+	}
+	return n
+}
+
 func sovTypes(x uint64) (n int) {
 	return (math_bits.Len64(x|1) + 6) / 7
 }
@@ -2186,6 +2380,174 @@ func (m *ChunkedSeries) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
+func (m *MetricMetadata) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowTypes
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: MetricMetadata: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: MetricMetadata: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Type", wireType)
+			}
+			m.Type = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTypes
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Type |= MetricMetadata_MetricType(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MetricFamilyName", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTypes
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthTypes
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthTypes
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.MetricFamilyName = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Help", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTypes
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthTypes
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthTypes
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Help = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Unit", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTypes
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthTypes
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthTypes
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Unit = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipTypes(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthTypes
+			}
+			if (iNdEx + skippy) < 0 {
+				return ErrInvalidLengthTypes
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func skipTypes(dAtA []byte) (n int, err error) {
 	l := len(dAtA)
 	iNdEx := 0
@@ -174,9 +174,10 @@ func (m *WriteResponse) XXX_DiscardUnknown() {
 var xxx_messageInfo_WriteResponse proto.InternalMessageInfo
 
 type WriteRequest struct {
-	Timeseries []prompb.TimeSeries `protobuf:"bytes,1,rep,name=timeseries,proto3" json:"timeseries"`
-	Tenant     string              `protobuf:"bytes,2,opt,name=tenant,proto3" json:"tenant,omitempty"`
-	Replica    int64               `protobuf:"varint,3,opt,name=replica,proto3" json:"replica,omitempty"`
+	Timeseries []prompb.TimeSeries     `protobuf:"bytes,1,rep,name=timeseries,proto3" json:"timeseries"`
+	Tenant     string                  `protobuf:"bytes,2,opt,name=tenant,proto3" json:"tenant,omitempty"`
+	Replica    int64                   `protobuf:"varint,3,opt,name=replica,proto3" json:"replica,omitempty"`
+	Metadata   []prompb.MetricMetadata `protobuf:"bytes,4,rep,name=metadata,proto3" json:"metadata"`
 }
 
 func (m *WriteRequest) Reset()         { *m = WriteRequest{} }
@@ -340,6 +341,9 @@ type SeriesRequest struct {
 	PartialResponseStrategy PartialResponseStrategy `protobuf:"varint,7,opt,name=partial_response_strategy,json=partialResponseStrategy,proto3,enum=thanos.PartialResponseStrategy" json:"partial_response_strategy,omitempty"`
 	// skip_chunks controls whether sending chunks or not in series responses.
 	SkipChunks bool `protobuf:"varint,8,opt,name=skip_chunks,json=skipChunks,proto3" json:"skip_chunks,omitempty"`
+	// fresh_stores_only restricts the request to stores whose data reaches max_time, so that e.g. instant queries
+	// are not answered by long-term stores lagging behind.
+	FreshStoresOnly bool `protobuf:"varint,9,opt,name=fresh_stores_only,json=freshStoresOnly,proto3" json:"fresh_stores_only,omitempty"`
 }
 
 func (m *SeriesRequest) Reset()         { *m = SeriesRequest{} }
@@ -464,6 +468,10 @@ type LabelNamesRequest struct {
 	PartialResponseDisabled bool `protobuf:"varint,1,opt,name=partial_response_disabled,json=partialResponseDisabled,proto3" json:"partial_response_disabled,omitempty"`
 	// TODO(bwplotka): Move Thanos components to use strategy instead. Including QueryAPI.
 	PartialResponseStrategy PartialResponseStrategy `protobuf:"varint,2,opt,name=partial_response_strategy,json=partialResponseStrategy,proto3,enum=thanos.PartialResponseStrategy" json:"partial_response_strategy,omitempty"`
+	// matchers are a hint restricting the label names to the ones of series matching all of them.
+	// Only Store Gateway restricts the label names of its series, other StoreAPIs filter by external
+	// labels at most and may return label names of series not matching the matchers.
+	Matchers []LabelMatcher `protobuf:"bytes,3,rep,name=matchers,proto3" json:"matchers"`
 }
 
 func (m *LabelNamesRequest) Reset()         { *m = LabelNamesRequest{} }
@@ -615,6 +623,82 @@ func (m *LabelValuesResponse) XXX_DiscardUnknown() {
 
 var xxx_messageInfo_LabelValuesResponse proto.InternalMessageInfo
 
+type MetadataRequest struct {
+	Metric string `protobuf:"bytes,1,opt,name=metric,proto3" json:"metric,omitempty"`
+	Limit  int64  `protobuf:"varint,2,opt,name=limit,proto3" json:"limit,omitempty"`
+	Tenant string `protobuf:"bytes,3,opt,name=tenant,proto3" json:"tenant,omitempty"`
+}
+
+func (m *MetadataRequest) Reset()         { *m = MetadataRequest{} }
+func (m *MetadataRequest) String() string { return proto.CompactTextString(m) }
+func (*MetadataRequest) ProtoMessage()    {}
+func (*MetadataRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_77a6da22d6a3feb1, []int{11}
+}
+func (m *MetadataRequest) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *MetadataRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_MetadataRequest.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *MetadataRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MetadataRequest.Merge(m, src)
+}
+func (m *MetadataRequest) XXX_Size() int {
+	return m.Size()
+}
+func (m *MetadataRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_MetadataRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MetadataRequest proto.InternalMessageInfo
+
+type MetadataResponse struct {
+	Metadata []prompb.MetricMetadata `protobuf:"bytes,1,rep,name=metadata,proto3" json:"metadata"`
+}
+
+func (m *MetadataResponse) Reset()         { *m = MetadataResponse{} }
+func (m *MetadataResponse) String() string { return proto.CompactTextString(m) }
+func (*MetadataResponse) ProtoMessage()    {}
+func (*MetadataResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_77a6da22d6a3feb1, []int{12}
+}
+func (m *MetadataResponse) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *MetadataResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_MetadataResponse.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *MetadataResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MetadataResponse.Merge(m, src)
+}
+func (m *MetadataResponse) XXX_Size() int {
+	return m.Size()
+}
+func (m *MetadataResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_MetadataResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MetadataResponse proto.InternalMessageInfo
+
 func init() {
 	proto.RegisterEnum("thanos.StoreType", StoreType_name, StoreType_value)
 	proto.RegisterEnum("thanos.PartialResponseStrategy", PartialResponseStrategy_name, PartialResponseStrategy_value)
@@ -630,70 +714,80 @@ func init() {
 	proto.RegisterType((*LabelNamesResponse)(nil), "thanos.LabelNamesResponse")
 	proto.RegisterType((*LabelValuesRequest)(nil), "thanos.LabelValuesRequest")
 	proto.RegisterType((*LabelValuesResponse)(nil), "thanos.LabelValuesResponse")
+	proto.RegisterType((*MetadataRequest)(nil), "thanos.MetadataRequest")
+	proto.RegisterType((*MetadataResponse)(nil), "thanos.MetadataResponse")
 }
 
 func init() { proto.RegisterFile("rpc.proto", fileDescriptor_77a6da22d6a3feb1) }
 
 var fileDescriptor_77a6da22d6a3feb1 = []byte{
-	// 927 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x56, 0xcd, 0x6e, 0x23, 0x45,
-	0x10, 0x76, 0x7b, 0xfc, 0x5b, 0xde, 0x98, 0xd9, 0x8e, 0x93, 0x9d, 0x78, 0x25, 0xc7, 0x1a, 0x09,
-	0xc9, 0x0a, 0xc8, 0x01, 0x23, 0x40, 0x20, 0x2e, 0xb6, 0xd7, 0xab, 0xb5, 0xd8, 0x38, 0xd0, 0xb6,
-	0xd7, 0xfc, 0x1c, 0xcc, 0xd8, 0x69, 0x9c, 0xd1, 0xce, 0x1f, 0xd3, 0x6d, 0x92, 0x5c, 0xe1, 0x05,
-	0xb8, 0xf2, 0x0e, 0xbc, 0x05, 0x97, 0x1c, 0xf7, 0x08, 0x17, 0x04, 0xc9, 0x8b, 0xa0, 0xee, 0xe9,
-	0x71, 0x66, 0x96, 0x6c, 0x24, 0x94, 0x5b, 0xd7, 0xf7, 0x55, 0x77, 0x55, 0x7d, 0x5d, 0x35, 0x3d,
-	0x50, 0x0e, 0x83, 0x65, 0x3b, 0x08, 0x7d, 0xee, 0xe3, 0x02, 0x3f, 0xb5, 0x3c, 0x9f, 0xd5, 0x2b,
-	0xfc, 0x22, 0xa0, 0x2c, 0x02, 0xeb, 0xb5, 0x95, 0xbf, 0xf2, 0xe5, 0xf2, 0x50, 0xac, 0x14, 0x8a,
-	0x83, 0xd0, 0x77, 0x83, 0xc5, 0x61, 0xc2, 0xd3, 0x7c, 0x0b, 0xb6, 0x66, 0xa1, 0xcd, 0x29, 0xa1,
-	0x2c, 0xf0, 0x3d, 0x46, 0xcd, 0x9f, 0x11, 0x3c, 0x50, 0xc8, 0x0f, 0x6b, 0xca, 0x38, 0xee, 0x02,
-	0x70, 0xdb, 0xa5, 0x8c, 0x86, 0x36, 0x65, 0x06, 0x6a, 0x6a, 0xad, 0x4a, 0xe7, 0xb1, 0xd8, 0xed,
-	0x52, 0x7e, 0x4a, 0xd7, 0x6c, 0xbe, 0xf4, 0x83, 0x8b, 0xf6, 0xc4, 0x76, 0xe9, 0x58, 0xba, 0xf4,
-	0x72, 0x97, 0x7f, 0xed, 0x67, 0x48, 0x62, 0x13, 0xde, 0x85, 0x02, 0xa7, 0x9e, 0xe5, 0x71, 0x23,
-	0xdb, 0x44, 0xad, 0x32, 0x51, 0x16, 0x36, 0xa0, 0x18, 0xd2, 0xc0, 0xb1, 0x97, 0x96, 0xa1, 0x35,
-	0x51, 0x4b, 0x23, 0xb1, 0x69, 0x6e, 0x41, 0x65, 0xe8, 0x7d, 0xef, 0xab, 0x1c, 0xcc, 0x3f, 0x11,
-	0x3c, 0x88, 0xec, 0x28, 0x4b, 0xfc, 0x0e, 0x14, 0x1c, 0x6b, 0x41, 0x9d, 0x38, 0xa1, 0xad, 0x76,
-	0x24, 0x43, 0xfb, 0xb9, 0x40, 0x55, 0x0a, 0xca, 0x05, 0xef, 0x41, 0xc9, 0xb5, 0xbd, 0xb9, 0x48,
-	0x48, 0x26, 0xa0, 0x91, 0xa2, 0x6b, 0x7b, 0x22, 0x63, 0x49, 0x59, 0xe7, 0x11, 0xa5, 0x52, 0x70,
-	0xad, 0x73, 0x49, 0x1d, 0x42, 0x99, 0x71, 0x3f, 0xa4, 0x93, 0x8b, 0x80, 0x1a, 0xb9, 0x26, 0x6a,
-	0x55, 0x3b, 0x0f, 0xe3, 0x28, 0xe3, 0x98, 0x20, 0x37, 0x3e, 0xf8, 0x43, 0x00, 0x19, 0x70, 0xce,
-	0x28, 0x67, 0x46, 0x5e, 0xe6, 0xa5, 0xa7, 0xf2, 0x1a, 0x53, 0xae, 0x52, 0x2b, 0x3b, 0xca, 0x66,
-	0xe6, 0xc7, 0x50, 0x8a, 0xc9, 0xff, 0x55, 0x96, 0xf9, 0xab, 0x06, 0x5b, 0x91, 0xe4, 0xf1, 0x55,
-	0x25, 0x0b, 0x45, 0x6f, 0x2e, 0x34, 0x9b, 0x2e, 0xf4, 0x23, 0x41, 0xf1, 0xe5, 0x29, 0x0d, 0x99,
-	0xa1, 0xc9, 0xb0, 0xb5, 0x54, 0xd8, 0xa3, 0x88, 0x54, 0xd1, 0x37, 0xbe, 0xb8, 0x03, 0x3b, 0xe2,
-	0xc8, 0x90, 0x32, 0xdf, 0x59, 0x73, 0xdb, 0xf7, 0xe6, 0x67, 0xb6, 0x77, 0xe2, 0x9f, 0x49, 0xb1,
-	0x34, 0xb2, 0xed, 0x5a, 0xe7, 0x64, 0xc3, 0xcd, 0x24, 0x85, 0xdf, 0x05, 0xb0, 0x56, 0xab, 0x90,
-	0xae, 0x2c, 0x4e, 0x23, 0x8d, 0xaa, 0x9d, 0x07, 0x71, 0xb4, 0xee, 0x6a, 0x15, 0x92, 0x04, 0x8f,
-	0x3f, 0x85, 0xbd, 0xc0, 0x0a, 0xb9, 0x6d, 0x39, 0x22, 0x8a, 0xbc, 0xf9, 0xf9, 0x89, 0xcd, 0xac,
-	0x85, 0x43, 0x4f, 0x8c, 0x42, 0x13, 0xb5, 0x4a, 0xe4, 0x91, 0x72, 0x88, 0x3b, 0xe3, 0x89, 0xa2,
-	0xf1, 0xb7, 0xb7, 0xec, 0x65, 0x3c, 0xb4, 0x38, 0x5d, 0x5d, 0x18, 0x45, 0x79, 0x9d, 0xfb, 0x71,
-	0xe0, 0x2f, 0xd2, 0x67, 0x8c, 0x95, 0xdb, 0x7f, 0x0e, 0x8f, 0x09, 0xbc, 0x0f, 0x15, 0xf6, 0xd2,
-	0x0e, 0xe6, 0xcb, 0xd3, 0xb5, 0xf7, 0x92, 0x19, 0x25, 0x99, 0x0a, 0x08, 0xa8, 0x2f, 0x11, 0xf3,
-	0x3b, 0xa8, 0xc6, 0x57, 0xa3, 0x3a, 0xb6, 0x05, 0x85, 0xcd, 0x08, 0xa1, 0x56, 0xa5, 0x53, 0xdd,
-	0xf4, 0x92, 0x44, 0x9f, 0x65, 0x88, 0xe2, 0x71, 0x1d, 0x8a, 0x67, 0x56, 0xe8, 0xd9, 0xde, 0x2a,
-	0x1a, 0x97, 0x67, 0x19, 0x12, 0x03, 0xbd, 0x12, 0x14, 0x42, 0xca, 0xd6, 0x0e, 0x37, 0x7f, 0x43,
-	0xf0, 0x50, 0x5e, 0xcf, 0xc8, 0x72, 0x6f, 0x3a, 0xe0, 0x4e, 0xc5, 0xd0, 0x3d, 0x14, 0xcb, 0xde,
-	0x4f, 0x31, 0xf3, 0x29, 0xe0, 0x64, 0xb6, 0x4a, 0x94, 0x1a, 0xe4, 0x3d, 0x01, 0xc8, 0x76, 0x2f,
-	0x93, 0xc8, 0xc0, 0x75, 0x28, 0xa9, 0x7a, 0x99, 0x91, 0x95, 0xc4, 0xc6, 0x36, 0x7f, 0x47, 0xea,
-	0xa0, 0x17, 0x96, 0xb3, 0xbe, 0xa9, 0xbb, 0x06, 0x79, 0x39, 0x15, 0xb2, 0xc6, 0x32, 0x89, 0x8c,
-	0xbb, 0xd5, 0xc8, 0xde, 0x43, 0x0d, 0xed, 0x9e, 0x6a, 0x0c, 0x61, 0x3b, 0x55, 0x84, 0x92, 0x63,
-	0x17, 0x0a, 0x3f, 0x4a, 0x44, 0xe9, 0xa1, 0xac, 0xbb, 0x04, 0x39, 0x20, 0x50, 0xde, 0x7c, 0x8d,
-	0x70, 0x05, 0x8a, 0xd3, 0xd1, 0xe7, 0xa3, 0xe3, 0xd9, 0x48, 0xcf, 0xe0, 0x32, 0xe4, 0xbf, 0x9c,
-	0x0e, 0xc8, 0xd7, 0x3a, 0xc2, 0x25, 0xc8, 0x91, 0xe9, 0xf3, 0x81, 0x9e, 0x15, 0x1e, 0xe3, 0xe1,
-	0x93, 0x41, 0xbf, 0x4b, 0x74, 0x4d, 0x78, 0x8c, 0x27, 0xc7, 0x64, 0xa0, 0xe7, 0x04, 0x4e, 0x06,
-	0xfd, 0xc1, 0xf0, 0xc5, 0x40, 0xcf, 0x1f, 0xb4, 0xe1, 0xd1, 0x1b, 0x4a, 0x12, 0x27, 0xcd, 0xba,
-	0x44, 0x1d, 0xdf, 0xed, 0x1d, 0x93, 0x89, 0x8e, 0x0e, 0x7a, 0x90, 0x13, 0xb3, 0x8b, 0x8b, 0xa0,
-	0x91, 0xee, 0x2c, 0xe2, 0xfa, 0xc7, 0xd3, 0xd1, 0x44, 0x47, 0x02, 0x1b, 0x4f, 0x8f, 0xf4, 0xac,
-	0x58, 0x1c, 0x0d, 0x47, 0xba, 0x26, 0x17, 0xdd, 0xaf, 0xa2, 0x98, 0xd2, 0x6b, 0x40, 0xf4, 0x7c,
-	0xe7, 0xa7, 0x2c, 0xe4, 0x65, 0x21, 0xf8, 0x7d, 0xc8, 0x89, 0x6f, 0x3d, 0xde, 0x8e, 0xe5, 0x4d,
-	0xbc, 0x04, 0xf5, 0x5a, 0x1a, 0x54, 0xc2, 0x7d, 0x02, 0x85, 0x68, 0x8c, 0xf0, 0x4e, 0x7a, 0xac,
-	0xe2, 0x6d, 0xbb, 0xaf, 0xc3, 0xd1, 0xc6, 0xf7, 0x10, 0xee, 0x03, 0xdc, 0x34, 0x26, 0xde, 0x4b,
-	0x7d, 0xf9, 0x92, 0xa3, 0x55, 0xaf, 0xdf, 0x46, 0xa9, 0xf8, 0x4f, 0xa1, 0x92, 0xb8, 0x4f, 0x9c,
-	0x76, 0x4d, 0x75, 0x6a, 0xfd, 0xf1, 0xad, 0x5c, 0x74, 0x4e, 0x67, 0x04, 0x55, 0xf9, 0xf6, 0x8a,
-	0x16, 0x8c, 0xc4, 0xf8, 0x0c, 0x2a, 0x84, 0xba, 0x3e, 0xa7, 0x12, 0xc7, 0x9b, 0xf2, 0x93, 0x4f,
-	0x74, 0x7d, 0xe7, 0x35, 0x54, 0x3d, 0xe5, 0x99, 0xde, 0xdb, 0x97, 0xff, 0x34, 0x32, 0x97, 0x57,
-	0x0d, 0xf4, 0xea, 0xaa, 0x81, 0xfe, 0xbe, 0x6a, 0xa0, 0x5f, 0xae, 0x1b, 0x99, 0x57, 0xd7, 0x8d,
-	0xcc, 0x1f, 0xd7, 0x8d, 0xcc, 0x37, 0x45, 0xf9, 0x76, 0x05, 0x8b, 0x45, 0x41, 0xfe, 0x0b, 0x7c,
-	0xf0, 0x6f, 0x00, 0x00, 0x00, 0xff, 0xff, 0xe7, 0x85, 0xb9, 0xc1, 0x57, 0x08, 0x00, 0x00,
+	// 1045 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x56, 0x5f, 0x6f, 0xe3, 0x44,
+	0x10, 0xcf, 0xc6, 0x89, 0x93, 0x4c, 0xae, 0xad, 0xbb, 0xfd, 0xe7, 0xfa, 0xa4, 0xb4, 0xb2, 0x84,
+	0x14, 0x15, 0xd4, 0x42, 0x10, 0x20, 0x10, 0x3c, 0xa4, 0xbd, 0x9c, 0x2e, 0xe2, 0x9a, 0xc2, 0xa6,
+	0xb9, 0xf0, 0xe7, 0x21, 0x38, 0xe9, 0x5e, 0x62, 0x9d, 0xff, 0xe1, 0xdd, 0xd0, 0xe6, 0x95, 0x4f,
+	0xc0, 0x77, 0x42, 0xa0, 0x3e, 0xde, 0x23, 0xbc, 0x20, 0x68, 0xf9, 0x20, 0xc8, 0xeb, 0x75, 0x62,
+	0xb7, 0xbd, 0x4a, 0x5c, 0xdf, 0x76, 0xe6, 0x37, 0x3b, 0xb3, 0xf3, 0xdb, 0x99, 0xd9, 0x85, 0x4a,
+	0x18, 0x8c, 0xf6, 0x83, 0xd0, 0xe7, 0x3e, 0x56, 0xf9, 0xc4, 0xf2, 0x7c, 0x66, 0x54, 0xf9, 0x2c,
+	0xa0, 0x2c, 0x56, 0x1a, 0xeb, 0x63, 0x7f, 0xec, 0x8b, 0xe5, 0x41, 0xb4, 0x92, 0x5a, 0x1c, 0x84,
+	0xbe, 0x1b, 0x0c, 0x0f, 0x52, 0x96, 0xe6, 0x0a, 0x2c, 0xf5, 0x43, 0x9b, 0x53, 0x42, 0x59, 0xe0,
+	0x7b, 0x8c, 0x9a, 0xbf, 0x23, 0x78, 0x24, 0x35, 0x3f, 0x4e, 0x29, 0xe3, 0xb8, 0x09, 0xc0, 0x6d,
+	0x97, 0x32, 0x1a, 0xda, 0x94, 0xe9, 0x68, 0x57, 0xa9, 0x57, 0x1b, 0x8f, 0xa3, 0xdd, 0x2e, 0xe5,
+	0x13, 0x3a, 0x65, 0x83, 0x91, 0x1f, 0xcc, 0xf6, 0x4f, 0x6d, 0x97, 0x76, 0x85, 0xc9, 0x61, 0xe1,
+	0xf2, 0xaf, 0x9d, 0x1c, 0x49, 0x6d, 0xc2, 0x9b, 0xa0, 0x72, 0xea, 0x59, 0x1e, 0xd7, 0xf3, 0xbb,
+	0xa8, 0x5e, 0x21, 0x52, 0xc2, 0x3a, 0x94, 0x42, 0x1a, 0x38, 0xf6, 0xc8, 0xd2, 0x95, 0x5d, 0x54,
+	0x57, 0x48, 0x22, 0xe2, 0x26, 0x94, 0x5d, 0xca, 0xad, 0x33, 0x8b, 0x5b, 0x7a, 0x41, 0x84, 0xdc,
+	0xb9, 0x15, 0xf2, 0x98, 0xf2, 0xd0, 0x1e, 0x1d, 0x4b, 0x33, 0x19, 0x76, 0xbe, 0xcd, 0x5c, 0x82,
+	0x6a, 0xdb, 0x7b, 0xe9, 0xcb, 0x34, 0xcc, 0x3f, 0x11, 0x3c, 0x8a, 0xe5, 0x38, 0x51, 0xfc, 0x2e,
+	0xa8, 0x8e, 0x35, 0xa4, 0x4e, 0x92, 0xd3, 0xd2, 0x7e, 0xcc, 0xe4, 0xfe, 0xf3, 0x48, 0x2b, 0xdd,
+	0x49, 0x13, 0xbc, 0x0d, 0x65, 0xd7, 0xf6, 0x06, 0x51, 0x4e, 0x22, 0x07, 0x85, 0x94, 0x5c, 0xdb,
+	0x8b, 0x92, 0x16, 0x90, 0x75, 0x11, 0x43, 0x32, 0x0b, 0xd7, 0xba, 0x10, 0xd0, 0x01, 0x54, 0x18,
+	0xf7, 0x43, 0x7a, 0x3a, 0x0b, 0xa8, 0x5e, 0xd8, 0x45, 0xf5, 0xe5, 0xc6, 0x6a, 0x12, 0xa5, 0x9b,
+	0x00, 0x64, 0x61, 0x83, 0x3f, 0x02, 0x10, 0x01, 0x07, 0x8c, 0x72, 0xa6, 0x17, 0xc5, 0xb9, 0xb4,
+	0xcc, 0xb9, 0xba, 0x94, 0xcb, 0xa3, 0x55, 0x1c, 0x29, 0x33, 0xf3, 0x13, 0x28, 0x27, 0xe0, 0xff,
+	0x4a, 0xcb, 0xfc, 0x4d, 0x81, 0xa5, 0xf8, 0xd6, 0x92, 0xdb, 0x4e, 0x27, 0x8a, 0xde, 0x9c, 0x68,
+	0x3e, 0x9b, 0xe8, 0xc7, 0x11, 0xc4, 0x47, 0x13, 0x1a, 0x32, 0x5d, 0x11, 0x61, 0xd7, 0x33, 0x61,
+	0x8f, 0x63, 0x70, 0x7e, 0x47, 0xd2, 0x16, 0x37, 0x60, 0x23, 0x72, 0x19, 0x52, 0xe6, 0x3b, 0x53,
+	0x6e, 0xfb, 0xde, 0xe0, 0xdc, 0xf6, 0xce, 0xfc, 0x73, 0x41, 0x96, 0x42, 0xd6, 0x5c, 0xeb, 0x82,
+	0xcc, 0xb1, 0xbe, 0x80, 0xf0, 0x7b, 0x00, 0xd6, 0x78, 0x1c, 0xd2, 0xb1, 0xc5, 0x69, 0xcc, 0xd1,
+	0x72, 0xe3, 0x51, 0x12, 0xad, 0x39, 0x1e, 0x87, 0x24, 0x85, 0xe3, 0xcf, 0x60, 0x3b, 0xb0, 0x42,
+	0x6e, 0x5b, 0xce, 0x20, 0x94, 0x37, 0x3f, 0x38, 0xb3, 0x99, 0x35, 0x74, 0xe8, 0x99, 0xae, 0xee,
+	0xa2, 0x7a, 0x99, 0x6c, 0x49, 0x83, 0xa4, 0x32, 0x9e, 0x48, 0x18, 0x7f, 0x7f, 0xc7, 0x5e, 0xc6,
+	0x43, 0x8b, 0xd3, 0xf1, 0x4c, 0x2f, 0x89, 0xeb, 0xdc, 0x49, 0x02, 0x7f, 0x95, 0xf5, 0xd1, 0x95,
+	0x66, 0xb7, 0x9c, 0x27, 0x00, 0xde, 0x81, 0x2a, 0x7b, 0x65, 0x07, 0x83, 0xd1, 0x64, 0xea, 0xbd,
+	0x62, 0x7a, 0x59, 0x1c, 0x05, 0x22, 0xd5, 0x91, 0xd0, 0xe0, 0x3d, 0x58, 0x7d, 0x19, 0x52, 0x36,
+	0x19, 0x88, 0xf2, 0x60, 0x03, 0xdf, 0x73, 0x66, 0x7a, 0x45, 0x98, 0xad, 0x08, 0x40, 0x54, 0x10,
+	0x3b, 0xf1, 0x9c, 0x99, 0xf9, 0x03, 0x2c, 0x27, 0xd7, 0x28, 0xab, 0xbb, 0x0e, 0xea, 0xbc, 0x63,
+	0x51, 0xbd, 0xda, 0x58, 0x9e, 0xd7, 0x9d, 0xd0, 0x3e, 0xcb, 0x11, 0x89, 0x63, 0x03, 0x4a, 0xe7,
+	0x56, 0xe8, 0xd9, 0xde, 0x38, 0xee, 0xce, 0x67, 0x39, 0x92, 0x28, 0x0e, 0xcb, 0xa0, 0x86, 0x94,
+	0x4d, 0x1d, 0x6e, 0xfe, 0x8b, 0x60, 0x55, 0x5c, 0x65, 0xc7, 0x72, 0x17, 0xd5, 0x72, 0x2f, 0xbb,
+	0xe8, 0x01, 0xec, 0xe6, 0x1f, 0xc8, 0xee, 0x5b, 0x16, 0xa4, 0xf9, 0x14, 0x70, 0x3a, 0x4b, 0x49,
+	0xe6, 0x3a, 0x14, 0xbd, 0x48, 0x21, 0x5a, 0xaa, 0x42, 0x62, 0x01, 0x1b, 0x50, 0x96, 0x3c, 0x31,
+	0x3d, 0x2f, 0x80, 0xb9, 0x6c, 0xfe, 0x8a, 0xa4, 0xa3, 0x17, 0x96, 0x33, 0x5d, 0xf0, 0xb5, 0x0e,
+	0x45, 0xd1, 0x79, 0x82, 0x9b, 0x0a, 0x89, 0x85, 0xfb, 0x59, 0xcc, 0x3f, 0x80, 0x45, 0xe5, 0x61,
+	0x2c, 0x9a, 0x6d, 0x58, 0xcb, 0x24, 0x21, 0xe9, 0xd8, 0x04, 0xf5, 0x27, 0xa1, 0x91, 0x7c, 0x48,
+	0xe9, 0x5e, 0x42, 0xfa, 0xb0, 0x92, 0x4c, 0xea, 0x84, 0x8c, 0x4d, 0x50, 0x5d, 0x31, 0xc2, 0x25,
+	0x1b, 0x52, 0x12, 0x24, 0xd9, 0xae, 0xcd, 0xe5, 0x90, 0x89, 0x85, 0xd4, 0x1b, 0xa2, 0xa4, 0xdf,
+	0x10, 0xb3, 0x07, 0xda, 0xc2, 0xb1, 0x3c, 0x60, 0xfa, 0xf5, 0x40, 0x6f, 0xf5, 0x7a, 0xec, 0x11,
+	0xa8, 0xcc, 0x27, 0x34, 0xae, 0x42, 0xa9, 0xd7, 0xf9, 0xb2, 0x73, 0xd2, 0xef, 0x68, 0x39, 0x5c,
+	0x81, 0xe2, 0xd7, 0xbd, 0x16, 0xf9, 0x56, 0x43, 0xb8, 0x0c, 0x05, 0xd2, 0x7b, 0xde, 0xd2, 0xf2,
+	0x91, 0x45, 0xb7, 0xfd, 0xa4, 0x75, 0xd4, 0x24, 0x9a, 0x12, 0x59, 0x74, 0x4f, 0x4f, 0x48, 0x4b,
+	0x2b, 0x44, 0x7a, 0xd2, 0x3a, 0x6a, 0xb5, 0x5f, 0xb4, 0xb4, 0xe2, 0xde, 0x3e, 0x6c, 0xbd, 0xe1,
+	0x0a, 0x22, 0x4f, 0xfd, 0x26, 0x91, 0xee, 0x9b, 0x87, 0x27, 0xe4, 0x54, 0x43, 0x7b, 0x87, 0x50,
+	0x88, 0xe6, 0x19, 0x2e, 0x81, 0x42, 0x9a, 0xfd, 0x18, 0x3b, 0x3a, 0xe9, 0x75, 0x4e, 0x35, 0x14,
+	0xe9, 0xba, 0xbd, 0x63, 0x2d, 0x1f, 0x2d, 0x8e, 0xdb, 0x1d, 0x4d, 0x11, 0x8b, 0xe6, 0x37, 0x71,
+	0x4c, 0x61, 0xd5, 0x22, 0x5a, 0xb1, 0xf1, 0x73, 0x1e, 0x8a, 0x22, 0x11, 0xfc, 0x01, 0x14, 0xa2,
+	0xf7, 0x0f, 0xaf, 0x25, 0xe5, 0x90, 0x7a, 0x1d, 0x8d, 0xf5, 0xac, 0x52, 0xf2, 0xf8, 0x29, 0xa8,
+	0xf1, 0xb8, 0xc0, 0x1b, 0xd9, 0xf1, 0x91, 0x6c, 0xdb, 0xbc, 0xa9, 0x8e, 0x37, 0xbe, 0x8f, 0xf0,
+	0x11, 0xc0, 0xa2, 0x91, 0xf0, 0x76, 0xa6, 0xf9, 0xd2, 0x23, 0xc4, 0x30, 0xee, 0x82, 0x64, 0xfc,
+	0xa7, 0x50, 0x4d, 0xd5, 0x1f, 0xce, 0x9a, 0x66, 0x3a, 0xcb, 0x78, 0x7c, 0x27, 0x16, 0xfb, 0x69,
+	0x74, 0x60, 0x59, 0x7c, 0x69, 0xa2, 0x96, 0x89, 0xc9, 0xf8, 0x1c, 0xaa, 0x84, 0xba, 0x3e, 0xa7,
+	0x42, 0x8f, 0xe7, 0xe9, 0xa7, 0x7f, 0x3e, 0xc6, 0xc6, 0x0d, 0xad, 0xfc, 0x21, 0xe5, 0x1a, 0x6d,
+	0x28, 0x27, 0x85, 0x83, 0xbf, 0x48, 0xad, 0xb7, 0x92, 0x0d, 0x37, 0x4a, 0xdd, 0xd0, 0x6f, 0x03,
+	0xb1, 0xb3, 0xc3, 0x77, 0x2e, 0xff, 0xa9, 0xe5, 0x2e, 0xaf, 0x6a, 0xe8, 0xf5, 0x55, 0x0d, 0xfd,
+	0x7d, 0x55, 0x43, 0xbf, 0x5c, 0xd7, 0x72, 0xaf, 0xaf, 0x6b, 0xb9, 0x3f, 0xae, 0x6b, 0xb9, 0xef,
+	0x4a, 0x62, 0xf6, 0x07, 0xc3, 0xa1, 0x2a, 0x7e, 0x6b, 0x1f, 0xfe, 0x37, 0x00, 0xd2, 0x90, 0x71,
+	0x39, 0xf9, 0x09, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -1008,6 +1102,78 @@ var _WriteableStore_serviceDesc = grpc.ServiceDesc{
 	Metadata: "rpc.proto",
 }
 
+// MetadataClient is the client API for Metadata service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type MetadataClient interface {
+	Metadata(ctx context.Context, in *MetadataRequest, opts ...grpc.CallOption) (*MetadataResponse, error)
+}
+
+type metadataClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewMetadataClient(cc *grpc.ClientConn) MetadataClient {
+	return &metadataClient{cc}
+}
+
+func (c *metadataClient) Metadata(ctx context.Context, in *MetadataRequest, opts ...grpc.CallOption) (*MetadataResponse, error) {
+	out := new(MetadataResponse)
+	err := c.cc.Invoke(ctx, "/thanos.Metadata/Metadata", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// MetadataServer is the server API for Metadata service.
+type MetadataServer interface {
+	Metadata(context.Context, *MetadataRequest) (*MetadataResponse, error)
+}
+
+// UnimplementedMetadataServer can be embedded to have forward compatible implementations.
+type UnimplementedMetadataServer struct {
+}
+
+func (*UnimplementedMetadataServer) Metadata(ctx context.Context, req *MetadataRequest) (*MetadataResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Metadata not implemented")
+}
+
+func RegisterMetadataServer(s *grpc.Server, srv MetadataServer) {
+	s.RegisterService(&_Metadata_serviceDesc, srv)
+}
+
+func _Metadata_Metadata_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MetadataRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetadataServer).Metadata(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/thanos.Metadata/Metadata",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetadataServer).Metadata(ctx, req.(*MetadataRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Metadata_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "thanos.Metadata",
+	HandlerType: (*MetadataServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Metadata",
+			Handler:    _Metadata_Metadata_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "rpc.proto",
+}
+
 func (m *WriteResponse) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
@@ -1051,6 +1217,20 @@ func (m *WriteRequest) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.Metadata) > 0 {
+		for iNdEx := len(m.Metadata) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.Metadata[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintRpc(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x22
+		}
+	}
 	if m.Replica != 0 {
 		i = encodeVarintRpc(dAtA, i, uint64(m.Replica))
 		i--
@@ -1226,6 +1406,16 @@ func (m *SeriesRequest) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.FreshStoresOnly {
+		i--
+		if m.FreshStoresOnly {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x48
+	}
 	if m.SkipChunks {
 		i--
 		if m.SkipChunks {
@@ -1388,6 +1578,20 @@ func (m *LabelNamesRequest) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.Matchers) > 0 {
+		for iNdEx := len(m.Matchers) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.Matchers[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintRpc(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x1a
+		}
+	}
 	if m.PartialResponseStrategy != 0 {
 		i = encodeVarintRpc(dAtA, i, uint64(m.PartialResponseStrategy))
 		i--
@@ -1533,6 +1737,85 @@ func (m *LabelValuesResponse) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *MetadataRequest) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *MetadataRequest) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *MetadataRequest) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if len(m.Tenant) > 0 {
+		i -= len(m.Tenant)
+		copy(dAtA[i:], m.Tenant)
+		i = encodeVarintRpc(dAtA, i, uint64(len(m.Tenant)))
+		i--
+		dAtA[i] = 0x1a
+	}
+	if m.Limit != 0 {
+		i = encodeVarintRpc(dAtA, i, uint64(m.Limit))
+		i--
+		dAtA[i] = 0x10
+	}
+	if len(m.Metric) > 0 {
+		i -= len(m.Metric)
+		copy(dAtA[i:], m.Metric)
+		i = encodeVarintRpc(dAtA, i, uint64(len(m.Metric)))
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
+}
+
+func (m *MetadataResponse) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *MetadataResponse) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *MetadataResponse) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if len(m.Metadata) > 0 {
+		for iNdEx := len(m.Metadata) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.Metadata[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintRpc(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0xa
+		}
+	}
+	return len(dAtA) - i, nil
+}
+
 func encodeVarintRpc(dAtA []byte, offset int, v uint64) int {
 	offset -= sovRpc(v)
 	base := offset
@@ -1572,6 +1855,12 @@ func (m *WriteRequest) Size() (n int) {
 	if m.Replica != 0 {
 		n += 1 + sovRpc(uint64(m.Replica))
 	}
+	if len(m.Metadata) > 0 {
+		for _, e := range m.Metadata {
+			l = e.Size()
+			n += 1 + l + sovRpc(uint64(l))
+		}
+	}
 	return n
 }
 
@@ -1666,6 +1955,9 @@ func (m *SeriesRequest) Size() (n int) {
 	if m.SkipChunks {
 		n += 2
 	}
+	if m.FreshStoresOnly {
+		n += 2
+	}
 	return n
 }
 
@@ -1715,6 +2007,12 @@ func (m *LabelNamesRequest) Size() (n int) {
 	if m.PartialResponseStrategy != 0 {
 		n += 1 + sovRpc(uint64(m.PartialResponseStrategy))
 	}
+	if len(m.Matchers) > 0 {
+		for _, e := range m.Matchers {
+			l = e.Size()
+			n += 1 + l + sovRpc(uint64(l))
+		}
+	}
 	return n
 }
 
@@ -1779,6 +2077,41 @@ func (m *LabelValuesResponse) Size() (n int) {
 	return n
 }
 
+func (m *MetadataRequest) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	l = len(m.Metric)
+	if l > 0 {
+		n += 1 + l + sovRpc(uint64(l))
+	}
+	if m.Limit != 0 {
+		n += 1 + sovRpc(uint64(m.Limit))
+	}
+	l = len(m.Tenant)
+	if l > 0 {
+		n += 1 + l + sovRpc(uint64(l))
+	}
+	return n
+}
+
+func (m *MetadataResponse) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if len(m.Metadata) > 0 {
+		for _, e := range m.Metadata {
+			l = e.Size()
+			n += 1 + l + sovRpc(uint64(l))
+		}
+	}
+	return n
+}
+
 func sovRpc(x uint64) (n int) {
 	return (math_bits.Len64(x|1) + 6) / 7
 }
@@ -1952,6 +2285,40 @@ func (m *WriteRequest) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Metadata", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthRpc
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Metadata = append(m.Metadata, prompb.MetricMetadata{})
+			if err := m.Metadata[len(m.Metadata)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRpc(dAtA[iNdEx:])
@@ -2542,6 +2909,26 @@ func (m *SeriesRequest) Unmarshal(dAtA []byte) error {
 				}
 			}
 			m.SkipChunks = bool(v != 0)
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field FreshStoresOnly", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.FreshStoresOnly = bool(v != 0)
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRpc(dAtA[iNdEx:])
@@ -2754,6 +3141,40 @@ func (m *LabelNamesRequest) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Matchers", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthRpc
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Matchers = append(m.Matchers, LabelMatcher{})
+			if err := m.Matchers[len(m.Matchers)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRpc(dAtA[iNdEx:])
@@ -3136,6 +3557,229 @@ func (m *LabelValuesResponse) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
+func (m *MetadataRequest) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowRpc
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: MetadataRequest: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: MetadataRequest: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Metric", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthRpc
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Metric = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Limit", wireType)
+			}
+			m.Limit = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Limit |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Tenant", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthRpc
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Tenant = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipRpc(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if (iNdEx + skippy) < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *MetadataResponse) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowRpc
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: MetadataResponse: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: MetadataResponse: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Metadata", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthRpc
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Metadata = append(m.Metadata, prompb.MetricMetadata{})
+			if err := m.Metadata[len(m.Metadata)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipRpc(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if (iNdEx + skippy) < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func skipRpc(dAtA []byte) (n int, err error) {
 	l := len(dAtA)
 	iNdEx := 0
@@ -200,6 +200,8 @@ type AggrChunk struct {
 	Min     *Chunk `protobuf:"bytes,6,opt,name=min,proto3" json:"min,omitempty"`
 	Max     *Chunk `protobuf:"bytes,7,opt,name=max,proto3" json:"max,omitempty"`
 	Counter *Chunk `protobuf:"bytes,8,opt,name=counter,proto3" json:"counter,omitempty"`
+	// resolution is the resolution in milliseconds of the downsampled data the chunk was read from, 0 for raw data.
+	Resolution int64 `protobuf:"varint,9,opt,name=resolution,proto3" json:"resolution,omitempty"`
 }
 
 func (m *AggrChunk) Reset()         { *m = AggrChunk{} }
@@ -288,35 +290,36 @@ func init() {
 func init() { proto.RegisterFile("types.proto", fileDescriptor_d938547f84707355) }
 
 var fileDescriptor_d938547f84707355 = []byte{
-	// 445 bytes of a gzipped FileDescriptorProto
+	// 459 bytes of a gzipped FileDescriptorProto
 	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x92, 0xcd, 0x6e, 0xd3, 0x40,
-	0x10, 0xc7, 0xbd, 0xfe, 0x4c, 0xa7, 0x05, 0x99, 0xa5, 0x42, 0x5b, 0x0e, 0x6e, 0x64, 0x84, 0x88,
-	0x40, 0xb8, 0xa2, 0x3c, 0x01, 0x45, 0xbe, 0xf1, 0xa1, 0x2e, 0x3d, 0x20, 0x84, 0x84, 0x36, 0xe9,
-	0xe2, 0x58, 0xc4, 0xeb, 0xc8, 0x5e, 0x43, 0xfa, 0x16, 0x20, 0x5e, 0x2a, 0xc7, 0x1e, 0x39, 0x21,
-	0x48, 0x5e, 0x04, 0xed, 0xd8, 0xa6, 0xad, 0xe4, 0xdb, 0xec, 0xfc, 0x7f, 0xf3, 0xa1, 0x9d, 0x3f,
-	0xec, 0xea, 0x8b, 0xa5, 0xac, 0x93, 0x65, 0x55, 0xea, 0x92, 0xfa, 0x7a, 0x2e, 0x54, 0x59, 0xdf,
-	0xdf, 0xcf, 0xca, 0xac, 0xc4, 0xd4, 0x91, 0x89, 0x5a, 0x35, 0x7e, 0x06, 0xde, 0x2b, 0x31, 0x95,
-	0x0b, 0x4a, 0xc1, 0x55, 0xa2, 0x90, 0x8c, 0x8c, 0xc9, 0x64, 0x87, 0x63, 0x4c, 0xf7, 0xc1, 0xfb,
-	0x2a, 0x16, 0x8d, 0x64, 0x36, 0x26, 0xdb, 0x47, 0xfc, 0x11, 0xbc, 0x97, 0xf3, 0x46, 0x7d, 0xa1,
-	0x8f, 0xc1, 0x35, 0x83, 0xb0, 0xe4, 0xf6, 0xf1, 0xbd, 0xa4, 0x1d, 0x94, 0xa0, 0x98, 0xa4, 0x6a,
-	0x56, 0x9e, 0xe7, 0x2a, 0xe3, 0xc8, 0x98, 0xf6, 0xe7, 0x42, 0x0b, 0xec, 0xb4, 0xc7, 0x31, 0x8e,
-	0xef, 0xc2, 0xa8, 0xa7, 0x68, 0x00, 0xce, 0xfb, 0xb7, 0x3c, 0xb4, 0xe2, 0xcf, 0xe0, 0xbf, 0x93,
-	0x55, 0x2e, 0x6b, 0xfa, 0x04, 0xfc, 0x85, 0x59, 0xad, 0x66, 0x64, 0xec, 0x4c, 0x76, 0x8f, 0x6f,
-	0xf5, 0x03, 0x70, 0xe1, 0x13, 0x77, 0xfd, 0xfb, 0xd0, 0xe2, 0x1d, 0x42, 0x8f, 0xc0, 0x9f, 0x99,
-	0xb9, 0x35, 0xb3, 0x11, 0xbe, 0xd3, 0xc3, 0x2f, 0xb2, 0xac, 0xc2, 0x8d, 0xfa, 0x82, 0x16, 0x8b,
-	0x7f, 0xda, 0xb0, 0xf3, 0x5f, 0xa3, 0x07, 0x30, 0x2a, 0x72, 0xf5, 0x49, 0xe7, 0xdd, 0x0f, 0x38,
-	0x3c, 0x28, 0x72, 0x75, 0x96, 0x17, 0x12, 0x25, 0xb1, 0x6a, 0x25, 0xbb, 0x93, 0xc4, 0x0a, 0xa5,
-	0x43, 0x70, 0x2a, 0xf1, 0x8d, 0x39, 0x63, 0x72, 0x7d, 0x3d, 0xec, 0xc8, 0x8d, 0x42, 0x1f, 0x80,
-	0x37, 0x2b, 0x1b, 0xa5, 0x99, 0x3b, 0x84, 0xb4, 0x9a, 0xe9, 0x52, 0x37, 0x05, 0xf3, 0x06, 0xbb,
-	0xd4, 0x4d, 0x61, 0x80, 0x22, 0x57, 0xcc, 0x1f, 0x04, 0x8a, 0x5c, 0x21, 0x20, 0x56, 0x2c, 0x18,
-	0x06, 0xc4, 0x8a, 0x3e, 0x82, 0x00, 0x67, 0xc9, 0x8a, 0x8d, 0x86, 0xa0, 0x5e, 0x8d, 0x7f, 0x10,
-	0xd8, 0xc3, 0xef, 0x7d, 0x2d, 0xf4, 0x6c, 0x2e, 0x2b, 0xfa, 0xf4, 0xc6, 0x8d, 0x0f, 0x6e, 0x9c,
-	0xa0, 0x63, 0x92, 0xb3, 0x8b, 0xa5, 0xbc, 0x3a, 0x33, 0xba, 0xc8, 0x1e, 0x72, 0x91, 0x73, 0xdd,
-	0x45, 0x13, 0x70, 0x4d, 0x1d, 0xf5, 0xc1, 0x4e, 0x4f, 0x43, 0xcb, 0x18, 0xe0, 0x4d, 0x7a, 0x1a,
-	0x12, 0x93, 0xe0, 0x69, 0x68, 0x63, 0x82, 0xa7, 0xa1, 0x73, 0xf2, 0x70, 0xfd, 0x37, 0xb2, 0xd6,
-	0x9b, 0x88, 0x5c, 0x6e, 0x22, 0xf2, 0x67, 0x13, 0x91, 0xef, 0xdb, 0xc8, 0xba, 0xdc, 0x46, 0xd6,
-	0xaf, 0x6d, 0x64, 0x7d, 0x08, 0x6a, 0x5d, 0x56, 0x72, 0x39, 0x9d, 0xfa, 0x68, 0xe8, 0xe7, 0xff,
-	0x02, 0x00, 0x00, 0xff, 0xff, 0x61, 0x46, 0x03, 0x25, 0xfd, 0x02, 0x00, 0x00,
+	0x10, 0xc7, 0xfd, 0x11, 0xdb, 0xc9, 0xb4, 0x20, 0xb3, 0x54, 0x68, 0xcb, 0xc1, 0x8d, 0x8c, 0x10,
+	0x11, 0x08, 0x57, 0x94, 0x27, 0xa0, 0xc8, 0x37, 0x3e, 0x54, 0xd3, 0x03, 0x42, 0x48, 0x68, 0x93,
+	0x2e, 0x8e, 0x45, 0xbc, 0x1b, 0x79, 0xd7, 0x90, 0xbe, 0x05, 0x3c, 0x0b, 0x2f, 0x91, 0x63, 0x8f,
+	0x9c, 0x10, 0x24, 0x2f, 0x82, 0x76, 0x6c, 0x43, 0x2a, 0x7c, 0x1b, 0xcf, 0xff, 0x37, 0x1f, 0x9e,
+	0xfd, 0xc3, 0x9e, 0xbe, 0x5c, 0x72, 0x95, 0x2c, 0x2b, 0xa9, 0x25, 0xf1, 0xf5, 0x9c, 0x09, 0xa9,
+	0xee, 0x1e, 0xe4, 0x32, 0x97, 0x98, 0x3a, 0x36, 0x51, 0xa3, 0xc6, 0x4f, 0xc0, 0x7b, 0xc1, 0xa6,
+	0x7c, 0x41, 0x08, 0x0c, 0x04, 0x2b, 0x39, 0xb5, 0xc7, 0xf6, 0x64, 0x94, 0x61, 0x4c, 0x0e, 0xc0,
+	0xfb, 0xcc, 0x16, 0x35, 0xa7, 0x0e, 0x26, 0x9b, 0x8f, 0xf8, 0x3d, 0x78, 0xcf, 0xe7, 0xb5, 0xf8,
+	0x44, 0x1e, 0xc2, 0xc0, 0x0c, 0xc2, 0x92, 0x9b, 0x27, 0x77, 0x92, 0x66, 0x50, 0x82, 0x62, 0x92,
+	0x8a, 0x99, 0xbc, 0x28, 0x44, 0x9e, 0x21, 0x63, 0xda, 0x5f, 0x30, 0xcd, 0xb0, 0xd3, 0x7e, 0x86,
+	0x71, 0x7c, 0x1b, 0x86, 0x1d, 0x45, 0x02, 0x70, 0xdf, 0xbe, 0xce, 0x42, 0x2b, 0xfe, 0x08, 0xfe,
+	0x1b, 0x5e, 0x15, 0x5c, 0x91, 0x47, 0xe0, 0x2f, 0xcc, 0x6a, 0x8a, 0xda, 0x63, 0x77, 0xb2, 0x77,
+	0x72, 0xa3, 0x1b, 0x80, 0x0b, 0x9f, 0x0e, 0xd6, 0x3f, 0x8f, 0xac, 0xac, 0x45, 0xc8, 0x31, 0xf8,
+	0x33, 0x33, 0x57, 0x51, 0x07, 0xe1, 0x5b, 0x1d, 0xfc, 0x2c, 0xcf, 0x2b, 0xdc, 0xa8, 0x2b, 0x68,
+	0xb0, 0xf8, 0xbb, 0x03, 0xa3, 0xbf, 0x1a, 0x39, 0x84, 0x61, 0x59, 0x88, 0x0f, 0xba, 0x68, 0x2f,
+	0xe0, 0x66, 0x41, 0x59, 0x88, 0xf3, 0xa2, 0xe4, 0x28, 0xb1, 0x55, 0x23, 0x39, 0xad, 0xc4, 0x56,
+	0x28, 0x1d, 0x81, 0x5b, 0xb1, 0x2f, 0xd4, 0x1d, 0xdb, 0xbb, 0xeb, 0x61, 0xc7, 0xcc, 0x28, 0xe4,
+	0x1e, 0x78, 0x33, 0x59, 0x0b, 0x4d, 0x07, 0x7d, 0x48, 0xa3, 0x99, 0x2e, 0xaa, 0x2e, 0xa9, 0xd7,
+	0xdb, 0x45, 0xd5, 0xa5, 0x01, 0xca, 0x42, 0x50, 0xbf, 0x17, 0x28, 0x0b, 0x81, 0x00, 0x5b, 0xd1,
+	0xa0, 0x1f, 0x60, 0x2b, 0xf2, 0x00, 0x02, 0x9c, 0xc5, 0x2b, 0x3a, 0xec, 0x83, 0x3a, 0x95, 0x44,
+	0x00, 0x15, 0x57, 0x72, 0x51, 0xeb, 0x42, 0x0a, 0x3a, 0xc2, 0xdf, 0xdd, 0xc9, 0xc4, 0xdf, 0x6c,
+	0xd8, 0xc7, 0xf3, 0xbf, 0x64, 0x7a, 0x36, 0xe7, 0x15, 0x79, 0x7c, 0xcd, 0x03, 0x87, 0xd7, 0x9e,
+	0xa8, 0x65, 0x92, 0xf3, 0xcb, 0x25, 0xff, 0x67, 0x03, 0xc1, 0xda, 0x43, 0xfe, 0xe7, 0x32, 0x77,
+	0xd7, 0x65, 0x13, 0x18, 0x98, 0x3a, 0xe2, 0x83, 0x93, 0x9e, 0x85, 0x96, 0x31, 0xc8, 0xab, 0xf4,
+	0x2c, 0xb4, 0x4d, 0x22, 0x4b, 0x43, 0x07, 0x13, 0x59, 0x1a, 0xba, 0xa7, 0xf7, 0xd7, 0xbf, 0x23,
+	0x6b, 0xbd, 0x89, 0xec, 0xab, 0x4d, 0x64, 0xff, 0xda, 0x44, 0xf6, 0xd7, 0x6d, 0x64, 0x5d, 0x6d,
+	0x23, 0xeb, 0xc7, 0x36, 0xb2, 0xde, 0x05, 0x4a, 0xcb, 0x8a, 0x2f, 0xa7, 0x53, 0x1f, 0x0d, 0xff,
+	0xf4, 0xcf, 0x00, 0x69, 0x35, 0x74, 0x98, 0x1d, 0x03, 0x00, 0x00,
 }
 
 func (m *Label) Marshal() (dAtA []byte, err error) {
@@ -462,6 +465,11 @@ func (m *AggrChunk) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.Resolution != 0 {
+		i = encodeVarintTypes(dAtA, i, uint64(m.Resolution))
+		i--
+		dAtA[i] = 0x48
+	}
 	if m.Counter != nil {
 		{
 			size, err := m.Counter.MarshalToSizedBuffer(dAtA[:i])
@@ -690,6 +698,9 @@ func (m *AggrChunk) Size() (n int) {
 		l = m.Counter.Size()
 		n += 1 + l + sovTypes(uint64(l))
 	}
+	if m.Resolution != 0 {
+		n += 1 + sovTypes(uint64(m.Resolution))
+	}
 	return n
 }
 
@@ -1346,6 +1357,25 @@ func (m *AggrChunk) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Resolution", wireType)
+			}
+			m.Resolution = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTypes
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Resolution |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipTypes(dAtA[iNdEx:])
@@ -32,6 +32,30 @@ func MergeUnsortedSlices(a ...[]string) []string {
 	return MergeSlices(a...)
 }
 
+// MergeUnorderedSlices merges a set of string slices into a single one while removing all duplicates, without
+// sorting them. Strings are returned in the order they are first seen.
+func MergeUnorderedSlices(a ...[]string) []string {
+	if len(a) == 1 {
+		return a[0]
+	}
+	n := 0
+	for _, s := range a {
+		n += len(s)
+	}
+	seen := make(map[string]struct{}, n)
+	res := make([]string, 0, n)
+	for _, s := range a {
+		for _, v := range s {
+			if _, ok := seen[v]; ok {
+				continue
+			}
+			seen[v] = struct{}{}
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
 func mergeTwoStringSlices(a, b []string) []string {
 	maxl := len(a)
 	if len(b) > len(a) {
@@ -0,0 +1,160 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package verifier
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const MetaStatsIssueID = "meta_stats"
+
+// metaStatsBackupDir is the directory of the backup bucket the original meta.json files of repaired blocks are uploaded to.
+const metaStatsBackupDir = "meta-stats-backup"
+
+// MetaStatsIssue verifies that the series, chunk and sample counts in the meta.json of blocks match their index and chunk files.
+// It repairs affected blocks by rewriting their meta.json with the recomputed stats. The original meta.json is uploaded
+// to the backup bucket first. Index and chunk files are never modified.
+func MetaStatsIssue(ctx context.Context, logger log.Logger, bkt objstore.Bucket, backupBkt objstore.Bucket, repair bool, idMatcher func(ulid.ULID) bool, fetcher block.MetadataFetcher, _ time.Duration, _ *verifierMetrics) error {
+	level.Info(logger).Log("msg", "started verifying issue", "with-repair", repair, "issue", MetaStatsIssueID)
+
+	metas, _, err := fetcher.Fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	for id := range metas {
+		if idMatcher != nil && !idMatcher(id) {
+			continue
+		}
+		if err := verifyMetaStats(ctx, logger, bkt, backupBkt, repair, id); err != nil {
+			return errors.Wrapf(err, "verify meta stats of block %s", id)
+		}
+	}
+
+	level.Info(logger).Log("msg", "verified issue", "with-repair", repair, "issue", MetaStatsIssueID)
+	return nil
+}
+
+func verifyMetaStats(ctx context.Context, logger log.Logger, bkt objstore.Bucket, backupBkt objstore.Bucket, repair bool, id ulid.ULID) error {
+	tmpdir, err := ioutil.TempDir("", fmt.Sprintf("meta-stats-block-%s-", id))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpdir); err != nil {
+			level.Warn(logger).Log("msg", "failed to delete dir", "tmpdir", tmpdir, "err", err)
+		}
+	}()
+
+	bdir := filepath.Join(tmpdir, id.String())
+	if err := block.Download(ctx, logger, bkt, id, bdir); err != nil {
+		return errors.Wrap(err, "download block")
+	}
+	// Use the meta.json as stored in the bucket, the fetched one might be modified by filters.
+	meta, err := metadata.Read(bdir)
+	if err != nil {
+		return errors.Wrap(err, "read meta")
+	}
+
+	stats, err := gatherBlockStats(bdir)
+	if err != nil {
+		return errors.Wrap(err, "gather block stats")
+	}
+	// Tombstones are not part of Thanos blocks, keep whatever the meta.json says.
+	stats.NumTombstones = meta.Stats.NumTombstones
+	if stats == meta.Stats {
+		return nil
+	}
+
+	level.Warn(logger).Log("msg", "detected issue", "id", id, "issue", MetaStatsIssueID,
+		"metaSeries", meta.Stats.NumSeries, "series", stats.NumSeries,
+		"metaChunks", meta.Stats.NumChunks, "chunks", stats.NumChunks,
+		"metaSamples", meta.Stats.NumSamples, "samples", stats.NumSamples,
+	)
+
+	if !repair {
+		// Only verify.
+		return nil
+	}
+
+	backup := path.Join(metaStatsBackupDir, id.String(), fmt.Sprintf("%s.%d", block.MetaFilename, time.Now().Unix()))
+	level.Info(logger).Log("msg", "backing up meta.json", "id", id, "backup", backup, "issue", MetaStatsIssueID)
+	if err := objstore.UploadFile(ctx, logger, backupBkt, filepath.Join(bdir, block.MetaFilename), backup); err != nil {
+		return errors.Wrap(err, "backup meta.json")
+	}
+
+	meta.Stats = stats
+	if err := metadata.Write(logger, bdir, meta); err != nil {
+		return errors.Wrap(err, "write repaired meta.json")
+	}
+	if err := objstore.UploadFile(ctx, logger, bkt, filepath.Join(bdir, block.MetaFilename), path.Join(id.String(), block.MetaFilename)); err != nil {
+		return errors.Wrap(err, "upload repaired meta.json")
+	}
+	level.Info(logger).Log("msg", "repaired meta.json stats", "id", id, "issue", MetaStatsIssueID)
+	return nil
+}
+
+// gatherBlockStats computes the series, chunk and sample counts of the block in the given directory from its
+// index and chunk files.
+func gatherBlockStats(bdir string) (stats tsdb.BlockStats, err error) {
+	ir, err := index.NewFileReader(filepath.Join(bdir, block.IndexFilename))
+	if err != nil {
+		return stats, errors.Wrap(err, "open index file")
+	}
+	defer runutil.CloseWithErrCapture(&err, ir, "block stats index reader")
+
+	// Downsampled blocks contain aggregated chunks, the downsample pool reads both.
+	cr, err := chunks.NewDirReader(filepath.Join(bdir, block.ChunksDirname), downsample.NewPool())
+	if err != nil {
+		return stats, errors.Wrap(err, "open chunks dir")
+	}
+	defer runutil.CloseWithErrCapture(&err, cr, "block stats chunk reader")
+
+	all, err := ir.Postings(index.AllPostingsKey())
+	if err != nil {
+		return stats, errors.Wrap(err, "postings")
+	}
+	var (
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+	for all.Next() {
+		if err := ir.Series(all.At(), &lset, &chks); err != nil {
+			return stats, errors.Wrap(err, "series")
+		}
+		stats.NumSeries++
+		stats.NumChunks += uint64(len(chks))
+		for _, c := range chks {
+			chk, err := cr.Chunk(c.Ref)
+			if err != nil {
+				return stats, errors.Wrapf(err, "read chunk %d", c.Ref)
+			}
+			stats.NumSamples += uint64(chk.NumSamples())
+		}
+	}
+	if all.Err() != nil {
+		return stats, errors.Wrap(all.Err(), "iterate series")
+	}
+	return stats, nil
+}
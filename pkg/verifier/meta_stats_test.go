@@ -0,0 +1,102 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package verifier
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestMetaStatsIssue(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	dir, err := ioutil.TempDir("", "meta-stats-issue")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := inmem.NewBucket()
+	backupBkt := inmem.NewBucket()
+
+	series := []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "2"),
+		labels.FromStrings("a", "3"),
+	}
+	id, err := e2eutil.CreateBlock(ctx, dir, series, 100, 0, 1000, labels.FromStrings("ext", "1"), 0)
+	testutil.Ok(t, err)
+	meta, err := metadata.Read(filepath.Join(dir, id.String()))
+	testutil.Ok(t, err)
+	expected := meta.Stats
+
+	// Break the stats of the meta.json before uploading the block.
+	meta.Stats.NumSeries = 1
+	meta.Stats.NumChunks = 2
+	meta.Stats.NumSamples = 3
+	testutil.Ok(t, metadata.Write(logger, filepath.Join(dir, id.String()), meta))
+	testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String())))
+
+	fetcher, err := block.NewMetaFetcher(logger, 1, bkt, "", nil, nil, nil)
+	testutil.Ok(t, err)
+
+	// Verify only.
+	testutil.Ok(t, MetaStatsIssue(ctx, logger, bkt, backupBkt, false, nil, fetcher, 0, newVerifierMetrics(nil)))
+	m, err := block.DownloadMeta(ctx, logger, bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, uint64(1), m.Stats.NumSeries)
+	testutil.Equals(t, 0, len(backupBkt.Objects()))
+
+	// Blocks not matching are not repaired.
+	testutil.Ok(t, MetaStatsIssue(ctx, logger, bkt, backupBkt, true, func(ulid.ULID) bool { return false }, fetcher, 0, newVerifierMetrics(nil)))
+	testutil.Equals(t, 0, len(backupBkt.Objects()))
+
+	chunks, err := objectNames(ctx, bkt, path.Join(id.String(), block.ChunksDirname))
+	testutil.Ok(t, err)
+
+	// Repair.
+	testutil.Ok(t, MetaStatsIssue(ctx, logger, bkt, backupBkt, true, nil, fetcher, 0, newVerifierMetrics(nil)))
+	m, err = block.DownloadMeta(ctx, logger, bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, expected, m.Stats)
+	testutil.Equals(t, meta.Thanos, m.Thanos)
+
+	// The original meta.json is backed up.
+	testutil.Equals(t, 1, len(backupBkt.Objects()))
+	for name, b := range backupBkt.Objects() {
+		testutil.Assert(t, strings.HasPrefix(name, path.Join(metaStatsBackupDir, id.String())+"/"), "unexpected backup %s", name)
+		testutil.Assert(t, strings.Contains(string(b), `"numSeries": 1`), "backup should contain the original stats")
+	}
+	// Data is not touched.
+	afterChunks, err := objectNames(ctx, bkt, path.Join(id.String(), block.ChunksDirname))
+	testutil.Ok(t, err)
+	testutil.Equals(t, chunks, afterChunks)
+
+	// Repaired blocks are healthy.
+	testutil.Ok(t, MetaStatsIssue(ctx, logger, bkt, backupBkt, true, nil, fetcher, 0, newVerifierMetrics(nil)))
+	testutil.Equals(t, 1, len(backupBkt.Objects()))
+}
+
+func objectNames(ctx context.Context, bkt objstore.Bucket, dir string) ([]string, error) {
+	var names []string
+	err := bkt.Iter(ctx, dir, func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	return names, err
+}